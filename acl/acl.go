@@ -46,6 +46,12 @@ type ACL interface {
 	// that deny a write.
 	KeyWritePrefix(string) bool
 
+	// KeyReadDenyPrefix returns the shortest prefix of a key under
+	// which every key is denied read access, so that listings can skip
+	// the entire prefix. Returns false if the key can be read, or if
+	// some key under the key itself can be read.
+	KeyReadDenyPrefix(string) (string, bool)
+
 	// ServiceWrite checks for permission to read a given service
 	ServiceWrite(string) bool
 
@@ -58,6 +64,13 @@ type ACL interface {
 	// EventWrite determines if a specific event may be fired.
 	EventWrite(string) bool
 
+	// SessionRead determines if the sessions of a node can be read
+	SessionRead(string) bool
+
+	// SessionWrite determines if sessions can be created on a node,
+	// and its sessions destroyed or renewed
+	SessionWrite(string) bool
+
 	// KeyringRead determines if the encryption keyring used in
 	// the gossip layer can be read.
 	KeyringRead() bool
@@ -65,6 +78,14 @@ type ACL interface {
 	// KeyringWrite determines if the keyring can be manipulated
 	KeyringWrite() bool
 
+	// OperatorRead determines if the internal state of the servers,
+	// such as the Raft configuration, can be read
+	OperatorRead() bool
+
+	// OperatorWrite determines if the servers can be managed, such as
+	// removing a peer from the Raft configuration
+	OperatorWrite() bool
+
 	// ACLList checks for permission to list all the ACLs
 	ACLList() bool
 
@@ -92,6 +113,10 @@ func (s *StaticACL) KeyWritePrefix(string) bool {
 	return s.defaultAllow
 }
 
+func (s *StaticACL) KeyReadDenyPrefix(string) (string, bool) {
+	return "", !s.defaultAllow
+}
+
 func (s *StaticACL) ServiceRead(string) bool {
 	return s.defaultAllow
 }
@@ -108,6 +133,14 @@ func (s *StaticACL) EventWrite(string) bool {
 	return s.defaultAllow
 }
 
+func (s *StaticACL) SessionRead(string) bool {
+	return s.defaultAllow
+}
+
+func (s *StaticACL) SessionWrite(string) bool {
+	return s.defaultAllow
+}
+
 func (s *StaticACL) KeyringRead() bool {
 	return s.defaultAllow
 }
@@ -116,6 +149,14 @@ func (s *StaticACL) KeyringWrite() bool {
 	return s.defaultAllow
 }
 
+func (s *StaticACL) OperatorRead() bool {
+	return s.defaultAllow
+}
+
+func (s *StaticACL) OperatorWrite() bool {
+	return s.defaultAllow
+}
+
 func (s *StaticACL) ACLList() bool {
 	return s.allowManage
 }
@@ -169,10 +210,17 @@ type PolicyACL struct {
 	// eventRules contains the user event policies
 	eventRules *radix.Tree
 
+	// sessionRules contains the session policies, by node prefix
+	sessionRules *radix.Tree
+
 	// keyringRules contains the keyring policies. The keyring has
 	// a very simple yes/no without prefix matching, so here we
 	// don't need to use a radix tree.
 	keyringRule string
+
+	// operatorRule contains the operator policy, which is also a
+	// simple yes/no without prefix matching
+	operatorRule string
 }
 
 // New is used to construct a policy based ACL from a set of policies
@@ -183,6 +231,7 @@ func New(parent ACL, policy *Policy) (*PolicyACL, error) {
 		keyRules:     radix.New(),
 		serviceRules: radix.New(),
 		eventRules:   radix.New(),
+		sessionRules: radix.New(),
 	}
 
 	// Load the key policy
@@ -200,9 +249,17 @@ func New(parent ACL, policy *Policy) (*PolicyACL, error) {
 		p.eventRules.Insert(ep.Event, ep.Policy)
 	}
 
+	// Load the session policy
+	for _, sp := range policy.Sessions {
+		p.sessionRules.Insert(sp.Node, sp.Policy)
+	}
+
 	// Load the keyring policy
 	p.keyringRule = policy.Keyring
 
+	// Load the operator policy
+	p.operatorRule = policy.Operator
+
 	return p, nil
 }
 
@@ -275,6 +332,44 @@ func (p *PolicyACL) KeyWritePrefix(prefix string) bool {
 	return p.parent.KeyWritePrefix(prefix)
 }
 
+// KeyReadDenyPrefix returns the shortest prefix of a denied key under
+// which no rule allows a read
+func (p *PolicyACL) KeyReadDenyPrefix(key string) (string, bool) {
+	if p.KeyRead(key) {
+		return "", false
+	}
+
+	// The key is denied by the longest matching rule, or by the
+	// parent if there is none
+	base, _, ok := p.keyRules.LongestPrefix(key)
+	if !ok {
+		if base, ok = p.parent.KeyReadDenyPrefix(key); !ok {
+			return "", false
+		}
+	}
+
+	// Lengthen the prefix until it excludes every rule beneath it
+	// that allows a read
+	n := len(base)
+	p.keyRules.WalkPrefix(base, func(path string, rule interface{}) bool {
+		if rule.(string) == KeyPolicyDeny {
+			return false
+		}
+		common := 0
+		for common < len(path) && common < len(key) && path[common] == key[common] {
+			common++
+		}
+		if common+1 > n {
+			n = common + 1
+		}
+		return false
+	})
+	if n > len(key) {
+		return "", false
+	}
+	return key[:n], true
+}
+
 // ServiceRead checks if reading (discovery) of a service is allowed
 func (p *PolicyACL) ServiceRead(name string) bool {
 	// Check for an exact rule or catch-all
@@ -344,6 +439,37 @@ func (p *PolicyACL) EventWrite(name string) bool {
 	return p.parent.EventWrite(name)
 }
 
+// SessionRead is used to determine if the sessions of a node can be
+// read by the policy
+func (p *PolicyACL) SessionRead(node string) bool {
+	// Longest-prefix match on node names
+	if _, rule, ok := p.sessionRules.LongestPrefix(node); ok {
+		switch rule {
+		case SessionPolicyRead:
+			return true
+		case SessionPolicyWrite:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Nothing matched, use parent
+	return p.parent.SessionRead(node)
+}
+
+// SessionWrite is used to determine if the policy allows for sessions
+// of a node to be created, destroyed or renewed
+func (p *PolicyACL) SessionWrite(node string) bool {
+	// Longest-prefix match on node names
+	if _, rule, ok := p.sessionRules.LongestPrefix(node); ok {
+		return rule == SessionPolicyWrite
+	}
+
+	// No match, use parent
+	return p.parent.SessionWrite(node)
+}
+
 // KeyringRead is used to determine if the keyring can be
 // read by the current ACL token.
 func (p *PolicyACL) KeyringRead() bool {
@@ -365,6 +491,27 @@ func (p *PolicyACL) KeyringWrite() bool {
 	return p.parent.KeyringWrite()
 }
 
+// OperatorRead is used to determine if the internal state of the
+// servers can be read by the current ACL token.
+func (p *PolicyACL) OperatorRead() bool {
+	switch p.operatorRule {
+	case OperatorPolicyRead, OperatorPolicyWrite:
+		return true
+	case OperatorPolicyDeny:
+		return false
+	default:
+		return p.parent.OperatorRead()
+	}
+}
+
+// OperatorWrite determines if the servers can be managed.
+func (p *PolicyACL) OperatorWrite() bool {
+	if p.operatorRule == OperatorPolicyWrite {
+		return true
+	}
+	return p.parent.OperatorWrite()
+}
+
 // ACLList checks if listing of ACLs is allowed
 func (p *PolicyACL) ACLList() bool {
 	return p.parent.ACLList()
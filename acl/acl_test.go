@@ -59,6 +59,18 @@ func TestStaticACL(t *testing.T) {
 	if !all.KeyringWrite() {
 		t.Fatalf("should allow")
 	}
+	if !all.OperatorRead() {
+		t.Fatalf("should allow")
+	}
+	if !all.OperatorWrite() {
+		t.Fatalf("should allow")
+	}
+	if !all.SessionRead("foobar") {
+		t.Fatalf("should allow")
+	}
+	if !all.SessionWrite("foobar") {
+		t.Fatalf("should allow")
+	}
 	if all.ACLList() {
 		t.Fatalf("should not allow")
 	}
@@ -96,6 +108,18 @@ func TestStaticACL(t *testing.T) {
 	if none.KeyringWrite() {
 		t.Fatalf("should not allow")
 	}
+	if none.OperatorRead() {
+		t.Fatalf("should not allow")
+	}
+	if none.OperatorWrite() {
+		t.Fatalf("should not allow")
+	}
+	if none.SessionRead("foobar") {
+		t.Fatalf("should not allow")
+	}
+	if none.SessionWrite("foobar") {
+		t.Fatalf("should not allow")
+	}
 	if none.ACLList() {
 		t.Fatalf("should not allow")
 	}
@@ -127,6 +151,18 @@ func TestStaticACL(t *testing.T) {
 	if !manage.KeyringWrite() {
 		t.Fatalf("should allow")
 	}
+	if !manage.OperatorRead() {
+		t.Fatalf("should allow")
+	}
+	if !manage.OperatorWrite() {
+		t.Fatalf("should allow")
+	}
+	if !manage.SessionRead("foobar") {
+		t.Fatalf("should allow")
+	}
+	if !manage.SessionWrite("foobar") {
+		t.Fatalf("should allow")
+	}
 	if !manage.ACLList() {
 		t.Fatalf("should allow")
 	}
@@ -397,3 +433,135 @@ func TestPolicyACL_Keyring(t *testing.T) {
 		}
 	}
 }
+
+func TestPolicyACL_Operator(t *testing.T) {
+	// Test operator ACLs
+	type operatorcase struct {
+		inp   string
+		read  bool
+		write bool
+	}
+	operatorcases := []operatorcase{
+		{"", false, false},
+		{OperatorPolicyRead, true, false},
+		{OperatorPolicyWrite, true, true},
+		{OperatorPolicyDeny, false, false},
+	}
+	for _, c := range operatorcases {
+		acl, err := New(DenyAll(), &Policy{Operator: c.inp})
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		if acl.OperatorRead() != c.read {
+			t.Fatalf("bad: %#v", c)
+		}
+		if acl.OperatorWrite() != c.write {
+			t.Fatalf("bad: %#v", c)
+		}
+	}
+}
+
+func TestPolicyACL_Session(t *testing.T) {
+	policy, err := Parse(`
+session "" {
+	policy = "read"
+}
+session "web-" {
+	policy = "write"
+}
+session "web-db" {
+	policy = "deny"
+}
+`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	acl, err := New(DenyAll(), policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	type sessioncase struct {
+		node  string
+		read  bool
+		write bool
+	}
+	cases := []sessioncase{
+		{"foo", true, false},
+		{"web-1", true, true},
+		{"web-db1", false, false},
+	}
+	for _, c := range cases {
+		if acl.SessionRead(c.node) != c.read {
+			t.Fatalf("bad: %#v", c)
+		}
+		if acl.SessionWrite(c.node) != c.write {
+			t.Fatalf("bad: %#v", c)
+		}
+	}
+
+	// Nodes without a matching rule use the parent
+	acl, err = New(AllowAll(), &Policy{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !acl.SessionWrite("foo") {
+		t.Fatalf("should allow")
+	}
+}
+
+func TestPolicyACL_KeyReadDenyPrefix(t *testing.T) {
+	policy := &Policy{
+		Keys: []*KeyPolicy{
+			&KeyPolicy{
+				Prefix: "foo/",
+				Policy: KeyPolicyRead,
+			},
+			&KeyPolicy{
+				Prefix: "foo/priv/",
+				Policy: KeyPolicyDeny,
+			},
+			&KeyPolicy{
+				Prefix: "foo/priv/shared/",
+				Policy: KeyPolicyRead,
+			},
+			&KeyPolicy{
+				Prefix: "bar/",
+				Policy: KeyPolicyDeny,
+			},
+		},
+	}
+	acl, err := New(DenyAll(), policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	type prefixcase struct {
+		inp    string
+		prefix string
+		ok     bool
+	}
+	cases := []prefixcase{
+		{"foo/test", "", false},
+		{"foo/priv/key", "foo/priv/k", true},
+		{"foo/priv/other/key", "foo/priv/o", true},
+		{"foo/priv/sh", "", false},
+		{"foo/priv/shared/key", "", false},
+		{"bar/key", "bar/", true},
+		{"zip/key", "z", true},
+		{"fo", "", false},
+	}
+	for _, c := range cases {
+		prefix, ok := acl.KeyReadDenyPrefix(c.inp)
+		if prefix != c.prefix || ok != c.ok {
+			t.Fatalf("bad: %#v %q %v", c, prefix, ok)
+		}
+	}
+
+	if prefix, ok := DenyAll().KeyReadDenyPrefix("foo"); prefix != "" || !ok {
+		t.Fatalf("bad: %q %v", prefix, ok)
+	}
+	if _, ok := AllowAll().KeyReadDenyPrefix("foo"); ok {
+		t.Fatalf("should not deny")
+	}
+}
@@ -7,18 +7,24 @@ import (
 )
 
 const (
-	KeyPolicyDeny      = "deny"
-	KeyPolicyRead      = "read"
-	KeyPolicyWrite     = "write"
-	ServicePolicyDeny  = "deny"
-	ServicePolicyRead  = "read"
-	ServicePolicyWrite = "write"
-	EventPolicyRead    = "read"
-	EventPolicyWrite   = "write"
-	EventPolicyDeny    = "deny"
-	KeyringPolicyWrite = "write"
-	KeyringPolicyRead  = "read"
-	KeyringPolicyDeny  = "deny"
+	KeyPolicyDeny       = "deny"
+	KeyPolicyRead       = "read"
+	KeyPolicyWrite      = "write"
+	ServicePolicyDeny   = "deny"
+	ServicePolicyRead   = "read"
+	ServicePolicyWrite  = "write"
+	EventPolicyRead     = "read"
+	EventPolicyWrite    = "write"
+	EventPolicyDeny     = "deny"
+	KeyringPolicyWrite  = "write"
+	KeyringPolicyRead   = "read"
+	KeyringPolicyDeny   = "deny"
+	OperatorPolicyWrite = "write"
+	OperatorPolicyRead  = "read"
+	OperatorPolicyDeny  = "deny"
+	SessionPolicyRead   = "read"
+	SessionPolicyWrite  = "write"
+	SessionPolicyDeny   = "deny"
 )
 
 // Policy is used to represent the policy specified by
@@ -28,7 +34,9 @@ type Policy struct {
 	Keys     []*KeyPolicy     `hcl:"key,expand"`
 	Services []*ServicePolicy `hcl:"service,expand"`
 	Events   []*EventPolicy   `hcl:"event,expand"`
+	Sessions []*SessionPolicy `hcl:"session,expand"`
 	Keyring  string           `hcl:"keyring"`
+	Operator string           `hcl:"operator"`
 }
 
 // KeyPolicy represents a policy for a key
@@ -61,6 +69,17 @@ func (e *EventPolicy) GoString() string {
 	return fmt.Sprintf("%#v", *e)
 }
 
+// SessionPolicy represents a policy for the sessions of the nodes
+// matching a prefix
+type SessionPolicy struct {
+	Node   string `hcl:",key"`
+	Policy string
+}
+
+func (s *SessionPolicy) GoString() string {
+	return fmt.Sprintf("%#v", *s)
+}
+
 // Parse is used to parse the specified ACL rules into an
 // intermediary set of policies, before being compiled into
 // the ACL
@@ -109,6 +128,17 @@ func Parse(rules string) (*Policy, error) {
 		}
 	}
 
+	// Validate the session policies
+	for _, sp := range p.Sessions {
+		switch sp.Policy {
+		case SessionPolicyRead:
+		case SessionPolicyWrite:
+		case SessionPolicyDeny:
+		default:
+			return nil, fmt.Errorf("Invalid session policy: %#v", sp)
+		}
+	}
+
 	// Validate the keyring policy
 	switch p.Keyring {
 	case KeyringPolicyRead:
@@ -119,5 +149,15 @@ func Parse(rules string) (*Policy, error) {
 		return nil, fmt.Errorf("Invalid keyring policy: %#v", p.Keyring)
 	}
 
+	// Validate the operator policy
+	switch p.Operator {
+	case OperatorPolicyRead:
+	case OperatorPolicyWrite:
+	case OperatorPolicyDeny:
+	case "": // Special case to allow omitting the operator policy
+	default:
+		return nil, fmt.Errorf("Invalid operator policy: %#v", p.Operator)
+	}
+
 	return p, nil
 }
@@ -1,5 +1,9 @@
 package api
 
+import (
+	"time"
+)
+
 const (
 	// ACLCLientType is the client type token
 	ACLClientType = "client"
@@ -16,6 +20,11 @@ type ACLEntry struct {
 	Name        string
 	Type        string
 	Rules       string
+
+	// LastUsedIndex and LastUsedTime record when the token was last
+	// used, and are zero if it has not been used
+	LastUsedIndex uint64
+	LastUsedTime  time.Time
 }
 
 // ACL can be used to query the ACL endpoints
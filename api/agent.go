@@ -23,6 +23,8 @@ type AgentService struct {
 	Tags    []string
 	Port    int
 	Address string
+	Version string
+	Canary  bool
 }
 
 // AgentMember represents a cluster member known to the agent
@@ -47,6 +49,8 @@ type AgentServiceRegistration struct {
 	Tags    []string `json:",omitempty"`
 	Port    int      `json:",omitempty"`
 	Address string   `json:",omitempty"`
+	Version string   `json:",omitempty"`
+	Canary  bool     `json:",omitempty"`
 	Check   *AgentServiceCheck
 	Checks  AgentServiceChecks
 }
@@ -26,6 +26,12 @@ type QueryOptions struct {
 	// a read. This allows for lower latency and higher throughput
 	AllowStale bool
 
+	// MaxStaleDuration and MaxStaleIndex bound the staleness of a read
+	// allowed by AllowStale. Servers that are further behind the leader
+	// forward the read to the leader instead.
+	MaxStaleDuration time.Duration
+	MaxStaleIndex    uint64
+
 	// RequireConsistent forces the read to be fully consistent.
 	// This is more expensive but prevents ever performing a stale
 	// read.
@@ -42,6 +48,10 @@ type QueryOptions struct {
 	// Token is used to provide a per-request ACL token
 	// which overrides the agent's default token.
 	Token string
+
+	// NodeMeta restricts the results of service queries to the
+	// nodes with all of the given metadata
+	NodeMeta map[string]string
 }
 
 // WriteOptions are used to parameterize a write
@@ -236,6 +246,12 @@ func (r *request) setQueryOptions(q *QueryOptions) {
 	if q.AllowStale {
 		r.params.Set("stale", "")
 	}
+	if q.MaxStaleDuration != 0 {
+		r.params.Set("max_stale", durToMsec(q.MaxStaleDuration))
+	}
+	if q.MaxStaleIndex != 0 {
+		r.params.Set("max_stale_index", strconv.FormatUint(q.MaxStaleIndex, 10))
+	}
 	if q.RequireConsistent {
 		r.params.Set("consistent", "")
 	}
@@ -248,6 +264,9 @@ func (r *request) setQueryOptions(q *QueryOptions) {
 	if q.Token != "" {
 		r.params.Set("token", q.Token)
 	}
+	for k, v := range q.NodeMeta {
+		r.params.Add("node-meta", k+":"+v)
+	}
 }
 
 // durToMsec converts a duration to a millisecond specified string
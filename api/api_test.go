@@ -123,6 +123,8 @@ func TestSetQueryOptions(t *testing.T) {
 	q := &QueryOptions{
 		Datacenter:        "foo",
 		AllowStale:        true,
+		MaxStaleDuration:  500 * time.Millisecond,
+		MaxStaleIndex:     10,
 		RequireConsistent: true,
 		WaitIndex:         1000,
 		WaitTime:          100 * time.Second,
@@ -136,6 +138,12 @@ func TestSetQueryOptions(t *testing.T) {
 	if _, ok := r.params["stale"]; !ok {
 		t.Fatalf("bad: %v", r.params)
 	}
+	if r.params.Get("max_stale") != "500ms" {
+		t.Fatalf("bad: %v", r.params)
+	}
+	if r.params.Get("max_stale_index") != "10" {
+		t.Fatalf("bad: %v", r.params)
+	}
 	if _, ok := r.params["consistent"]; !ok {
 		t.Fatalf("bad: %v", r.params)
 	}
@@ -3,6 +3,8 @@ package api
 type Node struct {
 	Node    string
 	Address string
+	Meta    map[string]string
+	NodeID  string
 }
 
 type CatalogService struct {
@@ -13,6 +15,8 @@ type CatalogService struct {
 	ServiceAddress string
 	ServiceTags    []string
 	ServicePort    int
+	ServiceVersion string
+	ServiceCanary  bool
 }
 
 type CatalogNode struct {
@@ -23,9 +27,12 @@ type CatalogNode struct {
 type CatalogRegistration struct {
 	Node       string
 	Address    string
+	NodeMeta   map[string]string
+	NodeID     string
 	Datacenter string
 	Service    *AgentService
 	Check      *AgentCheck
+	Source     string
 }
 
 type CatalogDeregistration struct {
@@ -18,6 +18,8 @@ type KVPair struct {
 	Flags       uint64
 	Value       []byte
 	Session     string
+	ContentType string
+	Encoding    string
 }
 
 // KVPairs is a list of KVPair objects
@@ -127,6 +129,7 @@ func (k *KV) Put(p *KVPair, q *WriteOptions) (*WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	setContentParams(p, params)
 	_, wm, err := k.put(p.Key, params, p.Value, q)
 	return wm, err
 }
@@ -139,6 +142,7 @@ func (k *KV) CAS(p *KVPair, q *WriteOptions) (bool, *WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	setContentParams(p, params)
 	params["cas"] = strconv.FormatUint(p.ModifyIndex, 10)
 	return k.put(p.Key, params, p.Value, q)
 }
@@ -151,6 +155,7 @@ func (k *KV) Acquire(p *KVPair, q *WriteOptions) (bool, *WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	setContentParams(p, params)
 	params["acquire"] = p.Session
 	return k.put(p.Key, params, p.Value, q)
 }
@@ -163,10 +168,22 @@ func (k *KV) Release(p *KVPair, q *WriteOptions) (bool, *WriteMeta, error) {
 	if p.Flags != 0 {
 		params["flags"] = strconv.FormatUint(p.Flags, 10)
 	}
+	setContentParams(p, params)
 	params["release"] = p.Session
 	return k.put(p.Key, params, p.Value, q)
 }
 
+// setContentParams is used to add the content type and encoding
+// of a pair to the parameters of a write
+func setContentParams(p *KVPair, params map[string]string) {
+	if p.ContentType != "" {
+		params["content-type"] = p.ContentType
+	}
+	if p.Encoding != "" {
+		params["encoding"] = p.Encoding
+	}
+}
+
 func (k *KV) put(key string, params map[string]string, body []byte, q *WriteOptions) (bool, *WriteMeta, error) {
 	if len(key) > 0 && key[0] == '/' {
 		return false, nil, fmt.Errorf("Invalid key. Key must not begin with a '/': %s", key)
@@ -29,6 +29,18 @@ type SessionEntry struct {
 	LockDelay   time.Duration
 	Behavior    string
 	TTL         string
+
+	ServiceChecks []SessionServiceCheck
+
+	// LockCount is the number of keys locked by the session
+	LockCount int
+}
+
+// SessionServiceCheck binds a session to the check of a service
+type SessionServiceCheck struct {
+	Node      string
+	ServiceID string
+	CheckID   string
 }
 
 // Session can be used to query the Session endpoints
@@ -86,6 +98,9 @@ func (s *Session) Create(se *SessionEntry, q *WriteOptions) (string, *WriteMeta,
 		if len(se.Checks) > 0 {
 			body["Checks"] = se.Checks
 		}
+		if len(se.ServiceChecks) > 0 {
+			body["ServiceChecks"] = se.ServiceChecks
+		}
 		if se.Behavior != "" {
 			body["Behavior"] = se.Behavior
 		}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +24,9 @@ const (
 	// Path to save agent service definitions
 	servicesDir = "services"
 
+	// Path to save the generated node ID
+	nodeIDFile = "node-id"
+
 	// Path to save local agent checks
 	checksDir     = "checks"
 	checkStateDir = "checks/state"
@@ -141,6 +145,11 @@ func Create(config *Config, logOutput io.Writer) (*Agent, error) {
 		config.AdvertiseAddrWan = config.AdvertiseAddr
 	}
 
+	// Load or generate the node ID
+	if err := setupNodeID(config); err != nil {
+		return nil, err
+	}
+
 	agent := &Agent{
 		config:        config,
 		logger:        log.New(logOutput, "", log.LstdFlags),
@@ -219,6 +228,9 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.NodeName != "" {
 		base.NodeName = a.config.NodeName
 	}
+	if a.config.NodeID != "" {
+		base.NodeID = a.config.NodeID
+	}
 	if a.config.BindAddr != "" {
 		base.SerfLANConfig.MemberlistConfig.BindAddr = a.config.BindAddr
 		base.SerfWANConfig.MemberlistConfig.BindAddr = a.config.BindAddr
@@ -291,9 +303,24 @@ func (a *Agent) consulConfig() *consul.Config {
 	if a.config.ACLDownPolicy != "" {
 		base.ACLDownPolicy = a.config.ACLDownPolicy
 	}
+	if a.config.ACLRotateGracePeriodRaw != "" {
+		base.ACLRotateGracePeriod = a.config.ACLRotateGracePeriod
+	}
+	if a.config.ACLEnforceSessionRules {
+		base.ACLEnforceSessionRules = true
+	}
 	if a.config.SessionTTLMinRaw != "" {
 		base.SessionTTLMin = a.config.SessionTTLMin
 	}
+	if len(a.config.CheckWebhooks) != 0 {
+		base.CheckWebhooks = a.config.CheckWebhooks
+	}
+	if a.config.CheckWebhookDebounceRaw != "" {
+		base.CheckWebhookDebounce = a.config.CheckWebhookDebounce
+	}
+	if a.config.CheckWebhookRetries != 0 {
+		base.CheckWebhookRetries = a.config.CheckWebhookRetries
+	}
 
 	// Format the build string
 	revision := a.config.Revision
@@ -361,6 +388,40 @@ func (a *Agent) setupClient() error {
 	return nil
 }
 
+// setupNodeID is used to set the node ID, which is either configured,
+// or generated once and saved in the data directory so it survives
+// restarts and changes of the node name
+func setupNodeID(config *Config) error {
+	if config.NodeID != "" {
+		if !structs.ValidNodeID(config.NodeID) {
+			return fmt.Errorf("Invalid node ID '%s', must be a UUID", config.NodeID)
+		}
+		return nil
+	}
+
+	path := filepath.Join(config.DataDir, nodeIDFile)
+	if buf, err := ioutil.ReadFile(path); err == nil {
+		id := strings.TrimSpace(string(buf))
+		if !structs.ValidNodeID(id) {
+			return fmt.Errorf("Invalid node ID '%s' in %s", id, path)
+		}
+		config.NodeID = id
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read node ID: %v", err)
+	}
+
+	id := generateUUID()
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return fmt.Errorf("Failed to create data dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(id), 0600); err != nil {
+		return fmt.Errorf("Failed to save node ID: %v", err)
+	}
+	config.NodeID = id
+	return nil
+}
+
 // setupKeyrings is used to initialize and load keyrings during agent startup
 func (a *Agent) setupKeyrings(config *consul.Config) error {
 	fileLAN := filepath.Join(a.config.DataDir, serfLANKeyring)
@@ -766,6 +827,7 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 	defer a.checkLock.Unlock()
 
 	// Check if already registered
+	var grace time.Duration
 	if chkType != nil {
 		if chkType.IsTTL() {
 			if existing, ok := a.checkTTLs[check.CheckID]; ok {
@@ -785,6 +847,13 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 					check.CheckID, err)
 			}
 
+			// Without a healthy status to restore, let the servers keep
+			// a healthy status heard within the TTL, so the check does
+			// not flap critical until the application checks in
+			if check.Status == "" || check.Status == structs.HealthCritical {
+				grace = chkType.TTL
+			}
+
 			ttl.Start()
 			a.checkTTLs[check.CheckID] = ttl
 
@@ -852,8 +921,14 @@ func (a *Agent) AddCheck(check *structs.HealthCheck, chkType *CheckType, persist
 		}
 	}
 
-	// Add to the local state for anti-entropy
+	// Add to the local state for anti-entropy, along with the grace
+	// period before the check is first synced
+	a.state.Pause()
 	a.state.AddCheck(check, token)
+	if grace > 0 {
+		a.state.SetCheckGrace(check.CheckID, grace)
+	}
+	a.state.Resume()
 
 	// Persist the check
 	if persist {
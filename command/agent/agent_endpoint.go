@@ -332,3 +332,14 @@ func (s *HTTPServer) syncChanges() {
 		s.logger.Printf("[ERR] agent: failed to sync changes: %v", err)
 	}
 }
+
+// DebugStateMemory returns an estimate of the bytes retained by the
+// tables of the state store. Only servers have a state store.
+func (s *HTTPServer) DebugStateMemory(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if s.agent.server == nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte("State store is only available on servers"))
+		return nil, nil
+	}
+	return s.agent.server.StateMemoryStats()
+}
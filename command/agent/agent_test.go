@@ -126,6 +126,44 @@ func TestAgentStartStop(t *testing.T) {
 	}
 }
 
+func TestAgent_NodeID(t *testing.T) {
+	conf := nextConfig()
+	dir, agent := makeAgent(t, conf)
+	defer os.RemoveAll(dir)
+	defer agent.Shutdown()
+
+	// A node ID is generated and saved
+	id := agent.config.NodeID
+	if !structs.ValidNodeID(id) {
+		t.Fatalf("bad: %v", id)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, nodeIDFile))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != id {
+		t.Fatalf("bad: %v", string(buf))
+	}
+
+	// The saved ID is reused
+	conf2 := nextConfig()
+	conf2.DataDir = dir
+	if err := setupNodeID(conf2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf2.NodeID != id {
+		t.Fatalf("bad: %v", conf2.NodeID)
+	}
+
+	// A configured ID must be a UUID
+	conf3 := nextConfig()
+	conf3.DataDir = dir
+	conf3.NodeID = "nope"
+	if err := setupNodeID(conf3); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
 func TestAgent_RPCPing(t *testing.T) {
 	dir, agent := makeAgent(t, nextConfig())
 	defer os.RemoveAll(dir)
@@ -20,6 +20,12 @@ func (s *HTTPServer) CatalogRegister(resp http.ResponseWriter, req *http.Request
 		args.Datacenter = s.agent.config.Datacenter
 	}
 
+	// Registrations through the API are told apart from those synced by
+	// the agents, unless they name their source
+	if args.Source == "" {
+		args.Source = structs.RegistrationSourceAPI
+	}
+
 	// Forward to the servers
 	var out struct{}
 	if err := s.agent.RPC("Catalog.Register", &args, &out); err != nil {
@@ -100,6 +106,7 @@ func (s *HTTPServer) CatalogServiceNodes(resp http.ResponseWriter, req *http.Req
 		args.ServiceTag = params.Get("tag")
 		args.TagFilter = true
 	}
+	args.NodeMetaFilters = parseNodeMeta(req)
 
 	// Pull out the service name
 	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/catalog/service/")
@@ -141,3 +148,46 @@ func (s *HTTPServer) CatalogNodeServices(resp http.ResponseWriter, req *http.Req
 	}
 	return out.NodeServices, nil
 }
+
+func (s *HTTPServer) CatalogNodeLastSeen(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default Datacenter
+	args := structs.NodeSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Pull out the node name
+	args.Node = strings.TrimPrefix(req.URL.Path, "/v1/catalog/last-seen/")
+	if args.Node == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing node name"))
+		return nil, nil
+	}
+
+	// Make the RPC request
+	var out structs.IndexedNodeSeen
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Catalog.NodeLastSeen", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.NodeSeen, nil
+}
+
+func (s *HTTPServer) CatalogEvents(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	// Set default Datacenter
+	args := structs.NodeSpecificRequest{}
+	if done := s.parse(resp, req, &args.Datacenter, &args.QueryOptions); done {
+		return nil, nil
+	}
+
+	// Limit the events to a node, if given
+	args.Node = req.URL.Query().Get("node")
+
+	// Make the RPC request
+	var out structs.IndexedCatalogEvents
+	defer setMeta(resp, &out.QueryMeta)
+	if err := s.agent.RPC("Catalog.Events", &args, &out); err != nil {
+		return nil, err
+	}
+	return out.Events, nil
+}
@@ -137,6 +137,10 @@ type Config struct {
 	// Node name is the name we use to advertise. Defaults to hostname.
 	NodeName string `mapstructure:"node_name"`
 
+	// NodeID is a UUID identifying the node across changes of its name.
+	// If not set, one is generated and saved in the data directory.
+	NodeID string `mapstructure:"node_id"`
+
 	// ClientAddr is used to control the address we bind to for
 	// client services (DNS, HTTP, HTTPS, RPC)
 	ClientAddr string `mapstructure:"client_addr"`
@@ -326,6 +330,17 @@ type Config struct {
 	//                    this acts like deny.
 	ACLDownPolicy string `mapstructure:"acl_down_policy"`
 
+	// ACLRotateGracePeriod is how long the old ID of a rotated token
+	// remains valid, so the agents using it can switch to the new ID.
+	// By default, it is 15 minutes.
+	ACLRotateGracePeriod    time.Duration `mapstructure:"-"`
+	ACLRotateGracePeriodRaw string        `mapstructure:"acl_rotate_grace_period"`
+
+	// ACLEnforceSessionRules enables the session rules of the ACL
+	// policies. It is off by default, so that existing tokens keep
+	// using sessions until they are given session rules.
+	ACLEnforceSessionRules bool `mapstructure:"acl_enforce_session_rules"`
+
 	// Watches are used to monitor various endpoints and to invoke a
 	// handler to act appropriately. These are managed entirely in the
 	// agent layer using the standard APIs.
@@ -399,6 +414,15 @@ type Config struct {
 	// Minimum Session TTL
 	SessionTTLMin    time.Duration `mapstructure:"-"`
 	SessionTTLMinRaw string        `mapstructure:"session_ttl_min"`
+
+	// CheckWebhooks are the URLs the leader posts the status changes of
+	// the health checks to. Changes are collected for CheckWebhookDebounce
+	// before they are posted, and failed posts are retried
+	// CheckWebhookRetries times. Only used by servers.
+	CheckWebhooks           []string      `mapstructure:"check_webhooks"`
+	CheckWebhookDebounce    time.Duration `mapstructure:"-"`
+	CheckWebhookDebounceRaw string        `mapstructure:"check_webhook_debounce"`
+	CheckWebhookRetries     int           `mapstructure:"check_webhook_retries"`
 }
 
 // UnixSocketPermissions contains information about a unix socket, and
@@ -625,6 +649,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.ACLTTL = dur
 	}
 
+	if raw := result.ACLRotateGracePeriodRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("ACL rotate grace period invalid: %v", err)
+		}
+		result.ACLRotateGracePeriod = dur
+	}
+
 	if raw := result.RetryIntervalRaw; raw != "" {
 		dur, err := time.ParseDuration(raw)
 		if err != nil {
@@ -654,6 +686,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.SessionTTLMin = dur
 	}
 
+	if raw := result.CheckWebhookDebounceRaw; raw != "" {
+		dur, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Check webhook debounce invalid: %v", err)
+		}
+		result.CheckWebhookDebounce = dur
+	}
+
 	if result.AdvertiseAddrs.SerfLanRaw != "" {
 		addr, err := net.ResolveTCPAddr("tcp", result.AdvertiseAddrs.SerfLanRaw)
 		if err != nil {
@@ -847,6 +887,9 @@ func MergeConfig(a, b *Config) *Config {
 	if b.NodeName != "" {
 		result.NodeName = b.NodeName
 	}
+	if b.NodeID != "" {
+		result.NodeID = b.NodeID
+	}
 	if b.ClientAddr != "" {
 		result.ClientAddr = b.ClientAddr
 	}
@@ -1021,9 +1064,16 @@ func MergeConfig(a, b *Config) *Config {
 	if b.ACLDownPolicy != "" {
 		result.ACLDownPolicy = b.ACLDownPolicy
 	}
+	if b.ACLRotateGracePeriodRaw != "" {
+		result.ACLRotateGracePeriod = b.ACLRotateGracePeriod
+		result.ACLRotateGracePeriodRaw = b.ACLRotateGracePeriodRaw
+	}
 	if b.ACLDefaultPolicy != "" {
 		result.ACLDefaultPolicy = b.ACLDefaultPolicy
 	}
+	if b.ACLEnforceSessionRules {
+		result.ACLEnforceSessionRules = true
+	}
 	if len(b.Watches) != 0 {
 		result.Watches = append(result.Watches, b.Watches...)
 	}
@@ -1067,6 +1117,13 @@ func MergeConfig(a, b *Config) *Config {
 		result.SessionTTLMin = b.SessionTTLMin
 		result.SessionTTLMinRaw = b.SessionTTLMinRaw
 	}
+	if b.CheckWebhookDebounceRaw != "" {
+		result.CheckWebhookDebounce = b.CheckWebhookDebounce
+		result.CheckWebhookDebounceRaw = b.CheckWebhookDebounceRaw
+	}
+	if b.CheckWebhookRetries != 0 {
+		result.CheckWebhookRetries = b.CheckWebhookRetries
+	}
 	if len(b.HTTPAPIResponseHeaders) != 0 {
 		if result.HTTPAPIResponseHeaders == nil {
 			result.HTTPAPIResponseHeaders = make(map[string]string)
@@ -1096,6 +1153,11 @@ func MergeConfig(a, b *Config) *Config {
 	result.RetryJoinWan = append(result.RetryJoinWan, a.RetryJoinWan...)
 	result.RetryJoinWan = append(result.RetryJoinWan, b.RetryJoinWan...)
 
+	// Copy the check webhooks
+	result.CheckWebhooks = make([]string, 0, len(a.CheckWebhooks)+len(b.CheckWebhooks))
+	result.CheckWebhooks = append(result.CheckWebhooks, a.CheckWebhooks...)
+	result.CheckWebhooks = append(result.CheckWebhooks, b.CheckWebhooks...)
+
 	return &result
 }
 
@@ -558,7 +558,8 @@ func TestDecodeConfig(t *testing.T) {
 	// ACLs
 	input = `{"acl_token": "1234", "acl_datacenter": "dc2",
 	"acl_ttl": "60s", "acl_down_policy": "deny",
-	"acl_default_policy": "deny", "acl_master_token": "2345"}`
+	"acl_default_policy": "deny", "acl_master_token": "2345",
+	"acl_enforce_session_rules": true, "acl_rotate_grace_period": "1h"}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
 	if err != nil {
 		t.Fatalf("err: %s", err)
@@ -576,12 +577,18 @@ func TestDecodeConfig(t *testing.T) {
 	if config.ACLTTL != 60*time.Second {
 		t.Fatalf("bad: %#v", config)
 	}
+	if config.ACLRotateGracePeriod != time.Hour {
+		t.Fatalf("bad: %#v", config)
+	}
 	if config.ACLDownPolicy != "deny" {
 		t.Fatalf("bad: %#v", config)
 	}
 	if config.ACLDefaultPolicy != "deny" {
 		t.Fatalf("bad: %#v", config)
 	}
+	if !config.ACLEnforceSessionRules {
+		t.Fatalf("bad: %#v", config)
+	}
 
 	// Watches
 	input = `{"watches": [{"type":"keyprefix", "prefix":"foo/", "handler":"foobar"}]}`
@@ -744,6 +751,21 @@ func TestDecodeConfig(t *testing.T) {
 	if config.SessionTTLMin != 5*time.Second {
 		t.Fatalf("bad: %s %#v", config.SessionTTLMin.String(), config)
 	}
+
+	// Check webhooks
+	input = `{"check_webhooks": ["http://127.0.0.1:8080/hook"],
+	"check_webhook_debounce": "10s", "check_webhook_retries": 5}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(config.CheckWebhooks) != 1 || config.CheckWebhooks[0] != "http://127.0.0.1:8080/hook" {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.CheckWebhookDebounce != 10*time.Second || config.CheckWebhookRetries != 5 {
+		t.Fatalf("bad: %#v", config)
+	}
 }
 
 func TestDecodeConfig_invalidKeys(t *testing.T) {
@@ -1186,6 +1208,7 @@ func TestMergeConfig(t *testing.T) {
 		ACLTTLRaw:              "15s",
 		ACLDownPolicy:          "deny",
 		ACLDefaultPolicy:       "deny",
+		ACLEnforceSessionRules: true,
 		Watches: []map[string]interface{}{
 			map[string]interface{}{
 				"type":    "keyprefix",
@@ -1199,6 +1222,8 @@ func TestMergeConfig(t *testing.T) {
 		StatsdAddr:                "127.0.0.1:7251",
 		DisableUpdateCheck:        true,
 		DisableAnonymousSignature: true,
+		ACLRotateGracePeriod:      time.Hour,
+		ACLRotateGracePeriodRaw:   "1h",
 		HTTPAPIResponseHeaders: map[string]string{
 			"Access-Control-Allow-Origin": "*",
 		},
@@ -1215,6 +1240,8 @@ func TestMergeConfig(t *testing.T) {
 		AtlasJoin:           true,
 		SessionTTLMinRaw:    "1000s",
 		SessionTTLMin:       1000 * time.Second,
+		CheckWebhooks:       []string{"http://127.0.0.1:8080/hook"},
+		CheckWebhookRetries: 5,
 		AdvertiseAddrs: AdvertiseAddrsConfig{
 			SerfLan:    &net.TCPAddr{},
 			SerfLanRaw: "127.0.0.5:1231",
@@ -498,6 +498,11 @@ RPC:
 		}
 	}
 
+	// Prefer the TTL configured for the service in the catalog
+	if len(out.Nodes) > 0 && out.Nodes[0].DNSTTL > 0 {
+		ttl = out.Nodes[0].DNSTTL
+	}
+
 	// Filter out any service nodes due to health checks
 	out.Nodes = d.filterServiceNodes(out.Nodes)
 
@@ -50,6 +50,9 @@ func (s *HTTPServer) EventFire(resp http.ResponseWriter, req *http.Request) (int
 	if filt := req.URL.Query().Get("tag"); filt != "" {
 		event.TagFilter = filt
 	}
+	if _, ok := req.URL.Query()["persist"]; ok {
+		event.Persist = true
+	}
 
 	// Get the payload
 	if req.ContentLength > 0 {
@@ -62,7 +65,7 @@ func (s *HTTPServer) EventFire(resp http.ResponseWriter, req *http.Request) (int
 
 	// Try to fire the event
 	if err := s.agent.UserEvent(dc, token, event); err != nil {
-		if strings.Contains(err.Error(), permissionDenied) {
+		if structs.ErrorCodeOf(err) == structs.ErrCodePermissionDenied {
 			resp.WriteHeader(403)
 			resp.Write([]byte(permissionDenied))
 			return nil, nil
@@ -1,9 +1,12 @@
 package agent
 
 import (
+	"fmt"
 	"github.com/hashicorp/consul/consul/structs"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (s *HTTPServer) HealthChecksInState(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
@@ -20,6 +23,7 @@ func (s *HTTPServer) HealthChecksInState(resp http.ResponseWriter, req *http.Req
 		resp.Write([]byte("Missing check state"))
 		return nil, nil
 	}
+	args.ServiceName = req.URL.Query().Get("service")
 
 	// Make the RPC request
 	var out structs.IndexedHealthChecks
@@ -91,6 +95,22 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 		args.ServiceTag = params.Get("tag")
 		args.TagFilter = true
 	}
+	args.NodeMetaFilters = parseNodeMeta(req)
+	_, args.PassingOnly = params["passing"]
+
+	// Check for an address tag
+	args.AddressTag = params.Get("address")
+
+	// Check for a version or canary filter
+	args.ServiceVersion = params.Get("version")
+	switch canary := structs.CanaryFilter(params.Get("canary")); canary {
+	case structs.CanaryAny, structs.CanaryOnly, structs.CanaryExclude:
+		args.Canary = canary
+	default:
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf("Invalid canary filter '%s'", canary)))
+		return nil, nil
+	}
 
 	// Pull out the service name
 	args.ServiceName = strings.TrimPrefix(req.URL.Path, "/v1/health/service/")
@@ -107,8 +127,16 @@ func (s *HTTPServer) HealthServiceNodes(resp http.ResponseWriter, req *http.Requ
 		return nil, err
 	}
 
-	// Filter to only passing if specified
-	if _, ok := params["passing"]; ok {
+	// Report the age of the nodes of a remote datacenter served from the
+	// cache of the servers, in milliseconds like the last contact
+	if out.Cached {
+		age := uint64(out.CacheAge / time.Millisecond)
+		resp.Header().Set("X-Consul-CacheAge", strconv.FormatUint(age, 10))
+	}
+
+	// Filter to only passing if specified. The servers already do, unless
+	// they predate the filter.
+	if args.PassingOnly {
 		out.Nodes = filterNonPassing(out.Nodes)
 	}
 	return out.Nodes, nil
@@ -205,6 +205,8 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 	s.mux.HandleFunc("/v1/catalog/services", s.wrap(s.CatalogServices))
 	s.mux.HandleFunc("/v1/catalog/service/", s.wrap(s.CatalogServiceNodes))
 	s.mux.HandleFunc("/v1/catalog/node/", s.wrap(s.CatalogNodeServices))
+	s.mux.HandleFunc("/v1/catalog/events", s.wrap(s.CatalogEvents))
+	s.mux.HandleFunc("/v1/catalog/last-seen/", s.wrap(s.CatalogNodeLastSeen))
 
 	s.mux.HandleFunc("/v1/health/node/", s.wrap(s.HealthNodeChecks))
 	s.mux.HandleFunc("/v1/health/checks/", s.wrap(s.HealthServiceChecks))
@@ -262,6 +264,7 @@ func (s *HTTPServer) registerHandlers(enableDebug bool) {
 		s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 		s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 		s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		s.mux.HandleFunc("/debug/state/memory", s.wrap(s.DebugStateMemory))
 	}
 
 	// Enable the UI + special endpoints
@@ -311,10 +314,13 @@ func (s *HTTPServer) wrap(handler func(resp http.ResponseWriter, req *http.Reque
 		if err != nil {
 			s.logger.Printf("[ERR] http: Request %s %v, error: %v", req.Method, logURL, err)
 			code := 500
-			errMsg := err.Error()
-			if strings.Contains(errMsg, "Permission denied") || strings.Contains(errMsg, "ACL not found") {
+			errCode := structs.ErrorCodeOf(err)
+			if errCode == structs.ErrCodePermissionDenied || errCode == structs.ErrCodeACLNotFound {
 				code = 403
 			}
+			if errCode != structs.ErrCodeUnknown {
+				resp.Header().Set("X-Consul-Error-Code", string(errCode))
+			}
 			resp.WriteHeader(code)
 			resp.Write([]byte(err.Error()))
 			return
@@ -451,6 +457,24 @@ func parseConsistency(resp http.ResponseWriter, req *http.Request, b *structs.Qu
 		resp.Write([]byte("Cannot specify ?stale with ?consistent, conflicting semantics."))
 		return true
 	}
+	if maxStale := query.Get("max_stale"); maxStale != "" {
+		dur, err := time.ParseDuration(maxStale)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid max stale time"))
+			return true
+		}
+		b.MaxStaleDuration = dur
+	}
+	if maxStale := query.Get("max_stale_index"); maxStale != "" {
+		index, err := strconv.ParseUint(maxStale, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Invalid max stale index"))
+			return true
+		}
+		b.MaxStaleIndex = index
+	}
 	return false
 }
 
@@ -480,6 +504,25 @@ func (s *HTTPServer) parseToken(req *http.Request, token *string) {
 	*token = s.agent.config.ACLToken
 }
 
+// parseNodeMeta is used to parse the ?node-meta=key:value query params.
+// The param may be repeated, and a key without a value matches an empty
+// value.
+func parseNodeMeta(req *http.Request) map[string]string {
+	var meta map[string]string
+	for _, filter := range req.URL.Query()["node-meta"] {
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		parts := strings.SplitN(filter, ":", 2)
+		if len(parts) == 2 {
+			meta[parts[0]] = parts[1]
+		} else {
+			meta[parts[0]] = ""
+		}
+	}
+	return meta
+}
+
 // parse is a convenience method for endpoints that need
 // to use both parseWait and parseDC.
 func (s *HTTPServer) parse(resp http.ResponseWriter, req *http.Request, dc *string, b *structs.QueryOptions) bool {
@@ -436,6 +436,29 @@ func TestParseConsistency(t *testing.T) {
 	}
 }
 
+func TestParseNodeMeta(t *testing.T) {
+	req, err := http.NewRequest("GET",
+		"/v1/catalog/service/redis?node-meta=ssd:true&node-meta=rack&node-meta=url:http://foo", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta := parseNodeMeta(req)
+	if len(meta) != 3 || meta["ssd"] != "true" || meta["url"] != "http://foo" {
+		t.Fatalf("bad: %v", meta)
+	}
+	if v, ok := meta["rack"]; !ok || v != "" {
+		t.Fatalf("bad: %v", meta)
+	}
+
+	req, err = http.NewRequest("GET", "/v1/catalog/service/redis", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta := parseNodeMeta(req); meta != nil {
+		t.Fatalf("bad: %v", meta)
+	}
+}
+
 func TestParseConsistency_Invalid(t *testing.T) {
 	resp := httptest.NewRecorder()
 	var b structs.QueryOptions
@@ -455,6 +478,46 @@ func TestParseConsistency_Invalid(t *testing.T) {
 	}
 }
 
+func TestParseConsistency_MaxStale(t *testing.T) {
+	resp := httptest.NewRecorder()
+	var b structs.QueryOptions
+
+	req, err := http.NewRequest("GET",
+		"/v1/catalog/nodes?stale&max_stale=5s&max_stale_index=100", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if d := parseConsistency(resp, req, &b); d {
+		t.Fatalf("unexpected done")
+	}
+
+	if !b.AllowStale {
+		t.Fatalf("Bad: %v", b)
+	}
+	if b.MaxStaleDuration != 5*time.Second {
+		t.Fatalf("Bad: %v", b)
+	}
+	if b.MaxStaleIndex != 100 {
+		t.Fatalf("Bad: %v", b)
+	}
+
+	b = structs.QueryOptions{}
+	req, err = http.NewRequest("GET",
+		"/v1/catalog/nodes?stale&max_stale=foo", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if d := parseConsistency(resp, req, &b); !d {
+		t.Fatalf("expected done")
+	}
+
+	if resp.Code != 400 {
+		t.Fatalf("bad code: %v", resp.Code)
+	}
+}
+
 // Test ACL token is resolved in correct order
 func TestACLResolution(t *testing.T) {
 	var token string
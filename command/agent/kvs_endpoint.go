@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 )
@@ -16,8 +19,30 @@ const (
 	// of a KV entry. If it exceeds this amount, the client is
 	// likely abusing the KV store.
 	maxKVSize = 512 * 1024
+
+	// rawDefaultContentType is used for the raw values that have no
+	// content type, or one that is not safe to serve
+	rawDefaultContentType = "application/octet-stream"
 )
 
+// rawSafeContentTypes are the content types of the raw values that are
+// served as stored. Browsers do not run scripts found in these, so the
+// values cannot be used to inject content into the origin of the agent.
+var rawSafeContentTypes = map[string]bool{
+	"application/json":         true,
+	"application/octet-stream": true,
+	"text/plain":               true,
+}
+
+// rawContentType returns the content type to serve a raw value with
+func rawContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !rawSafeContentTypes[mediaType] {
+		return rawDefaultContentType
+	}
+	return contentType
+}
+
 func (s *HTTPServer) KVSEndpoint(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	// Set default DC
 	args := structs.KeyRequest{}
@@ -64,6 +89,27 @@ func (s *HTTPServer) KVSGet(resp http.ResponseWriter, req *http.Request, args *s
 		return nil, nil
 	}
 
+	// Check for a flags filter. The flags are matched exactly, unless
+	// a mask is given.
+	if _, ok := params["flags"]; ok {
+		flagVal, err := strconv.ParseUint(params.Get("flags"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		args.Flags = flagVal
+		args.FlagsMask = math.MaxUint64
+	}
+	if _, ok := params["flags-mask"]; ok {
+		maskVal, err := strconv.ParseUint(params.Get("flags-mask"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		args.FlagsMask = maskVal
+	}
+
+	// Check for a key pattern filter
+	args.Pattern = params.Get("pattern")
+
 	// Make the RPC
 	var out structs.IndexedDirEntries
 	if err := s.agent.RPC(method, &args, &out); err != nil {
@@ -80,8 +126,14 @@ func (s *HTTPServer) KVSGet(resp http.ResponseWriter, req *http.Request, args *s
 	// Check if we are in raw mode with a normal get, write out
 	// the raw body
 	if _, ok := params["raw"]; ok && method == "KVS.Get" {
-		body := out.Entries[0].Value
+		ent := out.Entries[0]
+		body := ent.Value
 		resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(body)), 10))
+		resp.Header().Set("Content-Type", rawContentType(ent.ContentType))
+		resp.Header().Set("X-Content-Type-Options", "nosniff")
+		if ent.Encoding != "" {
+			resp.Header().Set("Content-Encoding", ent.Encoding)
+		}
 		resp.Write(body)
 		return nil, nil
 	}
@@ -160,6 +212,10 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 		applyReq.DirEnt.Flags = flagVal
 	}
 
+	// Check for the content type and encoding of the value
+	applyReq.DirEnt.ContentType = params.Get("content-type")
+	applyReq.DirEnt.Encoding = params.Get("encoding")
+
 	// Check for cas value
 	if _, ok := params["cas"]; ok {
 		casVal, err := strconv.ParseUint(params.Get("cas"), 10, 64)
@@ -174,6 +230,17 @@ func (s *HTTPServer) KVSPut(resp http.ResponseWriter, req *http.Request, args *s
 	if _, ok := params["acquire"]; ok {
 		applyReq.DirEnt.Session = params.Get("acquire")
 		applyReq.Op = structs.KVSLock
+
+		// Check if the session should queue for a held lock, and how
+		// long to wait for it
+		_, applyReq.Queue = params["queue"]
+		if wait := params.Get("wait"); wait != "" && applyReq.Queue {
+			dur, err := time.ParseDuration(wait)
+			if err != nil {
+				return nil, err
+			}
+			applyReq.QueueWait = dur
+		}
 	}
 
 	// Check for lock release
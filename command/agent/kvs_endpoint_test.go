@@ -573,3 +573,88 @@ func TestKVSEndpoint_DELETE_ConflictingFlags(t *testing.T) {
 		}
 	})
 }
+
+func TestKVSEndpoint_GET_Raw_ContentType(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		buf := bytes.NewBuffer([]byte(`{"foo": 1}`))
+		req, err := http.NewRequest("PUT", "/v1/kv/test?content-type=application/json&encoding=identity", buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		obj, err := srv.KVSEndpoint(resp, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if res := obj.(bool); !res {
+			t.Fatalf("should work")
+		}
+
+		req, err = http.NewRequest("GET", "/v1/kv/test?raw", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.KVSEndpoint(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Check the headers
+		if ct := resp.HeaderMap.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("bad: %v", ct)
+		}
+		if enc := resp.HeaderMap.Get("Content-Encoding"); enc != "identity" {
+			t.Fatalf("bad: %v", enc)
+		}
+		if opt := resp.HeaderMap.Get("X-Content-Type-Options"); opt != "nosniff" {
+			t.Fatalf("bad: %v", opt)
+		}
+	})
+}
+
+func TestKVSEndpoint_GET_Raw_UnsafeContentType(t *testing.T) {
+	httpTest(t, func(srv *HTTPServer) {
+		buf := bytes.NewBuffer([]byte("<script>alert(1)</script>"))
+		req, err := http.NewRequest("PUT", "/v1/kv/test?content-type=text/html", buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := httptest.NewRecorder()
+		if _, err := srv.KVSEndpoint(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		req, err = http.NewRequest("GET", "/v1/kv/test?raw", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp = httptest.NewRecorder()
+		if _, err := srv.KVSEndpoint(resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The value is not served as HTML
+		if ct := resp.HeaderMap.Get("Content-Type"); ct != rawDefaultContentType {
+			t.Fatalf("bad: %v", ct)
+		}
+		if opt := resp.HeaderMap.Get("X-Content-Type-Options"); opt != "nosniff" {
+			t.Fatalf("bad: %v", opt)
+		}
+	})
+}
+
+func TestRawContentType(t *testing.T) {
+	cases := map[string]string{
+		"":                          rawDefaultContentType,
+		"text/html":                 rawDefaultContentType,
+		"image/svg+xml":             rawDefaultContentType,
+		"not a type":                rawDefaultContentType,
+		"application/json":          "application/json",
+		"text/plain; charset=utf-8": "text/plain; charset=utf-8",
+	}
+	for in, expect := range cases {
+		if out := rawContentType(in); out != expect {
+			t.Fatalf("bad: %q %q", in, out)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"reflect"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,6 +25,7 @@ const (
 type syncStatus struct {
 	remoteDelete bool // Should this be deleted from the server
 	inSync       bool // Is this in sync with the server
+	statusOnly   bool // Only the status and output of a check are out of sync
 }
 
 // localState is used to represent the node's services,
@@ -58,6 +58,12 @@ type localState struct {
 	// Used to track checks that are being deferred
 	deferCheck map[string]*time.Timer
 
+	// checkGrace tracks the grace period of TTL checks that were added
+	// without a persisted status, until their status is first updated.
+	// While it is set, the servers keep a healthy status heard within
+	// the grace period instead of the initial critical status.
+	checkGrace map[string]time.Duration
+
 	// consulCh is used to inform of a change to the known
 	// consul nodes. This may be used to retry a sync run
 	consulCh chan struct{}
@@ -78,6 +84,7 @@ func (l *localState) Init(config *Config, logger *log.Logger) {
 	l.checkStatus = make(map[string]syncStatus)
 	l.checkTokens = make(map[string]string)
 	l.deferCheck = make(map[string]*time.Timer)
+	l.checkGrace = make(map[string]time.Duration)
 	l.consulCh = make(chan struct{}, 1)
 	l.triggerCh = make(chan struct{}, 1)
 }
@@ -216,9 +223,21 @@ func (l *localState) AddCheck(check *structs.HealthCheck, token string) {
 	l.checks[check.CheckID] = check
 	l.checkStatus[check.CheckID] = syncStatus{}
 	l.checkTokens[check.CheckID] = token
+	delete(l.checkGrace, check.CheckID)
 	l.changeMade()
 }
 
+// SetCheckGrace is used to set the grace period of a check, which lasts
+// until the status of the check is first updated
+func (l *localState) SetCheckGrace(checkID string, grace time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.checks[checkID]; ok {
+		l.checkGrace[checkID] = grace
+	}
+}
+
 // RemoveCheck is used to remove a health check from the local state.
 // The agent will make a best effort to ensure it is deregistered
 func (l *localState) RemoveCheck(checkID string) {
@@ -227,6 +246,7 @@ func (l *localState) RemoveCheck(checkID string) {
 
 	delete(l.checks, checkID)
 	delete(l.checkTokens, checkID)
+	delete(l.checkGrace, checkID)
 	l.checkStatus[checkID] = syncStatus{remoteDelete: true}
 	l.changeMade()
 }
@@ -241,8 +261,14 @@ func (l *localState) UpdateCheck(checkID, status, output string) {
 		return
 	}
 
+	// The first update ends the grace period, and must be synced even if
+	// it does not change the status, since the servers may have kept a
+	// different one
+	_, graced := l.checkGrace[checkID]
+	delete(l.checkGrace, checkID)
+
 	// Do nothing if update is idempotent
-	if check.Status == status && check.Output == output {
+	if check.Status == status && check.Output == output && !graced {
 		return
 	}
 
@@ -250,14 +276,14 @@ func (l *localState) UpdateCheck(checkID, status, output string) {
 	// frequent updates of output. Instead, we update the output internally,
 	// and periodically do a write-back to the servers. If there is a status
 	// change we do the write immediately.
-	if l.config.CheckUpdateInterval > 0 && check.Status == status {
+	if l.config.CheckUpdateInterval > 0 && check.Status == status && !graced {
 		check.Output = output
 		if _, ok := l.deferCheck[checkID]; !ok {
 			intv := time.Duration(uint64(l.config.CheckUpdateInterval)/2) + randomStagger(l.config.CheckUpdateInterval)
 			deferSync := time.AfterFunc(intv, func() {
 				l.Lock()
-				if _, ok := l.checkStatus[checkID]; ok {
-					l.checkStatus[checkID] = syncStatus{inSync: false}
+				if status, ok := l.checkStatus[checkID]; ok {
+					l.checkStatus[checkID] = outOfSyncStatus(status)
 					l.changeMade()
 				}
 				delete(l.deferCheck, checkID)
@@ -271,10 +297,17 @@ func (l *localState) UpdateCheck(checkID, status, output string) {
 	// Update status and mark out of sync
 	check.Status = status
 	check.Output = output
-	l.checkStatus[checkID] = syncStatus{inSync: false}
+	l.checkStatus[checkID] = outOfSyncStatus(l.checkStatus[checkID])
 	l.changeMade()
 }
 
+// outOfSyncStatus returns the sync status of a check whose status or
+// output changed. If the servers otherwise have the check, only the
+// status needs to be synced.
+func outOfSyncStatus(status syncStatus) syncStatus {
+	return syncStatus{statusOnly: status.inSync || status.statusOnly}
+}
+
 // Checks returns the locally registered checks that the
 // agent is aware of and are being kept in sync with the server
 func (l *localState) Checks() map[string]*structs.HealthCheck {
@@ -340,9 +373,107 @@ SYNC:
 	}
 }
 
-// setSyncState does a read of the server state, and updates
-// the local syncStatus as appropriate
+// setSyncState compares the local state against the server state, and
+// updates the local syncStatus as appropriate. The servers are sent the
+// hashes of the local services and checks and return only those that are
+// out of sync, falling back to a full read of the server state if some
+// of them do not support it yet.
 func (l *localState) setSyncState() error {
+	members := l.iface.LANMembers()
+	if consul.ServersSupport(members, l.config.Datacenter, structs.FeatureNodeSyncDiff) {
+		return l.setSyncStateDiff()
+	}
+	return l.setSyncStateFull()
+}
+
+// setSyncStateDiff sends the hashes of the local services and checks to
+// the servers, and updates the local syncStatus from the differences
+func (l *localState) setSyncStateDiff() error {
+	req := structs.NodeSyncRequest{
+		Datacenter:        l.config.Datacenter,
+		Node:              l.config.NodeName,
+		Services:          make(map[string]structs.NodeSyncService),
+		Checks:            make(map[string]structs.NodeSyncCheck),
+		IgnoreCheckOutput: l.config.CheckUpdateInterval != 0,
+		QueryOptions:      structs.QueryOptions{Token: l.config.ACLToken},
+	}
+	l.RLock()
+	for id, service := range l.services {
+		req.Services[id] = structs.NodeSyncService{
+			Hash:       service.SyncHash(service.EnableTagOverride),
+			IgnoreTags: service.EnableTagOverride,
+		}
+	}
+	for id, check := range l.checks {
+		req.Checks[id] = structs.NodeSyncCheck{
+			Hash:       check.SyncHash(),
+			StatusHash: check.StatusHash(req.IgnoreCheckOutput),
+		}
+	}
+	l.RUnlock()
+
+	var out structs.IndexedNodeSyncDiff
+	if err := l.iface.RPC("Catalog.NodeSyncDiff", &req, &out); err != nil {
+		return err
+	}
+	diff := out.Diff
+
+	l.Lock()
+	defer l.Unlock()
+
+	// Adopt the tags changed through the catalog
+	for id, tags := range diff.ServiceTags {
+		if existing, ok := l.services[id]; ok && existing.EnableTagOverride {
+			existing.Tags = tags
+		}
+	}
+
+	// The services and checks sent are in sync unless reported otherwise,
+	// or changed since their hash was taken
+	for id, sent := range req.Services {
+		if existing, ok := l.services[id]; ok &&
+			existing.SyncHash(existing.EnableTagOverride) == sent.Hash {
+			l.serviceStatus[id] = syncStatus{inSync: true}
+		}
+	}
+	for id, sent := range req.Checks {
+		if existing, ok := l.checks[id]; ok && existing.SyncHash() == sent.Hash &&
+			existing.StatusHash(req.IgnoreCheckOutput) == sent.StatusHash {
+			l.checkStatus[id] = syncStatus{inSync: true}
+		}
+	}
+
+	for _, id := range diff.SyncServices {
+		if _, ok := l.services[id]; ok {
+			l.serviceStatus[id] = syncStatus{inSync: false}
+		}
+	}
+	for _, id := range diff.DeleteServices {
+		if _, ok := l.services[id]; !ok {
+			l.serviceStatus[id] = syncStatus{remoteDelete: true}
+		}
+	}
+	for _, id := range diff.SyncChecks {
+		if _, ok := l.checks[id]; ok {
+			l.checkStatus[id] = syncStatus{inSync: false}
+		}
+	}
+	for _, id := range diff.SyncCheckStatuses {
+		if _, ok := l.checks[id]; ok {
+			l.checkStatus[id] = syncStatus{inSync: false, statusOnly: true}
+		}
+	}
+	for _, id := range diff.DeleteChecks {
+		if _, ok := l.checks[id]; !ok {
+			l.checkStatus[id] = syncStatus{remoteDelete: true}
+		}
+	}
+	return nil
+}
+
+// setSyncStateFull does a read of the server state, and updates
+// the local syncStatus as appropriate
+func (l *localState) setSyncStateFull() error {
 	req := structs.NodeSpecificRequest{
 		Datacenter:   l.config.Datacenter,
 		Node:         l.config.NodeName,
@@ -374,6 +505,11 @@ func (l *localState) setSyncState() error {
 	}
 
 	for id, service := range services {
+		// Services owned by an external tool are left alone
+		if service.Source == structs.RegistrationSourceExternal {
+			continue
+		}
+
 		// If we don't have the service locally, deregister it
 		existing, ok := l.services[id]
 		if !ok {
@@ -381,6 +517,9 @@ func (l *localState) setSyncState() error {
 			continue
 		}
 
+		// The source is set by the servers, and is not compared
+		service.Source = ""
+
 		// If our definition is different, we need to update it
 		if existing.EnableTagOverride {
 			existing.Tags = service.Tags
@@ -404,6 +543,11 @@ func (l *localState) setSyncState() error {
 	}
 
 	for _, check := range checks {
+		// Checks owned by an external tool are left alone
+		if check.Source == structs.RegistrationSourceExternal {
+			continue
+		}
+
 		// If we don't have the check locally, deregister it
 		id := check.CheckID
 		existing, ok := l.checks[id]
@@ -416,6 +560,7 @@ func (l *localState) setSyncState() error {
 			l.checkStatus[id] = syncStatus{remoteDelete: true}
 			continue
 		}
+		check.Source = ""
 
 		// If our definition is different, we need to update it
 		var equal bool
@@ -429,8 +574,17 @@ func (l *localState) setSyncState() error {
 			equal = reflect.DeepEqual(eCopy, check)
 		}
 
+		// If only the status differs, the definition need not be sent
+		statusOnly := false
+		if !equal {
+			eCopy := new(structs.HealthCheck)
+			*eCopy = *existing
+			eCopy.Status, eCopy.Output = check.Status, check.Output
+			statusOnly = reflect.DeepEqual(eCopy, check)
+		}
+
 		// Update the status
-		l.checkStatus[id] = syncStatus{inSync: equal}
+		l.checkStatus[id] = syncStatus{inSync: equal, statusOnly: statusOnly}
 	}
 	return nil
 }
@@ -526,8 +680,10 @@ func (l *localState) syncService(id string) error {
 	req := structs.RegisterRequest{
 		Datacenter:   l.config.Datacenter,
 		Node:         l.config.NodeName,
+		NodeID:       l.config.NodeID,
 		Address:      l.config.AdvertiseAddr,
 		Service:      l.services[id],
+		Source:       structs.RegistrationSourceAgent,
 		WriteRequest: structs.WriteRequest{Token: l.serviceToken(id)},
 	}
 
@@ -558,7 +714,7 @@ func (l *localState) syncService(id string) error {
 		for _, check := range checks {
 			l.checkStatus[check.CheckID] = syncStatus{inSync: true}
 		}
-	} else if strings.Contains(err.Error(), permissionDenied) {
+	} else if structs.ErrorCodeOf(err) == structs.ErrCodePermissionDenied {
 		l.serviceStatus[id] = syncStatus{inSync: true}
 		l.logger.Printf("[WARN] agent: Service '%s' registration blocked by ACLs", id)
 		for _, check := range checks {
@@ -571,6 +727,18 @@ func (l *localState) syncService(id string) error {
 
 // syncCheck is used to sync a service to the server
 func (l *localState) syncCheck(id string) error {
+	// Only send the status if the servers have the rest of the check.
+	// Servers that predate the update fall back to a registration.
+	members := l.iface.LANMembers()
+	if l.checkStatus[id].statusOnly &&
+		consul.ServersSupport(members, l.config.Datacenter, structs.FeatureCheckUpdate) {
+		err := l.syncCheckStatus(id)
+		if err == nil {
+			return nil
+		}
+		l.logger.Printf("[WARN] agent: Failed to update check '%s', registering instead: %v", id, err)
+	}
+
 	// Pull in the associated service if any
 	check := l.checks[id]
 	var service *structs.NodeService
@@ -583,9 +751,12 @@ func (l *localState) syncCheck(id string) error {
 	req := structs.RegisterRequest{
 		Datacenter:   l.config.Datacenter,
 		Node:         l.config.NodeName,
+		NodeID:       l.config.NodeID,
 		Address:      l.config.AdvertiseAddr,
 		Service:      service,
 		Check:        l.checks[id],
+		CheckGrace:   l.checkGrace[id],
+		Source:       structs.RegistrationSourceAgent,
 		WriteRequest: structs.WriteRequest{Token: l.checkToken(id)},
 	}
 	var out struct{}
@@ -593,10 +764,35 @@ func (l *localState) syncCheck(id string) error {
 	if err == nil {
 		l.checkStatus[id] = syncStatus{inSync: true}
 		l.logger.Printf("[INFO] agent: Synced check '%s'", id)
-	} else if strings.Contains(err.Error(), permissionDenied) {
+	} else if structs.ErrorCodeOf(err) == structs.ErrCodePermissionDenied {
 		l.checkStatus[id] = syncStatus{inSync: true}
 		l.logger.Printf("[WARN] agent: Check '%s' registration blocked by ACLs", id)
 		return nil
 	}
 	return err
 }
+
+// syncCheckStatus is used to sync only the status and output of a check
+func (l *localState) syncCheckStatus(id string) error {
+	check := l.checks[id]
+	req := structs.CheckUpdateRequest{
+		Datacenter:   l.config.Datacenter,
+		Node:         l.config.NodeName,
+		CheckID:      id,
+		Status:       check.Status,
+		Output:       check.Output,
+		Grace:        l.checkGrace[id],
+		WriteRequest: structs.WriteRequest{Token: l.checkToken(id)},
+	}
+	var out struct{}
+	err := l.iface.RPC("Catalog.UpdateCheck", &req, &out)
+	if err == nil {
+		l.checkStatus[id] = syncStatus{inSync: true}
+		l.logger.Printf("[INFO] agent: Synced check '%s' status", id)
+	} else if structs.ErrorCodeOf(err) == structs.ErrCodePermissionDenied {
+		l.checkStatus[id] = syncStatus{inSync: true}
+		l.logger.Printf("[WARN] agent: Check '%s' update blocked by ACLs", id)
+		return nil
+	}
+	return err
+}
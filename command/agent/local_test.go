@@ -125,8 +125,9 @@ func TestAgentAntiEntropy_Services(t *testing.T) {
 		t.Fatalf("bad: %v", services.NodeServices.Services)
 	}
 
-	// All the services should match
+	// All the services should match. The source is set by the servers.
 	for id, serv := range services.NodeServices.Services {
+		serv.Source = ""
 		switch id {
 		case "mysql":
 			if !reflect.DeepEqual(serv, srv1) {
@@ -234,8 +235,9 @@ func TestAgentAntiEntropy_EnableTagOverride(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	// All the services should match
+	// All the services should match. The source is set by the servers.
 	for id, serv := range services.NodeServices.Services {
+		serv.Source = ""
 		switch id {
 		case "svc_id1":
 			if serv.ID != "svc_id1" ||
@@ -453,8 +455,9 @@ func TestAgentAntiEntropy_Services_ACLDeny(t *testing.T) {
 		t.Fatalf("bad: %v", services.NodeServices.Services)
 	}
 
-	// All the services should match
+	// All the services should match. The source is set by the servers.
 	for id, serv := range services.NodeServices.Services {
+		serv.Source = ""
 		switch id {
 		case "mysql":
 			t.Fatalf("should not be permitted")
@@ -579,8 +582,9 @@ func TestAgentAntiEntropy_Checks(t *testing.T) {
 		t.Fatalf("bad: %v", checks)
 	}
 
-	// All the checks should match
+	// All the checks should match. The source is set by the servers.
 	for _, chk := range checks.HealthChecks {
+		chk.Source = ""
 		switch chk.CheckID {
 		case "mysql":
 			if !reflect.DeepEqual(chk, chk1) {
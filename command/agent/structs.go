@@ -15,6 +15,9 @@ type ServiceDefinition struct {
 	Checks            CheckTypes
 	Token             string
 	EnableTagOverride bool
+	Version           string
+	Canary            bool
+	Addresses         map[string]string
 }
 
 func (s *ServiceDefinition) NodeService() *structs.NodeService {
@@ -25,6 +28,9 @@ func (s *ServiceDefinition) NodeService() *structs.NodeService {
 		Address:           s.Address,
 		Port:              s.Port,
 		EnableTagOverride: s.EnableTagOverride,
+		Version:           s.Version,
+		Canary:            s.Canary,
+		Addresses:         s.Addresses,
 	}
 	if ns.ID == "" && ns.Service != "" {
 		ns.ID = ns.Service
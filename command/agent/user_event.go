@@ -41,6 +41,10 @@ type UserEvent struct {
 
 	// LTime is the lamport time. Automatically generated.
 	LTime uint64 `codec:"-"`
+
+	// Persist has the servers record the event before it is gossiped.
+	// It is not part of the message.
+	Persist bool `codec:"-"`
 }
 
 // validateUserEventParams is used to sanity check the inputs
@@ -91,12 +95,14 @@ func (a *Agent) UserEvent(dc, token string, params *UserEvent) error {
 		Datacenter:   dc,
 		Name:         params.Name,
 		Payload:      payload,
+		Persist:      params.Persist,
 		QueryOptions: structs.QueryOptions{Token: token},
 	}
 
 	// Any server can process in the remote DC, since the
-	// gossip will take over anyways
-	args.AllowStale = true
+	// gossip will take over anyways. Persisted events are
+	// handled by the leader.
+	args.AllowStale = !params.Persist
 	var out structs.EventFireResponse
 	return a.RPC("Internal.EventFire", &args, &out)
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -16,13 +15,13 @@ import (
 
 const (
 	// aclNotFound indicates there is no matching ACL
-	aclNotFound = "ACL not found"
+	aclNotFound = structs.ErrMsgACLNotFound
 
 	// rootDenied is returned when attempting to resolve a root ACL
 	rootDenied = "Cannot resolve root ACL"
 
 	// permissionDenied is returned when an ACL based rejection happens
-	permissionDenied = "Permission denied"
+	permissionDenied = structs.ErrMsgPermissionDenied
 
 	// aclDisabled is returned when ACL changes are not permitted
 	// since they are disabled.
@@ -34,10 +33,16 @@ const (
 
 	// Maximum number of cached ACL entries
 	aclCacheSize = 256
+
+	// aclCompiledWatchInterval is how often the compiled ACL cache
+	// re-arms its watch on the ACL table. This covers the state store
+	// being swapped out from under us by a snapshot restore.
+	aclCompiledWatchInterval = 30 * time.Second
 )
 
 var (
-	permissionDeniedErr = errors.New(permissionDenied)
+	permissionDeniedErr = &structs.Error{Code: structs.ErrCodePermissionDenied, Message: permissionDenied}
+	aclNotFoundErr      = &structs.Error{Code: structs.ErrCodeACLNotFound, Message: aclNotFound}
 )
 
 // aclCacheEntry is used to cache non-authoritative ACL's
@@ -56,8 +61,8 @@ func (s *Server) aclFault(id string) (string, string, error) {
 	if err != nil {
 		return "", "", err
 	}
-	if acl == nil {
-		return "", "", errors.New(aclNotFound)
+	if acl == nil || acl.Expired(time.Now()) {
+		return "", "", aclNotFoundErr
 	}
 
 	// Management tokens have no policy and inherit from the
@@ -67,7 +72,46 @@ func (s *Server) aclFault(id string) (string, string, error) {
 	}
 
 	// Otherwise use the base policy
-	return s.config.ACLDefaultPolicy, acl.Rules, nil
+	parent, err := s.aclDefaultPolicy()
+	if err != nil {
+		return "", "", err
+	}
+	return parent, acl.Rules, nil
+}
+
+// aclDefaultPolicy returns the default ACL policy. The policy of the
+// cluster config takes precedence over the configuration of the server.
+func (s *Server) aclDefaultPolicy() (string, error) {
+	_, conf, err := s.fsm.State().ClusterConfigGet()
+	if err != nil {
+		return "", err
+	}
+	if conf != nil && conf.ACLDefaultPolicy != "" {
+		return conf.ACLDefaultPolicy, nil
+	}
+	return s.config.ACLDefaultPolicy, nil
+}
+
+// aclDownPolicy returns the policy applied when the ACL datacenter
+// cannot be reached. The policy of the cluster config takes precedence
+// over the configuration of the server.
+func (s *Server) aclDownPolicy() string {
+	_, conf, err := s.fsm.State().ClusterConfigGet()
+	if err != nil {
+		s.logger.Printf("[ERR] consul.acl: Failed to get the cluster config: %v", err)
+	} else if conf != nil && conf.ACLDownPolicy != "" {
+		return conf.ACLDownPolicy
+	}
+	return s.config.ACLDownPolicy
+}
+
+// resolveSessionToken is used to resolve the ACL to enforce the session
+// rules with. It returns nil unless the session rules are enforced.
+func (s *Server) resolveSessionToken(id string) (acl.ACL, error) {
+	if !s.config.ACLEnforceSessionRules {
+		return nil, nil
+	}
+	return s.resolveToken(id)
 }
 
 // resolveToken is used to resolve an ACL is any is appropriate
@@ -87,15 +131,97 @@ func (s *Server) resolveToken(id string) (acl.ACL, error) {
 	}
 
 	// Check if we are the ACL datacenter and the leader, use the
-	// authoritative cache
+	// authoritative cache, otherwise use our non-authoritative cache.
+	// The use of the token is recorded by the leader of the ACL
+	// datacenter, which also serves the policies of the other servers.
 	if s.config.Datacenter == authDC && s.IsLeader() {
-		return s.aclAuthCache.GetACL(id)
+		resolved, err := s.resolveAuthToken(id)
+		if err == nil {
+			s.trackACLUsage(id)
+		}
+		return resolved, err
 	}
-
-	// Use our non-authoritative cache
 	return s.aclCache.lookupACL(id, authDC)
 }
 
+// aclCompiledID returns the compiled ACL cache key for a token. Including
+// the ModifyIndex means an update to the token can never hit a stale entry.
+func aclCompiledID(id string, modifyIndex uint64) string {
+	return fmt.Sprintf("%s:%d", id, modifyIndex)
+}
+
+// resolveAuthToken is used to resolve a token when we are authoritative.
+// Compiled ACLs are cached by token ID and ModifyIndex so that a hit only
+// costs a lookup of the token, instead of faulting in and compiling rules.
+func (s *Server) resolveAuthToken(id string) (acl.ACL, error) {
+	state := s.fsm.State()
+	_, token, err := state.ACLGet(id)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil || token.Expired(time.Now()) {
+		return nil, aclNotFoundErr
+	}
+
+	// Check for a cached compiled ACL
+	compiledID := aclCompiledID(id, token.ModifyIndex)
+	if raw, ok := s.aclCompiled.Get(compiledID); ok {
+		metrics.IncrCounter([]string{"consul", "acl", "compiled_hit"}, 1)
+		return raw.(acl.ACL), nil
+	}
+	metrics.IncrCounter([]string{"consul", "acl", "compiled_miss"}, 1)
+
+	// Clear any stale entry, so the rules for this version of the
+	// token are faulted in. Parsed policies are content-hashed, so
+	// this does not re-parse rules that have not changed.
+	s.aclAuthCache.ClearACL(id)
+	compiled, err := s.aclAuthCache.GetACL(id)
+	if err != nil {
+		return nil, err
+	}
+	s.aclCompiled.Add(compiledID, compiled)
+	return compiled, nil
+}
+
+// watchACLCompiled is a long running routine that purges the compiled
+// ACL cache whenever the ACL table is modified. A change to the cluster
+// config, which may change the default policy, also purges the policies
+// of the authoritative cache. This runs on every server, so a server that
+// becomes the leader never serves policies with a stale default.
+func (s *Server) watchACLCompiled() {
+	aclCh := make(chan struct{}, 1)
+	confCh := make(chan struct{}, 1)
+	for {
+		state := s.fsm.State()
+		aclTables := state.QueryTables("ACLList")
+		confTables := state.QueryTables("ClusterConfigGet")
+		state.Watch(aclTables, aclCh)
+		state.Watch(confTables, confCh)
+
+		select {
+		case <-aclCh:
+			state.StopWatch(confTables, confCh)
+			s.aclCompiled.Purge()
+		case <-confCh:
+			state.StopWatch(aclTables, aclCh)
+			s.aclAuthCache.Purge()
+			s.aclCompiled.Purge()
+		case <-state.AbandonCh():
+			state.StopWatch(aclTables, aclCh)
+			state.StopWatch(confTables, confCh)
+			s.aclAuthCache.Purge()
+			s.aclCompiled.Purge()
+		case <-time.After(aclCompiledWatchInterval):
+			state.StopWatch(aclTables, aclCh)
+			state.StopWatch(confTables, confCh)
+		case <-s.shutdownCh:
+			state.StopWatch(aclTables, aclCh)
+			state.StopWatch(confTables, confCh)
+			return
+		}
+	}
+}
+
 // rpcFn is used to make an RPC call to the client or server.
 type rpcFn func(string, interface{}, interface{}) error
 
@@ -112,6 +238,10 @@ type aclCache struct {
 
 	// The RPC function used to talk to the client/server
 	rpc rpcFn
+
+	// downPolicy returns the policy applied when the ACL datacenter
+	// cannot be reached. If nil, the configured policy is applied.
+	downPolicy func() string
 }
 
 // newAclCache returns a new cache layer for ACLs and policies
@@ -173,14 +303,18 @@ func (c *aclCache) lookupACL(id, authDC string) (acl.ACL, error) {
 	}
 
 	// Check for not-found
-	if strings.Contains(err.Error(), aclNotFound) {
-		return nil, errors.New(aclNotFound)
+	if structs.ErrorCodeOf(err) == structs.ErrCodeACLNotFound {
+		return nil, aclNotFoundErr
 	} else {
 		c.logger.Printf("[ERR] consul.acl: Failed to get policy for '%s': %v", id, err)
 	}
 
 	// Unable to refresh, apply the down policy
-	switch c.config.ACLDownPolicy {
+	downPolicy := c.config.ACLDownPolicy
+	if c.downPolicy != nil {
+		downPolicy = c.downPolicy()
+	}
+	switch downPolicy {
 	case "allow":
 		return acl.AllowAll(), nil
 	case "extend-cache":
@@ -348,6 +482,7 @@ func (f *aclFilter) filterNodeDump(dump *structs.NodeDump) {
 				continue
 			}
 			f.logger.Printf("[DEBUG] consul: dropping service %q from result due to ACLs", svc)
+			delete(info.ServiceTimes, info.Services[i].ID)
 			info.Services = append(info.Services[:i], info.Services[i+1:]...)
 			i--
 		}
@@ -366,6 +501,64 @@ func (f *aclFilter) filterNodeDump(dump *structs.NodeDump) {
 	*dump = nd
 }
 
+// filterConfigEntry is used to determine if a config entry is readable
+// for an ACL. Service defaults follow the rules of their service, and
+// the other kinds require operator read access.
+func (f *aclFilter) filterConfigEntry(entry *structs.ConfigEntry) bool {
+	if entry.Kind == structs.ServiceDefaults {
+		return f.acl.ServiceRead(entry.Name)
+	}
+	return f.acl.OperatorRead()
+}
+
+// filterConfigEntries is used to filter a set of config entries down
+// based on the configured ACL rules for a token.
+func (f *aclFilter) filterConfigEntries(entries *structs.ConfigEntries) {
+	ce := *entries
+	for i := 0; i < len(ce); i++ {
+		entry := ce[i]
+		if f.filterConfigEntry(entry) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping %s config entry %q from result due to ACLs", entry.Kind, entry.Name)
+		ce = append(ce[:i], ce[i+1:]...)
+		i--
+	}
+	*entries = ce
+}
+
+// filterServiceConfigs is used to filter a set of service configs down
+// based on the configured ACL rules for a token.
+func (f *aclFilter) filterServiceConfigs(confs *structs.ServiceConfigs) {
+	sc := *confs
+	for i := 0; i < len(sc); i++ {
+		conf := sc[i]
+		if f.acl.ServiceRead(conf.Service) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping config of service %q from result due to ACLs", conf.Service)
+		sc = append(sc[:i], sc[i+1:]...)
+		i--
+	}
+	*confs = sc
+}
+
+// filterUserEvents is used to filter a set of user events down based on
+// the configured ACL rules for a token.
+func (f *aclFilter) filterUserEvents(events *structs.UserEvents) {
+	ue := *events
+	for i := 0; i < len(ue); i++ {
+		ev := ue[i]
+		if f.acl.EventRead(ev.Name) {
+			continue
+		}
+		f.logger.Printf("[DEBUG] consul: dropping user event %q from result due to ACLs", ev.Name)
+		ue = append(ue[:i], ue[i+1:]...)
+		i--
+	}
+	*events = ue
+}
+
 // filterACL is used to filter results from our service catalog based on the
 // rules configured for the provided token. The subject is scrubbed and
 // modified in-place, leaving only resources the token can access.
@@ -405,6 +598,15 @@ func (s *Server) filterACL(token string, subj interface{}) error {
 	case *structs.IndexedNodeDump:
 		filt.filterNodeDump(&v.Dump)
 
+	case *structs.IndexedConfigEntries:
+		filt.filterConfigEntries(&v.Entries)
+
+	case *structs.IndexedServiceConfigs:
+		filt.filterServiceConfigs(&v.Configs)
+
+	case *structs.IndexedUserEvents:
+		filt.filterUserEvents(&v.Events)
+
 	default:
 		panic(fmt.Errorf("Unhandled type passed to ACL filter: %#v", subj))
 	}
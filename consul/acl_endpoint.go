@@ -46,7 +46,7 @@ func (a *ACL) Apply(args *structs.ACLRequest, reply *string) error {
 
 		// Verify this is not a root ACL
 		if acl.RootACL(args.ACL.ID) != nil {
-			return fmt.Errorf("%s: Cannot modify root ACL", permissionDenied)
+			return structs.NewError(structs.ErrCodePermissionDenied, "%s: Cannot modify root ACL", permissionDenied)
 		}
 
 		// Validate the rules compile
@@ -78,7 +78,44 @@ func (a *ACL) Apply(args *structs.ACLRequest, reply *string) error {
 		if args.ACL.ID == "" {
 			return fmt.Errorf("Missing ACL ID")
 		} else if args.ACL.ID == anonymousToken {
-			return fmt.Errorf("%s: Cannot delete anonymous token", permissionDenied)
+			return structs.NewError(structs.ErrCodePermissionDenied, "%s: Cannot delete anonymous token", permissionDenied)
+		}
+
+	case structs.ACLClone, structs.ACLRotate:
+		if args.ACL.ID == "" {
+			return fmt.Errorf("Missing ACL ID")
+		} else if args.Op == structs.ACLRotate && args.ACL.ID == anonymousToken {
+			return structs.NewError(structs.ErrCodePermissionDenied, "%s: Cannot rotate anonymous token", permissionDenied)
+		} else if acl.RootACL(args.ACL.ID) != nil {
+			return structs.NewError(structs.ErrCodePermissionDenied, "%s: Cannot copy root ACL", permissionDenied)
+		}
+
+		// Keep the old ID of a rotated token for the grace period.
+		// Older servers would remove it at once, so it is removed at
+		// once until they all support the grace period.
+		state := a.srv.fsm.State()
+		if args.Op == structs.ACLRotate {
+			enabled, err := state.FeatureEnabled(structs.FeatureACLRotateGrace)
+			if err != nil {
+				return err
+			}
+			if enabled {
+				args.GracePeriod = a.srv.config.ACLRotateGracePeriod
+			}
+		}
+
+		// Generate the new ID before appending to the raft log,
+		// for the same reason as with a set
+		for {
+			args.NewID = generateUUID()
+			_, acl, err := state.ACLGet(args.NewID)
+			if err != nil {
+				a.srv.logger.Printf("[ERR] consul.acl: ACL lookup failed: %v", err)
+				return err
+			}
+			if acl == nil {
+				break
+			}
 		}
 
 	default:
@@ -154,6 +191,10 @@ func (a *ACL) GetPolicy(args *structs.ACLPolicyRequest, reply *structs.ACLPolicy
 		return err
 	}
 
+	// The servers fetch the policy of a token as they resolve it, so
+	// this records its use across the datacenters
+	a.srv.trackACLUsage(args.ACL)
+
 	// Generate an ETag
 	conf := a.srv.config
 	etag := fmt.Sprintf("%s:%s", parent, policy.ID)
@@ -464,3 +464,93 @@ func TestACLEndpoint_List_Denied(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 }
+
+func TestACLEndpoint_Apply_CloneRotate(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLRotateGracePeriod = 500 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureACLRotateGrace)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Clone the token
+	arg.Op = structs.ACLClone
+	arg.ACL = structs.ACL{ID: id}
+	var clone string
+	if err := client.Call("ACL.Apply", &arg, &clone); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if clone == "" || clone == id {
+		t.Fatalf("bad: %v", clone)
+	}
+
+	// Rotate the original
+	arg.Op = structs.ACLRotate
+	var rotated string
+	if err := client.Call("ACL.Apply", &arg, &rotated); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rotated == "" || rotated == id || rotated == clone {
+		t.Fatalf("bad: %v", rotated)
+	}
+
+	// The old ID remains valid for the grace period
+	state := s1.fsm.State()
+	_, acl, err := state.ACLGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl == nil || acl.ExpireTime.IsZero() {
+		t.Fatalf("bad: %v", acl)
+	}
+	for _, newID := range []string{clone, rotated} {
+		_, acl, err := state.ACLGet(newID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if acl == nil || acl.Name != "User token" || acl.Rules != testACLPolicy {
+			t.Fatalf("bad: %v", acl)
+		}
+	}
+
+	// The leader deletes it once expired
+	testutil.WaitForResult(func() (bool, error) {
+		_, acl, err := state.ACLGet(id)
+		return acl == nil, err
+	}, func(err error) {
+		t.Fatalf("should be rotated: %v", err)
+	})
+
+	// Cannot copy the root token
+	arg.Op = structs.ACLClone
+	arg.ACL = structs.ACL{ID: "deny"}
+	err = client.Call("ACL.Apply", &arg, &clone)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// runACLExpiration is a long running routine used by the leader of the
+// ACL datacenter to delete the old IDs of rotated tokens once their grace
+// period is over
+func (s *Server) runACLExpiration(stopCh chan struct{}) {
+	notifyCh := make(chan struct{}, 1)
+	for {
+		state := s.fsm.State()
+		tables := state.QueryTables("ACLList")
+		state.Watch(tables, notifyCh)
+
+		var timeout <-chan time.Time
+		next, err := s.expireACLs()
+		if err != nil {
+			s.logger.Printf("[ERR] consul.acl: Failed to expire rotated tokens: %v", err)
+			timeout = time.After(aclUsageFlushInterval)
+		} else if !next.IsZero() {
+			timeout = time.After(next.Sub(time.Now()))
+		}
+
+		select {
+		case <-notifyCh:
+		case <-timeout:
+		case <-state.AbandonCh():
+		case <-stopCh:
+			state.StopWatch(tables, notifyCh)
+			return
+		case <-s.shutdownCh:
+			state.StopWatch(tables, notifyCh)
+			return
+		}
+		state.StopWatch(tables, notifyCh)
+	}
+}
+
+// expireACLs is used to delete the tokens that have expired, and returns
+// when the next token expires, or the zero time if none will
+func (s *Server) expireACLs() (time.Time, error) {
+	_, acls, err := s.fsm.State().ACLList()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var next time.Time
+	now := time.Now()
+	for _, acl := range acls {
+		if acl.ExpireTime.IsZero() {
+			continue
+		}
+		if !acl.Expired(now) {
+			if next.IsZero() || acl.ExpireTime.Before(next) {
+				next = acl.ExpireTime
+			}
+			continue
+		}
+
+		req := structs.ACLRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.ACLDelete,
+			ACL:        structs.ACL{ID: acl.ID},
+		}
+		resp, err := s.raftApply(structs.ACLRequestType, &req)
+		if err == nil {
+			if respErr, ok := resp.(error); ok {
+				err = respErr
+			}
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		s.aclAuthCache.ClearACL(acl.ID)
+		s.logger.Printf("[INFO] consul.acl: Deleted rotated token '%s' after its grace period", acl.Name)
+	}
+	return next, nil
+}
@@ -119,6 +119,247 @@ func TestACL_Authority_Found(t *testing.T) {
 	}
 }
 
+func TestACL_Authority_ClusterConfigDefault(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1" // Enable ACLs!
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureClusterConfig)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Create a new token
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The configured default policy allows services
+	acl, err := s1.resolveToken(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !acl.ServiceRead("db") {
+		t.Fatalf("unexpected failed read")
+	}
+
+	// Deny by default in the cluster config
+	conf := structs.ClusterConfigRequest{
+		Datacenter:   "dc1",
+		Config:       structs.ClusterConfig{ACLDefaultPolicy: "deny"},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out struct{}
+	if err := client.Call("Operator.ClusterConfigSet", &conf, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The policy of the cluster config takes precedence
+	testutil.WaitForResult(func() (bool, error) {
+		acl, err = s1.resolveToken(id)
+		if err != nil {
+			return false, err
+		}
+		return !acl.ServiceRead("db"), nil
+	}, func(err error) {
+		t.Fatalf("unexpected read: %v", err)
+	})
+	if !acl.KeyRead("foo/test") {
+		t.Fatalf("unexpected failed read")
+	}
+
+	// The parent of the policy served to other datacenters is the same
+	get := structs.ACLPolicyRequest{Datacenter: "dc1", ACL: id}
+	var policy structs.ACLPolicy
+	if err := client.Call("ACL.GetPolicy", &get, &policy); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if policy.Parent != "deny" {
+		t.Fatalf("bad: %v", policy)
+	}
+
+	// Invalid policies are rejected
+	conf.Config.ACLDownPolicy = "bogus"
+	if err := client.Call("Operator.ClusterConfigSet", &conf, &out); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestACL_Usage(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1" // Enable ACLs!
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create a new token
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wait for the leader to enable the usage records
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureACLUsage)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// The token has not been used
+	state := s1.fsm.State()
+	_, token, err := state.ACLGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token.LastUsedIndex != 0 {
+		t.Fatalf("bad: %v", token)
+	}
+
+	// Resolve the token and record its use
+	if _, err := s1.resolveToken(id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.flushACLUsage(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, token, err = state.ACLGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token.LastUsedIndex == 0 || token.LastUsedTime.IsZero() {
+		t.Fatalf("bad: %v", token)
+	}
+	if token.LastUsedIndex <= token.ModifyIndex {
+		t.Fatalf("bad: %v", token)
+	}
+
+	// Another use within the interval is not recorded again
+	last := token.LastUsedIndex
+	if _, err := s1.resolveToken(id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.flushACLUsage(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, token, err = state.ACLGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token.LastUsedIndex != last {
+		t.Fatalf("bad: %v", token)
+	}
+}
+
+func TestACL_Authority_Compiled(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1" // Enable ACLs!
+		c.ACLMasterToken = "root"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create a new token
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testACLPolicy,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Resolve the token, should populate the compiled cache
+	acl1, err := s1.resolveToken(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, token, err := s1.fsm.State().ACLGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := s1.aclCompiled.Get(aclCompiledID(id, token.ModifyIndex)); !ok {
+		t.Fatalf("should be cached")
+	}
+
+	// Resolving again should return the same compiled ACL
+	acl2, err := s1.resolveToken(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl1 != acl2 {
+		t.Fatalf("should be cached")
+	}
+
+	// Update the rules of the token
+	arg.ACL.ID = id
+	arg.ACL.Rules = `key "bar/" { policy = "read" }`
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Table changes should purge the cache
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.aclCompiled.Len() == 0, nil
+	}, func(err error) {
+		t.Fatalf("compiled cache not purged")
+	})
+
+	// The new rules should be used
+	acl3, err := s1.resolveToken(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if acl3.KeyRead("foo/test") {
+		t.Fatalf("unexpected read")
+	}
+	if !acl3.KeyRead("bar/test") {
+		t.Fatalf("unexpected failed read")
+	}
+}
+
 func TestACL_Authority_Anonymous_Found(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1" // Enable ACLs!
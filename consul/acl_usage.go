@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// aclUsageInterval is the minimum time between recording uses of
+	// the same token, which bounds the Raft writes made by busy tokens
+	aclUsageInterval = 10 * time.Minute
+
+	// aclUsageFlushInterval is how often the tokens used since the
+	// last flush are recorded by the leader of the ACL datacenter
+	aclUsageFlushInterval = time.Minute
+)
+
+// aclUsage tracks the tokens resolved by the leader of the ACL
+// datacenter, either for itself or for the servers fetching their
+// policies, so that their use can be recorded
+type aclUsage struct {
+	// recorded is the last time the use of each token was recorded
+	recorded map[string]time.Time
+
+	// pending are the tokens used since the last flush
+	pending map[string]struct{}
+
+	l sync.Mutex
+}
+
+// newACLUsage returns an empty usage tracker
+func newACLUsage() *aclUsage {
+	return &aclUsage{
+		recorded: make(map[string]time.Time),
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// trackACLUsage is used to note the use of a token. The use is recorded
+// by the next flush, unless it was recorded within aclUsageInterval.
+func (s *Server) trackACLUsage(id string) {
+	s.aclUsage.l.Lock()
+	defer s.aclUsage.l.Unlock()
+	if last, ok := s.aclUsage.recorded[id]; ok && time.Since(last) < aclUsageInterval {
+		return
+	}
+	s.aclUsage.recorded[id] = time.Now()
+	s.aclUsage.pending[id] = struct{}{}
+}
+
+// flushACLUsage is used to record the pending uses of tokens. Only the
+// leader records them, once every server supports the records, and the
+// entries are ignored by older servers. Otherwise, or on failure, the
+// tokens are tracked again by their next use.
+func (s *Server) flushACLUsage() error {
+	s.aclUsage.l.Lock()
+	ids := make([]string, 0, len(s.aclUsage.pending))
+	for id := range s.aclUsage.pending {
+		ids = append(ids, id)
+	}
+	s.aclUsage.pending = make(map[string]struct{})
+
+	// Forget old records, so the map does not grow with every token
+	// ever used
+	for id, last := range s.aclUsage.recorded {
+		if time.Since(last) >= aclUsageInterval {
+			delete(s.aclUsage.recorded, id)
+		}
+	}
+	s.aclUsage.l.Unlock()
+
+	if len(ids) == 0 {
+		return nil
+	}
+	err := s.applyACLUsage(ids)
+	if err != nil {
+		s.aclUsage.l.Lock()
+		for _, id := range ids {
+			delete(s.aclUsage.recorded, id)
+		}
+		s.aclUsage.l.Unlock()
+	}
+	return err
+}
+
+// applyACLUsage is used to commit the uses of the given tokens
+func (s *Server) applyACLUsage(ids []string) error {
+	if !s.IsLeader() {
+		return fmt.Errorf("Not the leader")
+	}
+	if err := s.requireFeature(structs.FeatureACLUsage); err != nil {
+		return err
+	}
+
+	args := structs.ACLUsageRequest{
+		Datacenter: s.config.Datacenter,
+		IDs:        ids,
+	}
+	resp, err := s.raftApply(structs.ACLUsageRequestType|structs.IgnoreUnknownTypeFlag, &args)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// runACLUsage is a long running routine that periodically records the
+// uses of tokens
+func (s *Server) runACLUsage() {
+	for {
+		select {
+		case <-time.After(aclUsageFlushInterval):
+			if err := s.flushACLUsage(); err != nil {
+				s.logger.Printf("[ERR] consul.acl: Failed to record token usage: %v", err)
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
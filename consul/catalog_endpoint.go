@@ -9,6 +9,16 @@ import (
 	"github.com/hashicorp/consul/consul/structs"
 )
 
+const (
+	// maxNodeMetaPairs is the maximum number of metadata pairs of a node
+	maxNodeMetaPairs = 64
+
+	// maxNodeMetaKeyLen and maxNodeMetaValueLen bound the size of a
+	// metadata pair
+	maxNodeMetaKeyLen   = 128
+	maxNodeMetaValueLen = 512
+)
+
 // Catalog endpoint is used to manipulate the service catalog
 type Catalog struct {
 	srv *Server
@@ -25,6 +35,18 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 	if args.Node == "" || args.Address == "" {
 		return fmt.Errorf("Must provide node and address")
 	}
+	if err := validateNodeMeta(args.NodeMeta); err != nil {
+		return err
+	}
+	if args.NodeID != "" && !structs.ValidNodeID(args.NodeID) {
+		return fmt.Errorf("Invalid node ID '%s', must be a UUID", args.NodeID)
+	}
+	switch args.Source {
+	case "", structs.RegistrationSourceAgent, structs.RegistrationSourceAPI,
+		structs.RegistrationSourceExternal:
+	default:
+		return fmt.Errorf("Invalid registration source '%s'", args.Source)
+	}
 
 	if args.Service != nil {
 		// If no service id, but service name, use default
@@ -36,6 +58,9 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 		if args.Service.ID != "" && args.Service.Service == "" {
 			return fmt.Errorf("Must provide service name with ID")
 		}
+		if err := validateServiceAddresses(args.Service.Addresses); err != nil {
+			return err
+		}
 
 		// Apply the ACL policy if any
 		// The 'consul' service is excluded since it is managed
@@ -63,6 +88,28 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 		if check.Node == "" {
 			check.Node = args.Node
 		}
+		check.Output = truncateOutput(check.Output, c.srv.config.CheckOutputMaxSize)
+	}
+
+	// Older servers would register namespaced entries over those of the
+	// default namespace
+	namespaced := args.Service != nil && args.Service.Namespace != ""
+	for _, check := range args.Checks {
+		if check.Namespace != "" {
+			namespaced = true
+		}
+	}
+	if namespaced {
+		if err := c.srv.requireFeature(structs.FeatureNamespaces); err != nil {
+			return err
+		}
+	}
+
+	// Enforce the registration policy
+	if v := c.srv.config.RegistrationValidator; v != nil {
+		if err := v.ValidateRegistration(args); err != nil {
+			return err
+		}
 	}
 
 	_, err := c.srv.raftApply(structs.RegisterRequestType, args)
@@ -74,6 +121,77 @@ func (c *Catalog) Register(args *structs.RegisterRequest, reply *struct{}) error
 	return nil
 }
 
+// validateNodeMeta is used to verify the metadata of a node
+func validateNodeMeta(meta map[string]string) error {
+	if len(meta) > maxNodeMetaPairs {
+		return fmt.Errorf("Node metadata cannot contain more than %d pairs", maxNodeMetaPairs)
+	}
+	for k, v := range meta {
+		if k == "" {
+			return fmt.Errorf("Node metadata keys cannot be blank")
+		}
+		if len(k) > maxNodeMetaKeyLen {
+			return fmt.Errorf("Node metadata key '%s' is longer than %d characters", k, maxNodeMetaKeyLen)
+		}
+		if len(v) > maxNodeMetaValueLen {
+			return fmt.Errorf("Node metadata value of '%s' is longer than %d characters", k, maxNodeMetaValueLen)
+		}
+	}
+	return nil
+}
+
+// UpdateCheck is used to update the status and output of a registered
+// check, without sending the full registration
+func (c *Catalog) UpdateCheck(args *structs.CheckUpdateRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("Catalog.UpdateCheck", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "update_check"}, time.Now())
+
+	// Verify the args
+	if args.Node == "" || args.CheckID == "" {
+		return fmt.Errorf("Must provide node and check ID")
+	}
+	switch args.Status {
+	case structs.HealthPassing, structs.HealthWarning, structs.HealthCritical:
+	default:
+		return fmt.Errorf("Invalid check status '%s'", args.Status)
+	}
+	args.Output = truncateOutput(args.Output, c.srv.config.CheckOutputMaxSize)
+
+	// Apply the ACL policy of the service of the check, like a
+	// registration of the check along with its service would
+	state := c.srv.fsm.State()
+	_, checks := state.NodeChecks(args.Node)
+	for _, check := range checks {
+		if check.CheckID != args.CheckID || check.ServiceName == "" {
+			continue
+		}
+		acl, err := c.srv.resolveToken(args.Token)
+		if err != nil {
+			return err
+		} else if acl != nil && !acl.ServiceWrite(check.ServiceName) {
+			c.srv.logger.Printf("[WARN] consul.catalog: Update of check '%s' on '%s' denied due to ACLs",
+				args.CheckID, args.Node)
+			return permissionDeniedErr
+		}
+	}
+
+	if err := c.srv.requireFeature(structs.FeatureCheckUpdate); err != nil {
+		return err
+	}
+
+	resp, err := c.srv.raftApply(structs.CheckUpdateRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: UpdateCheck failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
 // Deregister is used to remove a service registration for a given node.
 func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) error {
 	if done, err := c.srv.forward("Catalog.Deregister", args, args, reply); done {
@@ -82,15 +200,114 @@ func (c *Catalog) Deregister(args *structs.DeregisterRequest, reply *struct{}) e
 	defer metrics.MeasureSince([]string{"consul", "catalog", "deregister"}, time.Now())
 
 	// Verify the args
+	if args.Node == "" && args.ServiceName == "" {
+		return fmt.Errorf("Must provide node or service name")
+	}
+	if args.Namespace != "" && (args.Node == "" || (args.ServiceID == "" && args.CheckID == "")) {
+		return fmt.Errorf("Must provide node and service or check ID in a namespace")
+	}
+
+	// Older servers would deregister the entry of the default namespace
+	if args.Namespace != "" {
+		if err := c.srv.requireFeature(structs.FeatureNamespaces); err != nil {
+			return err
+		}
+	}
+
+	// Older servers would apply a deregistration without a node to an
+	// empty node name instead of to every instance of the service
 	if args.Node == "" {
-		return fmt.Errorf("Must provide node")
+		if err := c.srv.requireFeature(structs.FeatureDeregisterService); err != nil {
+			return err
+		}
 	}
 
-	_, err := c.srv.raftApply(structs.DeregisterRequestType, args)
+	resp, err := c.srv.raftApply(structs.DeregisterRequestType, args)
 	if err != nil {
 		c.srv.logger.Printf("[ERR] consul.catalog: Deregister failed: %v", err)
 		return err
 	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// Drain is used to start or stop draining a node. A draining node stays
+// in the catalog, but is no longer returned by health queries or DNS.
+// Draining requires operator write, since it affects every service of
+// the node.
+func (c *Catalog) Drain(args *structs.NodeDrainRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("Catalog.Drain", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "drain"}, time.Now())
+
+	// Verify the args
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	// Check ACLs
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		c.srv.logger.Printf("[WARN] consul.catalog: Drain of '%s' denied due to ACLs", args.Node)
+		return permissionDeniedErr
+	}
+
+	if err := c.srv.requireFeature(structs.FeatureNodeDrain); err != nil {
+		return err
+	}
+
+	resp, err := c.srv.raftApply(structs.NodeDrainRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: Drain failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// Protect is used to protect a node from deregistration, or to lift the
+// protection. A protected node is only deregistered when forced.
+func (c *Catalog) Protect(args *structs.NodeProtectRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("Catalog.Protect", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "protect"}, time.Now())
+
+	// Verify the args
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	// Check ACLs
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		c.srv.logger.Printf("[WARN] consul.catalog: Protect of '%s' denied due to ACLs", args.Node)
+		return permissionDeniedErr
+	}
+
+	if err := c.srv.requireFeature(structs.FeatureNodeProtect); err != nil {
+		return err
+	}
+
+	resp, err := c.srv.raftApply(structs.NodeProtectRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.catalog: Protect failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
 	return nil
 }
 
@@ -165,9 +382,9 @@ func (c *Catalog) ServiceNodes(args *structs.ServiceSpecificRequest, reply *stru
 		state.QueryTables("ServiceNodes"),
 		func() error {
 			if args.TagFilter {
-				reply.Index, reply.ServiceNodes = state.ServiceTagNodes(args.ServiceName, args.ServiceTag)
+				reply.Index, reply.ServiceNodes = state.ServiceTagNodes(args.ServiceName, args.ServiceTag, args.NodeMetaFilters)
 			} else {
-				reply.Index, reply.ServiceNodes = state.ServiceNodes(args.ServiceName)
+				reply.Index, reply.ServiceNodes = state.ServiceNodes(args.ServiceName, args.NodeMetaFilters)
 			}
 			return c.srv.filterACL(args.Token, reply)
 		})
@@ -206,3 +423,189 @@ func (c *Catalog) NodeServices(args *structs.NodeSpecificRequest, reply *structs
 			return c.srv.filterACL(args.Token, reply)
 		})
 }
+
+// NodeLastSeen returns when a node was last seen alive by the leader
+func (c *Catalog) NodeLastSeen(args *structs.NodeSpecificRequest, reply *structs.IndexedNodeSeen) error {
+	if done, err := c.srv.forward("Catalog.NodeLastSeen", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	// Get the time the node was last seen
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("NodeLastSeen"),
+		func() error {
+			var err error
+			reply.Index, reply.NodeSeen, err = state.NodeLastSeen(args.Node)
+			return err
+		})
+}
+
+// NodeInfoHash returns a hash of the services and checks of a node. This
+// allows an agent to detect that its view of the catalog is out of sync
+// without downloading all of the services and checks of the node.
+func (c *Catalog) NodeInfoHash(args *structs.NodeSpecificRequest, reply *structs.IndexedNodeInfoHash) error {
+	if done, err := c.srv.forward("Catalog.NodeInfoHash", args, args, reply); done {
+		return err
+	}
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	// Get the node hash
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("NodeInfo"),
+		func() error {
+			reply.Index, reply.Hash = state.NodeInfoHash(args.Node)
+			return nil
+		})
+}
+
+// NodeSyncDiff compares the hashes of the services and checks of an agent
+// against the catalog, and returns those the agent must sync. This spares
+// the agent from fetching all of the services and checks of its node on
+// every anti-entropy run.
+func (c *Catalog) NodeSyncDiff(args *structs.NodeSyncRequest, reply *structs.IndexedNodeSyncDiff) error {
+	if done, err := c.srv.forward("Catalog.NodeSyncDiff", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "catalog", "node_sync_diff"}, time.Now())
+
+	// Verify the arguments
+	if args.Node == "" {
+		return fmt.Errorf("Must provide node")
+	}
+
+	// Get the node info
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("NodeInfo"),
+		func() error {
+			var dump structs.IndexedNodeDump
+			reply.Index, dump.Dump = state.NodeInfo(args.Node)
+
+			// Leave out the services and checks the token cannot read,
+			// so they are registered again with the token of the agent
+			if err := c.srv.filterACL(args.Token, &dump); err != nil {
+				return err
+			}
+			var info *structs.NodeInfo
+			if len(dump.Dump) > 0 {
+				info = dump.Dump[0]
+			}
+			reply.Diff = nodeSyncDiff(args, info)
+			return nil
+		})
+}
+
+// nodeSyncDiff is used to compare the hashes of an agent against the
+// services and checks of its node, which is nil if it is not registered
+func nodeSyncDiff(args *structs.NodeSyncRequest, info *structs.NodeInfo) structs.NodeSyncDiff {
+	services := make(map[string]*structs.NodeService)
+	checks := make(map[string]*structs.HealthCheck)
+	if info != nil {
+		for _, service := range info.Services {
+			services[service.ID] = service
+		}
+		for _, check := range info.Checks {
+			checks[check.CheckID] = check
+		}
+	}
+
+	var diff structs.NodeSyncDiff
+	for id, local := range args.Services {
+		remote, ok := services[id]
+		if !ok {
+			diff.SyncServices = append(diff.SyncServices, id)
+			continue
+		}
+		if local.IgnoreTags {
+			if diff.ServiceTags == nil {
+				diff.ServiceTags = make(map[string][]string)
+			}
+			diff.ServiceTags[id] = remote.Tags
+		}
+		if remote.SyncHash(local.IgnoreTags) != local.Hash {
+			diff.SyncServices = append(diff.SyncServices, id)
+		}
+	}
+	for id, remote := range services {
+		// Services owned by an external tool are left alone
+		if remote.Source == structs.RegistrationSourceExternal {
+			continue
+		}
+		if _, ok := args.Services[id]; !ok {
+			diff.DeleteServices = append(diff.DeleteServices, id)
+		}
+	}
+
+	for id, local := range args.Checks {
+		remote, ok := checks[id]
+		switch {
+		case !ok || remote.SyncHash() != local.Hash:
+			diff.SyncChecks = append(diff.SyncChecks, id)
+		case remote.StatusHash(args.IgnoreCheckOutput) != local.StatusHash:
+			diff.SyncCheckStatuses = append(diff.SyncCheckStatuses, id)
+		}
+	}
+	for id, remote := range checks {
+		// The Serf check is created automatically, and is not
+		// registered by the agent
+		if id == SerfCheckID {
+			continue
+		}
+		if remote.Source == structs.RegistrationSourceExternal {
+			continue
+		}
+		if _, ok := args.Checks[id]; !ok {
+			diff.DeleteChecks = append(diff.DeleteChecks, id)
+		}
+	}
+
+	sort.Strings(diff.SyncServices)
+	sort.Strings(diff.DeleteServices)
+	sort.Strings(diff.SyncChecks)
+	sort.Strings(diff.SyncCheckStatuses)
+	sort.Strings(diff.DeleteChecks)
+	return diff
+}
+
+// Events returns the audit trail of registrations and deregistrations
+// applied to the catalog, optionally limited to a single node. The trail
+// identifies the tokens used, so it requires operator read privileges.
+func (c *Catalog) Events(args *structs.NodeSpecificRequest, reply *structs.IndexedCatalogEvents) error {
+	if done, err := c.srv.forward("Catalog.Events", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	// Get the events
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("CatalogEvents"),
+		func() error {
+			var err error
+			reply.Index, reply.Events, err = state.CatalogEvents(args.Node)
+			return err
+		})
+}
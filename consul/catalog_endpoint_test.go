@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/rpc"
 	"os"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -100,6 +101,205 @@ func TestCatalogRegister_ACLDeny(t *testing.T) {
 	}
 }
 
+func TestCatalogDrain_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureNodeDrain)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Create a token that can register services, but not drain
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testRegisterRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	argR := structs.RegisterRequest{
+		Datacenter:   "dc1",
+		Node:         "foo",
+		Address:      "127.0.0.1",
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out struct{}
+	if err := client.Call("Catalog.Register", &argR, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	argD := structs.NodeDrainRequest{
+		Datacenter:   "dc1",
+		Node:         "foo",
+		Drain:        true,
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	err := client.Call("Catalog.Drain", &argD, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	argD.Token = "root"
+	if err := client.Call("Catalog.Drain", &argD, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogProtect_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureNodeProtect)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Create a token that can register services, but not protect
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testRegisterRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	argR := structs.RegisterRequest{
+		Datacenter:   "dc1",
+		Node:         "foo",
+		Address:      "127.0.0.1",
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var out struct{}
+	if err := client.Call("Catalog.Register", &argR, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	argP := structs.NodeProtectRequest{
+		Datacenter:   "dc1",
+		Node:         "foo",
+		Protected:    true,
+		WriteRequest: structs.WriteRequest{Token: id},
+	}
+	err := client.Call("Catalog.Protect", &argP, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	argP.Token = "root"
+	if err := client.Call("Catalog.Protect", &argP, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogRegister_Validator(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.RegistrationValidator = &RegistrationPolicy{
+			ReservedServices: []string{"vault"},
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			Service: "vault",
+			Port:    8200,
+		},
+	}
+	var out struct{}
+	err := client.Call("Catalog.Register", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "is reserved") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nothing should be registered
+	state := s1.fsm.State()
+	if _, found, _ := state.GetNode("foo"); found {
+		t.Fatalf("should not be registered")
+	}
+
+	// Valid registrations are allowed
+	arg.Service.Service = "db"
+	if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCatalogRegister_CheckOutput(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CheckOutputMaxSize = 8
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			CheckID: "mem",
+			Name:    "memory utilization",
+			Status:  structs.HealthPassing,
+			Output:  "used 20% of the available memory",
+		},
+	}
+	var out struct{}
+	if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The output should be truncated
+	_, checks := s1.fsm.State().NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Output != "used 20%" {
+		t.Fatalf("bad: %v", checks)
+	}
+}
+
 func TestCatalogRegister_ForwardLeader(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -208,6 +408,101 @@ func TestCatalogDeregister(t *testing.T) {
 	}
 }
 
+func TestCatalogRegister_Namespace(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureNamespaces)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Register the same service in the default namespace and in a team's
+	var out struct{}
+	for _, namespace := range []string{"", "team"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service:   "db",
+				Port:      8000,
+				Namespace: namespace,
+			},
+		}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Deregistering the namespaced entry leaves the other one
+	arg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		ServiceID:  "db",
+		Namespace:  "team",
+	}
+	if err := client.Call("Catalog.Deregister", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	if _, nodes := state.NamespaceServiceNodes("team", "db", nil); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	if _, nodes := state.ServiceNodes("db", nil); len(nodes) != 1 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestCatalogDeregister_Service(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureDeregisterService)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Register the service on two nodes
+	var out struct{}
+	for _, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				Service: "db",
+				Port:    8000,
+			},
+		}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Deregister every instance
+	arg := structs.DeregisterRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	if err := client.Call("Catalog.Deregister", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, nodes := s1.fsm.State().ServiceNodes("db", nil); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestCatalogListDatacenters(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -266,7 +561,7 @@ func TestCatalogListNodes(t *testing.T) {
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	testutil.WaitForResult(func() (bool, error) {
 		client.Call("Catalog.ListNodes", &args, &out)
@@ -316,12 +611,12 @@ func TestCatalogListNodes_StaleRaad(t *testing.T) {
 		client = client1
 
 		// Inject fake data on the follower!
-		s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+		s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	} else {
 		client = client2
 
 		// Inject fake data on the follower!
-		s2.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+		s2.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	}
 
 	args := structs.DCSpecificRequest{
@@ -457,7 +752,7 @@ func BenchmarkCatalogListNodes(t *testing.B) {
 	defer client.Close()
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	args := structs.DCSpecificRequest{
 		Datacenter: "dc1",
@@ -489,8 +784,8 @@ func TestCatalogListServices(t *testing.T) {
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""})
 
 	if err := client.Call("Catalog.ListServices", &args, &out); err != nil {
 		t.Fatalf("err: %v", err)
@@ -543,8 +838,8 @@ func TestCatalogListServices_Blocking(t *testing.T) {
 	start := time.Now()
 	go func() {
 		time.Sleep(100 * time.Millisecond)
-		s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-		s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+		s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+		s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""})
 	}()
 
 	// Re-run the query
@@ -624,8 +919,8 @@ func TestCatalogListServices_Stale(t *testing.T) {
 	var out structs.IndexedServices
 
 	// Inject a fake service
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""})
 
 	// Run the query, do not wait for leader!
 	if err := client.Call("Catalog.ListServices", &args, &out); err != nil {
@@ -665,8 +960,8 @@ func TestCatalogListServiceNodes(t *testing.T) {
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""})
 
 	if err := client.Call("Catalog.ServiceNodes", &args, &out); err != nil {
 		t.Fatalf("err: %v", err)
@@ -688,6 +983,110 @@ func TestCatalogListServiceNodes(t *testing.T) {
 	}
 }
 
+func TestCatalogListServiceNodes_NodeMeta(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Invalid metadata is rejected
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		NodeMeta:   map[string]string{"": "true"},
+		Service: &structs.NodeService{
+			Service: "db",
+		},
+	}
+	var out struct{}
+	err := client.Call("Catalog.Register", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "cannot be blank") {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg.NodeMeta = map[string]string{"ssd": "true"}
+	if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Node = "bar"
+	arg.NodeMeta = nil
+	if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	args := structs.ServiceSpecificRequest{
+		Datacenter:      "dc1",
+		ServiceName:     "db",
+		NodeMetaFilters: map[string]string{"ssd": "true"},
+	}
+	var nodes structs.IndexedServiceNodes
+	if err := client.Call("Catalog.ServiceNodes", &args, &nodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nodes.ServiceNodes) != 1 || nodes.ServiceNodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	var checkNodes structs.IndexedCheckServiceNodes
+	if err := client.Call("Health.ServiceNodes", &args, &checkNodes); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(checkNodes.Nodes) != 1 || checkNodes.Nodes[0].Node.Node != "foo" {
+		t.Fatalf("bad: %v", checkNodes)
+	}
+}
+
+func TestCatalogNodeLastSeen(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.NodeHeartbeatInterval = 10 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// The leader registers itself, and is then seen alive
+	args := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       s1.config.NodeName,
+	}
+	var out structs.IndexedNodeSeen
+	testutil.WaitForResult(func() (bool, error) {
+		if err := client.Call("Catalog.NodeLastSeen", &args, &out); err != nil {
+			return false, err
+		}
+		return out.NodeSeen != nil, nil
+	}, func(err error) {
+		t.Fatalf("not seen: %v", err)
+	})
+	first := out.NodeSeen.SeenAt
+
+	// Heartbeats keep advancing the time
+	args.MinQueryIndex = out.Index
+	if err := client.Call("Catalog.NodeLastSeen", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.NodeSeen == nil || out.NodeSeen.SeenAt <= first {
+		t.Fatalf("bad: %v", out.NodeSeen)
+	}
+
+	// Unknown nodes were never seen
+	args.Node = "nope"
+	args.MinQueryIndex = 0
+	if err := client.Call("Catalog.NodeLastSeen", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.NodeSeen != nil {
+		t.Fatalf("bad: %v", out.NodeSeen)
+	}
+}
+
 func TestCatalogNodeServices(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -708,9 +1107,9 @@ func TestCatalogNodeServices(t *testing.T) {
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
-	s1.fsm.State().EnsureService(3, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""})
+	s1.fsm.State().EnsureService(3, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false, "", false, "", nil, ""})
 
 	if err := client.Call("Catalog.NodeServices", &args, &out); err != nil {
 		t.Fatalf("err: %v", err)
@@ -946,3 +1345,207 @@ service "foo" {
 	policy = "write"
 }
 `
+
+func TestCatalogRegister_MissingService(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// A check referencing an unknown service should be rejected
+	// before it reaches raft
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Check: &structs.HealthCheck{
+			CheckID:   "db",
+			Name:      "db",
+			ServiceID: "db",
+		},
+	}
+	var out struct{}
+	err := client.Call("Catalog.Register", &arg, &out)
+	if err == nil || err.Error() != "Missing service registration" {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The node should not have been registered
+	state := s1.fsm.State()
+	if _, found, _ := state.GetNode("foo"); found {
+		t.Fatalf("should not be registered")
+	}
+}
+
+func TestCatalogNodeInfoHash(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	args := structs.NodeSpecificRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	var out structs.IndexedNodeInfoHash
+	if err := client.Call("Catalog.NodeInfoHash", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Hash != "" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	state := s1.fsm.State()
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	state.EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""})
+	state.EnsureService(3, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false, "", false, "", nil, ""})
+
+	if err := client.Call("Catalog.NodeInfoHash", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index != 3 || out.Hash == "" {
+		t.Fatalf("bad: %v", out)
+	}
+	hash := out.Hash
+
+	// The hash must match the one computed from the node info
+	_, dump := state.NodeInfo("foo")
+	if dump[0].Hash() != hash {
+		t.Fatalf("bad: %v %v", dump[0].Hash(), hash)
+	}
+
+	// The hash must not depend on the order of the services
+	dump[0].Services[0], dump[0].Services[1] = dump[0].Services[1], dump[0].Services[0]
+	if dump[0].Hash() != hash {
+		t.Fatalf("bad: %v %v", dump[0].Hash(), hash)
+	}
+
+	// Changing a service must change the hash
+	state.EnsureService(4, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 8080, false, "", false, "", nil, ""})
+	if err := client.Call("Catalog.NodeInfoHash", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index != 4 || out.Hash == hash {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestCatalogNodeSyncDiff(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	db := &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""}
+	web := &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false, "", false, "", nil, ""}
+	cache := &structs.NodeService{"cache", "cache", nil, "127.0.0.1", 6379, false, "", false, "", nil, ""}
+	dbCheck := &structs.HealthCheck{Node: "foo", CheckID: "db", Name: "db", Status: structs.HealthPassing, ServiceID: "db", ServiceName: "db"}
+	webCheck := &structs.HealthCheck{Node: "foo", CheckID: "web", Name: "web", Status: structs.HealthPassing, ServiceID: "web", ServiceName: "web"}
+	oldCheck := &structs.HealthCheck{Node: "foo", CheckID: "old", Name: "old", Status: structs.HealthPassing}
+	serfCheck := &structs.HealthCheck{Node: "foo", CheckID: SerfCheckID, Name: SerfCheckName, Status: structs.HealthPassing}
+
+	state := s1.fsm.State()
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	state.EnsureService(2, "foo", db)
+	state.EnsureService(3, "foo", web)
+	state.EnsureService(4, "foo", cache)
+	state.EnsureCheck(5, dbCheck)
+	state.EnsureCheck(6, webCheck)
+	state.EnsureCheck(7, oldCheck)
+	state.EnsureCheck(8, serfCheck)
+
+	// The tags of db were changed through the catalog, the port of web
+	// was changed locally, and api is new
+	localDB := *db
+	localDB.Tags = []string{"secondary"}
+	localDB.EnableTagOverride = true
+	localWeb := *web
+	localWeb.Port = 8080
+	api := &structs.NodeService{"api", "api", nil, "127.0.0.1", 8000, false, "", false, "", nil, ""}
+
+	// The status of db-check changed, and new is new
+	localDBCheck := *dbCheck
+	localDBCheck.Status = structs.HealthCritical
+	newCheck := &structs.HealthCheck{Node: "foo", CheckID: "new", Name: "new", Status: structs.HealthPassing}
+
+	args := structs.NodeSyncRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Services: map[string]structs.NodeSyncService{
+			"db":  {Hash: localDB.SyncHash(true), IgnoreTags: true},
+			"web": {Hash: localWeb.SyncHash(false)},
+			"api": {Hash: api.SyncHash(false)},
+		},
+		Checks: map[string]structs.NodeSyncCheck{
+			"db":  {Hash: localDBCheck.SyncHash(), StatusHash: localDBCheck.StatusHash(false)},
+			"web": {Hash: webCheck.SyncHash(), StatusHash: webCheck.StatusHash(false)},
+			"new": {Hash: newCheck.SyncHash(), StatusHash: newCheck.StatusHash(false)},
+		},
+	}
+	var out structs.IndexedNodeSyncDiff
+	if err := client.Call("Catalog.NodeSyncDiff", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index != 8 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	expected := structs.NodeSyncDiff{
+		SyncServices:      []string{"api", "web"},
+		DeleteServices:    []string{"cache"},
+		ServiceTags:       map[string][]string{"db": []string{"primary"}},
+		SyncChecks:        []string{"new"},
+		SyncCheckStatuses: []string{"db"},
+		DeleteChecks:      []string{"old"},
+	}
+	if !reflect.DeepEqual(out.Diff, expected) {
+		t.Fatalf("bad: %#v", out.Diff)
+	}
+
+	// An unknown node must have everything synced
+	args.Node = "bar"
+	if err := client.Call("Catalog.NodeSyncDiff", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected = structs.NodeSyncDiff{
+		SyncServices: []string{"api", "db", "web"},
+		SyncChecks:   []string{"db", "new", "web"},
+	}
+	if !reflect.DeepEqual(out.Diff, expected) {
+		t.Fatalf("bad: %#v", out.Diff)
+	}
+}
+
+func TestCatalogNodeSyncDiff_External(t *testing.T) {
+	info := &structs.NodeInfo{
+		Node: "foo",
+		Services: []*structs.NodeService{
+			{ID: "web", Service: "web", Source: structs.RegistrationSourceAPI},
+			{ID: "db", Service: "db", Source: structs.RegistrationSourceExternal},
+		},
+		Checks: []*structs.HealthCheck{
+			{Node: "foo", CheckID: "web", Source: structs.RegistrationSourceAgent},
+			{Node: "foo", CheckID: "db", Source: structs.RegistrationSourceExternal},
+		},
+	}
+
+	// Only the entries the agent owns are deleted
+	args := &structs.NodeSyncRequest{Datacenter: "dc1", Node: "foo"}
+	diff := nodeSyncDiff(args, info)
+	expected := structs.NodeSyncDiff{
+		DeleteServices: []string{"web"},
+		DeleteChecks:   []string{"web"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("bad: %#v", diff)
+	}
+}
@@ -0,0 +1,144 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// CheckDefinition endpoint is used to manage the definitions of the
+// checks executed by the leader, for services without an agent
+type CheckDefinition struct {
+	srv *Server
+}
+
+// Apply is used to set or delete a check definition. Deleting a
+// definition also deregisters its check.
+func (c *CheckDefinition) Apply(args *structs.CheckDefinitionRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("CheckDefinition.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "check_definition", "apply"}, time.Now())
+
+	// Verify the args
+	def := &args.Definition
+	if def.Node == "" || def.CheckID == "" {
+		return fmt.Errorf("Must provide node and check ID")
+	}
+	switch args.Op {
+	case structs.CheckDefinitionSet, structs.CheckDefinitionDelete:
+	default:
+		return fmt.Errorf("Invalid check definition operation '%s'", args.Op)
+	}
+
+	// The servers probe the targets of the checks on behalf of the
+	// caller, so managing them requires operator write access
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.OperatorWrite() {
+		c.srv.logger.Printf("[WARN] consul.check_definition: Apply of '%s' on '%s' denied due to ACLs",
+			def.CheckID, def.Node)
+		return permissionDeniedErr
+	}
+
+	if err := c.srv.requireFeature(structs.FeatureCheckDefinitions); err != nil {
+		return err
+	}
+
+	resp, err := c.srv.raftApply(structs.CheckDefinitionRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.check_definition: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	if args.Op != structs.CheckDefinitionDelete {
+		return nil
+	}
+
+	// Remove the check the leader registered for the definition
+	dereg := structs.DeregisterRequest{
+		Datacenter:   args.Datacenter,
+		Node:         def.Node,
+		CheckID:      def.CheckID,
+		WriteRequest: args.WriteRequest,
+	}
+	resp, err = c.srv.raftApply(structs.DeregisterRequestType, &dereg)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.check_definition: Deregister failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// Get is used to get the check definition of a node by check ID
+func (c *CheckDefinition) Get(args *structs.CheckDefinitionQuery,
+	reply *structs.IndexedCheckDefinitions) error {
+	if done, err := c.srv.forward("CheckDefinition.Get", args, args, reply); done {
+		return err
+	}
+	if args.Node == "" || args.CheckID == "" {
+		return fmt.Errorf("Must provide node and check ID")
+	}
+	if err := c.checkRead(args.Token); err != nil {
+		return err
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("CheckDefinitionGet"),
+		func() error {
+			index, def, err := state.CheckDefinitionGet(args.Node, args.CheckID)
+			if err != nil {
+				return err
+			}
+			reply.Index = index
+			if def != nil {
+				reply.Definitions = structs.CheckDefinitions{def}
+			} else {
+				reply.Definitions = nil
+			}
+			return nil
+		})
+}
+
+// List is used to list all the check definitions
+func (c *CheckDefinition) List(args *structs.CheckDefinitionQuery,
+	reply *structs.IndexedCheckDefinitions) error {
+	if done, err := c.srv.forward("CheckDefinition.List", args, args, reply); done {
+		return err
+	}
+	if err := c.checkRead(args.Token); err != nil {
+		return err
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("CheckDefinitionList"),
+		func() error {
+			var err error
+			reply.Index, reply.Definitions, err = state.CheckDefinitionList()
+			return err
+		})
+}
+
+// checkRead is used to verify the token can read the check definitions,
+// whose targets may not be meant to be public
+func (c *CheckDefinition) checkRead(token string) error {
+	acl, err := c.srv.resolveToken(token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+	return nil
+}
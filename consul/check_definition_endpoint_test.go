@@ -0,0 +1,160 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestCheckDefinition_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureCheckDefinitions)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// The leader probes a listener of the test
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "external",
+		Address:    "127.0.0.2",
+	}
+	var out struct{}
+	if err := client.Call("Catalog.Register", &reg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.CheckDefinitionRequest{
+		Datacenter: "dc1",
+		Op:         structs.CheckDefinitionSet,
+		Definition: structs.CheckDefinition{
+			Node:     "external",
+			CheckID:  "tcp",
+			Name:     "TCP",
+			TCP:      list.Addr().String(),
+			Interval: 100 * time.Millisecond,
+		},
+	}
+	if err := client.Call("CheckDefinition.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	get := structs.CheckDefinitionQuery{
+		Datacenter: "dc1",
+		Node:       "external",
+		CheckID:    "tcp",
+	}
+	var defs structs.IndexedCheckDefinitions
+	if err := client.Call("CheckDefinition.Get", &get, &defs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if defs.Index == 0 || len(defs.Definitions) != 1 || defs.Definitions[0].TCP != list.Addr().String() {
+		t.Fatalf("bad: %v", defs)
+	}
+	if err := client.Call("CheckDefinition.List", &structs.CheckDefinitionQuery{Datacenter: "dc1"}, &defs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(defs.Definitions) != 1 {
+		t.Fatalf("bad: %v", defs)
+	}
+
+	// The leader registers the check with its status
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, checks := state.NodeChecks("external")
+		if len(checks) != 1 || checks[0].Status != structs.HealthPassing {
+			return false, fmt.Errorf("bad: %v", checks)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// The status follows the target
+	list.Close()
+	testutil.WaitForResult(func() (bool, error) {
+		_, checks := state.NodeChecks("external")
+		if len(checks) != 1 || checks[0].Status != structs.HealthCritical {
+			return false, fmt.Errorf("bad: %v", checks)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Deleting the definition deregisters the check
+	arg.Op = structs.CheckDefinitionDelete
+	if err := client.Call("CheckDefinition.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, def, err := state.CheckDefinitionGet("external", "tcp"); err != nil || def != nil {
+		t.Fatalf("bad: %v %v", def, err)
+	}
+	if _, checks := state.NodeChecks("external"); len(checks) != 0 {
+		t.Fatalf("bad: %v", checks)
+	}
+}
+
+func TestCheckDefinition_Apply_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	arg := structs.CheckDefinitionRequest{
+		Datacenter: "dc1",
+		Op:         structs.CheckDefinitionSet,
+		Definition: structs.CheckDefinition{
+			Node:     "external",
+			CheckID:  "tcp",
+			TCP:      "127.0.0.1:1",
+			Interval: time.Second,
+		},
+	}
+	var out struct{}
+	err := client.Call("CheckDefinition.Apply", &arg, &out)
+	if err == nil || err.Error() != permissionDenied {
+		t.Fatalf("err: %v", err)
+	}
+
+	get := structs.CheckDefinitionQuery{Datacenter: "dc1"}
+	var defs structs.IndexedCheckDefinitions
+	err = client.Call("CheckDefinition.List", &get, &defs)
+	if err == nil || err.Error() != permissionDenied {
+		t.Fatalf("err: %v", err)
+	}
+}
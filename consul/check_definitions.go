@@ -0,0 +1,206 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// checkDefinitionMinInterval is the minimum interval at which the
+	// leader executes a check definition
+	checkDefinitionMinInterval = time.Second
+
+	// checkDefinitionTimeout is the timeout of the check definitions
+	// that do not set one
+	checkDefinitionTimeout = 10 * time.Second
+)
+
+// runCheckDefinitions is a long running routine used by the leader to
+// execute the check definitions. Each definition is run by a goroutine
+// of its own, which is replaced whenever the definition is updated.
+func (s *Server) runCheckDefinitions(stopCh chan struct{}) {
+	runners := make(map[string]*checkDefinitionRunner)
+	defer func() {
+		for _, r := range runners {
+			close(r.stopCh)
+		}
+	}()
+
+	notifyCh := make(chan struct{}, 1)
+	for {
+		state := s.fsm.State()
+		tables := state.QueryTables("CheckDefinitionList")
+		state.Watch(tables, notifyCh)
+
+		if _, defs, err := state.CheckDefinitionList(); err != nil {
+			s.logger.Printf("[ERR] consul: Failed to list check definitions: %v", err)
+		} else {
+			s.syncCheckDefinitions(runners, defs)
+		}
+
+		select {
+		case <-notifyCh:
+		case <-state.AbandonCh():
+		case <-stopCh:
+			state.StopWatch(tables, notifyCh)
+			return
+		case <-s.shutdownCh:
+			state.StopWatch(tables, notifyCh)
+			return
+		}
+		state.StopWatch(tables, notifyCh)
+	}
+}
+
+// syncCheckDefinitions is used to start a runner for each new or updated
+// definition, and to stop those of the definitions that were removed
+func (s *Server) syncCheckDefinitions(runners map[string]*checkDefinitionRunner, defs structs.CheckDefinitions) {
+	seen := make(map[string]struct{}, len(defs))
+	for _, def := range defs {
+		key := def.Node + "/" + def.CheckID
+		seen[key] = struct{}{}
+		if r, ok := runners[key]; ok {
+			if r.def.ModifyIndex == def.ModifyIndex {
+				continue
+			}
+			close(r.stopCh)
+		}
+		r := &checkDefinitionRunner{
+			srv:    s,
+			def:    def,
+			stopCh: make(chan struct{}),
+		}
+		runners[key] = r
+		go r.run()
+	}
+	for key, r := range runners {
+		if _, ok := seen[key]; !ok {
+			close(r.stopCh)
+			delete(runners, key)
+		}
+	}
+}
+
+// checkDefinitionRunner executes a check definition on the leader, and
+// registers its check with the status of each run that changes it
+type checkDefinitionRunner struct {
+	srv    *Server
+	def    *structs.CheckDefinition
+	stopCh chan struct{}
+
+	// status and output are those last registered
+	status string
+	output string
+}
+
+func (r *checkDefinitionRunner) run() {
+	interval := r.def.Interval
+	if interval < checkDefinitionMinInterval {
+		interval = checkDefinitionMinInterval
+	}
+
+	// Stagger the first run, so the definitions do not all run at once
+	// after a change of leader
+	next := time.After(randomStagger(interval))
+	for {
+		select {
+		case <-next:
+			r.check()
+			next = time.After(interval)
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+// check is used to run the definition once, and to register the result
+// if it changed
+func (r *checkDefinitionRunner) check() {
+	defer metrics.MeasureSince([]string{"consul", "leader", "check_definition"}, time.Now())
+	timeout := r.def.Timeout
+	if timeout <= 0 {
+		timeout = checkDefinitionTimeout
+	}
+
+	var status, output string
+	if r.def.HTTP != "" {
+		status, output = probeHTTP(r.def.HTTP, timeout)
+	} else {
+		status, output = probeTCP(r.def.TCP, timeout)
+	}
+	if status == r.status && output == r.output {
+		return
+	}
+
+	// The check is registered with the node, which must exist
+	state := r.srv.fsm.State()
+	_, found, addr := state.GetNode(r.def.Node)
+	if !found {
+		r.srv.logger.Printf("[WARN] consul: Missing node '%s' of check definition '%s'",
+			r.def.Node, r.def.CheckID)
+		return
+	}
+	req := structs.RegisterRequest{
+		Datacenter: r.srv.config.Datacenter,
+		Node:       r.def.Node,
+		Address:    addr,
+		Check: &structs.HealthCheck{
+			Node:      r.def.Node,
+			CheckID:   r.def.CheckID,
+			Name:      r.def.Name,
+			Notes:     r.def.Notes,
+			ServiceID: r.def.ServiceID,
+			Status:    status,
+			Output:    output,
+		},
+		Source: structs.RegistrationSourceExternal,
+	}
+	resp, err := r.srv.raftApply(structs.RegisterRequestType, &req)
+	if err == nil {
+		if respErr, ok := resp.(error); ok {
+			err = respErr
+		}
+	}
+	if err != nil {
+		r.srv.logger.Printf("[ERR] consul: Failed to update check '%s' on '%s': %v",
+			r.def.CheckID, r.def.Node, err)
+		return
+	}
+	r.status, r.output = status, output
+}
+
+// probeHTTP is used to check an HTTP endpoint. A 2xx response is passing,
+// a 429 Too Many Requests is a warning, and anything else is critical.
+func probeHTTP(url string, timeout time.Duration) (string, string) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return structs.HealthCritical, fmt.Sprintf("HTTP GET %s: %v", url, err)
+	}
+	resp.Body.Close()
+
+	output := fmt.Sprintf("HTTP GET %s: %s", url, resp.Status)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return structs.HealthPassing, output
+	case resp.StatusCode == 429:
+		return structs.HealthWarning, output
+	default:
+		return structs.HealthCritical, output
+	}
+}
+
+// probeTCP is used to check that a TCP address accepts connections
+func probeTCP(addr string, timeout time.Duration) (string, string) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return structs.HealthCritical, fmt.Sprintf("TCP connect %s: %v", addr, err)
+	}
+	conn.Close()
+	return structs.HealthPassing, fmt.Sprintf("TCP connect %s: Success", addr)
+}
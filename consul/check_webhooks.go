@@ -0,0 +1,183 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// checkWebhookQueueSize is the number of check status changes queued
+	// for the webhooks. Changes are dropped while the queue is full.
+	checkWebhookQueueSize = 4096
+
+	// checkWebhookTimeout is the timeout of a single post to a webhook
+	checkWebhookTimeout = 10 * time.Second
+
+	// checkWebhookBackoff is the wait before the first retry of a failed
+	// post, which doubles with each retry
+	checkWebhookBackoff = time.Second
+
+	// checkWebhookBatches is the number of batches of changes queued for
+	// each webhook. Batches are dropped for a webhook while its queue is
+	// full, so a webhook that is down does not hold back the others.
+	checkWebhookBatches = 64
+)
+
+// checkWebhookPayload is the body posted to the check webhooks
+type checkWebhookPayload struct {
+	Datacenter string
+	Changes    []*structs.CheckStatusChange
+}
+
+// checkStatusChanged is invoked by the FSM once a check status change
+// is committed. Every server applies the change, so only the leader
+// queues it for the webhooks.
+func (s *Server) checkStatusChanged(change *structs.CheckStatusChange) {
+	if len(s.config.CheckWebhooks) == 0 || !s.IsLeader() {
+		return
+	}
+
+	select {
+	case s.checkChangeCh <- change:
+	default:
+		metrics.IncrCounter([]string{"consul", "check_webhook", "dropped"}, 1)
+		s.logger.Printf("[WARN] consul: check webhook queue is full, dropping status change of check '%s' on node '%s'",
+			change.CheckID, change.Node)
+	}
+}
+
+// runCheckWebhooks is a long running routine used by the leader to collect
+// the check status changes for the webhooks. Changes are collected for
+// the debounce window, and only the latest status of each check is
+// posted. A check that is back to its previous status is left out. Each
+// webhook is posted to by a goroutine of its own, so slow or failing
+// webhooks do not hold back the collection.
+func (s *Server) runCheckWebhooks(stopCh chan struct{}) {
+	client := &http.Client{Timeout: checkWebhookTimeout}
+	queues := make([]chan []byte, len(s.config.CheckWebhooks))
+	for i, url := range s.config.CheckWebhooks {
+		queues[i] = make(chan []byte, checkWebhookBatches)
+		go s.runCheckWebhook(client, url, queues[i], stopCh)
+	}
+
+	pending := make(map[string]*structs.CheckStatusChange)
+	var order []string
+	var flush <-chan time.Time
+	for {
+		select {
+		case change := <-s.checkChangeCh:
+			key := change.Node + "/" + change.Namespace + "/" + change.CheckID
+			if prev, ok := pending[key]; ok {
+				change.PrevStatus = prev.PrevStatus
+			} else {
+				order = append(order, key)
+			}
+			pending[key] = change
+			if flush == nil {
+				flush = time.After(s.config.CheckWebhookDebounce)
+			}
+
+		case <-flush:
+			changes := make([]*structs.CheckStatusChange, 0, len(order))
+			for _, key := range order {
+				if change := pending[key]; change.Status != change.PrevStatus {
+					changes = append(changes, change)
+				}
+			}
+			pending = make(map[string]*structs.CheckStatusChange)
+			order = nil
+			flush = nil
+
+			if len(changes) > 0 {
+				s.queueCheckWebhooks(queues, changes)
+			}
+
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// queueCheckWebhooks is used to queue the changes for every webhook
+func (s *Server) queueCheckWebhooks(queues []chan []byte, changes []*structs.CheckStatusChange) {
+	payload := checkWebhookPayload{
+		Datacenter: s.config.Datacenter,
+		Changes:    changes,
+	}
+	buf, err := json.Marshal(&payload)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to encode check status changes: %v", err)
+		return
+	}
+
+	for i, queue := range queues {
+		select {
+		case queue <- buf:
+		default:
+			metrics.IncrCounter([]string{"consul", "check_webhook", "dropped"}, float32(len(changes)))
+			s.logger.Printf("[WARN] consul: check webhook %s is falling behind, dropping %d check status changes",
+				s.config.CheckWebhooks[i], len(changes))
+		}
+	}
+}
+
+// runCheckWebhook is a long running routine used by the leader to post
+// the queued changes to a webhook, retrying each failed post with an
+// exponential backoff
+func (s *Server) runCheckWebhook(client *http.Client, url string, queue chan []byte, stopCh chan struct{}) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-queue:
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+
+		for attempt := 0; ; attempt++ {
+			err := postCheckWebhook(client, url, buf)
+			if err == nil {
+				metrics.IncrCounter([]string{"consul", "check_webhook", "posted"}, 1)
+				break
+			}
+			if attempt >= s.config.CheckWebhookRetries {
+				metrics.IncrCounter([]string{"consul", "check_webhook", "failed"}, 1)
+				s.logger.Printf("[ERR] consul: failed to post check status changes to webhook %s: %v",
+					url, err)
+				break
+			}
+			s.logger.Printf("[WARN] consul: failed to post check status changes to webhook %s, retrying: %v",
+				url, err)
+
+			select {
+			case <-time.After(checkWebhookBackoff << uint(attempt)):
+			case <-stopCh:
+				return
+			case <-s.shutdownCh:
+				return
+			}
+		}
+	}
+}
+
+// postCheckWebhook is used to post an encoded payload to a webhook
+func postCheckWebhook(client *http.Client, url string, buf []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
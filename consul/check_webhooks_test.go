@@ -0,0 +1,144 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestCheckWebhooks(t *testing.T) {
+	// The first post fails, so it must be retried
+	posts := make(chan checkWebhookPayload, 4)
+	failed := false
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !failed {
+			failed = true
+			w.WriteHeader(500)
+			return
+		}
+		var payload checkWebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		posts <- payload
+	}))
+	defer hook.Close()
+
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CheckWebhooks = []string{hook.URL}
+		c.CheckWebhookDebounce = 200 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Register two passing checks
+	setStatus := func(checkID, status string) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Check: &structs.HealthCheck{
+				CheckID: checkID,
+				Name:    checkID,
+				Status:  status,
+			},
+		}
+		var out struct{}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	setStatus("mem", structs.HealthPassing)
+	setStatus("disk", structs.HealthPassing)
+
+	// One check fails, while the other flaps back to passing
+	setStatus("mem", structs.HealthCritical)
+	setStatus("disk", structs.HealthWarning)
+	setStatus("disk", structs.HealthPassing)
+
+	select {
+	case payload := <-posts:
+		if payload.Datacenter != "dc1" || len(payload.Changes) != 1 {
+			t.Fatalf("bad: %v", payload)
+		}
+		change := payload.Changes[0]
+		if change.CheckID != "mem" || change.PrevStatus != structs.HealthPassing ||
+			change.Status != structs.HealthCritical {
+			t.Fatalf("bad: %v", change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook not posted")
+	}
+}
+
+func TestCheckWebhooks_Unresponsive(t *testing.T) {
+	// The first webhook never answers, which must not hold back the
+	// second one
+	stuck := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer slow.Close()
+	defer close(stuck)
+
+	posts := make(chan checkWebhookPayload, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload checkWebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		posts <- payload
+	}))
+	defer hook.Close()
+
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.CheckWebhooks = []string{slow.URL, hook.URL}
+		c.CheckWebhookDebounce = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Register a passing check, then fail it
+	for _, status := range []string{structs.HealthPassing, structs.HealthCritical} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Check: &structs.HealthCheck{
+				CheckID: "mem",
+				Name:    "mem",
+				Status:  status,
+			},
+		}
+		var out struct{}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	select {
+	case payload := <-posts:
+		if len(payload.Changes) != 1 || payload.Changes[0].Status != structs.HealthCritical {
+			t.Fatalf("bad: %v", payload)
+		}
+	case <-time.After(checkWebhookTimeout / 2):
+		t.Fatalf("webhook not posted")
+	}
+}
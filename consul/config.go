@@ -7,6 +7,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/tlsutil"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/raft"
@@ -56,6 +57,10 @@ type Config struct {
 	// Node name is the name we use to advertise. Defaults to hostname.
 	NodeName string
 
+	// NodeID is a UUID identifying the node across changes of its name.
+	// It is gossiped so the leader registers the node with it.
+	NodeID string
+
 	// Domain is the DNS domain for the records. Defaults to "consul."
 	Domain string
 
@@ -88,6 +93,11 @@ type Config struct {
 	// logs will go to stderr.
 	LogOutput io.Writer
 
+	// StateLogger, if set, receives the logs of the FSM and the state
+	// store in place of LogOutput, with the context of each message,
+	// such as the index of the log entry being applied, as fields.
+	StateLogger StateLogger
+
 	// ProtocolVersion is the protocol version to speak. This must be between
 	// ProtocolVersionMin and ProtocolVersionMax.
 	ProtocolVersion uint8
@@ -169,6 +179,17 @@ type Config struct {
 	// "allow" can be used to allow all requests. This is not recommended.
 	ACLDownPolicy string
 
+	// ACLEnforceSessionRules enables the session rules of the ACL
+	// policies. Otherwise sessions can be used by any token, as before
+	// the rules were added, so existing tokens keep working under a
+	// default deny policy until they are given session rules.
+	ACLEnforceSessionRules bool
+
+	// ACLRotateGracePeriod is how long the old ID of a rotated token
+	// remains valid, so the agents using it can switch to the new ID
+	// without downtime. If zero, the old ID is removed at once.
+	ACLRotateGracePeriod time.Duration
+
 	// TombstoneTTL is used to control how long KV tombstones are retained.
 	// This provides a window of time where the X-Consul-Index is monotonic.
 	// Outside this window, the index may not be monotonic. This is a result
@@ -192,9 +213,137 @@ type Config struct {
 	// to reduce overhead. It is unlikely a user would ever need to tune this.
 	TombstoneTTLGranularity time.Duration
 
+	// TombstonePrefixTTLs maps KV prefixes to a TTL of their own for the
+	// tombstones under them. This allows hot prefixes with heavy delete
+	// churn, such as ephemeral election keys, to be compacted sooner
+	// than the TombstoneTTL that protects the rest of the keyspace.
+	TombstonePrefixTTLs map[string]time.Duration
+
 	// Minimum Session TTL
 	SessionTTLMin time.Duration
 
+	// WatchCoalesceWindow is used to coalesce the notifications sent to
+	// blocking queries. When set, a burst of writes to the same table or
+	// KV prefix fires the watchers at most once per window, which greatly
+	// reduces spurious wakeups during mass registration events at the cost
+	// of delaying notifications by up to the window. Defaults to zero,
+	// which disables coalescing.
+	WatchCoalesceWindow time.Duration
+
+	// RegistrationValidator, if set, is invoked for every catalog
+	// registration and can reject it, to enforce a naming policy.
+	// Registrations are validated by the leader, so it should be
+	// configured on all the servers to survive a change of leader.
+	RegistrationValidator RegistrationValidator
+
+	// SnapshotWriteRate is the maximum rate in MB/s at which snapshots
+	// are written to disk. Persisting a large snapshot at full speed
+	// can saturate the disk and starve the fsyncs of Raft, stalling
+	// the leader. Defaults to zero, which disables the limit.
+	SnapshotWriteRate int
+
+	// SnapshotEncoding is the encoding of the entries of the snapshots
+	// written. Snapshots record their encoding, and are restored with
+	// it, so every server must support an encoding before it is used.
+	// Defaults to msgpack, which is currently the only encoding.
+	SnapshotEncoding string
+
+	// SnapshotMirror, if set, receives a copy of each snapshot as it is
+	// written, such as for off-site backups. Mirrored snapshots are
+	// always written in full, since the copy cannot resolve the
+	// unchanged sections of an incremental snapshot.
+	SnapshotMirror SnapshotMirror
+
+	// IncrementalSnapshots enables writing the sections of the state
+	// that are unchanged since the previous snapshot as markers, which
+	// are resolved against the sections retained on disk whenever a
+	// snapshot is read. This shrinks the snapshots written when only a
+	// few tables churn, such as the KV store.
+	IncrementalSnapshots bool
+
+	// FSMDecodeWorkers is the number of goroutines decoding log entries
+	// as they are stored, ahead of applying them. Entries are applied in
+	// log order either way, but decoding them while they are replicated
+	// takes the decoding off the serial apply path of the FSM. Defaults
+	// to zero, which decodes each entry as it is applied.
+	FSMDecodeWorkers int
+
+	// FSMSlowApplyThreshold is the duration above which applying a log
+	// entry is logged as a slow operation, with the key or node the entry
+	// involves, and counted in a metric per message type. This pinpoints
+	// the writes that stall the serial apply path of Raft. Defaults to
+	// zero, which disables the logging.
+	FSMSlowApplyThreshold time.Duration
+
+	// FSMSlowApplyThresholds overrides FSMSlowApplyThreshold for the
+	// given message types, such as a higher threshold for KV batches
+	FSMSlowApplyThresholds map[structs.MessageType]time.Duration
+
+	// FSMStallThreshold is the duration without any entry applied, while
+	// committed entries are waiting, above which the FSM is considered
+	// stalled. A stall is logged as a warning, giving early warning of a
+	// wedged server. Defaults to 30 seconds, zero disables the detection.
+	FSMStallThreshold time.Duration
+
+	// CheckOutputMaxSize is the maximum size in bytes of the output of
+	// a health check that is stored. Longer output is truncated by the
+	// leader before it is committed, which limits the cost of checks that
+	// produce a lot of output. Defaults to zero, which does not limit
+	// the output.
+	CheckOutputMaxSize int
+
+	// KVValidateJSON rejects writes of KV entries with a JSON content
+	// type whose value is not valid JSON. Values with an encoding are
+	// not validated. Defaults to false.
+	KVValidateJSON bool
+
+	// CheckWebhooks are the URLs the leader posts the status changes of
+	// the health checks to, as JSON. Changes are collected for
+	// CheckWebhookDebounce before they are posted, so a check that flaps
+	// back to its previous status within that window is not reported.
+	// Failed posts are retried CheckWebhookRetries times with an
+	// exponential backoff. Defaults to 5 seconds and 3 retries.
+	CheckWebhooks        []string
+	CheckWebhookDebounce time.Duration
+	CheckWebhookRetries  int
+
+	// KVReplicationDatacenter, if set, is the primary datacenter the
+	// KV store is replicated from. The leader tails the entries under
+	// KVReplicationSourcePrefix in that datacenter, and applies them
+	// locally under KVReplicationPrefix. The local prefix is owned by
+	// the replicator, so local keys under it that do not exist in the
+	// primary datacenter are deleted.
+	KVReplicationDatacenter   string
+	KVReplicationSourcePrefix string
+	KVReplicationPrefix       string
+
+	// RemoteServiceCacheTTL enables the caching of the stale queries of
+	// the health of services in remote datacenters. Cached queries are
+	// refreshed with blocking queries, and dropped once unused for the
+	// TTL. Defaults to 3 minutes, zero disables the cache.
+	RemoteServiceCacheTTL time.Duration
+
+	// NodeHeartbeatInterval is how often the leader records the nodes
+	// that Serf reports alive in the state store, so the time each node
+	// was last seen can be queried. Defaults to 1 minute, zero disables
+	// the heartbeats.
+	NodeHeartbeatInterval time.Duration
+
+	// KVReplicationToken is the ACL token used to read the entries
+	// from the primary datacenter
+	KVReplicationToken string
+
+	// QueryJitterFraction is the limit of the jitter added to the wait
+	// time of blocking queries, as a fraction of the wait time, so the
+	// queries of many clients started together do not all return at
+	// once. Defaults to 1/16, and zero disables the jitter.
+	QueryJitterFraction float64
+
+	// QueryJitter, if set, returns the jitter added to the wait time of a
+	// blocking query, which must be less than the given limit. This lets
+	// tests make the wait deterministic. Defaults to a random duration.
+	QueryJitter func(limit time.Duration) time.Duration
+
 	// ServerUp callback can be used to trigger a notification that
 	// a Consul server is now up and known about.
 	ServerUp func()
@@ -234,6 +383,22 @@ func (c *Config) CheckACL() error {
 	return nil
 }
 
+// CheckKVReplication is used to sanity check the KV replication
+// configuration. The local prefix is owned by the replicator, so the
+// prefixes cannot be empty, or the whole KV store would be replaced.
+func (c *Config) CheckKVReplication() error {
+	if c.KVReplicationDatacenter == "" || c.KVReplicationDatacenter == c.Datacenter {
+		return nil
+	}
+	if c.KVReplicationSourcePrefix == "" {
+		return fmt.Errorf("KV replication requires a KVReplicationSourcePrefix")
+	}
+	if c.KVReplicationPrefix == "" {
+		return fmt.Errorf("KV replication requires a KVReplicationPrefix")
+	}
+	return nil
+}
+
 // DefaultConfig is used to return a sane default configuration
 func DefaultConfig() *Config {
 	hostname, err := os.Hostname()
@@ -253,9 +418,16 @@ func DefaultConfig() *Config {
 		ACLTTL:                  30 * time.Second,
 		ACLDefaultPolicy:        "allow",
 		ACLDownPolicy:           "extend-cache",
+		ACLRotateGracePeriod:    15 * time.Minute,
 		TombstoneTTL:            15 * time.Minute,
 		TombstoneTTLGranularity: 30 * time.Second,
 		SessionTTLMin:           10 * time.Second,
+		QueryJitterFraction:     1.0 / jitterFraction,
+		CheckWebhookDebounce:    5 * time.Second,
+		CheckWebhookRetries:     3,
+		FSMStallThreshold:       30 * time.Second,
+		RemoteServiceCacheTTL:   3 * time.Minute,
+		NodeHeartbeatInterval:   time.Minute,
 	}
 
 	// Increase our reap interval to 3 days instead of 24h.
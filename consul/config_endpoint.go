@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// ConfigEntry endpoint is used to manage the config entries, which hold
+// the runtime configuration of services and proxies
+type ConfigEntry struct {
+	srv *Server
+}
+
+// Apply is used to set or delete a config entry
+func (c *ConfigEntry) Apply(args *structs.ConfigEntryRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("ConfigEntry.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "config_entry", "apply"}, time.Now())
+
+	// Verify the entry before it is committed, so an invalid entry is
+	// rejected instead of failing to apply
+	if err := validateConfigEntry(&args.Entry); err != nil {
+		return err
+	}
+
+	// Check ACLs. Service defaults follow the rules of their service,
+	// and the other kinds require operator write access.
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil {
+		if args.Entry.Kind == structs.ServiceDefaults {
+			if !acl.ServiceWrite(args.Entry.Name) {
+				return permissionDeniedErr
+			}
+		} else if !acl.OperatorWrite() {
+			return permissionDeniedErr
+		}
+	}
+
+	if err := c.srv.requireFeature(structs.FeatureConfigEntries); err != nil {
+		return err
+	}
+
+	resp, err := c.srv.raftApply(structs.ConfigEntryRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.config_entry: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// Get is used to get a single config entry by kind and name
+func (c *ConfigEntry) Get(args *structs.ConfigEntryQuery,
+	reply *structs.IndexedConfigEntries) error {
+	if done, err := c.srv.forward("ConfigEntry.Get", args, args, reply); done {
+		return err
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("ConfigEntryGet"),
+		func() error {
+			index, entry, err := state.ConfigEntryGet(args.Kind, args.Name)
+			if err != nil {
+				return err
+			}
+			reply.Index = index
+			if entry != nil {
+				reply.Entries = structs.ConfigEntries{entry}
+			} else {
+				reply.Entries = nil
+			}
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
+
+// List is used to list the config entries of a kind, or all of them if
+// no kind is given
+func (c *ConfigEntry) List(args *structs.ConfigEntryQuery,
+	reply *structs.IndexedConfigEntries) error {
+	if done, err := c.srv.forward("ConfigEntry.List", args, args, reply); done {
+		return err
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("ConfigEntryList"),
+		func() error {
+			var err error
+			reply.Index, reply.Entries, err = state.ConfigEntryList(args.Kind)
+			if err != nil {
+				return err
+			}
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
@@ -0,0 +1,159 @@
+package consul
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestConfigEntry_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureConfigEntries)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Invalid entries are rejected
+	arg := structs.ConfigEntryRequest{
+		Datacenter: "dc1",
+		Op:         structs.ConfigEntrySet,
+		Entry: structs.ConfigEntry{
+			Kind: structs.ProxyDefaults,
+			Name: "db",
+		},
+	}
+	var out struct{}
+	err := client.Call("ConfigEntry.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid name") {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg.Entry = structs.ConfigEntry{
+		Kind:   structs.ServiceDefaults,
+		Name:   "db",
+		Config: map[string]string{"protocol": "http"},
+	}
+	if err := client.Call("ConfigEntry.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	get := structs.ConfigEntryQuery{
+		Datacenter: "dc1",
+		Kind:       structs.ServiceDefaults,
+		Name:       "db",
+	}
+	var reply structs.IndexedConfigEntries
+	if err := client.Call("ConfigEntry.Get", &get, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || len(reply.Entries) != 1 ||
+		reply.Entries[0].Config["protocol"] != "http" {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	// Delete the entry
+	arg.Op = structs.ConfigEntryDelete
+	if err := client.Call("ConfigEntry.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.Call("ConfigEntry.Get", &get, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Entries) != 0 {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
+func TestConfigEntry_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureConfigEntries)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Create the ACL
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testRegisterRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The token can only write the defaults of its service
+	entries := []structs.ConfigEntry{
+		{Kind: structs.ServiceDefaults, Name: "foo"},
+		{Kind: structs.ServiceDefaults, Name: "db"},
+		{Kind: structs.ProxyDefaults, Name: structs.ProxyConfigGlobal},
+	}
+	var out struct{}
+	for i, entry := range entries {
+		req := structs.ConfigEntryRequest{
+			Datacenter:   "dc1",
+			Op:           structs.ConfigEntrySet,
+			Entry:        entry,
+			WriteRequest: structs.WriteRequest{Token: id},
+		}
+		err := client.Call("ConfigEntry.Apply", &req, &out)
+		if i == 0 && err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if i > 0 && (err == nil || !strings.Contains(err.Error(), permissionDenied)) {
+			t.Fatalf("err: %v", err)
+		}
+
+		req.WriteRequest.Token = "root"
+		if err := client.Call("ConfigEntry.Apply", &req, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The list is filtered down to the entries the token can read
+	list := structs.ConfigEntryQuery{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: id},
+	}
+	var reply structs.IndexedConfigEntries
+	if err := client.Call("ConfigEntry.List", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Entries) != 1 || reply.Entries[0].Name != "foo" {
+		t.Fatalf("bad: %v", reply.Entries)
+	}
+
+	list.Token = "root"
+	if err := client.Call("ConfigEntry.List", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Entries) != 3 {
+		t.Fatalf("bad: %v", reply.Entries)
+	}
+}
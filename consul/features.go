@@ -0,0 +1,138 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
+)
+
+// supportedFeatures are the features this server supports, which are
+// gossiped in the "features" tag. A feature is enabled for the datacenter
+// once every server gossips it.
+var supportedFeatures = []string{
+	structs.FeatureKVSBatch,
+	structs.FeatureKVSImport,
+	structs.FeatureACLUsage,
+	structs.FeatureClusterConfig,
+	structs.FeatureStateCompact,
+	structs.FeatureNodeNameMerge,
+	structs.FeatureNodeSyncDiff,
+	structs.FeatureKVSLockQueue,
+	structs.FeatureCheckDefinitions,
+	structs.FeatureServiceConfig,
+	structs.FeatureTombstoneReapPrefix,
+	structs.FeatureKVSCASMulti,
+	structs.FeatureACLRotateGrace,
+	structs.FeatureDeregisterService,
+	structs.FeatureNamespaces,
+	structs.FeatureCheckUpdate,
+	structs.FeatureNodeProtect,
+	structs.FeatureKVSIncrement,
+	structs.FeatureKVSSoftDelete,
+	structs.FeatureNodeDrain,
+	structs.FeatureConfigEntries,
+	structs.FeatureUserEvents,
+	structs.FeatureTableRestore,
+}
+
+// featuresTag is used to encode the features for the Serf tag
+func featuresTag(features []string) string {
+	return strings.Join(features, ",")
+}
+
+// parseFeaturesTag is used to decode the features of the Serf tag
+func parseFeaturesTag(tag string) []string {
+	if tag == "" {
+		return nil
+	}
+	return strings.Split(tag, ",")
+}
+
+// commonFeatures returns the features supported by every server of the
+// datacenter among the members. Servers that left are ignored, but failed
+// servers are not, since they may come back running an older version.
+func commonFeatures(members []serf.Member, dc string) []string {
+	var common map[string]struct{}
+	for _, member := range members {
+		valid, parts := isConsulServer(member)
+		if !valid || parts.Datacenter != dc || member.Status == serf.StatusLeft {
+			continue
+		}
+
+		supported := make(map[string]struct{})
+		for _, name := range parts.Features {
+			if _, ok := common[name]; ok || common == nil {
+				supported[name] = struct{}{}
+			}
+		}
+		common = supported
+	}
+
+	out := make([]string, 0, len(common))
+	for name := range common {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ServersSupport checks if every server of the datacenter among the
+// members supports a feature. It lets agents find out before calling an
+// RPC that older servers do not have.
+func ServersSupport(members []serf.Member, dc, feature string) bool {
+	for _, name := range commonFeatures(members, dc) {
+		if name == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateFeatures is used by the leader to enable the features that
+// every server of the datacenter now supports
+func (s *Server) negotiateFeatures(members []serf.Member) error {
+	state := s.fsm.State()
+	var names []string
+	for _, name := range commonFeatures(members, s.config.Datacenter) {
+		enabled, err := state.FeatureEnabled(name)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	req := structs.FeatureRequest{
+		Datacenter: s.config.Datacenter,
+		Names:      names,
+	}
+	resp, err := s.raftApply(structs.FeatureRequestType, &req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	s.logger.Printf("[INFO] consul: Enabled features %v", names)
+	return nil
+}
+
+// requireFeature returns an error unless the feature is enabled, so the
+// entries it covers are never applied by servers that do not support it
+func (s *Server) requireFeature(name string) error {
+	enabled, err := s.fsm.State().FeatureEnabled(name)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return fmt.Errorf("Feature '%s' is not supported by every server", name)
+	}
+	return nil
+}
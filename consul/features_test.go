@@ -0,0 +1,84 @@
+package consul
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/serf/serf"
+)
+
+func testFeaturesMember(name, dc, features string, status serf.MemberStatus) serf.Member {
+	return serf.Member{
+		Name: name,
+		Addr: net.IP([]byte{127, 0, 0, 1}),
+		Tags: map[string]string{
+			"role":     "consul",
+			"dc":       dc,
+			"port":     "10000",
+			"vsn":      "2",
+			"features": features,
+		},
+		Status: status,
+	}
+}
+
+func TestCommonFeatures(t *testing.T) {
+	members := []serf.Member{
+		testFeaturesMember("a", "dc1", "foo,bar,baz", serf.StatusAlive),
+		testFeaturesMember("b", "dc1", "bar,foo", serf.StatusFailed),
+		testFeaturesMember("c", "dc1", "", serf.StatusLeft),
+		testFeaturesMember("d", "dc2", "", serf.StatusAlive),
+		serf.Member{
+			Name: "e",
+			Tags: map[string]string{"role": "node", "dc": "dc1"},
+		},
+	}
+	if out := commonFeatures(members, "dc1"); !reflect.DeepEqual(out, []string{"bar", "foo"}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// A server without the tag disables every feature
+	members = append(members, testFeaturesMember("f", "dc1", "", serf.StatusAlive))
+	if out := commonFeatures(members, "dc1"); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestServersSupport(t *testing.T) {
+	members := []serf.Member{
+		testFeaturesMember("a", "dc1", "foo,bar", serf.StatusAlive),
+		testFeaturesMember("b", "dc1", "foo", serf.StatusAlive),
+	}
+	if !ServersSupport(members, "dc1", "foo") {
+		t.Fatalf("should be supported")
+	}
+	if ServersSupport(members, "dc1", "bar") {
+		t.Fatalf("should not be supported")
+	}
+	if ServersSupport(members, "dc2", "foo") {
+		t.Fatalf("should not be supported")
+	}
+}
+
+func TestServer_RequireFeature(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	// The leader enables the features it supports
+	testutil.WaitForResult(func() (bool, error) {
+		err := s1.requireFeature(structs.FeatureKVSBatch)
+		return err == nil, err
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Unknown features are never enabled
+	if err := s1.requireFeature("bogus"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
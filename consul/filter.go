@@ -50,6 +50,75 @@ func FilterKeys(acl acl.ACL, keys []string) []string {
 	return keys[:FilterEntries(&kf)]
 }
 
+type keyLockFilter struct {
+	acl   acl.ACL
+	locks structs.KeyLocks
+}
+
+func (k *keyLockFilter) Len() int {
+	return len(k.locks)
+}
+func (k *keyLockFilter) Filter(i int) bool {
+	return !k.acl.KeyRead(k.locks[i].Key)
+}
+
+func (k *keyLockFilter) Move(dst, src, span int) {
+	copy(k.locks[dst:dst+span], k.locks[src:src+span])
+}
+
+// FilterKeyLocks is used to filter a list of key locks by
+// applying an ACL policy
+func FilterKeyLocks(acl acl.ACL, locks structs.KeyLocks) structs.KeyLocks {
+	kf := keyLockFilter{acl: acl, locks: locks}
+	return locks[:FilterEntries(&kf)]
+}
+
+type tombstoneFilter struct {
+	acl   acl.ACL
+	tombs structs.Tombstones
+}
+
+func (t *tombstoneFilter) Len() int {
+	return len(t.tombs)
+}
+func (t *tombstoneFilter) Filter(i int) bool {
+	return !t.acl.KeyRead(t.tombs[i].Key)
+}
+
+func (t *tombstoneFilter) Move(dst, src, span int) {
+	copy(t.tombs[dst:dst+span], t.tombs[src:src+span])
+}
+
+// FilterTombstones is used to filter a list of tombstones by
+// applying an ACL policy
+func FilterTombstones(acl acl.ACL, tombs structs.Tombstones) structs.Tombstones {
+	tf := tombstoneFilter{acl: acl, tombs: tombs}
+	return tombs[:FilterEntries(&tf)]
+}
+
+type sessionFilter struct {
+	acl      acl.ACL
+	sessions structs.Sessions
+}
+
+func (f *sessionFilter) Len() int {
+	return len(f.sessions)
+}
+func (f *sessionFilter) Filter(i int) bool {
+	return !f.acl.SessionRead(f.sessions[i].Node)
+}
+
+func (f *sessionFilter) Move(dst, src, span int) {
+	copy(f.sessions[dst:dst+span], f.sessions[src:src+span])
+}
+
+// FilterSessions is used to filter a list of sessions by
+// applying an ACL policy
+func FilterSessions(acl acl.ACL, sessions structs.Sessions) structs.Sessions {
+	sf := sessionFilter{acl: acl, sessions: sessions}
+	return sessions[:FilterEntries(&sf)]
+}
+
 // Filter interface is used with FilterEntries to do an
 // in-place filter of a slice.
 type Filter interface {
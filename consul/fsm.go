@@ -1,11 +1,14 @@
 package consul
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/armon/go-metrics"
@@ -19,17 +22,108 @@ import (
 // this outside the Server to avoid exposing this outside the package.
 type consulFSM struct {
 	logOutput io.Writer
-	logger    *log.Logger
+	logger    StateLogger
 	path      string
 	state     *StateStore
 	gc        *TombstoneGC
+
+	// notifyWindow is the watch coalescing window applied to the
+	// state store, which must survive a restore.
+	notifyWindow time.Duration
+
+	// snapshotRate is the maximum number of bytes per second written
+	// when persisting a snapshot. Zero disables the limit.
+	snapshotRate int64
+
+	// snapshotEncoding is the encoding of the entries of the snapshots
+	// persisted. Empty selects the default encoding.
+	snapshotEncoding string
+
+	// snapshotMirror, if set, receives a copy of each snapshot persisted
+	snapshotMirror SnapshotMirror
+
+	// sessionHandler is invoked by the state store for each session
+	// invalidation, and must also survive a restore.
+	sessionHandler func(*structs.SessionInvalidation)
+
+	// checkStatusHandler is invoked by the state store for each check
+	// status transition, and must also survive a restore.
+	checkStatusHandler func(*structs.CheckStatusChange)
+
+	// stateLogger, if set, replaces the default logger of the state
+	// store, and must also survive a restore.
+	stateLogger StateLogger
+
+	// persisted tracks the index of each snapshot section as of the
+	// last persisted snapshot, so that sections which are unchanged
+	// can be skipped when persisting to an IncrementalSnapshotSink.
+	persisted     map[string]uint64
+	persistedLock sync.Mutex
+
+	// pipeline, if set, decodes log entries ahead of Apply, and decoded
+	// is the request it decoded for the entry being applied
+	pipeline *fsmPipeline
+	decoded  interface{}
+
+	// slowApply is the duration above which applying an entry is logged
+	// as slow, and slowApplyTypes overrides it per message type. Zero
+	// disables the logging. applying is the request of the entry being
+	// applied, used to describe a slow entry.
+	slowApply      time.Duration
+	slowApplyTypes map[structs.MessageType]time.Duration
+	applying       interface{}
+
+	// lastApply is the time the last entry was applied or a snapshot
+	// restored, used to detect a stalled FSM
+	lastApply     time.Time
+	lastApplyLock sync.Mutex
 }
 
 // consulSnapshot is used to provide a snapshot of the current
 // state in a way that can be accessed concurrently with operations
 // that may modify the live state.
 type consulSnapshot struct {
-	state *StateSnapshot
+	fsm      *consulFSM
+	state    *StateSnapshot
+	rate     int64
+	encoding string
+	mirror   SnapshotMirror
+}
+
+// snapshotSection is a part of a snapshot, covering one or more tables
+type snapshotSection struct {
+	name    string
+	tables  []string
+	persist func(*consulSnapshot, raft.SnapshotSink, snapshotEncoder) error
+
+	// incremental is false for sections that can change without the
+	// index of their tables advancing, which must always be persisted
+	incremental bool
+}
+
+// snapshotSections are the sections of a snapshot, in the order
+// they are persisted
+var snapshotSections = []snapshotSection{
+	{"nodes", []string{dbNodes, dbServices, dbChecks}, (*consulSnapshot).persistNodes, true},
+	{"sessions", []string{dbSessions}, (*consulSnapshot).persistSessions, true},
+	{"acls", []string{dbACLs}, (*consulSnapshot).persistACLs, true},
+	{"kvs", []string{dbKVS}, (*consulSnapshot).persistKV, true},
+	{"tombstones", []string{dbTombstone}, (*consulSnapshot).persistTombstones, false},
+	{"checkDefinitions", []string{dbCheckDefinitions}, (*consulSnapshot).persistCheckDefinitions, true},
+	{"serviceConfigs", []string{dbServiceConfigs}, (*consulSnapshot).persistServiceConfigs, true},
+	{"intentions", []string{dbIntentions}, (*consulSnapshot).persistIntentions, true},
+	{"nodeDrains", []string{dbNodeDrains}, (*consulSnapshot).persistNodeDrains, true},
+	{"registrationTimes", []string{dbRegistrations, dbNodeRegTimes}, (*consulSnapshot).persistRegistrationTimes, true},
+	{"lockWaiters", []string{dbLockWaiters}, (*consulSnapshot).persistLockWaiters, true},
+	{"catalogEvents", []string{dbCatalogEvents}, (*consulSnapshot).persistCatalogEvents, true},
+	{"prefixTombstones", []string{dbPrefixTombstones}, (*consulSnapshot).persistPrefixTombstones, false},
+	{"checkHeard", []string{dbCheckHeard}, (*consulSnapshot).persistCheckHeard, true},
+	{"clusterConfig", []string{dbClusterConfig}, (*consulSnapshot).persistClusterConfig, true},
+	{"features", []string{dbFeatures}, (*consulSnapshot).persistFeatures, true},
+	{"configEntries", []string{dbConfigEntries}, (*consulSnapshot).persistConfigEntries, true},
+	{"userEvents", []string{dbUserEvents}, (*consulSnapshot).persistUserEvents, true},
+	{"nodeSeen", []string{dbNodeSeen}, (*consulSnapshot).persistNodeSeen, true},
+	{"aclUsage", []string{dbACLUsage}, (*consulSnapshot).persistACLUsage, true},
 }
 
 // snapshotHeader is the first entry in our snapshot
@@ -37,6 +131,11 @@ type snapshotHeader struct {
 	// LastIndex is the last index that affects the data.
 	// This is used when we do the restore for watchers.
 	LastIndex uint64
+
+	// Encoding is the encoding of the entries that follow the header.
+	// It is empty for snapshots that predate the setting, whose
+	// entries are encoded with msgpack.
+	Encoding string
 }
 
 // NewFSMPath is used to construct a new FSM with a blank state
@@ -55,28 +154,192 @@ func NewFSM(gc *TombstoneGC, path string, logOutput io.Writer) (*consulFSM, erro
 
 	fsm := &consulFSM{
 		logOutput: logOutput,
-		logger:    log.New(logOutput, "", log.LstdFlags),
+		logger:    newStdStateLogger(logOutput, "consul.fsm"),
 		path:      path,
 		state:     state,
 		gc:        gc,
+		lastApply: time.Now(),
 	}
 	return fsm, nil
 }
 
 // Close is used to cleanup resources associated with the FSM
 func (c *consulFSM) Close() error {
+	if c.pipeline != nil {
+		c.pipeline.Shutdown()
+	}
 	return c.state.Close()
 }
 
+// SetDecodeWorkers is used to decode log entries on the given number of
+// worker goroutines as they are stored, ahead of applying them. It must
+// be set before the log store is wrapped with WrapLogStore.
+func (c *consulFSM) SetDecodeWorkers(workers int) {
+	if workers > 0 {
+		c.pipeline = newFSMPipeline(workers)
+	}
+}
+
+// SetSlowApplyThresholds is used to log the entries that take longer
+// than a threshold to apply, along with the key or node they involve.
+// The thresholds of the given message types override the default one,
+// and a zero threshold disables the logging.
+func (c *consulFSM) SetSlowApplyThresholds(threshold time.Duration, types map[structs.MessageType]time.Duration) {
+	c.slowApply = threshold
+	c.slowApplyTypes = types
+}
+
+// WrapLogStore returns the log store to use with raft, which submits the
+// entries stored to the decode workers, if any
+func (c *consulFSM) WrapLogStore(store raft.LogStore) raft.LogStore {
+	if c.pipeline == nil {
+		return store
+	}
+	return &pipelineLogStore{store, c.pipeline}
+}
+
+// SetNotifyWindow is used to set the watch coalescing window of the
+// current state store, and any state store created by a restore
+func (c *consulFSM) SetNotifyWindow(window time.Duration) {
+	c.notifyWindow = window
+	c.state.SetNotifyWindow(window)
+}
+
+// SetSessionHandler is used to set the session invalidation handler of
+// the current state store, and any state store created by a restore
+func (c *consulFSM) SetSessionHandler(fn func(*structs.SessionInvalidation)) {
+	c.sessionHandler = fn
+	c.state.SetSessionHandler(fn)
+}
+
+// SetCheckStatusHandler is used to set the check status handler of the
+// current state store, and any state store created by a restore
+func (c *consulFSM) SetCheckStatusHandler(fn func(*structs.CheckStatusChange)) {
+	c.checkStatusHandler = fn
+	c.state.SetCheckStatusHandler(fn)
+}
+
+// SetLogger is used to replace the logger of the FSM, the current state
+// store, and any state store created by a restore
+func (c *consulFSM) SetLogger(logger StateLogger) {
+	c.logger = logger
+	c.stateLogger = logger
+	c.state.SetLogger(logger)
+}
+
+// SetSnapshotRate is used to limit the rate in bytes per second at
+// which snapshots are persisted. Zero disables the limit.
+func (c *consulFSM) SetSnapshotRate(rate int64) {
+	c.snapshotRate = rate
+}
+
+// SetSnapshotEncoding is used to set the encoding of the entries of the
+// snapshots persisted. Snapshots are restored using the encoding named
+// in their header, so servers must all support an encoding before any
+// of them is configured to use it.
+func (c *consulFSM) SetSnapshotEncoding(name string) error {
+	if _, err := getSnapshotCodec(name); err != nil {
+		return err
+	}
+	c.snapshotEncoding = name
+	return nil
+}
+
+// SetSnapshotMirror is used to set a mirror receiving a copy of each
+// snapshot persisted
+func (c *consulFSM) SetSnapshotMirror(mirror SnapshotMirror) {
+	c.snapshotMirror = mirror
+}
+
 // State is used to return a handle to the current state
 func (c *consulFSM) State() *StateStore {
 	return c.state
 }
 
 func (c *consulFSM) Apply(log *raft.Log) interface{} {
+	start := time.Now()
+	c.applying = nil
+	resp := c.apply(log)
+	end := time.Now()
+	c.checkSlowApply(log, end.Sub(start))
+	c.setLastApply(end)
+	return resp
+}
+
+// LastApply returns the time the FSM last applied an entry or restored
+// a snapshot
+func (c *consulFSM) LastApply() time.Time {
+	c.lastApplyLock.Lock()
+	defer c.lastApplyLock.Unlock()
+	return c.lastApply
+}
+
+// setLastApply is used to record the time of an apply or restore
+func (c *consulFSM) setLastApply(t time.Time) {
+	c.lastApplyLock.Lock()
+	c.lastApply = t
+	c.lastApplyLock.Unlock()
+}
+
+// checkSlowApply is used to log an entry which took longer than the
+// threshold of its message type to apply
+func (c *consulFSM) checkSlowApply(log *raft.Log, elapsed time.Duration) {
+	if len(log.Data) == 0 {
+		return
+	}
+	msgType := structs.MessageType(log.Data[0]) &^ structs.IgnoreUnknownTypeFlag
+	threshold, ok := c.slowApplyTypes[msgType]
+	if !ok {
+		threshold = c.slowApply
+	}
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	metrics.IncrCounter([]string{"consul", "fsm", "slow_apply", strconv.Itoa(int(msgType))}, 1)
+	fields := []LogField{logType(msgType), logIndex(log.Index), logDuration(elapsed)}
+	fields = append(fields, slowApplyFields(c.applying)...)
+	c.logger.Warn("Slow log entry apply", fields...)
+}
+
+// slowApplyFields returns the key or node involved in a request, to
+// describe an entry which was slow to apply
+func slowApplyFields(req interface{}) []LogField {
+	switch r := req.(type) {
+	case *structs.RegisterRequest:
+		return []LogField{logField("node", r.Node)}
+	case *structs.DeregisterRequest:
+		return []LogField{logField("node", r.Node)}
+	case *structs.KVSRequest:
+		return []LogField{logField("op", r.Op), logField("key", r.DirEnt.Key)}
+	case *structs.SessionRequest:
+		return []LogField{logField("op", r.Op), logField("node", r.Session.Node)}
+	case *structs.CheckUpdateRequest:
+		return []LogField{logField("node", r.Node)}
+	case *structs.NodeDrainRequest:
+		return []LogField{logField("node", r.Node)}
+	case *structs.NodeProtectRequest:
+		return []LogField{logField("node", r.Node)}
+	}
+	return nil
+}
+
+// apply is used to apply a log entry to the state store
+func (c *consulFSM) apply(log *raft.Log) interface{} {
 	buf := log.Data
+	if len(buf) == 0 {
+		c.logger.Error("Skipping empty log entry", logIndex(log.Index))
+		metrics.IncrCounter([]string{"consul", "fsm", "corrupt_entry"}, 1)
+		return fmt.Errorf("empty log entry")
+	}
 	msgType := structs.MessageType(buf[0])
 
+	// Use the request decoded by the pipeline, if any
+	c.decoded = nil
+	if c.pipeline != nil {
+		c.decoded = c.pipeline.take(log)
+	}
+
 	// Check if this message type should be ignored when unknown. This is
 	// used so that new commands can be added with developer control if older
 	// versions can safely ignore the command, or if they should crash.
@@ -99,9 +362,40 @@ func (c *consulFSM) Apply(log *raft.Log) interface{} {
 		return c.applyACLOperation(buf[1:], log.Index)
 	case structs.TombstoneRequestType:
 		return c.applyTombstoneOperation(buf[1:], log.Index)
+	case structs.CheckDefinitionRequestType:
+		return c.applyCheckDefinitionOperation(buf[1:], log.Index)
+	case structs.ServiceConfigRequestType:
+		return c.applyServiceConfigOperation(buf[1:], log.Index)
+	case structs.IntentionRequestType:
+		return c.applyIntentionOperation(buf[1:], log.Index)
+	case structs.NodeDrainRequestType:
+		return c.applyNodeDrain(buf[1:], log.Index)
+	case structs.TableRestoreRequestType:
+		return c.applyTableRestore(buf[1:], log.Index)
+	case structs.CheckUpdateRequestType:
+		return c.applyCheckUpdate(buf[1:], log.Index)
+	case structs.ACLUsageRequestType:
+		return c.applyACLUsage(buf[1:], log.Index)
+	case structs.ClusterConfigRequestType:
+		return c.applyClusterConfig(buf[1:], log.Index)
+	case structs.FeatureRequestType:
+		return c.applyFeature(buf[1:], log.Index)
+	case structs.NodeProtectRequestType:
+		return c.applyNodeProtect(buf[1:], log.Index)
+	case structs.ConfigEntryRequestType:
+		return c.applyConfigEntryOperation(buf[1:], log.Index)
+	case structs.EventFireRequestType:
+		return c.applyEventFire(buf[1:], log.Index)
+	case structs.StateCompactRequestType:
+		return c.applyStateCompact(buf[1:], log.Index)
+	case structs.NodeHeartbeatRequestType:
+		return c.applyNodeHeartbeat(buf[1:], log.Index)
+	case structs.NodeNameMergeRequestType:
+		return c.applyNodeNameMerge(buf[1:], log.Index)
 	default:
 		if ignoreUnknown {
-			c.logger.Printf("[WARN] consul.fsm: ignoring unknown message type (%d), upgrade to newer version", msgType)
+			c.logger.Warn("Ignoring unknown message type, upgrade to newer version",
+				logType(msgType), logIndex(log.Index))
 			return nil
 		} else {
 			panic(fmt.Errorf("failed to apply request: %#v", buf))
@@ -109,19 +403,139 @@ func (c *consulFSM) Apply(log *raft.Log) interface{} {
 	}
 }
 
+// Validate is used to decode a log entry and verify it against the current
+// state without applying it. This is a dry-run of Apply that lets the RPC
+// layer reject requests which are certain to fail, such as a session for a
+// missing node, before paying the cost of a raft round trip. Only the
+// invariants enforced by the state store are verified, so a nil error does
+// not guarantee the entry will apply cleanly if the state changes in between.
+func (c *consulFSM) Validate(log *raft.Log) error {
+	buf := log.Data
+	if len(buf) == 0 {
+		return fmt.Errorf("empty log entry")
+	}
+	msgType := structs.MessageType(buf[0])
+	msgType &= ^structs.IgnoreUnknownTypeFlag
+
+	switch msgType {
+	case structs.RegisterRequestType:
+		var req structs.RegisterRequest
+		if err := structs.Decode(buf[1:], &req); err != nil {
+			return fmt.Errorf("failed to decode request: %v", err)
+		}
+		return c.state.ValidateRegistration(&req)
+
+	case structs.KVSRequestType:
+		var req structs.KVSRequest
+		if err := structs.Decode(buf[1:], &req); err != nil {
+			return fmt.Errorf("failed to decode request: %v", err)
+		}
+		if req.Op == structs.KVSLock {
+			return c.state.ValidateKVSLock(&req.DirEnt)
+		}
+
+	case structs.SessionRequestType:
+		var req structs.SessionRequest
+		if err := structs.Decode(buf[1:], &req); err != nil {
+			return fmt.Errorf("failed to decode request: %v", err)
+		}
+		if req.Op == structs.SessionCreate {
+			return c.state.ValidateSession(&req.Session)
+		}
+
+	case structs.CheckDefinitionRequestType:
+		var req structs.CheckDefinitionRequest
+		if err := structs.Decode(buf[1:], &req); err != nil {
+			return fmt.Errorf("failed to decode request: %v", err)
+		}
+		if req.Op == structs.CheckDefinitionSet {
+			return c.state.ValidateCheckDefinition(&req.Definition)
+		}
+	}
+	return nil
+}
+
+// decodeRecoverable are the message types whose log entries are skipped,
+// instead of crashing the server, if they fail to decode. Every server
+// decodes the same bytes, so they all skip the entry and stay consistent.
+// ACLs, sessions, intentions and restores still panic, since silently
+// dropping them could weaken access control or break the entries that
+// follow them.
+var decodeRecoverable = map[structs.MessageType]bool{
+	structs.RegisterRequestType:        true,
+	structs.DeregisterRequestType:      true,
+	structs.KVSRequestType:             true,
+	structs.TombstoneRequestType:       true,
+	structs.CheckDefinitionRequestType: true,
+	structs.ServiceConfigRequestType:   true,
+	structs.NodeDrainRequestType:       true,
+	structs.CheckUpdateRequestType:     true,
+	structs.ACLUsageRequestType:        true,
+	structs.FeatureRequestType:         true,
+	structs.NodeProtectRequestType:     true,
+	structs.ConfigEntryRequestType:     true,
+	structs.EventFireRequestType:       true,
+	structs.StateCompactRequestType:    true,
+	structs.NodeHeartbeatRequestType:   true,
+	structs.NodeNameMergeRequestType:   true,
+}
+
+// restoreBatched are the message types of the snapshot entries that are
+// restored through a StateRestore
+var restoreBatched = map[structs.MessageType]bool{
+	structs.KVSRequestType:       true,
+	structs.SessionRequestType:   true,
+	structs.ACLRequestType:       true,
+	structs.TombstoneRequestType: true,
+}
+
+// decodeFailed is used to handle a log entry that failed to decode. If the
+// message type is recoverable, the entry is marked failed by returning an
+// error as its response, otherwise the FSM panics.
+func (c *consulFSM) decodeFailed(msgType structs.MessageType, index uint64, err error) interface{} {
+	if !decodeRecoverable[msgType] {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+	c.logger.Error("Skipping corrupt log entry", logType(msgType), logIndex(index), logError(err))
+	metrics.IncrCounter([]string{"consul", "fsm", "corrupt_entry"}, 1)
+	return fmt.Errorf("failed to decode request: %v", err)
+}
+
 func (c *consulFSM) decodeRegister(buf []byte, index uint64) interface{} {
 	var req structs.RegisterRequest
-	if err := structs.Decode(buf, &req); err != nil {
-		panic(fmt.Errorf("failed to decode request: %v", err))
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.RegisterRequestType, index, err)
+	}
+
+	// Restores also apply registrations, so the event is only set for
+	// registrations applied from the log. It is recorded by the state
+	// store if the registration changes the catalog.
+	ev := &structs.CatalogEvent{
+		Op:   structs.CatalogEventRegister,
+		Node: req.Node,
+	}
+	if req.Service != nil {
+		ev.ServiceID = req.Service.ID
 	}
-	return c.applyRegister(&req, index)
+	if req.Check != nil {
+		ev.CheckIDs = append(ev.CheckIDs, req.Check.CheckID)
+	}
+	for _, check := range req.Checks {
+		ev.CheckIDs = append(ev.CheckIDs, check.CheckID)
+	}
+	c.setCatalogEvent(req.Token, ev)
+	defer c.state.SetCatalogEvent(nil)
+
+	return c.applyRegister(c.state, &req, index)
 }
 
-func (c *consulFSM) applyRegister(req *structs.RegisterRequest, index uint64) interface{} {
+func (c *consulFSM) applyRegister(state *StateStore, req *structs.RegisterRequest, index uint64) interface{} {
 	defer metrics.MeasureSince([]string{"consul", "fsm", "register"}, time.Now())
+	state.SetClock(req.RequestTime())
+
 	// Apply all updates in a single transaction
-	if err := c.state.EnsureRegistration(index, req); err != nil {
-		c.logger.Printf("[INFO] consul.fsm: EnsureRegistration failed: %v", err)
+	if err := state.EnsureRegistration(index, req); err != nil {
+		c.logger.Info("EnsureRegistration failed", logType(structs.RegisterRequestType), logIndex(index), logError(err))
 		return err
 	}
 	return nil
@@ -130,36 +544,102 @@ func (c *consulFSM) applyRegister(req *structs.RegisterRequest, index uint64) in
 func (c *consulFSM) applyDeregister(buf []byte, index uint64) interface{} {
 	defer metrics.MeasureSince([]string{"consul", "fsm", "deregister"}, time.Now())
 	var req structs.DeregisterRequest
-	if err := structs.Decode(buf, &req); err != nil {
-		panic(fmt.Errorf("failed to decode request: %v", err))
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.DeregisterRequestType, index, err)
 	}
+	c.state.SetClock(req.RequestTime())
 
-	// Either remove the service entry or the whole node
-	if req.ServiceID != "" {
+	// Namespaced entries are only removed by ID, and are not part of
+	// the catalog events
+	if req.Namespace != "" {
+		return c.applyNamespaceDeregister(&req, index)
+	}
+
+	// The event is recorded by the state store if something is removed
+	ev := &structs.CatalogEvent{
+		Op:        structs.CatalogEventDeregister,
+		Node:      req.Node,
+		ServiceID: req.ServiceID,
+	}
+	if req.Node == "" {
+		ev.ServiceName = req.ServiceName
+	}
+	if req.CheckID != "" {
+		ev.CheckIDs = []string{req.CheckID}
+	}
+	c.setCatalogEvent(req.Token, ev)
+	defer c.state.SetCatalogEvent(nil)
+
+	// Either remove all instances of a service, the service entry,
+	// the check entry or the whole node
+	if req.Node == "" && req.ServiceName != "" {
+		if err := c.state.DeleteService(index, req.ServiceName); err != nil {
+			c.logger.Info("DeleteService failed", logType(structs.DeregisterRequestType), logIndex(index), logError(err))
+			return err
+		}
+	} else if req.ServiceID != "" {
 		if err := c.state.DeleteNodeService(index, req.Node, req.ServiceID); err != nil {
-			c.logger.Printf("[INFO] consul.fsm: DeleteNodeService failed: %v", err)
+			c.logger.Info("DeleteNodeService failed", logType(structs.DeregisterRequestType), logIndex(index), logError(err))
 			return err
 		}
 	} else if req.CheckID != "" {
 		if err := c.state.DeleteNodeCheck(index, req.Node, req.CheckID); err != nil {
-			c.logger.Printf("[INFO] consul.fsm: DeleteNodeCheck failed: %v", err)
+			c.logger.Info("DeleteNodeCheck failed", logType(structs.DeregisterRequestType), logIndex(index), logError(err))
+			return err
+		}
+	} else if req.Force {
+		if err := c.state.ForceDeleteNode(index, req.Node); err != nil {
+			c.logger.Info("ForceDeleteNode failed", logType(structs.DeregisterRequestType), logIndex(index), logError(err))
 			return err
 		}
 	} else {
 		if err := c.state.DeleteNode(index, req.Node); err != nil {
-			c.logger.Printf("[INFO] consul.fsm: DeleteNode failed: %v", err)
+			c.logger.Info("DeleteNode failed", logType(structs.DeregisterRequestType), logIndex(index), logError(err))
 			return err
 		}
 	}
 	return nil
 }
 
+// applyNamespaceDeregister is used to remove a service or check entry
+// of a namespace
+func (c *consulFSM) applyNamespaceDeregister(req *structs.DeregisterRequest, index uint64) interface{} {
+	if req.ServiceID != "" {
+		if err := c.state.DeleteNamespaceService(index, req.Namespace, req.Node, req.ServiceID); err != nil {
+			c.logger.Info("DeleteNamespaceService failed", logType(structs.DeregisterRequestType), logIndex(index), logError(err))
+			return err
+		}
+	} else if req.CheckID != "" {
+		if err := c.state.DeleteNamespaceCheck(index, req.Namespace, req.Node, req.CheckID); err != nil {
+			c.logger.Info("DeleteNamespaceCheck failed", logType(structs.DeregisterRequestType), logIndex(index), logError(err))
+			return err
+		}
+	} else {
+		c.logger.Warn("Ignoring namespaced deregister without an ID", logType(structs.DeregisterRequestType), logIndex(index))
+	}
+	return nil
+}
+
+// setCatalogEvent is used to set the catalog event of the change being
+// applied, attributed to the token of the request. The state store adds it
+// to the audit trail in the txn of the change, if the catalog changes.
+func (c *consulFSM) setCatalogEvent(token string, ev *structs.CatalogEvent) {
+	if token != "" {
+		ev.TokenHash = fmt.Sprintf("%x", sha256.Sum256([]byte(token)))[:16]
+		if _, acl, err := c.state.ACLGet(token); err == nil && acl != nil {
+			ev.Actor = acl.Name
+		}
+	}
+	c.state.SetCatalogEvent(ev)
+}
+
 func (c *consulFSM) applyKVSOperation(buf []byte, index uint64) interface{} {
 	var req structs.KVSRequest
-	if err := structs.Decode(buf, &req); err != nil {
-		panic(fmt.Errorf("failed to decode request: %v", err))
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.KVSRequestType, index, err)
 	}
 	defer metrics.MeasureSince([]string{"consul", "fsm", "kvs", string(req.Op)}, time.Now())
+	c.state.SetClock(req.RequestTime())
 	switch req.Op {
 	case structs.KVSSet:
 		return c.state.KVSSet(index, &req.DirEnt)
@@ -182,7 +662,11 @@ func (c *consulFSM) applyKVSOperation(buf []byte, index uint64) interface{} {
 			return act
 		}
 	case structs.KVSLock:
-		act, err := c.state.KVSLock(index, &req.DirEnt)
+		lock := c.state.KVSLock
+		if req.Queue {
+			lock = c.state.KVSLockQueue
+		}
+		act, err := lock(index, &req.DirEnt)
 		if err != nil {
 			return err
 		} else {
@@ -195,19 +679,53 @@ func (c *consulFSM) applyKVSOperation(buf []byte, index uint64) interface{} {
 		} else {
 			return act
 		}
+	case structs.KVSDequeue:
+		act, err := c.state.KVSLockDequeue(index, &req.DirEnt)
+		if err != nil {
+			return err
+		} else {
+			return act
+		}
+	case structs.KVSUndelete:
+		act, err := c.state.KVSUndelete(index, req.DirEnt.Key)
+		if err != nil {
+			return err
+		} else {
+			return act
+		}
+	case structs.KVSIncrement:
+		val, err := c.state.KVSIncrement(index, req.DirEnt.Key, req.Delta)
+		if err != nil {
+			return err
+		} else {
+			return val
+		}
+	case structs.KVSBatch:
+		return c.state.KVSBatch(index, req.Batch)
+	case structs.KVSCASMulti:
+		act, err := c.state.KVSSetCASMulti(index, req.Entries)
+		if err != nil {
+			return err
+		} else {
+			return act
+		}
+	case structs.KVSImport:
+		return c.state.KVSImport(index, req.DirEnt.Key, req.Entries)
 	default:
 		err := errors.New(fmt.Sprintf("Invalid KVS operation '%s'", req.Op))
-		c.logger.Printf("[WARN] consul.fsm: %v", err)
+		c.logger.Warn("Invalid KVS operation", logType(structs.KVSRequestType), logIndex(index),
+			logField("op", req.Op))
 		return err
 	}
 }
 
 func (c *consulFSM) applySessionOperation(buf []byte, index uint64) interface{} {
 	var req structs.SessionRequest
-	if err := structs.Decode(buf, &req); err != nil {
-		panic(fmt.Errorf("failed to decode request: %v", err))
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.SessionRequestType, index, err)
 	}
 	defer metrics.MeasureSince([]string{"consul", "fsm", "session", string(req.Op)}, time.Now())
+	c.state.SetClock(req.RequestTime())
 	switch req.Op {
 	case structs.SessionCreate:
 		if err := c.state.SessionCreate(index, &req.Session); err != nil {
@@ -218,15 +736,16 @@ func (c *consulFSM) applySessionOperation(buf []byte, index uint64) interface{}
 	case structs.SessionDestroy:
 		return c.state.SessionDestroy(index, req.Session.ID)
 	default:
-		c.logger.Printf("[WARN] consul.fsm: Invalid Session operation '%s'", req.Op)
+		c.logger.Warn("Invalid Session operation", logType(structs.SessionRequestType), logIndex(index),
+			logField("op", req.Op))
 		return fmt.Errorf("Invalid Session operation '%s'", req.Op)
 	}
 }
 
 func (c *consulFSM) applyACLOperation(buf []byte, index uint64) interface{} {
 	var req structs.ACLRequest
-	if err := structs.Decode(buf, &req); err != nil {
-		panic(fmt.Errorf("failed to decode request: %v", err))
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.ACLRequestType, index, err)
 	}
 	defer metrics.MeasureSince([]string{"consul", "fsm", "acl", string(req.Op)}, time.Now())
 	switch req.Op {
@@ -238,173 +757,781 @@ func (c *consulFSM) applyACLOperation(buf []byte, index uint64) interface{} {
 		}
 	case structs.ACLDelete:
 		return c.state.ACLDelete(index, req.ACL.ID)
+	case structs.ACLClone:
+		if err := c.state.ACLClone(index, req.ACL.ID, req.NewID); err != nil {
+			return err
+		} else {
+			return req.NewID
+		}
+	case structs.ACLRotate:
+		// The old ID expires relative to the clock of the leader, so
+		// every server expires it at the same time
+		var expires time.Time
+		if req.GracePeriod > 0 && !req.RequestTime().IsZero() {
+			expires = req.RequestTime().Add(req.GracePeriod)
+		}
+		if err := c.state.ACLRotate(index, req.ACL.ID, req.NewID, expires); err != nil {
+			return err
+		} else {
+			return req.NewID
+		}
 	default:
-		c.logger.Printf("[WARN] consul.fsm: Invalid ACL operation '%s'", req.Op)
+		c.logger.Warn("Invalid ACL operation", logType(structs.ACLRequestType), logIndex(index),
+			logField("op", req.Op))
 		return fmt.Errorf("Invalid ACL operation '%s'", req.Op)
 	}
 }
 
 func (c *consulFSM) applyTombstoneOperation(buf []byte, index uint64) interface{} {
 	var req structs.TombstoneRequest
-	if err := structs.Decode(buf, &req); err != nil {
-		panic(fmt.Errorf("failed to decode request: %v", err))
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.TombstoneRequestType, index, err)
 	}
 	defer metrics.MeasureSince([]string{"consul", "fsm", "tombstone", string(req.Op)}, time.Now())
 	switch req.Op {
 	case structs.TombstoneReap:
 		return c.state.ReapTombstones(req.ReapIndex)
+	case structs.TombstoneReapPrefix:
+		return c.state.ReapTombstonesPrefix(req.ReapIndex, req.Prefix)
 	default:
-		c.logger.Printf("[WARN] consul.fsm: Invalid Tombstone operation '%s'", req.Op)
+		c.logger.Warn("Invalid Tombstone operation", logType(structs.TombstoneRequestType), logIndex(index),
+			logField("op", req.Op))
 		return fmt.Errorf("Invalid Tombstone operation '%s'", req.Op)
 	}
 }
 
-func (c *consulFSM) Snapshot() (raft.FSMSnapshot, error) {
-	defer func(start time.Time) {
-		c.logger.Printf("[INFO] consul.fsm: snapshot created in %v", time.Now().Sub(start))
-	}(time.Now())
+func (c *consulFSM) applyCheckDefinitionOperation(buf []byte, index uint64) interface{} {
+	var req structs.CheckDefinitionRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.CheckDefinitionRequestType, index, err)
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "check_definition", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.CheckDefinitionSet:
+		return c.state.CheckDefinitionSet(index, &req.Definition)
+	case structs.CheckDefinitionDelete:
+		return c.state.CheckDefinitionDelete(index, req.Definition.Node, req.Definition.CheckID)
+	default:
+		c.logger.Warn("Invalid CheckDefinition operation", logType(structs.CheckDefinitionRequestType), logIndex(index),
+			logField("op", req.Op))
+		return fmt.Errorf("Invalid CheckDefinition operation '%s'", req.Op)
+	}
+}
 
-	// Create a new snapshot
-	snap, err := c.state.Snapshot()
-	if err != nil {
-		return nil, err
+func (c *consulFSM) applyServiceConfigOperation(buf []byte, index uint64) interface{} {
+	var req structs.ServiceConfigRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.ServiceConfigRequestType, index, err)
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "service_config", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.ServiceConfigSet:
+		return c.state.ServiceConfigSet(index, &req.Config)
+	case structs.ServiceConfigDelete:
+		return c.state.ServiceConfigDelete(index, req.Config.Service)
+	default:
+		c.logger.Warn("Invalid ServiceConfig operation", logType(structs.ServiceConfigRequestType), logIndex(index),
+			logField("op", req.Op))
+		return fmt.Errorf("Invalid ServiceConfig operation '%s'", req.Op)
 	}
-	return &consulSnapshot{snap}, nil
 }
 
-func (c *consulFSM) Restore(old io.ReadCloser) error {
-	defer old.Close()
+func (c *consulFSM) applyConfigEntryOperation(buf []byte, index uint64) interface{} {
+	var req structs.ConfigEntryRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.ConfigEntryRequestType, index, err)
+	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "config_entry", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.ConfigEntrySet:
+		return c.state.ConfigEntrySet(index, &req.Entry)
+	case structs.ConfigEntryDelete:
+		return c.state.ConfigEntryDelete(index, req.Entry.Kind, req.Entry.Name)
+	default:
+		c.logger.Warn("Invalid ConfigEntry operation", logType(structs.ConfigEntryRequestType), logIndex(index),
+			logField("op", req.Op))
+		return fmt.Errorf("Invalid ConfigEntry operation '%s'", req.Op)
+	}
+}
 
-	// Create a temporary path for the state store
-	tmpPath, err := ioutil.TempDir(c.path, "state")
-	if err != nil {
-		return err
+func (c *consulFSM) applyIntentionOperation(buf []byte, index uint64) interface{} {
+	var req structs.IntentionRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.IntentionRequestType, index, err)
 	}
+	defer metrics.MeasureSince([]string{"consul", "fsm", "intention", string(req.Op)}, time.Now())
+	switch req.Op {
+	case structs.IntentionSet:
+		return c.state.IntentionSet(index, &req.Intention)
+	case structs.IntentionDelete:
+		return c.state.IntentionDelete(index, req.Intention.ID)
+	default:
+		c.logger.Warn("Invalid Intention operation", logType(structs.IntentionRequestType), logIndex(index),
+			logField("op", req.Op))
+		return fmt.Errorf("Invalid Intention operation '%s'", req.Op)
+	}
+}
 
-	// Create a new state store
-	state, err := NewStateStorePath(c.gc, tmpPath, c.logOutput)
-	if err != nil {
+func (c *consulFSM) applyNodeDrain(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "drain"}, time.Now())
+	var req structs.NodeDrainRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.NodeDrainRequestType, index, err)
+	}
+	if err := c.state.NodeDrain(index, req.Node, req.Drain); err != nil {
+		c.logger.Info("NodeDrain failed", logType(structs.NodeDrainRequestType), logIndex(index), logError(err))
 		return err
 	}
-	c.state.Close()
-	c.state = state
+	return nil
+}
 
-	// Create a decoder
-	dec := codec.NewDecoder(old, msgpackHandle)
+func (c *consulFSM) applyNodeProtect(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "protect"}, time.Now())
+	var req structs.NodeProtectRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.NodeProtectRequestType, index, err)
+	}
+	if err := c.state.NodeProtect(index, req.Node, req.Protected); err != nil {
+		c.logger.Info("NodeProtect failed", logType(structs.NodeProtectRequestType), logIndex(index), logError(err))
+		return err
+	}
+	return nil
+}
 
-	// Read in the header
-	var header snapshotHeader
-	if err := dec.Decode(&header); err != nil {
+func (c *consulFSM) applyCheckUpdate(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "check_update"}, time.Now())
+	var req structs.CheckUpdateRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.CheckUpdateRequestType, index, err)
+	}
+	c.state.SetClock(req.RequestTime())
+	if err := c.state.UpdateCheckStatus(index, req.Node, req.CheckID, req.Status, req.Output, req.Grace); err != nil {
+		c.logger.Info("UpdateCheck failed", logType(structs.CheckUpdateRequestType), logIndex(index), logError(err))
 		return err
 	}
+	return nil
+}
 
-	// Populate the new state
-	msgType := make([]byte, 1)
-	for {
-		// Read the message type
-		_, err := old.Read(msgType)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
+func (c *consulFSM) applyACLUsage(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "acl_usage"}, time.Now())
+	var req structs.ACLUsageRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.ACLUsageRequestType, index, err)
+	}
+	c.state.SetClock(req.RequestTime())
+	return c.state.ACLUsage(index, req.IDs)
+}
 
-		// Decode
-		switch structs.MessageType(msgType[0]) {
-		case structs.RegisterRequestType:
-			var req structs.RegisterRequest
-			if err := dec.Decode(&req); err != nil {
-				return err
-			}
-			c.applyRegister(&req, header.LastIndex)
+func (c *consulFSM) applyClusterConfig(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "cluster_config"}, time.Now())
+	var req structs.ClusterConfigRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.ClusterConfigRequestType, index, err)
+	}
+	return c.state.ClusterConfigSet(index, &req.Config)
+}
 
-		case structs.KVSRequestType:
-			var req structs.DirEntry
-			if err := dec.Decode(&req); err != nil {
-				return err
-			}
-			if err := c.state.KVSRestore(&req); err != nil {
-				return err
-			}
+func (c *consulFSM) applyFeature(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "feature"}, time.Now())
+	var req structs.FeatureRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.FeatureRequestType, index, err)
+	}
+	return c.state.FeatureEnable(index, req.Names)
+}
 
-		case structs.SessionRequestType:
-			var req structs.Session
-			if err := dec.Decode(&req); err != nil {
-				return err
-			}
-			if err := c.state.SessionRestore(&req); err != nil {
-				return err
-			}
+func (c *consulFSM) applyEventFire(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "event_fire"}, time.Now())
+	var ev structs.UserEvent
+	if err := c.decode(buf, &ev); err != nil {
+		return c.decodeFailed(structs.EventFireRequestType, index, err)
+	}
+	if err := c.state.RecordUserEvent(index, &ev); err != nil {
+		return err
+	}
+	return ev.ID
+}
 
-		case structs.ACLRequestType:
-			var req structs.ACL
-			if err := dec.Decode(&req); err != nil {
-				return err
-			}
-			if err := c.state.ACLRestore(&req); err != nil {
-				return err
-			}
+func (c *consulFSM) applyStateCompact(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "state_compact"}, time.Now())
+	var req structs.StateCompactRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.StateCompactRequestType, index, err)
+	}
+	if err := c.compactState(); err != nil {
+		c.logger.Error("State compaction failed", logType(structs.StateCompactRequestType), logIndex(index), logError(err))
+		return err
+	}
+	return nil
+}
 
-		case structs.TombstoneRequestType:
+func (c *consulFSM) applyNodeHeartbeat(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "node_heartbeat"}, time.Now())
+	var req structs.NodeHeartbeatRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.NodeHeartbeatRequestType, index, err)
+	}
+	c.state.SetClock(req.RequestTime())
+	return c.state.NodeHeartbeat(index, req.Nodes)
+}
+
+func (c *consulFSM) applyNodeNameMerge(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "node_name_merge"}, time.Now())
+	var req structs.NodeNameMergeRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.NodeNameMergeRequestType, index, err)
+	}
+	if err := c.state.MergeNodeNames(index); err != nil {
+		c.logger.Error("Node name merge failed", logType(structs.NodeNameMergeRequestType), logIndex(index), logError(err))
+		return err
+	}
+	return nil
+}
+
+// compactState is used to copy the state store into a fresh one, which
+// releases the pages that LMDB keeps after large deletes. The state is
+// persisted to a temporary file, as for a snapshot, and restored from it
+// once complete, so a failure leaves the current store in place. The
+// change log carries over, since the state is unchanged. Every server
+// compacts at the same index, and holds up the apply meanwhile.
+func (c *consulFSM) compactState() error {
+	f, err := ioutil.TempFile(c.path, "compact")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Persist the whole state, without the mirror or the rate limit of
+	// the snapshots
+	snap, err := c.state.Snapshot()
+	if err != nil {
+		return err
+	}
+	s := &consulSnapshot{
+		fsm:      c,
+		state:    snap,
+		encoding: c.snapshotEncoding,
+	}
+	err = s.Persist(&writerSink{f})
+	snap.Close()
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	state, err := c.restoreState(f)
+	if err != nil {
+		return err
+	}
+	if err := state.CopyChangeLog(c.state); err != nil {
+		state.Close()
+		return err
+	}
+	c.replaceState(state)
+	return nil
+}
+
+func (c *consulFSM) applyTableRestore(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"consul", "fsm", "restore_table"}, time.Now())
+	var req structs.TableRestoreRequest
+	if err := c.decode(buf, &req); err != nil {
+		return c.decodeFailed(structs.TableRestoreRequestType, index, err)
+	}
+	var err error
+	switch req.Section {
+	case "acls":
+		err = c.state.ACLRestoreTable(index, req.Reset, req.ACLs)
+	case "kvs":
+		err = c.state.KVSRestoreTable(index, req.Reset, req.DirEntries)
+	default:
+		err = fmt.Errorf("Invalid restore section '%s'", req.Section)
+	}
+	if err != nil {
+		c.logger.Info("TableRestore failed", logType(structs.TableRestoreRequestType), logIndex(index), logError(err))
+		return err
+	}
+	return nil
+}
+
+func (c *consulFSM) Snapshot() (raft.FSMSnapshot, error) {
+	defer func(start time.Time) {
+		c.logger.Info("Snapshot created", logDuration(time.Now().Sub(start)))
+	}(time.Now())
+
+	// Create a new snapshot
+	snap, err := c.state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &consulSnapshot{
+		fsm:      c,
+		state:    snap,
+		rate:     c.snapshotRate,
+		encoding: c.snapshotEncoding,
+		mirror:   c.snapshotMirror,
+	}, nil
+}
+
+// tableSnapshot is a snapshot of the section of the state that covers a
+// table, see TableSnapshot
+type tableSnapshot struct {
+	Index   uint64 // Last index of the section
+	snap    *consulSnapshot
+	section *snapshotSection
+}
+
+// TableSnapshot is used to take a snapshot of the section of the state
+// that covers a table, given by its name or the name of its section.
+// Tables persisted along with others, such as the services with the
+// nodes, are snapshotted with their section. The snapshot must be closed.
+func (c *consulFSM) TableSnapshot(table string) (*tableSnapshot, error) {
+	var section *snapshotSection
+	for i := range snapshotSections {
+		if snapshotSections[i].name == table || strContains(snapshotSections[i].tables, table) {
+			section = &snapshotSections[i]
+			break
+		}
+	}
+	if section == nil {
+		return nil, fmt.Errorf("Unknown table '%s'", table)
+	}
+
+	snap, err := c.state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	index, err := snap.TablesIndex(section.tables...)
+	if err != nil {
+		snap.Close()
+		return nil, err
+	}
+	return &tableSnapshot{
+		Index: index,
+		snap: &consulSnapshot{
+			fsm:      c,
+			state:    snap,
+			encoding: c.snapshotEncoding,
+		},
+		section: section,
+	}, nil
+}
+
+// WriteTo is used to write the snapshot as it is read from the state
+// store. It has the format of a full snapshot, with only the section of
+// the table, so it can be given to a partial restore.
+func (t *tableSnapshot) WriteTo(w io.Writer) error {
+	// Write the header, which is always encoded with msgpack
+	sink := &writerSink{w}
+	header := snapshotHeader{
+		LastIndex: t.Index,
+		Encoding:  t.snap.encoding,
+	}
+	if err := codec.NewEncoder(sink, msgpackHandle).Encode(&header); err != nil {
+		return err
+	}
+	sc, err := getSnapshotCodec(t.snap.encoding)
+	if err != nil {
+		return err
+	}
+	return t.section.persist(t.snap, sink, sc.newEncoder(sink))
+}
+
+// Close is used to release the snapshot of the state store
+func (t *tableSnapshot) Close() {
+	t.snap.state.Close()
+}
+
+func (c *consulFSM) Restore(old io.ReadCloser) error {
+	defer old.Close()
+
+	// Populate a new state store, so the current one is left in place
+	// if the snapshot cannot be restored
+	state, err := c.restoreState(old)
+	if err != nil {
+		return err
+	}
+
+	// The restored rows are not part of the change log
+	if err := state.ResetChangeLog(); err != nil {
+		state.Close()
+		return err
+	}
+	c.replaceState(state)
+
+	// The next snapshot cannot be incremental, since the restored
+	// state may not match the last persisted snapshot
+	c.setPersisted(nil)
+	c.setLastApply(time.Now())
+	return nil
+}
+
+// replaceState is used to swap in a populated state store. The old store
+// is abandoned so blocking queries against it wake up and retry against
+// the new store, and it is closed once the reads against it complete.
+func (c *consulFSM) replaceState(state *StateStore) {
+	prev := c.state
+	c.state = state
+	prev.Abandon()
+	prev.CloseWhenIdle()
+}
+
+// restoreState is used to create a new state store populated from a
+// snapshot. The store is closed if the snapshot cannot be restored.
+func (c *consulFSM) restoreState(old io.Reader) (*StateStore, error) {
+	// Create a temporary path for the state store
+	tmpPath, err := ioutil.TempDir(c.path, "state")
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new state store
+	state, err := NewStateStorePath(c.gc, tmpPath, c.logOutput)
+	if err != nil {
+		return nil, err
+	}
+	state.SetNotifyWindow(c.notifyWindow)
+	state.SetSessionHandler(c.sessionHandler)
+	state.SetCheckStatusHandler(c.checkStatusHandler)
+	if c.stateLogger != nil {
+		state.SetLogger(c.stateLogger)
+	}
+	if err := c.populateState(state, old); err != nil {
+		state.Close()
+		return nil, err
+	}
+	return state, nil
+}
+
+// populateState is used to restore the entries of a snapshot into a
+// new state store
+func (c *consulFSM) populateState(state *StateStore, old io.Reader) error {
+	// Read in the header, which selects the decoder of the entries
+	header, dec, err := readSnapshotHeader(old)
+	if err != nil {
+		return err
+	}
+
+	// Populate the new state. The most numerous entries are restored in
+	// batches, which must be flushed before the state store is written
+	// to by the other entries.
+	restore := state.Restore()
+	defer restore.Abort()
+	msgType := make([]byte, 1)
+	for {
+		// Read the message type
+		_, err := old.Read(msgType)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if !restoreBatched[structs.MessageType(msgType[0])] {
+			if err := restore.Flush(); err != nil {
+				return err
+			}
+		}
+
+		// Decode
+		switch structs.MessageType(msgType[0]) {
+		case structs.RegisterRequestType:
+			var req structs.RegisterRequest
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			c.applyRegister(state, &req, header.LastIndex)
+
+		case structs.KVSRequestType:
+			var req structs.DirEntry
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.KVS(&req); err != nil {
+				return err
+			}
+
+		case structs.SessionRequestType:
+			var req structs.Session
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.Session(&req); err != nil {
+				return err
+			}
+
+		case structs.ACLRequestType:
+			var req structs.ACL
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := restore.ACL(&req); err != nil {
+				return err
+			}
+
+		case structs.TombstoneRequestType:
 			var req structs.DirEntry
 			if err := dec.Decode(&req); err != nil {
 				return err
 			}
-			if err := c.state.TombstoneRestore(&req); err != nil {
+			if err := restore.Tombstone(&req); err != nil {
+				return err
+			}
+
+		case structs.CheckDefinitionRequestType:
+			var req structs.CheckDefinition
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.CheckDefinitionRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.ServiceConfigRequestType:
+			var req structs.ServiceConfig
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.ServiceConfigRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.IntentionRequestType:
+			var req structs.Intention
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.IntentionRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.NodeDrainRequestType:
+			var req structs.NodeDrain
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.NodeDrainRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.RegistrationTimeType:
+			var req structs.RegistrationTime
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.RegistrationTimeRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.LockWaiterType:
+			var req structs.LockWaiter
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.LockWaiterRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.CatalogEventType:
+			var req structs.CatalogEvent
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.CatalogEventRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.PrefixTombstoneType:
+			var req structs.PrefixTombstone
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.PrefixTombstoneRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.CheckHeardType:
+			var req structs.CheckHeard
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.CheckHeardRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.ClusterConfigRequestType:
+			var req structs.ClusterConfig
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.ClusterConfigRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.FeatureRequestType:
+			var req structs.Feature
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.FeatureRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.NodeProtectRequestType:
+			var req structs.NodeProtectRequest
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.NodeProtect(header.LastIndex, req.Node, req.Protected); err != nil {
+				return err
+			}
+
+		case structs.ConfigEntryRequestType:
+			var req structs.ConfigEntry
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.ConfigEntryRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.EventFireRequestType:
+			var req structs.UserEvent
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.UserEventRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.ACLUsageRequestType:
+			var req structs.ACLUsage
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.ACLUsageRestore(&req); err != nil {
 				return err
 			}
 
+		case structs.NodeHeartbeatRequestType:
+			var req structs.NodeSeen
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			if err := state.NodeSeenRestore(&req); err != nil {
+				return err
+			}
+
+		case structs.SnapshotUnchangedType:
+			var req structs.SnapshotUnchanged
+			if err := dec.Decode(&req); err != nil {
+				return err
+			}
+			return fmt.Errorf("Snapshot section '%s' unchanged since index %d was not resolved by the snapshot store",
+				req.Section, req.Index)
+
 		default:
 			return fmt.Errorf("Unrecognized msg type: %v", msgType)
 		}
 	}
 
-	return nil
+	return restore.Commit()
 }
 
 func (s *consulSnapshot) Persist(sink raft.SnapshotSink) error {
 	defer metrics.MeasureSince([]string{"consul", "fsm", "persist"}, time.Now())
-	// Register the nodes
-	encoder := codec.NewEncoder(sink, msgpackHandle)
 
-	// Write the header
+	// Skip the unchanged sections if the sink can resolve them. A mirror
+	// cannot, so the snapshot is written in full when mirrored.
+	incr, _ := sink.(IncrementalSnapshotSink)
+	var base map[string]uint64
+	if incr != nil && incr.Incremental() && s.mirror == nil {
+		base = s.fsm.getPersisted()
+	}
+
+	// Copy the snapshot to the mirror, if any. Failing to start the copy
+	// does not fail the snapshot.
+	var mirrored *mirroredSink
+	if s.mirror != nil {
+		if m, err := s.mirror.Create(s.state.LastIndex()); err != nil {
+			s.fsm.logger.Error("Failed to create snapshot mirror", logError(err))
+			metrics.IncrCounter([]string{"consul", "fsm", "persist", "mirror_failed"}, 1)
+		} else {
+			mirrored = newMirroredSink(sink, m, s.fsm.logger)
+			sink = mirrored
+		}
+	}
+
+	// Throttle the writes if configured
+	if s.rate > 0 {
+		sink = newRateLimitedSink(sink, s.rate)
+	}
+
+	// Write the header, which is always encoded with msgpack
 	header := snapshotHeader{
 		LastIndex: s.state.LastIndex(),
+		Encoding:  s.encoding,
 	}
-	if err := encoder.Encode(&header); err != nil {
+	if err := codec.NewEncoder(sink, msgpackHandle).Encode(&header); err != nil {
 		sink.Cancel()
 		return err
 	}
 
-	if err := s.persistNodes(sink, encoder); err != nil {
+	// Register the nodes
+	c, err := getSnapshotCodec(s.encoding)
+	if err != nil {
 		sink.Cancel()
 		return err
 	}
+	encoder := c.newEncoder(sink)
 
-	if err := s.persistSessions(sink, encoder); err != nil {
-		sink.Cancel()
-		return err
+	indexes := make(map[string]uint64, len(snapshotSections))
+	for _, section := range snapshotSections {
+		if err := s.persistSection(sink, incr, encoder, section, base, indexes); err != nil {
+			sink.Cancel()
+			return err
+		}
 	}
 
-	if err := s.persistACLs(sink, encoder); err != nil {
-		sink.Cancel()
-		return err
+	// The sections become the base of the next snapshot only once the
+	// sink is closed, which Raft does after the snapshot is persisted
+	if incr != nil {
+		incr.OnClose(func() { s.fsm.setPersisted(indexes) })
 	}
+	if mirrored != nil {
+		mirrored.finish()
+	}
+	return nil
+}
 
-	if err := s.persistKV(sink, encoder); err != nil {
-		sink.Cancel()
+// persistSection is used to persist a section of the snapshot. If the
+// section is unchanged since the base snapshot, only a marker is written.
+func (s *consulSnapshot) persistSection(sink raft.SnapshotSink, incr IncrementalSnapshotSink,
+	encoder snapshotEncoder, section snapshotSection, base, indexes map[string]uint64) error {
+	index, err := s.state.TablesIndex(section.tables...)
+	if err != nil {
 		return err
 	}
+	indexes[section.name] = index
 
-	if err := s.persistTombstones(sink, encoder); err != nil {
-		sink.Cancel()
-		return err
+	prev, ok := base[section.name]
+	unchanged := ok && section.incremental && index == prev
+	if incr != nil {
+		if err := incr.Section(section.name, index, unchanged); err != nil {
+			return err
+		}
 	}
-	return nil
+	if unchanged {
+		metrics.IncrCounter([]string{"consul", "fsm", "persist", "unchanged"}, 1)
+		sink.Write([]byte{byte(structs.SnapshotUnchangedType)})
+		return encoder.Encode(&structs.SnapshotUnchanged{Section: section.name, Index: index})
+	}
+	return section.persist(s, sink, encoder)
 }
 
 func (s *consulSnapshot) persistNodes(sink raft.SnapshotSink,
-	encoder *codec.Encoder) error {
+	encoder snapshotEncoder) error {
 	// Get all the nodes
 	nodes := s.state.Nodes()
 
@@ -412,8 +1539,10 @@ func (s *consulSnapshot) persistNodes(sink raft.SnapshotSink,
 	var req structs.RegisterRequest
 	for i := 0; i < len(nodes); i++ {
 		req = structs.RegisterRequest{
-			Node:    nodes[i].Node,
-			Address: nodes[i].Address,
+			Node:     nodes[i].Node,
+			Address:  nodes[i].Address,
+			NodeMeta: nodes[i].Meta,
+			NodeID:   nodes[i].NodeID,
 		}
 
 		// Register the node itself
@@ -422,9 +1551,21 @@ func (s *consulSnapshot) persistNodes(sink raft.SnapshotSink,
 			return err
 		}
 
+		// Protect the node, which a registration does not carry
+		if nodes[i].Protected {
+			protect := structs.NodeProtectRequest{Node: nodes[i].Node, Protected: true}
+			sink.Write([]byte{byte(structs.NodeProtectRequestType)})
+			if err := encoder.Encode(&protect); err != nil {
+				return err
+			}
+		}
+
 		// Register each service this node has
-		services := s.state.NodeServices(nodes[i].Node)
-		for _, srv := range services.Services {
+		services, err := s.state.NodeServiceList(nodes[i].Node)
+		if err != nil {
+			return err
+		}
+		for _, srv := range services {
 			req.Service = srv
 			sink.Write([]byte{byte(structs.RegisterRequestType)})
 			if err := encoder.Encode(&req); err != nil {
@@ -447,7 +1588,7 @@ func (s *consulSnapshot) persistNodes(sink raft.SnapshotSink,
 }
 
 func (s *consulSnapshot) persistSessions(sink raft.SnapshotSink,
-	encoder *codec.Encoder) error {
+	encoder snapshotEncoder) error {
 	sessions, err := s.state.SessionList()
 	if err != nil {
 		return err
@@ -463,7 +1604,7 @@ func (s *consulSnapshot) persistSessions(sink raft.SnapshotSink,
 }
 
 func (s *consulSnapshot) persistACLs(sink raft.SnapshotSink,
-	encoder *codec.Encoder) error {
+	encoder snapshotEncoder) error {
 	acls, err := s.state.ACLList()
 	if err != nil {
 		return err
@@ -478,8 +1619,24 @@ func (s *consulSnapshot) persistACLs(sink raft.SnapshotSink,
 	return nil
 }
 
+func (s *consulSnapshot) persistACLUsage(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	usages, err := s.state.ACLUsageList()
+	if err != nil {
+		return err
+	}
+
+	for _, usage := range usages {
+		sink.Write([]byte{byte(structs.ACLUsageRequestType)})
+		if err := encoder.Encode(usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *consulSnapshot) persistKV(sink raft.SnapshotSink,
-	encoder *codec.Encoder) error {
+	encoder snapshotEncoder) error {
 	streamCh := make(chan interface{}, 256)
 	errorCh := make(chan error)
 	go func() {
@@ -506,7 +1663,7 @@ func (s *consulSnapshot) persistKV(sink raft.SnapshotSink,
 }
 
 func (s *consulSnapshot) persistTombstones(sink raft.SnapshotSink,
-	encoder *codec.Encoder) error {
+	encoder snapshotEncoder) error {
 	streamCh := make(chan interface{}, 256)
 	errorCh := make(chan error)
 	go func() {
@@ -532,6 +1689,240 @@ func (s *consulSnapshot) persistTombstones(sink raft.SnapshotSink,
 	}
 }
 
+func (s *consulSnapshot) persistCheckDefinitions(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	defs, err := s.state.CheckDefinitionList()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range defs {
+		sink.Write([]byte{byte(structs.CheckDefinitionRequestType)})
+		if err := encoder.Encode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistServiceConfigs(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	confs, err := s.state.ServiceConfigList()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range confs {
+		sink.Write([]byte{byte(structs.ServiceConfigRequestType)})
+		if err := encoder.Encode(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistConfigEntries(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	entries, err := s.state.ConfigEntryList()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		sink.Write([]byte{byte(structs.ConfigEntryRequestType)})
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistUserEvents(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	events, err := s.state.UserEventList()
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range events {
+		sink.Write([]byte{byte(structs.EventFireRequestType)})
+		if err := encoder.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistNodeSeen(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	seens, err := s.state.NodeSeenList()
+	if err != nil {
+		return err
+	}
+
+	for _, seen := range seens {
+		sink.Write([]byte{byte(structs.NodeHeartbeatRequestType)})
+		if err := encoder.Encode(seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistIntentions(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	ixns, err := s.state.IntentionList()
+	if err != nil {
+		return err
+	}
+
+	for _, ixn := range ixns {
+		sink.Write([]byte{byte(structs.IntentionRequestType)})
+		if err := encoder.Encode(ixn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistNodeDrains(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	drains, err := s.state.NodeDrainList()
+	if err != nil {
+		return err
+	}
+
+	for _, nd := range drains {
+		sink.Write([]byte{byte(structs.NodeDrainRequestType)})
+		if err := encoder.Encode(nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistRegistrationTimes(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	times, err := s.state.RegistrationTimeList()
+	if err != nil {
+		return err
+	}
+
+	for _, rt := range times {
+		sink.Write([]byte{byte(structs.RegistrationTimeType)})
+		if err := encoder.Encode(rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistLockWaiters(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	waiters, err := s.state.LockWaiterList()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range waiters {
+		sink.Write([]byte{byte(structs.LockWaiterType)})
+		if err := encoder.Encode(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistCatalogEvents(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	events, err := s.state.CatalogEventList()
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range events {
+		sink.Write([]byte{byte(structs.CatalogEventType)})
+		if err := encoder.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistPrefixTombstones(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	tombs, err := s.state.PrefixTombstoneList()
+	if err != nil {
+		return err
+	}
+
+	for _, tomb := range tombs {
+		sink.Write([]byte{byte(structs.PrefixTombstoneType)})
+		if err := encoder.Encode(tomb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistCheckHeard(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	heards, err := s.state.CheckHeardList()
+	if err != nil {
+		return err
+	}
+
+	for _, heard := range heards {
+		sink.Write([]byte{byte(structs.CheckHeardType)})
+		if err := encoder.Encode(heard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *consulSnapshot) persistClusterConfig(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	conf, err := s.state.ClusterConfig()
+	if err != nil || conf == nil {
+		return err
+	}
+
+	sink.Write([]byte{byte(structs.ClusterConfigRequestType)})
+	return encoder.Encode(conf)
+}
+
+func (s *consulSnapshot) persistFeatures(sink raft.SnapshotSink,
+	encoder snapshotEncoder) error {
+	features, err := s.state.FeatureList()
+	if err != nil {
+		return err
+	}
+
+	for _, feature := range features {
+		sink.Write([]byte{byte(structs.FeatureRequestType)})
+		if err := encoder.Encode(feature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPersisted returns the section indexes of the last persisted snapshot
+func (c *consulFSM) getPersisted() map[string]uint64 {
+	c.persistedLock.Lock()
+	defer c.persistedLock.Unlock()
+	return c.persisted
+}
+
+// setPersisted is used to update the section indexes after a snapshot
+// is persisted
+func (c *consulFSM) setPersisted(indexes map[string]uint64) {
+	c.persistedLock.Lock()
+	defer c.persistedLock.Unlock()
+	c.persisted = indexes
+}
+
 func (s *consulSnapshot) Release() {
 	s.state.Close()
 }
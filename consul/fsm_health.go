@@ -0,0 +1,66 @@
+package consul
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// fsmHealthInterval is how often the health of the FSM is checked
+	// for a stall, and emitted as metrics
+	fsmHealthInterval = 5 * time.Second
+)
+
+// fsmHealth is used to get the health of the FSM of this server. The
+// table indexes are left out, since they require a snapshot of the
+// state store.
+func (s *Server) fsmHealth() *structs.FSMHealth {
+	stats := s.raft.Stats()
+	health := &structs.FSMHealth{
+		Server:    s.config.NodeName,
+		LastApply: s.fsm.LastApply(),
+	}
+	health.CommitIndex, _ = strconv.ParseUint(stats["commit_index"], 10, 64)
+	health.AppliedIndex, _ = strconv.ParseUint(stats["applied_index"], 10, 64)
+	if health.CommitIndex > health.AppliedIndex {
+		health.QueueDepth = health.CommitIndex - health.AppliedIndex
+	}
+	health.SinceLastApply = time.Now().Sub(health.LastApply)
+
+	// An idle FSM is not stalled, only one with entries waiting
+	threshold := s.config.FSMStallThreshold
+	health.Stalled = threshold > 0 && health.QueueDepth > 0 &&
+		health.SinceLastApply > threshold
+	return health
+}
+
+// monitorFSM is a long running routine used to emit the health of the
+// FSM as metrics, and to log when it stalls and when it recovers
+func (s *Server) monitorFSM() {
+	stalled := false
+	for {
+		select {
+		case <-time.After(fsmHealthInterval):
+		case <-s.shutdownCh:
+			return
+		}
+
+		health := s.fsmHealth()
+		metrics.SetGauge([]string{"consul", "fsm", "apply_queue_depth"}, float32(health.QueueDepth))
+		metrics.SetGauge([]string{"consul", "fsm", "since_last_apply"},
+			float32(health.SinceLastApply.Seconds()))
+
+		switch {
+		case health.Stalled && !stalled:
+			metrics.IncrCounter([]string{"consul", "fsm", "stalled"}, 1)
+			s.logger.Printf("[WARN] consul: FSM stalled, no entry applied for %v with %d entries waiting (applied index %d, commit index %d)",
+				health.SinceLastApply, health.QueueDepth, health.AppliedIndex, health.CommitIndex)
+		case !health.Stalled && stalled:
+			s.logger.Printf("[INFO] consul: FSM resumed, applied index %d", health.AppliedIndex)
+		}
+		stalled = health.Stalled
+	}
+}
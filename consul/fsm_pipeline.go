@@ -0,0 +1,233 @@
+package consul
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// fsmPipelineMaxPending is the maximum number of log entries decoded
+	// ahead of the FSM. Entries beyond it are decoded by the FSM itself.
+	fsmPipelineMaxPending = 4096
+)
+
+// fsmRequests returns an empty request for each message type that the
+// pipeline decodes ahead of the FSM
+var fsmRequests = map[structs.MessageType]func() interface{}{
+	structs.RegisterRequestType:        func() interface{} { return new(structs.RegisterRequest) },
+	structs.DeregisterRequestType:      func() interface{} { return new(structs.DeregisterRequest) },
+	structs.KVSRequestType:             func() interface{} { return new(structs.KVSRequest) },
+	structs.SessionRequestType:         func() interface{} { return new(structs.SessionRequest) },
+	structs.ACLRequestType:             func() interface{} { return new(structs.ACLRequest) },
+	structs.TombstoneRequestType:       func() interface{} { return new(structs.TombstoneRequest) },
+	structs.CheckDefinitionRequestType: func() interface{} { return new(structs.CheckDefinitionRequest) },
+	structs.ServiceConfigRequestType:   func() interface{} { return new(structs.ServiceConfigRequest) },
+	structs.IntentionRequestType:       func() interface{} { return new(structs.IntentionRequest) },
+	structs.NodeDrainRequestType:       func() interface{} { return new(structs.NodeDrainRequest) },
+	structs.TableRestoreRequestType:    func() interface{} { return new(structs.TableRestoreRequest) },
+	structs.CheckUpdateRequestType:     func() interface{} { return new(structs.CheckUpdateRequest) },
+	structs.ACLUsageRequestType:        func() interface{} { return new(structs.ACLUsageRequest) },
+	structs.ClusterConfigRequestType:   func() interface{} { return new(structs.ClusterConfigRequest) },
+	structs.FeatureRequestType:         func() interface{} { return new(structs.FeatureRequest) },
+	structs.NodeProtectRequestType:     func() interface{} { return new(structs.NodeProtectRequest) },
+	structs.ConfigEntryRequestType:     func() interface{} { return new(structs.ConfigEntryRequest) },
+	structs.EventFireRequestType:       func() interface{} { return new(structs.UserEvent) },
+	structs.StateCompactRequestType:    func() interface{} { return new(structs.StateCompactRequest) },
+	structs.NodeHeartbeatRequestType:   func() interface{} { return new(structs.NodeHeartbeatRequest) },
+	structs.NodeNameMergeRequestType:   func() interface{} { return new(structs.NodeNameMergeRequest) },
+}
+
+// fsmPipeline decodes log entries on worker goroutines as they are stored,
+// before they are committed, so the FSM only has to apply them. Entries
+// are still applied one at a time in log order, so the pipeline does not
+// change the outcome of applying the log, only where the decoding is done.
+type fsmPipeline struct {
+	l sync.Mutex
+
+	// pending holds the entries being decoded or decoded, by index, and
+	// applied is the index of the last entry taken by the FSM
+	pending map[uint64]*decodedLog
+	applied uint64
+
+	workCh     chan *decodedLog
+	shutdown   bool
+	shutdownCh chan struct{}
+}
+
+// decodedLog is a log entry decoded by the pipeline
+type decodedLog struct {
+	index  uint64
+	term   uint64
+	data   []byte
+	req    interface{}
+	err    error
+	doneCh chan struct{}
+}
+
+// newFSMPipeline returns a pipeline decoding with the given number of
+// workers
+func newFSMPipeline(workers int) *fsmPipeline {
+	p := &fsmPipeline{
+		pending:    make(map[uint64]*decodedLog),
+		workCh:     make(chan *decodedLog, fsmPipelineMaxPending),
+		shutdownCh: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Shutdown is used to stop the workers. Entries not decoded yet are
+// decoded by the FSM instead.
+func (p *fsmPipeline) Shutdown() {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if !p.shutdown {
+		p.shutdown = true
+		close(p.shutdownCh)
+	}
+}
+
+// worker is a long running routine decoding the submitted entries
+func (p *fsmPipeline) worker() {
+	for {
+		select {
+		case d := <-p.workCh:
+			msgType := structs.MessageType(d.data[0]) &^ structs.IgnoreUnknownTypeFlag
+			d.req = fsmRequests[msgType]()
+			d.err = structs.Decode(d.data[1:], d.req)
+			close(d.doneCh)
+		case <-p.shutdownCh:
+			return
+		}
+	}
+}
+
+// submit is used to queue a stored log entry for decoding. Entries are
+// skipped rather than delaying the log store when the pipeline is full.
+func (p *fsmPipeline) submit(log *raft.Log) {
+	if log.Type != raft.LogCommand || len(log.Data) == 0 {
+		return
+	}
+	msgType := structs.MessageType(log.Data[0]) &^ structs.IgnoreUnknownTypeFlag
+	if _, ok := fsmRequests[msgType]; !ok {
+		return
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.shutdown || log.Index <= p.applied {
+		return
+	}
+	if len(p.pending) >= fsmPipelineMaxPending {
+		p.pruneLocked()
+	}
+	d := &decodedLog{
+		index:  log.Index,
+		term:   log.Term,
+		data:   log.Data,
+		doneCh: make(chan struct{}),
+	}
+	select {
+	case p.workCh <- d:
+		p.pending[log.Index] = d
+	default:
+	}
+}
+
+// forget is used to drop the entries in a range of indexes, which are
+// deleted from the log
+func (p *fsmPipeline) forget(min, max uint64) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	for index := range p.pending {
+		if index >= min && index <= max {
+			delete(p.pending, index)
+		}
+	}
+}
+
+// pruneLocked drops the entries the FSM is past, such as those covered
+// by a snapshot it restored instead of applying them
+func (p *fsmPipeline) pruneLocked() {
+	for index := range p.pending {
+		if index <= p.applied {
+			delete(p.pending, index)
+		}
+	}
+}
+
+// take returns the decoded request of an entry the FSM is about to apply,
+// waiting for a worker to finish decoding it if needed. It returns nil if
+// the entry was not decoded by the pipeline, or failed to decode, in
+// which case the FSM decodes it itself.
+func (p *fsmPipeline) take(log *raft.Log) interface{} {
+	p.l.Lock()
+	d, ok := p.pending[log.Index]
+	delete(p.pending, log.Index)
+	p.applied = log.Index
+	p.l.Unlock()
+
+	// An entry is identified by its index and term, an entry stored at
+	// the same index by another leader is a different one
+	if !ok || d.term != log.Term || len(d.data) != len(log.Data) {
+		return nil
+	}
+	select {
+	case <-d.doneCh:
+	case <-p.shutdownCh:
+		return nil
+	}
+	if d.err != nil {
+		return nil
+	}
+	return d.req
+}
+
+// pipelineLogStore wraps a raft.LogStore to submit the entries stored to
+// the pipeline
+type pipelineLogStore struct {
+	raft.LogStore
+	pipeline *fsmPipeline
+}
+
+func (s *pipelineLogStore) StoreLog(log *raft.Log) error {
+	if err := s.LogStore.StoreLog(log); err != nil {
+		return err
+	}
+	s.pipeline.submit(log)
+	return nil
+}
+
+func (s *pipelineLogStore) StoreLogs(logs []*raft.Log) error {
+	if err := s.LogStore.StoreLogs(logs); err != nil {
+		return err
+	}
+	for _, log := range logs {
+		s.pipeline.submit(log)
+	}
+	return nil
+}
+
+func (s *pipelineLogStore) DeleteRange(min, max uint64) error {
+	s.pipeline.forget(min, max)
+	return s.LogStore.DeleteRange(min, max)
+}
+
+// decode is used to decode the request of the entry being applied. If the
+// pipeline already decoded the entry, its request is used instead.
+func (c *consulFSM) decode(buf []byte, out interface{}) error {
+	c.applying = out
+	if req := c.decoded; req != nil {
+		c.decoded = nil
+		if reflect.TypeOf(req) == reflect.TypeOf(out) {
+			reflect.ValueOf(out).Elem().Set(reflect.ValueOf(req).Elem())
+			return nil
+		}
+	}
+	return structs.Decode(buf, out)
+}
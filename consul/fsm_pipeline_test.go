@@ -0,0 +1,133 @@
+package consul
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+func TestFSMPipeline_Take(t *testing.T) {
+	p := newFSMPipeline(2)
+	defer p.Shutdown()
+
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	buf, err := structs.Encode(structs.RegisterRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	log := &raft.Log{Index: 1, Term: 1, Type: raft.LogCommand, Data: buf}
+	p.submit(log)
+
+	out, ok := p.take(log).(*structs.RegisterRequest)
+	if !ok || out.Node != "foo" || out.Address != "127.0.0.1" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Entries are only taken once
+	if out := p.take(log); out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// An entry of another term at the same index is not the same entry
+	log = &raft.Log{Index: 2, Term: 1, Type: raft.LogCommand, Data: buf}
+	p.submit(log)
+	if out := p.take(&raft.Log{Index: 2, Term: 2, Type: raft.LogCommand, Data: buf}); out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Entries deleted from the log are dropped
+	log = &raft.Log{Index: 3, Term: 2, Type: raft.LogCommand, Data: buf}
+	p.submit(log)
+	p.forget(3, 3)
+	if out := p.take(log); out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Entries the FSM is past are not submitted
+	p.submit(&raft.Log{Index: 2, Term: 2, Type: raft.LogCommand, Data: buf})
+	if len(p.pending) != 0 {
+		t.Fatalf("bad: %v", p.pending)
+	}
+}
+
+func TestFSM_ApplyPipelined(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	fsm.SetDecodeWorkers(2)
+	store := fsm.WrapLogStore(raft.NewInmemStore())
+
+	var logs []*raft.Log
+	for i, node := range []string{"foo", "bar", "baz"} {
+		req := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+		}
+		buf, err := structs.Encode(structs.RegisterRequestType, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		logs = append(logs, &raft.Log{Index: uint64(i + 1), Term: 1, Type: raft.LogCommand, Data: buf})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A new leader replaces the last entry
+	req := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "/test/path",
+			Value: []byte("test"),
+		},
+	}
+	buf, err := structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteRange(3, 3); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	logs[2] = &raft.Log{Index: 3, Term: 2, Type: raft.LogCommand, Data: buf}
+	if err := store.StoreLog(logs[2]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, log := range logs {
+		if resp := fsm.Apply(log); resp != nil {
+			t.Fatalf("resp: %v", resp)
+		}
+	}
+
+	for _, node := range []string{"foo", "bar"} {
+		if _, found, _ := fsm.state.GetNode(node); !found {
+			t.Fatalf("missing node %s", node)
+		}
+	}
+	if _, found, _ := fsm.state.GetNode("baz"); found {
+		t.Fatalf("replaced entry should not be applied")
+	}
+	_, d, err := fsm.state.KVSGet("/test/path")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+}
@@ -2,11 +2,17 @@ package consul
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/raft"
 )
 
@@ -328,6 +334,65 @@ func TestFSM_DeregisterNode(t *testing.T) {
 	}
 }
 
+func TestFSM_DeregisterNode_Protected(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	protect := structs.NodeProtectRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Protected:  true,
+	}
+	buf, err := structs.Encode(structs.NodeProtectRequestType, protect)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// The deregistration is refused unless forced
+	dereg := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	buf, err = structs.Encode(structs.DeregisterRequestType, dereg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if err, ok := resp.(error); !ok || structs.ErrorCodeOf(err) != structs.ErrCodeNodeProtected {
+		t.Fatalf("resp: %v", resp)
+	}
+	if _, found, _ := fsm.state.GetNode("foo"); !found {
+		t.Fatalf("not found!")
+	}
+
+	dereg.Force = true
+	buf, err = structs.Encode(structs.DeregisterRequestType, dereg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	if _, found, _ := fsm.state.GetNode("foo"); found {
+		t.Fatalf("found!")
+	}
+}
+
 func TestFSM_SnapshotRestore(t *testing.T) {
 	path, err := ioutil.TempDir("", "fsm")
 	if err != nil {
@@ -341,12 +406,12 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	defer fsm.Close()
 
 	// Add some state
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	fsm.state.EnsureNode(2, structs.Node{"baz", "127.0.0.2"})
-	fsm.state.EnsureService(3, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false})
-	fsm.state.EnsureService(4, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false})
-	fsm.state.EnsureService(5, "baz", &structs.NodeService{"web", "web", nil, "127.0.0.2", 80, false})
-	fsm.state.EnsureService(6, "baz", &structs.NodeService{"db", "db", []string{"secondary"}, "127.0.0.2", 5000, false})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.EnsureNode(2, structs.Node{Node: "baz", Address: "127.0.0.2", Meta: map[string]string{"ssd": "true"}})
+	fsm.state.EnsureService(3, "foo", &structs.NodeService{"web", "web", nil, "127.0.0.1", 80, false, "", false, "", nil, ""})
+	fsm.state.EnsureService(4, "foo", &structs.NodeService{"db", "db", []string{"primary"}, "127.0.0.1", 5000, false, "", false, "", nil, ""})
+	fsm.state.EnsureService(5, "baz", &structs.NodeService{"web", "web", nil, "127.0.0.2", 80, false, "", false, "", nil, ""})
+	fsm.state.EnsureService(6, "baz", &structs.NodeService{"db", "db", []string{"secondary"}, "127.0.0.2", 5000, false, "", false, "", nil, ""})
 	fsm.state.EnsureCheck(7, &structs.HealthCheck{
 		Node:      "foo",
 		CheckID:   "web",
@@ -368,6 +433,28 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 		Value: []byte("foo"),
 	})
 	fsm.state.KVSDelete(12, "/remove")
+	fsm.state.CheckDefinitionSet(13, &structs.CheckDefinition{
+		Node:     "baz",
+		CheckID:  "ping",
+		TCP:      "127.0.0.2:22",
+		Interval: 10 * time.Second,
+	})
+	fsm.state.ServiceConfigSet(14, &structs.ServiceConfig{
+		Service: "db",
+		DNSTTL:  30 * time.Second,
+	})
+	fsm.state.IntentionSet(15, &structs.Intention{
+		ID:              "ixn1",
+		SourceName:      "web",
+		DestinationName: "db",
+		Action:          structs.IntentionActionAllow,
+	})
+	fsm.state.NodeProtect(16, "baz", true)
+	fsm.state.ConfigEntrySet(17, &structs.ConfigEntry{
+		Kind:   structs.ServiceDefaults,
+		Name:   "db",
+		Config: map[string]string{"protocol": "http"},
+	})
 
 	// Snapshot
 	snap, err := fsm.Snapshot()
@@ -400,6 +487,14 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	if len(nodes) != 2 {
 		t.Fatalf("Bad: %v", nodes)
 	}
+	for _, node := range nodes {
+		if node.Node == "baz" && (node.Meta["ssd"] != "true" || !node.Protected) {
+			t.Fatalf("Bad: %v", node)
+		}
+		if node.Node == "foo" && node.Protected {
+			t.Fatalf("Bad: %v", node)
+		}
+	}
 
 	_, fooSrv := fsm2.state.NodeServices("foo")
 	if len(fooSrv.Services) != 2 {
@@ -427,7 +522,7 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	}
 
 	// Verify the index is restored
-	idx, _, err := fsm2.state.KVSListKeys("/blah", "")
+	idx, _, err := fsm2.state.KVSListKeys("/blah", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -460,13 +555,61 @@ func TestFSM_SnapshotRestore(t *testing.T) {
 	}
 
 	// Verify tombstones are restored
-	_, res, err := fsm2.state.tombstoneTable.Get("id", "/remove")
+	_, res, err := fsm2.state.tombstoneTable.Get("id", "", "/remove")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	if len(res) != 1 {
 		t.Fatalf("bad: %v", res)
 	}
+
+	// Verify check definitions are restored
+	idx, def, err := fsm2.state.CheckDefinitionGet("baz", "ping")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if def == nil || def.TCP != "127.0.0.2:22" {
+		t.Fatalf("bad: %v", def)
+	}
+	if idx != 13 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Verify service configs are restored
+	idx, conf, err := fsm2.state.ServiceConfigGet("db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf == nil || conf.DNSTTL != 30*time.Second {
+		t.Fatalf("bad: %v", conf)
+	}
+	if idx != 14 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Verify intentions are restored
+	idx, ixn, err := fsm2.state.IntentionGet("ixn1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ixn == nil || ixn.SourceName != "web" || ixn.Action != structs.IntentionActionAllow {
+		t.Fatalf("bad: %v", ixn)
+	}
+	if idx != 15 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Verify config entries are restored
+	idx, entry, err := fsm2.state.ConfigEntryGet(structs.ServiceDefaults, "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if entry == nil || entry.Config["protocol"] != "http" {
+		t.Fatalf("bad: %v", entry)
+	}
+	if idx != 17 {
+		t.Fatalf("bad index: %d", idx)
+	}
 }
 
 func TestFSM_KVSSet(t *testing.T) {
@@ -747,7 +890,7 @@ func TestFSM_SessionCreate_Destroy(t *testing.T) {
 	}
 	defer fsm.Close()
 
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	fsm.state.EnsureCheck(2, &structs.HealthCheck{
 		Node:    "foo",
 		CheckID: "web",
@@ -832,7 +975,7 @@ func TestFSM_KVSLock(t *testing.T) {
 	}
 	defer fsm.Close()
 
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
 	fsm.state.SessionCreate(2, session)
 
@@ -882,7 +1025,7 @@ func TestFSM_KVSUnlock(t *testing.T) {
 	}
 	defer fsm.Close()
 
-	fsm.state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
 	fsm.state.SessionCreate(2, session)
 
@@ -1089,3 +1232,1382 @@ func TestFSM_IgnoreUnknown(t *testing.T) {
 		t.Fatalf("resp: %v", err)
 	}
 }
+
+func TestFSM_CheckDefinition_Set_Delete(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	// Create a new definition
+	req := structs.CheckDefinitionRequest{
+		Datacenter: "dc1",
+		Op:         structs.CheckDefinitionSet,
+		Definition: structs.CheckDefinition{
+			Node:     "foo",
+			CheckID:  "ping",
+			TCP:      "127.0.0.1:22",
+			Interval: 10 * time.Second,
+		},
+	}
+	buf, err := structs.Encode(structs.CheckDefinitionRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, def, err := fsm.state.CheckDefinitionGet("foo", "ping")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if def == nil || def.TCP != "127.0.0.1:22" {
+		t.Fatalf("bad: %v", def)
+	}
+
+	// Try to delete
+	req.Op = structs.CheckDefinitionDelete
+	buf, err = structs.Encode(structs.CheckDefinitionRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, def, err = fsm.state.CheckDefinitionGet("foo", "ping")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if def != nil {
+		t.Fatalf("should be deleted")
+	}
+}
+
+func TestFSM_Validate(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// A session on a missing node should fail
+	sess := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			ID:   generateUUID(),
+			Node: "foo",
+		},
+	}
+	buf, err := structs.Encode(structs.SessionRequestType, sess)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.Validate(makeLog(buf)); err == nil || err.Error() != "Missing node registration" {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A check on a service in the same request should pass
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+		},
+		Check: &structs.HealthCheck{
+			Node:      "foo",
+			CheckID:   "db",
+			ServiceID: "db",
+		},
+	}
+	buf, err = structs.Encode(structs.RegisterRequestType, reg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.Validate(makeLog(buf)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Node names are case insensitive
+	reg.Check.Node = "FOO"
+	buf, err = structs.Encode(structs.RegisterRequestType, reg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.Validate(makeLog(buf)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A check on a missing service should fail
+	reg.Service = nil
+	buf, err = structs.Encode(structs.RegisterRequestType, reg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.Validate(makeLog(buf)); err == nil || err.Error() != "Missing service registration" {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Validate must not modify the state
+	if _, found, _ := fsm.state.GetNode("foo"); found {
+		t.Fatalf("should not be registered")
+	}
+
+	// Once the node exists the session should pass
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	buf, err = structs.Encode(structs.SessionRequestType, sess)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.Validate(makeLog(buf)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A lock with an unknown session should fail
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt: structs.DirEntry{
+			Key:     "/test/path",
+			Session: sess.Session.ID,
+		},
+	}
+	buf, err = structs.Encode(structs.KVSRequestType, kv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.Validate(makeLog(buf)); err == nil || err.Error() != "Invalid session" {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFSM_TombstoneReapPrefix(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Create some tombstones
+	fsm.state.KVSSet(11, &structs.DirEntry{Key: "/hot/remove"})
+	fsm.state.KVSDelete(12, "/hot/remove")
+	fsm.state.KVSSet(13, &structs.DirEntry{Key: "/cold/remove"})
+	fsm.state.KVSDelete(14, "/cold/remove")
+
+	// Create a new reap request
+	req := structs.TombstoneRequest{
+		Datacenter: "dc1",
+		Op:         structs.TombstoneReapPrefix,
+		ReapIndex:  14,
+		Prefix:     "/hot",
+	}
+	buf, err := structs.Encode(structs.TombstoneRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if err, ok := resp.(error); ok {
+		t.Fatalf("resp: %v", err)
+	}
+
+	// Verify only the hot tombstone is gone
+	_, res, err := fsm.state.tombstoneTable.Get("id")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 || res[0].(*structs.DirEntry).Key != "/cold/remove" {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
+func TestFSM_ServiceConfig_Set_Delete(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Create a new config
+	req := structs.ServiceConfigRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceConfigSet,
+		Config: structs.ServiceConfig{
+			Service: "db",
+			DNSTTL:  10 * time.Second,
+		},
+	}
+	buf, err := structs.Encode(structs.ServiceConfigRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, conf, err := fsm.state.ServiceConfigGet("db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf == nil || conf.DNSTTL != 10*time.Second {
+		t.Fatalf("bad: %v", conf)
+	}
+
+	// Try to delete
+	req.Op = structs.ServiceConfigDelete
+	buf, err = structs.Encode(structs.ServiceConfigRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, conf, err = fsm.state.ServiceConfigGet("db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf != nil {
+		t.Fatalf("should be deleted")
+	}
+}
+
+func TestFSM_ConfigEntry_Set_Delete(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Create a new entry
+	req := structs.ConfigEntryRequest{
+		Datacenter: "dc1",
+		Op:         structs.ConfigEntrySet,
+		Entry: structs.ConfigEntry{
+			Kind:   structs.ProxyDefaults,
+			Name:   structs.ProxyConfigGlobal,
+			Config: map[string]string{"local_connect_timeout_ms": "1000"},
+		},
+	}
+	buf, err := structs.Encode(structs.ConfigEntryRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, entry, err := fsm.state.ConfigEntryGet(structs.ProxyDefaults, structs.ProxyConfigGlobal)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if entry == nil || entry.Config["local_connect_timeout_ms"] != "1000" {
+		t.Fatalf("bad: %v", entry)
+	}
+
+	// Try to delete
+	req.Op = structs.ConfigEntryDelete
+	buf, err = structs.Encode(structs.ConfigEntryRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, entry, err = fsm.state.ConfigEntryGet(structs.ProxyDefaults, structs.ProxyConfigGlobal)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if entry != nil {
+		t.Fatalf("should be deleted")
+	}
+}
+
+func TestFSM_DeregisterServiceName(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Register db on two nodes, and web on one of them
+	for _, node := range []string{"foo", "bar"} {
+		for _, service := range []string{"db", "web"} {
+			if node == "bar" && service == "web" {
+				continue
+			}
+			req := structs.RegisterRequest{
+				Datacenter: "dc1",
+				Node:       node,
+				Address:    "127.0.0.1",
+				Service: &structs.NodeService{
+					ID:      service + "1",
+					Service: service,
+					Port:    8000,
+				},
+				Check: &structs.HealthCheck{
+					Node:      node,
+					CheckID:   service + "-check",
+					Status:    structs.HealthPassing,
+					ServiceID: service + "1",
+				},
+			}
+			buf, err := structs.Encode(structs.RegisterRequestType, req)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if resp := fsm.Apply(makeLog(buf)); resp != nil {
+				t.Fatalf("resp: %v", resp)
+			}
+		}
+	}
+
+	dereg := structs.DeregisterRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+	}
+	buf, err := structs.Encode(structs.DeregisterRequestType, dereg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Verify all the db instances are gone
+	_, nodes := fsm.state.ServiceNodes("db", nil)
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, checks := fsm.state.NodeChecks("bar")
+	if len(checks) != 0 {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// Verify the nodes and other services remain
+	if _, found, _ := fsm.state.GetNode("bar"); !found {
+		t.Fatalf("not found!")
+	}
+	_, services := fsm.state.NodeServices("foo")
+	if _, ok := services.Services["web1"]; !ok {
+		t.Fatalf("web not registered!")
+	}
+}
+
+func TestFSM_Intention_Set_Delete(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Create a new intention
+	req := structs.IntentionRequest{
+		Datacenter: "dc1",
+		Op:         structs.IntentionSet,
+		Intention: structs.Intention{
+			ID:              generateUUID(),
+			SourceName:      "web",
+			DestinationName: "db",
+			Action:          structs.IntentionActionDeny,
+		},
+	}
+	buf, err := structs.Encode(structs.IntentionRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, ixn, err := fsm.state.IntentionMatch("web", "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ixn == nil || ixn.ID != req.Intention.ID {
+		t.Fatalf("bad: %v", ixn)
+	}
+
+	// Try to delete
+	req.Op = structs.IntentionDelete
+	buf, err = structs.Encode(structs.IntentionRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, ixn, err = fsm.state.IntentionGet(req.Intention.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ixn != nil {
+		t.Fatalf("should be deleted")
+	}
+}
+
+type IncrementalMockSink struct {
+	*MockSink
+	closeErr error
+	onClose  []func()
+}
+
+func (m *IncrementalMockSink) Incremental() bool {
+	return true
+}
+
+func (m *IncrementalMockSink) Section(name string, index uint64, unchanged bool) error {
+	return nil
+}
+
+func (m *IncrementalMockSink) OnClose(fn func()) {
+	m.onClose = append(m.onClose, fn)
+}
+
+func (m *IncrementalMockSink) Close() error {
+	if m.closeErr != nil {
+		return m.closeErr
+	}
+	for _, fn := range m.onClose {
+		fn()
+	}
+	return nil
+}
+
+func TestFSM_SnapshotIncremental(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.KVSSet(2, &structs.DirEntry{Key: "/test", Value: []byte("foo")})
+
+	persist := func(closeErr error) (*bytes.Buffer, []string) {
+		snap, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer snap.Release()
+
+		buf := bytes.NewBuffer(nil)
+		sink := &IncrementalMockSink{MockSink: &MockSink{buf, false}, closeErr: closeErr}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sink.Close()
+
+		// Collect the unchanged sections
+		data := bytes.NewBuffer(buf.Bytes())
+		dec := codec.NewDecoder(data, msgpackHandle)
+		var header snapshotHeader
+		if err := dec.Decode(&header); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var unchanged []string
+		msgType := make([]byte, 1)
+		for {
+			if _, err := data.Read(msgType); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if structs.MessageType(msgType[0]) == structs.SnapshotUnchangedType {
+				var req structs.SnapshotUnchanged
+				if err := dec.Decode(&req); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				unchanged = append(unchanged, req.Section)
+				continue
+			}
+			var req interface{}
+			if err := dec.Decode(&req); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		return buf, unchanged
+	}
+
+	// The first snapshot is always full
+	full, unchanged := persist(nil)
+	if len(unchanged) != 0 {
+		t.Fatalf("bad: %v", unchanged)
+	}
+
+	// Only the KV store churns
+	fsm.state.KVSSet(3, &structs.DirEntry{Key: "/test", Value: []byte("bar")})
+	_, unchanged = persist(nil)
+	expect := []string{"nodes", "sessions", "acls", "checkDefinitions",
+		"serviceConfigs", "intentions"}
+	if !reflect.DeepEqual(unchanged, expect) {
+		t.Fatalf("bad: %v", unchanged)
+	}
+
+	// A full snapshot restores fine
+	if err := fsm.Restore(&MockSink{full, false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// After a restore the next snapshot must be full again, and so must
+	// the one after a snapshot that failed to close
+	_, unchanged = persist(errors.New("failed"))
+	if len(unchanged) != 0 {
+		t.Fatalf("bad: %v", unchanged)
+	}
+	_, unchanged = persist(nil)
+	if len(unchanged) != 0 {
+		t.Fatalf("bad: %v", unchanged)
+	}
+
+	// An unresolved marker cannot be restored
+	incr, unchanged := persist(nil)
+	if len(unchanged) == 0 {
+		t.Fatalf("expected unchanged sections")
+	}
+	if err := fsm.Restore(&MockSink{incr, false}); err == nil || !strings.Contains(err.Error(), "unchanged") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFSM_SnapshotMirror(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	mirror := &MockMirror{}
+	fsm.SetSnapshotMirror(mirror)
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.KVSSet(2, &structs.DirEntry{Key: "/test", Value: []byte("foo")})
+
+	// Persist twice to an incremental sink, the mirror gets both in full
+	for i := 0; i < 2; i++ {
+		snap, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf := bytes.NewBuffer(nil)
+		sink := &IncrementalMockSink{MockSink: &MockSink{buf, false}}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sink.Close()
+		snap.Release()
+
+		m := mirror.sinks[i]
+		if m.index != 2 || !m.closed || m.cancelled {
+			t.Fatalf("bad: %v %v %v", m.index, m.closed, m.cancelled)
+		}
+		if !bytes.Equal(m.Bytes(), buf.Bytes()) {
+			t.Fatalf("mirror should match the snapshot")
+		}
+	}
+
+	// The copy restores on its own
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(&MockSink{mirror.sinks[1].Buffer, false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err := fsm2.state.KVSGet("/test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "foo" {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestFSM_SessionDestroy_LockDelayClock(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	session := &structs.Session{ID: generateUUID(), Node: "foo", LockDelay: 10 * time.Second}
+	fsm.state.SessionCreate(2, session)
+	ok, err := fsm.state.KVSLock(3, &structs.DirEntry{Key: "/test/path", Session: session.ID})
+	if err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+
+	// Destroy the session with a request stamped in the past
+	stamp := time.Now().Add(-time.Minute)
+	req := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionDestroy,
+		Session:    *session,
+	}
+	req.SetTimestamp(stamp)
+	buf, err := structs.Encode(structs.SessionRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// The lock delay must be relative to the clock of the request,
+	// so it has already expired
+	expires := fsm.state.KVSLockDelay("/test/path")
+	if !expires.Equal(stamp.Add(10 * time.Second)) {
+		t.Fatalf("bad: %v", expires)
+	}
+	if expires.After(time.Now()) {
+		t.Fatalf("bad: %v", expires)
+	}
+}
+
+func TestFSM_RegistrationTimes(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// Register a node and a service twice, with the leader time
+	// on each request
+	stamp1 := time.Now().Add(-time.Hour)
+	stamp2 := time.Now().Add(-time.Minute)
+	for _, stamp := range []time.Time{stamp1, stamp2} {
+		req := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+				Port:    8000,
+			},
+		}
+		req.SetTimestamp(stamp)
+		buf, err := structs.Encode(structs.RegisterRequestType, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := fsm.Apply(makeLog(buf))
+		if resp != nil {
+			t.Fatalf("resp: %v", resp)
+		}
+	}
+
+	verify := func(state *StateStore) {
+		_, dump := state.NodeInfo("foo")
+		if len(dump) != 1 {
+			t.Fatalf("bad: %v", dump)
+		}
+		info := dump[0]
+		if info.RegisteredAt != stamp1.UnixNano() || info.LastSyncedAt != stamp2.UnixNano() {
+			t.Fatalf("bad: %#v", info)
+		}
+		rt, ok := info.ServiceTimes["db"]
+		if !ok || rt.RegisteredAt != stamp1.UnixNano() || rt.LastSyncedAt != stamp2.UnixNano() {
+			t.Fatalf("bad: %#v", rt)
+		}
+	}
+	verify(fsm.state)
+
+	// The times must survive a snapshot and restore
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	verify(fsm2.state)
+
+	// Deregistering the service removes its times
+	if err := fsm2.state.DeleteNodeService(10, "foo", "db"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, dump := fsm2.state.NodeInfo("foo")
+	if len(dump[0].ServiceTimes) != 0 {
+		t.Fatalf("bad: %v", dump[0].ServiceTimes)
+	}
+}
+
+func TestFSM_CorruptEntry(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	// A corrupt KVS entry is marked failed
+	buf := []byte{byte(structs.KVSRequestType), 0xc1}
+	resp := fsm.Apply(makeLog(buf))
+	if err, ok := resp.(error); !ok || !strings.Contains(err.Error(), "failed to decode") {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// An empty entry is marked failed
+	resp = fsm.Apply(makeLog(nil))
+	if _, ok := resp.(error); !ok {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// The FSM still applies the following entries
+	req := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "foo", Value: []byte("bar")},
+	}
+	buf, err = structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, d, err := fsm.state.KVSGet("foo")
+	if err != nil || d == nil {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	// A corrupt ACL entry is not safe to skip
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("should panic")
+		}
+	}()
+	fsm.Apply(makeLog([]byte{byte(structs.ACLRequestType), 0xc1}))
+}
+
+func TestFSM_CheckUpdate(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.EnsureService(2, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""})
+	check := &structs.HealthCheck{
+		Node:      "foo",
+		CheckID:   "db",
+		Name:      "db connectivity",
+		Notes:     "verify the connection",
+		Status:    structs.HealthPassing,
+		ServiceID: "db",
+	}
+	fsm.state.EnsureCheck(3, check)
+
+	req := structs.CheckUpdateRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		CheckID:    "db",
+		Status:     structs.HealthCritical,
+		Output:     "connection refused",
+	}
+	buf, err := structs.Encode(structs.CheckUpdateRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Only the status and output should change
+	_, checks := fsm.state.NodeChecks("foo")
+	if len(checks) != 1 {
+		t.Fatalf("bad: %v", checks)
+	}
+	out := checks[0]
+	if out.Status != structs.HealthCritical || out.Output != "connection refused" {
+		t.Fatalf("bad: %v", out)
+	}
+	if out.Name != check.Name || out.Notes != check.Notes || out.ServiceName != "db" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Updating a missing check fails
+	req.CheckID = "nope"
+	buf, err = structs.Encode(structs.CheckUpdateRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if err, ok := resp.(error); !ok || structs.ErrorCodeOf(err) != structs.ErrCodeMissingCheck {
+		t.Fatalf("resp: %v", resp)
+	}
+}
+
+func TestFSM_CatalogEvents(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	acl := &structs.ACL{ID: generateUUID(), Name: "deploy"}
+	if err := fsm.state.ACLSet(1, acl); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Register a service with a check, using the token
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+		},
+		Check: &structs.HealthCheck{
+			Node:      "foo",
+			CheckID:   "db",
+			Name:      "db connectivity",
+			ServiceID: "db",
+		},
+		WriteRequest: structs.WriteRequest{Token: acl.ID},
+	}
+	buf, err := structs.Encode(structs.RegisterRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	log := makeLog(buf)
+	log.Index = 2
+	if resp := fsm.Apply(log); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Syncing the same registration again changes nothing
+	log = makeLog(buf)
+	log.Index = 3
+	if resp := fsm.Apply(log); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// Deregister the node without a token, twice
+	dereq := structs.DeregisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+	}
+	buf, err = structs.Encode(structs.DeregisterRequestType, dereq)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, index := range []uint64{4, 5} {
+		log = makeLog(buf)
+		log.Index = index
+		if resp := fsm.Apply(log); resp != nil {
+			t.Fatalf("resp: %v", resp)
+		}
+	}
+
+	// Only the changes are recorded
+	idx, events, err := fsm.state.CatalogEvents("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 || len(events) != 2 {
+		t.Fatalf("bad: %d %v", idx, events)
+	}
+	reg := events[0]
+	if reg.Op != structs.CatalogEventRegister || reg.Index != 2 || reg.ServiceID != "db" {
+		t.Fatalf("bad: %v", reg)
+	}
+	if len(reg.CheckIDs) != 1 || reg.CheckIDs[0] != "db" {
+		t.Fatalf("bad: %v", reg)
+	}
+	if reg.Actor != "deploy" || reg.TokenHash == "" || reg.TokenHash == acl.ID {
+		t.Fatalf("bad: %v", reg)
+	}
+	dereg := events[1]
+	if dereg.Op != structs.CatalogEventDeregister || dereg.Index != 4 {
+		t.Fatalf("bad: %v", dereg)
+	}
+	if dereg.Actor != "" || dereg.TokenHash != "" {
+		t.Fatalf("bad: %v", dereg)
+	}
+
+	// Snapshot and restore, which must not record the restored
+	// registrations again
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := &MockSink{bytes.NewBuffer(nil), false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, restored, err := fsm2.state.CatalogEvents("")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(restored, events) {
+		t.Fatalf("bad: %v", restored)
+	}
+}
+
+func TestFSM_EventFire(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	ev := structs.UserEvent{
+		Name:    "deploy",
+		Payload: []byte("v2"),
+		Time:    time.Now().UnixNano(),
+	}
+	buf, err := structs.Encode(structs.EventFireRequestType, ev)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	log := makeLog(buf)
+	resp := fsm.Apply(log)
+	if id, ok := resp.(string); !ok || id != "0000000000000001" {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	idx, events, err := fsm.state.UserEvents("deploy")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != log.Index || len(events) != 1 || string(events[0].Payload) != "v2" {
+		t.Fatalf("bad: %v %v", idx, events)
+	}
+
+	// The events survive a snapshot and restore
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := &MockSink{bytes.NewBuffer(nil), false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, restored, err := fsm2.state.UserEvents("")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(restored, events) {
+		t.Fatalf("bad: %v", restored)
+	}
+}
+
+func TestFSM_NodeHeartbeat(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	now := time.Now()
+	req := structs.NodeHeartbeatRequest{
+		Datacenter: "dc1",
+		Nodes:      []string{"foo"},
+	}
+	req.SetTimestamp(now)
+	buf, err := structs.Encode(structs.NodeHeartbeatRequestType|structs.IgnoreUnknownTypeFlag, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	log := makeLog(buf)
+	if resp := fsm.Apply(log); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, seen, err := fsm.state.NodeLastSeen("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if seen == nil || seen.ModifyIndex != log.Index || seen.SeenAt != now.UnixNano() {
+		t.Fatalf("bad: %v", seen)
+	}
+
+	// The heartbeats survive a snapshot and restore
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := &MockSink{bytes.NewBuffer(nil), false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm2, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, restored, err := fsm2.state.NodeLastSeen("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(restored, seen) {
+		t.Fatalf("bad: %v", restored)
+	}
+}
+
+func TestFSM_Restore_AbandonsState(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	// Snapshot
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Watch the old store
+	old := fsm.State()
+	abandonCh := old.AbandonCh()
+	select {
+	case <-abandonCh:
+		t.Fatalf("should not be abandoned")
+	default:
+	}
+
+	// Restore over it
+	if err := fsm.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case <-abandonCh:
+	default:
+		t.Fatalf("should be abandoned")
+	}
+	if fsm.State() == old {
+		t.Fatalf("state should be replaced")
+	}
+	select {
+	case <-fsm.State().AbandonCh():
+		t.Fatalf("new state should not be abandoned")
+	default:
+	}
+
+	// Abandoning twice is safe
+	old.Abandon()
+}
+
+func TestFSM_Restore_Failed(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+
+	// Snapshot
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Append an entry that cannot be restored
+	buf.Write([]byte{byte(structs.IgnoreUnknownTypeFlag - 1)})
+
+	old := fsm.State()
+	if err := fsm.Restore(sink); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// The current store is kept, and still usable
+	if fsm.State() != old {
+		t.Fatalf("state should not be replaced")
+	}
+	select {
+	case <-old.AbandonCh():
+		t.Fatalf("should not be abandoned")
+	default:
+	}
+	if _, found, _ := old.GetNode("foo"); !found {
+		t.Fatalf("missing node")
+	}
+}
+
+func TestFSM_CompactState(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	fsm.state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	fsm.state.KVSSet(2, &structs.DirEntry{Key: "/test", Value: []byte("test")})
+
+	// Hold a read against the old store
+	old := fsm.State()
+	snap, err := old.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := fsm.compactState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fsm.State() == old {
+		t.Fatalf("state should be replaced")
+	}
+	select {
+	case <-old.AbandonCh():
+	default:
+		t.Fatalf("should be abandoned")
+	}
+
+	// The old store is still readable until the read completes
+	if nodes := snap.Nodes(); len(nodes) != 1 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	snap.Close()
+
+	// The change log carries over
+	_, changes, err := fsm.State().ChangesSince(0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := structs.Changes{
+		&structs.Change{1, dbNodes, "", "foo", structs.ChangeSet},
+		&structs.Change{2, dbKVS, "", "/test", structs.ChangeSet},
+	}
+	if !reflect.DeepEqual(changes, expect) {
+		t.Fatalf("bad: %v", changes)
+	}
+}
+
+func TestFSM_SlowApply(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	logger := &recordingLogger{}
+	fsm.SetLogger(logger)
+	fsm.SetSlowApplyThresholds(time.Nanosecond, map[structs.MessageType]time.Duration{
+		structs.KVSRequestType: time.Hour,
+	})
+
+	// KV entries are under their own threshold
+	kvs := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "/test", Value: []byte("test")},
+	}
+	buf, err := structs.Encode(structs.KVSRequestType, kvs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	if len(logger.msgs) != 0 {
+		t.Fatalf("bad: %v", logger.msgs)
+	}
+
+	// Other entries exceed the default threshold
+	req := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	buf, err = structs.Encode(structs.RegisterRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	if len(logger.msgs) != 1 || logger.msgs[0] != "Slow log entry apply" {
+		t.Fatalf("bad: %v", logger.msgs)
+	}
+	var node interface{}
+	for _, f := range logger.fields[0] {
+		if f.Key == "node" {
+			node = f.Value
+		}
+	}
+	if node != "foo" {
+		t.Fatalf("bad: %v", logger.fields[0])
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
+	"strings"
 )
 
 // Health endpoint is used to query the health information
@@ -24,7 +25,13 @@ func (h *Health) ChecksInState(args *structs.ChecksInStateRequest,
 		&reply.QueryMeta,
 		state.QueryTables("ChecksInState"),
 		func() error {
-			reply.Index, reply.HealthChecks = state.ChecksInState(args.State)
+			if args.ServiceName != "" {
+				reply.Index, reply.HealthChecks = state.ServiceChecksInState(args.ServiceName,
+					args.State, args.Cursor, args.Limit)
+			} else {
+				reply.Index, reply.HealthChecks = state.ChecksInState(args.State, args.Cursor, args.Limit)
+			}
+			reply.NextCursor = nextCheckCursor(reply.HealthChecks, args.Limit)
 			return h.srv.filterACL(args.Token, reply)
 		})
 }
@@ -66,13 +73,18 @@ func (h *Health) ServiceChecks(args *structs.ServiceSpecificRequest,
 		&reply.QueryMeta,
 		state.QueryTables("ServiceChecks"),
 		func() error {
-			reply.Index, reply.HealthChecks = state.ServiceChecks(args.ServiceName)
+			reply.Index, reply.HealthChecks = state.ServiceChecks(args.ServiceName, args.Cursor, args.Limit)
+			reply.NextCursor = nextCheckCursor(reply.HealthChecks, args.Limit)
 			return h.srv.filterACL(args.Token, reply)
 		})
 }
 
 // ServiceNodes returns all the nodes registered as part of a service including health info
 func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *structs.IndexedCheckServiceNodes) error {
+	// Serve the stale queries of remote datacenters from the cache
+	if h.srv.remoteServices.cacheable(args) {
+		return h.srv.remoteServices.ServiceNodes(args, reply)
+	}
 	if done, err := h.srv.forward("Health.ServiceNodes", args, args, reply); done {
 		return err
 	}
@@ -88,11 +100,21 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 		&reply.QueryMeta,
 		state.QueryTables("CheckServiceNodes"),
 		func() error {
-			if args.TagFilter {
-				reply.Index, reply.Nodes = state.CheckServiceTagNodes(args.ServiceName, args.ServiceTag)
-			} else {
-				reply.Index, reply.Nodes = state.CheckServiceNodes(args.ServiceName)
+			switch {
+			case args.TagFilter:
+				reply.Index, reply.Nodes = state.CheckServiceTagNodes(args.ServiceName, args.ServiceTag, args.NodeMetaFilters)
+			case args.ServiceVersion != "":
+				reply.Index, reply.Nodes = state.CheckServiceVersionNodes(args.ServiceName, args.ServiceVersion, args.NodeMetaFilters)
+			case args.PassingOnly:
+				reply.Index, reply.Nodes = state.PassingCheckServiceNodes(args.ServiceName, args.NodeMetaFilters)
+			default:
+				reply.Index, reply.Nodes = state.CheckServiceNodes(args.ServiceName, args.NodeMetaFilters)
+			}
+			if args.PassingOnly && (args.TagFilter || args.ServiceVersion != "") {
+				reply.Nodes = filterNonPassing(reply.Nodes)
 			}
+			reply.Nodes = filterServiceRelease(reply.Nodes, args.ServiceVersion, args.Canary)
+			selectServiceAddress(reply.Nodes, args.AddressTag)
 			return h.srv.filterACL(args.Token, reply)
 		})
 
@@ -108,3 +130,67 @@ func (h *Health) ServiceNodes(args *structs.ServiceSpecificRequest, reply *struc
 	}
 	return err
 }
+
+// filterNonPassing is used to filter out the nodes with any check that is
+// not passing
+func filterNonPassing(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	n := 0
+OUTER:
+	for _, node := range nodes {
+		for _, check := range node.Checks {
+			if check.Status != structs.HealthPassing {
+				continue OUTER
+			}
+		}
+		nodes[n] = node
+		n++
+	}
+	return nodes[:n]
+}
+
+// filterServiceRelease is used to filter the nodes of a service by the
+// version and canary flag of their instance. The version is matched like
+// the version index, ignoring case.
+func filterServiceRelease(nodes structs.CheckServiceNodes, version string,
+	canary structs.CanaryFilter) structs.CheckServiceNodes {
+	if version == "" && canary == structs.CanaryAny {
+		return nodes
+	}
+	n := 0
+	for _, node := range nodes {
+		if version != "" && !strings.EqualFold(node.Service.Version, version) {
+			continue
+		}
+		if !canary.Matches(node.Service.Canary) {
+			continue
+		}
+		nodes[n] = node
+		n++
+	}
+	return nodes[:n]
+}
+
+// selectServiceAddress is used to replace the address of each instance
+// with its address of the given tag. Instances without an address of
+// the tag keep their address.
+func selectServiceAddress(nodes structs.CheckServiceNodes, tag string) {
+	if tag == "" {
+		return
+	}
+	for i := range nodes {
+		if addr, ok := nodes[i].Service.Addresses[tag]; ok {
+			nodes[i].Service.Address = addr
+		}
+	}
+}
+
+// nextCheckCursor returns the cursor of the next page of checks, or nil
+// if the checks were not limited. It must be computed before the ACL
+// filtering, which can drop the last check of the page.
+func nextCheckCursor(checks structs.HealthChecks, limit int) *structs.CheckCursor {
+	if limit <= 0 || len(checks) < limit {
+		return nil
+	}
+	last := checks[len(checks)-1]
+	return &structs.CheckCursor{Node: last.Node, CheckID: last.CheckID}
+}
@@ -223,6 +223,136 @@ func TestHealth_ServiceNodes(t *testing.T) {
 	}
 }
 
+func TestHealth_ServiceNodes_PassingOnly(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	for _, node := range []struct {
+		name, tag, status string
+	}{
+		{"foo", "master", structs.HealthPassing},
+		{"bar", "slave", structs.HealthWarning},
+	} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node.name,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+				Tags:    []string{node.tag},
+			},
+			Check: &structs.HealthCheck{
+				Name:      "db connect",
+				Status:    node.status,
+				ServiceID: "db",
+			},
+		}
+		var out struct{}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	var out structs.IndexedCheckServiceNodes
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+		PassingOnly: true,
+	}
+	if err := client.Call("Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 1 || out.Nodes[0].Node.Node != "foo" {
+		t.Fatalf("Bad: %v", out.Nodes)
+	}
+
+	// The passing filter applies along with the tag filter
+	req.ServiceTag = "slave"
+	req.TagFilter = true
+	var out2 structs.IndexedCheckServiceNodes
+	if err := client.Call("Health.ServiceNodes", &req, &out2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out2.Nodes) != 0 {
+		t.Fatalf("Bad: %v", out2.Nodes)
+	}
+}
+
+func TestHealth_ServiceNodes_AddressTag(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Only the first instance has an IPv6 address
+	for i, node := range []string{"foo", "bar"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+				Address: "10.0.0.1",
+			},
+		}
+		if i == 0 {
+			arg.Service.Addresses = map[string]string{structs.AddressLANIPv6: "fd00::1"}
+		}
+		var out struct{}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	var out structs.IndexedCheckServiceNodes
+	req := structs.ServiceSpecificRequest{
+		Datacenter:  "dc1",
+		ServiceName: "db",
+		AddressTag:  structs.AddressLANIPv6,
+	}
+	if err := client.Call("Health.ServiceNodes", &req, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out.Nodes) != 2 {
+		t.Fatalf("Bad: %v", out.Nodes)
+	}
+	for _, node := range out.Nodes {
+		expect := "10.0.0.1"
+		if node.Node.Node == "foo" {
+			expect = "fd00::1"
+		}
+		if node.Service.Address != expect {
+			t.Fatalf("Bad: %v", node)
+		}
+	}
+
+	// An invalid address is rejected
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:        "db",
+			Service:   "db",
+			Addresses: map[string]string{structs.AddressLANIPv4: "fd00::1"},
+		},
+	}
+	var reply struct{}
+	if err := client.Call("Catalog.Register", &arg, &reply); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
 func TestHealth_NodeChecks_FilterACL(t *testing.T) {
 	dir, token, srv, client := testACLFilterServer(t)
 	defer os.RemoveAll(dir)
@@ -346,3 +476,57 @@ func TestHealth_ChecksInState_FilterACL(t *testing.T) {
 		t.Fatalf("missing service 'foo': %#v", reply.HealthChecks)
 	}
 }
+
+func TestHealth_ChecksInState_Paging(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	for _, node := range []string{"foo3", "foo1", "foo2"} {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc1",
+			Node:       node,
+			Address:    "127.0.0.1",
+			Check: &structs.HealthCheck{
+				Name:   "memory utilization",
+				Status: structs.HealthPassing,
+			},
+		}
+		var out struct{}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Page through the checks, the serf check of the server comes first
+	inState := structs.ChecksInStateRequest{
+		Datacenter: "dc1",
+		State:      structs.HealthPassing,
+		Limit:      2,
+	}
+	var nodes []string
+	for i := 0; i < 3; i++ {
+		var out structs.IndexedHealthChecks
+		if err := client.Call("Health.ChecksInState", &inState, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for _, check := range out.HealthChecks {
+			nodes = append(nodes, check.Node)
+		}
+		if out.NextCursor == nil {
+			break
+		}
+		inState.Cursor = *out.NextCursor
+	}
+	if len(nodes) != 4 || nodes[0] != s1.config.NodeName ||
+		nodes[1] != "foo1" || nodes[2] != "foo2" || nodes[3] != "foo3" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	if inState.Cursor.Node != "foo3" {
+		t.Fatalf("bad: %v", inState.Cursor)
+	}
+}
@@ -2,6 +2,7 @@ package consul
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/serf/serf"
@@ -55,6 +56,11 @@ func (m *Internal) NodeDump(args *structs.DCSpecificRequest,
 // triggered in a remote DC.
 func (m *Internal) EventFire(args *structs.EventFireRequest,
 	reply *structs.EventFireResponse) error {
+	// Persisted events are applied through Raft, so they must be handled
+	// by the leader
+	if args.Persist {
+		args.AllowStale = false
+	}
 	if done, err := m.srv.forward("Internal.EventFire", args, args, reply); done {
 		return err
 	}
@@ -73,6 +79,28 @@ func (m *Internal) EventFire(args *structs.EventFireRequest,
 	// Set the query meta data
 	m.srv.setQueryMeta(&reply.QueryMeta)
 
+	// Record the event before it is gossiped, so it is retained even if
+	// the gossip fails. The request was forwarded to the leader, since
+	// persisted events must not allow stale reads.
+	if args.Persist {
+		if err := m.srv.requireFeature(structs.FeatureUserEvents); err != nil {
+			return err
+		}
+		ev := structs.UserEvent{
+			Name:    args.Name,
+			Payload: args.Payload,
+			Time:    time.Now().UnixNano(),
+		}
+		resp, err := m.srv.raftApply(structs.EventFireRequestType, &ev)
+		if err != nil {
+			m.srv.logger.Printf("[ERR] consul: Failed to persist user event %q: %v", args.Name, err)
+			return err
+		}
+		if respErr, ok := resp.(error); ok {
+			return respErr
+		}
+	}
+
 	// Add the consul prefix to the event name
 	eventName := userEventName(args.Name)
 
@@ -80,6 +108,28 @@ func (m *Internal) EventFire(args *structs.EventFireRequest,
 	return m.srv.serfLAN.UserEvent(eventName, args.Payload, false)
 }
 
+// EventList is used to list the persisted user events, which were fired
+// with the persist flag. Only the most recent events are retained.
+func (m *Internal) EventList(args *structs.EventListRequest,
+	reply *structs.IndexedUserEvents) error {
+	if done, err := m.srv.forward("Internal.EventList", args, args, reply); done {
+		return err
+	}
+
+	state := m.srv.fsm.State()
+	return m.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("UserEvents"),
+		func() error {
+			var err error
+			reply.Index, reply.Events, err = state.UserEvents(args.Name)
+			if err != nil {
+				return err
+			}
+			return m.srv.filterACL(args.Token, reply)
+		})
+}
+
 // KeyringOperation will query the WAN and LAN gossip keyrings of all nodes.
 func (m *Internal) KeyringOperation(
 	args *structs.KeyringRequest,
@@ -359,3 +359,63 @@ func TestInternal_EventFire_Token(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 }
+
+func TestInternal_EventFire_Persist(t *testing.T) {
+	dir, srv := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir)
+	defer srv.Shutdown()
+
+	client := rpcClient(t, srv)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return srv.fsm.State().FeatureEnabled(structs.FeatureUserEvents)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Fire an event that is not persisted, then a persisted one
+	event := structs.EventFireRequest{
+		Name:         "deploy",
+		Datacenter:   "dc1",
+		Payload:      []byte("v1"),
+		QueryOptions: structs.QueryOptions{Token: "root"},
+	}
+	var out structs.EventFireResponse
+	if err := client.Call("Internal.EventFire", &event, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	event.Payload = []byte("v2")
+	event.Persist = true
+	if err := client.Call("Internal.EventFire", &event, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the persisted event is listed
+	list := structs.EventListRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: "root"},
+	}
+	var reply structs.IndexedUserEvents
+	if err := client.Call("Internal.EventList", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || len(reply.Events) != 1 ||
+		reply.Events[0].Name != "deploy" || string(reply.Events[0].Payload) != "v2" {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	// The events are filtered by ACLs
+	list.Token = ""
+	if err := client.Call("Internal.EventList", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Events) != 0 {
+		t.Fatalf("bad: %v", reply.Events)
+	}
+}
@@ -51,7 +51,7 @@ func TestHealthCheckRace(t *testing.T) {
 	}
 
 	// Verify the index
-	idx, out1 := state.CheckServiceNodes("db")
+	idx, out1 := state.CheckServiceNodes("db", nil)
 	if idx != 10 {
 		t.Fatalf("Bad index")
 	}
@@ -71,7 +71,7 @@ func TestHealthCheckRace(t *testing.T) {
 	}
 
 	// Verify the index changed
-	idx, out2 := state.CheckServiceNodes("db")
+	idx, out2 := state.CheckServiceNodes("db", nil)
 	if idx != 20 {
 		t.Fatalf("Bad index")
 	}
@@ -1,13 +1,29 @@
 package consul
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
 )
 
+const (
+	// maxKVSBatchOps is the maximum number of operations in a batch,
+	// which bounds the size of its Raft entry
+	maxKVSBatchOps = 4096
+)
+
+var (
+	// errKVSNamespace is returned for requests in a KV namespace, which
+	// are only supported by the state store so far
+	errKVSNamespace = errors.New("KV namespaces are not supported")
+)
+
 // KVS endpoint is used to manipulate the Key-Value store
 type KVS struct {
 	srv *Server
@@ -25,6 +41,9 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 	if args.DirEnt.Key == "" && args.Op != structs.KVSDeleteTree {
 		return fmt.Errorf("Must provide key")
 	}
+	if args.DirEnt.Namespace != "" {
+		return errKVSNamespace
+	}
 
 	// Apply the ACL policy if any
 	acl, err := k.srv.resolveToken(args.Token)
@@ -43,6 +62,42 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 		}
 	}
 
+	// Older servers would not know to remove the sessions that stop
+	// waiting for a queued lock
+	queued := args.Op == structs.KVSLock && args.Queue
+	if queued || args.Op == structs.KVSDequeue {
+		if err := k.srv.requireFeature(structs.FeatureKVSLockQueue); err != nil {
+			return err
+		}
+	}
+
+	// Older servers would neither recover a key nor keep the value of a
+	// deleted key in its tombstone
+	softDelete := false
+	switch args.Op {
+	case structs.KVSDelete, structs.KVSDeleteCAS, structs.KVSDeleteTree:
+		_, conf, err := k.srv.fsm.State().ClusterConfigGet()
+		if err != nil {
+			return err
+		}
+		softDelete = conf != nil && conf.KVSoftDelete
+	}
+	if softDelete || args.Op == structs.KVSUndelete {
+		if err := k.srv.requireFeature(structs.FeatureKVSSoftDelete); err != nil {
+			return err
+		}
+	}
+
+	// Verify JSON values if enabled
+	if k.srv.config.KVValidateJSON {
+		switch args.Op {
+		case structs.KVSSet, structs.KVSCAS, structs.KVSLock, structs.KVSUnlock:
+			if err := validateKVJSON(&args.DirEnt); err != nil {
+				return err
+			}
+		}
+	}
+
 	// If this is a lock, we must check for a lock-delay. Since lock-delay
 	// is based on wall-time, each peer expire the lock-delay at a slightly
 	// different time. This means the enforcement of lock-delay cannot be done
@@ -74,6 +129,358 @@ func (k *KVS) Apply(args *structs.KVSRequest, reply *bool) error {
 	if respBool, ok := resp.(bool); ok {
 		*reply = respBool
 	}
+
+	// Wait for a queued lock to be granted
+	if queued && !*reply {
+		granted, err := k.waitQueuedLock(args)
+		if err != nil {
+			return err
+		}
+		*reply = granted
+	}
+	return nil
+}
+
+// waitQueuedLock is used to wait for the lock a session queued for to be
+// granted to it, up to the QueueWait of the request. Once the wait ends,
+// the session leaves the queue, so a contender that gave up does not hold
+// up the sessions queued after it forever. Returns if the lock was granted.
+func (k *KVS) waitQueuedLock(args *structs.KVSRequest) (bool, error) {
+	// Restrict the wait time, and ensure there is always one
+	wait := args.QueueWait
+	if wait > maxQueryTime {
+		wait = maxQueryTime
+	} else if wait <= 0 {
+		wait = defaultQueryTime
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	key, session := args.DirEnt.Key, args.DirEnt.Session
+	var watches WatchSet
+	watches.AddKVPrefix(key)
+	watches.AddTables(k.srv.fsm.State().QueryTables("KVSLockWaiters"))
+	defer watches.Stop()
+	for {
+		// Arm the watch before reading, so a grant in between is not missed
+		state := k.srv.fsm.State()
+		if err := watches.Arm(state); err != nil {
+			return false, err
+		}
+		_, ent, err := state.KVSGet(key)
+		if err != nil {
+			return false, err
+		}
+		if ent != nil && ent.Session == session {
+			return true, nil
+		}
+
+		// The session may have been dropped from the queue, such as when
+		// it was invalidated or the key was deleted
+		_, waiters, err := state.KVSLockWaiters(key)
+		if err != nil {
+			return false, err
+		}
+		queued := false
+		for _, waiter := range waiters {
+			if waiter.Session == session {
+				queued = true
+				break
+			}
+		}
+		if !queued {
+			return false, nil
+		}
+
+		if watches.Wait(timeout.C) == watchTimeout {
+			break
+		}
+	}
+
+	// Leave the queue. The lock may have been granted before the dequeue
+	// was applied, so check for it again afterwards.
+	metrics.IncrCounter([]string{"consul", "kvs", "lock_queue", "timeout"}, 1)
+	req := structs.KVSRequest{
+		Datacenter:   args.Datacenter,
+		Op:           structs.KVSDequeue,
+		DirEnt:       structs.DirEntry{Key: key, Session: session},
+		WriteRequest: args.WriteRequest,
+	}
+	resp, err := k.srv.raftApply(structs.KVSRequestType, &req)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Dequeue of %s failed: %v", key, err)
+		return false, err
+	}
+	if respErr, ok := resp.(error); ok {
+		return false, respErr
+	}
+	_, ent, err := k.srv.fsm.State().KVSGet(key)
+	if err != nil {
+		return false, err
+	}
+	return ent != nil && ent.Session == session, nil
+}
+
+// Increment is used to atomically add a delta to the integer value
+// of a key. The new value is returned, so callers such as rate limiters
+// and ID allocators do not need a check-and-set retry loop.
+func (k *KVS) Increment(args *structs.KVSRequest, reply *int64) error {
+	if done, err := k.srv.forward("KVS.Increment", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "increment"}, time.Now())
+
+	// Verify the args
+	if args.DirEnt.Key == "" {
+		return fmt.Errorf("Must provide key")
+	}
+	args.Op = structs.KVSIncrement
+
+	// Apply the ACL policy if any
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.KeyWrite(args.DirEnt.Key) {
+		return permissionDeniedErr
+	}
+
+	// Servers without the increment op would fail to apply it
+	if err := k.srv.requireFeature(structs.FeatureKVSIncrement); err != nil {
+		return err
+	}
+
+	// Apply the update
+	resp, err := k.srv.raftApply(structs.KVSRequestType, args)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Increment failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	if respVal, ok := resp.(int64); ok {
+		*reply = respVal
+	}
+	return nil
+}
+
+// Import is used to import entries under an empty prefix, keeping their
+// original create and modify indexes. This allows a tree to be migrated
+// between datacenters without breaking the clients that rely on its
+// indexes. The import is rejected if the prefix has any existing key.
+func (k *KVS) Import(args *structs.KVSRequest, reply *bool) error {
+	if done, err := k.srv.forward("KVS.Import", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "import"}, time.Now())
+
+	// Verify the args
+	if len(args.Entries) == 0 {
+		return fmt.Errorf("Must provide entries")
+	}
+	if args.DirEnt.Namespace != "" {
+		return errKVSNamespace
+	}
+	prefix := args.DirEnt.Key
+	for _, ent := range args.Entries {
+		if err := validateKVSImport(prefix, ent); err != nil {
+			return err
+		}
+	}
+	args.Op = structs.KVSImport
+
+	// Apply the ACL policy if any
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.KeyWritePrefix(prefix) {
+		return permissionDeniedErr
+	}
+
+	// Servers without the import op would fail to apply it
+	if err := k.srv.requireFeature(structs.FeatureKVSImport); err != nil {
+		return err
+	}
+
+	// Verify JSON values if enabled
+	if k.srv.config.KVValidateJSON {
+		for _, ent := range args.Entries {
+			if err := validateKVJSON(ent); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Apply the import as a single update
+	resp, err := k.srv.raftApply(structs.KVSRequestType, args)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Import failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	*reply = true
+	return nil
+}
+
+// ApplyBatch is used to apply several set and delete operations with a
+// single Raft entry, which is applied in one transaction. This reduces
+// the overhead of each write for bulk imports.
+func (k *KVS) ApplyBatch(args *structs.KVSBatchRequest, reply *bool) error {
+	if done, err := k.srv.forward("KVS.ApplyBatch", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "apply_batch"}, time.Now())
+
+	// Verify the args
+	if len(args.Ops) == 0 {
+		return fmt.Errorf("Must provide operations")
+	}
+	if len(args.Ops) > maxKVSBatchOps {
+		return fmt.Errorf("Batch exceeds the limit of %d operations", maxKVSBatchOps)
+	}
+	for _, op := range args.Ops {
+		if op == nil {
+			return fmt.Errorf("Must provide operation")
+		}
+		if op.DirEnt.Namespace != "" {
+			return errKVSNamespace
+		}
+		switch op.Op {
+		case structs.KVSSet, structs.KVSDelete:
+			if op.DirEnt.Key == "" {
+				return fmt.Errorf("Must provide key")
+			}
+		case structs.KVSDeleteTree:
+		default:
+			return fmt.Errorf("Invalid KVS batch operation '%s'", op.Op)
+		}
+	}
+
+	// Apply the ACL policy if any
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil {
+		for _, op := range args.Ops {
+			if op.Op == structs.KVSDeleteTree {
+				if !acl.KeyWritePrefix(op.DirEnt.Key) {
+					return permissionDeniedErr
+				}
+			} else if !acl.KeyWrite(op.DirEnt.Key) {
+				return permissionDeniedErr
+			}
+		}
+	}
+
+	// Verify JSON values if enabled
+	if k.srv.config.KVValidateJSON {
+		for _, op := range args.Ops {
+			if op.Op != structs.KVSSet {
+				continue
+			}
+			if err := validateKVJSON(&op.DirEnt); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Servers without the batch op would fail to apply it
+	if err := k.srv.requireFeature(structs.FeatureKVSBatch); err != nil {
+		return err
+	}
+
+	// Apply the batch as a single update
+	req := structs.KVSRequest{
+		Datacenter:   args.Datacenter,
+		Op:           structs.KVSBatch,
+		Batch:        args.Ops,
+		WriteRequest: args.WriteRequest,
+	}
+	resp, err := k.srv.raftApply(structs.KVSRequestType, &req)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Apply batch failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	*reply = true
+	return nil
+}
+
+// ApplyCASMulti is used to check-and-set several keys with a single Raft
+// entry. The reply is false if the check of any of the keys failed, in
+// which case none of them were written.
+func (k *KVS) ApplyCASMulti(args *structs.KVSCASMultiRequest, reply *bool) error {
+	if done, err := k.srv.forward("KVS.ApplyCASMulti", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "kvs", "apply_cas_multi"}, time.Now())
+
+	// Verify the args
+	if len(args.Entries) == 0 {
+		return fmt.Errorf("Must provide entries")
+	}
+	if len(args.Entries) > maxKVSBatchOps {
+		return fmt.Errorf("Check-and-set exceeds the limit of %d entries", maxKVSBatchOps)
+	}
+	for _, ent := range args.Entries {
+		if ent == nil {
+			return fmt.Errorf("Must provide entry")
+		}
+		if ent.Namespace != "" {
+			return errKVSNamespace
+		}
+		if ent.Key == "" {
+			return fmt.Errorf("Must provide key")
+		}
+	}
+
+	// Apply the ACL policy if any
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil {
+		for _, ent := range args.Entries {
+			if !acl.KeyWrite(ent.Key) {
+				return permissionDeniedErr
+			}
+		}
+	}
+
+	// Verify JSON values if enabled
+	if k.srv.config.KVValidateJSON {
+		for _, ent := range args.Entries {
+			if err := validateKVJSON(ent); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Servers without the op would fail to apply it
+	if err := k.srv.requireFeature(structs.FeatureKVSCASMulti); err != nil {
+		return err
+	}
+
+	req := structs.KVSRequest{
+		Datacenter:   args.Datacenter,
+		Op:           structs.KVSCASMulti,
+		Entries:      args.Entries,
+		WriteRequest: args.WriteRequest,
+	}
+	resp, err := k.srv.raftApply(structs.KVSRequestType, &req)
+	if err != nil {
+		k.srv.logger.Printf("[ERR] consul.kvs: Apply check-and-set failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	if respBool, ok := resp.(bool); ok {
+		*reply = respBool
+	}
 	return nil
 }
 
@@ -103,6 +510,9 @@ func (k *KVS) Get(args *structs.KeyRequest, reply *structs.IndexedDirEntries) er
 			if acl != nil && !acl.KeyRead(args.Key) {
 				ent = nil
 			}
+			if ent != nil && !args.MatchFlags(ent.Flags) {
+				ent = nil
+			}
 			if ent == nil {
 				// Must provide non-zero index to prevent blocking
 				// Index 1 is impossible anyways (due to Raft internals)
@@ -122,6 +532,118 @@ func (k *KVS) Get(args *structs.KeyRequest, reply *structs.IndexedDirEntries) er
 	return k.srv.blockingRPCOpt(&opts)
 }
 
+// GetWithSession is used to lookup a single key along with the session
+// holding its lock, without racing the destruction of the session
+func (k *KVS) GetWithSession(args *structs.KeyRequest, reply *structs.IndexedDirEntryWithSession) error {
+	if done, err := k.srv.forward("KVS.GetWithSession", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	sessionACL, err := k.srv.resolveSessionToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	opts := blockingRPCOptions{
+		queryOpts: &args.QueryOptions,
+		queryMeta: &reply.QueryMeta,
+		kvWatch:   true,
+		kvPrefix:  args.Key,
+		run: func() error {
+			index, ent, session, err := state.KVSGetWithSession(args.Key)
+			if err != nil {
+				return err
+			}
+			if acl != nil && !acl.KeyRead(args.Key) {
+				ent, session = nil, nil
+			}
+			if session != nil && sessionACL != nil && !sessionACL.SessionRead(session.Node) {
+				session = nil
+			}
+			reply.Entry, reply.Session = ent, session
+			if ent == nil {
+				// Must provide non-zero index to prevent blocking
+				// Index 1 is impossible anyways (due to Raft internals)
+				if index == 0 {
+					reply.Index = 1
+				} else {
+					reply.Index = index
+				}
+			} else {
+				reply.Index = ent.ModifyIndex
+			}
+			return nil
+		},
+	}
+	return k.srv.blockingRPCOpt(&opts)
+}
+
+// WaitUnlocked is used to wait until a key is not locked, or the wait time
+// of the query elapses. The server waits on a watch of the key, so lock
+// contenders do not have to poll it. The entry is returned as of the
+// unlock, or as of the timeout in which case it is still locked. A
+// missing key is not locked.
+func (k *KVS) WaitUnlocked(args *structs.KeyRequest, reply *structs.IndexedDirEntries) error {
+	if done, err := k.srv.forward("KVS.WaitUnlocked", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.KeyRead(args.Key) {
+		return permissionDeniedErr
+	}
+
+	// Restrict the wait time, and ensure there is always one
+	wait := args.MaxQueryTime
+	if wait > maxQueryTime {
+		wait = maxQueryTime
+	} else if wait <= 0 {
+		wait = defaultQueryTime
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	var watches WatchSet
+	watches.AddKVPrefix(args.Key)
+	defer watches.Stop()
+	for {
+		// Arm the watch before reading the key, so an unlock in between
+		// is not missed
+		state := k.srv.fsm.State()
+		if err := watches.Arm(state); err != nil {
+			return err
+		}
+		k.srv.setQueryMeta(&reply.QueryMeta)
+		index, ent, err := state.KVSGet(args.Key)
+		if err != nil {
+			return err
+		}
+		if ent == nil {
+			reply.Index = index
+			reply.Entries = nil
+		} else {
+			reply.Index = ent.ModifyIndex
+			reply.Entries = structs.DirEntries{ent}
+		}
+		if ent == nil || ent.Session == "" {
+			return nil
+		}
+		if watches.Wait(timeout.C) == watchTimeout {
+			metrics.IncrCounter([]string{"consul", "kvs", "wait_unlocked", "timeout"}, 1)
+			return nil
+		}
+	}
+}
+
 // List is used to list all keys with a given prefix
 func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) error {
 	if done, err := k.srv.forward("KVS.List", args, args, reply); done {
@@ -133,20 +655,46 @@ func (k *KVS) List(args *structs.KeyRequest, reply *structs.IndexedDirEntries) e
 		return err
 	}
 
+	// A pattern only wakes the query for the keys matching it, and its
+	// literal part may narrow down the prefix to list
+	prefix := args.Key
+	if args.Pattern != "" {
+		if _, err := path.Match(args.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %v", args.Pattern, err)
+		}
+		if literal := patternLiteral(args.Pattern); strings.HasPrefix(literal, prefix) {
+			prefix = literal
+		}
+	}
+
 	// Get the local state
 	state := k.srv.fsm.State()
 	opts := blockingRPCOptions{
 		queryOpts: &args.QueryOptions,
 		queryMeta: &reply.QueryMeta,
-		kvWatch:   true,
+		kvWatch:   args.Pattern == "",
 		kvPrefix:  args.Key,
+		kvPattern: args.Pattern,
 		run: func() error {
-			tombIndex, index, ent, err := state.KVSList(args.Key)
+			var tombIndex, index uint64
+			var ent structs.DirEntries
+			var err error
+			if args.Session != "" {
+				tombIndex, index, ent, err = state.KVSListSession(prefix, args.Session)
+				if err == nil && acl != nil {
+					ent = FilterDirEnt(acl, ent)
+				}
+				if err == nil && args.FlagsMask != 0 {
+					ent = filterDirEntFlags(args, ent)
+				}
+			} else {
+				tombIndex, index, ent, err = state.KVSListFlags(prefix, args.FlagsMask, args.Flags, acl)
+			}
 			if err != nil {
 				return err
 			}
-			if acl != nil {
-				ent = FilterDirEnt(acl, ent)
+			if args.Pattern != "" {
+				ent = filterDirEntPattern(args.Pattern, ent)
 			}
 
 			if len(ent) == 0 {
@@ -198,11 +746,8 @@ func (k *KVS) ListKeys(args *structs.KeyListRequest, reply *structs.IndexedKeyLi
 		kvWatch:   true,
 		kvPrefix:  args.Prefix,
 		run: func() error {
-			index, keys, err := state.KVSListKeys(args.Prefix, args.Seperator)
+			index, keys, err := state.KVSListKeys(args.Prefix, args.Seperator, acl)
 			reply.Index = index
-			if acl != nil {
-				keys = FilterKeys(acl, keys)
-			}
 			reply.Keys = keys
 			return err
 
@@ -210,3 +755,168 @@ func (k *KVS) ListKeys(args *structs.KeyListRequest, reply *structs.IndexedKeyLi
 	}
 	return k.srv.blockingRPCOpt(&opts)
 }
+
+// Stats is used to summarize the keys under a prefix, without listing
+// them. Only the keys the token can read are counted.
+func (k *KVS) Stats(args *structs.KeyRequest, reply *structs.IndexedKVSStats) error {
+	if done, err := k.srv.forward("KVS.Stats", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	opts := blockingRPCOptions{
+		queryOpts: &args.QueryOptions,
+		queryMeta: &reply.QueryMeta,
+		kvWatch:   true,
+		kvPrefix:  args.Key,
+		run: func() error {
+			index, stats, err := state.KVSStats(args.Key, acl)
+			if err != nil {
+				return err
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				reply.Index = 1
+			} else {
+				reply.Index = index
+			}
+			reply.Stats = stats
+			return nil
+		},
+	}
+	return k.srv.blockingRPCOpt(&opts)
+}
+
+// ListLocked is used to list the keys under a prefix which are currently
+// locked, along with the session and node holding each lock
+func (k *KVS) ListLocked(args *structs.KeyRequest, reply *structs.IndexedKeyLocks) error {
+	if done, err := k.srv.forward("KVS.ListLocked", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	opts := blockingRPCOptions{
+		queryOpts: &args.QueryOptions,
+		queryMeta: &reply.QueryMeta,
+		tables:    state.QueryTables("SessionList"),
+		kvWatch:   true,
+		kvPrefix:  args.Key,
+		run: func() error {
+			index, locks, err := state.KVSListLocked(args.Key)
+			if err != nil {
+				return err
+			}
+			if acl != nil {
+				locks = FilterKeyLocks(acl, locks)
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				reply.Index = 1
+			} else {
+				reply.Index = index
+			}
+			reply.Locks = locks
+			return nil
+		},
+	}
+	return k.srv.blockingRPCOpt(&opts)
+}
+
+// ListTombstones is used to list the tombstones under a prefix that have
+// not been reaped yet. It is meant for debugging, to find out why the
+// index of a prefix stays elevated after its keys were deleted.
+func (k *KVS) ListTombstones(args *structs.KeyRequest, reply *structs.IndexedTombstones) error {
+	if done, err := k.srv.forward("KVS.ListTombstones", args, args, reply); done {
+		return err
+	}
+
+	acl, err := k.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+
+	// Get the local state
+	state := k.srv.fsm.State()
+	opts := blockingRPCOptions{
+		queryOpts: &args.QueryOptions,
+		queryMeta: &reply.QueryMeta,
+		kvWatch:   true,
+		kvPrefix:  args.Key,
+		run: func() error {
+			index, tombs, err := state.TombstoneList(args.Key)
+			if err != nil {
+				return err
+			}
+			if acl != nil {
+				tombs = FilterTombstones(acl, tombs)
+			}
+
+			// Must provide non-zero index to prevent blocking
+			// Index 1 is impossible anyways (due to Raft internals)
+			if index == 0 {
+				reply.Index = 1
+			} else {
+				reply.Index = index
+			}
+			reply.Tombstones = tombs
+			return nil
+		},
+	}
+	return k.srv.blockingRPCOpt(&opts)
+}
+
+// validateKVJSON is used to verify that the value of an entry with a
+// JSON content type is valid JSON. Encoded values cannot be verified.
+func validateKVJSON(d *structs.DirEntry) error {
+	mediaType := strings.TrimSpace(strings.SplitN(d.ContentType, ";", 2)[0])
+	if !strings.EqualFold(mediaType, "application/json") || d.Encoding != "" {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(d.Value, &v); err != nil {
+		return fmt.Errorf("Invalid JSON value for key '%s': %v", d.Key, err)
+	}
+	return nil
+}
+
+// filterDirEntFlags is used to filter the entries down to those matching
+// the flags of the request
+func filterDirEntFlags(args *structs.KeyRequest, ents structs.DirEntries) structs.DirEntries {
+	n := 0
+	for _, ent := range ents {
+		if args.MatchFlags(ent.Flags) {
+			ents[n] = ent
+			n++
+		}
+	}
+	return ents[:n]
+}
+
+// filterDirEntPattern is used to filter the entries down to those whose
+// key matches a glob pattern
+func filterDirEntPattern(pattern string, ents structs.DirEntries) structs.DirEntries {
+	n := 0
+	for _, ent := range ents {
+		if match, _ := path.Match(pattern, ent.Key); match {
+			ents[n] = ent
+			n++
+		}
+	}
+	return ents[:n]
+}
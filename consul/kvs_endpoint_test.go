@@ -2,6 +2,7 @@ package consul
 
 import (
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -66,6 +67,63 @@ func TestKVS_Apply(t *testing.T) {
 	}
 }
 
+func TestKVS_Apply_Undelete(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureKVSSoftDelete)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Enable soft deletes
+	state := s1.fsm.State()
+	conf := &structs.ClusterConfig{KVSoftDelete: true}
+	if err := state.ClusterConfigSet(1000, conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:   "test",
+			Value: []byte("test"),
+		},
+	}
+	var out bool
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	arg.Op = structs.KVSDelete
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Recover the key
+	arg.Op = structs.KVSUndelete
+	arg.DirEnt.Value = nil
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("should undelete")
+	}
+
+	_, d, err := state.KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
 func TestKVS_Apply_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -175,6 +233,139 @@ func TestKVS_Get(t *testing.T) {
 	}
 }
 
+func TestKVS_GetWithSession(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create a session to lock the key with
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sessArg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Node: "foo",
+			Name: "leader",
+		},
+	}
+	var id string
+	if err := client.Call("Session.Apply", &sessArg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt: structs.DirEntry{
+			Key:     "test",
+			Value:   []byte("test"),
+			Session: id,
+		},
+	}
+	var out bool
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil || !out {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test",
+	}
+	var reply structs.IndexedDirEntryWithSession
+	if err := client.Call("KVS.GetWithSession", &getR, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Entry == nil || reply.Index != reply.Entry.ModifyIndex ||
+		string(reply.Entry.Value) != "test" {
+		t.Fatalf("bad: %v", reply)
+	}
+	if reply.Session == nil || reply.Session.ID != id || reply.Session.Name != "leader" {
+		t.Fatalf("bad: %v", reply.Session)
+	}
+
+	// Missing keys still return a non-zero index
+	getR.Key = "nope"
+	reply = structs.IndexedDirEntryWithSession{}
+	if err := client.Call("KVS.GetWithSession", &getR, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Entry != nil || reply.Session != nil || reply.Index == 0 {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
+func TestKVS_GetWithSession_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.ACLEnforceSessionRules = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create a token which can read the key, but not the session
+	aclReq := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: `key "test" { policy = "read" }`,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var token string
+	if err := client.Call("ACL.Apply", &aclReq, &token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, err := state.KVSLock(3, &structs.DirEntry{Key: "test", Session: session.ID}); err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter:   "dc1",
+		Key:          "test",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	var reply structs.IndexedDirEntryWithSession
+	if err := client.Call("KVS.GetWithSession", &getR, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Entry == nil || reply.Session != nil {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	getR.Token = "root"
+	reply = structs.IndexedDirEntryWithSession{}
+	if err := client.Call("KVS.GetWithSession", &getR, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Entry == nil || reply.Session == nil || reply.Session.ID != session.ID {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
 func TestKVS_Get_ACLDeny(t *testing.T) {
 	dir1, s1 := testServerWithConfig(t, func(c *Config) {
 		c.ACLDatacenter = "dc1"
@@ -279,6 +470,124 @@ func TestKVSEndpoint_List(t *testing.T) {
 	}
 }
 
+func TestKVSEndpoint_List_Flags(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	for key, flags := range map[string]uint64{
+		"/test/key1": 0x11,
+		"/test/key2": 0x12,
+		"/test/key3": 0x21,
+	} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Flags: flags,
+			},
+		}
+		var out bool
+		if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "/test",
+		FlagsMask:  0x0f,
+		Flags:      0x01,
+	}
+	var dirent structs.IndexedDirEntries
+	if err := client.Call("KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 2 || dirent.Entries[0].Key != "/test/key1" ||
+		dirent.Entries[1].Key != "/test/key3" {
+		t.Fatalf("Bad: %v", dirent.Entries)
+	}
+
+	// A single key is only returned if its flags match
+	getR.Key = "/test/key2"
+	if err := client.Call("KVS.Get", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 0 {
+		t.Fatalf("Bad: %v", dirent.Entries)
+	}
+}
+
+func TestKVSEndpoint_List_Pattern(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	for _, key := range []string{"/test/a/leader", "/test/a/config", "/test/b/leader"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt:     structs.DirEntry{Key: key},
+		}
+		var out bool
+		if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "/test",
+		Pattern:    "/test/*/leader",
+	}
+	var dirent structs.IndexedDirEntries
+	if err := client.Call("KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dirent.Entries) != 2 || dirent.Entries[0].Key != "/test/a/leader" ||
+		dirent.Entries[1].Key != "/test/b/leader" {
+		t.Fatalf("Bad: %v", dirent.Entries)
+	}
+
+	// Only a change to a matching key wakes a blocking query
+	state := s1.fsm.State()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		state.KVSSet(100, &structs.DirEntry{Key: "/test/a/config", Value: []byte("foo")})
+		time.Sleep(100 * time.Millisecond)
+		state.KVSSet(101, &structs.DirEntry{Key: "/test/c/leader"})
+	}()
+
+	start := time.Now()
+	getR.MinQueryIndex = dirent.Index
+	getR.MaxQueryTime = time.Second
+	if err := client.Call("KVS.List", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 150*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if len(dirent.Entries) != 3 || dirent.Index != 101 {
+		t.Fatalf("Bad: %v %v", dirent.Index, dirent.Entries)
+	}
+
+	// Invalid patterns are rejected
+	getR.Pattern = "/test/["
+	getR.MinQueryIndex = 0
+	if err := client.Call("KVS.List", &getR, &dirent); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
 func TestKVSEndpoint_List_Blocking(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -593,7 +902,7 @@ func TestKVSEndpoint_ListKeys_ACLDeny(t *testing.T) {
 	}
 }
 
-func TestKVS_Apply_LockDelay(t *testing.T) {
+func TestKVS_WaitUnlocked(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
 	defer s1.Shutdown()
@@ -602,59 +911,196 @@ func TestKVS_Apply_LockDelay(t *testing.T) {
 
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
-	// Create and invalidate a session with a lock
+	// Lock a key
 	state := s1.fsm.State()
-	if err := state.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	session := &structs.Session{
-		ID:        generateUUID(),
-		Node:      "foo",
-		LockDelay: 50 * time.Millisecond,
-	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
 	if err := state.SessionCreate(2, session); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	id := session.ID
-	d := &structs.DirEntry{
-		Key:     "test",
-		Session: id,
-	}
+	d := &structs.DirEntry{Key: "test", Session: session.ID}
 	if ok, err := state.KVSLock(3, d); err != nil || !ok {
 		t.Fatalf("err: %v", err)
 	}
-	if err := state.SessionDestroy(4, id); err != nil {
-		t.Fatalf("err: %v", err)
-	}
-
-	// Make a new session that is valid
-	if err := state.SessionCreate(5, session); err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	validId := session.ID
 
-	// Make a lock request
-	arg := structs.KVSRequest{
-		Datacenter: "dc1",
-		Op:         structs.KVSLock,
-		DirEnt: structs.DirEntry{
-			Key:     "test",
-			Session: validId,
-		},
+	// The wait times out while the key is locked
+	getR := structs.KeyRequest{
+		Datacenter:   "dc1",
+		Key:          "test",
+		QueryOptions: structs.QueryOptions{MaxQueryTime: 50 * time.Millisecond},
 	}
-	var out bool
-	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+	var dirent structs.IndexedDirEntries
+	if err := client.Call("KVS.WaitUnlocked", &getR, &dirent); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if out != false {
-		t.Fatalf("should not acquire")
+	if len(dirent.Entries) != 1 || dirent.Entries[0].Session != session.ID {
+		t.Fatalf("Bad: %v", dirent.Entries)
 	}
 
-	// Wait for lock-delay
-	time.Sleep(50 * time.Millisecond)
+	// Release the lock while waiting
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		d := &structs.DirEntry{Key: "test", Session: session.ID}
+		state.KVSUnlock(4, d)
+	}()
 
-	// Should acquire
-	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+	start := time.Now()
+	getR.MaxQueryTime = 5 * time.Second
+	if err := client.Call("KVS.WaitUnlocked", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if len(dirent.Entries) != 1 || dirent.Entries[0].Session != "" || dirent.Index != 4 {
+		t.Fatalf("Bad: %v", dirent.Entries)
+	}
+}
+
+func TestKVS_Apply_LockQueue(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureKVSLockQueue)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Lock a key
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	holder := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(2, holder); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(3, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, err := state.KVSLock(4, &structs.DirEntry{Key: "test", Session: holder.ID}); err != nil || !ok {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The session leaves the queue when the wait times out
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt:     structs.DirEntry{Key: "test", Session: session.ID},
+		Queue:      true,
+		QueueWait:  50 * time.Millisecond,
+	}
+	var out bool
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out {
+		t.Fatalf("should not acquire")
+	}
+	_, waiters, err := state.KVSLockWaiters("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(waiters) != 0 {
+		t.Fatalf("bad: %v", waiters)
+	}
+
+	// Release the lock while waiting
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		state.KVSUnlock(100, &structs.DirEntry{Key: "test", Session: holder.ID})
+	}()
+
+	arg.QueueWait = 5 * time.Second
+	start := time.Now()
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("bad: %v", elapsed)
+	}
+	if !out {
+		t.Fatalf("should acquire")
+	}
+	_, d, err := state.KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.Session != session.ID {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestKVS_Apply_LockDelay(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create and invalidate a session with a lock
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{
+		ID:        generateUUID(),
+		Node:      "foo",
+		LockDelay: 50 * time.Millisecond,
+	}
+	if err := state.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id := session.ID
+	d := &structs.DirEntry{
+		Key:     "test",
+		Session: id,
+	}
+	if ok, err := state.KVSLock(3, d); err != nil || !ok {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.SessionDestroy(4, id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make a new session that is valid
+	if err := state.SessionCreate(5, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	validId := session.ID
+
+	// Make a lock request
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSLock,
+		DirEnt: structs.DirEntry{
+			Key:     "test",
+			Session: validId,
+		},
+	}
+	var out bool
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != false {
+		t.Fatalf("should not acquire")
+	}
+
+	// Wait for lock-delay
+	time.Sleep(50 * time.Millisecond)
+
+	// Should acquire
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	if out != true {
@@ -676,3 +1122,384 @@ key "test/priv" {
 	policy = "read"
 }
 `
+
+func TestKVSEndpoint_ListLocked(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create a session holding a lock
+	state := s1.fsm.State()
+	if err := state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := state.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &structs.DirEntry{Key: "test/lock", Session: session.ID}
+	if ok, err := state.KVSLock(3, d); err != nil || !ok {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.KVSSet(4, &structs.DirEntry{Key: "test/free"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test",
+	}
+	var dirent structs.IndexedKeyLocks
+	if err := client.Call("KVS.ListLocked", &getR, &dirent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dirent.Index != 4 {
+		t.Fatalf("Bad: %v", dirent)
+	}
+	if len(dirent.Locks) != 1 {
+		t.Fatalf("Bad: %v", dirent)
+	}
+	l := dirent.Locks[0]
+	if l.Key != "test/lock" || l.Session != session.ID || l.Node != "foo" {
+		t.Fatalf("bad: %v", l)
+	}
+}
+
+func TestKVSEndpoint_ListTombstones(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	state := s1.fsm.State()
+	for i, key := range []string{"test/a", "test/b", "other"} {
+		if err := state.KVSSet(uint64(1+i), &structs.DirEntry{Key: key}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := state.KVSDelete(4, "test/a"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.KVSDelete(5, "other"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test",
+	}
+	var out structs.IndexedTombstones
+	if err := client.Call("KVS.ListTombstones", &getR, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index != 5 {
+		t.Fatalf("Bad: %v", out)
+	}
+	if len(out.Tombstones) != 1 {
+		t.Fatalf("Bad: %v", out)
+	}
+	if tomb := out.Tombstones[0]; tomb.Key != "test/a" || tomb.ModifyIndex != 4 || tomb.Prefix {
+		t.Fatalf("bad: %v", tomb)
+	}
+}
+
+func TestKVSEndpoint_Stats(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	state := s1.fsm.State()
+	for i, key := range []string{"test/a", "test/sub/b", "other"} {
+		if err := state.KVSSet(uint64(1+i), &structs.DirEntry{Key: key, Value: []byte("12345")}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	getR := structs.KeyRequest{
+		Datacenter: "dc1",
+		Key:        "test/",
+	}
+	var out structs.IndexedKVSStats
+	if err := client.Call("KVS.Stats", &getR, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index != 2 {
+		t.Fatalf("Bad: %v", out)
+	}
+	expect := &structs.KVSStats{Keys: 2, ValueBytes: 10, Depth: 1, MaxIndex: 2}
+	if !reflect.DeepEqual(out.Stats, expect) {
+		t.Fatalf("Bad: %v", out.Stats)
+	}
+}
+
+func TestKVS_Increment(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureKVSIncrement)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		DirEnt: structs.DirEntry{
+			Key: "counter",
+		},
+		Delta: 2,
+	}
+	var out int64
+	for i := 0; i < 3; i++ {
+		if err := client.Call("KVS.Increment", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if out != 6 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Verify
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("counter")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "6" {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestKVS_ApplyBatch(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureKVSBatch)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	arg := structs.KVSBatchRequest{
+		Datacenter: "dc1",
+		Ops: structs.KVSBatchOps{
+			&structs.KVSBatchOp{Op: structs.KVSSet, DirEnt: structs.DirEntry{Key: "foo", Value: []byte("foo")}},
+			&structs.KVSBatchOp{Op: structs.KVSSet, DirEnt: structs.DirEntry{Key: "bar", Value: []byte("bar")}},
+		},
+	}
+	var out bool
+	if err := client.Call("KVS.ApplyBatch", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Verify both keys were written by the same entry
+	state := s1.fsm.State()
+	_, foo, err := state.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, bar, err := state.KVSGet("bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if foo == nil || bar == nil || foo.ModifyIndex != bar.ModifyIndex {
+		t.Fatalf("bad: %v %v", foo, bar)
+	}
+
+	// Conditional operations cannot be batched
+	arg.Ops[1].Op = structs.KVSCAS
+	err = client.Call("KVS.ApplyBatch", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid KVS batch operation") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Missing operations are rejected
+	arg.Ops[1] = nil
+	err = client.Call("KVS.ApplyBatch", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Must provide operation") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_ApplyCASMulti(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureKVSCASMulti)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Create both keys, which must not exist
+	arg := structs.KVSCASMultiRequest{
+		Datacenter: "dc1",
+		Entries: structs.DirEntries{
+			&structs.DirEntry{Key: "foo", Value: []byte("foo")},
+			&structs.DirEntry{Key: "bar", Value: []byte("bar")},
+		},
+	}
+	var out bool
+	if err := client.Call("KVS.ApplyCASMulti", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("bad: %v", out)
+	}
+
+	state := s1.fsm.State()
+	_, foo, err := state.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if foo == nil {
+		t.Fatalf("missing foo")
+	}
+
+	// A stale index fails the whole update
+	arg.Entries[0].ModifyIndex = foo.ModifyIndex
+	arg.Entries[0].Value = []byte("zip")
+	arg.Entries[1].ModifyIndex = foo.ModifyIndex - 1
+	if err := client.Call("KVS.ApplyCASMulti", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out {
+		t.Fatalf("bad: %v", out)
+	}
+	_, d, err := state.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(d.Value) != "foo" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Missing keys are rejected
+	arg.Entries[1].Key = ""
+	err = client.Call("KVS.ApplyCASMulti", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Must provide key") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Import(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureKVSImport)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		DirEnt: structs.DirEntry{
+			Key: "app/",
+		},
+		Entries: structs.DirEntries{
+			&structs.DirEntry{Key: "app/foo", Value: []byte("foo"), CreateIndex: 1, ModifyIndex: 2},
+		},
+	}
+	var out bool
+	if err := client.Call("KVS.Import", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Verify the indexes were kept
+	state := s1.fsm.State()
+	_, d, err := state.KVSGet("app/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.CreateIndex != 1 || d.ModifyIndex != 2 {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// The prefix is no longer empty
+	err = client.Call("KVS.Import", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "existing keys") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKVS_Apply_ValidateJSON(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.KVValidateJSON = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Invalid JSON is rejected
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt: structs.DirEntry{
+			Key:         "test",
+			Value:       []byte("{not json"),
+			ContentType: "application/json; charset=utf-8",
+		},
+	}
+	var out bool
+	err := client.Call("KVS.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid JSON") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Encoded values are not validated
+	arg.DirEnt.Encoding = "gzip"
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Valid JSON is stored with its content type
+	arg.DirEnt.Value = []byte(`{"foo": 1}`)
+	arg.DirEnt.Encoding = ""
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err := s1.fsm.State().KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.ContentType != "application/json; charset=utf-8" || d.Encoding != "" {
+		t.Fatalf("bad: %v", d)
+	}
+}
@@ -0,0 +1,162 @@
+package consul
+
+import (
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// kvReplicationRetry is how long the replicator waits before
+	// retrying after a failure to replicate
+	kvReplicationRetry = 5 * time.Second
+)
+
+// kvReplicationEnabled checks if the KV store is replicated from
+// another datacenter
+func (s *Server) kvReplicationEnabled() bool {
+	dc := s.config.KVReplicationDatacenter
+	return dc != "" && dc != s.config.Datacenter
+}
+
+// runKVReplication is a long running routine used by the leader to
+// replicate the KV store from the primary datacenter. It uses blocking
+// queries against the primary, so changes are applied as they happen.
+func (s *Server) runKVReplication(stopCh chan struct{}) {
+	s.logger.Printf("[INFO] consul: KV replication from datacenter '%s' started",
+		s.config.KVReplicationDatacenter)
+	s.setKVReplicationRunning(true)
+	defer s.setKVReplicationRunning(false)
+
+	var lastIndex uint64
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		default:
+		}
+
+		index, err := s.replicateKV(lastIndex)
+		if err != nil {
+			s.logger.Printf("[ERR] consul: KV replication failed: %v", err)
+			s.kvReplicationLock.Lock()
+			s.kvReplicationStatus.LastError = err.Error()
+			s.kvReplicationStatus.LastErrorTime = time.Now()
+			s.kvReplicationLock.Unlock()
+
+			select {
+			case <-time.After(kvReplicationRetry):
+			case <-stopCh:
+				return
+			case <-s.shutdownCh:
+				return
+			}
+			continue
+		}
+
+		lastIndex = index
+		s.kvReplicationLock.Lock()
+		s.kvReplicationStatus.ReplicatedIndex = index
+		s.kvReplicationStatus.LastSuccess = time.Now()
+		s.kvReplicationLock.Unlock()
+	}
+}
+
+// setKVReplicationRunning is used to update the running flag of the
+// replication status
+func (s *Server) setKVReplicationRunning(running bool) {
+	s.kvReplicationLock.Lock()
+	s.kvReplicationStatus.Running = running
+	s.kvReplicationLock.Unlock()
+}
+
+// replicateKV waits for the entries of the primary datacenter to change
+// past the given index, and applies the differences to the local KV
+// store. It returns the index of the primary that was replicated.
+func (s *Server) replicateKV(minIndex uint64) (uint64, error) {
+	source := s.config.KVReplicationSourcePrefix
+	prefix := s.config.KVReplicationPrefix
+
+	// Block until the primary changes
+	args := structs.KeyRequest{
+		Datacenter: s.config.KVReplicationDatacenter,
+		Key:        source,
+		QueryOptions: structs.QueryOptions{
+			Token:         s.config.KVReplicationToken,
+			MinQueryIndex: minIndex,
+			AllowStale:    true,
+		},
+	}
+	var remote structs.IndexedDirEntries
+	if err := s.forwardDC("KVS.List", args.Datacenter, &args, &remote); err != nil {
+		return 0, err
+	}
+	defer metrics.MeasureSince([]string{"consul", "leader", "replicateKV"}, time.Now())
+
+	// Get the local entries to diff against
+	_, _, local, err := s.fsm.State().KVSList(prefix, nil)
+	if err != nil {
+		return 0, err
+	}
+	existing := make(map[string]*structs.DirEntry, len(local))
+	for _, ent := range local {
+		existing[ent.Key] = ent
+	}
+
+	// Set the entries that are missing or have changed. Sessions are
+	// local to the primary datacenter, so locks are not replicated.
+	for _, ent := range remote.Entries {
+		key := prefix + strings.TrimPrefix(ent.Key, source)
+		exist, ok := existing[key]
+		delete(existing, key)
+		if ok && exist.Flags == ent.Flags && string(exist.Value) == string(ent.Value) &&
+			exist.ContentType == ent.ContentType && exist.Encoding == ent.Encoding {
+			continue
+		}
+
+		req := structs.KVSRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:         key,
+				Flags:       ent.Flags,
+				Value:       ent.Value,
+				ContentType: ent.ContentType,
+				Encoding:    ent.Encoding,
+			},
+		}
+		if err := s.applyKVReplication(&req); err != nil {
+			return 0, err
+		}
+	}
+
+	// Delete the entries that no longer exist in the primary
+	for key := range existing {
+		req := structs.KVSRequest{
+			Datacenter: s.config.Datacenter,
+			Op:         structs.KVSDelete,
+			DirEnt:     structs.DirEntry{Key: key},
+		}
+		if err := s.applyKVReplication(&req); err != nil {
+			return 0, err
+		}
+	}
+	return remote.Index, nil
+}
+
+// applyKVReplication is used to apply a replicated KVS request
+func (s *Server) applyKVReplication(req *structs.KVSRequest) error {
+	resp, err := s.raftApply(structs.KVSRequestType, req)
+	if err != nil {
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	metrics.IncrCounter([]string{"consul", "leader", "replicateKV", string(req.Op)}, 1)
+	return nil
+}
@@ -0,0 +1,127 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestKVReplication(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+		c.KVReplicationDatacenter = "dc1"
+		c.KVReplicationSourcePrefix = "shared/"
+		c.KVReplicationPrefix = "replica/"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForLeader(t, client.Call, "dc2")
+
+	// Write a shared key and a local key in the primary
+	for _, key := range []string{"shared/foo", "local/bar"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   key,
+				Flags: 42,
+				Value: []byte("test"),
+			},
+		}
+		var out bool
+		if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Wait for the shared key to be replicated
+	state := s2.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, d, err := state.KVSGet("replica/foo")
+		return d != nil && string(d.Value) == "test" && d.Flags == 42, err
+	}, func(err error) {
+		t.Fatalf("key not replicated: %v", err)
+	})
+	_, _, ents, err := state.KVSList("", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// Delete the shared key in the primary
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSDelete,
+		DirEnt:     structs.DirEntry{Key: "shared/foo"},
+	}
+	var out bool
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		_, d, err := state.KVSGet("replica/foo")
+		return d == nil, err
+	}, func(err error) {
+		t.Fatalf("key not deleted: %v", err)
+	})
+
+	// Check the replication status
+	args := structs.DCSpecificRequest{Datacenter: "dc2"}
+	var status structs.KVReplicationStatus
+	if err := client.Call("Operator.KVReplicationStatus", &args, &status); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !status.Enabled || !status.Running || status.SourceDatacenter != "dc1" {
+		t.Fatalf("bad: %#v", status)
+	}
+	if status.ReplicatedIndex == 0 || status.LastSuccess.IsZero() {
+		t.Fatalf("bad: %#v", status)
+	}
+}
+
+func TestKVReplication_Prefix(t *testing.T) {
+	config := DefaultConfig()
+	config.Datacenter = "dc2"
+	config.KVReplicationDatacenter = "dc1"
+	config.KVReplicationPrefix = "replica/"
+	if err := config.CheckKVReplication(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	config.KVReplicationSourcePrefix = "shared/"
+	config.KVReplicationPrefix = ""
+	if err := config.CheckKVReplication(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	config.KVReplicationPrefix = "replica/"
+	if err := config.CheckKVReplication(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The prefixes are not needed in the primary datacenter
+	config.Datacenter = "dc1"
+	config.KVReplicationSourcePrefix = ""
+	if err := config.CheckKVReplication(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
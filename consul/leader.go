@@ -86,6 +86,29 @@ RECONCILE:
 			goto WAIT
 		}
 		establishedLeader = true
+
+		// Start replicating the KV store if we are a secondary
+		if s.kvReplicationEnabled() {
+			go s.runKVReplication(stopCh)
+		}
+
+		// Start posting the check status changes to the webhooks
+		if len(s.config.CheckWebhooks) > 0 {
+			go s.runCheckWebhooks(stopCh)
+		}
+
+		// Start recording the nodes that are alive
+		if s.config.NodeHeartbeatInterval > 0 {
+			go s.runNodeHeartbeats(stopCh)
+		}
+
+		// Start executing the check definitions
+		go s.runCheckDefinitions(stopCh)
+
+		// Start deleting the rotated tokens, if we are authoritative
+		if s.config.ACLDatacenter != "" && s.config.ACLDatacenter == s.config.Datacenter {
+			go s.runACLExpiration(stopCh)
+		}
 	}
 
 	// Reconcile any missing data
@@ -113,6 +136,8 @@ WAIT:
 			s.reconcileMember(member)
 		case index := <-s.tombstoneGC.ExpireCh():
 			go s.reapTombstones(index)
+		case exp := <-s.tombstoneGC.PrefixExpireCh():
+			go s.reapTombstonesPrefix(exp.Prefix, exp.Index)
 		}
 	}
 }
@@ -180,6 +205,7 @@ func (s *Server) initializeACL() error {
 	// Purge the cache, since it could've changed while we
 	// were not the leader
 	s.aclAuthCache.Purge()
+	s.aclCompiled.Purge()
 
 	// Look for the anonymous token
 	state := s.fsm.State()
@@ -251,7 +277,12 @@ func (s *Server) reconcile() (err error) {
 	}
 
 	// Reconcile any members that have been reaped while we were not the leader
-	return s.reconcileReaped(knownMembers)
+	if err := s.reconcileReaped(knownMembers); err != nil {
+		return err
+	}
+
+	// Enable any features that every server now supports
+	return s.negotiateFeatures(members)
 }
 
 // reconcileReaped is used to reconcile nodes that have failed and been reaped
@@ -260,7 +291,7 @@ func (s *Server) reconcile() (err error) {
 // a "reap" event to cause the node to be cleaned up.
 func (s *Server) reconcileReaped(known map[string]struct{}) error {
 	state := s.fsm.State()
-	_, checks := state.ChecksInState(structs.HealthAny)
+	_, checks := state.ChecksInState(structs.HealthAny, structs.CheckCursor{}, 0)
 	for _, check := range checks {
 		// Ignore any non serf checks
 		if check.CheckID != SerfCheckID {
@@ -330,7 +361,7 @@ func (s *Server) reconcileMember(member serf.Member) error {
 			member, err)
 
 		// Permission denied should not bubble up
-		if strings.Contains(err.Error(), permissionDenied) {
+		if structs.ErrorCodeOf(err) == structs.ErrCodePermissionDenied {
 			return nil
 		}
 		return err
@@ -369,9 +400,15 @@ func (s *Server) handleAliveMember(member serf.Member) error {
 		}
 	}
 
-	// Check if the node exists
+	// Check if the node exists, and holds the ID of the member
+	nodeID := member.Tags["id"]
+	_, owner := state.GetNodeByID(nodeID)
 	_, found, addr := state.GetNode(member.Name)
 	if found && addr == member.Addr.String() {
+		if nodeID != "" && (owner == nil || !strings.EqualFold(owner.Node, member.Name)) {
+			goto AFTER_CHECK
+		}
+
 		// Check if the associated service is available
 		if service != nil {
 			match := false
@@ -397,12 +434,33 @@ func (s *Server) handleAliveMember(member serf.Member) error {
 		}
 	}
 AFTER_CHECK:
+	// A node that was renamed keeps its ID, so the node registered
+	// under the old name is removed, unless it is still alive
+	if owner != nil && !strings.EqualFold(owner.Node, member.Name) {
+		if s.isAliveLANMember(owner.Node) {
+			return fmt.Errorf("member '%s' has the node ID %s of alive member '%s'",
+				member.Name, nodeID, owner.Node)
+		}
+		s.logger.Printf("[INFO] consul: member '%s' took over node ID %s of '%s', deregistering '%s'",
+			member.Name, nodeID, owner.Node, owner.Node)
+		req := structs.DeregisterRequest{
+			Datacenter: s.config.Datacenter,
+			Node:       owner.Node,
+			Force:      true,
+		}
+		var out struct{}
+		if err := s.endpoints.Catalog.Deregister(&req, &out); err != nil {
+			return err
+		}
+	}
+
 	s.logger.Printf("[INFO] consul: member '%s' joined, marking health alive", member.Name)
 
 	// Register with the catalog
 	req := structs.RegisterRequest{
 		Datacenter: s.config.Datacenter,
 		Node:       member.Name,
+		NodeID:     nodeID,
 		Address:    member.Addr.String(),
 		Service:    service,
 		Check: &structs.HealthCheck{
@@ -418,6 +476,16 @@ AFTER_CHECK:
 	return s.endpoints.Catalog.Register(&req, &out)
 }
 
+// isAliveLANMember checks if a node is an alive member of the LAN pool
+func (s *Server) isAliveLANMember(name string) bool {
+	for _, member := range s.serfLAN.Members() {
+		if strings.EqualFold(member.Name, name) {
+			return member.Status == serf.StatusAlive
+		}
+	}
+	return false
+}
+
 // handleFailedMember is used to mark the node's status
 // as being critical, along with all checks as unknown.
 func (s *Server) handleFailedMember(member serf.Member) error {
@@ -490,16 +558,91 @@ func (s *Server) handleDeregisterMember(reason string, member serf.Member) error
 		return nil
 	}
 
-	// Deregister the node
+	// Services and checks owned by an external tool outlive the agent,
+	// so only the rest of the node is deregistered
+	if s.hasExternalRegistrations(member.Name) {
+		s.logger.Printf("[INFO] consul: member '%s' %s, deregistering all but the external registrations",
+			member.Name, reason)
+		return s.deregisterAgentRegistrations(member.Name)
+	}
+
+	// Deregister the node. The membership is authoritative, so a
+	// protected node is deregistered as well, instead of failing every
+	// reconcile after it.
 	s.logger.Printf("[INFO] consul: member '%s' %s, deregistering", member.Name, reason)
 	req := structs.DeregisterRequest{
 		Datacenter: s.config.Datacenter,
 		Node:       member.Name,
+		Force:      true,
 	}
 	var out struct{}
 	return s.endpoints.Catalog.Deregister(&req, &out)
 }
 
+// hasExternalRegistrations is used to check if a node has services or
+// checks registered by an external tool
+func (s *Server) hasExternalRegistrations(node string) bool {
+	state := s.fsm.State()
+	_, services := state.NodeServices(node)
+	if services != nil {
+		for _, service := range services.Services {
+			if service.Source == structs.RegistrationSourceExternal {
+				return true
+			}
+		}
+	}
+	_, checks := state.NodeChecks(node)
+	for _, check := range checks {
+		if check.Source == structs.RegistrationSourceExternal {
+			return true
+		}
+	}
+	return false
+}
+
+// deregisterAgentRegistrations is used to deregister the services and
+// checks of a node that are not owned by an external tool, including the
+// Serf check, so the node is not reaped again
+func (s *Server) deregisterAgentRegistrations(node string) error {
+	state := s.fsm.State()
+	var out struct{}
+	_, services := state.NodeServices(node)
+	if services != nil {
+		for _, service := range services.Services {
+			if service.Source == structs.RegistrationSourceExternal {
+				continue
+			}
+			req := structs.DeregisterRequest{
+				Datacenter: s.config.Datacenter,
+				Node:       node,
+				ServiceID:  service.ID,
+				Namespace:  service.Namespace,
+			}
+			if err := s.endpoints.Catalog.Deregister(&req, &out); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Deregistering a service may remove its checks, so the checks are
+	// read after the services
+	_, checks := state.NodeChecks(node)
+	for _, check := range checks {
+		if check.Source == structs.RegistrationSourceExternal {
+			continue
+		}
+		req := structs.DeregisterRequest{
+			Datacenter: s.config.Datacenter,
+			Node:       node,
+			CheckID:    check.CheckID,
+		}
+		if err := s.endpoints.Catalog.Deregister(&req, &out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // joinConsulServer is used to try to join another consul server
 func (s *Server) joinConsulServer(m serf.Member, parts *serverParts) error {
 	// Do not join ourself
@@ -564,3 +707,26 @@ func (s *Server) reapTombstones(index uint64) {
 			index, err)
 	}
 }
+
+// reapTombstonesPrefix is like reapTombstones, but for the tombstones
+// under a prefix with a TTL of its own. Until every server supports it,
+// those tombstones are left to the regular GC.
+func (s *Server) reapTombstonesPrefix(prefix string, index uint64) {
+	defer metrics.MeasureSince([]string{"consul", "leader", "reapTombstonesPrefix"}, time.Now())
+	if err := s.requireFeature(structs.FeatureTombstoneReapPrefix); err != nil {
+		s.logger.Printf("[DEBUG] consul: not reaping tombstones under '%s': %v", prefix, err)
+		return
+	}
+	req := structs.TombstoneRequest{
+		Datacenter:   s.config.Datacenter,
+		Op:           structs.TombstoneReapPrefix,
+		ReapIndex:    index,
+		Prefix:       prefix,
+		WriteRequest: structs.WriteRequest{Token: s.config.ACLToken},
+	}
+	_, err := s.raftApply(structs.TombstoneRequestType, &req)
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to reap tombstones under '%s' up to %d: %v",
+			prefix, index, err)
+	}
+}
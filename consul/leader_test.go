@@ -277,6 +277,53 @@ func TestLeader_Reconcile(t *testing.T) {
 	})
 }
 
+func TestLeader_Reconcile_RenamedNode(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Register the node under its former name
+	id := generateUUID()
+	arg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "old-name",
+		NodeID:     id,
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dir2, c1 := testClientWithConfig(t, func(c *Config) {
+		c.NodeID = id
+	})
+	defer os.RemoveAll(dir2)
+	defer c1.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := c1.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The node under the new name takes over the ID
+	state := s1.fsm.State()
+	testutil.WaitForResult(func() (bool, error) {
+		_, node := state.GetNodeByID(id)
+		return node != nil && node.Node == c1.config.NodeName, nil
+	}, func(err error) {
+		t.Fatalf("client should be registered with the node ID")
+	})
+	if _, found, _ := state.GetNode("old-name"); found {
+		t.Fatalf("old node should be deregistered")
+	}
+}
+
 func TestLeader_LeftServer(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
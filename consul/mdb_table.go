@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -41,7 +42,8 @@ type MDBTable struct {
 	lastRowID uint64
 
 	Env     *mdb.Env
-	Name    string // This is the name of the table, must be unique
+	Txns    *MDBTxnTracker // Tracks the open transactions of the Env, if set
+	Name    string         // This is the name of the table, must be unique
 	Indexes map[string]*MDBIndex
 	Encoder func(interface{}) []byte
 	Decoder func([]byte) interface{}
@@ -60,6 +62,7 @@ type MDBIndex struct {
 	Virtual         bool      // Virtual index does not exist, but can be used for queries
 	RealIndex       string    // Virtual indexes use a RealIndex for iteration
 	CaseInsensitive bool      // Controls if values are case-insensitive
+	BlankFields     []string  // Fields that can be blank without AllowBlank
 
 	table     *MDBTable
 	name      string
@@ -73,6 +76,7 @@ type MDBTxn struct {
 	tx       *mdb.Txn
 	dbis     map[string]mdb.DBI
 	after    []func()
+	tracker  *MDBTxnTracker
 }
 
 // Abort is used to close the transaction
@@ -80,11 +84,14 @@ func (t *MDBTxn) Abort() {
 	if t != nil && t.tx != nil {
 		t.tx.Abort()
 	}
+	t.release()
 }
 
 // Commit is used to commit a transaction
 func (t *MDBTxn) Commit() error {
-	if err := t.tx.Commit(); err != nil {
+	err := t.tx.Commit()
+	t.release()
+	if err != nil {
 		return err
 	}
 	for _, f := range t.after {
@@ -99,6 +106,65 @@ func (t *MDBTxn) Defer(f func()) {
 	t.after = append(t.after, f)
 }
 
+// release is used to mark the transaction as closed with its tracker
+func (t *MDBTxn) release() {
+	if t != nil && t.tracker != nil {
+		t.tracker.release()
+		t.tracker = nil
+	}
+}
+
+// MDBTxnTracker is used to track the open transactions of an Env, so
+// that it can be closed once the transactions in progress complete
+type MDBTxnTracker struct {
+	l       sync.Mutex
+	open    int
+	closed  bool
+	closeFn func()
+}
+
+// acquire is used to track a new transaction. It fails once the Env
+// is closed.
+func (t *MDBTxnTracker) acquire() error {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.closed {
+		return fmt.Errorf("Environment is closed")
+	}
+	t.open++
+	return nil
+}
+
+// release is used to stop tracking a transaction
+func (t *MDBTxnTracker) release() {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.open--
+	t.closeIfIdle()
+}
+
+// CloseWhenIdle is used to invoke fn, which closes the Env, once there
+// are no open transactions. Transactions may still start until then,
+// but fail afterwards. It does not wait for fn to be invoked.
+func (t *MDBTxnTracker) CloseWhenIdle(fn func()) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.closeFn != nil {
+		return
+	}
+	t.closeFn = fn
+	t.closeIfIdle()
+}
+
+// closeIfIdle invokes the close function if it is set and there are no
+// open transactions. The lock must be held.
+func (t *MDBTxnTracker) closeIfIdle() {
+	if t.open == 0 && t.closeFn != nil && !t.closed {
+		t.closed = true
+		t.closeFn()
+	}
+}
+
 type IndexFunc func(*MDBIndex, []string) string
 
 // DefaultIndexFunc is used if no IdxFunc is provided. It joins
@@ -124,6 +190,13 @@ func DefaultIndexPrefixFunc(idx *MDBIndex, parts []string) string {
 	return prefix
 }
 
+// IndexUint formats an unsigned integer field for an index. Values are
+// padded to a fixed width, so they are ordered numerically. Lookups on
+// such a field must format the value the same way.
+func IndexUint(v uint64) string {
+	return fmt.Sprintf("%016x", v)
+}
+
 // Init is used to initialize the MDBTable and ensure it's ready
 func (t *MDBTable) Init() error {
 	if t.Env == nil {
@@ -150,6 +223,9 @@ func (t *MDBTable) Init() error {
 	if id.Virtual {
 		return fmt.Errorf("id index cannot be virtual")
 	}
+	if len(id.BlankFields) >= len(id.Fields) {
+		return fmt.Errorf("id index must have a field that cannot be blank")
+	}
 
 	// Create the table
 	if err := t.createTable(); err != nil {
@@ -241,8 +317,16 @@ func (t *MDBTable) StartTxn(readonly bool, mdbTxn *MDBTxn) (*MDBTxn, error) {
 		txFlags |= mdb.RDONLY
 	}
 
+	if t.Txns != nil {
+		if err := t.Txns.acquire(); err != nil {
+			return nil, err
+		}
+	}
 	tx, err = t.Env.BeginTxn(nil, txFlags)
 	if err != nil {
+		if t.Txns != nil {
+			t.Txns.release()
+		}
 		return nil, err
 	}
 
@@ -250,11 +334,12 @@ func (t *MDBTable) StartTxn(readonly bool, mdbTxn *MDBTxn) (*MDBTxn, error) {
 		readonly: readonly,
 		tx:       tx,
 		dbis:     make(map[string]mdb.DBI),
+		tracker:  t.Txns,
 	}
 EXTEND:
 	dbi, err := tx.DBIOpen(t.Name, 0)
 	if err != nil {
-		tx.Abort()
+		mdbTxn.Abort()
 		return nil, err
 	}
 	mdbTxn.dbis[t.Name] = dbi
@@ -265,7 +350,7 @@ EXTEND:
 		}
 		dbi, err := index.openDBI(tx)
 		if err != nil {
-			tx.Abort()
+			mdbTxn.Abort()
 			return nil, err
 		}
 		mdbTxn.dbis[index.dbiName] = dbi
@@ -443,6 +528,39 @@ func (t *MDBTable) StreamTxn(stream chan<- interface{}, tx *MDBTxn, index string
 	return err
 }
 
+// WalkTxn is like StreamTxn, but invokes the callback with each row in
+// the order of the index. The callback can return a prefix of the last
+// field given, or of the first field if none are, to skip every row whose
+// value has that prefix, which avoids the cost of reading rows that are
+// not wanted. The callback returns true to stop the walk.
+func (t *MDBTable) WalkTxn(tx *MDBTxn, cb func(obj interface{}) (string, bool),
+	index string, parts ...string) error {
+	// Get the associated index
+	idx, key, err := t.getIndex(index, parts)
+	if err != nil {
+		return err
+	}
+
+	return idx.iterateSeek(tx, key, func(res []byte) ([]byte, bool) {
+		skip, stop := cb(t.Decoder(res))
+		if stop || skip == "" {
+			return nil, stop
+		}
+
+		// Seek past every key with the skipped prefix, under the same
+		// leading fields as the walk
+		skipParts := []string{skip}
+		if n := len(parts); n > 0 {
+			skipParts = append(append([]string{}, parts[:n-1]...), skip)
+		}
+		if idx.CaseInsensitive {
+			skipParts = ToLowerList(skipParts)
+		}
+		seek := prefixEnd([]byte(DefaultIndexPrefixFunc(idx, skipParts)))
+		return seek, seek == nil
+	})
+}
+
 // getIndex is used to get the proper index, and also check the arity
 func (t *MDBTable) getIndex(index string, parts []string) (*MDBIndex, []byte, error) {
 	// Get the index
@@ -644,8 +762,14 @@ func (i *MDBIndex) keyFromObject(obj interface{}) ([]byte, error) {
 		if !fv.IsValid() {
 			return nil, fmt.Errorf("Field '%s' for %#v is invalid", field, obj)
 		}
-		val := fv.String()
-		if !i.AllowBlank && val == "" {
+		var val string
+		switch fv.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			val = IndexUint(fv.Uint())
+		default:
+			val = fv.String()
+		}
+		if !i.AllowBlank && val == "" && !i.blankField(field) {
 			return nil, fmt.Errorf("Field '%s' must be set: %#v", field, obj)
 		}
 		if i.CaseInsensitive {
@@ -657,6 +781,17 @@ func (i *MDBIndex) keyFromObject(obj interface{}) ([]byte, error) {
 	return key, nil
 }
 
+// blankField returns if a field can be blank even though the index
+// does not allow blanks
+func (i *MDBIndex) blankField(field string) bool {
+	for _, f := range i.BlankFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
 // keyFromParts returns the key from component parts
 func (i *MDBIndex) keyFromParts(parts ...string) []byte {
 	return []byte(i.IdxFunc(i, parts))
@@ -741,6 +876,82 @@ func (i *MDBIndex) iterate(tx *MDBTxn, prefix []byte,
 	return nil
 }
 
+// iterateSeek is like iterate, but instead of deleting rows the cb can
+// return a key to seek to, skipping the keys before it. The seek key must
+// be after the current key.
+func (i *MDBIndex) iterateSeek(tx *MDBTxn, prefix []byte,
+	cb func(res []byte) ([]byte, bool)) error {
+	table := tx.dbis[i.table.Name]
+
+	// If virtual, use the correct DBI
+	var dbi mdb.DBI
+	if i.Virtual {
+		dbi = tx.dbis[i.realIndex.dbiName]
+	} else {
+		dbi = tx.dbis[i.dbiName]
+	}
+
+	cursor, err := tx.tx.CursorOpen(dbi)
+	if err != nil {
+		return err
+	}
+	if tx.readonly {
+		defer cursor.Close()
+	}
+
+	var key, encRowId, objBytes, seek []byte
+	first := true
+	shouldStop := false
+	for !shouldStop {
+		if first && len(prefix) > 0 {
+			first = false
+			key, encRowId, err = cursor.Get(prefix, mdb.SET_RANGE)
+		} else if seek != nil {
+			key, encRowId, err = cursor.Get(seek, mdb.SET_RANGE)
+		} else if i.Unique {
+			key, encRowId, err = cursor.Get(nil, mdb.NEXT)
+		} else {
+			key, encRowId, err = cursor.Get(nil, mdb.NEXT_DUP)
+			if err == mdb.NotFound {
+				key, encRowId, err = cursor.Get(nil, mdb.NEXT)
+			}
+		}
+		if err == mdb.NotFound {
+			break
+		} else if err != nil {
+			return fmt.Errorf("iterate failed: %v", err)
+		}
+
+		// Bail if this does not match our filter
+		if len(prefix) > 0 && !bytes.HasPrefix(key, prefix) {
+			break
+		}
+
+		// Lookup the actual object
+		objBytes, err = tx.tx.Get(table, encRowId)
+		if err != nil {
+			return fmt.Errorf("rowid lookup failed: %v (%v)", err, encRowId)
+		}
+
+		// Invoke the cb
+		seek, shouldStop = cb(objBytes)
+	}
+	return nil
+}
+
+// prefixEnd returns the smallest key that is greater than every key with
+// the given prefix, or nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 // LastIndex is get the last index that updated the table
 func (t *MDBTable) LastIndex() (uint64, error) {
 	// Start a readonly txn
@@ -800,6 +1011,59 @@ func (t *MDBTable) SetMaxLastIndexTxn(tx *MDBTxn, index uint64) error {
 	return nil
 }
 
+// MDBStats are the B+tree statistics of a table. The entries and pages
+// are summed over the table and its indexes, and Depth is that of the
+// deepest tree.
+type MDBStats struct {
+	Entries       uint64
+	Depth         uint64
+	BranchPages   uint64
+	LeafPages     uint64
+	OverflowPages uint64
+}
+
+// StatsTxn is used to get the B+tree statistics of the table and of its
+// indexes within a transaction
+func (t *MDBTable) StatsTxn(tx *MDBTxn) (*MDBStats, error) {
+	dbis := []mdb.DBI{tx.dbis[t.Name]}
+	for _, index := range t.Indexes {
+		if !index.Virtual {
+			dbis = append(dbis, tx.dbis[index.dbiName])
+		}
+	}
+
+	out := new(MDBStats)
+	for _, dbi := range dbis {
+		stat, err := tx.tx.Stat(dbi)
+		if err != nil {
+			return nil, err
+		}
+		out.Entries += uint64(stat.Entries)
+		out.BranchPages += uint64(stat.BranchPages)
+		out.LeafPages += uint64(stat.LeafPages)
+		out.OverflowPages += uint64(stat.OverflowPages)
+		if depth := uint64(stat.Depth); depth > out.Depth {
+			out.Depth = depth
+		}
+	}
+	return out, nil
+}
+
+// namedDBs returns the number of named DBs used by the tables, one
+// for each table and each index that is not virtual
+func (t MDBTables) namedDBs() int {
+	n := 0
+	for _, table := range t {
+		n++
+		for _, index := range table.Indexes {
+			if !index.Virtual {
+				n++
+			}
+		}
+	}
+	return n
+}
+
 // StartTxn is used to create a transaction that spans a list of tables
 func (t MDBTables) StartTxn(readonly bool) (*MDBTxn, error) {
 	var tx *MDBTxn
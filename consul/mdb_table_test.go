@@ -297,6 +297,72 @@ func TestMDBTableInsert_AllowBlank(t *testing.T) {
 	}
 }
 
+func TestMDBTableInsert_BlankFields(t *testing.T) {
+	dir, env := testMDBEnv(t)
+	defer os.RemoveAll(dir)
+	defer env.Close()
+
+	table := &MDBTable{
+		Env:  env,
+		Name: "test",
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:      true,
+				Fields:      []string{"Country", "Key"},
+				BlankFields: []string{"Country"},
+			},
+		},
+		Encoder: MockEncoder,
+		Decoder: MockDecoder,
+	}
+	if err := table.Init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The same key with and without a country are distinct rows
+	objs := []*MockData{
+		&MockData{Key: "1", Country: ""},
+		&MockData{Key: "1", Country: "USA"},
+	}
+	for _, obj := range objs {
+		if err := table.Insert(obj); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, obj := range objs {
+		_, res, err := table.Get("id", obj.Country, obj.Key)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(res) != 1 || res[0].(*MockData).Country != obj.Country {
+			t.Fatalf("bad: %#v", res)
+		}
+	}
+
+	// The other fields still cannot be blank
+	if err := table.Insert(&MockData{Country: "USA"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// An id index needs a field that cannot be blank
+	bad := &MDBTable{
+		Env:  env,
+		Name: "bad",
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:      true,
+				Fields:      []string{"Key"},
+				BlankFields: []string{"Key"},
+			},
+		},
+		Encoder: MockEncoder,
+		Decoder: MockDecoder,
+	}
+	if err := bad.Init(); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
 func TestMDBTableDelete(t *testing.T) {
 	dir, env := testMDBEnv(t)
 	defer os.RemoveAll(dir)
@@ -1046,3 +1112,198 @@ func TestMDBTableGetTxnLimit(t *testing.T) {
 		t.Fatalf("expect 2 result: %#v", res)
 	}
 }
+
+func TestMDBTableWalkTxn(t *testing.T) {
+	dir, env := testMDBEnv(t)
+	defer os.RemoveAll(dir)
+	defer env.Close()
+
+	table := &MDBTable{
+		Env:  env,
+		Name: "test",
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Key"},
+			},
+			"id_prefix": &MDBIndex{
+				Virtual:   true,
+				RealIndex: "id",
+				Fields:    []string{"Key"},
+				IdxFunc:   DefaultIndexPrefixFunc,
+			},
+		},
+		Encoder: MockEncoder,
+		Decoder: MockDecoder,
+	}
+	if err := table.Init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, key := range []string{"a/1", "a/2", "b/1", "b/2", "b/3", "c/1"} {
+		if err := table.Insert(&MockData{Key: key}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Start a readonly txn
+	tx, err := table.StartTxn(true, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Abort()
+
+	// Skip the b prefix as soon as it is reached
+	var keys []string
+	err = table.WalkTxn(tx, func(obj interface{}) (string, bool) {
+		key := obj.(*MockData).Key
+		keys = append(keys, key)
+		if key == "b/1" {
+			return "b/", false
+		}
+		return "", false
+	}, "id_prefix")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := []string{"a/1", "a/2", "b/1", "c/1"}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("bad: %v", keys)
+	}
+
+	// Stop the walk
+	keys = nil
+	err = table.WalkTxn(tx, func(obj interface{}) (string, bool) {
+		keys = append(keys, obj.(*MockData).Key)
+		return "", true
+	}, "id_prefix", "b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"b/1"}) {
+		t.Fatalf("bad: %v", keys)
+	}
+}
+
+func TestMDBTableWalkTxn_Namespaced(t *testing.T) {
+	dir, env := testMDBEnv(t)
+	defer os.RemoveAll(dir)
+	defer env.Close()
+
+	table := &MDBTable{
+		Env:  env,
+		Name: "test",
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"First", "Key"},
+			},
+			"id_prefix": &MDBIndex{
+				Virtual:   true,
+				RealIndex: "id",
+				Fields:    []string{"First", "Key"},
+				IdxFunc:   DefaultIndexPrefixFunc,
+			},
+		},
+		Encoder: MockEncoder,
+		Decoder: MockDecoder,
+	}
+	if err := table.Init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, ns := range []string{"", "team"} {
+		for _, key := range []string{"web/a", "web/priv/1", "web/priv/2", "web/z"} {
+			if err := table.Insert(&MockData{First: ns, Key: key}); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+
+	tx, err := table.StartTxn(true, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer tx.Abort()
+
+	// The skip is relative to the namespace of the walk, with either an
+	// empty or a non-empty prefix
+	for _, prefix := range []string{"", "web/"} {
+		var keys []string
+		err = table.WalkTxn(tx, func(obj interface{}) (string, bool) {
+			key := obj.(*MockData).Key
+			keys = append(keys, key)
+			if key == "web/priv/1" {
+				return "web/priv/", false
+			}
+			return "", len(keys) > 10
+		}, "id_prefix", "", prefix)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		expect := []string{"web/a", "web/priv/1", "web/z"}
+		if !reflect.DeepEqual(keys, expect) {
+			t.Fatalf("bad: %v", keys)
+		}
+	}
+}
+
+func TestMDBTable_TxnTracker(t *testing.T) {
+	dir, env := testMDBEnv(t)
+	defer os.RemoveAll(dir)
+
+	tracker := &MDBTxnTracker{}
+	table := &MDBTable{
+		Env:  env,
+		Txns: tracker,
+		Name: "test",
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Key"},
+			},
+		},
+		Encoder: MockEncoder,
+		Decoder: MockDecoder,
+	}
+	if err := table.Init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tx, err := table.StartTxn(true, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The env is not closed while a transaction is open
+	closed := false
+	tracker.CloseWhenIdle(func() {
+		closed = true
+		env.Close()
+	})
+	if closed {
+		t.Fatalf("should not be closed")
+	}
+
+	// Transactions can still start until it is closed
+	tx2, err := table.StartTxn(true, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tx2.Abort()
+	if closed {
+		t.Fatalf("should not be closed")
+	}
+
+	// Closing the last transaction closes the env, once
+	tx.Abort()
+	tx.Abort()
+	if !closed {
+		t.Fatalf("should be closed")
+	}
+
+	// New transactions fail
+	if _, err := table.StartTxn(true, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+}
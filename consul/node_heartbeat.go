@@ -0,0 +1,64 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// nodeHeartbeatBatchSize is the maximum number of nodes recorded by
+	// a single Raft entry, which bounds the size of the entries
+	nodeHeartbeatBatchSize = 1024
+)
+
+// runNodeHeartbeats is a long running routine used by the leader to
+// periodically record the nodes that are alive
+func (s *Server) runNodeHeartbeats(stopCh chan struct{}) {
+	for {
+		select {
+		case <-time.After(s.config.NodeHeartbeatInterval):
+			if err := s.heartbeatNodes(); err != nil {
+				s.logger.Printf("[ERR] consul: Failed to record node heartbeats: %v", err)
+			}
+		case <-stopCh:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// heartbeatNodes is used to record the nodes that Serf reports alive, in
+// batches of nodeHeartbeatBatchSize
+func (s *Server) heartbeatNodes() error {
+	defer metrics.MeasureSince([]string{"consul", "leader", "node_heartbeat"}, time.Now())
+	var nodes []string
+	for _, member := range s.serfLAN.Members() {
+		if member.Status == serf.StatusAlive {
+			nodes = append(nodes, member.Name)
+		}
+	}
+
+	for len(nodes) > 0 {
+		n := len(nodes)
+		if n > nodeHeartbeatBatchSize {
+			n = nodeHeartbeatBatchSize
+		}
+		req := structs.NodeHeartbeatRequest{
+			Datacenter: s.config.Datacenter,
+			Nodes:      nodes[:n],
+		}
+		resp, err := s.raftApply(structs.NodeHeartbeatRequestType|structs.IgnoreUnknownTypeFlag, &req)
+		if err != nil {
+			return err
+		}
+		if respErr, ok := resp.(error); ok {
+			return respErr
+		}
+		nodes = nodes[n:]
+	}
+	return nil
+}
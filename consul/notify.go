@@ -2,8 +2,19 @@ package consul
 
 import (
 	"sync"
+	"time"
 )
 
+// Watch is implemented by the notification sources that blocking
+// queries wait on. LastIndex increases every time the watch fires, so
+// a caller can compare the index from before it registered a channel
+// with the current one to detect a change that fired in between.
+type Watch interface {
+	Wait(ch chan struct{})
+	Clear(ch chan struct{})
+	LastIndex() uint64
+}
+
 // NotifyGroup is used to allow a simple notification mechanism.
 // Channels can be marked as waiting, and when notify is invoked,
 // all the waiting channels get a message and are cleared from the
@@ -11,13 +22,52 @@ import (
 type NotifyGroup struct {
 	l      sync.Mutex
 	notify map[chan struct{}]struct{}
+
+	// window is used to coalesce bursts of notifications. If set,
+	// Notify only schedules the waiting channels to be fired once
+	// the window elapses, and any further calls in between are
+	// absorbed into that single firing.
+	window  time.Duration
+	pending bool
+
+	// index is incremented every time the waiting channels are fired
+	index uint64
+}
+
+// SetWindow is used to set the coalescing window of the group. A zero
+// window disables coalescing, so every Notify fires immediately.
+func (n *NotifyGroup) SetWindow(window time.Duration) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.window = window
 }
 
 // Notify will do a non-blocking send to all waiting channels, and
-// clear the notify list
+// clear the notify list. If a coalescing window is set, the send is
+// deferred until the window elapses.
 func (n *NotifyGroup) Notify() {
 	n.l.Lock()
 	defer n.l.Unlock()
+	if n.window > 0 {
+		if !n.pending {
+			n.pending = true
+			time.AfterFunc(n.window, n.fire)
+		}
+		return
+	}
+	n.notifyLocked()
+}
+
+// fire is used to deliver a coalesced notification
+func (n *NotifyGroup) fire() {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.pending = false
+	n.notifyLocked()
+}
+
+// notifyLocked does the actual send, and must be called with the lock held
+func (n *NotifyGroup) notifyLocked() {
 	for ch, _ := range n.notify {
 		select {
 		case ch <- struct{}{}:
@@ -25,6 +75,14 @@ func (n *NotifyGroup) Notify() {
 		}
 	}
 	n.notify = nil
+	n.index++
+}
+
+// LastIndex returns the number of times the group has fired
+func (n *NotifyGroup) LastIndex() uint64 {
+	n.l.Lock()
+	defer n.l.Unlock()
+	return n.index
 }
 
 // Wait adds a channel to the notify group
@@ -47,6 +105,13 @@ func (n *NotifyGroup) Clear(ch chan struct{}) {
 	delete(n.notify, ch)
 }
 
+// Empty checks if no channel is waiting on the group
+func (n *NotifyGroup) Empty() bool {
+	n.l.Lock()
+	defer n.l.Unlock()
+	return len(n.notify) == 0
+}
+
 // WaitCh allocates a channel that is subscribed to notifications
 func (n *NotifyGroup) WaitCh() chan struct{} {
 	ch := make(chan struct{}, 1)
@@ -2,6 +2,7 @@ package consul
 
 import (
 	"testing"
+	"time"
 )
 
 func TestNotifyGroup(t *testing.T) {
@@ -70,3 +71,87 @@ func TestNotifyGroup_Clear(t *testing.T) {
 	default:
 	}
 }
+
+func TestNotifyGroup_Window(t *testing.T) {
+	grp := &NotifyGroup{}
+	grp.SetWindow(50 * time.Millisecond)
+
+	ch1 := grp.WaitCh()
+
+	// A burst of notifications should be coalesced
+	for i := 0; i < 10; i++ {
+		grp.Notify()
+	}
+
+	// Should not fire until the window elapses
+	select {
+	case <-ch1:
+		t.Fatalf("should block")
+	default:
+	}
+
+	select {
+	case <-ch1:
+	case <-time.After(time.Second):
+		t.Fatalf("should fire")
+	}
+
+	// A channel registered during the window is fired as well
+	ch2 := grp.WaitCh()
+	grp.Notify()
+	ch3 := grp.WaitCh()
+	for _, ch := range []chan struct{}{ch2, ch3} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("should fire")
+		}
+	}
+
+	// Only a single message is delivered per window
+	select {
+	case <-ch2:
+		t.Fatalf("should block")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifyGroup_LastIndex(t *testing.T) {
+	var grp Watch = &NotifyGroup{}
+	if idx := grp.LastIndex(); idx != 0 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	// Firing without waiters should still advance the index
+	before := grp.LastIndex()
+	grp.(*NotifyGroup).Notify()
+	if idx := grp.LastIndex(); idx != before+1 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	// A change between reading the index and waiting is detectable
+	before = grp.LastIndex()
+	grp.(*NotifyGroup).Notify()
+	ch := make(chan struct{}, 1)
+	grp.Wait(ch)
+	if grp.LastIndex() == before {
+		t.Fatalf("should detect the missed notification")
+	}
+	grp.Clear(ch)
+}
+
+func TestNotifyGroup_LastIndex_Window(t *testing.T) {
+	grp := &NotifyGroup{}
+	grp.SetWindow(10 * time.Millisecond)
+
+	// Coalesced notifications fire once
+	grp.Notify()
+	grp.Notify()
+	if idx := grp.LastIndex(); idx != 0 {
+		t.Fatalf("bad: %v", idx)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if idx := grp.LastIndex(); idx != 1 {
+		t.Fatalf("bad: %v", idx)
+	}
+}
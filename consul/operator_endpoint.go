@@ -0,0 +1,490 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+// Operator endpoint is used to inspect the internal state of the
+// servers for operators
+type Operator struct {
+	srv *Server
+}
+
+// KVReplicationStatus is used to get the status of replicating the KV
+// store from the primary datacenter. Since only the leader replicates,
+// the request is forwarded to the leader.
+func (o *Operator) KVReplicationStatus(args *structs.DCSpecificRequest,
+	reply *structs.KVReplicationStatus) error {
+	args.AllowStale = false
+	if done, err := o.srv.forward("Operator.KVReplicationStatus", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	o.srv.kvReplicationLock.RLock()
+	*reply = o.srv.kvReplicationStatus
+	o.srv.kvReplicationLock.RUnlock()
+	reply.Enabled = o.srv.kvReplicationEnabled()
+	reply.SourceDatacenter = o.srv.config.KVReplicationDatacenter
+	return nil
+}
+
+// RaftGetConfiguration is used to get the Raft peer configuration. This
+// is the view of the server that handles the request, so the request is
+// forwarded to the leader unless stale reads are allowed.
+func (o *Operator) RaftGetConfiguration(args *structs.DCSpecificRequest,
+	reply *structs.RaftConfigurationResponse) error {
+	if done, err := o.srv.forward("Operator.RaftGetConfiguration", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	peers, err := o.srv.raftPeers.Peers()
+	if err != nil {
+		return err
+	}
+
+	// Map the Raft addresses to the names of the servers
+	names := make(map[string]string)
+	for _, member := range o.srv.serfLAN.Members() {
+		if ok, parts := isConsulServer(member); ok {
+			names[parts.Addr.String()] = member.Name
+		}
+	}
+
+	leader := o.srv.raft.Leader()
+	reply.Servers = make([]*structs.RaftServer, 0, len(peers))
+	for _, peer := range peers {
+		reply.Servers = append(reply.Servers, &structs.RaftServer{
+			Node:    names[peer],
+			Address: peer,
+			Leader:  peer == leader,
+		})
+	}
+	o.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// FSMHealth is used to get the health of the FSM, including the number
+// of entries waiting to be applied and the time since the last apply.
+// This is the view of the server that handles the request, so the request
+// is forwarded to the leader unless stale reads are allowed.
+func (o *Operator) FSMHealth(args *structs.DCSpecificRequest,
+	reply *structs.FSMHealth) error {
+	if done, err := o.srv.forward("Operator.FSMHealth", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	snap, err := o.srv.fsm.State().Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	tables, err := snap.TableIndexes()
+	if err != nil {
+		return err
+	}
+
+	*reply = *o.srv.fsmHealth()
+	reply.TableIndexes = tables
+	o.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// StateStats is used to get the storage statistics of the state store,
+// including the B+tree pages of each table. This is the view of the
+// server that handles the request, as with FSMHealth.
+func (o *Operator) StateStats(args *structs.DCSpecificRequest,
+	reply *structs.StateStoreStats) error {
+	if done, err := o.srv.forward("Operator.StateStats", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "operator", "state_stats"}, time.Now())
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	snap, err := o.srv.fsm.State().Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	stats, err := snap.StorageStats()
+	if err != nil {
+		return err
+	}
+
+	*reply = *stats
+	reply.Server = o.srv.config.NodeName
+	o.srv.setQueryMeta(&reply.QueryMeta)
+	return nil
+}
+
+// StateCompact is used to copy the state store of every server into a
+// fresh one, to release the pages left free by a large delete. The
+// compaction is applied through Raft, so it requires every server to
+// support it.
+func (o *Operator) StateCompact(args *structs.StateCompactRequest,
+	reply *struct{}) error {
+	if done, err := o.srv.forward("Operator.StateCompact", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "operator", "state_compact"}, time.Now())
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	if err := o.srv.requireFeature(structs.FeatureStateCompact); err != nil {
+		return err
+	}
+
+	resp, err := o.srv.raftApply(structs.StateCompactRequestType, args)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul: Failed to compact the state store: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// NodeNameMerge is used to merge the rows stored under another case of
+// the name of a node, written before node names were normalized, into
+// the rows of the name the node is registered under. If the cluster
+// config asks for lowercase node names, the nodes are renamed as well.
+func (o *Operator) NodeNameMerge(args *structs.NodeNameMergeRequest,
+	reply *struct{}) error {
+	if done, err := o.srv.forward("Operator.NodeNameMerge", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "operator", "node_name_merge"}, time.Now())
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	if err := o.srv.requireFeature(structs.FeatureNodeNameMerge); err != nil {
+		return err
+	}
+
+	resp, err := o.srv.raftApply(structs.NodeNameMergeRequestType, args)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul: Failed to merge the node names: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// RaftRemovePeerByAddress is used to remove a peer from the Raft
+// configuration. This is used to repair a cluster when a failed server
+// cannot leave gracefully, without editing the peers.json of every
+// server by hand.
+func (o *Operator) RaftRemovePeerByAddress(args *structs.RaftPeerByAddressRequest,
+	reply *struct{}) error {
+	if done, err := o.srv.forward("Operator.RaftRemovePeerByAddress", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Verify the peer is known, to give a clearer error
+	peers, err := o.srv.raftPeers.Peers()
+	if err != nil {
+		return err
+	}
+	if !raft.PeerContained(peers, args.Address) {
+		return fmt.Errorf("Address %q was not found in the Raft configuration", args.Address)
+	}
+
+	future := o.srv.raft.RemovePeer(args.Address)
+	if err := future.Error(); err != nil {
+		o.srv.logger.Printf("[WARN] consul: Failed to remove Raft peer %q: %v", args.Address, err)
+		return err
+	}
+	o.srv.logger.Printf("[WARN] consul: Removed Raft peer %q", args.Address)
+	return nil
+}
+
+// RestoreSections is used to restore only some of the sections of a
+// snapshot, such as the ACLs or the KV store, into the live state. The
+// entries are applied through Raft in batches, replacing the existing
+// contents of each section. This is meant for disaster recovery when a
+// single subsystem was corrupted, and is not atomic: if a batch fails,
+// the section is left partially restored and the request should be
+// retried. If no snapshot is given, the latest snapshot retained by the
+// leader is used, which rolls the sections back to that snapshot.
+func (o *Operator) RestoreSections(args *structs.PartialRestoreRequest,
+	reply *struct{}) error {
+	if done, err := o.srv.forward("Operator.RestoreSections", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	if len(args.Sections) == 0 {
+		return fmt.Errorf("Must provide sections to restore")
+	}
+
+	// Check before the first batch, so a section is never left partially
+	// restored because of older servers
+	if err := o.srv.requireFeature(structs.FeatureTableRestore); err != nil {
+		return err
+	}
+	var source io.Reader = bytes.NewReader(args.Snapshot)
+	if len(args.Snapshot) == 0 {
+		_, latest, err := o.srv.latestSnapshot()
+		if err != nil {
+			return err
+		}
+		defer latest.Close()
+		source = latest
+	}
+	snap, err := readPartialSnapshot(source, args.Sections)
+	if err != nil {
+		return fmt.Errorf("Failed to read snapshot: %v", err)
+	}
+	for _, section := range args.Sections {
+		if err := o.srv.restoreSection(args.Datacenter, section, snap); err != nil {
+			o.srv.logger.Printf("[ERR] consul: Failed to restore snapshot section '%s': %v", section, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// SeedSnapshot is used to stream the latest snapshot of the leader into
+// the snapshot store of the server handling the request, which must be a
+// follower. The request is not forwarded. This seeds a new or lagging
+// server, which restores the snapshot when it is next started instead of
+// waiting for Raft to install one.
+func (o *Operator) SeedSnapshot(args *structs.DCSpecificRequest,
+	reply *structs.SnapshotResponse) error {
+	if args.Datacenter != o.srv.config.Datacenter {
+		return fmt.Errorf("Snapshots can only be seeded within the local datacenter")
+	}
+
+	// Check ACLs, the leader also verifies the token before streaming
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	resp, err := o.srv.seedSnapshot(args.Token)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul: Failed to seed snapshot: %v", err)
+		return err
+	}
+	*reply = *resp
+	return nil
+}
+
+// ClusterConfigGet is used to get the cluster config. The config is nil
+// if it was never set, in which case all the defaults apply.
+func (o *Operator) ClusterConfigGet(args *structs.DCSpecificRequest,
+	reply *structs.IndexedClusterConfig) error {
+	if done, err := o.srv.forward("Operator.ClusterConfigGet", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	state := o.srv.fsm.State()
+	return o.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("ClusterConfigGet"),
+		func() error {
+			var err error
+			reply.Index, reply.Config, err = state.ClusterConfigGet()
+			return err
+		})
+}
+
+// ClusterConfigSet is used to replace the cluster config. Settings left
+// at their zero value use their defaults.
+func (o *Operator) ClusterConfigSet(args *structs.ClusterConfigRequest,
+	reply *struct{}) error {
+	if done, err := o.srv.forward("Operator.ClusterConfigSet", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "operator", "cluster_config_set"}, time.Now())
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorWrite() {
+		return permissionDeniedErr
+	}
+
+	// Verify the config before it is committed, so an invalid config
+	// is rejected instead of failing to apply
+	if err := validateClusterConfig(&args.Config); err != nil {
+		return err
+	}
+	if err := o.srv.requireFeature(structs.FeatureClusterConfig); err != nil {
+		return err
+	}
+
+	resp, err := o.srv.raftApply(structs.ClusterConfigRequestType, args)
+	if err != nil {
+		o.srv.logger.Printf("[ERR] consul: Failed to set cluster config: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// FeatureList is used to list the features enabled for the datacenter
+func (o *Operator) FeatureList(args *structs.DCSpecificRequest,
+	reply *structs.IndexedFeatures) error {
+	if done, err := o.srv.forward("Operator.FeatureList", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	state := o.srv.fsm.State()
+	return o.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("FeatureList"),
+		func() error {
+			var err error
+			reply.Index, reply.Features, err = state.FeatureList()
+			return err
+		})
+}
+
+// ChangesSince is used to read the changes made to the state store after
+// an index, so external tooling can back up or replicate the changes
+// instead of taking full snapshots. If the change log no longer retains
+// some of those changes, an error is returned and a snapshot is required.
+func (o *Operator) ChangesSince(args *structs.ChangesRequest,
+	reply *structs.IndexedChanges) error {
+	if done, err := o.srv.forward("Operator.ChangesSince", args, args, reply); done {
+		return err
+	}
+
+	// Check ACLs. The keys of the ACL table are the tokens, so they are
+	// only included for a token that can list the ACLs.
+	acl, err := o.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.OperatorRead() {
+		return permissionDeniedErr
+	}
+
+	state := o.srv.fsm.State()
+	return o.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("ChangesSince"),
+		func() error {
+			var err error
+			reply.Index, reply.Changes, err = state.ChangesSince(args.Since)
+			if err != nil {
+				return err
+			}
+			if acl != nil && !acl.ACLList() {
+				reply.Changes = filterACLChanges(reply.Changes)
+			}
+			return nil
+		})
+}
+
+// filterACLChanges is used to drop the changes of the ACL table
+func filterACLChanges(changes structs.Changes) structs.Changes {
+	out := changes[:0]
+	for _, change := range changes {
+		if change.Table != dbACLs {
+			out = append(out, change)
+		}
+	}
+	return out
+}
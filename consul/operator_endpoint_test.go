@@ -0,0 +1,618 @@
+package consul
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestOperator_RaftGetConfiguration(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.RaftConfigurationResponse
+	if err := client.Call("Operator.RaftGetConfiguration", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Servers) != 1 {
+		t.Fatalf("bad: %v", reply.Servers)
+	}
+	server := reply.Servers[0]
+	if server.Node != s1.config.NodeName || !server.Leader ||
+		server.Address != s1.raftTransport.LocalAddr() {
+		t.Fatalf("bad: %#v", server)
+	}
+}
+
+func TestOperator_FSMHealth(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Register a node to advance the index of the nodes table
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "foo",
+		Address:    "127.0.0.1",
+	}
+	var out struct{}
+	if err := client.Call("Catalog.Register", &reg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.FSMHealth
+	if err := client.Call("Operator.FSMHealth", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Server != s1.config.NodeName || reply.Stalled || reply.AppliedIndex == 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if reply.LastApply.IsZero() || reply.SinceLastApply < 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	if reply.TableIndexes[dbNodes] == 0 || reply.TableIndexes[dbNodes] > reply.AppliedIndex {
+		t.Fatalf("bad: %v", reply.TableIndexes)
+	}
+}
+
+func TestOperator_StateCompact(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Write some keys, and delete most of them
+	for i := 0; i < 100; i++ {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt: structs.DirEntry{
+				Key:   fmt.Sprintf("purge/%d", i),
+				Value: bytes.Repeat([]byte("x"), 1024),
+			},
+		}
+		var out bool
+		if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSDeleteTree,
+		DirEnt:     structs.DirEntry{Key: "purge/1"},
+	}
+	var out bool
+	if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stats := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var before structs.StateStoreStats
+	if err := client.Call("Operator.StateStats", &stats, &before); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if before.Server != s1.config.NodeName || before.PageSize == 0 || before.UsedPages == 0 {
+		t.Fatalf("bad: %#v", before)
+	}
+	var kvs *structs.StateTableStats
+	for _, table := range before.Tables {
+		if table.Table == dbKVS {
+			kvs = table
+		}
+	}
+	if kvs == nil || kvs.Rows != 89 || kvs.LeafPages == 0 || kvs.Depth == 0 {
+		t.Fatalf("bad: %#v", kvs)
+	}
+
+	// Wait for the leader to enable the compaction
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureStateCompact)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	compact := structs.StateCompactRequest{
+		Datacenter: "dc1",
+	}
+	var reply struct{}
+	if err := client.Call("Operator.StateCompact", &compact, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The keys are kept
+	var after structs.StateStoreStats
+	if err := client.Call("Operator.StateStats", &stats, &after); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if after.UsedPages > before.UsedPages {
+		t.Fatalf("bad: %v %v", before.UsedPages, after.UsedPages)
+	}
+	_, _, ents, err := s1.fsm.State().KVSList("purge/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 89 {
+		t.Fatalf("bad: %v", len(ents))
+	}
+}
+
+func TestOperator_RaftRemovePeerByAddress(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Removing an unknown peer fails
+	arg := structs.RaftPeerByAddressRequest{
+		Datacenter: "dc1",
+		Address:    "127.0.0.1:1234",
+	}
+	var reply struct{}
+	err := client.Call("Operator.RaftRemovePeerByAddress", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_NodeNameMerge(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureNodeNameMerge)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	reg := structs.RegisterRequest{
+		Datacenter: "dc1",
+		Node:       "Foo",
+		Address:    "127.0.0.1",
+		Service:    &structs.NodeService{ID: "db", Service: "db"},
+	}
+	var out struct{}
+	if err := client.Call("Catalog.Register", &reg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf := structs.ClusterConfigRequest{
+		Datacenter: "dc1",
+		Config:     structs.ClusterConfig{LowercaseNodeNames: true},
+	}
+	if err := client.Call("Operator.ClusterConfigSet", &conf, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg := structs.NodeNameMergeRequest{
+		Datacenter: "dc1",
+	}
+	if err := client.Call("Operator.NodeNameMerge", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, services := s1.fsm.State().NodeServices("foo")
+	if services == nil || services.Node.Node != "foo" || services.Services["db"] == nil {
+		t.Fatalf("bad: %#v", services)
+	}
+}
+
+func TestOperator_ClusterConfig(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureClusterConfig)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// There is no config until one is set
+	get := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedClusterConfig
+	if err := client.Call("Operator.ClusterConfigGet", &get, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Config != nil {
+		t.Fatalf("bad: %v", reply.Config)
+	}
+
+	// Invalid configs are rejected
+	arg := structs.ClusterConfigRequest{
+		Datacenter: "dc1",
+		Config: structs.ClusterConfig{
+			SessionTTLMin: time.Minute,
+			SessionTTLMax: 30 * time.Second,
+		},
+	}
+	var out struct{}
+	err := client.Call("Operator.ClusterConfigSet", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg.Config.SessionBehavior = structs.SessionKeysDelete
+	arg.Config.SessionTTLMax = 10 * time.Minute
+	if err := client.Call("Operator.ClusterConfigSet", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.Call("Operator.ClusterConfigGet", &get, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Config == nil || reply.Config.SessionTTLMin != time.Minute ||
+		reply.Config.SessionBehavior != structs.SessionKeysDelete {
+		t.Fatalf("bad: %v", reply.Config)
+	}
+
+	// Sessions are created with the cluster defaults and bounds
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	session := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session: structs.Session{
+			Node: "foo",
+			TTL:  "30s",
+		},
+	}
+	var id string
+	err = client.Call("Session.Apply", &session, &id)
+	if err == nil || !strings.Contains(err.Error(), "Invalid Session TTL") {
+		t.Fatalf("err: %v", err)
+	}
+	session.Session.TTL = "2m"
+	if err := client.Call("Session.Apply", &session, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, sess, err := s1.fsm.State().SessionGet(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sess == nil || sess.Behavior != structs.SessionKeysDelete {
+		t.Fatalf("bad: %v", sess)
+	}
+}
+
+func TestOperator_RestoreSections(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureTableRestore)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	apply := func(op structs.KVSOp, key, value string) uint64 {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         op,
+			DirEnt:     structs.DirEntry{Key: key, Value: []byte(value)},
+		}
+		var out bool
+		if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		idx, _, _ := s1.fsm.State().KVSGet(key)
+		return idx
+	}
+
+	// Snapshot some keys
+	apply(structs.KVSSet, "foo", "foo")
+	apply(structs.KVSSet, "zip", "zip")
+	snap, err := s1.fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	if err := snap.Persist(&MockSink{buf, false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Corrupt the keys after the snapshot
+	apply(structs.KVSDelete, "foo", "")
+	apply(structs.KVSSet, "zip", "bad")
+	last := apply(structs.KVSSet, "new", "new")
+
+	// Only known sections can be restored
+	arg := structs.PartialRestoreRequest{
+		Datacenter: "dc1",
+		Sections:   []string{"sessions"},
+		Snapshot:   buf.Bytes(),
+	}
+	var reply struct{}
+	err = client.Call("Operator.RestoreSections", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "cannot be restored") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Restore the keys
+	arg.Sections = []string{"kvs"}
+	if err := client.Call("Operator.RestoreSections", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, _, ents, err := s1.fsm.State().KVSList("", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 2 {
+		t.Fatalf("bad: %v", ents)
+	}
+	if ents[0].Key != "foo" || string(ents[0].Value) != "foo" || ents[0].ModifyIndex <= last {
+		t.Fatalf("bad: %v", ents[0])
+	}
+	if ents[1].Key != "zip" || string(ents[1].Value) != "zip" {
+		t.Fatalf("bad: %v", ents[1])
+	}
+}
+
+func TestServer_TableSnapshot(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	for _, key := range []string{"foo", "zip"} {
+		arg := structs.KVSRequest{
+			Datacenter: "dc1",
+			Op:         structs.KVSSet,
+			DirEnt:     structs.DirEntry{Key: key, Value: []byte(key)},
+		}
+		var out bool
+		if err := client.Call("KVS.Apply", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	idx, _, _ := s1.fsm.State().KVSGet("zip")
+
+	// Unknown tables are rejected
+	args := structs.SnapshotRequest{
+		Datacenter: "dc1",
+		Table:      "nope",
+	}
+	var buf bytes.Buffer
+	_, err := s1.TableSnapshot(&args, &buf)
+	if err == nil || !strings.Contains(err.Error(), "Unknown table") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The follower streams the snapshot from the leader
+	args.Table = dbKVS
+	testutil.WaitForResult(func() (bool, error) {
+		buf.Reset()
+		index, err := s2.TableSnapshot(&args, &buf)
+		return err == nil && index == idx, err
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// The snapshot only holds the keys, and reads like a full snapshot
+	snap, err := readPartialSnapshot(bytes.NewReader(buf.Bytes()), []string{"kvs"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snap.entries) != 2 || snap.entries[0].Key != "foo" || snap.entries[1].Key != "zip" {
+		t.Fatalf("bad: %v", snap.entries)
+	}
+	fsm, err := NewFSM(nil, dir1, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	if err := fsm.Restore(&MockSink{bytes.NewBuffer(buf.Bytes()), false}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, _, ents, err := fsm.State().KVSList("", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 2 {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// Stale reads are served by the follower itself
+	args.AllowStale = true
+	buf.Reset()
+	if _, err := s2.TableSnapshot(&args, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := readPartialSnapshot(bytes.NewReader(buf.Bytes()), []string{"kvs"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestOperator_SeedSnapshot(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client1 := rpcClient(t, s1)
+	defer client1.Close()
+
+	dir2, s2 := testServerDCBootstrap(t, "dc1", false)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+	client2 := rpcClient(t, s2)
+	defer client2.Close()
+
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfLANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinLAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		peers, _ := s2.raftPeers.Peers()
+		return len(peers) == 2 && s2.raft.Leader() != "", errors.New(fmt.Sprintf("%v", peers))
+	}, func(err error) {
+		t.Fatalf("should have 2 peers: %v", err)
+	})
+
+	// Seeding fails until the leader has a snapshot
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.SnapshotResponse
+	err := client2.Call("Operator.SeedSnapshot", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), errNoSnapshot.Error()) {
+		t.Fatalf("err: %v", err)
+	}
+
+	kv := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "foo", Value: []byte("bar")},
+	}
+	var out bool
+	if err := client1.Call("KVS.Apply", &kv, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The leader cannot seed itself
+	err = client1.Call("Operator.SeedSnapshot", &arg, &reply)
+	if err == nil || !strings.Contains(err.Error(), "leader to itself") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Seed the follower
+	if err := client2.Call("Operator.SeedSnapshot", &arg, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || reply.Size == 0 {
+		t.Fatalf("bad: %#v", reply)
+	}
+	snaps, err := s2.raftSnapshots.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snaps) == 0 || snaps[0].Index != reply.Index || snaps[0].Size != reply.Size {
+		t.Fatalf("bad: %v", snaps)
+	}
+}
+
+func TestOperator_FeatureList(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// The leader enables every feature, since it is the only server
+	arg := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var reply structs.IndexedFeatures
+	testutil.WaitForResult(func() (bool, error) {
+		if err := client.Call("Operator.FeatureList", &arg, &reply); err != nil {
+			return false, err
+		}
+		return len(reply.Features) == len(supportedFeatures), nil
+	}, func(err error) {
+		t.Fatalf("bad: %v %v", reply.Features, err)
+	})
+
+	enabled, err := s1.fsm.State().FeatureEnabled(structs.FeatureKVSBatch)
+	if err != nil || !enabled {
+		t.Fatalf("bad: %v %v", enabled, err)
+	}
+}
+
+func TestOperator_ChangesSince(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	arg := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         structs.KVSSet,
+		DirEnt:     structs.DirEntry{Key: "test", Value: []byte("test")},
+	}
+	var ok bool
+	if err := client.Call("KVS.Apply", &arg, &ok); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state := s1.fsm.State()
+	idx, _, err := state.KVSGet("test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.ChangesRequest{
+		Datacenter: "dc1",
+		Since:      idx - 1,
+	}
+	var reply structs.IndexedChanges
+	if err := client.Call("Operator.ChangesSince", &req, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index < idx || len(reply.Changes) == 0 {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	// The leader may have made other changes since
+	change := reply.Changes[0]
+	if change.Index != idx || change.Table != dbKVS || change.Key != "test" || change.Op != structs.ChangeSet {
+		t.Fatalf("bad: %v", change)
+	}
+}
@@ -0,0 +1,133 @@
+package consul
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	// restoreBatchSize is the maximum number of entries applied
+	// through Raft in a single batch of a partial restore
+	restoreBatchSize = 256
+)
+
+// partialRestoreSections are the snapshot sections that can be restored
+// without the rest of the snapshot, along with the message type of
+// their entries
+var partialRestoreSections = map[string]structs.MessageType{
+	"acls": structs.ACLRequestType,
+	"kvs":  structs.KVSRequestType,
+}
+
+// partialSnapshot holds the entries of the sections read from a snapshot
+type partialSnapshot struct {
+	acls    structs.ACLs
+	entries structs.DirEntries
+}
+
+// readPartialSnapshot is used to decode the entries of the given sections
+// from a snapshot. The entries of the other sections are skipped.
+func readPartialSnapshot(r io.Reader, sections []string) (*partialSnapshot, error) {
+	wanted := make(map[structs.MessageType]string, len(sections))
+	for _, section := range sections {
+		msgType, ok := partialRestoreSections[section]
+		if !ok {
+			return nil, fmt.Errorf("Section '%s' cannot be restored", section)
+		}
+		wanted[msgType] = section
+	}
+
+	_, dec, err := readSnapshotHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &partialSnapshot{}
+	msgType := make([]byte, 1)
+	for {
+		_, err := r.Read(msgType)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		t := structs.MessageType(msgType[0])
+		_, ok := wanted[t]
+		switch {
+		case ok && t == structs.ACLRequestType:
+			var acl structs.ACL
+			if err := dec.Decode(&acl); err != nil {
+				return nil, err
+			}
+			snap.acls = append(snap.acls, &acl)
+
+		case ok && t == structs.KVSRequestType:
+			var ent structs.DirEntry
+			if err := dec.Decode(&ent); err != nil {
+				return nil, err
+			}
+			snap.entries = append(snap.entries, &ent)
+
+		case t == structs.SnapshotUnchangedType:
+			var req structs.SnapshotUnchanged
+			if err := dec.Decode(&req); err != nil {
+				return nil, err
+			}
+			if strContains(sections, req.Section) {
+				return nil, fmt.Errorf("Snapshot section '%s' is not included in the snapshot", req.Section)
+			}
+
+		default:
+			var skip interface{}
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return snap, nil
+}
+
+// restoreSection is used to apply the entries of a section through Raft
+// in batches. The first batch resets the section, so the entries that are
+// not part of the snapshot are removed.
+func (s *Server) restoreSection(dc, section string, snap *partialSnapshot) error {
+	var num int
+	switch section {
+	case "acls":
+		num = len(snap.acls)
+	case "kvs":
+		num = len(snap.entries)
+	}
+
+	for start := 0; start == 0 || start < num; start += restoreBatchSize {
+		end := start + restoreBatchSize
+		if end > num {
+			end = num
+		}
+		req := structs.TableRestoreRequest{
+			Datacenter: dc,
+			Section:    section,
+			Reset:      start == 0,
+		}
+		switch section {
+		case "acls":
+			req.ACLs = snap.acls[start:end]
+		case "kvs":
+			req.DirEntries = snap.entries[start:end]
+		}
+
+		resp, err := s.raftApply(structs.TableRestoreRequestType, &req)
+		if err != nil {
+			return err
+		}
+		if respErr, ok := resp.(error); ok {
+			return respErr
+		}
+	}
+	s.logger.Printf("[WARN] consul: Restored %d entries of snapshot section '%s'", num, section)
+	return nil
+}
@@ -0,0 +1,87 @@
+package consul
+
+import (
+	"sync"
+)
+
+const (
+	// queryCacheSize is the maximum number of results retained by a
+	// query cache. Once full, the cache is flushed.
+	queryCacheSize = 1024
+)
+
+// queryCache is used to cache the results of hot read queries, like the
+// health of a service polled by thousands of agents. Results are keyed
+// by the query parameters, and are only served at the index of the
+// tables they were computed at, so a cached result is never stale. A
+// watch on the tables flushes the cache once they change, releasing the
+// results that can no longer be served.
+type queryCache struct {
+	l       sync.Mutex
+	watch   func(ch chan struct{})
+	watchCh chan struct{}
+	entries map[string]queryCacheEntry
+}
+
+type queryCacheEntry struct {
+	index uint64
+	value interface{}
+}
+
+// newQueryCache creates a query cache that uses the watch function to
+// subscribe to changes of the underlying tables
+func newQueryCache(watch func(ch chan struct{})) *queryCache {
+	return &queryCache{
+		watch:   watch,
+		entries: make(map[string]queryCacheEntry),
+	}
+}
+
+// get returns the result cached for the key at the given index
+func (c *queryCache) get(key string, index uint64) (interface{}, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.flushIfChanged()
+
+	ent, ok := c.entries[key]
+	if !ok || ent.index != index {
+		return nil, false
+	}
+	return ent.value, true
+}
+
+// set is used to cache the result for the key, computed at the given index
+func (c *queryCache) set(key string, index uint64, value interface{}) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.flushIfChanged()
+
+	// Do not replace a result computed at a later index
+	if exist, ok := c.entries[key]; ok && exist.index > index {
+		return
+	}
+	if len(c.entries) >= queryCacheSize {
+		c.entries = make(map[string]queryCacheEntry)
+	}
+	c.entries[key] = queryCacheEntry{index, value}
+
+	// Watch for changes, unless a watch is already pending
+	if c.watchCh == nil {
+		c.watchCh = make(chan struct{}, 1)
+		c.watch(c.watchCh)
+	}
+}
+
+// flushIfChanged is used to flush the cache once the watch has fired.
+// The lock must be held.
+func (c *queryCache) flushIfChanged() {
+	if c.watchCh == nil {
+		return
+	}
+	select {
+	case <-c.watchCh:
+		c.entries = make(map[string]queryCacheEntry)
+		c.watchCh = nil
+	default:
+	}
+}
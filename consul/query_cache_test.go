@@ -0,0 +1,96 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestQueryCache(t *testing.T) {
+	var watchCh chan struct{}
+	c := newQueryCache(func(ch chan struct{}) {
+		watchCh = ch
+	})
+
+	if _, ok := c.get("foo", 1); ok {
+		t.Fatalf("should miss")
+	}
+	c.set("foo", 1, "bar")
+	if watchCh == nil {
+		t.Fatalf("should watch")
+	}
+
+	// Only served at the same index
+	if v, ok := c.get("foo", 1); !ok || v.(string) != "bar" {
+		t.Fatalf("bad: %v %v", v, ok)
+	}
+	if _, ok := c.get("foo", 2); ok {
+		t.Fatalf("should miss")
+	}
+
+	// An older result does not replace a newer one
+	c.set("foo", 2, "baz")
+	c.set("foo", 1, "bar")
+	if v, ok := c.get("foo", 2); !ok || v.(string) != "baz" {
+		t.Fatalf("bad: %v %v", v, ok)
+	}
+
+	// Firing the watch flushes the cache
+	watchCh <- struct{}{}
+	if _, ok := c.get("foo", 2); ok {
+		t.Fatalf("should miss")
+	}
+
+	// A new watch is registered
+	watchCh = nil
+	c.set("foo", 3, "zip")
+	if watchCh == nil {
+		t.Fatalf("should watch")
+	}
+}
+
+func TestStateStore_QueryCache(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.KVSSet(1, &structs.DirEntry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, d, err := store.KVSGet("foo")
+	if err != nil || idx != 1 || string(d.Value) != "bar" {
+		t.Fatalf("bad: %v %v %v", idx, d, err)
+	}
+
+	// Modifying the result does not affect the cache
+	d.Value = []byte("zip")
+	_, d, err = store.KVSGet("foo")
+	if err != nil || string(d.Value) != "bar" {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	// A write is visible immediately
+	if err := store.KVSSet(2, &structs.DirEntry{Key: "foo", Value: []byte("baz")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, d, err = store.KVSGet("foo")
+	if err != nil || idx != 2 || string(d.Value) != "baz" {
+		t.Fatalf("bad: %v %v %v", idx, d, err)
+	}
+
+	// Same for the service nodes
+	store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	store.EnsureService(4, "foo", &structs.NodeService{"db1", "db", nil, "", 8000, false, "", false, "", nil, ""})
+	_, nodes := store.CheckServiceNodes("db", nil)
+	if len(nodes) != 1 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	nodes[0] = structs.CheckServiceNode{}
+	store.EnsureService(5, "foo", &structs.NodeService{"db1", "db", nil, "", 9000, false, "", false, "", nil, ""})
+	idx, nodes = store.CheckServiceNodes("db", nil)
+	if idx != 5 || len(nodes) != 1 || nodes[0].Service.Port != 9000 {
+		t.Fatalf("bad: %v %v", idx, nodes)
+	}
+}
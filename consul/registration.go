@@ -0,0 +1,91 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// RegistrationValidator is used to enforce a policy on catalog
+// registrations. It is invoked by the leader before a registration is
+// committed, so a violation is rejected before it reaches the Raft log.
+type RegistrationValidator interface {
+	ValidateRegistration(req *structs.RegisterRequest) error
+}
+
+// RegistrationValidators is used to chain multiple validators. The
+// first violation is returned.
+type RegistrationValidators []RegistrationValidator
+
+func (v RegistrationValidators) ValidateRegistration(req *structs.RegisterRequest) error {
+	for _, validator := range v {
+		if err := validator.ValidateRegistration(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegistrationError is returned when a registration violates the policy
+// enforced by a RegistrationValidator.
+type RegistrationError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("Invalid registration, %s '%s' %s", e.Field, e.Value, e.Reason)
+}
+
+// RegistrationPolicy is a RegistrationValidator that enforces a
+// common naming policy. The zero value allows every registration.
+type RegistrationPolicy struct {
+	// NodeName, if set, must match the name of every node
+	NodeName *regexp.Regexp
+
+	// ServiceName, if set, must match the name of every service
+	ServiceName *regexp.Regexp
+
+	// RequireIPAddress requires node and service addresses to be
+	// IP addresses instead of host names
+	RequireIPAddress bool
+
+	// ReservedServices are service names that cannot be registered.
+	// The consul service is always allowed, since it is registered by
+	// the servers themselves.
+	ReservedServices []string
+
+	// MaxTags is the maximum number of tags of a service, if non-zero
+	MaxTags int
+}
+
+func (p *RegistrationPolicy) ValidateRegistration(req *structs.RegisterRequest) error {
+	if p.NodeName != nil && !p.NodeName.MatchString(req.Node) {
+		return &RegistrationError{"node", req.Node, "does not match naming policy"}
+	}
+	if p.RequireIPAddress && net.ParseIP(req.Address) == nil {
+		return &RegistrationError{"address", req.Address, "is not an IP address"}
+	}
+
+	svc := req.Service
+	if svc == nil || svc.Service == ConsulServiceName {
+		return nil
+	}
+	if p.ServiceName != nil && !p.ServiceName.MatchString(svc.Service) {
+		return &RegistrationError{"service", svc.Service, "does not match naming policy"}
+	}
+	if strContains(p.ReservedServices, svc.Service) {
+		return &RegistrationError{"service", svc.Service, "is reserved"}
+	}
+	if p.RequireIPAddress && svc.Address != "" && net.ParseIP(svc.Address) == nil {
+		return &RegistrationError{"service address", svc.Address, "is not an IP address"}
+	}
+	if p.MaxTags > 0 && len(svc.Tags) > p.MaxTags {
+		return &RegistrationError{"service", svc.Service,
+			fmt.Sprintf("has more than %d tags", p.MaxTags)}
+	}
+	return nil
+}
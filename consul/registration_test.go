@@ -0,0 +1,84 @@
+package consul
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestRegistrationPolicy(t *testing.T) {
+	policy := &RegistrationPolicy{
+		NodeName:         regexp.MustCompile(`^[a-z0-9-]+$`),
+		ServiceName:      regexp.MustCompile(`^[a-z-]+$`),
+		RequireIPAddress: true,
+		ReservedServices: []string{"vault"},
+		MaxTags:          2,
+	}
+
+	req := &structs.RegisterRequest{
+		Node:    "node-1",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+			Tags:    []string{"master"},
+		},
+	}
+	if err := policy.ValidateRegistration(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		mutate func(req *structs.RegisterRequest)
+		field  string
+	}{
+		{func(req *structs.RegisterRequest) { req.Node = "Node_1" }, "node"},
+		{func(req *structs.RegisterRequest) { req.Address = "foo.local" }, "address"},
+		{func(req *structs.RegisterRequest) { req.Service.Service = "db2" }, "service"},
+		{func(req *structs.RegisterRequest) { req.Service.Service = "vault" }, "service"},
+		{func(req *structs.RegisterRequest) { req.Service.Address = "db.local" }, "service address"},
+		{func(req *structs.RegisterRequest) { req.Service.Tags = []string{"a", "b", "c"} }, "service"},
+	}
+	for i, c := range cases {
+		bad := *req
+		svc := *req.Service
+		bad.Service = &svc
+		c.mutate(&bad)
+
+		err := policy.ValidateRegistration(&bad)
+		regErr, ok := err.(*RegistrationError)
+		if !ok {
+			t.Fatalf("case %d: bad: %v", i, err)
+		}
+		if regErr.Field != c.field {
+			t.Fatalf("case %d: bad: %v", i, regErr)
+		}
+	}
+
+	// The consul service is always allowed
+	policy.ReservedServices = append(policy.ReservedServices, ConsulServiceName)
+	req.Service = &structs.NodeService{ID: ConsulServiceID, Service: ConsulServiceName}
+	if err := policy.ValidateRegistration(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRegistrationValidators(t *testing.T) {
+	validators := RegistrationValidators{
+		&RegistrationPolicy{},
+		&RegistrationPolicy{MaxTags: 1},
+	}
+	req := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{
+			ID:      "db",
+			Service: "db",
+			Tags:    []string{"master", "v1"},
+		},
+	}
+	if _, ok := validators.ValidateRegistration(req).(*RegistrationError); !ok {
+		t.Fatalf("expected registration error")
+	}
+}
@@ -0,0 +1,235 @@
+package consul
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// remoteServiceCacheSize is the maximum number of queries cached for
+	// the remote datacenters. Once full, other queries are forwarded.
+	remoteServiceCacheSize = 1024
+
+	// remoteServiceCacheRetry is how long a cached query waits before
+	// retrying after a failure to refresh
+	remoteServiceCacheRetry = 5 * time.Second
+)
+
+// remoteServiceCache is used to cache the health of the services of the
+// remote datacenters, so repeated stale queries do not pay the WAN
+// latency. Each cached query is kept up to date by a routine running
+// blocking queries against its datacenter, until it goes unused for the
+// TTL or its datacenter is gone. Results are served with their age, as
+// they may lag behind the remote datacenter.
+type remoteServiceCache struct {
+	srv *Server
+	ttl time.Duration
+
+	l       sync.Mutex
+	entries map[string]*remoteServiceEntry
+}
+
+// remoteServiceEntry is a query cached by the remoteServiceCache
+type remoteServiceEntry struct {
+	dc      string
+	readyCh chan struct{} // Closed once the query was first fetched
+	stopCh  chan struct{} // Closed once the entry is invalidated
+
+	// Guarded by the lock of the cache
+	reply     structs.IndexedCheckServiceNodes
+	err       error
+	refreshed time.Time
+	lastUsed  time.Time
+}
+
+// newRemoteServiceCache creates a cache whose queries are dropped once
+// unused for the TTL. A zero TTL disables the cache.
+func newRemoteServiceCache(srv *Server, ttl time.Duration) *remoteServiceCache {
+	return &remoteServiceCache{
+		srv:     srv,
+		ttl:     ttl,
+		entries: make(map[string]*remoteServiceEntry),
+	}
+}
+
+// cacheable checks if a query can be served from the cache. Only the
+// stale, non-blocking queries of the remote datacenters are.
+func (c *remoteServiceCache) cacheable(args *structs.ServiceSpecificRequest) bool {
+	return c.ttl > 0 && args.Datacenter != c.srv.config.Datacenter &&
+		args.AllowStale && !args.RequireConsistent &&
+		args.MinQueryIndex == 0 && args.Limit == 0
+}
+
+// remoteServiceKey returns the key of a query, which covers its
+// parameters and token, but not its blocking and staleness options
+func remoteServiceKey(args *structs.ServiceSpecificRequest) (string, error) {
+	key := *args
+	key.QueryOptions = structs.QueryOptions{Token: args.Token}
+	buf, err := json.Marshal(&key)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// ServiceNodes is used to serve a query from the cache, fetching it from
+// its datacenter if it is not cached yet. A result older than the
+// MaxStaleDuration of the query is fetched again instead.
+func (c *remoteServiceCache) ServiceNodes(args *structs.ServiceSpecificRequest,
+	reply *structs.IndexedCheckServiceNodes) error {
+	key, err := remoteServiceKey(args)
+	if err != nil {
+		return err
+	}
+
+	c.l.Lock()
+	ent, ok := c.entries[key]
+	if !ok {
+		if len(c.entries) >= remoteServiceCacheSize {
+			c.l.Unlock()
+			return c.forward(args, reply)
+		}
+		ent = &remoteServiceEntry{
+			dc:      args.Datacenter,
+			readyCh: make(chan struct{}),
+			stopCh:  make(chan struct{}),
+		}
+		c.entries[key] = ent
+		go c.refresh(key, ent, *args)
+	}
+	ent.lastUsed = time.Now()
+	c.l.Unlock()
+
+	// Wait for the first fetch of the query
+	select {
+	case <-ent.readyCh:
+	case <-c.srv.shutdownCh:
+		return c.forward(args, reply)
+	}
+
+	c.l.Lock()
+	if ent.refreshed.IsZero() {
+		err := ent.err
+		c.l.Unlock()
+		return err
+	}
+	age := time.Since(ent.refreshed)
+	if args.MaxStaleDuration > 0 && age > args.MaxStaleDuration {
+		c.l.Unlock()
+		return c.forward(args, reply)
+	}
+
+	// The nodes are copied, since callers such as the DNS server
+	// shuffle them in place
+	*reply = ent.reply
+	reply.Nodes = append(structs.CheckServiceNodes(nil), ent.reply.Nodes...)
+	c.l.Unlock()
+
+	reply.Cached = true
+	reply.CacheAge = age
+	metrics.IncrCounter([]string{"consul", "health", "remote_cache", "hit"}, 1)
+	return nil
+}
+
+// forward is used to fetch a query from its datacenter, bypassing the cache
+func (c *remoteServiceCache) forward(args *structs.ServiceSpecificRequest,
+	reply *structs.IndexedCheckServiceNodes) error {
+	metrics.IncrCounter([]string{"consul", "health", "remote_cache", "miss"}, 1)
+	return c.srv.forwardDC("Health.ServiceNodes", args.Datacenter, args, reply)
+}
+
+// refresh is a long running routine used to keep a cached query up to
+// date with blocking queries, until it is unused for the TTL or
+// invalidated. A query that fails to be fetched the first time is
+// dropped, so the next request fetches it again.
+func (c *remoteServiceCache) refresh(key string, ent *remoteServiceEntry,
+	args structs.ServiceSpecificRequest) {
+	defer c.remove(key, ent)
+
+	args.QueryOptions = structs.QueryOptions{
+		Token:        args.Token,
+		AllowStale:   true,
+		MaxQueryTime: c.ttl,
+	}
+	ready := false
+	for {
+		var reply structs.IndexedCheckServiceNodes
+		err := c.srv.forwardDC("Health.ServiceNodes", args.Datacenter, &args, &reply)
+
+		c.l.Lock()
+		if err == nil {
+			ent.reply = reply
+			ent.refreshed = time.Now()
+		}
+		ent.err = err
+		fetched := !ent.refreshed.IsZero()
+		idle := time.Since(ent.lastUsed) > c.ttl
+		c.l.Unlock()
+
+		if !ready {
+			close(ent.readyCh)
+			ready = true
+		}
+		if !fetched || idle {
+			return
+		}
+
+		if err != nil {
+			metrics.IncrCounter([]string{"consul", "health", "remote_cache", "refresh_failed"}, 1)
+			c.srv.logger.Printf("[WARN] consul: Failed to refresh the cached nodes of service '%s' in datacenter '%s': %v",
+				args.ServiceName, args.Datacenter, err)
+		}
+
+		// Block on the index of the last result. Without one, the query
+		// would not block, so it is retried after a while instead.
+		var wait <-chan time.Time
+		if err == nil && reply.Index > 0 {
+			args.MinQueryIndex = reply.Index
+		} else {
+			wait = time.After(remoteServiceCacheRetry)
+		}
+		if wait == nil {
+			select {
+			case <-ent.stopCh:
+				return
+			case <-c.srv.shutdownCh:
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-wait:
+		case <-ent.stopCh:
+			return
+		case <-c.srv.shutdownCh:
+			return
+		}
+	}
+}
+
+// remove is used to drop an entry, unless it was already replaced
+func (c *remoteServiceCache) remove(key string, ent *remoteServiceEntry) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.entries[key] == ent {
+		delete(c.entries, key)
+	}
+}
+
+// invalidateDC is used to drop the queries of a datacenter, once its
+// last server is gone
+func (c *remoteServiceCache) invalidateDC(dc string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	for key, ent := range c.entries {
+		if ent.dc == dc {
+			close(ent.stopCh)
+			delete(c.entries, key)
+		}
+	}
+}
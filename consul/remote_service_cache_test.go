@@ -0,0 +1,94 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestRemoteServiceCache(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	dir2, s2 := testServerWithConfig(t, func(c *Config) {
+		c.Datacenter = "dc2"
+	})
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	// Try to join
+	addr := fmt.Sprintf("127.0.0.1:%d",
+		s1.config.SerfWANConfig.MemberlistConfig.BindPort)
+	if _, err := s2.JoinWAN([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForLeader(t, client.Call, "dc2")
+
+	// Register a service in dc2
+	register := func(port int) {
+		arg := structs.RegisterRequest{
+			Datacenter: "dc2",
+			Node:       "foo",
+			Address:    "127.0.0.1",
+			Service:    &structs.NodeService{ID: "db", Service: "db", Port: port},
+		}
+		var out struct{}
+		if err := client.Call("Catalog.Register", &arg, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	register(5000)
+
+	// A stale query is served from the cache
+	args := structs.ServiceSpecificRequest{
+		Datacenter:   "dc2",
+		ServiceName:  "db",
+		QueryOptions: structs.QueryOptions{AllowStale: true},
+	}
+	var out structs.IndexedCheckServiceNodes
+	if err := client.Call("Health.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Cached || len(out.Nodes) != 1 || out.Nodes[0].Service.Port != 5000 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Other queries are forwarded
+	args.AllowStale = false
+	out = structs.IndexedCheckServiceNodes{}
+	if err := client.Call("Health.ServiceNodes", &args, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Cached || len(out.Nodes) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The cache is refreshed when the service changes
+	register(6000)
+	args.AllowStale = true
+	testutil.WaitForResult(func() (bool, error) {
+		out = structs.IndexedCheckServiceNodes{}
+		if err := client.Call("Health.ServiceNodes", &args, &out); err != nil {
+			return false, err
+		}
+		return out.Cached && len(out.Nodes) == 1 && out.Nodes[0].Service.Port == 6000, nil
+	}, func(err error) {
+		t.Fatalf("not refreshed: %#v %v", out, err)
+	})
+
+	// Invalidating the datacenter drops its queries
+	s1.remoteServices.invalidateDC("dc2")
+	s1.remoteServices.l.Lock()
+	n := len(s1.remoteServices.entries)
+	s1.remoteServices.l.Unlock()
+	if n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/yamux"
 	"github.com/inconshreveable/muxado"
 )
@@ -24,6 +26,7 @@ const (
 	rpcMultiplex
 	rpcTLS
 	rpcMultiplexV2
+	rpcSnapshot
 )
 
 const (
@@ -34,9 +37,10 @@ const (
 	// if no time is specified. Previously we would wait the maxQueryTime.
 	defaultQueryTime = 300 * time.Second
 
-	// jitterFraction is a the limit to the amount of jitter we apply
-	// to a user specified MaxQueryTime. We divide the specified time by
-	// the fraction. So 16 == 6.25% limit of jitter
+	// jitterFraction is the default limit to the amount of jitter we
+	// apply to a user specified MaxQueryTime. We divide the specified
+	// time by the fraction. So 16 == 6.25% limit of jitter. See the
+	// QueryJitterFraction of the config.
 	jitterFraction = 16
 
 	// Warn if the Raft command is larger than this.
@@ -112,6 +116,9 @@ func (s *Server) handleConn(conn net.Conn, isTLS bool) {
 	case rpcMultiplexV2:
 		s.handleMultiplexV2(conn)
 
+	case rpcSnapshot:
+		s.handleSnapshotConn(conn)
+
 	default:
 		s.logger.Printf("[ERR] consul.rpc: unrecognized RPC byte: %v", buf[0])
 		conn.Close()
@@ -188,7 +195,7 @@ func (s *Server) forward(method string, info structs.RPCInfo, args interface{},
 	}
 
 	// Check if we can allow a stale read
-	if info.IsRead() && info.AllowStaleRead() {
+	if info.IsRead() && info.AllowStaleRead() && s.withinStaleBound(info) {
 		return false, nil
 	}
 
@@ -278,6 +285,12 @@ func (s *Server) globalRPC(method string, args interface{},
 // raftApply is used to encode a message, run it through raft, and return
 // the FSM response along with any errors
 func (s *Server) raftApply(t structs.MessageType, msg interface{}) (interface{}, error) {
+	// Stamp write requests with our clock, so the FSM computes the
+	// same expirations on every server, including during a replay
+	if req, ok := msg.(structs.TimestampedRequest); ok {
+		req.SetTimestamp(time.Now())
+	}
+
 	buf, err := structs.Encode(t, msg)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to encode request: %v", err)
@@ -288,6 +301,12 @@ func (s *Server) raftApply(t structs.MessageType, msg interface{}) (interface{},
 		s.logger.Printf("[WARN] consul: Attempting to apply large raft entry (%d bytes)", n)
 	}
 
+	// Reject requests that are certain to fail against the current
+	// state, before paying the cost of a raft round trip
+	if err := s.fsm.Validate(&raft.Log{Data: buf}); err != nil {
+		return nil, err
+	}
+
 	future := s.raft.Apply(buf, enqueueLimit)
 	if err := future.Error(); err != nil {
 		return nil, err
@@ -317,6 +336,7 @@ type blockingRPCOptions struct {
 	tables    MDBTables
 	kvWatch   bool
 	kvPrefix  string
+	kvPattern string
 	run       func() error
 }
 
@@ -324,8 +344,7 @@ type blockingRPCOptions struct {
 // for more parameterization easily. It should be preferred over blockingRPC.
 func (s *Server) blockingRPCOpt(opts *blockingRPCOptions) error {
 	var timeout *time.Timer
-	var notifyCh chan struct{}
-	var state *StateStore
+	var watches WatchSet
 
 	// Fast path non-blocking
 	if opts.queryOpts.MinQueryIndex == 0 {
@@ -333,7 +352,14 @@ func (s *Server) blockingRPCOpt(opts *blockingRPCOptions) error {
 	}
 
 	// Sanity check that we have tables to block on
-	if len(opts.tables) == 0 && !opts.kvWatch {
+	watches.AddTables(opts.tables)
+	if opts.kvWatch {
+		watches.AddKVPrefix(opts.kvPrefix)
+	}
+	if opts.kvPattern != "" {
+		watches.AddKVPattern(opts.kvPattern)
+	}
+	if watches.Empty() {
 		panic("no tables to block on")
 	}
 
@@ -345,30 +371,23 @@ func (s *Server) blockingRPCOpt(opts *blockingRPCOptions) error {
 	}
 
 	// Apply a small amount of jitter to the request
-	opts.queryOpts.MaxQueryTime += randomStagger(opts.queryOpts.MaxQueryTime / jitterFraction)
+	opts.queryOpts.MaxQueryTime += s.queryJitter(opts.queryOpts.MaxQueryTime)
 
 	// Setup a query timeout
 	timeout = time.NewTimer(opts.queryOpts.MaxQueryTime)
 
-	// Setup the notify channel
-	notifyCh = make(chan struct{}, 1)
-
 	// Ensure we tear down any watchers on return
-	state = s.fsm.State()
 	defer func() {
 		timeout.Stop()
-		state.StopWatch(opts.tables, notifyCh)
-		if opts.kvWatch {
-			state.StopWatchKV(opts.kvPrefix, notifyCh)
-		}
+		watches.Stop()
 	}()
 
 REGISTER_NOTIFY:
-	// Register the notification channel. This may be done
-	// multiple times if we have not reached the target wait index.
-	state.Watch(opts.tables, notifyCh)
-	if opts.kvWatch {
-		state.WatchKV(opts.kvPrefix, notifyCh)
+	// Register the watches. This may be done multiple times if we have
+	// not reached the target wait index, and moves the watches over to
+	// the new store if the previous one was replaced by a restore.
+	if err := watches.Arm(s.fsm.State()); err != nil {
+		return err
 	}
 
 RUN_QUERY:
@@ -388,15 +407,26 @@ RUN_QUERY:
 
 	// Check for minimum query time
 	if err == nil && opts.queryMeta.Index > 0 && opts.queryMeta.Index <= opts.queryOpts.MinQueryIndex {
-		select {
-		case <-notifyCh:
+		if watches.Wait(timeout.C) != watchTimeout {
 			goto REGISTER_NOTIFY
-		case <-timeout.C:
 		}
 	}
 	return err
 }
 
+// queryJitter returns the jitter to add to the wait time of a blocking
+// query, using the jitter source and fraction of the config
+func (s *Server) queryJitter(wait time.Duration) time.Duration {
+	limit := time.Duration(float64(wait) * s.config.QueryJitterFraction)
+	if limit <= 0 {
+		return 0
+	}
+	if s.config.QueryJitter != nil {
+		return s.config.QueryJitter(limit)
+	}
+	return randomStagger(limit)
+}
+
 // setQueryMeta is used to populate the QueryMeta data for an RPC call
 func (s *Server) setQueryMeta(m *structs.QueryMeta) {
 	if s.IsLeader() {
@@ -408,6 +438,37 @@ func (s *Server) setQueryMeta(m *structs.QueryMeta) {
 	}
 }
 
+// withinStaleBound checks if this server is fresh enough to service a
+// stale read within the staleness bound of the request. The leader is
+// never considered stale.
+func (s *Server) withinStaleBound(info structs.RPCInfo) bool {
+	maxDuration, maxIndex := info.MaxStaleness()
+	if (maxDuration == 0 && maxIndex == 0) || s.IsLeader() {
+		return true
+	}
+	if maxDuration > 0 && time.Now().Sub(s.raft.LastContact()) > maxDuration {
+		metrics.IncrCounter([]string{"consul", "rpc", "stale_bound_exceeded"}, 1)
+		return false
+	}
+	if maxIndex > 0 && s.applyLag() > maxIndex {
+		metrics.IncrCounter([]string{"consul", "rpc", "stale_bound_exceeded"}, 1)
+		return false
+	}
+	return true
+}
+
+// applyLag returns the number of entries committed by the leader, as
+// last reported to this server, that have not yet been applied
+func (s *Server) applyLag() uint64 {
+	stats := s.raft.Stats()
+	commit, _ := strconv.ParseUint(stats["commit_index"], 10, 64)
+	applied, _ := strconv.ParseUint(stats["applied_index"], 10, 64)
+	if commit <= applied {
+		return 0
+	}
+	return commit - applied
+}
+
 // consistentRead is used to ensure we do not perform a stale
 // read. This is done by verifying leadership before the read.
 func (s *Server) consistentRead() error {
@@ -265,6 +265,11 @@ func (s *Server) nodeFailed(me serf.MemberEvent, wan bool) {
 		}
 		s.remoteLock.Unlock()
 
+		// The cached queries of a datacenter can no longer be refreshed
+		if n == 0 && wan {
+			s.remoteServices.invalidateDC(parts.Datacenter)
+		}
+
 		// Remove from the local list as well
 		if !wan {
 			s.localLock.Lock()
@@ -14,8 +14,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/acl"
+	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/tlsutil"
+	"github.com/hashicorp/golang-lru"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
 	"github.com/hashicorp/serf/serf"
@@ -51,8 +54,18 @@ const (
 	// raftRemoveGracePeriod is how long we wait to allow a RemovePeer
 	// to replicate to gracefully leave the cluster.
 	raftRemoveGracePeriod = 5 * time.Second
+
+	// stateStatsInterval is how often the sizes of the state store
+	// tables are emitted as metrics
+	stateStatsInterval = 30 * time.Second
 )
 
+// stateStatsTables are the state store tables that have their
+// sizes emitted as metrics
+var stateStatsTables = []string{
+	dbNodes, dbServices, dbChecks, dbKVS, dbSessions, dbACLs, dbTombstone,
+}
+
 // Server is Consul server which manages the service discovery,
 // health checking, DC forwarding, Raft, and multiple Serf pools.
 type Server struct {
@@ -62,6 +75,14 @@ type Server struct {
 	// aclCache is the non-authoritative ACL cache.
 	aclCache *aclCache
 
+	// aclCompiled caches compiled ACLs by token ID and ModifyIndex
+	// when we are authoritative. It is purged on ACL table changes.
+	aclCompiled *lru.Cache
+
+	// aclUsage tracks the tokens used since their use was last
+	// recorded in the ACL datacenter
+	aclUsage *aclUsage
+
 	// Consul configuration
 	config *Config
 
@@ -83,6 +104,11 @@ type Server struct {
 	// strong consistency.
 	fsm *consulFSM
 
+	// kvReplicationStatus tracks the progress of replicating the
+	// KV store from the primary datacenter
+	kvReplicationStatus structs.KVReplicationStatus
+	kvReplicationLock   sync.RWMutex
+
 	// Have we attempted to leave the cluster
 	left bool
 
@@ -99,6 +125,7 @@ type Server struct {
 	raft          *raft.Raft
 	raftLayer     *RaftLayer
 	raftPeers     raft.PeerStore
+	raftSnapshots raft.SnapshotStore
 	raftStore     *raftboltdb.BoltStore
 	raftTransport *raft.NetworkTransport
 
@@ -129,14 +156,25 @@ type Server struct {
 
 	// sessionTimers track the expiration time of each Session that has
 	// a TTL. On expiration, a SessionDestroy event will occur, and
-	// destroy the session via standard session destroy processing
-	sessionTimers     map[string]*time.Timer
+	// destroy the session via standard session destroy processing.
+	// The timers run on sessionWheel, so a large number of sessions
+	// does not take a runtime timer each.
+	sessionTimers     map[string]*wheelTimer
+	sessionWheel      *timerWheel
 	sessionTimersLock sync.Mutex
 
 	// tombstoneGC is used to track the pending GC invocations
 	// for the KV tombstones
 	tombstoneGC *TombstoneGC
 
+	// checkChangeCh is used to pass the check status changes applied
+	// by the FSM to the leader, which posts them to the webhooks
+	checkChangeCh chan *structs.CheckStatusChange
+
+	// remoteServices caches the health of the services of the remote
+	// datacenters
+	remoteServices *remoteServiceCache
+
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
@@ -144,13 +182,17 @@ type Server struct {
 
 // Holds the RPC endpoints
 type endpoints struct {
-	Catalog  *Catalog
-	Health   *Health
-	Status   *Status
-	KVS      *KVS
-	Session  *Session
-	Internal *Internal
-	ACL      *ACL
+	Catalog         *Catalog
+	Health          *Health
+	Status          *Status
+	KVS             *KVS
+	Session         *Session
+	Internal        *Internal
+	ACL             *ACL
+	Operator        *Operator
+	ConfigEntry     *ConfigEntry
+	CheckDefinition *CheckDefinition
+	ServiceConfig   *ServiceConfig
 }
 
 // NewServer is used to construct a new Consul server from the
@@ -171,6 +213,11 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, err
 	}
 
+	// Sanity check the KV replication
+	if err := config.CheckKVReplication(); err != nil {
+		return nil, err
+	}
+
 	// Ensure we have a log output
 	if config.LogOutput == nil {
 		config.LogOutput = os.Stderr
@@ -197,6 +244,11 @@ func NewServer(config *Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	for prefix, ttl := range config.TombstonePrefixTTLs {
+		if err := gc.SetPrefixTTL(prefix, ttl); err != nil {
+			return nil, err
+		}
+	}
 
 	// Create server
 	s := &Server{
@@ -211,8 +263,12 @@ func NewServer(config *Config) (*Server, error) {
 		rpcServer:     rpc.NewServer(),
 		rpcTLS:        incomingTLS,
 		tombstoneGC:   gc,
+		aclUsage:      newACLUsage(),
+		sessionWheel:  newTimerWheel(sessionTimerTick),
+		checkChangeCh: make(chan *structs.CheckStatusChange, checkWebhookQueueSize),
 		shutdownCh:    make(chan struct{}),
 	}
+	s.remoteServices = newRemoteServiceCache(s, config.RemoteServiceCacheTTL)
 
 	// Initialize the authoritative ACL cache
 	s.aclAuthCache, err = acl.NewCache(aclCacheSize, s.aclFault)
@@ -226,6 +282,13 @@ func NewServer(config *Config) (*Server, error) {
 		s.Shutdown()
 		return nil, err
 	}
+	s.aclCache.downPolicy = s.aclDownPolicy
+
+	// Set up the compiled ACL cache
+	if s.aclCompiled, err = lru.New(aclCacheSize); err != nil {
+		s.Shutdown()
+		return nil, fmt.Errorf("Failed to create compiled ACL cache: %v", err)
+	}
 
 	// Initialize the RPC layer
 	if err := s.setupRPC(tlsWrap); err != nil {
@@ -262,6 +325,16 @@ func NewServer(config *Config) (*Server, error) {
 
 	// Start the metrics handlers
 	go s.sessionStats()
+	go s.stateStats()
+	go s.monitorFSM()
+
+	// Purge compiled ACLs as the ACL table changes
+	go s.watchACLCompiled()
+
+	// Record the use of tokens in the ACL datacenter
+	if config.ACLDatacenter != "" && config.ACLDatacenter == config.Datacenter {
+		go s.runACLUsage()
+	}
 	return s, nil
 }
 
@@ -280,6 +353,10 @@ func (s *Server) setupSerf(conf *serf.Config, ch chan serf.Event, path string, w
 	conf.Tags["vsn_min"] = fmt.Sprintf("%d", ProtocolVersionMin)
 	conf.Tags["vsn_max"] = fmt.Sprintf("%d", ProtocolVersionMax)
 	conf.Tags["build"] = s.config.Build
+	if s.config.NodeID != "" {
+		conf.Tags["id"] = s.config.NodeID
+	}
+	conf.Tags["features"] = featuresTag(supportedFeatures)
 	conf.Tags["port"] = fmt.Sprintf("%d", addr.Port)
 	if s.config.Bootstrap {
 		conf.Tags["bootstrap"] = "1"
@@ -331,6 +408,19 @@ func (s *Server) setupRaft() error {
 	if err != nil {
 		return err
 	}
+	s.fsm.SetNotifyWindow(s.config.WatchCoalesceWindow)
+	s.fsm.SetSnapshotRate(int64(s.config.SnapshotWriteRate) * 1024 * 1024)
+	if err := s.fsm.SetSnapshotEncoding(s.config.SnapshotEncoding); err != nil {
+		return err
+	}
+	s.fsm.SetSnapshotMirror(s.config.SnapshotMirror)
+	s.fsm.SetSessionHandler(s.sessionInvalidated)
+	s.fsm.SetCheckStatusHandler(s.checkStatusChanged)
+	s.fsm.SetDecodeWorkers(s.config.FSMDecodeWorkers)
+	s.fsm.SetSlowApplyThresholds(s.config.FSMSlowApplyThreshold, s.config.FSMSlowApplyThresholds)
+	if s.config.StateLogger != nil {
+		s.fsm.SetLogger(s.config.StateLogger)
+	}
 
 	// Create the base raft path
 	path := filepath.Join(s.config.DataDir, raftState)
@@ -353,11 +443,20 @@ func (s *Server) setupRaft() error {
 	}
 
 	// Create the snapshot store
-	snapshots, err := raft.NewFileSnapshotStore(path, snapshotsRetained, s.config.LogOutput)
+	fileSnapshots, err := raft.NewFileSnapshotStore(path, snapshotsRetained, s.config.LogOutput)
 	if err != nil {
 		store.Close()
 		return err
 	}
+	var snapshots raft.SnapshotStore = fileSnapshots
+	if s.config.IncrementalSnapshots {
+		snapshots, err = newIncrementalSnapshotStore(fileSnapshots, filepath.Join(path, "sections"), s.logger)
+		if err != nil {
+			store.Close()
+			return err
+		}
+	}
+	s.raftSnapshots = snapshots
 
 	// Create a transport layer
 	trans := raft.NewNetworkTransport(s.raftLayer, 3, 10*time.Second, s.config.LogOutput)
@@ -382,7 +481,7 @@ func (s *Server) setupRaft() error {
 	s.config.RaftConfig.LogOutput = s.config.LogOutput
 
 	// Setup the Raft store
-	s.raft, err = raft.NewRaft(s.config.RaftConfig, s.fsm, cacheStore, store,
+	s.raft, err = raft.NewRaft(s.config.RaftConfig, s.fsm, s.fsm.WrapLogStore(cacheStore), store,
 		snapshots, s.raftPeers, trans)
 	if err != nil {
 		store.Close()
@@ -405,6 +504,10 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	s.endpoints.Session = &Session{s}
 	s.endpoints.Internal = &Internal{s}
 	s.endpoints.ACL = &ACL{s}
+	s.endpoints.Operator = &Operator{s}
+	s.endpoints.ConfigEntry = &ConfigEntry{s}
+	s.endpoints.CheckDefinition = &CheckDefinition{s}
+	s.endpoints.ServiceConfig = &ServiceConfig{s}
 
 	// Register the handlers
 	s.rpcServer.Register(s.endpoints.Status)
@@ -414,6 +517,10 @@ func (s *Server) setupRPC(tlsWrap tlsutil.DCWrapper) error {
 	s.rpcServer.Register(s.endpoints.Session)
 	s.rpcServer.Register(s.endpoints.Internal)
 	s.rpcServer.Register(s.endpoints.ACL)
+	s.rpcServer.Register(s.endpoints.Operator)
+	s.rpcServer.Register(s.endpoints.ConfigEntry)
+	s.rpcServer.Register(s.endpoints.CheckDefinition)
+	s.rpcServer.Register(s.endpoints.ServiceConfig)
 
 	list, err := net.ListenTCP("tcp", s.config.RPCAddr)
 	if err != nil {
@@ -621,6 +728,12 @@ func (s *Server) IsLeader() bool {
 	return s.raft.State() == raft.Leader
 }
 
+// StateMemoryStats is used to estimate the bytes retained by the tables
+// of the local state store
+func (s *Server) StateMemoryStats() (*structs.StateMemoryStats, error) {
+	return s.fsm.State().MemoryStats()
+}
+
 // KeyManagerLAN returns the LAN Serf keyring manager
 func (s *Server) KeyManagerLAN() *serf.KeyManager {
 	return s.serfLAN.KeyManager()
@@ -704,3 +817,55 @@ func (s *Server) Stats() map[string]map[string]string {
 	}
 	return stats
 }
+
+// stateStats is a long running routine used to capture the number
+// of rows, approximate size and pages of the state store tables
+func (s *Server) stateStats() {
+	for {
+		select {
+		case <-time.After(stateStatsInterval):
+			s.emitStateStats()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// emitStateStats computes the table sizes from a snapshot of the
+// state store, so the tables are not locked while they are walked
+func (s *Server) emitStateStats() {
+	snap, err := s.fsm.State().Snapshot()
+	if err != nil {
+		s.logger.Printf("[ERR] consul: Failed to snapshot state for stats: %v", err)
+		return
+	}
+	defer snap.Close()
+
+	for _, table := range stateStatsTables {
+		rows, bytes, err := snap.TableStats(table)
+		if err != nil {
+			s.logger.Printf("[ERR] consul: Failed to get stats of table '%s': %v", table, err)
+			continue
+		}
+		metrics.SetGauge([]string{"consul", "state", table, "rows"}, float32(rows))
+		metrics.SetGauge([]string{"consul", "state", table, "bytes"}, float32(bytes))
+
+		tree, err := snap.TableTreeStats(table)
+		if err != nil {
+			s.logger.Printf("[ERR] consul: Failed to get tree stats of table '%s': %v", table, err)
+			continue
+		}
+		pages := tree.BranchPages + tree.LeafPages + tree.OverflowPages
+		metrics.SetGauge([]string{"consul", "state", table, "pages"}, float32(pages))
+		metrics.SetGauge([]string{"consul", "state", table, "depth"}, float32(tree.Depth))
+	}
+
+	// The pages used by the map include the free ones, which are only
+	// released by a compaction
+	stats, err := snap.EnvStats()
+	if err != nil {
+		s.logger.Printf("[ERR] consul: Failed to get state store stats: %v", err)
+		return
+	}
+	metrics.SetGauge([]string{"consul", "state", "used_pages"}, float32(stats.UsedPages))
+}
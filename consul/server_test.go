@@ -689,3 +689,38 @@ func TestServer_Encrypted(t *testing.T) {
 		t.Fatalf("should be encrypted")
 	}
 }
+
+func TestServer_QueryJitter(t *testing.T) {
+	var limits []time.Duration
+	s := &Server{config: &Config{
+		QueryJitterFraction: 0.25,
+		QueryJitter: func(limit time.Duration) time.Duration {
+			limits = append(limits, limit)
+			return limit / 2
+		},
+	}}
+	if jitter := s.queryJitter(time.Minute); jitter != 7500*time.Millisecond {
+		t.Fatalf("bad: %v", jitter)
+	}
+	if len(limits) != 1 || limits[0] != 15*time.Second {
+		t.Fatalf("bad: %v", limits)
+	}
+
+	// No jitter is applied without a fraction
+	s.config.QueryJitterFraction = 0
+	if jitter := s.queryJitter(time.Minute); jitter != 0 {
+		t.Fatalf("bad: %v", jitter)
+	}
+	if len(limits) != 1 {
+		t.Fatalf("bad: %v", limits)
+	}
+
+	// The default source stays below the limit
+	s.config.QueryJitterFraction = DefaultConfig().QueryJitterFraction
+	s.config.QueryJitter = nil
+	for i := 0; i < 100; i++ {
+		if jitter := s.queryJitter(time.Minute); jitter < 0 || jitter >= time.Minute/jitterFraction {
+			t.Fatalf("bad: %v", jitter)
+		}
+	}
+}
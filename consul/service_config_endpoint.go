@@ -0,0 +1,111 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// ServiceConfig endpoint is used to manage the configuration that applies
+// to all the instances of a service, such as its DNS TTL
+type ServiceConfig struct {
+	srv *Server
+}
+
+// Apply is used to set or delete the configuration of a service
+func (c *ServiceConfig) Apply(args *structs.ServiceConfigRequest, reply *struct{}) error {
+	if done, err := c.srv.forward("ServiceConfig.Apply", args, args, reply); done {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"consul", "service_config", "apply"}, time.Now())
+
+	// Verify the args
+	if args.Config.Service == "" {
+		return fmt.Errorf("Must provide service")
+	}
+	switch args.Op {
+	case structs.ServiceConfigSet:
+		if args.Config.DNSTTL < 0 {
+			return fmt.Errorf("Invalid DNS TTL '%v'", args.Config.DNSTTL)
+		}
+	case structs.ServiceConfigDelete:
+	default:
+		return fmt.Errorf("Invalid service config operation '%s'", args.Op)
+	}
+
+	// The configuration follows the rules of its service
+	acl, err := c.srv.resolveToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && !acl.ServiceWrite(args.Config.Service) {
+		c.srv.logger.Printf("[WARN] consul.service_config: Apply of '%s' denied due to ACLs",
+			args.Config.Service)
+		return permissionDeniedErr
+	}
+
+	if err := c.srv.requireFeature(structs.FeatureServiceConfig); err != nil {
+		return err
+	}
+
+	resp, err := c.srv.raftApply(structs.ServiceConfigRequestType, args)
+	if err != nil {
+		c.srv.logger.Printf("[ERR] consul.service_config: Apply failed: %v", err)
+		return err
+	}
+	if respErr, ok := resp.(error); ok {
+		return respErr
+	}
+	return nil
+}
+
+// Get is used to get the configuration of a service
+func (c *ServiceConfig) Get(args *structs.ServiceConfigQuery,
+	reply *structs.IndexedServiceConfigs) error {
+	if done, err := c.srv.forward("ServiceConfig.Get", args, args, reply); done {
+		return err
+	}
+	if args.Service == "" {
+		return fmt.Errorf("Must provide service")
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("ServiceConfigGet"),
+		func() error {
+			index, conf, err := state.ServiceConfigGet(args.Service)
+			if err != nil {
+				return err
+			}
+			reply.Index = index
+			if conf != nil {
+				reply.Configs = structs.ServiceConfigs{conf}
+			} else {
+				reply.Configs = nil
+			}
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
+
+// List is used to list the configuration of all services
+func (c *ServiceConfig) List(args *structs.ServiceConfigQuery,
+	reply *structs.IndexedServiceConfigs) error {
+	if done, err := c.srv.forward("ServiceConfig.List", args, args, reply); done {
+		return err
+	}
+
+	state := c.srv.fsm.State()
+	return c.srv.blockingRPC(&args.QueryOptions,
+		&reply.QueryMeta,
+		state.QueryTables("ServiceConfigList"),
+		func() error {
+			var err error
+			reply.Index, reply.Configs, err = state.ServiceConfigList()
+			if err != nil {
+				return err
+			}
+			return c.srv.filterACL(args.Token, reply)
+		})
+}
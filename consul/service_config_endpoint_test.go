@@ -0,0 +1,149 @@
+package consul
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestServiceConfig_Apply(t *testing.T) {
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureServiceConfig)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Invalid configs are rejected
+	arg := structs.ServiceConfigRequest{
+		Datacenter: "dc1",
+		Op:         structs.ServiceConfigSet,
+		Config: structs.ServiceConfig{
+			Service: "db",
+			DNSTTL:  -time.Second,
+		},
+	}
+	var out struct{}
+	err := client.Call("ServiceConfig.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), "Invalid DNS TTL") {
+		t.Fatalf("err: %v", err)
+	}
+
+	arg.Config.DNSTTL = 10 * time.Second
+	if err := client.Call("ServiceConfig.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	get := structs.ServiceConfigQuery{
+		Datacenter: "dc1",
+		Service:    "db",
+	}
+	var reply structs.IndexedServiceConfigs
+	if err := client.Call("ServiceConfig.Get", &get, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply.Index == 0 || len(reply.Configs) != 1 || reply.Configs[0].DNSTTL != 10*time.Second {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	// Delete the config
+	arg.Op = structs.ServiceConfigDelete
+	if err := client.Call("ServiceConfig.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.Call("ServiceConfig.Get", &get, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Configs) != 0 {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
+func TestServiceConfig_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+	testutil.WaitForResult(func() (bool, error) {
+		return s1.fsm.State().FeatureEnabled(structs.FeatureServiceConfig)
+	}, func(err error) {
+		t.Fatalf("not enabled: %v", err)
+	})
+
+	// Create the ACL
+	arg := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: testRegisterRules,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var id string
+	if err := client.Call("ACL.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The token can only write the config of its service
+	var out struct{}
+	for i, service := range []string{"foo", "db"} {
+		req := structs.ServiceConfigRequest{
+			Datacenter:   "dc1",
+			Op:           structs.ServiceConfigSet,
+			Config:       structs.ServiceConfig{Service: service, DNSTTL: time.Second},
+			WriteRequest: structs.WriteRequest{Token: id},
+		}
+		err := client.Call("ServiceConfig.Apply", &req, &out)
+		if i == 0 && err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if i > 0 && (err == nil || !strings.Contains(err.Error(), permissionDenied)) {
+			t.Fatalf("err: %v", err)
+		}
+
+		req.WriteRequest.Token = "root"
+		if err := client.Call("ServiceConfig.Apply", &req, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The list is filtered down to the configs the token can read
+	list := structs.ServiceConfigQuery{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: id},
+	}
+	var reply structs.IndexedServiceConfigs
+	if err := client.Call("ServiceConfig.List", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Configs) != 1 || reply.Configs[0].Service != "foo" {
+		t.Fatalf("bad: %v", reply.Configs)
+	}
+
+	list.Token = "root"
+	if err := client.Call("ServiceConfig.List", &list, &reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reply.Configs) != 2 {
+		t.Fatalf("bad: %v", reply.Configs)
+	}
+}
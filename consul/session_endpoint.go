@@ -29,11 +29,31 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 		return fmt.Errorf("Must provide Node")
 	}
 
-	// Ensure that the specified behavior is allowed
+	// Apply the ACL policy if any. A destroy is checked against the node
+	// of the existing session.
+	acl, err := s.srv.resolveSessionToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil {
+		node := args.Session.Node
+		if args.Op == structs.SessionDestroy {
+			_, existing, err := s.srv.fsm.State().SessionGet(args.Session.ID)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				node = existing.Node
+			}
+		}
+		if !acl.SessionWrite(node) {
+			return permissionDeniedErr
+		}
+	}
+
+	// Ensure that the specified behavior is allowed. A session without
+	// one gets the default of the cluster config when it is created.
 	switch args.Session.Behavior {
 	case "":
-		// Default behavior to Release for backwards compatibility
-		args.Session.Behavior = structs.SessionKeysRelease
 	case structs.SessionKeysRelease:
 	case structs.SessionKeysDelete:
 	default:
@@ -47,9 +67,13 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 			return fmt.Errorf("Session TTL '%s' invalid: %v", args.Session.TTL, err)
 		}
 
-		if ttl != 0 && (ttl < s.srv.config.SessionTTLMin || ttl > structs.SessionTTLMax) {
+		min, max, err := s.ttlBounds()
+		if err != nil {
+			return err
+		}
+		if ttl != 0 && (ttl < min || ttl > max) {
 			return fmt.Errorf("Invalid Session TTL '%d', must be between [%v=%v]",
-				ttl, s.srv.config.SessionTTLMin, structs.SessionTTLMax)
+				ttl, min, max)
 		}
 	}
 
@@ -100,6 +124,23 @@ func (s *Session) Apply(args *structs.SessionRequest, reply *string) error {
 	return nil
 }
 
+// ttlBounds returns the bounds of the TTL of new sessions. The bounds of
+// the cluster config take precedence over the configuration of the server.
+func (s *Session) ttlBounds() (time.Duration, time.Duration, error) {
+	min, max := s.srv.config.SessionTTLMin, structs.SessionTTLMax
+	_, conf, err := s.srv.fsm.State().ClusterConfigGet()
+	if err != nil {
+		return 0, 0, err
+	}
+	if conf != nil && conf.SessionTTLMin > 0 {
+		min = conf.SessionTTLMin
+	}
+	if conf != nil && conf.SessionTTLMax > 0 {
+		max = conf.SessionTTLMax
+	}
+	return min, max, nil
+}
+
 // Get is used to retrieve a single session
 func (s *Session) Get(args *structs.SessionSpecificRequest,
 	reply *structs.IndexedSessions) error {
@@ -107,6 +148,11 @@ func (s *Session) Get(args *structs.SessionSpecificRequest,
 		return err
 	}
 
+	acl, err := s.srv.resolveSessionToken(args.Token)
+	if err != nil {
+		return err
+	}
+
 	// Get the local state
 	state := s.srv.fsm.State()
 	return s.srv.blockingRPC(&args.QueryOptions,
@@ -120,6 +166,9 @@ func (s *Session) Get(args *structs.SessionSpecificRequest,
 			} else {
 				reply.Sessions = nil
 			}
+			if acl != nil {
+				reply.Sessions = FilterSessions(acl, reply.Sessions)
+			}
 			return err
 		})
 }
@@ -131,6 +180,11 @@ func (s *Session) List(args *structs.DCSpecificRequest,
 		return err
 	}
 
+	acl, err := s.srv.resolveSessionToken(args.Token)
+	if err != nil {
+		return err
+	}
+
 	// Get the local state
 	state := s.srv.fsm.State()
 	return s.srv.blockingRPC(&args.QueryOptions,
@@ -139,6 +193,9 @@ func (s *Session) List(args *structs.DCSpecificRequest,
 		func() error {
 			var err error
 			reply.Index, reply.Sessions, err = state.SessionList()
+			if err == nil && acl != nil {
+				reply.Sessions = FilterSessions(acl, reply.Sessions)
+			}
 			return err
 		})
 }
@@ -150,6 +207,11 @@ func (s *Session) NodeSessions(args *structs.NodeSpecificRequest,
 		return err
 	}
 
+	acl, err := s.srv.resolveSessionToken(args.Token)
+	if err != nil {
+		return err
+	}
+
 	// Get the local state
 	state := s.srv.fsm.State()
 	return s.srv.blockingRPC(&args.QueryOptions,
@@ -158,6 +220,9 @@ func (s *Session) NodeSessions(args *structs.NodeSpecificRequest,
 		func() error {
 			var err error
 			reply.Index, reply.Sessions, err = state.NodeSessions(args.Node)
+			if err == nil && acl != nil {
+				reply.Sessions = FilterSessions(acl, reply.Sessions)
+			}
 			return err
 		})
 }
@@ -177,6 +242,14 @@ func (s *Session) Renew(args *structs.SessionSpecificRequest,
 		return err
 	}
 
+	// Apply the ACL policy if any
+	acl, err := s.srv.resolveSessionToken(args.Token)
+	if err != nil {
+		return err
+	} else if acl != nil && session != nil && !acl.SessionWrite(session.Node) {
+		return permissionDeniedErr
+	}
+
 	// Reset the session TTL timer
 	reply.Index = index
 	if session != nil {
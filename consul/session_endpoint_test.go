@@ -1,12 +1,15 @@
 package consul
 
 import (
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul/consul/structs"
 	"github.com/hashicorp/consul/testutil"
+	"github.com/hashicorp/serf/serf"
 )
 
 func TestSessionEndpoint_Apply(t *testing.T) {
@@ -19,7 +22,7 @@ func TestSessionEndpoint_Apply(t *testing.T) {
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
@@ -68,6 +71,131 @@ func TestSessionEndpoint_Apply(t *testing.T) {
 	}
 }
 
+func TestSessionEndpoint_ACLDeny(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+		c.ACLEnforceSessionRules = true
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create a token which can only manage the sessions of foo
+	aclReq := structs.ACLRequest{
+		Datacenter: "dc1",
+		Op:         structs.ACLSet,
+		ACL: structs.ACL{
+			Name:  "User token",
+			Type:  structs.ACLTypeClient,
+			Rules: `session "foo" { policy = "write" }`,
+		},
+		WriteRequest: structs.WriteRequest{Token: "root"},
+	}
+	var token string
+	if err := client.Call("ACL.Apply", &aclReq, &token); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	state := s1.fsm.State()
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	state.EnsureNode(2, structs.Node{Node: "bar", Address: "127.0.0.2"})
+
+	arg := structs.SessionRequest{
+		Datacenter:   "dc1",
+		Op:           structs.SessionCreate,
+		Session:      structs.Session{Node: "foo"},
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	var fooID string
+	if err := client.Call("Session.Apply", &arg, &fooID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Sessions of other nodes cannot be created or destroyed
+	arg.Session.Node = "bar"
+	var out string
+	err := client.Call("Session.Apply", &arg, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+	arg.WriteRequest.Token = "root"
+	var barID string
+	if err := client.Call("Session.Apply", &arg, &barID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	destroy := structs.SessionRequest{
+		Datacenter:   "dc1",
+		Op:           structs.SessionDestroy,
+		Session:      structs.Session{ID: barID},
+		WriteRequest: structs.WriteRequest{Token: token},
+	}
+	err = client.Call("Session.Apply", &destroy, &out)
+	if err == nil || !strings.Contains(err.Error(), permissionDenied) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the sessions of foo are listed
+	list := structs.DCSpecificRequest{
+		Datacenter:   "dc1",
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	var sessions structs.IndexedSessions
+	if err := client.Call("Session.List", &list, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].ID != fooID {
+		t.Fatalf("bad: %v", sessions.Sessions)
+	}
+
+	destroy.Session.ID = fooID
+	if err := client.Call("Session.Apply", &destroy, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSessionEndpoint_ACLNotEnforced(t *testing.T) {
+	dir1, s1 := testServerWithConfig(t, func(c *Config) {
+		c.ACLDatacenter = "dc1"
+		c.ACLMasterToken = "root"
+		c.ACLDefaultPolicy = "deny"
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Without the session rules enforced, the anonymous token can
+	// still use sessions
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionCreate,
+		Session:    structs.Session{Node: "foo"},
+	}
+	var id string
+	if err := client.Call("Session.Apply", &arg, &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	list := structs.DCSpecificRequest{
+		Datacenter: "dc1",
+	}
+	var sessions structs.IndexedSessions
+	if err := client.Call("Session.List", &list, &sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].ID != id {
+		t.Fatalf("bad: %v", sessions.Sessions)
+	}
+}
+
 func TestSessionEndpoint_DeleteApply(t *testing.T) {
 	dir1, s1 := testServer(t)
 	defer os.RemoveAll(dir1)
@@ -78,7 +206,7 @@ func TestSessionEndpoint_DeleteApply(t *testing.T) {
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
 	// Just add a node
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
@@ -140,7 +268,7 @@ func TestSessionEndpoint_Get(t *testing.T) {
 
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
 		Op:         structs.SessionCreate,
@@ -183,7 +311,7 @@ func TestSessionEndpoint_List(t *testing.T) {
 
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	ids := []string{}
 	for i := 0; i < 5; i++ {
 		arg := structs.SessionRequest{
@@ -234,7 +362,7 @@ func TestSessionEndpoint_ApplyTimers(t *testing.T) {
 
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	arg := structs.SessionRequest{
 		Datacenter: "dc1",
 		Op:         structs.SessionCreate,
@@ -277,7 +405,7 @@ func TestSessionEndpoint_Renew(t *testing.T) {
 	TTL := "10s" // the minimum allowed ttl
 	ttl := 10 * time.Second
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
 	ids := []string{}
 	for i := 0; i < 5; i++ {
 		arg := structs.SessionRequest{
@@ -435,8 +563,8 @@ func TestSessionEndpoint_NodeSessions(t *testing.T) {
 
 	testutil.WaitForLeader(t, client.Call, "dc1")
 
-	s1.fsm.State().EnsureNode(1, structs.Node{"foo", "127.0.0.1"})
-	s1.fsm.State().EnsureNode(1, structs.Node{"bar", "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	s1.fsm.State().EnsureNode(1, structs.Node{Node: "bar", Address: "127.0.0.1"})
 	ids := []string{}
 	for i := 0; i < 10; i++ {
 		arg := structs.SessionRequest{
@@ -536,3 +664,68 @@ func TestSessionEndpoint_Apply_BadTTL(t *testing.T) {
 		t.Fatalf("incorrect error message: %s", err.Error())
 	}
 }
+
+func TestSessionEndpoint_InvalidateEvent(t *testing.T) {
+	eventCh := make(chan serf.UserEvent, 4)
+	dir1, s1 := testServerWithConfig(t, func(conf *Config) {
+		conf.UserEventHandler = func(e serf.UserEvent) {
+			eventCh <- e
+		}
+	})
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+	client := rpcClient(t, s1)
+	defer client.Close()
+
+	testutil.WaitForLeader(t, client.Call, "dc1")
+
+	// Create a session holding a lock
+	state := s1.fsm.State()
+	state.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"})
+	session := &structs.Session{ID: generateUUID(), Node: "foo", Name: "my-session"}
+	if err := state.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, err := state.KVSLock(3, &structs.DirEntry{Key: "foo/lock", Session: session.ID}); err != nil || !ok {
+		t.Fatalf("err: %v %v", ok, err)
+	}
+
+	// Destroy the session
+	arg := structs.SessionRequest{
+		Datacenter: "dc1",
+		Op:         structs.SessionDestroy,
+		Session:    structs.Session{ID: session.ID},
+	}
+	var out string
+	if err := client.Call("Session.Apply", &arg, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wait for the event
+	for {
+		select {
+		case e := <-eventCh:
+			if e.Name != sessionInvalidateEvent {
+				continue
+			}
+			var event structs.SessionInvalidation
+			if err := json.Unmarshal(e.Payload, &event); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if event.Session != session.ID || event.Name != "my-session" || event.Node != "foo" {
+				t.Fatalf("bad: %#v", event)
+			}
+			if event.Behavior != structs.SessionKeysRelease {
+				t.Fatalf("bad: %#v", event)
+			}
+
+			// The keys of the session are not gossiped
+			if strings.Contains(string(e.Payload), "foo/lock") {
+				t.Fatalf("bad: %s", e.Payload)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
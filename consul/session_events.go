@@ -0,0 +1,52 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// sessionInvalidateEvent is the name of the user event fired by
+	// the leader when a session is invalidated. Applications can watch
+	// it to react to the loss of their locks, looking up the keys of the
+	// session with their own token.
+	sessionInvalidateEvent = "consul-session-invalidate"
+
+	// userEventSizeLimit is the maximum size of the name and payload
+	// of a user event, as enforced by Serf
+	userEventSizeLimit = 512
+)
+
+// sessionInvalidated is invoked by the FSM once a session invalidation
+// is committed. Every server applies the invalidation, so only the
+// leader fires the event.
+func (s *Server) sessionInvalidated(event *structs.SessionInvalidation) {
+	if !s.IsLeader() {
+		return
+	}
+
+	name := userEventName(sessionInvalidateEvent)
+	payload, err := encodeSessionInvalidation(event, userEventSizeLimit-len(name))
+	if err != nil {
+		s.logger.Printf("[ERR] consul: failed to encode session invalidation event: %v", err)
+		return
+	}
+	if err := s.serfLAN.UserEvent(name, payload, false); err != nil {
+		s.logger.Printf("[WARN] consul: failed to fire session invalidation event: %v", err)
+	}
+}
+
+// encodeSessionInvalidation is used to encode the event as JSON, making
+// sure it fits in limit bytes
+func encodeSessionInvalidation(event *structs.SessionInvalidation, limit int) ([]byte, error) {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > limit {
+		return nil, fmt.Errorf("event exceeds limit of %d bytes", limit)
+	}
+	return buf, nil
+}
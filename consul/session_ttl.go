@@ -8,6 +8,11 @@ import (
 	"github.com/hashicorp/consul/consul/structs"
 )
 
+const (
+	// sessionTimerTick is the resolution of the session timers
+	sessionTimerTick = time.Millisecond
+)
+
 // initializeSessionTimers is used when a leader is newly elected to create
 // a new map to track session expiration and to reset all the timers from
 // the previously known set of timers.
@@ -70,7 +75,7 @@ func (s *Server) resetSessionTimer(id string, session *structs.Session) error {
 func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) {
 	// Ensure a timer map exists
 	if s.sessionTimers == nil {
-		s.sessionTimers = make(map[string]*time.Timer)
+		s.sessionTimers = make(map[string]*wheelTimer)
 	}
 
 	// Adjust the given TTL by the TTL multiplier. This is done
@@ -87,7 +92,7 @@ func (s *Server) resetSessionTimerLocked(id string, ttl time.Duration) {
 	}
 
 	// Create a new timer to track expiration of thi ssession
-	timer := time.AfterFunc(ttl, func() {
+	timer := s.sessionWheel.AfterFunc(ttl, func() {
 		s.invalidateSession(id)
 	})
 	s.sessionTimers[id] = timer
@@ -0,0 +1,70 @@
+package consul
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	// defaultSnapshotEncoding is the encoding of the entries of snapshots
+	// that do not name one, including all those that predate the setting
+	defaultSnapshotEncoding = "msgpack"
+)
+
+// snapshotEncoder is used to encode the entries of a snapshot
+type snapshotEncoder interface {
+	Encode(v interface{}) error
+}
+
+// snapshotDecoder is used to decode the entries of a snapshot. The type
+// of each entry is read directly from the snapshot between entries, so
+// a decoder must not read past the end of the entry it decodes.
+type snapshotDecoder interface {
+	Decode(v interface{}) error
+}
+
+// snapshotCodec is an encoding of the entries of a snapshot
+type snapshotCodec struct {
+	newEncoder func(io.Writer) snapshotEncoder
+	newDecoder func(io.Reader) snapshotDecoder
+}
+
+// snapshotCodecs are the supported encodings of the entries of a snapshot,
+// by the name recorded in the snapshot header. The header itself is always
+// encoded with msgpack, so the encoding can be read before the entries.
+var snapshotCodecs = map[string]snapshotCodec{
+	"msgpack": {
+		newEncoder: func(w io.Writer) snapshotEncoder { return codec.NewEncoder(w, msgpackHandle) },
+		newDecoder: func(r io.Reader) snapshotDecoder { return codec.NewDecoder(r, msgpackHandle) },
+	},
+}
+
+// getSnapshotCodec returns the codec of the named encoding. An empty
+// name selects the default encoding.
+func getSnapshotCodec(name string) (snapshotCodec, error) {
+	if name == "" {
+		name = defaultSnapshotEncoding
+	}
+	c, ok := snapshotCodecs[name]
+	if !ok {
+		return snapshotCodec{}, fmt.Errorf("Unsupported snapshot encoding '%s'", name)
+	}
+	return c, nil
+}
+
+// readSnapshotHeader is used to read the header of a snapshot, returning
+// the decoder of the entries that follow it
+func readSnapshotHeader(r io.Reader) (*snapshotHeader, snapshotDecoder, error) {
+	var header snapshotHeader
+	dec := codec.NewDecoder(r, msgpackHandle)
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, err
+	}
+	c, err := getSnapshotCodec(header.Encoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &header, c.newDecoder(r), nil
+}
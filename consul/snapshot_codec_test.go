@@ -0,0 +1,70 @@
+package consul
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+func TestSnapshotCodec_Header(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	if err := fsm.SetSnapshotEncoding("protobuf"); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := fsm.SetSnapshotEncoding("msgpack"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm.state.KVSSet(1, &structs.DirEntry{Key: "/foo", Value: []byte("bar")})
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	buf := bytes.NewBuffer(nil)
+	sink := &MockSink{buf, false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The header records the encoding
+	header, _, err := readSnapshotHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header.Encoding != "msgpack" || header.LastIndex != 1 {
+		t.Fatalf("bad: %#v", header)
+	}
+
+	// Snapshots without an encoding are restored as msgpack
+	old := bytes.NewBuffer(nil)
+	if err := codec.NewEncoder(old, msgpackHandle).Encode(&snapshotHeader{LastIndex: 1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := readSnapshotHeader(old); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown encodings are rejected
+	unknown := bytes.NewBuffer(nil)
+	if err := codec.NewEncoder(unknown, msgpackHandle).Encode(&snapshotHeader{LastIndex: 1, Encoding: "foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := readSnapshotHeader(unknown); err == nil {
+		t.Fatalf("should fail")
+	}
+}
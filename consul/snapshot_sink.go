@@ -0,0 +1,174 @@
+package consul
+
+import (
+	"io"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// snapshotCheckpointSize is the number of bytes written to a
+	// snapshot sink between checkpoints. At each checkpoint the writer
+	// is throttled to stay below the configured rate.
+	snapshotCheckpointSize = 1024 * 1024
+)
+
+// IncrementalSnapshotSink is implemented by snapshot sinks that retain
+// the previous snapshot. When persisting to such a sink, the sections of
+// the state that are unchanged since the previous snapshot are replaced
+// by a structs.SnapshotUnchanged marker, which shrinks the snapshot when
+// only a few tables churn. The snapshot store is responsible for
+// replacing the markers with the retained sections before a restore.
+type IncrementalSnapshotSink interface {
+	raft.SnapshotSink
+
+	// Incremental returns true if the sink retains a complete previous
+	// snapshot to resolve the markers against
+	Incremental() bool
+
+	// Section is called before each section of the snapshot is written,
+	// with the index of its tables. Unchanged is set if only a marker
+	// is written for the section.
+	Section(name string, index uint64, unchanged bool) error
+
+	// OnClose registers a function that is called once the snapshot is
+	// closed successfully. Sections can only be skipped against the
+	// snapshots that were.
+	OnClose(fn func())
+}
+
+// rateLimitedSink wraps a SnapshotSink to limit the rate at which
+// a snapshot is written. Persisting a large state store can otherwise
+// saturate the disk and starve the fsyncs done by Raft, which stalls
+// the leader. Writes are accounted in checkpoints, and after each
+// checkpoint the writer sleeps until it is back under the rate.
+type rateLimitedSink struct {
+	raft.SnapshotSink
+
+	// rate is the maximum number of bytes written per second
+	rate int64
+
+	start   time.Time
+	written int64
+	pending int64
+}
+
+// newRateLimitedSink returns a sink that writes at most rate bytes
+// per second to the given sink
+func newRateLimitedSink(sink raft.SnapshotSink, rate int64) *rateLimitedSink {
+	return &rateLimitedSink{
+		SnapshotSink: sink,
+		rate:         rate,
+		start:        time.Now(),
+	}
+}
+
+func (r *rateLimitedSink) Write(p []byte) (int, error) {
+	n, err := r.SnapshotSink.Write(p)
+	r.written += int64(n)
+	r.pending += int64(n)
+	if err == nil && r.pending >= snapshotCheckpointSize {
+		r.checkpoint()
+	}
+	return n, err
+}
+
+// checkpoint is used to throttle the writer if it is ahead of the rate
+func (r *rateLimitedSink) checkpoint() {
+	metrics.IncrCounter([]string{"consul", "fsm", "persist", "bytes"}, float32(r.pending))
+	r.pending = 0
+
+	expected := time.Duration(float64(r.written) / float64(r.rate) * float64(time.Second))
+	if elapsed := time.Now().Sub(r.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// writerSink adapts a writer to a SnapshotSink, to persist parts of the
+// state outside of Raft
+type writerSink struct {
+	io.Writer
+}
+
+func (w *writerSink) ID() string    { return "" }
+func (w *writerSink) Cancel() error { return nil }
+func (w *writerSink) Close() error  { return nil }
+
+// SnapshotMirror is implemented by destinations that receive a copy of
+// each snapshot as it is persisted, such as an uploader for off-site
+// backups. The copy is written in the same pass as the snapshot, so it
+// takes no extra iteration of the state.
+type SnapshotMirror interface {
+	// Create starts the copy of a snapshot of the state as of the
+	// given index
+	Create(index uint64) (SnapshotMirrorSink, error)
+}
+
+// SnapshotMirrorSink receives the copy of a single snapshot. It is closed
+// once the snapshot is completely written, or cancelled if persisting the
+// snapshot fails.
+type SnapshotMirrorSink interface {
+	io.WriteCloser
+	Cancel() error
+}
+
+// mirroredSink wraps a SnapshotSink to tee the snapshot written to a
+// mirror. The mirror is best effort: if it fails, it is cancelled and the
+// snapshot is persisted without it, so a broken backup target does not
+// stop Raft from compacting its log.
+type mirroredSink struct {
+	raft.SnapshotSink
+	mirror SnapshotMirrorSink
+	logger StateLogger
+}
+
+// newMirroredSink returns a sink that copies the writes to the given sink
+// to the mirror
+func newMirroredSink(sink raft.SnapshotSink, mirror SnapshotMirrorSink, logger StateLogger) *mirroredSink {
+	return &mirroredSink{
+		SnapshotSink: sink,
+		mirror:       mirror,
+		logger:       logger,
+	}
+}
+
+func (m *mirroredSink) Write(p []byte) (int, error) {
+	n, err := m.SnapshotSink.Write(p)
+	if m.mirror != nil && n > 0 {
+		if _, err := m.mirror.Write(p[:n]); err != nil {
+			m.fail(err)
+		}
+	}
+	return n, err
+}
+
+func (m *mirroredSink) Cancel() error {
+	if m.mirror != nil {
+		m.mirror.Cancel()
+		m.mirror = nil
+	}
+	return m.SnapshotSink.Cancel()
+}
+
+// finish is used to close the mirror once the snapshot is written. The
+// sink itself is closed by Raft.
+func (m *mirroredSink) finish() {
+	if m.mirror == nil {
+		return
+	}
+	if err := m.mirror.Close(); err != nil {
+		m.logger.Error("Failed to close snapshot mirror", logError(err))
+		metrics.IncrCounter([]string{"consul", "fsm", "persist", "mirror_failed"}, 1)
+	}
+	m.mirror = nil
+}
+
+// fail is used to give up on the mirror after an error
+func (m *mirroredSink) fail(err error) {
+	m.logger.Error("Snapshot mirror failed, persisting without it", logError(err))
+	metrics.IncrCounter([]string{"consul", "fsm", "persist", "mirror_failed"}, 1)
+	m.mirror.Cancel()
+	m.mirror = nil
+}
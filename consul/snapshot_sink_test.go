@@ -0,0 +1,100 @@
+package consul
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedSink(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	sink := newRateLimitedSink(&MockSink{buf, false}, 10*1024*1024)
+
+	// Writing 3MB at 10MB/s should take at least 300ms
+	start := time.Now()
+	chunk := make([]byte, snapshotCheckpointSize)
+	for i := 0; i < 3; i++ {
+		n, err := sink.Write(chunk)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if n != len(chunk) {
+			t.Fatalf("bad: %d", n)
+		}
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("too fast: %v", elapsed)
+	}
+	if buf.Len() != 3*snapshotCheckpointSize {
+		t.Fatalf("bad: %d", buf.Len())
+	}
+}
+
+type MockMirror struct {
+	sinks []*MockMirrorSink
+}
+
+func (m *MockMirror) Create(index uint64) (SnapshotMirrorSink, error) {
+	sink := &MockMirrorSink{Buffer: bytes.NewBuffer(nil), index: index}
+	m.sinks = append(m.sinks, sink)
+	return sink, nil
+}
+
+type MockMirrorSink struct {
+	*bytes.Buffer
+	index     uint64
+	fail      bool
+	closed    bool
+	cancelled bool
+}
+
+func (m *MockMirrorSink) Write(p []byte) (int, error) {
+	if m.fail {
+		return 0, errors.New("mirror failed")
+	}
+	return m.Buffer.Write(p)
+}
+
+func (m *MockMirrorSink) Close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *MockMirrorSink) Cancel() error {
+	m.cancelled = true
+	return nil
+}
+
+func TestMirroredSink(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	mirror := &MockMirrorSink{Buffer: bytes.NewBuffer(nil)}
+	sink := newMirroredSink(&MockSink{buf, false}, mirror, newStdStateLogger(os.Stderr, "consul.fsm"))
+
+	if _, err := sink.Write([]byte("foo")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mirror.String() != "foo" {
+		t.Fatalf("bad: %q", mirror.String())
+	}
+
+	// A failed mirror is cancelled, without failing the sink
+	mirror.fail = true
+	if _, err := sink.Write([]byte("bar")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !mirror.cancelled {
+		t.Fatalf("should be cancelled")
+	}
+	if _, err := sink.Write([]byte("baz")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if buf.String() != "foobarbaz" || mirror.String() != "foo" {
+		t.Fatalf("bad: %q %q", buf.String(), mirror.String())
+	}
+	sink.finish()
+	if mirror.closed {
+		t.Fatalf("should not be closed")
+	}
+}
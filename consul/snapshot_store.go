@@ -0,0 +1,301 @@
+package consul
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// sectionTmpSuffix is the suffix of a section file being written
+	sectionTmpSuffix = ".tmp"
+)
+
+// incrementalSnapshotStore wraps a SnapshotStore to persist incremental
+// snapshots. Each section written in full is retained in a file of its
+// own, named by the section and the index of its tables, and when a
+// snapshot is opened, its markers are replaced by the retained sections,
+// so Raft only ever reads complete snapshots. Only the latest version of
+// each section is retained, so older snapshots may not be resolvable.
+type incrementalSnapshotStore struct {
+	raft.SnapshotStore
+	dir    string
+	logger *log.Logger
+
+	// lock serializes resolving snapshots with replacing the sections
+	lock sync.Mutex
+}
+
+// newIncrementalSnapshotStore returns a store that retains the sections
+// of the snapshots written to the given store in a directory
+func newIncrementalSnapshotStore(store raft.SnapshotStore, dir string, logger *log.Logger) (*incrementalSnapshotStore, error) {
+	if err := ensurePath(dir, true); err != nil {
+		return nil, err
+	}
+	s := &incrementalSnapshotStore{
+		SnapshotStore: store,
+		dir:           dir,
+		logger:        logger,
+	}
+	return s, nil
+}
+
+// Create is used to start a new snapshot, which may be incremental
+func (s *incrementalSnapshotStore) Create(index, term uint64, peers []byte) (raft.SnapshotSink, error) {
+	sink, err := s.SnapshotStore.Create(index, term, peers)
+	if err != nil {
+		return nil, err
+	}
+	return &incrementalSink{SnapshotSink: sink, store: s}, nil
+}
+
+// Open is used to open a snapshot with its unchanged sections resolved.
+// The complete snapshot is written to a temporary file first, since its
+// size must be known to send it to another server.
+func (s *incrementalSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, r, err := s.SnapshotStore.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := ioutil.TempFile(s.dir, "resolved")
+	if err != nil {
+		return nil, nil, err
+	}
+	out := &tempFileReader{f}
+	size, err := s.resolve(r, f)
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		out.Close()
+		return nil, nil, fmt.Errorf("failed to resolve snapshot %s: %v", id, err)
+	}
+
+	resolved := *meta
+	resolved.Size = size
+	return &resolved, out, nil
+}
+
+// resolve is used to copy a snapshot, replacing each marker by the
+// retained section it refers to. The entries are decoded to find where
+// they end, and copied as they are read.
+func (s *incrementalSnapshotStore) resolve(r io.Reader, w io.Writer) (int64, error) {
+	out := &countingWriter{w: w}
+	header, dec, err := readSnapshotHeader(io.TeeReader(r, out))
+	if err != nil {
+		return 0, err
+	}
+	c, err := getSnapshotCodec(header.Encoding)
+	if err != nil {
+		return 0, err
+	}
+	markers := c.newDecoder(r)
+
+	msgType := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, msgType); err == io.EOF {
+			return out.n, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		if structs.MessageType(msgType[0]) != structs.SnapshotUnchangedType {
+			out.Write(msgType)
+			var entry interface{}
+			if err := dec.Decode(&entry); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		var marker structs.SnapshotUnchanged
+		if err := markers.Decode(&marker); err != nil {
+			return 0, err
+		}
+		f, err := os.Open(s.sectionPath(marker.Section, marker.Index))
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("section '%s' as of index %d is not retained", marker.Section, marker.Index)
+		} else if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(out, f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// sectionPath returns the path of the file retaining a section
+func (s *incrementalSnapshotStore) sectionPath(name string, index uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%d", name, index))
+}
+
+// retain is used to replace the retained sections by the ones written
+// with a snapshot, once it is closed
+func (s *incrementalSnapshotStore) retain(paths map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, path := range paths {
+		if err := os.Rename(path+sectionTmpSuffix, path); err != nil {
+			return err
+		}
+	}
+
+	// Only remove the previous versions once every section is in place,
+	// so a failure leaves the previous ones to resolve against
+	for name, path := range paths {
+		matches, err := filepath.Glob(filepath.Join(s.dir, name+"-*"))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if match != path && !strings.HasSuffix(match, sectionTmpSuffix) {
+				os.Remove(match)
+			}
+		}
+	}
+	return nil
+}
+
+// incrementalSink is the sink of a snapshot of an incrementalSnapshotStore.
+// It copies the sections written in full to temporary files, which
+// replace the retained sections once the snapshot is closed.
+type incrementalSink struct {
+	raft.SnapshotSink
+	store *incrementalSnapshotStore
+
+	// section is the file of the section being written, if any, and
+	// paths has the path of each section written by name
+	section *os.File
+	paths   map[string]string
+
+	onClose []func()
+}
+
+func (s *incrementalSink) Incremental() bool {
+	return true
+}
+
+func (s *incrementalSink) Section(name string, index uint64, unchanged bool) error {
+	if err := s.endSection(); err != nil {
+		return err
+	}
+	if unchanged {
+		return nil
+	}
+
+	path := s.store.sectionPath(name, index)
+	f, err := os.Create(path + sectionTmpSuffix)
+	if err != nil {
+		return err
+	}
+	if s.paths == nil {
+		s.paths = make(map[string]string)
+	}
+	s.section = f
+	s.paths[name] = path
+	return nil
+}
+
+func (s *incrementalSink) OnClose(fn func()) {
+	s.onClose = append(s.onClose, fn)
+}
+
+func (s *incrementalSink) Write(p []byte) (int, error) {
+	n, err := s.SnapshotSink.Write(p)
+	if s.section != nil && n > 0 && err == nil {
+		_, err = s.section.Write(p[:n])
+	}
+	return n, err
+}
+
+func (s *incrementalSink) Close() error {
+	if err := s.endSection(); err != nil {
+		s.discard()
+		s.SnapshotSink.Cancel()
+		return err
+	}
+	if err := s.SnapshotSink.Close(); err != nil {
+		s.discard()
+		return err
+	}
+
+	// The snapshot is complete, but if its sections cannot be retained,
+	// the next snapshot must not be based on it
+	if err := s.store.retain(s.paths); err != nil {
+		s.store.logger.Printf("[ERR] consul: failed to retain snapshot sections: %v", err)
+		s.discard()
+		return nil
+	}
+	for _, fn := range s.onClose {
+		fn()
+	}
+	return nil
+}
+
+func (s *incrementalSink) Cancel() error {
+	s.endSection()
+	s.discard()
+	return s.SnapshotSink.Cancel()
+}
+
+// endSection is used to sync and close the file of the section being
+// written, if any
+func (s *incrementalSink) endSection() error {
+	f := s.section
+	if f == nil {
+		return nil
+	}
+	s.section = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// discard is used to remove the files of the sections written that were
+// not retained
+func (s *incrementalSink) discard() {
+	for _, path := range s.paths {
+		os.Remove(path + sectionTmpSuffix)
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tempFileReader reads a temporary file, which is removed once closed
+type tempFileReader struct {
+	*os.File
+}
+
+func (t *tempFileReader) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
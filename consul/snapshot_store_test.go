@@ -0,0 +1,111 @@
+package consul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/raft"
+)
+
+func TestIncrementalSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store, err := newIncrementalSnapshotStore(files, filepath.Join(dir, "sections"),
+		log.New(os.Stderr, "", log.LstdFlags))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm, err := NewFSM(nil, dir, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+	for i := 0; i < 50; i++ {
+		fsm.state.EnsureNode(1, structs.Node{Node: fmt.Sprintf("node%d", i), Address: "127.0.0.1"})
+	}
+	fsm.state.KVSSet(2, &structs.DirEntry{Key: "/test", Value: []byte("foo")})
+
+	persist := func(index uint64) {
+		snap, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer snap.Release()
+		sink, err := store.Create(index, 1, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Persist a full snapshot, then one where only the KV store changed
+	persist(2)
+	fsm.state.KVSSet(3, &structs.DirEntry{Key: "/test", Value: []byte("bar")})
+	persist(3)
+
+	snaps, err := files.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snaps) != 2 || snaps[0].Index != 3 {
+		t.Fatalf("bad: %v", snaps)
+	}
+	if snaps[0].Size >= snaps[1].Size {
+		t.Fatalf("should be incremental: %d %d", snaps[0].Size, snaps[1].Size)
+	}
+
+	// Opening the snapshot resolves its unchanged sections
+	meta, r, err := store.Open(snaps[0].ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.Size <= snaps[0].Size {
+		t.Fatalf("bad: %d", meta.Size)
+	}
+	fsm2, err := NewFSM(nil, dir, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm2.Close()
+	if err := fsm2.Restore(r); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, found, _ := fsm2.state.GetNode("node0"); !found {
+		t.Fatalf("missing node")
+	}
+	_, d, err := fsm2.state.KVSGet("/test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || string(d.Value) != "bar" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// A snapshot whose sections are gone cannot be opened
+	if err := os.RemoveAll(filepath.Join(dir, "sections")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := store.Open(snaps[0].ID); err == nil || !strings.Contains(err.Error(), "not retained") {
+		t.Fatalf("err: %v", err)
+	}
+}
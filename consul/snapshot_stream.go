@@ -0,0 +1,268 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/consul/structs"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// snapshotDialTimeout is how long a follower waits to connect
+	// to the leader to stream a snapshot
+	snapshotDialTimeout = 10 * time.Second
+)
+
+var (
+	// errNoSnapshot is returned when Raft has not retained a snapshot
+	errNoSnapshot = errors.New("No snapshot available")
+)
+
+// latestSnapshot is used to open the most recent snapshot retained by
+// Raft. The snapshot must be closed by the caller.
+func (s *Server) latestSnapshot() (*raft.SnapshotMeta, io.ReadCloser, error) {
+	snaps, err := s.raftSnapshots.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, nil, errNoSnapshot
+	}
+	return s.raftSnapshots.Open(snaps[0].ID)
+}
+
+// handleSnapshotConn is used to stream the latest snapshot, or a snapshot
+// of a single table, to a follower. The follower sends a single request,
+// and the leader replies with the metadata of the snapshot followed by
+// its contents, then closes the connection.
+func (s *Server) handleSnapshotConn(conn net.Conn) {
+	defer conn.Close()
+	var args structs.SnapshotRequest
+	if err := codec.NewDecoder(conn, msgpackHandle).Decode(&args); err != nil {
+		s.logger.Printf("[ERR] consul.rpc: failed to decode snapshot request: %v", err)
+		return
+	}
+
+	enc := codec.NewEncoder(conn, msgpackHandle)
+	if args.Table != "" {
+		if err := s.streamTableSnapshot(&args, conn, enc); err != nil {
+			s.logger.Printf("[ERR] consul.rpc: failed to stream table snapshot: %v", err)
+		}
+		return
+	}
+	meta, snap, err := s.openSnapshotStream(&args)
+	if err != nil {
+		s.logger.Printf("[ERR] consul.rpc: failed to stream snapshot: %v", err)
+		enc.Encode(&structs.SnapshotResponse{Error: err.Error()})
+		return
+	}
+	defer snap.Close()
+	defer metrics.MeasureSince([]string{"consul", "rpc", "snapshot_stream"}, time.Now())
+
+	resp := structs.SnapshotResponse{
+		Index: meta.Index,
+		Term:  meta.Term,
+		Peers: meta.Peers,
+		Size:  meta.Size,
+	}
+	if err := enc.Encode(&resp); err != nil {
+		s.logger.Printf("[ERR] consul.rpc: failed to stream snapshot: %v", err)
+		return
+	}
+	if _, err := io.Copy(conn, snap); err != nil {
+		s.logger.Printf("[ERR] consul.rpc: failed to stream snapshot: %v", err)
+	}
+}
+
+// openSnapshotStream is used to verify a request to stream the latest
+// snapshot, and to open the snapshot
+func (s *Server) openSnapshotStream(args *structs.SnapshotRequest) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	if !s.IsLeader() {
+		return nil, nil, fmt.Errorf("Snapshots are only streamed by the leader")
+	}
+	if err := s.checkSnapshotACL(args.Token); err != nil {
+		return nil, nil, err
+	}
+	return s.latestSnapshot()
+}
+
+// checkSnapshotACL is used to check that a token can read snapshots.
+// A snapshot contains every ACL token, as do the snapshots of the ACL
+// table, so a management token is required.
+func (s *Server) checkSnapshotACL(token string) error {
+	acl, err := s.resolveToken(token)
+	if err != nil {
+		return err
+	}
+	if acl != nil && !acl.ACLList() {
+		return permissionDeniedErr
+	}
+	return nil
+}
+
+// streamTableSnapshot is used to stream a snapshot of a table of the
+// local state store, as it is read. Table snapshots are served by the
+// leader, or by any server if stale reads are allowed.
+func (s *Server) streamTableSnapshot(args *structs.SnapshotRequest, w io.Writer, enc *codec.Encoder) error {
+	snap, err := s.openTableSnapshot(args)
+	if err != nil {
+		enc.Encode(&structs.SnapshotResponse{Error: err.Error()})
+		return err
+	}
+	defer snap.Close()
+	defer metrics.MeasureSince([]string{"consul", "rpc", "table_snapshot_stream"}, time.Now())
+
+	if err := enc.Encode(&structs.SnapshotResponse{Index: snap.Index}); err != nil {
+		return err
+	}
+	return snap.WriteTo(w)
+}
+
+// openTableSnapshot is used to verify a request for a table snapshot,
+// and to take the snapshot
+func (s *Server) openTableSnapshot(args *structs.SnapshotRequest) (*tableSnapshot, error) {
+	if !args.AllowStale && !s.IsLeader() {
+		return nil, fmt.Errorf("Table snapshots are only streamed by the leader")
+	}
+	if err := s.checkSnapshotACL(args.Token); err != nil {
+		return nil, err
+	}
+	return s.fsm.TableSnapshot(args.Table)
+}
+
+// TableSnapshot is used to write a snapshot of a single table, such as
+// the ACLs or the KV store, for targeted backups and migrations. The
+// snapshot has the format of a full snapshot, so it can be given to a
+// partial restore. It is read from the local state store if this server
+// is the leader or stale reads are allowed, and streamed from the leader
+// otherwise. It returns the last index of the table.
+func (s *Server) TableSnapshot(args *structs.SnapshotRequest, w io.Writer) (uint64, error) {
+	if args.Table == "" {
+		return 0, fmt.Errorf("Must provide a table")
+	}
+	if args.AllowStale || s.IsLeader() {
+		snap, err := s.openTableSnapshot(args)
+		if err != nil {
+			return 0, err
+		}
+		defer snap.Close()
+		return snap.Index, snap.WriteTo(w)
+	}
+
+	resp, stream, err := s.dialLeaderSnapshot(args)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	if _, err := io.Copy(w, stream); err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
+
+// dialLeaderSnapshot is used by a follower to request the latest snapshot
+// of the leader, or a snapshot of a table. It returns the metadata of the
+// snapshot and a reader of its contents, which must be closed by the
+// caller. This bypasses the install snapshot mechanism of Raft, which only
+// sends a snapshot once a follower falls behind the logs retained by the
+// leader.
+func (s *Server) dialLeaderSnapshot(args *structs.SnapshotRequest) (*structs.SnapshotResponse, io.ReadCloser, error) {
+	if s.IsLeader() {
+		return nil, nil, fmt.Errorf("Cannot stream a snapshot from the leader to itself")
+	}
+
+	// Lookup the leader
+	leader := s.raft.Leader()
+	if leader == "" {
+		return nil, nil, structs.ErrNoLeader
+	}
+	s.localLock.RLock()
+	server := s.localConsuls[leader]
+	s.localLock.RUnlock()
+	if server == nil {
+		return nil, nil, structs.ErrNoLeader
+	}
+
+	conn, err := net.DialTimeout("tcp", server.Addr.String(), snapshotDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check for tls mode
+	if s.connPool.tlsWrap != nil {
+		// Switch the connection into TLS mode
+		if _, err := conn.Write([]byte{byte(rpcTLS)}); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+
+		// Wrap the connection in a TLS client
+		tlsConn, err := s.connPool.tlsWrap(s.config.Datacenter, conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	// Write the snapshot byte to set the mode, and the request
+	if _, err := conn.Write([]byte{byte(rpcSnapshot)}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := codec.NewEncoder(conn, msgpackHandle).Encode(args); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	var resp structs.SnapshotResponse
+	if err := codec.NewDecoder(conn, msgpackHandle).Decode(&resp); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, nil, errors.New(resp.Error)
+	}
+	return &resp, conn, nil
+}
+
+// seedSnapshot is used by a follower to add the latest snapshot of the
+// leader to its own snapshot store. Raft only restores snapshots when it
+// starts, so the snapshot takes effect once the server is restarted, and
+// the server then only needs the logs after the snapshot.
+func (s *Server) seedSnapshot(token string) (*structs.SnapshotResponse, error) {
+	args := structs.SnapshotRequest{
+		Datacenter:   s.config.Datacenter,
+		QueryOptions: structs.QueryOptions{Token: token},
+	}
+	resp, snap, err := s.dialLeaderSnapshot(&args)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	sink, err := s.raftSnapshots.Create(resp.Index, resp.Term, resp.Peers)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(sink, snap)
+	if err == nil && n != resp.Size {
+		err = fmt.Errorf("Snapshot truncated after %d of %d bytes", n, resp.Size)
+	}
+	if err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	if err := sink.Close(); err != nil {
+		return nil, err
+	}
+	s.logger.Printf("[INFO] consul: Seeded snapshot at index %d from the leader", resp.Index)
+	return resp, nil
+}
@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"fmt"
+)
+
+const (
+	// iteratorBuffer is the number of rows decoded ahead of the
+	// consumer of a StateIterator
+	iteratorBuffer = 128
+)
+
+// StateIterator is used to iterate over all the rows of a table. It is
+// backed by a read-only transaction, so it provides a stable view of the
+// table that is isolated from concurrent writes. Rows are streamed from
+// the table, so large tables can be iterated without loading them into
+// memory. The iterator must be closed to release the transaction.
+type StateIterator struct {
+	table  *MDBTable
+	tx     *MDBTxn
+	index  uint64
+	stream chan interface{}
+	stopCh chan struct{}
+	err    error
+}
+
+// SnapshotIterator is used to create an iterator over the rows of the
+// named table. This allows read-only consumers, like metrics exporters,
+// to walk the state without reaching into the underlying tables.
+func (s *StateStore) SnapshotIterator(table string) (*StateIterator, error) {
+	t := s.getTable(table)
+	if t == nil {
+		return nil, fmt.Errorf("Unknown table '%s'", table)
+	}
+
+	tx, err := t.StartTxn(true, nil)
+	if err != nil {
+		return nil, err
+	}
+	index, err := t.LastIndexTxn(tx)
+	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
+
+	iter := &StateIterator{
+		table:  t,
+		tx:     tx,
+		index:  index,
+		stream: make(chan interface{}, iteratorBuffer),
+		stopCh: make(chan struct{}),
+	}
+	go iter.run()
+	return iter, nil
+}
+
+// run is a long running routine that streams the rows of the table
+func (i *StateIterator) run() {
+	defer close(i.stream)
+
+	idx, key, err := i.table.getIndex("id", nil)
+	if err != nil {
+		i.err = err
+		return
+	}
+	i.err = idx.iterate(i.tx, key, func(encRowId, res []byte) (bool, bool) {
+		select {
+		case i.stream <- i.table.Decoder(res):
+			return false, false
+		case <-i.stopCh:
+			return false, true
+		}
+	})
+}
+
+// Index returns the last index of the table as of the iterator
+func (i *StateIterator) Index() uint64 {
+	return i.index
+}
+
+// Next returns the next row of the table, or nil once all
+// the rows have been returned
+func (i *StateIterator) Next() interface{} {
+	return <-i.stream
+}
+
+// Err returns any error encountered while iterating. It must only
+// be checked once Next has returned nil.
+func (i *StateIterator) Err() error {
+	return i.err
+}
+
+// Close is used to stop the iteration and release the transaction
+func (i *StateIterator) Close() {
+	select {
+	case <-i.stopCh:
+		return
+	default:
+	}
+	close(i.stopCh)
+
+	// Wait for the stream to finish before aborting
+	for _ = range i.stream {
+	}
+	i.tx.Abort()
+}
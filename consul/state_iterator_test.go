@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateIterator(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := store.SnapshotIterator("nope"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	for i := 0; i < 300; i++ {
+		node := structs.Node{Node: fmt.Sprintf("node%03d", i), Address: "127.0.0.1"}
+		if err := store.EnsureNode(uint64(i+1), node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	iter, err := store.SnapshotIterator(dbNodes)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer iter.Close()
+	if iter.Index() != 300 {
+		t.Fatalf("bad: %v", iter.Index())
+	}
+
+	// Writes after the iterator is created should not be visible
+	if err := store.EnsureNode(301, structs.Node{Node: "zzz", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	num := 0
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		node := raw.(*structs.Node)
+		if node.Node != fmt.Sprintf("node%03d", num) {
+			t.Fatalf("bad: %v", node)
+		}
+		num++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if num != 300 {
+		t.Fatalf("bad: %d", num)
+	}
+}
+
+func TestStateIterator_Close(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 300; i++ {
+		d := &structs.DirEntry{Key: fmt.Sprintf("/foo/%03d", i)}
+		if err := store.KVSSet(uint64(i+1), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Stop the iteration early
+	iter, err := store.SnapshotIterator(dbKVS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := iter.Next().(*structs.DirEntry); d.Key != "/foo/000" {
+		t.Fatalf("bad: %v", d)
+	}
+	iter.Close()
+	iter.Close()
+}
@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// Keys of the fields attached to the messages of the FSM and the state
+// store, for loggers that ship them to a log pipeline
+const (
+	LogFieldType     = "type"
+	LogFieldIndex    = "index"
+	LogFieldDuration = "duration"
+	LogFieldError    = "error"
+)
+
+// StateLogger is a leveled, structured logger used by the FSM and the
+// state store. The context of a message, such as the type and index of
+// the log entry being applied, is passed as fields instead of being
+// formatted into the message, so it can be queried once shipped.
+type StateLogger interface {
+	Debug(msg string, fields ...LogField)
+	Info(msg string, fields ...LogField)
+	Warn(msg string, fields ...LogField)
+	Error(msg string, fields ...LogField)
+}
+
+// LogField is a key and value attached to a log message
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func logField(key string, value interface{}) LogField {
+	return LogField{key, value}
+}
+
+func logType(t structs.MessageType) LogField {
+	return LogField{LogFieldType, t}
+}
+
+func logIndex(index uint64) LogField {
+	return LogField{LogFieldIndex, index}
+}
+
+func logDuration(d time.Duration) LogField {
+	return LogField{LogFieldDuration, d}
+}
+
+func logError(err error) LogField {
+	return LogField{LogFieldError, err}
+}
+
+// stdStateLogger is the default StateLogger, which writes the messages
+// in the format of the other Consul logs, with the fields appended as
+// key=value pairs
+type stdStateLogger struct {
+	logger *log.Logger
+	name   string
+}
+
+// newStdStateLogger returns a StateLogger writing to the given output,
+// with messages attributed to the named subsystem
+func newStdStateLogger(logOutput io.Writer, name string) StateLogger {
+	return &stdStateLogger{
+		logger: log.New(logOutput, "", log.LstdFlags),
+		name:   name,
+	}
+}
+
+func (l *stdStateLogger) Debug(msg string, fields ...LogField) {
+	l.output("DEBUG", msg, fields)
+}
+
+func (l *stdStateLogger) Info(msg string, fields ...LogField) {
+	l.output("INFO", msg, fields)
+}
+
+func (l *stdStateLogger) Warn(msg string, fields ...LogField) {
+	l.output("WARN", msg, fields)
+}
+
+func (l *stdStateLogger) Error(msg string, fields ...LogField) {
+	l.output("ERR", msg, fields)
+}
+
+func (l *stdStateLogger) output(level, msg string, fields []LogField) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%s] %s: %s", level, l.name, msg)
+	for _, f := range fields {
+		fmt.Fprintf(&buf, " %s=%v", f.Key, f.Value)
+	}
+	l.logger.Print(buf.String())
+}
@@ -0,0 +1,100 @@
+package consul
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// recordingLogger is used to capture the messages of a StateLogger
+type recordingLogger struct {
+	msgs   []string
+	fields [][]LogField
+}
+
+func (r *recordingLogger) record(msg string, fields []LogField) {
+	r.msgs = append(r.msgs, msg)
+	r.fields = append(r.fields, fields)
+}
+
+func (r *recordingLogger) Debug(msg string, fields ...LogField) { r.record(msg, fields) }
+func (r *recordingLogger) Info(msg string, fields ...LogField)  { r.record(msg, fields) }
+func (r *recordingLogger) Warn(msg string, fields ...LogField)  { r.record(msg, fields) }
+func (r *recordingLogger) Error(msg string, fields ...LogField) { r.record(msg, fields) }
+
+func TestStdStateLogger(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger := newStdStateLogger(buf, "consul.fsm")
+	logger.Error("Skipping corrupt log entry", logType(structs.KVSRequestType),
+		logIndex(10), logError(errors.New("bad entry")))
+
+	out := buf.String()
+	if !strings.Contains(out, "[ERR] consul.fsm: Skipping corrupt log entry type=2 index=10 error=bad entry") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestFSM_SetLogger(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(path)
+	fsm, err := NewFSM(nil, path, os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fsm.Close()
+
+	logger := &recordingLogger{}
+	fsm.SetLogger(logger)
+
+	// Apply an invalid operation
+	req := structs.KVSRequest{
+		Datacenter: "dc1",
+		Op:         "bogus",
+		DirEnt:     structs.DirEntry{Key: "/test"},
+	}
+	buf, err := structs.Encode(structs.KVSRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := fsm.Apply(makeLog(buf)).(error); !ok {
+		t.Fatalf("expected error")
+	}
+	if len(logger.msgs) != 1 || logger.msgs[0] != "Invalid KVS operation" {
+		t.Fatalf("bad: %v", logger.msgs)
+	}
+
+	var index uint64
+	for _, f := range logger.fields[0] {
+		if f.Key == LogFieldIndex {
+			index = f.Value.(uint64)
+		}
+	}
+	if index != 1 {
+		t.Fatalf("bad: %v", logger.fields[0])
+	}
+
+	// The logger survives a restore
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := &MockSink{bytes.NewBuffer(nil), false}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.Restore(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fsm.State().logger != logger {
+		t.Fatalf("logger not retained")
+	}
+}
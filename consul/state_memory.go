@@ -0,0 +1,71 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// rowIDSize is the size of an encoded row ID, which is stored as the
+	// key of every row and as the value of every index entry
+	rowIDSize = 8
+)
+
+// MemoryStats is used to estimate the bytes retained by each table of
+// the state store. The value bytes are the encoded rows, while the index
+// bytes are the keys of the row and of every index entry pointing at it.
+// Deleted keys are retained by the tombstones table until they are
+// reaped, so a KV store bloated by deletes shows up there. The estimate
+// ignores the page overhead of MDB, and walks every row of every table
+// in a single read transaction, so it is expensive on a large store.
+func (s *StateStore) MemoryStats() (*structs.StateMemoryStats, error) {
+	tx, err := s.tables.StartTxn(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Abort()
+
+	index, err := s.tables.LastIndexTxn(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &structs.StateMemoryStats{Index: index}
+	for _, t := range s.tables {
+		stats, err := tableMemoryStats(t, tx)
+		if err != nil {
+			return nil, err
+		}
+		out.Tables = append(out.Tables, stats)
+		out.TotalBytes += stats.ValueBytes + stats.IndexBytes
+	}
+	return out, nil
+}
+
+// tableMemoryStats is used to estimate the bytes retained by a table
+func tableMemoryStats(t *MDBTable, tx *MDBTxn) (*structs.TableMemoryStats, error) {
+	stats := &structs.TableMemoryStats{Table: t.Name}
+	idx, key, err := t.getIndex("id", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyErr error
+	err = idx.iterate(tx, key, func(encRowId, res []byte) (bool, bool) {
+		keys, err := t.objIndexKeys(t.Decoder(res))
+		if err != nil {
+			keyErr = err
+			return false, true
+		}
+		stats.Rows++
+		stats.ValueBytes += uint64(len(res))
+		stats.IndexBytes += rowIDSize
+		for _, k := range keys {
+			stats.IndexBytes += uint64(len(k)) + rowIDSize
+		}
+		return false, false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, keyErr
+}
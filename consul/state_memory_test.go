@@ -0,0 +1,49 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestMemoryStats(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	d := &structs.DirEntry{Key: "/foo", Value: []byte("test")}
+	if err := store.KVSSet(10, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSDelete(11, "/foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stats, err := store.MemoryStats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Index != 11 {
+		t.Fatalf("bad: %v", stats.Index)
+	}
+
+	var total uint64
+	for _, table := range stats.Tables {
+		total += table.ValueBytes + table.IndexBytes
+		switch table.Table {
+		case dbKVS:
+			if table.Rows != 0 || table.ValueBytes != 0 || table.IndexBytes != 0 {
+				t.Fatalf("bad: %#v", table)
+			}
+		case dbTombstone:
+			if table.Rows != 1 || table.ValueBytes == 0 || table.IndexBytes == 0 {
+				t.Fatalf("bad: %#v", table)
+			}
+		}
+	}
+	if total != stats.TotalBytes {
+		t.Fatalf("bad: %v %v", total, stats.TotalBytes)
+	}
+}
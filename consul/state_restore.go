@@ -0,0 +1,178 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+const (
+	// restoreChunkSize is the number of entries a StateRestore inserts
+	// in each transaction. Chunking bounds the size of the transactions,
+	// while saving most of the cost of a transaction per entry.
+	restoreChunkSize = 1024
+)
+
+// StateRestore is used to restore the entries of a snapshot in chunked
+// transactions, instead of one transaction per entry. The last indexes
+// of the tables are only updated by Commit, along with a single watch
+// notification per table. Only one write transaction can be open at a
+// time, so Flush must be called before the state store is written to
+// by other means while a restore is in progress.
+type StateRestore struct {
+	store   *StateStore
+	tx      *MDBTxn
+	pending int
+
+	// indexes and kvsNamespaces are the highest indexes restored per
+	// table and per KV namespace
+	indexes       map[*MDBTable]uint64
+	kvsNamespaces map[string]uint64
+}
+
+// Restore is used to start a restore. Either Commit or Abort must be
+// called to release it.
+func (s *StateStore) Restore() *StateRestore {
+	return &StateRestore{
+		store:         s,
+		indexes:       make(map[*MDBTable]uint64),
+		kvsNamespaces: make(map[string]uint64),
+	}
+}
+
+// ACL is used to restore an ACL
+func (r *StateRestore) ACL(acl *structs.ACL) error {
+	tx, err := r.txn()
+	if err != nil {
+		return err
+	}
+	if err := r.store.aclTable.InsertTxn(tx, acl); err != nil {
+		return err
+	}
+	r.setIndex(r.store.aclTable, acl.ModifyIndex)
+	return r.inserted()
+}
+
+// KVS is used to restore a KV entry
+func (r *StateRestore) KVS(d *structs.DirEntry) error {
+	tx, err := r.txn()
+	if err != nil {
+		return err
+	}
+	if err := r.store.kvsTable.InsertTxn(tx, d); err != nil {
+		return err
+	}
+	r.setIndex(r.store.kvsTable, d.ModifyIndex)
+	r.setKVSNamespaceIndex(d.Namespace, d.ModifyIndex)
+	return r.inserted()
+}
+
+// Session is used to restore a session, along with its check mappings
+func (r *StateRestore) Session(session *structs.Session) error {
+	tx, err := r.txn()
+	if err != nil {
+		return err
+	}
+	if err := r.store.sessionTable.InsertTxn(tx, session); err != nil {
+		return err
+	}
+	for _, sCheck := range sessionCheckMappings(session) {
+		if err := r.store.sessionCheckTable.InsertTxn(tx, sCheck); err != nil {
+			return err
+		}
+	}
+	r.setIndex(r.store.sessionTable, session.CreateIndex)
+	return r.inserted()
+}
+
+// Tombstone is used to restore a tombstone. The index of the tombstone
+// table is left as is, as only the reaping of tombstones updates it.
+func (r *StateRestore) Tombstone(d *structs.DirEntry) error {
+	tx, err := r.txn()
+	if err != nil {
+		return err
+	}
+	if err := r.store.tombstoneTable.InsertTxn(tx, d); err != nil {
+		return err
+	}
+	r.setKVSNamespaceIndex(d.Namespace, d.ModifyIndex)
+	return r.inserted()
+}
+
+// Flush is used to commit the entries restored so far, without updating
+// the indexes of the tables
+func (r *StateRestore) Flush() error {
+	if r.tx == nil {
+		return nil
+	}
+	tx := r.tx
+	r.tx = nil
+	r.pending = 0
+	return tx.Commit()
+}
+
+// Commit is used to commit the remaining entries, and to update the
+// indexes of the tables with the highest indexes restored
+func (r *StateRestore) Commit() error {
+	tx, err := r.txn()
+	if err != nil {
+		return err
+	}
+	for table, index := range r.indexes {
+		if err := table.SetMaxLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		table := table
+		tx.Defer(func() { r.store.watch[table].Notify() })
+	}
+	for namespace, index := range r.kvsNamespaces {
+		if err := r.store.setKVSNamespaceIndexTxn(tx, namespace, index); err != nil {
+			return err
+		}
+	}
+	return r.Flush()
+}
+
+// Abort is used to discard the entries restored since the last flush
+func (r *StateRestore) Abort() {
+	if r.tx != nil {
+		r.tx.Abort()
+		r.tx = nil
+		r.pending = 0
+	}
+}
+
+// txn returns the open transaction, starting one if needed
+func (r *StateRestore) txn() (*MDBTxn, error) {
+	if r.tx == nil {
+		tx, err := r.store.tables.StartTxn(false)
+		if err != nil {
+			return nil, err
+		}
+		r.tx = tx
+	}
+	return r.tx, nil
+}
+
+// inserted is used to count an entry, and to commit the transaction
+// once it holds a full chunk
+func (r *StateRestore) inserted() error {
+	r.pending++
+	if r.pending < restoreChunkSize {
+		return nil
+	}
+	return r.Flush()
+}
+
+// setIndex is used to track the highest index restored in a table
+func (r *StateRestore) setIndex(table *MDBTable, index uint64) {
+	if index > r.indexes[table] {
+		r.indexes[table] = index
+	}
+}
+
+// setKVSNamespaceIndex is used to track the highest index restored in a
+// KV namespace. The default namespace uses the index of the tables.
+func (r *StateRestore) setKVSNamespaceIndex(namespace string, index uint64) {
+	if namespace != "" && index > r.kvsNamespaces[namespace] {
+		r.kvsNamespaces[namespace] = index
+	}
+}
@@ -0,0 +1,102 @@
+package consul
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateRestore(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	notify := make(chan struct{}, 1)
+	store.Watch(MDBTables{store.kvsTable}, notify)
+
+	restore := store.Restore()
+	defer restore.Abort()
+
+	// Restore more entries than fit in a chunk
+	for i := 0; i < restoreChunkSize+10; i++ {
+		d := &structs.DirEntry{
+			Key:         fmt.Sprintf("/key/%d", i),
+			Value:       []byte("test"),
+			CreateIndex: uint64(i + 1),
+			ModifyIndex: uint64(i + 1),
+		}
+		if err := restore.KVS(d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	d := &structs.DirEntry{Namespace: "team", Key: "/ns", ModifyIndex: 2000}
+	if err := restore.KVS(d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tomb := &structs.DirEntry{Namespace: "team", Key: "/gone", ModifyIndex: 2500}
+	if err := restore.Tombstone(tomb); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	acl := &structs.ACL{ID: generateUUID(), Name: "User Token", CreateIndex: 5, ModifyIndex: 7}
+	if err := restore.ACL(acl); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo", CreateIndex: 9}
+	if err := restore.Session(session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Flushing commits the entries, but not the indexes
+	if err := restore.Flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, idx, ents, err := store.KVSList("/key/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 0 || len(ents) != restoreChunkSize+10 {
+		t.Fatalf("bad: %v %v", idx, len(ents))
+	}
+	select {
+	case <-notify:
+		t.Fatalf("should not notify")
+	default:
+	}
+
+	// Commit updates the indexes, and notifies the watchers
+	if err := restore.Commit(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("should notify")
+	}
+	idx, _, err = store.KVSGet("/key/0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 2000 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if idx, err := store.KVSNamespaceIndex("team"); err != nil || idx != 2500 {
+		t.Fatalf("bad: %v %v", idx, err)
+	}
+	idx, acls, err := store.ACLList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 7 || len(acls) != 1 || acls[0].ID != acl.ID {
+		t.Fatalf("bad: %v %v", idx, acls)
+	}
+	idx, sessions, err := store.SessionList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 9 || len(sessions) != 1 || sessions[0].ID != session.ID {
+		t.Fatalf("bad: %v %v", idx, sessions)
+	}
+}
@@ -1,33 +1,86 @@
 package consul
 
 import (
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"net"
 	"os"
+	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/armon/go-radix"
 	"github.com/armon/gomdb"
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/consul/structs"
 )
 
 const (
-	dbNodes                  = "nodes"
-	dbServices               = "services"
-	dbChecks                 = "checks"
-	dbKVS                    = "kvs"
-	dbTombstone              = "tombstones"
-	dbSessions               = "sessions"
-	dbSessionChecks          = "sessionChecks"
-	dbACLs                   = "acls"
-	dbMaxMapSize32bit uint64 = 128 * 1024 * 1024       // 128MB maximum size
-	dbMaxMapSize64bit uint64 = 32 * 1024 * 1024 * 1024 // 32GB maximum size
-	dbMaxReaders      uint   = 4096                    // 4K, default is 126
+	dbNodes                   = "nodes"
+	dbServices                = "services"
+	dbChecks                  = "checks"
+	dbKVS                     = "kvs"
+	dbTombstone               = "tombstones"
+	dbSessions                = "sessions"
+	dbSessionChecks           = "sessionChecks"
+	dbACLs                    = "acls"
+	dbCheckDefinitions        = "checkDefinitions"
+	dbChanges                 = "changes"
+	dbServiceConfigs          = "serviceConfigs"
+	dbIntentions              = "intentions"
+	dbNodeDrains              = "nodeDrains"
+	dbRegistrations           = "registrations"
+	dbNodeRegTimes            = "nodeRegistrations"
+	dbLockWaiters             = "lockWaiters"
+	dbCatalogEvents           = "catalogEvents"
+	dbPrefixTombstones        = "prefixTombstones"
+	dbCheckHeard              = "checkHeard"
+	dbClusterConfig           = "clusterConfig"
+	dbFeatures                = "features"
+	dbKVSNamespaces           = "kvsNamespaces"
+	dbConfigEntries           = "configEntries"
+	dbUserEvents              = "userEvents"
+	dbNodeSeen                = "nodeSeen"
+	dbACLUsage                = "aclUsage"
+	dbMaxMapSize32bit  uint64 = 128 * 1024 * 1024       // 128MB maximum size
+	dbMaxMapSize64bit  uint64 = 32 * 1024 * 1024 * 1024 // 32GB maximum size
+	dbMaxReaders       uint   = 4096                    // 4K, default is 126
+
+	// prefixTombstoneThreshold is the number of keys a tree delete must
+	// remove before a single prefix tombstone is created in place of a
+	// tombstone for each key
+	prefixTombstoneThreshold = 10000
+
+	// changeLogSize is the number of changes retained by the change
+	// log before the oldest entries are overwritten
+	changeLogSize = 8192
+
+	// catalogEventsSize is the number of catalog events retained
+	// before the oldest events are deleted
+	catalogEventsSize = 4096
+
+	// userEventsSize is the number of persisted user events retained
+	// before the oldest events are deleted
+	userEventsSize = 1024
+
+	// kvPatternShardThreshold is the number of KV pattern watches above
+	// which the watches are sharded by the literal prefix of the pattern
+	kvPatternShardThreshold = 128
+)
+
+var (
+	// errChangeLogTruncated is returned when the changes since a given
+	// index are no longer all retained by the change log
+	errChangeLogTruncated = errors.New("Change log truncated, snapshot required")
 )
 
 // kvMode is used internally to control which type of set
@@ -49,17 +102,35 @@ const (
 // implementation uses the Lightning Memory-Mapped Database (MDB).
 // This gives us Multi-Version Concurrency Control for "free"
 type StateStore struct {
-	logger            *log.Logger
+	logger            StateLogger
 	path              string
 	env               *mdb.Env
 	nodeTable         *MDBTable
 	serviceTable      *MDBTable
 	checkTable        *MDBTable
 	kvsTable          *MDBTable
+	kvsNamespaceTable *MDBTable
 	tombstoneTable    *MDBTable
 	sessionTable      *MDBTable
 	sessionCheckTable *MDBTable
 	aclTable          *MDBTable
+	checkDefTable     *MDBTable
+	changeTable       *MDBTable
+	serviceConfTable  *MDBTable
+	intentionTable    *MDBTable
+	nodeDrainTable    *MDBTable
+	registrationTable *MDBTable
+	nodeRegTable      *MDBTable
+	lockWaiterTable   *MDBTable
+	catalogEventTable *MDBTable
+	prefixTombTable   *MDBTable
+	checkHeardTable   *MDBTable
+	clusterConfTable  *MDBTable
+	featureTable      *MDBTable
+	configEntryTable  *MDBTable
+	userEventTable    *MDBTable
+	nodeSeenTable     *MDBTable
+	aclUsageTable     *MDBTable
 	tables            MDBTables
 	watch             map[*MDBTable]*NotifyGroup
 	queryTables       map[string]MDBTables
@@ -72,6 +143,25 @@ type StateStore struct {
 	kvWatch     *radix.Tree
 	kvWatchLock sync.Mutex
 
+	// kvPatternWatch is used to watch for KV changes on keys matching
+	// a glob pattern, like "services/*/config", which cannot be expressed
+	// as a single prefix. It maps the pattern to the notify group, and is
+	// protected by the kvWatchLock.
+	kvPatternWatch map[string]*NotifyGroup
+
+	// kvPatternShards indexes the pattern watches by the literal prefix
+	// of the pattern, mapping it to the patterns sharing that prefix. A
+	// write must otherwise check every pattern, so once there are more
+	// than kvPatternShardThreshold patterns, only the shards on the path
+	// of the written key are checked. It is nil until the threshold is
+	// crossed, and is protected by the kvWatchLock.
+	kvPatternShards *radix.Tree
+
+	// notifyWindow is used to coalesce bursts of writes so that the
+	// watchers of a table or KV prefix are fired at most once per
+	// window. It is protected by the kvWatchLock.
+	notifyWindow time.Duration
+
 	// lockDelay is used to mark certain locks as unacquirable.
 	// When a lock is forcefully released (failing health
 	// check, destroyed session, etc), it is subject to the LockDelay
@@ -88,9 +178,68 @@ type StateStore struct {
 	lockDelay     map[string]time.Time
 	lockDelayLock sync.RWMutex
 
+	// clock is the time of the request being applied, as carried by
+	// the Raft log. Lock delays expire relative to it instead of the
+	// local clock, so every server computes identical expirations and
+	// replaying old log entries does not resurrect expired lock delays.
+	// It is only used by the FSM, so it is not protected by a lock.
+	clock time.Time
+
+	// catalogEvent is the catalog event of the registration or
+	// deregistration being applied, if any. It is recorded in the txn of
+	// the change it describes, and only if the catalog actually changes.
+	// Like the clock, it is only used by the FSM.
+	catalogEvent *structs.CatalogEvent
+
 	// GC is when we create tombstones to track their time-to-live.
 	// The GC is consumed upstream to manage clearing of tombstones.
 	gc *TombstoneGC
+
+	// changeSeq is the sequence number of the next change log entry.
+	// The change log is a ring of changeLogSize slots, and changeFloor
+	// is the highest index of any change that has been overwritten.
+	// Only changes after the floor are guaranteed to be retained.
+	changeSeq   uint64
+	changeFloor uint64
+	changeLock  sync.Mutex
+
+	// changeBatch holds the changes recorded by the write txn in
+	// progress, which only advance the change log once it commits
+	changeBatch *changeBatch
+
+	// txns tracks the open transactions, so that a replaced store is
+	// only closed once the reads in progress against it complete
+	txns MDBTxnTracker
+
+	// catalogEventCount is the number of rows of the catalog events
+	// table, which is bounded to catalogEventsSize rows
+	catalogEventCount int
+	catalogEventLock  sync.Mutex
+
+	// userEventCount is the number of rows of the user events table,
+	// which is bounded to userEventsSize rows
+	userEventCount int
+	userEventLock  sync.Mutex
+
+	// sessionHandler, if set, is invoked once a session invalidation
+	// is committed
+	sessionHandler func(*structs.SessionInvalidation)
+
+	// checkStatusHandler, if set, is invoked once a change to the status
+	// of a check is committed
+	checkStatusHandler func(*structs.CheckStatusChange)
+
+	// serviceNodesCache and kvsCache cache the results of the hottest
+	// read queries, CheckServiceNodes and KVSGet
+	serviceNodesCache *queryCache
+	kvsCache          *queryCache
+
+	// abandonCh is closed once the store is abandoned, which happens
+	// when a snapshot restore replaces it with a fresh store. Watchers
+	// observe it so they are not left waiting on a store that will
+	// never change again.
+	abandonCh   chan struct{}
+	abandonLock sync.Mutex
 }
 
 // StateSnapshot is used to provide a point-in-time snapshot
@@ -110,6 +259,36 @@ type sessionCheck struct {
 	Session string
 }
 
+// kvsNamespace is used to track the last index that modified the keys
+// of a namespace, so each namespace can be watched on its own
+type kvsNamespace struct {
+	Namespace   string
+	ModifyIndex uint64
+}
+
+// changeLogEntry is used to store a change in a slot of the change log.
+// The sequence number orders changes made at the same index.
+type changeLogEntry struct {
+	Slot   string
+	Seq    uint64
+	Change structs.Change
+}
+
+// changeBatch tracks the changes recorded by a write txn. Writes are
+// serialized, so a batch of another txn was either committed or aborted.
+type changeBatch struct {
+	tx    *MDBTxn
+	seq   uint64
+	floor uint64
+}
+
+// changeLogBySeq is used to sort change log entries
+type changeLogBySeq []*changeLogEntry
+
+func (c changeLogBySeq) Len() int           { return len(c) }
+func (c changeLogBySeq) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c changeLogBySeq) Less(i, j int) bool { return c[i].Seq < c[j].Seq }
+
 // Close is used to abort the transaction and allow for cleanup
 func (s *StateSnapshot) Close() error {
 	s.tx.Abort()
@@ -136,13 +315,15 @@ func NewStateStorePath(gc *TombstoneGC, path string, logOutput io.Writer) (*Stat
 	}
 
 	s := &StateStore{
-		logger:    log.New(logOutput, "", log.LstdFlags),
-		path:      path,
-		env:       env,
-		watch:     make(map[*MDBTable]*NotifyGroup),
-		kvWatch:   radix.New(),
-		lockDelay: make(map[string]time.Time),
-		gc:        gc,
+		logger:         newStdStateLogger(logOutput, "consul.state"),
+		path:           path,
+		env:            env,
+		watch:          make(map[*MDBTable]*NotifyGroup),
+		kvWatch:        radix.New(),
+		kvPatternWatch: make(map[string]*NotifyGroup),
+		lockDelay:      make(map[string]time.Time),
+		gc:             gc,
+		abandonCh:      make(chan struct{}),
 	}
 
 	// Ensure we can initialize
@@ -151,9 +332,45 @@ func NewStateStorePath(gc *TombstoneGC, path string, logOutput io.Writer) (*Stat
 		os.RemoveAll(path)
 		return nil, err
 	}
+
+	// Setup the query caches, which are flushed by watches on the
+	// tables of the queries
+	s.serviceNodesCache = newQueryCache(func(ch chan struct{}) {
+		s.Watch(s.queryTables["CheckServiceNodes"], ch)
+	})
+	s.kvsCache = newQueryCache(func(ch chan struct{}) {
+		s.WatchKV("", ch)
+	})
 	return s, nil
 }
 
+// getTable returns the table with the given name, or nil
+func (s *StateStore) getTable(name string) *MDBTable {
+	for _, table := range s.tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// Abandon is used to signal that the store has been replaced, waking
+// any watchers waiting on it. It is safe to call more than once.
+func (s *StateStore) Abandon() {
+	s.abandonLock.Lock()
+	defer s.abandonLock.Unlock()
+	select {
+	case <-s.abandonCh:
+	default:
+		close(s.abandonCh)
+	}
+}
+
+// AbandonCh returns a channel that is closed once the store is abandoned
+func (s *StateStore) AbandonCh() <-chan struct{} {
+	return s.abandonCh
+}
+
 // Close is used to safely shutdown the state store
 func (s *StateStore) Close() error {
 	s.env.Close()
@@ -161,40 +378,15 @@ func (s *StateStore) Close() error {
 	return nil
 }
 
+// CloseWhenIdle is used to close a store that was replaced, once the
+// transactions in progress against it complete. It does not wait for
+// them, and transactions started after the close fail.
+func (s *StateStore) CloseWhenIdle() {
+	s.txns.CloseWhenIdle(func() { s.Close() })
+}
+
 // initialize is used to setup the store for use
 func (s *StateStore) initialize() error {
-	// Setup the Env first
-	if err := s.env.SetMaxDBs(mdb.DBI(32)); err != nil {
-		return err
-	}
-
-	// Set the maximum db size based on 32/64bit. Since we are
-	// doing an mmap underneath, we need to limit our use of virtual
-	// address space on 32bit, but don't have to care on 64bit.
-	dbSize := dbMaxMapSize32bit
-	if runtime.GOARCH == "amd64" {
-		dbSize = dbMaxMapSize64bit
-	}
-
-	// Increase the maximum map size
-	if err := s.env.SetMapSize(dbSize); err != nil {
-		return err
-	}
-
-	// Increase the maximum number of concurrent readers
-	// TODO: Block transactions if we could exceed dbMaxReaders
-	if err := s.env.SetMaxReaders(dbMaxReaders); err != nil {
-		return err
-	}
-
-	// Optimize our flags for speed over safety, since the Raft log + snapshots
-	// are durable. We treat this as an ephemeral in-memory DB, since we nuke
-	// the data anyways.
-	var flags uint = mdb.NOMETASYNC | mdb.NOSYNC | mdb.NOTLS
-	if err := s.env.Open(s.path, flags, 0755); err != nil {
-		return err
-	}
-
 	// Tables use a generic struct encoder
 	encoder := func(obj interface{}) []byte {
 		buf, err := structs.Encode(255, obj)
@@ -213,6 +405,13 @@ func (s *StateStore) initialize() error {
 				Fields:          []string{"Node"},
 				CaseInsensitive: true,
 			},
+			// Nodes registered without an ID share the blank ID,
+			// so uniqueness is enforced by ensureNodeTxn instead
+			"node_id": &MDBIndex{
+				AllowBlank:      true,
+				Fields:          []string{"NodeID"},
+				CaseInsensitive: true,
+			},
 		},
 		Decoder: func(buf []byte) interface{} {
 			out := new(structs.Node)
@@ -223,16 +422,24 @@ func (s *StateStore) initialize() error {
 		},
 	}
 
+	// The namespace is the last field of the indexes of the services and
+	// checks, so the rows of a node can still be found by a prefix
 	s.serviceTable = &MDBTable{
 		Name: dbServices,
 		Indexes: map[string]*MDBIndex{
 			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Node", "ServiceID"},
+				Unique:      true,
+				Fields:      []string{"Node", "ServiceID", "Namespace"},
+				BlankFields: []string{"Namespace"},
 			},
 			"service": &MDBIndex{
 				AllowBlank:      true,
-				Fields:          []string{"ServiceName"},
+				Fields:          []string{"ServiceName", "Namespace"},
+				CaseInsensitive: true,
+			},
+			"version": &MDBIndex{
+				AllowBlank:      true,
+				Fields:          []string{"ServiceName", "ServiceVersion", "Namespace"},
 				CaseInsensitive: true,
 			},
 		},
@@ -249,19 +456,25 @@ func (s *StateStore) initialize() error {
 		Name: dbChecks,
 		Indexes: map[string]*MDBIndex{
 			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Node", "CheckID"},
+				Unique:      true,
+				Fields:      []string{"Node", "CheckID", "Namespace"},
+				BlankFields: []string{"Namespace"},
 			},
 			"status": &MDBIndex{
-				Fields: []string{"Status"},
+				Fields:      []string{"Status", "Namespace"},
+				BlankFields: []string{"Namespace"},
+			},
+			"status_service": &MDBIndex{
+				AllowBlank: true,
+				Fields:     []string{"Status", "ServiceName", "Namespace"},
 			},
 			"service": &MDBIndex{
 				AllowBlank: true,
-				Fields:     []string{"ServiceName"},
+				Fields:     []string{"ServiceName", "Namespace"},
 			},
 			"node": &MDBIndex{
 				AllowBlank: true,
-				Fields:     []string{"Node", "ServiceID"},
+				Fields:     []string{"Node", "ServiceID", "Namespace"},
 			},
 		},
 		Decoder: func(buf []byte) interface{} {
@@ -277,19 +490,30 @@ func (s *StateStore) initialize() error {
 		Name: dbKVS,
 		Indexes: map[string]*MDBIndex{
 			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Key"},
+				Unique:      true,
+				Fields:      []string{"Namespace", "Key"},
+				BlankFields: []string{"Namespace"},
 			},
 			"id_prefix": &MDBIndex{
 				Virtual:   true,
 				RealIndex: "id",
-				Fields:    []string{"Key"},
+				Fields:    []string{"Namespace", "Key"},
 				IdxFunc:   DefaultIndexPrefixFunc,
 			},
 			"session": &MDBIndex{
 				AllowBlank: true,
 				Fields:     []string{"Session"},
 			},
+			"flags": &MDBIndex{
+				Fields:      []string{"Namespace", "Flags", "Key"},
+				BlankFields: []string{"Namespace"},
+			},
+			"flags_prefix": &MDBIndex{
+				Virtual:   true,
+				RealIndex: "flags",
+				Fields:    []string{"Namespace", "Flags", "Key"},
+				IdxFunc:   DefaultIndexPrefixFunc,
+			},
 		},
 		Decoder: func(buf []byte) interface{} {
 			out := new(structs.DirEntry)
@@ -300,17 +524,35 @@ func (s *StateStore) initialize() error {
 		},
 	}
 
+	s.kvsNamespaceTable = &MDBTable{
+		Name: dbKVSNamespaces,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Namespace"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(kvsNamespace)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
 	s.tombstoneTable = &MDBTable{
 		Name: dbTombstone,
 		Indexes: map[string]*MDBIndex{
 			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Key"},
+				Unique:      true,
+				Fields:      []string{"Namespace", "Key"},
+				BlankFields: []string{"Namespace"},
 			},
 			"id_prefix": &MDBIndex{
 				Virtual:   true,
 				RealIndex: "id",
-				Fields:    []string{"Key"},
+				Fields:    []string{"Namespace", "Key"},
 				IdxFunc:   DefaultIndexPrefixFunc,
 			},
 		},
@@ -351,6 +593,11 @@ func (s *StateStore) initialize() error {
 				Unique: true,
 				Fields: []string{"Node", "CheckID", "Session"},
 			},
+			// session maps a session back to its checks, so they are
+			// removed by index lookup when it is invalidated
+			"session": &MDBIndex{
+				Fields: []string{"Session"},
+			},
 		},
 		Decoder: func(buf []byte) interface{} {
 			out := new(sessionCheck)
@@ -378,1674 +625,6663 @@ func (s *StateStore) initialize() error {
 		},
 	}
 
-	// Store the set of tables
-	s.tables = []*MDBTable{s.nodeTable, s.serviceTable, s.checkTable,
-		s.kvsTable, s.tombstoneTable, s.sessionTable, s.sessionCheckTable,
-		s.aclTable}
-	for _, table := range s.tables {
-		table.Env = s.env
-		table.Encoder = encoder
-		if err := table.Init(); err != nil {
-			return err
-		}
-
-		// Setup a notification group per table
-		s.watch[table] = &NotifyGroup{}
+	s.checkDefTable = &MDBTable{
+		Name: dbCheckDefinitions,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Node", "CheckID"},
+			},
+			"node": &MDBIndex{
+				AllowBlank: true,
+				Fields:     []string{"Node", "ServiceID"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.CheckDefinition)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
 	}
 
-	// Setup the query tables
-	s.queryTables = map[string]MDBTables{
-		"Nodes":             MDBTables{s.nodeTable},
-		"Services":          MDBTables{s.serviceTable},
-		"ServiceNodes":      MDBTables{s.nodeTable, s.serviceTable},
-		"NodeServices":      MDBTables{s.nodeTable, s.serviceTable},
-		"ChecksInState":     MDBTables{s.checkTable},
-		"NodeChecks":        MDBTables{s.checkTable},
-		"ServiceChecks":     MDBTables{s.checkTable},
-		"CheckServiceNodes": MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
-		"NodeInfo":          MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
-		"NodeDump":          MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
-		"SessionGet":        MDBTables{s.sessionTable},
-		"SessionList":       MDBTables{s.sessionTable},
-		"NodeSessions":      MDBTables{s.sessionTable},
-		"ACLGet":            MDBTables{s.aclTable},
-		"ACLList":           MDBTables{s.aclTable},
+	s.changeTable = &MDBTable{
+		Name: dbChanges,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Slot"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(changeLogEntry)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
 	}
-	return nil
-}
 
-// Watch is used to subscribe a channel to a set of MDBTables
-func (s *StateStore) Watch(tables MDBTables, notify chan struct{}) {
-	for _, t := range tables {
-		s.watch[t].Wait(notify)
+	s.serviceConfTable = &MDBTable{
+		Name: dbServiceConfigs,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:          true,
+				Fields:          []string{"Service"},
+				CaseInsensitive: true,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ServiceConfig)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
 	}
-}
 
-// StopWatch is used to unsubscribe a channel to a set of MDBTables
-func (s *StateStore) StopWatch(tables MDBTables, notify chan struct{}) {
-	for _, t := range tables {
-		s.watch[t].Clear(notify)
+	s.intentionTable = &MDBTable{
+		Name: dbIntentions,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+			"destination": &MDBIndex{
+				Fields:          []string{"DestinationName"},
+				CaseInsensitive: true,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.Intention)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
 	}
-}
-
-// WatchKV is used to subscribe a channel to changes in KV data
-func (s *StateStore) WatchKV(prefix string, notify chan struct{}) {
-	s.kvWatchLock.Lock()
-	defer s.kvWatchLock.Unlock()
 
-	// Check for an existing notify group
-	if raw, ok := s.kvWatch.Get(prefix); ok {
-		grp := raw.(*NotifyGroup)
-		grp.Wait(notify)
-		return
+	s.nodeDrainTable = &MDBTable{
+		Name: dbNodeDrains,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:          true,
+				Fields:          []string{"Node"},
+				CaseInsensitive: true,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.NodeDrain)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
 	}
 
-	// Create new notify group
-	grp := &NotifyGroup{}
-	grp.Wait(notify)
-	s.kvWatch.Insert(prefix, grp)
-}
-
-// StopWatchKV is used to unsubscribe a channel from changes in KV data
-func (s *StateStore) StopWatchKV(prefix string, notify chan struct{}) {
-	s.kvWatchLock.Lock()
-	defer s.kvWatchLock.Unlock()
-
-	// Check for an existing notify group
-	if raw, ok := s.kvWatch.Get(prefix); ok {
-		grp := raw.(*NotifyGroup)
-		grp.Clear(notify)
+	s.registrationTable = &MDBTable{
+		Name: dbRegistrations,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Node", "ServiceID"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.RegistrationTime)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
 	}
-}
-
-// notifyKV is used to notify any KV listeners of a change
-// on a prefix
-func (s *StateStore) notifyKV(path string, prefix bool) {
-	s.kvWatchLock.Lock()
-	defer s.kvWatchLock.Unlock()
 
-	var toDelete []string
-	fn := func(s string, v interface{}) bool {
-		group := v.(*NotifyGroup)
-		group.Notify()
-		if s != "" {
-			toDelete = append(toDelete, s)
-		}
-		return false
+	// The registration times of nodes have no ServiceID, which the id
+	// index of the service registration times cannot allow
+	s.nodeRegTable = &MDBTable{
+		Name: dbNodeRegTimes,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Node"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.RegistrationTime)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
 	}
 
-	// Invoke any watcher on the path downward to the key.
-	s.kvWatch.WalkPath(path, fn)
-
-	// If the entire prefix may be affected (e.g. delete tree),
-	// invoke the entire prefix
-	if prefix {
-		s.kvWatch.WalkPrefix(path, fn)
-	}
+	s.lockWaiterTable = &MDBTable{
+		Name: dbLockWaiters,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Key", "Session"},
+			},
+			"session": &MDBIndex{
+				Fields: []string{"Session"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.LockWaiter)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.catalogEventTable = &MDBTable{
+		Name: dbCatalogEvents,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+			"node": &MDBIndex{
+				AllowBlank: true,
+				Fields:     []string{"Node"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.CatalogEvent)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.prefixTombTable = &MDBTable{
+		Name: dbPrefixTombstones,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Prefix"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.PrefixTombstone)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.checkHeardTable = &MDBTable{
+		Name: dbCheckHeard,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Node", "CheckID"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.CheckHeard)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.clusterConfTable = &MDBTable{
+		Name: dbClusterConfig,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ClusterConfig)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.featureTable = &MDBTable{
+		Name: dbFeatures,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"Name"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.Feature)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.configEntryTable = &MDBTable{
+		Name: dbConfigEntries,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:          true,
+				Fields:          []string{"Kind", "Name"},
+				CaseInsensitive: true,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ConfigEntry)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.userEventTable = &MDBTable{
+		Name: dbUserEvents,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+			"name": &MDBIndex{
+				Fields: []string{"Name"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.UserEvent)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.nodeSeenTable = &MDBTable{
+		Name: dbNodeSeen,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique:          true,
+				Fields:          []string{"Node"},
+				CaseInsensitive: true,
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.NodeSeen)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	s.aclUsageTable = &MDBTable{
+		Name: dbACLUsage,
+		Indexes: map[string]*MDBIndex{
+			"id": &MDBIndex{
+				Unique: true,
+				Fields: []string{"ID"},
+			},
+		},
+		Decoder: func(buf []byte) interface{} {
+			out := new(structs.ACLUsage)
+			if err := structs.Decode(buf, out); err != nil {
+				panic(err)
+			}
+			return out
+		},
+	}
+
+	// Store the set of tables
+	s.tables = []*MDBTable{s.nodeTable, s.serviceTable, s.checkTable,
+		s.kvsTable, s.tombstoneTable, s.sessionTable, s.sessionCheckTable,
+		s.aclTable, s.checkDefTable, s.changeTable, s.serviceConfTable,
+		s.intentionTable, s.nodeDrainTable, s.registrationTable, s.nodeRegTable,
+		s.lockWaiterTable, s.catalogEventTable, s.prefixTombTable,
+		s.checkHeardTable, s.clusterConfTable, s.featureTable,
+		s.kvsNamespaceTable, s.configEntryTable, s.userEventTable,
+		s.nodeSeenTable, s.aclUsageTable}
+
+	// Setup the Env, with a named DB for each table and index
+	if err := s.env.SetMaxDBs(mdb.DBI(s.tables.namedDBs())); err != nil {
+		return err
+	}
+
+	// Set the maximum db size based on 32/64bit. Since we are
+	// doing an mmap underneath, we need to limit our use of virtual
+	// address space on 32bit, but don't have to care on 64bit.
+	dbSize := dbMaxMapSize32bit
+	if runtime.GOARCH == "amd64" {
+		dbSize = dbMaxMapSize64bit
+	}
+
+	// Increase the maximum map size
+	if err := s.env.SetMapSize(dbSize); err != nil {
+		return err
+	}
+
+	// Increase the maximum number of concurrent readers
+	// TODO: Block transactions if we could exceed dbMaxReaders
+	if err := s.env.SetMaxReaders(dbMaxReaders); err != nil {
+		return err
+	}
+
+	// Optimize our flags for speed over safety, since the Raft log + snapshots
+	// are durable. We treat this as an ephemeral in-memory DB, since we nuke
+	// the data anyways.
+	var flags uint = mdb.NOMETASYNC | mdb.NOSYNC | mdb.NOTLS
+	if err := s.env.Open(s.path, flags, 0755); err != nil {
+		return err
+	}
+
+	for _, table := range s.tables {
+		table.Env = s.env
+		table.Txns = &s.txns
+		table.Encoder = encoder
+		if err := table.Init(); err != nil {
+			return err
+		}
+
+		// Setup a notification group per table
+		s.watch[table] = &NotifyGroup{}
+	}
+
+	// Setup the query tables
+	s.queryTables = map[string]MDBTables{
+		"Nodes":               MDBTables{s.nodeTable},
+		"Services":            MDBTables{s.serviceTable},
+		"ServicesSummary":     MDBTables{s.serviceTable},
+		"ServiceNodes":        MDBTables{s.nodeTable, s.serviceTable},
+		"NodesWithoutService": MDBTables{s.nodeTable, s.serviceTable},
+		"NodeServices":        MDBTables{s.nodeTable, s.serviceTable},
+		"ChecksInState":       MDBTables{s.checkTable},
+		"NodeChecks":          MDBTables{s.checkTable},
+		"ServiceChecks":       MDBTables{s.checkTable},
+		"CheckServiceNodes":   MDBTables{s.nodeTable, s.serviceTable, s.checkTable, s.serviceConfTable, s.nodeDrainTable},
+		"NodeInfo":            MDBTables{s.nodeTable, s.serviceTable, s.checkTable, s.registrationTable, s.nodeRegTable},
+		"NodeDump":            MDBTables{s.nodeTable, s.serviceTable, s.checkTable, s.registrationTable, s.nodeRegTable},
+		"SessionGet":          MDBTables{s.sessionTable},
+		"SessionList":         MDBTables{s.sessionTable},
+		"NodeSessions":        MDBTables{s.sessionTable},
+		"ACLGet":              MDBTables{s.aclTable},
+		"ACLList":             MDBTables{s.aclTable},
+		"CheckDefinitionGet":  MDBTables{s.checkDefTable},
+		"CheckDefinitionList": MDBTables{s.checkDefTable},
+		"ChangesSince":        MDBTables{s.changeTable},
+		"ServiceConfigGet":    MDBTables{s.serviceConfTable},
+		"ServiceConfigList":   MDBTables{s.serviceConfTable},
+		"IntentionGet":        MDBTables{s.intentionTable},
+		"IntentionList":       MDBTables{s.intentionTable},
+		"ClusterConfigGet":    MDBTables{s.clusterConfTable},
+		"FeatureList":         MDBTables{s.featureTable},
+		"IntentionMatch":      MDBTables{s.intentionTable},
+		"NodeDrains":          MDBTables{s.nodeDrainTable},
+		"KVSLockWaiters":      MDBTables{s.lockWaiterTable},
+		"CatalogEvents":       MDBTables{s.catalogEventTable},
+		"ConfigEntryGet":      MDBTables{s.configEntryTable},
+		"ConfigEntryList":     MDBTables{s.configEntryTable},
+		"UserEvents":          MDBTables{s.userEventTable},
+		"NodeLastSeen":        MDBTables{s.nodeSeenTable},
+	}
+	return nil
+}
+
+// Watch is used to subscribe a channel to a set of MDBTables
+func (s *StateStore) Watch(tables MDBTables, notify chan struct{}) {
+	for _, t := range tables {
+		s.watch[t].Wait(notify)
+	}
+}
+
+// StopWatch is used to unsubscribe a channel to a set of MDBTables
+func (s *StateStore) StopWatch(tables MDBTables, notify chan struct{}) {
+	for _, t := range tables {
+		s.watch[t].Clear(notify)
+	}
+}
+
+// SetNotifyWindow is used to coalesce the notifications of watchers, so
+// that a burst of writes fires them at most once per window. This greatly
+// reduces spurious wakeups of blocking queries during mass registrations.
+// A zero window disables coalescing.
+func (s *StateStore) SetNotifyWindow(window time.Duration) {
+	s.kvWatchLock.Lock()
+	defer s.kvWatchLock.Unlock()
+	s.notifyWindow = window
+
+	for _, grp := range s.watch {
+		grp.SetWindow(window)
+	}
+	s.kvWatch.Walk(func(k string, v interface{}) bool {
+		v.(*NotifyGroup).SetWindow(window)
+		return false
+	})
+	for _, grp := range s.kvPatternWatch {
+		grp.SetWindow(window)
+	}
+}
+
+// SetLogger is used to replace the default logger of the state store
+func (s *StateStore) SetLogger(logger StateLogger) {
+	s.logger = logger
+}
+
+// SetSessionHandler is used to set a handler that is invoked with the
+// locks released by each session invalidation, once it is committed
+func (s *StateStore) SetSessionHandler(fn func(*structs.SessionInvalidation)) {
+	s.sessionHandler = fn
+}
+
+// SetCheckStatusHandler is used to set a handler that is invoked with
+// each status transition of an existing check, once it is committed
+func (s *StateStore) SetCheckStatusHandler(fn func(*structs.CheckStatusChange)) {
+	s.checkStatusHandler = fn
+}
+
+// WatchKV is used to subscribe a channel to changes in KV data
+func (s *StateStore) WatchKV(prefix string, notify chan struct{}) {
+	s.kvWatchLock.Lock()
+	defer s.kvWatchLock.Unlock()
+
+	// Check for an existing notify group
+	if raw, ok := s.kvWatch.Get(prefix); ok {
+		grp := raw.(*NotifyGroup)
+		grp.Wait(notify)
+		return
+	}
+
+	// Create new notify group
+	grp := &NotifyGroup{}
+	grp.SetWindow(s.notifyWindow)
+	grp.Wait(notify)
+	s.kvWatch.Insert(prefix, grp)
+}
+
+// StopWatchKV is used to unsubscribe a channel from changes in KV data
+func (s *StateStore) StopWatchKV(prefix string, notify chan struct{}) {
+	s.kvWatchLock.Lock()
+	defer s.kvWatchLock.Unlock()
+
+	// Check for an existing notify group
+	if raw, ok := s.kvWatch.Get(prefix); ok {
+		grp := raw.(*NotifyGroup)
+		grp.Clear(notify)
+	}
+}
+
+// WatchKVPattern is used to subscribe a channel to changes in KV data
+// of keys matching a glob pattern. Patterns use the syntax of path.Match,
+// so a "*" matches any sequence of characters other than "/".
+func (s *StateStore) WatchKVPattern(pattern string, notify chan struct{}) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Invalid pattern '%s': %v", pattern, err)
+	}
+
+	s.kvWatchLock.Lock()
+	defer s.kvWatchLock.Unlock()
+
+	// Check for an existing notify group
+	grp, ok := s.kvPatternWatch[pattern]
+	if !ok {
+		grp = &NotifyGroup{}
+		grp.SetWindow(s.notifyWindow)
+		s.kvPatternWatch[pattern] = grp
+		s.shardKVPattern(pattern, grp)
+	}
+	grp.Wait(notify)
+	return nil
+}
+
+// shardKVPattern is used to add a new pattern watch to the shards, and to
+// switch to sharding once the threshold is crossed. It must be called with
+// the kvWatchLock held.
+func (s *StateStore) shardKVPattern(pattern string, grp *NotifyGroup) {
+	if s.kvPatternShards == nil {
+		if len(s.kvPatternWatch) <= kvPatternShardThreshold {
+			return
+		}
+		s.kvPatternShards = radix.New()
+		for p, g := range s.kvPatternWatch {
+			s.insertKVPatternShard(p, g)
+		}
+		s.logger.Warn("Too many KV pattern watches, sharding by prefix",
+			logField("threshold", kvPatternShardThreshold))
+		metrics.IncrCounter([]string{"consul", "state", "kvs", "pattern_sharded"}, 1)
+		return
+	}
+	s.insertKVPatternShard(pattern, grp)
+}
+
+// insertKVPatternShard is used to add a pattern watch to the shard of its
+// literal prefix
+func (s *StateStore) insertKVPatternShard(pattern string, grp *NotifyGroup) {
+	literal := patternLiteral(pattern)
+	if raw, ok := s.kvPatternShards.Get(literal); ok {
+		raw.(map[string]*NotifyGroup)[pattern] = grp
+		return
+	}
+	s.kvPatternShards.Insert(literal, map[string]*NotifyGroup{pattern: grp})
+}
+
+// StopWatchKVPattern is used to unsubscribe a channel from changes
+// in KV data matching a pattern. Unlike prefixes, patterns are rarely
+// shared between queries, so the group of a pattern is removed along
+// with its last channel instead of lingering until a matching write.
+func (s *StateStore) StopWatchKVPattern(pattern string, notify chan struct{}) {
+	s.kvWatchLock.Lock()
+	defer s.kvWatchLock.Unlock()
+
+	grp, ok := s.kvPatternWatch[pattern]
+	if !ok {
+		return
+	}
+	grp.Clear(notify)
+	if !grp.Empty() {
+		return
+	}
+	delete(s.kvPatternWatch, pattern)
+	if s.kvPatternShards == nil {
+		return
+	}
+	literal := patternLiteral(pattern)
+	if raw, ok := s.kvPatternShards.Get(literal); ok {
+		shard := raw.(map[string]*NotifyGroup)
+		delete(shard, pattern)
+		if len(shard) == 0 {
+			s.kvPatternShards.Delete(literal)
+		}
+	}
+}
+
+// patternMayMatch is used to check if a pattern may match a given key,
+// or any key under it if prefix is set. For a prefix, only the literal
+// part of the pattern before the first meta character is compared.
+func patternMayMatch(pattern, key string, prefix bool) bool {
+	if !prefix {
+		match, _ := path.Match(pattern, key)
+		return match
+	}
+	literal := patternLiteral(pattern)
+	return strings.HasPrefix(literal, key) || strings.HasPrefix(key, literal)
+}
+
+// patternLiteral returns the literal part of a pattern before the
+// first meta character. Every key matching the pattern has this prefix.
+func patternLiteral(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// notifyKV is used to notify any KV listeners of a change
+// on a prefix
+func (s *StateStore) notifyKV(path string, prefix bool) {
+	s.kvWatchLock.Lock()
+	defer s.kvWatchLock.Unlock()
+
+	var toDelete []string
+	fn := func(s string, v interface{}) bool {
+		group := v.(*NotifyGroup)
+		group.Notify()
+		if s != "" {
+			toDelete = append(toDelete, s)
+		}
+		return false
+	}
+
+	// Invoke any watcher on the path downward to the key.
+	s.kvWatch.WalkPath(path, fn)
+
+	// If the entire prefix may be affected (e.g. delete tree),
+	// invoke the entire prefix
+	if prefix {
+		s.kvWatch.WalkPrefix(path, fn)
+	}
+
+	// Delete the old watch groups
+	for i := len(toDelete) - 1; i >= 0; i-- {
+		s.kvWatch.Delete(toDelete[i])
+	}
+
+	// Invoke any pattern watchers that may match
+	if s.kvPatternShards == nil {
+		for pattern, group := range s.kvPatternWatch {
+			if patternMayMatch(pattern, path, prefix) {
+				group.Notify()
+				delete(s.kvPatternWatch, pattern)
+			}
+		}
+		return
+	}
+
+	// Only the shards with a literal prefix on the path to the key, or
+	// under the key for a prefix change, may match
+	var emptyShards []string
+	shardFn := func(literal string, v interface{}) bool {
+		shard := v.(map[string]*NotifyGroup)
+		for pattern, group := range shard {
+			if patternMayMatch(pattern, path, prefix) {
+				group.Notify()
+				delete(s.kvPatternWatch, pattern)
+				delete(shard, pattern)
+			}
+		}
+		if len(shard) == 0 {
+			emptyShards = append(emptyShards, literal)
+		}
+		return false
+	}
+	s.kvPatternShards.WalkPath(path, shardFn)
+	if prefix {
+		s.kvPatternShards.WalkPrefix(path, shardFn)
+	}
+	for _, literal := range emptyShards {
+		s.kvPatternShards.Delete(literal)
+	}
+}
+
+// QueryTables returns the Tables that are queried for a given query
+func (s *StateStore) QueryTables(q string) MDBTables {
+	return s.queryTables[q]
+}
+
+// EnsureRegistration is used to make sure a node, service, and check registration
+// is performed within a single transaction to avoid race conditions on state updates.
+func (s *StateStore) EnsureRegistration(index uint64, req *structs.RegisterRequest) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	// The services and checks are registered under the normalized name
+	req.Node, err = s.normalizeNodeTxn(tx, req.Node)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the node, keeping its metadata and ID unless replaced
+	node := structs.Node{
+		Node:    req.Node,
+		Address: req.Address,
+		Meta:    req.NodeMeta,
+		NodeID:  req.NodeID,
+	}
+	if node.Meta == nil || node.NodeID == "" {
+		res, err := s.nodeTable.GetTxn(tx, "id", req.Node)
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 {
+			existing := res[0].(*structs.Node)
+			if node.Meta == nil {
+				node.Meta = existing.Meta
+			}
+			if node.NodeID == "" {
+				node.NodeID = existing.NodeID
+			}
+		}
+	}
+
+	// Record the source of the registration on the service and on the
+	// checks. Checks of the service that do not name a namespace are in
+	// the namespace of the service.
+	if req.Service != nil {
+		req.Service.Source = req.Source
+	}
+	if req.Service != nil && req.Service.Namespace != "" {
+		for _, check := range append(structs.HealthChecks{req.Check}, req.Checks...) {
+			if check != nil && check.ServiceID == req.Service.ID && check.Namespace == "" {
+				check.Namespace = req.Service.Namespace
+			}
+		}
+	}
+	for _, check := range append(structs.HealthChecks{req.Check}, req.Checks...) {
+		if check != nil {
+			check.Source = req.Source
+		}
+	}
+
+	// Agents periodically sync registrations that are already in place,
+	// which are not recorded as catalog events
+	if s.catalogEvent != nil {
+		changed, err := s.registrationChangedTxn(tx, req, &node)
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err := s.catalogEventTxn(index, tx, req.Node); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.ensureNodeTxn(index, node, tx); err != nil {
+		return err
+	}
+
+	// Ensure the service if provided
+	if req.Service != nil {
+		if err := s.ensureServiceTxn(index, req.Node, req.Service, tx); err != nil {
+			return err
+		}
+	}
+
+	// Ensure the check(s), if provided
+	if req.Check != nil {
+		if err := s.checkGraceTxn(tx, req.Check, req.CheckGrace); err != nil {
+			return err
+		}
+		if err := s.ensureCheckTxn(index, req.Check, tx); err != nil {
+			return err
+		}
+	}
+	for _, check := range req.Checks {
+		if err := s.ensureCheckTxn(index, check, tx); err != nil {
+			return err
+		}
+	}
+
+	// Commit as one unit
+	return tx.Commit()
+}
+
+// registrationChangedTxn checks if a registration changes the catalog,
+// given the node it registers. Indexes and the heard times of the checks
+// are not part of the comparison.
+func (s *StateStore) registrationChangedTxn(tx *MDBTxn, req *structs.RegisterRequest, node *structs.Node) (bool, error) {
+	res, err := s.nodeTable.GetTxn(tx, "id", node.Node)
+	if err != nil {
+		return false, err
+	}
+	if len(res) == 0 {
+		return true, nil
+	}
+	exist := res[0].(*structs.Node)
+	if exist.Address != node.Address || exist.NodeID != node.NodeID || !metaEqual(exist.Meta, node.Meta) {
+		return true, nil
+	}
+
+	if ns := req.Service; ns != nil {
+		res, err := s.serviceTable.GetTxn(tx, "id", node.Node, ns.ID, ns.Namespace)
+		if err != nil {
+			return false, err
+		}
+		if len(res) == 0 || !serviceEqual(res[0].(*structs.ServiceNode), ns) {
+			return true, nil
+		}
+	}
+
+	for _, check := range append(structs.HealthChecks{req.Check}, req.Checks...) {
+		if check == nil {
+			continue
+		}
+		res, err := s.checkTable.GetTxn(tx, "id", node.Node, check.CheckID, check.Namespace)
+		if err != nil {
+			return false, err
+		}
+		if len(res) == 0 {
+			return true, nil
+		}
+
+		// Compare the check as ensureCheckTxn would store it
+		exist := res[0].(*structs.HealthCheck)
+		c := *check
+		c.Node = exist.Node
+		c.ServiceName = exist.ServiceName
+		if c.Status == "" {
+			c.Status = structs.HealthCritical
+		}
+		if c.Source == "" {
+			c.Source = exist.Source
+		}
+		if !checkEqual(exist, &c) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// serviceEqual checks if a registration of a service matches its entry.
+// A registration without a source keeps that of the entry.
+func serviceEqual(a *structs.ServiceNode, b *structs.NodeService) bool {
+	if a.ServiceName != b.Service || a.ServiceAddress != b.Address ||
+		a.ServicePort != b.Port || a.ServiceVersion != b.Version ||
+		a.ServiceCanary != b.Canary || (b.Source != "" && a.ServiceSource != b.Source) {
+		return false
+	}
+	if len(a.ServiceTags) != len(b.Tags) || !metaEqual(a.ServiceAddresses, b.Addresses) {
+		return false
+	}
+	for i, tag := range a.ServiceTags {
+		if b.Tags[i] != tag {
+			return false
+		}
+	}
+	return true
+}
+
+// metaEqual checks if two maps of strings have the same entries
+func metaEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// EnsureNode is used to ensure a given node exists, with the provided address
+func (s *StateStore) EnsureNode(index uint64, node structs.Node) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+	if err := s.ensureNodeTxn(index, node, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ensureNodeTxn is used to ensure a given node exists, with the provided address
+// within a given txn
+func (s *StateStore) ensureNodeTxn(index uint64, node structs.Node, tx *MDBTxn) error {
+	var err error
+	node.Node, err = s.normalizeNodeTxn(tx, node.Node)
+	if err != nil {
+		return err
+	}
+
+	// Refuse an ID that is in use by another node
+	if node.NodeID != "" {
+		res, err := s.nodeTable.GetTxn(tx, "node_id", node.NodeID)
+		if err != nil {
+			return err
+		}
+		for _, r := range res {
+			existing := r.(*structs.Node)
+			if !strings.EqualFold(existing.Node, node.Node) {
+				return structs.NewError(structs.ErrCodeNodeIDConflict,
+					structs.ErrMsgNodeIDConflict, node.NodeID, existing.Node)
+			}
+		}
+	}
+
+	// The protection is kept, since it is only changed by NodeProtect
+	res, err := s.nodeTable.GetTxn(tx, "id", node.Node)
+	if err != nil {
+		return err
+	}
+	node.Protected = len(res) > 0 && res[0].(*structs.Node).Protected
+
+	if err := s.nodeTable.InsertTxn(tx, node); err != nil {
+		return err
+	}
+	if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(index, tx, dbNodes, node.Node, structs.ChangeSet); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.nodeTable].Notify() })
+	return s.ensureRegistrationTimeTxn(index, tx, node.Node, "")
+}
+
+// normalizeNodeTxn returns the name under which a node is stored. Node
+// lookups ignore case, so a node already registered keeps its name,
+// and the rows naming it with another case would otherwise be stored
+// apart from its own. New nodes are lowercased if the cluster config
+// asks for it.
+func (s *StateStore) normalizeNodeTxn(tx *MDBTxn, name string) (string, error) {
+	res, err := s.nodeTable.GetTxn(tx, "id", name)
+	if err != nil {
+		return "", err
+	}
+	if len(res) > 0 {
+		return res[0].(*structs.Node).Node, nil
+	}
+	conf, err := s.clusterConfigTxn(tx)
+	if err != nil {
+		return "", err
+	}
+	if conf.LowercaseNodeNames {
+		return strings.ToLower(name), nil
+	}
+	return name, nil
+}
+
+// MergeNodeNames is used to merge the rows stored under another case of
+// the name of a node, written before the names were normalized, into the
+// rows of the name it is registered under. If the cluster config asks for
+// lowercase names, the registered nodes are also renamed to lowercase.
+// The services and checks of another case are moved, unless a row already
+// exists under the registered name, and dropped if the node is no longer
+// registered. Sessions and their checks are moved along.
+func (s *StateStore) MergeNodeNames(index uint64) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	conf, err := s.clusterConfigTxn(tx)
+	if err != nil {
+		return err
+	}
+
+	// Find the name to keep for each node, renaming the nodes if needed
+	res, err := s.nodeTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string, len(res))
+	renamed := false
+	for _, raw := range res {
+		node := raw.(*structs.Node)
+		name := node.Node
+		if conf.LowercaseNodeNames && name != strings.ToLower(name) {
+			name = strings.ToLower(name)
+			updated := *node
+			updated.Node = name
+			if err := s.nodeTable.InsertTxn(tx, &updated); err != nil {
+				return err
+			}
+			if err := s.recordChangeTxn(index, tx, dbNodes, name, structs.ChangeSet); err != nil {
+				return err
+			}
+			renamed = true
+		}
+		names[strings.ToLower(node.Node)] = name
+	}
+	if renamed {
+		if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.nodeTable].Notify() })
+	}
+
+	// Move the services
+	res, err = s.serviceTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	moved := false
+	for _, raw := range res {
+		srv := raw.(*structs.ServiceNode)
+		name, ok := names[strings.ToLower(srv.Node)]
+		if ok && name == srv.Node {
+			continue
+		}
+		if _, err := s.serviceTable.DeleteTxn(tx, "id", srv.Node, srv.ServiceID, srv.Namespace); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbServices, srv.Node+"/"+srv.ServiceID, structs.ChangeDelete); err != nil {
+			return err
+		}
+		moved = true
+		if !ok {
+			continue
+		}
+		exist, err := s.serviceTable.GetTxn(tx, "id", name, srv.ServiceID, srv.Namespace)
+		if err != nil {
+			return err
+		}
+		if len(exist) > 0 {
+			continue
+		}
+		updated := *srv
+		updated.Node = name
+		if err := s.serviceTable.InsertTxn(tx, &updated); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbServices, name+"/"+srv.ServiceID, structs.ChangeSet); err != nil {
+			return err
+		}
+	}
+	if moved {
+		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+	}
+
+	// Move the checks
+	res, err = s.checkTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	moved = false
+	for _, raw := range res {
+		check := raw.(*structs.HealthCheck)
+		name, ok := names[strings.ToLower(check.Node)]
+		if ok && name == check.Node {
+			continue
+		}
+		if _, err := s.checkTable.DeleteTxn(tx, "id", check.Node, check.CheckID, check.Namespace); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbChecks, check.Node+"/"+check.CheckID, structs.ChangeDelete); err != nil {
+			return err
+		}
+		moved = true
+		if !ok {
+			continue
+		}
+		exist, err := s.checkTable.GetTxn(tx, "id", name, check.CheckID, check.Namespace)
+		if err != nil {
+			return err
+		}
+		if len(exist) > 0 {
+			continue
+		}
+		updated := *check
+		updated.Node = name
+		if err := s.checkTable.InsertTxn(tx, &updated); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbChecks, name+"/"+check.CheckID, structs.ChangeSet); err != nil {
+			return err
+		}
+	}
+	if moved {
+		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+	}
+
+	// Move the sessions of the registered nodes, and their checks
+	res, err = s.sessionTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	moved = false
+	for _, raw := range res {
+		session := raw.(*structs.Session)
+		name, ok := names[strings.ToLower(session.Node)]
+		if !ok || name == session.Node {
+			continue
+		}
+		updated := *session
+		updated.Node = name
+		if err := s.sessionTable.InsertTxn(tx, &updated); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbSessions, session.ID, structs.ChangeSet); err != nil {
+			return err
+		}
+		moved = true
+	}
+	if moved {
+		if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.sessionTable].Notify() })
+	}
+	res, err = s.sessionCheckTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	for _, raw := range res {
+		sc := raw.(*sessionCheck)
+		name, ok := names[strings.ToLower(sc.Node)]
+		if !ok || name == sc.Node {
+			continue
+		}
+		if _, err := s.sessionCheckTable.DeleteTxn(tx, "id", sc.Node, sc.CheckID, sc.Session); err != nil {
+			return err
+		}
+		updated := *sc
+		updated.Node = name
+		if err := s.sessionCheckTable.InsertTxn(tx, &updated); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ensureRegistrationTimeTxn is used to record the registration of a node,
+// or of a service if the ID is provided, within a given txn. The time of
+// the first registration is kept, while the last sync time is updated.
+func (s *StateStore) ensureRegistrationTimeTxn(index uint64, tx *MDBTxn, node, id string) error {
+	now := s.now().UnixNano()
+	rt := &structs.RegistrationTime{
+		ModifyIndex:  index,
+		Node:         node,
+		ServiceID:    id,
+		RegisteredAt: now,
+		LastSyncedAt: now,
+	}
+	table, parts := s.registrationTable, []string{node, id}
+	if id == "" {
+		table, parts = s.nodeRegTable, []string{node}
+	}
+	res, err := table.GetTxn(tx, "id", parts...)
+	if err != nil {
+		return err
+	}
+	if len(res) > 0 {
+		rt.RegisteredAt = res[0].(*structs.RegistrationTime).RegisteredAt
+	}
+
+	if err := table.InsertTxn(tx, rt); err != nil {
+		return err
+	}
+	if err := table.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(index, tx, dbRegistrations, node+"/"+id, structs.ChangeSet); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[table].Notify() })
+	return nil
+}
+
+// GetNode returns all the address of the known and if it was found
+func (s *StateStore) GetNode(name string) (uint64, bool, string) {
+	idx, res, err := s.nodeTable.Get("id", name)
+	if err != nil {
+		s.logger.Error("Error during node lookup", logError(err))
+		return 0, false, ""
+	}
+	if len(res) == 0 {
+		return idx, false, ""
+	}
+	return idx, true, res[0].(*structs.Node).Address
+}
+
+// NodeHeartbeat is used to record that the given nodes were seen alive.
+// Nodes that are not registered are ignored.
+func (s *StateStore) NodeHeartbeat(index uint64, nodes []string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	now := s.now().UnixNano()
+	updated := false
+	for _, node := range nodes {
+		res, err := s.nodeTable.GetTxn(tx, "id", node)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			continue
+		}
+		seen := &structs.NodeSeen{
+			ModifyIndex: index,
+			Node:        res[0].(*structs.Node).Node,
+			SeenAt:      now,
+		}
+		if err := s.nodeSeenTable.InsertTxn(tx, seen); err != nil {
+			return err
+		}
+		updated = true
+	}
+
+	if updated {
+		if err := s.nodeSeenTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.nodeSeenTable].Notify() })
+	}
+	return tx.Commit()
+}
+
+// NodeLastSeen is used to get when a node was last seen alive. It
+// returns nil if the node was never seen.
+func (s *StateStore) NodeLastSeen(node string) (uint64, *structs.NodeSeen, error) {
+	idx, res, err := s.nodeSeenTable.Get("id", node)
+	var seen *structs.NodeSeen
+	if len(res) > 0 {
+		seen = res[0].(*structs.NodeSeen)
+	}
+	return idx, seen, err
+}
+
+// GetNodeByID is used to look up the node registered with an ID
+func (s *StateStore) GetNodeByID(id string) (uint64, *structs.Node) {
+	if id == "" {
+		return 0, nil
+	}
+	idx, res, err := s.nodeTable.Get("node_id", id)
+	if err != nil {
+		s.logger.Error("Error during node lookup", logError(err))
+		return 0, nil
+	}
+	if len(res) == 0 {
+		return idx, nil
+	}
+	return idx, res[0].(*structs.Node)
+}
+
+// GetNodes returns all the known nodes, the slice alternates between
+// the node name and address
+func (s *StateStore) Nodes() (uint64, structs.Nodes) {
+	idx, res, err := s.nodeTable.Get("id")
+	if err != nil {
+		s.logger.Error("Error getting nodes", logError(err))
+	}
+	results := make([]structs.Node, len(res))
+	for i, r := range res {
+		results[i] = *r.(*structs.Node)
+	}
+	return idx, results
+}
+
+// EnsureService is used to ensure a given node exposes a service
+func (s *StateStore) EnsureService(index uint64, node string, ns *structs.NodeService) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+	if err := s.ensureServiceTxn(index, node, ns, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ensureServiceTxn is used to ensure a given node exposes a service in a transaction
+func (s *StateStore) ensureServiceTxn(index uint64, node string, ns *structs.NodeService, tx *MDBTxn) error {
+	// Ensure the node exists, and use its registered name
+	res, err := s.nodeTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return structs.ErrMissingNode
+	}
+	node = res[0].(*structs.Node).Node
+	if err := validateServiceAddresses(ns.Addresses); err != nil {
+		return err
+	}
+
+	// Create the entry
+	entry := structs.ServiceNode{
+		Node:             node,
+		ServiceID:        ns.ID,
+		ServiceName:      ns.Service,
+		ServiceTags:      ns.Tags,
+		ServiceAddress:   ns.Address,
+		ServicePort:      ns.Port,
+		ServiceVersion:   ns.Version,
+		ServiceCanary:    ns.Canary,
+		Namespace:        ns.Namespace,
+		ServiceAddresses: ns.Addresses,
+		ServiceSource:    ns.Source,
+	}
+
+	// A registration without a source keeps that of the existing entry
+	if entry.ServiceSource == "" {
+		res, err := s.serviceTable.GetTxn(tx, "id", node, ns.ID, ns.Namespace)
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 {
+			entry.ServiceSource = res[0].(*structs.ServiceNode).ServiceSource
+		}
+	}
+	entry.AggregatedStatus, err = s.serviceStatusTxn(tx, node, ns.ID, ns.Namespace)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the service entry is set
+	if err := s.serviceTable.InsertTxn(tx, &entry); err != nil {
+		return err
+	}
+	if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+
+	// The change log and the registration times are tracked by node and
+	// service ID, so only for the default namespace
+	if ns.Namespace != "" {
+		return nil
+	}
+	if err := s.recordChangeTxn(index, tx, dbServices, node+"/"+ns.ID, structs.ChangeSet); err != nil {
+		return err
+	}
+
+	// A service without an ID cannot be told apart from the node
+	if ns.ID == "" {
+		return nil
+	}
+	return s.ensureRegistrationTimeTxn(index, tx, node, ns.ID)
+}
+
+// validateServiceAddresses is used to check the additional addresses of
+// a service. Every address must be an IP, of the family of its tag when
+// the tag is a well-known one.
+func validateServiceAddresses(addrs map[string]string) error {
+	for tag, addr := range addrs {
+		if tag == "" {
+			return fmt.Errorf("Missing tag for service address '%s'", addr)
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("Invalid service address '%s' for tag '%s'", addr, tag)
+		}
+		switch tag {
+		case structs.AddressLANIPv4, structs.AddressWANIPv4:
+			if ip.To4() == nil {
+				return fmt.Errorf("Service address '%s' for tag '%s' must be IPv4", addr, tag)
+			}
+		case structs.AddressLANIPv6, structs.AddressWANIPv6:
+			if ip.To4() != nil {
+				return fmt.Errorf("Service address '%s' for tag '%s' must be IPv6", addr, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// NodeServices is used to return all the services of a given node
+func (s *StateStore) NodeServices(name string) (uint64, *structs.NodeServices) {
+	return s.NamespaceNodeServices("", name)
+}
+
+// NamespaceNodeServices is used to return the services of a given node
+// in a namespace
+func (s *StateStore) NamespaceNodeServices(namespace, name string) (uint64, *structs.NodeServices) {
+	tables := s.queryTables["NodeServices"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+	return s.parseNodeServices(tables, tx, name, namespace)
+}
+
+// parseNodeServices is used to get the services belonging to a
+// node in a namespace, using a given txn
+func (s *StateStore) parseNodeServices(tables MDBTables, tx *MDBTxn, name, namespace string) (uint64, *structs.NodeServices) {
+	ns := &structs.NodeServices{
+		Services: make(map[string]*structs.NodeService),
+	}
+
+	// Get the maximum index
+	index, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	// Get the node first
+	res, err := s.nodeTable.GetTxn(tx, "id", name)
+	if err != nil {
+		s.logger.Error("Failed to get node", logError(err))
+	}
+	if len(res) == 0 {
+		return index, nil
+	}
+
+	// Set the address
+	node := res[0].(*structs.Node)
+	ns.Node = *node
+
+	// Get the services
+	res, err = s.serviceTable.GetTxn(tx, "id", name)
+	if err != nil {
+		s.logger.Error("Failed to get node services", logField("node", name), logError(err))
+	}
+
+	// Add each service
+	for _, r := range namespaceFilter(res, namespace) {
+		service := r.(*structs.ServiceNode)
+		srv := &structs.NodeService{
+			ID:        service.ServiceID,
+			Service:   service.ServiceName,
+			Tags:      service.ServiceTags,
+			Address:   service.ServiceAddress,
+			Port:      service.ServicePort,
+			Version:   service.ServiceVersion,
+			Canary:    service.ServiceCanary,
+			Namespace: service.Namespace,
+			Addresses: service.ServiceAddresses,
+			Source:    service.ServiceSource,
+		}
+		ns.Services[srv.ID] = srv
+	}
+	return index, ns
+}
+
+// DeleteNodeService is used to delete a node service
+func (s *StateStore) DeleteNodeService(index uint64, node, id string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	if err := s.deleteNodeServiceTxn(index, tx, node, id, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteNamespaceService is like DeleteNodeService, but deletes a service
+// of the given namespace
+func (s *StateStore) DeleteNamespaceService(index uint64, namespace, node, id string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.deleteNodeServiceTxn(index, tx, node, id, namespace); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteService is used to delete all the instances of a service
+// across all the nodes. This is used to decommission a service in
+// a single operation.
+func (s *StateStore) DeleteService(index uint64, name string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	res, err := s.serviceTable.GetTxn(tx, "service", name, "")
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		srv := r.(*structs.ServiceNode)
+		if err := s.deleteNodeServiceTxn(index, tx, srv.Node, srv.ServiceID, ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteNodeServiceTxn is used to delete a node service within a txn
+func (s *StateStore) deleteNodeServiceTxn(index uint64, tx *MDBTxn, node, id, namespace string) error {
+	// The services are stored under the name the node is registered under
+	node, err := s.normalizeNodeTxn(tx, node)
+	if err != nil {
+		return err
+	}
+	if namespace != "" {
+		return s.deleteNamespaceServiceTxn(index, tx, node, id, namespace)
+	}
+	if n, err := s.serviceTable.DeleteTxn(tx, "id", node, id, ""); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbServices, node+"/"+id, structs.ChangeDelete); err != nil {
+			return err
+		}
+		if err := s.catalogEventTxn(index, tx, node); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+	}
+	if n, err := s.registrationTable.DeleteTxn(tx, "id", node, id); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.registrationTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbRegistrations, node+"/"+id, structs.ChangeDelete); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.registrationTable].Notify() })
+	}
+
+	// Invalidate any sessions using these checks
+	checks, err := s.checkTable.GetTxn(tx, "node", node, id, "")
+	if err != nil {
+		return err
+	}
+	for _, c := range checks {
+		check := c.(*structs.HealthCheck)
+		if err := s.invalidateCheck(index, tx, node, check.CheckID); err != nil {
+			return err
+		}
+	}
+
+	if n, err := s.checkTable.DeleteTxn(tx, "node", node, id, ""); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		for _, c := range checks {
+			check := c.(*structs.HealthCheck)
+			if err := s.recordChangeTxn(index, tx, dbChecks, node+"/"+check.CheckID, structs.ChangeDelete); err != nil {
+				return err
+			}
+			if _, err := s.checkHeardTable.DeleteTxn(tx, "id", node, check.CheckID); err != nil {
+				return err
+			}
+		}
+		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+	}
+
+	// Remove any server-executed check definitions for the service
+	defs, err := s.checkDefTable.GetTxn(tx, "node", node, id)
+	if err != nil {
+		return err
+	}
+	if n, err := s.checkDefTable.DeleteTxn(tx, "node", node, id); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.checkDefTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		for _, d := range defs {
+			def := d.(*structs.CheckDefinition)
+			if err := s.recordChangeTxn(index, tx, dbCheckDefinitions, node+"/"+def.CheckID, structs.ChangeDelete); err != nil {
+				return err
+			}
+		}
+		tx.Defer(func() { s.watch[s.checkDefTable].Notify() })
+	}
+	return nil
+}
+
+// deleteNamespaceServiceTxn is used to delete a node service of a
+// namespace, along with its checks, within a txn. Sessions, check
+// definitions and registration times are only tied to the services and
+// checks of the default namespace, so there is nothing else to remove.
+func (s *StateStore) deleteNamespaceServiceTxn(index uint64, tx *MDBTxn, node, id, namespace string) error {
+	if n, err := s.serviceTable.DeleteTxn(tx, "id", node, id, namespace); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+	}
+	if n, err := s.checkTable.DeleteTxn(tx, "node", node, id, namespace); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+	}
+	return nil
+}
+
+// DeleteNode is used to delete a node and all it's services. A protected
+// node is refused, use ForceDeleteNode to delete it anyways.
+func (s *StateStore) DeleteNode(index uint64, node string) error {
+	return s.deleteNode(index, node, false)
+}
+
+// ForceDeleteNode is like DeleteNode, but also deletes a protected node
+func (s *StateStore) ForceDeleteNode(index uint64, node string) error {
+	return s.deleteNode(index, node, true)
+}
+
+// deleteNode is used to delete a node and all it's services, refusing a
+// protected node unless forced
+func (s *StateStore) deleteNode(index uint64, node string, force bool) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	// The rows of the node are stored under the name it is registered under
+	node, err = s.normalizeNodeTxn(tx, node)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		res, err := s.nodeTable.GetTxn(tx, "id", node)
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 && res[0].(*structs.Node).Protected {
+			return structs.NewError(structs.ErrCodeNodeProtected,
+				structs.ErrMsgNodeProtected, node)
+		}
+	}
+
+	// Invalidate any sessions held by the node
+	if err := s.invalidateNode(index, tx, node); err != nil {
+		return err
+	}
+
+	if n, err := s.serviceTable.DeleteTxn(tx, "id", node); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbServices, node+"/", structs.ChangeDeleteTree); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+	}
+	if n, err := s.checkTable.DeleteTxn(tx, "id", node); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbChecks, node+"/", structs.ChangeDeleteTree); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+	}
+	if _, err := s.checkHeardTable.DeleteTxn(tx, "id", node); err != nil {
+		return err
+	}
+	if _, err := s.nodeSeenTable.DeleteTxn(tx, "id", node); err != nil {
+		return err
+	}
+	if n, err := s.checkDefTable.DeleteTxn(tx, "id", node); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.checkDefTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbCheckDefinitions, node+"/", structs.ChangeDeleteTree); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.checkDefTable].Notify() })
+	}
+	if n, err := s.nodeDrainTable.DeleteTxn(tx, "id", node); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.nodeDrainTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbNodeDrains, node, structs.ChangeDelete); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.nodeDrainTable].Notify() })
+	}
+	deletedTimes := false
+	for _, table := range []*MDBTable{s.registrationTable, s.nodeRegTable} {
+		if n, err := table.DeleteTxn(tx, "id", node); err != nil {
+			return err
+		} else if n > 0 {
+			if err := table.SetLastIndexTxn(tx, index); err != nil {
+				return err
+			}
+			table := table
+			tx.Defer(func() { s.watch[table].Notify() })
+			deletedTimes = true
+		}
+	}
+	if deletedTimes {
+		if err := s.recordChangeTxn(index, tx, dbRegistrations, node+"/", structs.ChangeDeleteTree); err != nil {
+			return err
+		}
+	}
+	if n, err := s.nodeTable.DeleteTxn(tx, "id", node); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbNodes, node, structs.ChangeDelete); err != nil {
+			return err
+		}
+		if err := s.catalogEventTxn(index, tx, node); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.nodeTable].Notify() })
+	}
+	return tx.Commit()
+}
+
+// Services is used to return all the services with a list of associated tags
+func (s *StateStore) Services() (uint64, map[string][]string) {
+	return s.NamespaceServices("")
+}
+
+// NamespaceServices is used to return the services of a namespace with a
+// list of associated tags
+func (s *StateStore) NamespaceServices(namespace string) (uint64, map[string][]string) {
+	services := make(map[string][]string)
+	idx, res, err := s.serviceTable.Get("id")
+	if err != nil {
+		s.logger.Error("Failed to get services", logError(err))
+		return idx, services
+	}
+	for _, r := range namespaceFilter(res, namespace) {
+		srv := r.(*structs.ServiceNode)
+		tags, ok := services[srv.ServiceName]
+		if !ok {
+			services[srv.ServiceName] = make([]string, 0)
+		}
+
+		for _, tag := range srv.ServiceTags {
+			if !strContains(tags, tag) {
+				tags = append(tags, tag)
+				services[srv.ServiceName] = tags
+			}
+		}
+	}
+	return idx, services
+}
+
+// ServicesSummary is used to return the number of instances, distinct
+// nodes and the union of tags of every service. This avoids the need
+// to call ServiceNodes for every service to build the same picture.
+func (s *StateStore) ServicesSummary() (uint64, structs.ServiceSummaries) {
+	tables := s.queryTables["ServicesSummary"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	summaries := make(structs.ServiceSummaries)
+	res, err := s.serviceTable.GetTxn(tx, "id")
+	if err != nil {
+		s.logger.Error("Failed to get services", logError(err))
+		return idx, summaries
+	}
+
+	nodes := make(map[string]map[string]struct{})
+	for _, r := range namespaceFilter(res, "") {
+		srv := r.(*structs.ServiceNode)
+		summary, ok := summaries[srv.ServiceName]
+		if !ok {
+			summary = &structs.ServiceSummary{Tags: make([]string, 0)}
+			summaries[srv.ServiceName] = summary
+			nodes[srv.ServiceName] = make(map[string]struct{})
+		}
+		summary.Instances++
+		nodes[srv.ServiceName][srv.Node] = struct{}{}
+
+		for _, tag := range srv.ServiceTags {
+			if !strContains(summary.Tags, tag) {
+				summary.Tags = append(summary.Tags, tag)
+			}
+		}
+	}
+	for name, summary := range summaries {
+		summary.Nodes = len(nodes[name])
+	}
+	return idx, summaries
+}
+
+// ServiceNodes returns the nodes associated with a given service. If any
+// node metadata is given, only the nodes with all of it are returned.
+func (s *StateStore) ServiceNodes(service string, nodeMeta map[string]string) (uint64, structs.ServiceNodes) {
+	return s.NamespaceServiceNodes("", service, nodeMeta)
+}
+
+// NamespaceServiceNodes is like ServiceNodes, but returns the nodes of a
+// service of the given namespace
+func (s *StateStore) NamespaceServiceNodes(namespace, service string, nodeMeta map[string]string) (uint64, structs.ServiceNodes) {
+	tables := s.queryTables["ServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "service", service, namespace)
+	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err, nodeMeta)
+}
+
+// NodesWithoutService returns the nodes that do not provide a given
+// service, such as to find the nodes missing a service every node is
+// expected to run
+func (s *StateStore) NodesWithoutService(service string) (uint64, structs.Nodes) {
+	tables := s.queryTables["NodesWithoutService"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "service", service, "")
+	if err != nil {
+		s.logger.Error("Failed to get service nodes", logError(err))
+		return idx, nil
+	}
+	provides := make(map[string]struct{}, len(res))
+	for _, r := range res {
+		provides[r.(*structs.ServiceNode).Node] = struct{}{}
+	}
+
+	res, err = s.nodeTable.GetTxn(tx, "id")
+	if err != nil {
+		s.logger.Error("Error getting nodes", logError(err))
+		return idx, nil
+	}
+	var nodes structs.Nodes
+	for _, r := range res {
+		node := r.(*structs.Node)
+		if _, ok := provides[node.Node]; !ok {
+			nodes = append(nodes, *node)
+		}
+	}
+	return idx, nodes
+}
+
+// ServiceTagNodes returns the nodes associated with a given service matching a tag,
+// and any given node metadata
+func (s *StateStore) ServiceTagNodes(service, tag string, nodeMeta map[string]string) (uint64, structs.ServiceNodes) {
+	tables := s.queryTables["ServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "service", service, "")
+	res = serviceTagFilter(res, tag)
+	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err, nodeMeta)
+}
+
+// serviceTagFilter is used to filter a list of *structs.ServiceNode which do
+// not have the specified tag
+func serviceTagFilter(l []interface{}, tag string) []interface{} {
+	n := len(l)
+	for i := 0; i < n; i++ {
+		srv := l[i].(*structs.ServiceNode)
+		if !strContains(ToLowerList(srv.ServiceTags), strings.ToLower(tag)) {
+			l[i], l[n-1] = l[n-1], nil
+			i--
+			n--
+		}
+	}
+	return l[:n]
+}
+
+// namespaceFilter is used to filter a list of *structs.ServiceNode or
+// *structs.HealthCheck which are not in the given namespace
+func namespaceFilter(l []interface{}, namespace string) []interface{} {
+	n := 0
+	for _, r := range l {
+		var ns string
+		switch v := r.(type) {
+		case *structs.ServiceNode:
+			ns = v.Namespace
+		case *structs.HealthCheck:
+			ns = v.Namespace
+		}
+		if ns == namespace {
+			l[n] = r
+			n++
+		}
+	}
+	return l[:n]
+}
+
+// servicePassingFilter is used to filter a list of *structs.ServiceNode
+// whose aggregated status is not passing
+func servicePassingFilter(l []interface{}) []interface{} {
+	n := 0
+	for _, r := range l {
+		if r.(*structs.ServiceNode).AggregatedStatus == structs.HealthPassing {
+			l[n] = r
+			n++
+		}
+	}
+	return l[:n]
+}
+
+// nodeMetaMatches checks if a node has all of the given metadata
+func nodeMetaMatches(node *structs.Node, nodeMeta map[string]string) bool {
+	for k, v := range nodeMeta {
+		if value, ok := node.Meta[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseServiceNodes parses results ServiceNodes and ServiceTagNodes,
+// skipping the nodes without the given metadata
+func (s *StateStore) parseServiceNodes(tx *MDBTxn, table *MDBTable, res []interface{}, err error,
+	nodeMeta map[string]string) structs.ServiceNodes {
+	nodes := make(structs.ServiceNodes, len(res))
+	if err != nil {
+		s.logger.Error("Failed to get service nodes", logError(err))
+		return nodes
+	}
+
+	var i int
+	for _, r := range res {
+		srv := r.(*structs.ServiceNode)
+
+		// Get the address of the node
+		nodeRes, err := table.GetTxn(tx, "id", srv.Node)
+		if err != nil || len(nodeRes) != 1 {
+			s.logger.Error("Failed to join service node with node", logField("node", srv.Node),
+				logField("service", srv.ServiceID), logError(err))
+			continue
+		}
+		node := nodeRes[0].(*structs.Node)
+		if !nodeMetaMatches(node, nodeMeta) {
+			continue
+		}
+		srv.Address = node.Address
+
+		nodes[i] = *srv
+		i++
+	}
+
+	return nodes[:i]
+}
+
+// EnsureCheck is used to create a check or updates it's state
+func (s *StateStore) EnsureCheck(index uint64, check *structs.HealthCheck) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+	if err := s.ensureCheckTxn(index, check, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateCheckStatus is used to update the status and output of an
+// existing check, leaving the rest of its definition untouched. A
+// critical status is subject to the grace period, as with the CheckGrace
+// of a registration.
+func (s *StateStore) UpdateCheckStatus(index uint64, node, checkID, status, output string, grace time.Duration) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	res, err := s.checkTable.GetTxn(tx, "id", node, checkID, "")
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return structs.NewError(structs.ErrCodeMissingCheck, structs.ErrMsgMissingCheck, checkID)
+	}
+	check := res[0].(*structs.HealthCheck)
+	check.Status = status
+	check.Output = output
+
+	if err := s.checkGraceTxn(tx, check, grace); err != nil {
+		return err
+	}
+	if err := s.ensureCheckTxn(index, check, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ensureCheckTxn is used to create a check or updates it's state in a transaction
+func (s *StateStore) ensureCheckTxn(index uint64, check *structs.HealthCheck, tx *MDBTxn) error {
+	// Ensure we have a status
+	if check.Status == "" {
+		check.Status = structs.HealthCritical
+	}
+
+	// Ensure the node exists, and use its registered name
+	res, err := s.nodeTable.GetTxn(tx, "id", check.Node)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return structs.ErrMissingNode
+	}
+	check.Node = res[0].(*structs.Node).Node
+
+	// Ensure the service exists if specified
+	if check.ServiceID != "" {
+		res, err = s.serviceTable.GetTxn(tx, "id", check.Node, check.ServiceID, check.Namespace)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return structs.ErrMissingService
+		}
+		// Ensure we set the correct service
+		srv := res[0].(*structs.ServiceNode)
+		check.ServiceName = srv.ServiceName
+	}
+
+	// Look for the existing check. Chatty checks often rewrite the same
+	// output, so an update that changes nothing meaningful only records
+	// the heard time, and does not wake up every watcher.
+	res, err = s.checkTable.GetTxn(tx, "id", check.Node, check.CheckID, check.Namespace)
+	if err != nil {
+		return err
+	}
+	// A registration without a source keeps that of the existing check
+	if len(res) > 0 && check.Source == "" {
+		check.Source = res[0].(*structs.HealthCheck).Source
+	}
+	unchanged := len(res) > 0 && checkEqual(res[0].(*structs.HealthCheck), check)
+
+	// Invalidate any sessions if status is critical. Sessions and the
+	// heard times are only tied to the checks of the default namespace.
+	if !unchanged && check.Status == structs.HealthCritical && check.Namespace == "" {
+		err := s.invalidateCheck(index, tx, check.Node, check.CheckID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Record that a healthy status was heard, even if nothing changed
+	if check.Status != structs.HealthCritical && check.Namespace == "" {
+		heard := &structs.CheckHeard{
+			ModifyIndex: index,
+			Node:        check.Node,
+			CheckID:     check.CheckID,
+			HeardAt:     s.now().UnixNano(),
+		}
+		if err := s.checkHeardTable.InsertTxn(tx, heard); err != nil {
+			return err
+		}
+		if err := s.checkHeardTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+	}
+
+	if unchanged {
+		return nil
+	}
+
+	// Notify the handler of a status transition
+	if handler := s.checkStatusHandler; handler != nil && len(res) > 0 {
+		if prev := res[0].(*structs.HealthCheck).Status; prev != check.Status {
+			change := &structs.CheckStatusChange{
+				Index:       index,
+				Node:        check.Node,
+				CheckID:     check.CheckID,
+				Name:        check.Name,
+				Namespace:   check.Namespace,
+				ServiceID:   check.ServiceID,
+				ServiceName: check.ServiceName,
+				PrevStatus:  prev,
+				Status:      check.Status,
+				Output:      check.Output,
+			}
+			tx.Defer(func() { handler(change) })
+		}
+	}
+
+	// Ensure the check is set
+	if err := s.checkTable.InsertTxn(tx, check); err != nil {
+		return err
+	}
+	if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.checkTable].Notify() })
+	if err := s.aggregateStatusTxn(tx, check.Node, check.ServiceID, check.Namespace); err != nil {
+		return err
+	}
+	if check.Namespace != "" {
+		return nil
+	}
+	return s.recordChangeTxn(index, tx, dbChecks, check.Node+"/"+check.CheckID, structs.ChangeSet)
+}
+
+// aggregateStatusTxn is used to update the aggregated status of the
+// instances affected by a change to a check. A check of the node that is
+// not associated with any service affects every instance of the node,
+// unless it is namespaced, since only the node checks of the default
+// namespace apply to the instances.
+func (s *StateStore) aggregateStatusTxn(tx *MDBTxn, node, serviceID, namespace string) error {
+	var res []interface{}
+	var err error
+	if serviceID != "" {
+		res, err = s.serviceTable.GetTxn(tx, "id", node, serviceID, namespace)
+	} else if namespace == "" {
+		res, err = s.serviceTable.GetTxn(tx, "id", node)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, r := range res {
+		srv := r.(*structs.ServiceNode)
+		status, err := s.serviceStatusTxn(tx, srv.Node, srv.ServiceID, srv.Namespace)
+		if err != nil {
+			return err
+		}
+		if status == srv.AggregatedStatus {
+			continue
+		}
+
+		// The index of the service is left as is, since the change is
+		// already reflected by the index of the checks
+		updated := *srv
+		updated.AggregatedStatus = status
+		if err := s.serviceTable.InsertTxn(tx, &updated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceStatusTxn returns the worst status of the checks of an instance
+// and of the checks of its node, or passing if there are none
+func (s *StateStore) serviceStatusTxn(tx *MDBTxn, node, serviceID, namespace string) (string, error) {
+	status := structs.HealthPassing
+	for _, parts := range [][]string{{node, serviceID, namespace}, {node, "", ""}} {
+		res, err := s.checkTable.GetTxn(tx, "node", parts...)
+		if err != nil {
+			return "", err
+		}
+		for _, r := range res {
+			status = structs.WorseStatus(status, r.(*structs.HealthCheck).Status)
+		}
+	}
+	return status, nil
+}
+
+// checkGraceTxn is used to keep the prior status of a check in place of
+// a critical status, if the prior status was passing or warning and was
+// last heard within the grace period
+func (s *StateStore) checkGraceTxn(tx *MDBTxn, check *structs.HealthCheck, grace time.Duration) error {
+	if grace <= 0 || (check.Status != "" && check.Status != structs.HealthCritical) {
+		return nil
+	}
+
+	// The heard times are only kept for the default namespace
+	if check.Namespace != "" {
+		return nil
+	}
+
+	res, err := s.checkTable.GetTxn(tx, "id", check.Node, check.CheckID, "")
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	prior := res[0].(*structs.HealthCheck)
+	if prior.Status == structs.HealthCritical {
+		return nil
+	}
+
+	res, err = s.checkHeardTable.GetTxn(tx, "id", check.Node, check.CheckID)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	heard := time.Unix(0, res[0].(*structs.CheckHeard).HeardAt)
+	if s.now().Sub(heard) > grace {
+		return nil
+	}
+
+	check.Status = prior.Status
+	check.Output = prior.Output
+	return nil
+}
+
+// checkEqual is used to determine if two checks are the same. The
+// outputs are compared by the hash of their words, so changes that
+// only affect whitespace are ignored.
+func checkEqual(a, b *structs.HealthCheck) bool {
+	if a.Node != b.Node || a.CheckID != b.CheckID || a.Name != b.Name ||
+		a.Status != b.Status || a.Notes != b.Notes ||
+		a.ServiceID != b.ServiceID || a.ServiceName != b.ServiceName ||
+		a.Namespace != b.Namespace || a.Source != b.Source {
+		return false
+	}
+	return checkOutputHash(a.Output) == checkOutputHash(b.Output)
+}
+
+// checkOutputHash is used to hash the output of a check, ignoring
+// differences in whitespace
+func checkOutputHash(output string) [md5.Size]byte {
+	return md5.Sum([]byte(strings.Join(strings.Fields(output), " ")))
+}
+
+// DeleteNodeCheck is used to delete a node health check
+func (s *StateStore) DeleteNodeCheck(index uint64, node, id string) error {
+	return s.DeleteNamespaceCheck(index, "", node, id)
+}
+
+// DeleteNamespaceCheck is like DeleteNodeCheck, but deletes a check of
+// the given namespace
+func (s *StateStore) DeleteNamespaceCheck(index uint64, namespace, node, id string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	// The checks are stored under the name the node is registered under
+	node, err = s.normalizeNodeTxn(tx, node)
+	if err != nil {
+		return err
+	}
+
+	// Find the check, whose instances have their status aggregated again
+	res, err := s.checkTable.GetTxn(tx, "id", node, id, namespace)
+	if err != nil {
+		return err
+	}
+	var check *structs.HealthCheck
+	if len(res) > 0 {
+		check = res[0].(*structs.HealthCheck)
+	}
+
+	if namespace != "" {
+		if n, err := s.checkTable.DeleteTxn(tx, "id", node, id, namespace); err != nil {
+			return err
+		} else if n > 0 {
+			if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+				return err
+			}
+			tx.Defer(func() { s.watch[s.checkTable].Notify() })
+		}
+		if check != nil {
+			if err := s.aggregateStatusTxn(tx, node, check.ServiceID, namespace); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	// Invalidate any sessions held by this check
+	if err := s.invalidateCheck(index, tx, node, id); err != nil {
+		return err
+	}
+
+	if n, err := s.checkTable.DeleteTxn(tx, "id", node, id, ""); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbChecks, node+"/"+id, structs.ChangeDelete); err != nil {
+			return err
+		}
+		if err := s.catalogEventTxn(index, tx, node); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+	}
+	if _, err := s.checkHeardTable.DeleteTxn(tx, "id", node, id); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := s.aggregateStatusTxn(tx, node, check.ServiceID, ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// NodeChecks is used to get all the checks for a node
+func (s *StateStore) NodeChecks(node string) (uint64, structs.HealthChecks) {
+	return s.NamespaceNodeChecks("", node)
+}
+
+// NamespaceNodeChecks is used to get the checks for a node in a namespace
+func (s *StateStore) NamespaceNodeChecks(namespace, node string) (uint64, structs.HealthChecks) {
+	idx, res, err := s.checkTable.Get("id", node)
+	return s.parseHealthChecks(idx, namespaceFilter(res, namespace), err)
+}
+
+// ServiceChecks is used to get the checks for a service, in node and
+// check ID order starting after the cursor. At most limit checks are
+// returned, unless limit is zero.
+func (s *StateStore) ServiceChecks(service string, cursor structs.CheckCursor,
+	limit int) (uint64, structs.HealthChecks) {
+	idx, checks := s.parseHealthChecks(s.checkTable.Get("service", service, ""))
+	return idx, pageHealthChecks(checks, cursor, limit)
+}
+
+// CheckInState is used to get the checks in a given state, in node and
+// check ID order starting after the cursor. At most limit checks are
+// returned, unless limit is zero.
+func (s *StateStore) ChecksInState(state string, cursor structs.CheckCursor,
+	limit int) (uint64, structs.HealthChecks) {
+	var idx uint64
+	var res []interface{}
+	var err error
+	if state == structs.HealthAny {
+		idx, res, err = s.checkTable.Get("id")
+		res = namespaceFilter(res, "")
+	} else {
+		idx, res, err = s.checkTable.Get("status", state, "")
+	}
+	_, checks := s.parseHealthChecks(idx, res, err)
+	return idx, pageHealthChecks(checks, cursor, limit)
+}
+
+// ServiceChecksInState is used to get the checks of a service in a given
+// state. It is paged like ChecksInState, and uses the composite index on
+// the status and service so that only the matching checks are scanned.
+func (s *StateStore) ServiceChecksInState(service, state string, cursor structs.CheckCursor,
+	limit int) (uint64, structs.HealthChecks) {
+	var idx uint64
+	var res []interface{}
+	var err error
+	if state == structs.HealthAny {
+		idx, res, err = s.checkTable.Get("service", service, "")
+	} else {
+		idx, res, err = s.checkTable.Get("status_service", state, service, "")
+	}
+	_, checks := s.parseHealthChecks(idx, res, err)
+	return idx, pageHealthChecks(checks, cursor, limit)
+}
+
+// pageHealthChecks is used to sort the checks and return the page
+// that starts after the cursor
+func pageHealthChecks(checks structs.HealthChecks, cursor structs.CheckCursor,
+	limit int) structs.HealthChecks {
+	sort.Sort(healthChecksByID(checks))
+	start := sort.Search(len(checks), func(i int) bool {
+		c := checks[i]
+		return c.Node > cursor.Node || (c.Node == cursor.Node && c.CheckID > cursor.CheckID)
+	})
+	checks = checks[start:]
+	if limit > 0 && len(checks) > limit {
+		checks = checks[:limit]
+	}
+	return checks
+}
+
+// healthChecksByID is used to sort a list of checks by node and check ID
+type healthChecksByID structs.HealthChecks
+
+func (h healthChecksByID) Len() int      { return len(h) }
+func (h healthChecksByID) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h healthChecksByID) Less(i, j int) bool {
+	if h[i].Node != h[j].Node {
+		return h[i].Node < h[j].Node
+	}
+	return h[i].CheckID < h[j].CheckID
+}
+
+// parseHealthChecks is used to handle the results of a Get against
+// the checkTable
+func (s *StateStore) parseHealthChecks(idx uint64, res []interface{}, err error) (uint64, structs.HealthChecks) {
+	results := make([]*structs.HealthCheck, len(res))
+	if err != nil {
+		s.logger.Error("Failed to get health checks", logError(err))
+		return idx, results
+	}
+	for i, r := range res {
+		results[i] = r.(*structs.HealthCheck)
+	}
+	return idx, results
+}
+
+// CheckServiceNodes returns the nodes associated with a given service, along
+// with any associated check. If any node metadata is given, only the nodes
+// with all of it are returned.
+func (s *StateStore) CheckServiceNodes(service string, nodeMeta map[string]string) (uint64, structs.CheckServiceNodes) {
+	return s.NamespaceCheckServiceNodes("", service, nodeMeta)
+}
+
+// NamespaceCheckServiceNodes is like CheckServiceNodes, but returns the
+// nodes of a service of the given namespace
+func (s *StateStore) NamespaceCheckServiceNodes(namespace, service string, nodeMeta map[string]string) (uint64, structs.CheckServiceNodes) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	// Check for a cached result, which is not filtered by node metadata.
+	// The nodes are copied, since callers filter the result in place.
+	// Only the default namespace is cached.
+	var nodes structs.CheckServiceNodes
+	if cached, ok := s.serviceNodesCache.get(service, idx); ok && namespace == "" {
+		nodes = cached.(structs.CheckServiceNodes)
+	} else {
+		res, err := s.serviceTable.GetTxn(tx, "service", service, namespace)
+		nodes = s.parseCheckServiceNodes(tx, res, err, nil)
+		if err == nil && namespace == "" {
+			s.serviceNodesCache.set(service, idx, nodes)
+		}
+	}
+	var out structs.CheckServiceNodes
+	for _, node := range nodes {
+		if nodeMetaMatches(&node.Node, nodeMeta) {
+			out = append(out, node)
+		}
+	}
+	return idx, out
+}
+
+// PassingCheckServiceNodes is like CheckServiceNodes, but only returns the
+// instances whose checks, and the checks of their node, are all passing.
+// The other instances are skipped by their aggregated status, before their
+// node and checks are joined.
+func (s *StateStore) PassingCheckServiceNodes(service string, nodeMeta map[string]string) (uint64, structs.CheckServiceNodes) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "service", service, "")
+	res = servicePassingFilter(res)
+	return idx, s.parseCheckServiceNodes(tx, res, err, nodeMeta)
+}
+
+// CheckServiceNodes returns the nodes associated with a given service, along
+// with any associated checks
+func (s *StateStore) CheckServiceTagNodes(service, tag string, nodeMeta map[string]string) (uint64, structs.CheckServiceNodes) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "service", service, "")
+	res = serviceTagFilter(res, tag)
+	return idx, s.parseCheckServiceNodes(tx, res, err, nodeMeta)
+}
+
+// CheckServiceVersionNodes returns the nodes of the instances of a service
+// of the given version, along with any associated checks
+func (s *StateStore) CheckServiceVersionNodes(service, version string, nodeMeta map[string]string) (uint64, structs.CheckServiceNodes) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "version", service, version, "")
+	return idx, s.parseCheckServiceNodes(tx, res, err, nodeMeta)
+}
+
+// ServiceHasPassingInstance returns if any instance of a service has all
+// of its checks passing, as CheckServiceNodes with only the passing nodes
+// kept would be non-empty. The failing checks are found through the status
+// index, so it stops at the first passing instance instead of joining the
+// checks of every instance.
+func (s *StateStore) ServiceHasPassingInstance(service string) (bool, uint64) {
+	tables := s.queryTables["CheckServiceNodes"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	// Collect the failing instances and the nodes with a failing check
+	// not associated with any service
+	failing := make(map[[2]string]struct{})
+	failingNodes := make(map[string]struct{})
+	for _, status := range []string{structs.HealthUnknown, structs.HealthWarning, structs.HealthCritical} {
+		res, err := s.checkTable.GetTxn(tx, "status_service", status, service, "")
+		if err != nil {
+			s.logger.Error("Failed to get checks", logField("service", service), logError(err))
+			return false, idx
+		}
+		for _, r := range res {
+			check := r.(*structs.HealthCheck)
+			failing[[2]string{check.Node, check.ServiceID}] = struct{}{}
+		}
+
+		res, err = s.checkTable.GetTxn(tx, "status", status, "")
+		if err != nil {
+			s.logger.Error("Failed to get checks", logError(err))
+			return false, idx
+		}
+		for _, r := range res {
+			if check := r.(*structs.HealthCheck); check.ServiceID == "" {
+				failingNodes[check.Node] = struct{}{}
+			}
+		}
+	}
+
+	res, err := s.serviceTable.GetTxn(tx, "service", service, "")
+	if err != nil {
+		s.logger.Error("Failed to get service nodes", logField("service", service), logError(err))
+		return false, idx
+	}
+	for _, r := range res {
+		srv := r.(*structs.ServiceNode)
+		if _, ok := failing[[2]string{srv.Node, srv.ServiceID}]; ok {
+			continue
+		}
+		if _, ok := failingNodes[srv.Node]; ok {
+			continue
+		}
+
+		// Draining nodes are not returned by CheckServiceNodes
+		drainRes, err := s.nodeDrainTable.GetTxn(tx, "id", srv.Node)
+		if err != nil {
+			s.logger.Error("Failed to get node drain", logField("node", srv.Node), logError(err))
+			continue
+		} else if len(drainRes) > 0 {
+			continue
+		}
+		return true, idx
+	}
+	return false, idx
+}
+
+// parseCheckServiceNodes parses results CheckServiceNodes and CheckServiceTagNodes,
+// skipping the nodes without the given metadata
+func (s *StateStore) parseCheckServiceNodes(tx *MDBTxn, res []interface{}, err error,
+	nodeMeta map[string]string) structs.CheckServiceNodes {
+	nodes := make(structs.CheckServiceNodes, len(res))
+	if err != nil {
+		s.logger.Error("Failed to get service nodes", logError(err))
+		return nodes
+	}
+
+	var i int
+	for _, r := range res {
+		srv := r.(*structs.ServiceNode)
+
+		// Get the node
+		nodeRes, err := s.nodeTable.GetTxn(tx, "id", srv.Node)
+		if err != nil || len(nodeRes) != 1 {
+			s.logger.Error("Failed to join service node with node", logField("node", srv.Node),
+				logField("service", srv.ServiceID), logError(err))
+			continue
+		}
+		if !nodeMetaMatches(nodeRes[0].(*structs.Node), nodeMeta) {
+			continue
+		}
+
+		// Skip the node if it is draining
+		drainRes, err := s.nodeDrainTable.GetTxn(tx, "id", srv.Node)
+		if err != nil {
+			s.logger.Error("Failed to get node drain", logField("node", srv.Node), logError(err))
+		} else if len(drainRes) > 0 {
+			continue
+		}
+
+		// Get any associated checks of the service
+		res, err := s.checkTable.GetTxn(tx, "node", srv.Node, srv.ServiceID, srv.Namespace)
+		_, checks := s.parseHealthChecks(0, res, err)
+
+		// Get any checks of the node, not associated with any service.
+		// These are those of the default namespace, which apply to the
+		// services of every namespace.
+		res, err = s.checkTable.GetTxn(tx, "node", srv.Node, "", "")
+		_, nodeChecks := s.parseHealthChecks(0, res, err)
+		checks = append(checks, nodeChecks...)
+
+		// Setup the node
+		nodes[i].Node = *nodeRes[0].(*structs.Node)
+		nodes[i].Service = structs.NodeService{
+			ID:        srv.ServiceID,
+			Service:   srv.ServiceName,
+			Tags:      srv.ServiceTags,
+			Address:   srv.ServiceAddress,
+			Port:      srv.ServicePort,
+			Version:   srv.ServiceVersion,
+			Canary:    srv.ServiceCanary,
+			Namespace: srv.Namespace,
+			Addresses: srv.ServiceAddresses,
+			Source:    srv.ServiceSource,
+		}
+		nodes[i].Checks = checks
+
+		// Get the DNS TTL of the service, if configured
+		res, err = s.serviceConfTable.GetTxn(tx, "id", srv.ServiceName)
+		if err != nil {
+			s.logger.Error("Failed to get service config", logField("service", srv.ServiceName), logError(err))
+		} else if len(res) > 0 {
+			nodes[i].DNSTTL = res[0].(*structs.ServiceConfig).DNSTTL
+		}
+		i++
+	}
+
+	return nodes[:i]
+}
+
+// NodeInfo is used to generate the full info about a node.
+func (s *StateStore) NodeInfo(node string) (uint64, structs.NodeDump) {
+	tables := s.queryTables["NodeInfo"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.nodeTable.GetTxn(tx, "id", node)
+	return idx, s.parseNodeInfo(tx, res, err)
+}
+
+// NodeInfoHash is used to return a stable hash of the services and checks
+// of a node, or an empty string if the node is not registered
+func (s *StateStore) NodeInfoHash(node string) (uint64, string) {
+	idx, dump := s.NodeInfo(node)
+	if len(dump) == 0 {
+		return idx, ""
+	}
+	return idx, dump[0].Hash()
+}
+
+// NodeDump is used to generate the NodeInfo for all nodes. This is very expensive,
+// and should generally be avoided for programmatic access.
+func (s *StateStore) NodeDump() (uint64, structs.NodeDump) {
+	tables := s.queryTables["NodeDump"]
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	res, err := s.nodeTable.GetTxn(tx, "id")
+	return idx, s.parseNodeInfo(tx, res, err)
+}
+
+// parseNodeInfo is used to scan over the results of a node
+// iteration and generate a NodeDump
+func (s *StateStore) parseNodeInfo(tx *MDBTxn, res []interface{}, err error) structs.NodeDump {
+	dump := make(structs.NodeDump, 0, len(res))
+	if err != nil {
+		s.logger.Error("Failed to get nodes", logError(err))
+		return dump
+	}
+
+	for _, r := range res {
+		// Copy the address and node
+		node := r.(*structs.Node)
+		info := &structs.NodeInfo{
+			Node:    node.Node,
+			NodeID:  node.NodeID,
+			Address: node.Address,
+		}
+
+		// Get any services of the node
+		res, err = s.serviceTable.GetTxn(tx, "id", node.Node)
+		if err != nil {
+			s.logger.Error("Failed to get node services", logError(err))
+		}
+		res = namespaceFilter(res, "")
+		info.Services = make([]*structs.NodeService, 0, len(res))
+		for _, r := range res {
+			service := r.(*structs.ServiceNode)
+			srv := &structs.NodeService{
+				ID:        service.ServiceID,
+				Service:   service.ServiceName,
+				Tags:      service.ServiceTags,
+				Address:   service.ServiceAddress,
+				Port:      service.ServicePort,
+				Version:   service.ServiceVersion,
+				Canary:    service.ServiceCanary,
+				Addresses: service.ServiceAddresses,
+				Source:    service.ServiceSource,
+			}
+			info.Services = append(info.Services, srv)
+		}
+
+		// Get any checks of the node
+		res, err = s.checkTable.GetTxn(tx, "node", node.Node)
+		if err != nil {
+			s.logger.Error("Failed to get node checks", logError(err))
+		}
+		res = namespaceFilter(res, "")
+		info.Checks = make([]*structs.HealthCheck, 0, len(res))
+		for _, r := range res {
+			chk := r.(*structs.HealthCheck)
+			info.Checks = append(info.Checks, chk)
+		}
+
+		// Get the registration times of the node and its services
+		res, err = s.nodeRegTable.GetTxn(tx, "id", node.Node)
+		if err != nil {
+			s.logger.Error("Failed to get node registration times", logError(err))
+		}
+		if len(res) > 0 {
+			rt := res[0].(*structs.RegistrationTime)
+			info.RegisteredAt = rt.RegisteredAt
+			info.LastSyncedAt = rt.LastSyncedAt
+		}
+		res, err = s.registrationTable.GetTxn(tx, "id", node.Node)
+		if err != nil {
+			s.logger.Error("Failed to get service registration times", logError(err))
+		}
+		info.ServiceTimes = make(map[string]*structs.RegistrationTime, len(res))
+		for _, r := range res {
+			rt := r.(*structs.RegistrationTime)
+			info.ServiceTimes[rt.ServiceID] = rt
+		}
+
+		// Add the node info
+		dump = append(dump, info)
+	}
+	return dump
+}
+
+// KVSSet is used to create or update a KV entry
+func (s *StateStore) KVSSet(index uint64, d *structs.DirEntry) error {
+	_, err := s.kvsSet(index, d, kvSet)
+	return err
+}
+
+// KVSRestore is used to restore a DirEntry. It should only be used when
+// doing a restore, otherwise KVSSet should be used. Restoring many
+// entries is faster through a StateRestore.
+func (s *StateStore) KVSRestore(d *structs.DirEntry) error {
+	r := s.Restore()
+	defer r.Abort()
+	if err := r.KVS(d); err != nil {
+		return err
+	}
+	return r.Commit()
+}
+
+// KVSRestoreTable is used to restore KV entries from a snapshot into the
+// live store. Unlike KVSRestore, the entries are written at the given
+// index so that watchers and blocking queries observe the change. If
+// reset is set, all the existing keys are deleted first. Sessions are
+// not restored with the entries, so the restored keys are unlocked.
+func (s *StateStore) KVSRestoreTable(index uint64, reset bool, entries structs.DirEntries) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if reset {
+		if err := s.kvsDeleteWithIndexTxn(index, tx, "id"); err != nil {
+			return err
+		}
+	}
+	for _, ent := range entries {
+		d := *ent
+		d.Session = ""
+		d.LockIndex = 0
+		if _, err := s.kvsSetTxn(index, tx, &d, kvSet); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// KVSGet is used to get a KV entry
+func (s *StateStore) KVSGet(key string) (uint64, *structs.DirEntry, error) {
+	tx, err := s.kvsTable.StartTxn(true, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.kvsTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Check for a cached entry, which is copied so that it cannot be
+	// modified by the caller
+	var d *structs.DirEntry
+	if cached, ok := s.kvsCache.get(key, idx); ok {
+		d = cached.(*structs.DirEntry)
+	} else {
+		res, err := s.kvsTable.GetTxn(tx, "id", "", key)
+		if err != nil {
+			return idx, nil, err
+		}
+		if len(res) > 0 {
+			d = res[0].(*structs.DirEntry)
+		}
+		s.kvsCache.set(key, idx, d)
+	}
+	if d == nil {
+		return idx, nil, nil
+	}
+	ent := *d
+	return idx, &ent, nil
+}
+
+// KVSNamespaceGet is like KVSGet, but gets a key of the given namespace.
+// The index returned is the last index of the namespace.
+func (s *StateStore) KVSNamespaceGet(namespace, key string) (uint64, *structs.DirEntry, error) {
+	if namespace == "" {
+		return s.KVSGet(key)
+	}
+	tables := MDBTables{s.kvsTable, s.kvsNamespaceTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.kvsNamespaceIndexTxn(tx, namespace)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := s.kvsTable.GetTxn(tx, "id", namespace, key)
+	if err != nil || len(res) == 0 {
+		return idx, nil, err
+	}
+	return idx, res[0].(*structs.DirEntry), nil
+}
+
+// KVSNamespaceIndex returns the last index that modified the keys of a
+// namespace
+func (s *StateStore) KVSNamespaceIndex(namespace string) (uint64, error) {
+	tables := MDBTables{s.kvsTable, s.kvsNamespaceTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Abort()
+	return s.kvsNamespaceIndexTxn(tx, namespace)
+}
+
+// kvsNamespaceIndexTxn returns the last index of a namespace within a
+// given txn. The default namespace is not tracked on its own, so the
+// index of the whole table is used for it, as it always has been.
+func (s *StateStore) kvsNamespaceIndexTxn(tx *MDBTxn, namespace string) (uint64, error) {
+	if namespace == "" {
+		return s.kvsTable.LastIndexTxn(tx)
+	}
+	res, err := s.kvsNamespaceTable.GetTxn(tx, "id", namespace)
+	if err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return res[0].(*kvsNamespace).ModifyIndex, nil
+}
+
+// setKVSNamespaceIndexTxn is used to advance the last index of a
+// namespace within a given txn
+func (s *StateStore) setKVSNamespaceIndexTxn(tx *MDBTxn, namespace string, index uint64) error {
+	if namespace == "" {
+		return nil
+	}
+	current, err := s.kvsNamespaceIndexTxn(tx, namespace)
+	if err != nil || index <= current {
+		return err
+	}
+	ns := &kvsNamespace{Namespace: namespace, ModifyIndex: index}
+	if err := s.kvsNamespaceTable.InsertTxn(tx, ns); err != nil {
+		return err
+	}
+	return s.kvsNamespaceTable.SetMaxLastIndexTxn(tx, index)
+}
+
+// KVSGetWithSession is used to lookup a key along with the session that
+// holds its lock. Both are read in a single transaction, so the session
+// cannot be destroyed between the two lookups. The session is nil if the
+// key is not locked.
+func (s *StateStore) KVSGetWithSession(key string) (uint64, *structs.DirEntry, *structs.Session, error) {
+	tables := MDBTables{s.kvsTable, s.sessionTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.kvsTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	res, err := s.kvsTable.GetTxn(tx, "id", "", key)
+	if err != nil || len(res) == 0 {
+		return idx, nil, nil, err
+	}
+	ent := res[0].(*structs.DirEntry)
+	if ent.Session == "" {
+		return idx, ent, nil, nil
+	}
+
+	res, err = s.sessionTable.GetTxn(tx, "id", ent.Session)
+	if err != nil || len(res) == 0 {
+		return idx, ent, nil, err
+	}
+	session := res[0].(*structs.Session)
+	locks, err := s.kvsTable.GetTxn(tx, "session", session.ID)
+	if err != nil {
+		return idx, nil, nil, err
+	}
+	session.LockCount = len(locks)
+	return idx, ent, session, nil
+}
+
+// KVSList is used to list all KV entries with a prefix. If an ACL is
+// given, only the entries it can read are returned, and the subtrees it
+// denies are skipped without being read.
+func (s *StateStore) KVSList(prefix string, acl acl.ACL) (uint64, uint64, structs.DirEntries, error) {
+	return s.kvsList("", prefix, "", 0, 0, acl)
+}
+
+// KVSNamespaceList is like KVSList, but lists the keys of the given
+// namespace. The index returned is the last index of the namespace.
+func (s *StateStore) KVSNamespaceList(namespace, prefix string) (uint64, uint64, structs.DirEntries, error) {
+	return s.kvsList(namespace, prefix, "", 0, 0, nil)
+}
+
+// KVSListSession is like KVSList, but only returns the keys that are
+// locked by the given session. The keys are looked up using the session
+// index, so this is cheap even for large prefixes.
+func (s *StateStore) KVSListSession(prefix, session string) (uint64, uint64, structs.DirEntries, error) {
+	if session == "" {
+		return 0, 0, nil, structs.ErrMissingSession
+	}
+	return s.kvsList("", prefix, session, 0, 0, nil)
+}
+
+// KVSListFlags is like KVSList, but only returns the keys whose flags
+// match the given flags on the bits of the mask. Keys with exactly the
+// given flags are looked up using the flags index.
+func (s *StateStore) KVSListFlags(prefix string, mask, flags uint64, acl acl.ACL) (uint64, uint64, structs.DirEntries, error) {
+	if mask == 0 {
+		return s.kvsList("", prefix, "", 0, 0, acl)
+	}
+	return s.kvsList("", prefix, "", mask, flags&mask, acl)
+}
+
+// kvsList is used to list the keys of a namespace with a prefix,
+// optionally only those locked by a session, matching flags on the bits
+// of a mask, or readable by an ACL
+func (s *StateStore) kvsList(namespace, prefix, session string, mask, flags uint64,
+	acl acl.ACL) (uint64, uint64, structs.DirEntries, error) {
+	tables := MDBTables{s.kvsTable, s.tombstoneTable, s.prefixTombTable}
+	if namespace != "" {
+		tables = append(tables, s.kvsNamespaceTable)
+	}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer tx.Abort()
+
+	var idx uint64
+	if namespace == "" {
+		idx, err = tables.LastIndexTxn(tx)
+	} else {
+		idx, err = s.kvsNamespaceIndexTxn(tx, namespace)
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	var ents structs.DirEntries
+	if session != "" {
+		res, err := s.kvsTable.GetTxn(tx, "session", session)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		ents = make(structs.DirEntries, 0, len(res))
+		for _, r := range res {
+			ent := r.(*structs.DirEntry)
+			if ent.Namespace != namespace || !strings.HasPrefix(ent.Key, prefix) {
+				continue
+			}
+			if ent.Flags&mask != flags {
+				continue
+			}
+			if acl != nil && !acl.KeyRead(ent.Key) {
+				continue
+			}
+			ents = append(ents, ent)
+		}
+		sort.Sort(dirEntriesByKey(ents))
+	} else if mask == math.MaxUint64 {
+		// The entries are ordered by key within the same flags
+		res, err := s.kvsTable.GetTxn(tx, "flags_prefix", namespace, IndexUint(flags), prefix)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		ents = make(structs.DirEntries, 0, len(res))
+		for _, r := range res {
+			ent := r.(*structs.DirEntry)
+			if acl != nil && !acl.KeyRead(ent.Key) {
+				continue
+			}
+			ents = append(ents, ent)
+		}
+	} else {
+		err = s.kvsTable.WalkTxn(tx, func(raw interface{}) (string, bool) {
+			ent := raw.(*structs.DirEntry)
+			if acl != nil && !acl.KeyRead(ent.Key) {
+				return kvsReadSkip(acl, prefix, ent.Key)
+			}
+			if ent.Flags&mask == flags {
+				ents = append(ents, ent)
+			}
+			return "", false
+		}, "id_prefix", namespace, prefix)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	// Check for the highest index in the tombstone tables. Prefix
+	// tombstones are only created in the default namespace.
+	var maxIndex uint64
+	if namespace == "" {
+		maxIndex, err = s.prefixTombstoneIndexTxn(tx, prefix)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	res, err := s.tombstoneTable.GetTxn(tx, "id_prefix", namespace, prefix)
+	for _, r := range res {
+		ent := r.(*structs.DirEntry)
+		if ent.ModifyIndex > maxIndex {
+			maxIndex = ent.ModifyIndex
+		}
+	}
+
+	return maxIndex, idx, ents, err
+}
+
+// prefixTombstoneIndexTxn returns the highest index of the prefix
+// tombstones covering keys under a prefix, which are those of the
+// prefixes containing it and of the prefixes nested beneath it. Prefix
+// tombstones are only created by mass deletes, so there are few of them
+// and they are simply scanned.
+func (s *StateStore) prefixTombstoneIndexTxn(tx *MDBTxn, prefix string) (uint64, error) {
+	res, err := s.prefixTombTable.GetTxn(tx, "id")
+	if err != nil {
+		return 0, err
+	}
+	var maxIndex uint64
+	for _, r := range res {
+		tomb := r.(*structs.PrefixTombstone)
+		if !strings.HasPrefix(prefix, tomb.Prefix) && !strings.HasPrefix(tomb.Prefix, prefix) {
+			continue
+		}
+		if tomb.ModifyIndex > maxIndex {
+			maxIndex = tomb.ModifyIndex
+		}
+	}
+	return maxIndex, nil
+}
+
+// kvsReadSkip is used when listing a prefix to find the keys that can be
+// skipped after a key the ACL denies. It returns the prefix to skip, if
+// any, and true if every remaining key of the listing is denied.
+func kvsReadSkip(acl acl.ACL, prefix, key string) (string, bool) {
+	deny, ok := acl.KeyReadDenyPrefix(key)
+	if !ok {
+		return "", false
+	}
+	if len(deny) <= len(prefix) {
+		return "", true
+	}
+	return deny, false
+}
+
+// KVSListKeys is used to list keys with a prefix, and up to a given
+// separator. If an ACL is given, only the keys it can read are returned,
+// and the subtrees it denies are skipped without being read.
+func (s *StateStore) KVSListKeys(prefix, seperator string, acl acl.ACL) (uint64, []string, error) {
+	tables := MDBTables{s.kvsTable, s.tombstoneTable, s.prefixTombTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.kvsTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Ensure a non-zero index
+	if idx == 0 {
+		// Must provide non-zero index to prevent blocking
+		// Index 1 is impossible anyways (due to Raft internals)
+		idx = 1
+	}
+
+	var keys []string
+	var maxIndex uint64
+	prefixLen := len(prefix)
+	sepLen := len(seperator)
+	last := ""
+	err = s.kvsTable.WalkTxn(tx, func(raw interface{}) (string, bool) {
+		ent := raw.(*structs.DirEntry)
+		after := ent.Key[prefixLen:]
+
+		// Check for the separator, and roll up the keys beneath it
+		key := ent.Key
+		rolled := false
+		if sepLen > 0 {
+			if idx := strings.Index(after, seperator); idx >= 0 {
+				key = ent.Key[:prefixLen+idx+sepLen]
+				rolled = true
+			}
+		}
+
+		// Every key beneath a denied roll up is skipped, since they
+		// would only be rolled up into it
+		if acl != nil && !acl.KeyRead(key) {
+			if rolled {
+				return key, false
+			}
+			return kvsReadSkip(acl, prefix, key)
+		}
+
+		// Update the highest index we've seen
+		if ent.ModifyIndex > maxIndex {
+			maxIndex = ent.ModifyIndex
+		}
+		if last != key {
+			keys = append(keys, key)
+			last = key
+		}
+		return "", false
+	}, "id_prefix", "", prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Handle the tombstones for any index updates
+	tombs, err := s.tombstoneTable.GetTxn(tx, "id_prefix", "", prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, raw := range tombs {
+		ent := raw.(*structs.DirEntry)
+		if ent.ModifyIndex > maxIndex {
+			maxIndex = ent.ModifyIndex
+		}
+	}
+	prefixIndex, err := s.prefixTombstoneIndexTxn(tx, prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	if prefixIndex > maxIndex {
+		maxIndex = prefixIndex
+	}
+
+	// Use the maxIndex if we have any keys
+	if maxIndex != 0 {
+		idx = maxIndex
+	}
+	return idx, keys, nil
+}
+
+// KVSStats is used to summarize the keys under a prefix in a single walk,
+// without returning them. If an ACL is given, only the keys it can read
+// are counted. The index returned is the one a listing of the prefix would
+// return, so it can be used for blocking queries.
+func (s *StateStore) KVSStats(prefix string, acl acl.ACL) (uint64, *structs.KVSStats, error) {
+	tables := MDBTables{s.kvsTable, s.tombstoneTable, s.prefixTombTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.kvsTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stats := &structs.KVSStats{}
+	err = s.kvsTable.WalkTxn(tx, func(raw interface{}) (string, bool) {
+		ent := raw.(*structs.DirEntry)
+		if acl != nil && !acl.KeyRead(ent.Key) {
+			return kvsReadSkip(acl, prefix, ent.Key)
+		}
+		stats.Keys++
+		stats.ValueBytes += int64(len(ent.Value))
+		if depth := strings.Count(ent.Key[len(prefix):], "/"); depth > stats.Depth {
+			stats.Depth = depth
+		}
+		if ent.ModifyIndex > stats.MaxIndex {
+			stats.MaxIndex = ent.ModifyIndex
+		}
+		return "", false
+	}, "id_prefix", "", prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Handle the tombstones for any index updates
+	maxIndex := stats.MaxIndex
+	tombs, err := s.tombstoneTable.GetTxn(tx, "id_prefix", "", prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, raw := range tombs {
+		ent := raw.(*structs.DirEntry)
+		if ent.ModifyIndex > maxIndex {
+			maxIndex = ent.ModifyIndex
+		}
+	}
+	prefixIndex, err := s.prefixTombstoneIndexTxn(tx, prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	if prefixIndex > maxIndex {
+		maxIndex = prefixIndex
+	}
+
+	// Use the maxIndex if we have any keys
+	if maxIndex != 0 {
+		idx = maxIndex
+	}
+	return idx, stats, nil
+}
+
+// KVSListLocked is used to list the keys under a prefix that are currently
+// held by a session. Rather than scanning the entire prefix, the locks
+// held by each session are looked up, so the cost is proportional to the
+// number of locks instead of the size of the tree.
+func (s *StateStore) KVSListLocked(prefix string) (uint64, structs.KeyLocks, error) {
+	tables := MDBTables{s.kvsTable, s.sessionTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sessions, err := s.sessionTable.GetTxn(tx, "id")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var locks structs.KeyLocks
+	for _, raw := range sessions {
+		session := raw.(*structs.Session)
+		res, err := s.kvsTable.GetTxn(tx, "session", session.ID)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, r := range res {
+			ent := r.(*structs.DirEntry)
+			if !strings.HasPrefix(ent.Key, prefix) {
+				continue
+			}
+			locks = append(locks, &structs.KeyLock{
+				Key:         ent.Key,
+				LockIndex:   ent.LockIndex,
+				ModifyIndex: ent.ModifyIndex,
+				Session:     session.ID,
+				Node:        session.Node,
+			})
+		}
+	}
+	sort.Sort(keyLocksByKey(locks))
+	return idx, locks, nil
+}
+
+// TombstoneList is used to list the tombstones that hold up the index of
+// a listing under a prefix. These are the tombstones of the keys under the
+// prefix, and the prefix tombstones containing it or nested beneath it.
+func (s *StateStore) TombstoneList(prefix string) (uint64, structs.Tombstones, error) {
+	tables := MDBTables{s.kvsTable, s.tombstoneTable, s.prefixTombTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	res, err := s.tombstoneTable.GetTxn(tx, "id_prefix", "", prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	tombs := make(structs.Tombstones, 0, len(res))
+	for _, r := range res {
+		ent := r.(*structs.DirEntry)
+		tombs = append(tombs, &structs.Tombstone{
+			Key:         ent.Key,
+			ModifyIndex: ent.ModifyIndex,
+		})
+	}
+
+	res, err = s.prefixTombTable.GetTxn(tx, "id")
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, r := range res {
+		tomb := r.(*structs.PrefixTombstone)
+		if !strings.HasPrefix(prefix, tomb.Prefix) && !strings.HasPrefix(tomb.Prefix, prefix) {
+			continue
+		}
+		tombs = append(tombs, &structs.Tombstone{
+			Key:         tomb.Prefix,
+			ModifyIndex: tomb.ModifyIndex,
+			Prefix:      true,
+		})
+	}
+	sort.Sort(tombstonesByKey(tombs))
+	return idx, tombs, nil
+}
+
+// tombstonesByKey is used to sort a list of tombstones by key
+type tombstonesByKey structs.Tombstones
+
+func (t tombstonesByKey) Len() int           { return len(t) }
+func (t tombstonesByKey) Less(i, j int) bool { return t[i].Key < t[j].Key }
+func (t tombstonesByKey) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// keyLocksByKey is used to sort a list of key locks by key
+type keyLocksByKey structs.KeyLocks
+
+func (k keyLocksByKey) Len() int           { return len(k) }
+func (k keyLocksByKey) Less(i, j int) bool { return k[i].Key < k[j].Key }
+func (k keyLocksByKey) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+
+// dirEntriesByKey is used to sort a list of entries by key
+type dirEntriesByKey structs.DirEntries
+
+func (d dirEntriesByKey) Len() int           { return len(d) }
+func (d dirEntriesByKey) Less(i, j int) bool { return d[i].Key < d[j].Key }
+func (d dirEntriesByKey) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// KVSDelete is used to delete a KVS entry
+func (s *StateStore) KVSDelete(index uint64, key string) error {
+	return s.kvsDeleteWithIndex(index, "id", "", key)
+}
+
+// KVSNamespaceDelete is like KVSDelete, but deletes a key of the given
+// namespace
+func (s *StateStore) KVSNamespaceDelete(index uint64, namespace, key string) error {
+	return s.kvsDeleteWithIndex(index, "id", namespace, key)
+}
+
+// KVSDeleteCheckAndSet is used to perform an atomic delete check-and-set
+func (s *StateStore) KVSDeleteCheckAndSet(index uint64, key string, casIndex uint64) (bool, error) {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	// Get the existing node
+	res, err := s.kvsTable.GetTxn(tx, "id", "", key)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the existing node if any
+	var exist *structs.DirEntry
+	if len(res) > 0 {
+		exist = res[0].(*structs.DirEntry)
+	}
+
+	// Use the casIndex as the constraint. A modify time of 0 means
+	// we are doing a delete-if-not-exists (odd...), while any other
+	// value means we expect that modify time.
+	if casIndex == 0 {
+		return exist == nil, nil
+	} else if casIndex > 0 && (exist == nil || exist.ModifyIndex != casIndex) {
+		return false, nil
+	}
+
+	// Do the actual delete
+	if err := s.kvsDeleteWithIndexTxn(index, tx, "id", "", key); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// KVSDeleteTree is used to delete all keys with a given prefix
+func (s *StateStore) KVSDeleteTree(index uint64, prefix string) error {
+	if prefix == "" {
+		return s.kvsDeleteWithIndex(index, "id", "")
+	}
+	return s.kvsDeleteWithIndex(index, "id_prefix", "", prefix)
+}
+
+// kvsDeleteWithIndex does a delete with either the id or id_prefix
+func (s *StateStore) kvsDeleteWithIndex(index uint64, tableIndex string, parts ...string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+	if err := s.kvsDeleteWithIndexTxn(index, tx, tableIndex, parts...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// kvsDeleteWithIndexTxn does a delete within an existing transaction. The
+// parts are the namespace and the key or prefix, and without any parts
+// every key of every namespace is deleted.
+func (s *StateStore) kvsDeleteWithIndexTxn(index uint64, tx *MDBTxn, tableIndex string, parts ...string) error {
+	namespace, key := "", ""
+	if len(parts) > 0 {
+		namespace = parts[0]
+	}
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+
+	// Soft deletes are a setting of the cluster config, so that every
+	// server applies the delete the same way
+	conf, err := s.clusterConfigTxn(tx)
+	if err != nil {
+		return err
+	}
+	softDelete := conf.KVSoftDelete
+
+	// A tree delete of a large number of keys creates a single prefix
+	// tombstone instead of a tombstone for each key. Soft deletes need
+	// the tombstone of each key to recover it, so they always use them.
+	// Prefix tombstones are only used in the default namespace.
+	tree := len(parts) < 2 || tableIndex == "id_prefix"
+	prefixTomb := false
+	if tree && namespace == "" && !softDelete {
+		prefixTomb, err = s.kvsExceedsTxn(tx, prefixTombstoneThreshold, tableIndex, parts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	num, dequeued := 0, 0
+	namespaces := make(map[string]struct{})
+	for {
+		// Get some number of entries to delete
+		pairs, err := s.kvsTable.GetTxnLimit(tx, 128, tableIndex, parts...)
+		if err != nil {
+			return err
+		}
+
+		// Create the tombstones and delete
+		for _, raw := range pairs {
+			ent := raw.(*structs.DirEntry)
+			ent.ModifyIndex = index // Update the index
+			ent.Session = ""
+			if !softDelete {
+				ent.Value = nil // Reduce storage required
+			}
+			if !prefixTomb {
+				if err := s.tombstoneTable.InsertTxn(tx, ent); err != nil {
+					return err
+				}
+			}
+			if num, err := s.kvsTable.DeleteTxn(tx, "id", ent.Namespace, ent.Key); err != nil {
+				return err
+			} else if num != 1 {
+				return fmt.Errorf("Failed to delete key '%s'", ent.Key)
+			}
+			if err := s.recordKVSChangeTxn(index, tx, ent.Namespace, ent.Key, structs.ChangeDelete); err != nil {
+				return err
+			}
+			if ent.Namespace != "" {
+				namespaces[ent.Namespace] = struct{}{}
+				continue
+			}
+
+			// The sessions queued for the lock of a deleted key would
+			// otherwise wait for a release that never comes
+			n, err := s.lockWaiterTable.DeleteTxn(tx, "id", ent.Key)
+			if err != nil {
+				return err
+			}
+			dequeued += n
+		}
+
+		// Increment the total number
+		num += len(pairs)
+		if len(pairs) == 0 {
+			break
+		}
+	}
+
+	if prefixTomb {
+		if err := s.prefixTombstoneTxn(index, tx, key); err != nil {
+			return err
+		}
+	}
+
+	if dequeued > 0 {
+		if err := s.lockWaiterTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.lockWaiterTable].Notify() })
+	}
+
+	if num > 0 {
+		if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		for ns := range namespaces {
+			if err := s.setKVSNamespaceIndexTxn(tx, ns, index); err != nil {
+				return err
+			}
+		}
+		tx.Defer(func() {
+			// Trigger the most fine grained notifications if possible
+			switch {
+			case len(parts) < 2:
+				s.notifyKV("", true)
+			case tableIndex == "id":
+				s.notifyKV(key, false)
+			case tableIndex == "id_prefix":
+				s.notifyKV(key, true)
+			default:
+				s.notifyKV("", true)
+			}
+			if s.gc != nil {
+				// If GC is configured, then we hint that this index
+				// required expiration.
+				s.gc.HintKey(index, key)
+			}
+		})
+	}
+	return nil
+}
+
+// kvsExceedsTxn checks if there are more than limit keys matching the
+// index, without retaining them
+func (s *StateStore) kvsExceedsTxn(tx *MDBTxn, limit int, tableIndex string, parts ...string) (bool, error) {
+	count := 0
+	err := s.kvsTable.WalkTxn(tx, func(interface{}) (string, bool) {
+		count++
+		return "", count > limit
+	}, tableIndex, parts...)
+	return count > limit, err
+}
+
+// prefixTombstoneTxn is used to mark the deletion of every key under a
+// prefix with a single prefix tombstone. The tombstones of keys and the
+// prefix tombstones beneath the prefix are subsumed by it, so they are
+// removed. When every key is deleted no tombstone is needed, since any
+// key listed afterwards is newer than the delete.
+func (s *StateStore) prefixTombstoneTxn(index uint64, tx *MDBTxn, prefix string) error {
+	var err error
+	if prefix == "" {
+		_, err = s.tombstoneTable.DeleteTxn(tx, "id", "")
+	} else {
+		_, err = s.tombstoneTable.DeleteTxn(tx, "id_prefix", "", prefix)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := s.prefixTombTable.GetTxn(tx, "id")
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		tomb := r.(*structs.PrefixTombstone)
+		if !strings.HasPrefix(tomb.Prefix, prefix) {
+			continue
+		}
+		if _, err := s.prefixTombTable.DeleteTxn(tx, "id", tomb.Prefix); err != nil {
+			return err
+		}
+	}
+
+	if prefix == "" {
+		return nil
+	}
+	tomb := &structs.PrefixTombstone{Prefix: prefix, ModifyIndex: index}
+	return s.prefixTombTable.InsertTxn(tx, tomb)
+}
+
+// KVSUndelete is used to recover a soft-deleted key from its tombstone.
+// It returns false if there is no tombstone for the key, or if the key
+// has since been recreated.
+func (s *StateStore) KVSUndelete(index uint64, key string) (bool, error) {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	conf, err := s.clusterConfigTxn(tx)
+	if err != nil {
+		return false, err
+	}
+	if !conf.KVSoftDelete {
+		return false, fmt.Errorf("Soft delete is not enabled")
+	}
+
+	// Get the tombstone
+	res, err := s.tombstoneTable.GetTxn(tx, "id", "", key)
+	if err != nil {
+		return false, err
+	}
+	if len(res) == 0 {
+		return false, nil
+	}
+	ent := res[0].(*structs.DirEntry)
+
+	// Ensure the key has not been recreated
+	res, err = s.kvsTable.GetTxn(tx, "id", "", key)
+	if err != nil {
+		return false, err
+	}
+	if len(res) > 0 {
+		return false, nil
+	}
+
+	// Restore the entry and remove the tombstone
+	ent.ModifyIndex = index
+	if err := s.kvsTable.InsertTxn(tx, ent); err != nil {
+		return false, err
+	}
+	if _, err := s.tombstoneTable.DeleteTxn(tx, "id", "", key); err != nil {
+		return false, err
+	}
+	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	if err := s.recordKVSChangeTxn(index, tx, "", key, structs.ChangeSet); err != nil {
+		return false, err
+	}
+	tx.Defer(func() { s.notifyKV(key, false) })
+	return true, tx.Commit()
+}
+
+// KVSIncrement is used to atomically add delta to the integer value
+// of a key, returning the new value. The value is stored as a decimal
+// string so it remains readable through the KV API. A missing key or an
+// empty value is treated as zero. Since the read and write happen in a
+// single transaction, concurrent increments never conflict.
+func (s *StateStore) KVSIncrement(index uint64, key string, delta int64) (int64, error) {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Abort()
+
+	res, err := s.kvsTable.GetTxn(tx, "id", "", key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Parse the current value, preserving the flags and content type
+	d := &structs.DirEntry{Key: key}
+	var val int64
+	if len(res) > 0 {
+		exist := res[0].(*structs.DirEntry)
+		d.Flags = exist.Flags
+		d.ContentType = exist.ContentType
+		if raw := strings.TrimSpace(string(exist.Value)); raw != "" {
+			val, err = strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Value of key '%s' is not an integer", key)
+			}
+		}
+	}
+
+	// Refuse to wrap around, so counters never silently jump sign
+	if (delta > 0 && val > math.MaxInt64-delta) || (delta < 0 && val < math.MinInt64-delta) {
+		return 0, fmt.Errorf("Incrementing key '%s' by %d overflows its value %d", key, delta, val)
+	}
+	val += delta
+	d.Value = []byte(strconv.FormatInt(val, 10))
+	if _, err := s.kvsSetTxn(index, tx, d, kvSet); err != nil {
+		return 0, err
+	}
+	return val, tx.Commit()
+}
+
+// KVSCheckAndSet is used to perform an atomic check-and-set
+func (s *StateStore) KVSCheckAndSet(index uint64, d *structs.DirEntry) (bool, error) {
+	return s.kvsSet(index, d, kvCAS)
+}
+
+// KVSLock works like KVSSet but only writes if the lock can be acquired
+func (s *StateStore) KVSLock(index uint64, d *structs.DirEntry) (bool, error) {
+	return s.kvsSet(index, d, kvLock)
+}
+
+// KVSLockQueue works like KVSLock, but if the lock is held, the session
+// is queued to acquire it instead. The lock is granted to the queued
+// sessions in order as it is released, so contenders can wait on the key
+// instead of retrying. Returns true only if the lock was acquired now.
+func (s *StateStore) KVSLockQueue(index uint64, d *structs.DirEntry) (bool, error) {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	ok, err := s.kvsSetTxn(index, tx, d, kvLock)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		if queued, err := s.enqueueLockTxn(index, tx, d); err != nil || !queued {
+			return false, err
+		}
+	}
+	return ok, tx.Commit()
+}
+
+// enqueueLockTxn is used to queue a session to acquire a held lock within
+// a given txn. Returns false if the session was not queued, either because
+// it already holds the lock or is already queued for it.
+func (s *StateStore) enqueueLockTxn(index uint64, tx *MDBTxn, d *structs.DirEntry) (bool, error) {
+	res, err := s.kvsTable.GetTxn(tx, "id", "", d.Key)
+	if err != nil {
+		return false, err
+	}
+	if len(res) > 0 && res[0].(*structs.DirEntry).Session == d.Session {
+		return false, nil
+	}
+
+	// Verify the session exists
+	res, err = s.sessionTable.GetTxn(tx, "id", d.Session)
+	if err != nil {
+		return false, err
+	}
+	if len(res) == 0 {
+		return false, structs.ErrInvalidSession
+	}
+
+	res, err = s.lockWaiterTable.GetTxn(tx, "id", d.Key, d.Session)
+	if err != nil {
+		return false, err
+	}
+	if len(res) > 0 {
+		return false, nil
+	}
+
+	waiter := &structs.LockWaiter{
+		CreateIndex: index,
+		Key:         d.Key,
+		Session:     d.Session,
+		Flags:       d.Flags,
+		Value:       d.Value,
+	}
+	if err := s.lockWaiterTable.InsertTxn(tx, waiter); err != nil {
+		return false, err
+	}
+	if err := s.lockWaiterTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	tx.Defer(func() { s.watch[s.lockWaiterTable].Notify() })
+	return true, nil
+}
+
+// lockWaitersTxn returns the sessions queued for the lock of a key,
+// oldest first
+func (s *StateStore) lockWaitersTxn(tx *MDBTxn, key string) (structs.LockWaiters, error) {
+	res, err := s.lockWaiterTable.GetTxn(tx, "id", key)
+	if err != nil {
+		return nil, err
+	}
+	waiters := make(structs.LockWaiters, len(res))
+	for i, raw := range res {
+		waiters[i] = raw.(*structs.LockWaiter)
+	}
+	sort.Sort(lockWaitersByIndex(waiters))
+	return waiters, nil
+}
+
+// grantLockTxn is used to grant a released lock to the oldest session
+// queued for it within a given txn. All tables should be locked in the tx.
+func (s *StateStore) grantLockTxn(index uint64, tx *MDBTxn, key string) error {
+	waiters, err := s.lockWaitersTxn(tx, key)
+	if err != nil || len(waiters) == 0 {
+		return err
+	}
+
+	// Acquiring the lock as the oldest waiter dequeues it
+	d := &structs.DirEntry{
+		Key:     key,
+		Flags:   waiters[0].Flags,
+		Value:   waiters[0].Value,
+		Session: waiters[0].Session,
+	}
+	if ok, err := s.kvsSetTxn(index, tx, d, kvLock); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("Failed to grant lock of '%s' to session '%s'", key, d.Session)
+	}
+	return nil
+}
+
+// KVSLockWaiters is used to list the sessions queued for the lock of
+// a key, oldest first
+func (s *StateStore) KVSLockWaiters(key string) (uint64, structs.LockWaiters, error) {
+	tx, err := s.lockWaiterTable.StartTxn(true, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.lockWaiterTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	waiters, err := s.lockWaitersTxn(tx, key)
+	return idx, waiters, err
+}
+
+// lockWaitersByIndex is used to sort lock waiters by the order they queued
+type lockWaitersByIndex structs.LockWaiters
+
+func (l lockWaitersByIndex) Len() int           { return len(l) }
+func (l lockWaitersByIndex) Less(i, j int) bool { return l[i].CreateIndex < l[j].CreateIndex }
+func (l lockWaitersByIndex) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// KVSLockDequeue is used to remove a session from the queue for the
+// lock of a key, once it stops waiting for it. Returns true if the
+// session was queued.
+func (s *StateStore) KVSLockDequeue(index uint64, d *structs.DirEntry) (bool, error) {
+	tx, err := s.lockWaiterTable.StartTxn(false, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	n, err := s.lockWaiterTable.DeleteTxn(tx, "id", d.Key, d.Session)
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if err := s.lockWaiterTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	tx.Defer(func() { s.watch[s.lockWaiterTable].Notify() })
+	return true, tx.Commit()
+}
+
+// KVSUnlock works like KVSSet but only writes if the lock can be unlocked
+func (s *StateStore) KVSUnlock(index uint64, d *structs.DirEntry) (bool, error) {
+	return s.kvsSet(index, d, kvUnlock)
+}
+
+// KVSLockDelay returns the expiration time of a key lock delay. A key may
+// have a lock delay if it was unlocked due to a session invalidation instead
+// of a graceful unlock. This must be checked on the leader node, and not in
+// KVSLock due to the variability of clocks.
+func (s *StateStore) KVSLockDelay(key string) time.Time {
+	s.lockDelayLock.RLock()
+	expires := s.lockDelay[key]
+	s.lockDelayLock.RUnlock()
+	return expires
+}
+
+// SetClock is used by the FSM to set the time of the request being
+// applied, as carried by the Raft log. A zero time reverts to the
+// local clock, which is used for requests that were not stamped.
+func (s *StateStore) SetClock(t time.Time) {
+	s.clock = t
+}
+
+// SetCatalogEvent is used by the FSM to set the catalog event of the
+// registration or deregistration being applied. Nil clears it.
+func (s *StateStore) SetCatalogEvent(ev *structs.CatalogEvent) {
+	s.catalogEvent = ev
+}
+
+// now returns the time used to compute expirations
+func (s *StateStore) now() time.Time {
+	if s.clock.IsZero() {
+		return time.Now()
+	}
+	return s.clock
+}
+
+// KVSSetCASMulti is used to perform an atomic check-and-set of several
+// keys. The ModifyIndex of every entry is verified before any of them
+// is written, and if any check fails, none of the entries are written.
+func (s *StateStore) KVSSetCASMulti(index uint64, entries structs.DirEntries) (bool, error) {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	// Verify all the preconditions first
+	seen := make(map[[2]string]struct{}, len(entries))
+	for _, d := range entries {
+		id := [2]string{d.Namespace, d.Key}
+		if _, ok := seen[id]; ok {
+			return false, fmt.Errorf("Duplicate key '%s'", d.Key)
+		}
+		seen[id] = struct{}{}
+
+		res, err := s.kvsTable.GetTxn(tx, "id", d.Namespace, d.Key)
+		if err != nil {
+			return false, err
+		}
+		var exist *structs.DirEntry
+		if len(res) > 0 {
+			exist = res[0].(*structs.DirEntry)
+		}
+		if d.ModifyIndex == 0 && exist != nil {
+			return false, nil
+		} else if d.ModifyIndex > 0 && (exist == nil || exist.ModifyIndex != d.ModifyIndex) {
+			return false, nil
+		}
+	}
+
+	// Apply all the writes
+	for _, d := range entries {
+		if _, err := s.kvsSetTxn(index, tx, d, kvSet); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// KVSBatch is used to apply several set and delete operations in a
+// single transaction. Unlike KVSSetCASMulti, the operations are not
+// conditional, so the batch only fails on an error.
+func (s *StateStore) KVSBatch(index uint64, ops structs.KVSBatchOps) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	for _, op := range ops {
+		if op == nil {
+			return fmt.Errorf("Missing KVS batch operation")
+		}
+		switch op.Op {
+		case structs.KVSSet:
+			_, err = s.kvsSetTxn(index, tx, &op.DirEnt, kvSet)
+		case structs.KVSDelete:
+			err = s.kvsDeleteWithIndexTxn(index, tx, "id", op.DirEnt.Namespace, op.DirEnt.Key)
+		case structs.KVSDeleteTree:
+			if op.DirEnt.Key == "" {
+				err = s.kvsDeleteWithIndexTxn(index, tx, "id", op.DirEnt.Namespace)
+			} else {
+				err = s.kvsDeleteWithIndexTxn(index, tx, "id_prefix", op.DirEnt.Namespace, op.DirEnt.Key)
+			}
+		default:
+			err = fmt.Errorf("Invalid KVS batch operation '%s'", op.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// KVSImport is used to import entries under an empty prefix, keeping
+// their original create and modify indexes, so that clients relying on
+// the indexes of a migrated tree, such as for check-and-set, keep working.
+// The import fails if any key exists under the prefix, or if an entry was
+// modified at or after the given index, since a later write could then
+// reuse the index of an entry and break check-and-set. The indexes of the
+// table still advance to the given index, to notify the watchers.
+// Sessions do not carry over, so the imported keys are unlocked.
+func (s *StateStore) KVSImport(index uint64, prefix string, entries structs.DirEntries) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	// Guard against overwriting existing keys
+	res, err := s.kvsTable.GetTxn(tx, "id_prefix", "", prefix)
+	if err != nil {
+		return err
+	}
+	if len(res) > 0 {
+		return fmt.Errorf("Cannot import into prefix '%s', it has %d existing keys", prefix, len(res))
+	}
+
+	for _, ent := range entries {
+		if err := validateKVSImport(prefix, ent); err != nil {
+			return err
+		}
+		if ent.ModifyIndex >= index {
+			return fmt.Errorf("Cannot import '%s' with modify index %d, it is not below the index %d of the import",
+				ent.Key, ent.ModifyIndex, index)
+		}
+		d := *ent
+		d.Session = ""
+		if err := s.kvsTable.InsertTxn(tx, &d); err != nil {
+			return err
+		}
+		if err := s.recordKVSChangeTxn(index, tx, "", d.Key, structs.ChangeSet); err != nil {
+			return err
+		}
+		key := d.Key
+		tx.Defer(func() { s.notifyKV(key, false) })
+	}
+	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// validateKVSImport checks that an entry to import is under the prefix
+// of the import, and has valid indexes
+func validateKVSImport(prefix string, d *structs.DirEntry) error {
+	if d.Namespace != "" {
+		return fmt.Errorf("Cannot import '%s' from KV namespace '%s'", d.Key, d.Namespace)
+	}
+	if d.Key == "" || !strings.HasPrefix(d.Key, prefix) {
+		return fmt.Errorf("Cannot import '%s', it is not under prefix '%s'", d.Key, prefix)
+	}
+	if d.CreateIndex == 0 || d.ModifyIndex < d.CreateIndex {
+		return fmt.Errorf("Cannot import '%s' with create index %d and modify index %d",
+			d.Key, d.CreateIndex, d.ModifyIndex)
+	}
+	return nil
+}
+
+// kvsSet is the internal setter
+func (s *StateStore) kvsSet(
+	index uint64,
+	d *structs.DirEntry,
+	mode kvMode) (bool, error) {
+	// Start a new txn
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Abort()
+
+	if ok, err := s.kvsSetTxn(index, tx, d, mode); !ok || err != nil {
+		return ok, err
+	}
+	return true, tx.Commit()
+}
+
+// kvsSetTxn is the internal setter within an existing transaction
+func (s *StateStore) kvsSetTxn(
+	index uint64,
+	tx *MDBTxn,
+	d *structs.DirEntry,
+	mode kvMode) (bool, error) {
+	// Locks are only supported in the default namespace, since the lock
+	// delays and queues are tracked by key
+	if (mode == kvLock || mode == kvUnlock) && d.Namespace != "" {
+		return false, fmt.Errorf("Locks are not supported in KV namespaces")
+	}
+
+	// Get the existing node
+	res, err := s.kvsTable.GetTxn(tx, "id", d.Namespace, d.Key)
+	if err != nil {
+		return false, err
+	}
+
+	// Get the existing node if any
+	var exist *structs.DirEntry
+	if len(res) > 0 {
+		exist = res[0].(*structs.DirEntry)
+	}
+
+	// Use the ModifyIndex as the constraint. A modify of time of 0
+	// means we are doing a set-if-not-exists, while any other value
+	// means we expect that modify time.
+	if mode == kvCAS {
+		if d.ModifyIndex == 0 && exist != nil {
+			return false, nil
+		} else if d.ModifyIndex > 0 && (exist == nil || exist.ModifyIndex != d.ModifyIndex) {
+			return false, nil
+		}
+	}
 
-	// Delete the old watch groups
-	for i := len(toDelete) - 1; i >= 0; i-- {
-		s.kvWatch.Delete(toDelete[i])
+	// If attempting to lock, check this is possible
+	if mode == kvLock {
+		// Verify we have a session
+		if d.Session == "" {
+			return false, structs.ErrMissingSession
+		}
+
+		// Bail if it is already locked
+		if exist != nil && exist.Session != "" {
+			return false, nil
+		}
+
+		// Verify the session exists
+		res, err := s.sessionTable.GetTxn(tx, "id", d.Session)
+		if err != nil {
+			return false, err
+		}
+		if len(res) == 0 {
+			return false, structs.ErrInvalidSession
+		}
+
+		// Queued sessions take precedence over other contenders
+		waiters, err := s.lockWaitersTxn(tx, d.Key)
+		if err != nil {
+			return false, err
+		}
+		if len(waiters) > 0 {
+			if waiters[0].Session != d.Session {
+				return false, nil
+			}
+			if _, err := s.lockWaiterTable.DeleteTxn(tx, "id", d.Key, d.Session); err != nil {
+				return false, err
+			}
+			if err := s.lockWaiterTable.SetLastIndexTxn(tx, index); err != nil {
+				return false, err
+			}
+			tx.Defer(func() { s.watch[s.lockWaiterTable].Notify() })
+		}
+
+		// Update the lock index
+		if exist != nil {
+			exist.LockIndex++
+			exist.Session = d.Session
+		} else {
+			d.LockIndex = 1
+		}
+	}
+
+	// If attempting to unlock, verify the key exists and is held
+	if mode == kvUnlock {
+		if exist == nil || exist.Session != d.Session {
+			return false, nil
+		}
+		// Clear the session to unlock
+		exist.Session = ""
+	}
+
+	// Set the create and modify times
+	if exist == nil {
+		d.CreateIndex = index
+	} else {
+		d.CreateIndex = exist.CreateIndex
+		d.LockIndex = exist.LockIndex
+		d.Session = exist.Session
+
+	}
+	d.ModifyIndex = index
+
+	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
+		return false, err
+	}
+	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+		return false, err
+	}
+	if d.Namespace != "" {
+		if err := s.setKVSNamespaceIndexTxn(tx, d.Namespace, index); err != nil {
+			return false, err
+		}
+	}
+	if err := s.recordKVSChangeTxn(index, tx, d.Namespace, d.Key, structs.ChangeSet); err != nil {
+		return false, err
+	}
+	tx.Defer(func() { s.notifyKV(d.Key, false) })
+
+	// Hand the lock over to the next queued session
+	if mode == kvUnlock {
+		if err := s.grantLockTxn(index, tx, d.Key); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ReapTombstones is used to delete all the tombstones with a ModifyTime
+// less than or equal to the given index. This is used to prevent unbounded
+// storage growth of the tombstones.
+func (s *StateStore) ReapTombstones(index uint64) error {
+	return s.reapTombstones(index, "id")
+}
+
+// ReapTombstonesPrefix is like ReapTombstones, but only deletes the
+// tombstones under the given prefix. This allows hot prefixes with heavy
+// delete churn, such as ephemeral election keys, to be compacted more
+// aggressively than the TTL that protects the rest of the keyspace.
+func (s *StateStore) ReapTombstonesPrefix(index uint64, prefix string) error {
+	if prefix == "" {
+		return s.reapTombstones(index, "id")
+	}
+	return s.reapTombstones(index, "id_prefix", "", prefix)
+}
+
+// reapTombstones does a reap with either the id or id_prefix index
+func (s *StateStore) reapTombstones(index uint64, tableIndex string, parts ...string) error {
+	tables := MDBTables{s.tombstoneTable, s.prefixTombTable}
+	tx, err := tables.StartTxn(false)
+	if err != nil {
+		return fmt.Errorf("failed to start txn: %v", err)
+	}
+	defer tx.Abort()
+
+	// Scan the tombstone table for all the entries that are
+	// eligible for GC. This could be improved by indexing on
+	// ModifyTime and doing a less-than-equals scan, however
+	// we don't currently support numeric indexes internally.
+	// Luckily, this is a low frequency operation.
+	var toDelete [][2]string
+	streamCh := make(chan interface{}, 128)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for raw := range streamCh {
+			ent := raw.(*structs.DirEntry)
+			if ent.ModifyIndex <= index {
+				toDelete = append(toDelete, [2]string{ent.Namespace, ent.Key})
+			}
+		}
+	}()
+	if err := s.tombstoneTable.StreamTxn(streamCh, tx, tableIndex, parts...); err != nil {
+		s.logger.Error("Failed to scan tombstones", logError(err))
+		return fmt.Errorf("failed to scan tombstones: %v", err)
+	}
+	<-doneCh
+
+	// Delete each tombstone
+	if len(toDelete) > 0 {
+		s.logger.Debug("Reaping tombstones", logField("count", len(toDelete)), logIndex(index))
+	}
+	for _, id := range toDelete {
+		key := id[1]
+		num, err := s.tombstoneTable.DeleteTxn(tx, "id", id[0], key)
+		if err != nil {
+			s.logger.Error("Failed to delete tombstone", logField("key", key), logError(err))
+			return fmt.Errorf("failed to delete tombstone: %v", err)
+		}
+		if num != 1 {
+			return fmt.Errorf("failed to delete tombstone '%s'", key)
+		}
+	}
+
+	// Delete the prefix tombstones under the prefix
+	res, err := s.prefixTombTable.GetTxn(tx, "id")
+	if err != nil {
+		return fmt.Errorf("failed to scan prefix tombstones: %v", err)
+	}
+	for _, r := range res {
+		tomb := r.(*structs.PrefixTombstone)
+		if tomb.ModifyIndex > index {
+			continue
+		}
+		if len(parts) > 1 && !strings.HasPrefix(tomb.Prefix, parts[1]) {
+			continue
+		}
+		if _, err := s.prefixTombTable.DeleteTxn(tx, "id", tomb.Prefix); err != nil {
+			return fmt.Errorf("failed to delete prefix tombstone: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// TombstoneRestore is used to restore a tombstone. It should only be
+// used when doing a restore. Restoring many tombstones is faster through
+// a StateRestore.
+func (s *StateStore) TombstoneRestore(d *structs.DirEntry) error {
+	r := s.Restore()
+	defer r.Abort()
+	if err := r.Tombstone(d); err != nil {
+		return err
+	}
+	return r.Commit()
+}
+
+// PrefixTombstoneRestore is used to restore a prefix tombstone.
+// It should only be used when doing a restore.
+func (s *StateStore) PrefixTombstoneRestore(tomb *structs.PrefixTombstone) error {
+	// Start a new txn
+	tx, err := s.prefixTombTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.prefixTombTable.InsertTxn(tx, tomb); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SessionCreate is used to create a new session. The
+// ID will be populated on a successful return
+func (s *StateStore) SessionCreate(index uint64, session *structs.Session) error {
+	// Verify a Session ID is generated
+	if session.ID == "" {
+		return fmt.Errorf("Missing Session ID")
+	}
+
+	// Start the transaction
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	// Apply the session defaults of the cluster
+	conf, err := s.clusterConfigTxn(tx)
+	if err != nil {
+		return err
+	}
+	switch session.Behavior {
+	case "":
+		// Default behavior is Release for backwards compatibility,
+		// unless the cluster config sets one
+		session.Behavior = structs.SessionKeysRelease
+		if conf.SessionBehavior != "" {
+			session.Behavior = conf.SessionBehavior
+		}
+	case structs.SessionKeysRelease:
+	case structs.SessionKeysDelete:
+	default:
+		return structs.NewError(structs.ErrCodeInvalidSessionBehavior,
+			structs.ErrMsgInvalidSessionBehavior, session.Behavior)
+	}
+	session.LockDelay = sessionLockDelay(session.LockDelay, conf)
+
+	// Assign the create index
+	session.CreateIndex = index
+
+	// Verify the node and checks
+	if err := s.validateSessionTxn(tx, session); err != nil {
+		return err
+	}
+
+	// Insert the session
+	if err := s.sessionTable.InsertTxn(tx, session); err != nil {
+		return err
+	}
+
+	// Insert the check mappings
+	for _, sCheck := range sessionCheckMappings(session) {
+		if err := s.sessionCheckTable.InsertTxn(tx, sCheck); err != nil {
+			return err
+		}
+	}
+
+	// Trigger the update notifications
+	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(index, tx, dbSessions, session.ID, structs.ChangeSet); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
+	return tx.Commit()
+}
+
+// validateSessionTxn is used to verify that the node of a session exists,
+// and that the checks it is bound to exist and are not critical
+func (s *StateStore) validateSessionTxn(tx *MDBTxn, session *structs.Session) error {
+	// Verify that the node exists, and use its registered name so the
+	// session is found by the node
+	res, err := s.nodeTable.GetTxn(tx, "id", session.Node)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return structs.ErrMissingNode
+	}
+	session.Node = res[0].(*structs.Node).Node
+
+	// Verify that the checks exist and are not critical
+	for _, checkId := range session.Checks {
+		res, err := s.checkTable.GetTxn(tx, "id", session.Node, checkId, "")
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return structs.NewError(structs.ErrCodeMissingCheck, structs.ErrMsgMissingCheck, checkId)
+		}
+		chk := res[0].(*structs.HealthCheck)
+		if chk.Status == structs.HealthCritical {
+			return structs.NewError(structs.ErrCodeCheckCritical, structs.ErrMsgCheckCritical, checkId, chk.Status)
+		}
+	}
+
+	// Verify that the service checks exist, belong to the service,
+	// and are not critical
+	for i := range session.ServiceChecks {
+		sc := &session.ServiceChecks[i]
+		if sc.Node == "" || sc.ServiceID == "" || sc.CheckID == "" {
+			return fmt.Errorf("Service check requires a node, service and check")
+		}
+		if sc.Node, err = s.normalizeNodeTxn(tx, sc.Node); err != nil {
+			return err
+		}
+		if sc.Node == session.Node && strContains(session.Checks, sc.CheckID) {
+			return fmt.Errorf("Duplicate check '%s'", sc.CheckID)
+		}
+		res, err := s.checkTable.GetTxn(tx, "id", sc.Node, sc.CheckID, "")
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return structs.NewError(structs.ErrCodeMissingCheck,
+				structs.ErrMsgMissingNodeCheck, sc.CheckID, sc.Node)
+		}
+		chk := res[0].(*structs.HealthCheck)
+		if chk.ServiceID != sc.ServiceID {
+			return fmt.Errorf("Check '%s' is not a check of service '%s'", sc.CheckID, sc.ServiceID)
+		}
+		if chk.Status == structs.HealthCritical {
+			return structs.NewError(structs.ErrCodeCheckCritical, structs.ErrMsgCheckCritical, sc.CheckID, chk.Status)
+		}
+	}
+	return nil
+}
+
+// sessionCheckMappings returns the check mappings of a session, covering
+// both its node checks and its service checks
+func sessionCheckMappings(session *structs.Session) []*sessionCheck {
+	out := make([]*sessionCheck, 0, len(session.Checks)+len(session.ServiceChecks))
+	for _, checkID := range session.Checks {
+		out = append(out, &sessionCheck{Node: session.Node, CheckID: checkID, Session: session.ID})
+	}
+	for _, sc := range session.ServiceChecks {
+		out = append(out, &sessionCheck{Node: sc.Node, CheckID: sc.CheckID, Session: session.ID})
+	}
+	return out
+}
+
+// SessionRestore is used to restore a session. It should only be used when
+// doing a restore, otherwise SessionCreate should be used. Restoring many
+// sessions is faster through a StateRestore.
+func (s *StateStore) SessionRestore(session *structs.Session) error {
+	r := s.Restore()
+	defer r.Abort()
+	if err := r.Session(session); err != nil {
+		return err
+	}
+	return r.Commit()
+}
+
+// SessionGet is used to get a session entry
+func (s *StateStore) SessionGet(id string) (uint64, *structs.Session, error) {
+	idx, out, err := s.getSessions("id", id)
+	var d *structs.Session
+	if len(out) > 0 {
+		d = out[0]
 	}
+	return idx, d, err
 }
 
-// QueryTables returns the Tables that are queried for a given query
-func (s *StateStore) QueryTables(q string) MDBTables {
-	return s.queryTables[q]
+// SessionList is used to list all the open sessions
+func (s *StateStore) SessionList() (uint64, []*structs.Session, error) {
+	return s.getSessions("id")
 }
 
-// EnsureRegistration is used to make sure a node, service, and check registration
-// is performed within a single transaction to avoid race conditions on state updates.
-func (s *StateStore) EnsureRegistration(index uint64, req *structs.RegisterRequest) error {
+// NodeSessions is used to list all the open sessions for a node
+func (s *StateStore) NodeSessions(node string) (uint64, []*structs.Session, error) {
+	return s.getSessions("node", node)
+}
+
+// getSessions is used to lookup sessions, counting the keys locked by
+// each of them. The locks are read in the same transaction, but the
+// tables watched by the session queries do not include the KV store,
+// since waking them on every KV write would be too expensive. The
+// counts are only refreshed when the sessions themselves change.
+func (s *StateStore) getSessions(index string, parts ...string) (uint64, []*structs.Session, error) {
+	tables := MDBTables{s.sessionTable, s.kvsTable}
+	tx, err := tables.StartTxn(true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Abort()
+
+	idx, err := s.sessionTable.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := s.sessionTable.GetTxn(tx, index, parts...)
+	if err != nil {
+		return idx, nil, err
+	}
+
+	out := make([]*structs.Session, len(res))
+	for i, raw := range res {
+		session := raw.(*structs.Session)
+		locks, err := s.kvsTable.GetTxn(tx, "session", session.ID)
+		if err != nil {
+			return idx, nil, err
+		}
+		session.LockCount = len(locks)
+		out[i] = session
+	}
+	return idx, out, nil
+}
+
+// SessionDestroy is used to destroy a session.
+func (s *StateStore) SessionDestroy(index uint64, id string) error {
 	tx, err := s.tables.StartTxn(false)
 	if err != nil {
 		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
 	defer tx.Abort()
 
-	// Ensure the node
-	node := structs.Node{req.Node, req.Address}
-	if err := s.ensureNodeTxn(index, node, tx); err != nil {
+	s.logger.Debug("Invalidating session due to session destroy", logField("session", id))
+	if err := s.invalidateSession(index, tx, id); err != nil {
 		return err
 	}
+	return tx.Commit()
+}
 
-	// Ensure the service if provided
-	if req.Service != nil {
-		if err := s.ensureServiceTxn(index, req.Node, req.Service, tx); err != nil {
+// invalidateNode is used to invalidate all sessions belonging to a node
+// All tables should be locked in the tx.
+func (s *StateStore) invalidateNode(index uint64, tx *MDBTxn, node string) error {
+	sessions, err := s.sessionTable.GetTxn(tx, "node", node)
+	if err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		session := sess.(*structs.Session).ID
+		s.logger.Debug("Invalidating session due to node invalidation",
+			logField("session", session), logField("node", node))
+		if err := s.invalidateSession(index, tx, session); err != nil {
 			return err
 		}
 	}
 
-	// Ensure the check(s), if provided
-	if req.Check != nil {
-		if err := s.ensureCheckTxn(index, req.Check, tx); err != nil {
+	// Invalidate any sessions of other nodes bound to service
+	// checks of this node
+	sessionChecks, err := s.sessionCheckTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return err
+	}
+	for _, sc := range sessionChecks {
+		session := sc.(*sessionCheck).Session
+		s.logger.Debug("Invalidating session due to node invalidation",
+			logField("session", session), logField("node", node))
+		if err := s.invalidateSession(index, tx, session); err != nil {
 			return err
 		}
 	}
-	for _, check := range req.Checks {
-		if err := s.ensureCheckTxn(index, check, tx); err != nil {
+	return nil
+}
+
+// invalidateCheck is used to invalidate all sessions belonging to a check
+// All tables should be locked in the tx.
+func (s *StateStore) invalidateCheck(index uint64, tx *MDBTxn, node, check string) error {
+	sessionChecks, err := s.sessionCheckTable.GetTxn(tx, "id", node, check)
+	if err != nil {
+		return err
+	}
+	for _, sc := range sessionChecks {
+		session := sc.(*sessionCheck).Session
+		s.logger.Debug("Invalidating session due to check invalidation",
+			logField("session", session), logField("check", check))
+		if err := s.invalidateSession(index, tx, session); err != nil {
 			return err
 		}
 	}
-
-	// Commit as one unit
-	return tx.Commit()
+	return nil
 }
 
-// EnsureNode is used to ensure a given node exists, with the provided address
-func (s *StateStore) EnsureNode(index uint64, node structs.Node) error {
-	tx, err := s.nodeTable.StartTxn(false, nil)
+// invalidateSession is used to invalidate a session within a given txn
+// All tables should be locked in the tx.
+func (s *StateStore) invalidateSession(index uint64, tx *MDBTxn, id string) error {
+	// Get the session
+	res, err := s.sessionTable.GetTxn(tx, "id", id)
 	if err != nil {
 		return err
 	}
-	defer tx.Abort()
-	if err := s.ensureNodeTxn(index, node, tx); err != nil {
+
+	// Quit if this session does not exist
+	if len(res) == 0 {
+		return nil
+	}
+	session := res[0].(*structs.Session)
+
+	// Enforce the lock-delay bounds, which may have changed since
+	// the session was created
+	conf, err := s.clusterConfigTxn(tx)
+	if err != nil {
 		return err
 	}
-	return tx.Commit()
-}
+	delay := sessionLockDelay(session.LockDelay, conf)
 
-// ensureNodeTxn is used to ensure a given node exists, with the provided address
-// within a given txn
-func (s *StateStore) ensureNodeTxn(index uint64, node structs.Node, tx *MDBTxn) error {
-	if err := s.nodeTable.InsertTxn(tx, node); err != nil {
+	// Notify the handler of the invalidation
+	if handler := s.sessionHandler; handler != nil {
+		event := &structs.SessionInvalidation{
+			Index:    index,
+			Session:  id,
+			Name:     session.Name,
+			Node:     session.Node,
+			Behavior: session.Behavior,
+		}
+		tx.Defer(func() { handler(event) })
+	}
+
+	// Remove the session from the lock queues before releasing its
+	// locks, so none of them can be handed back to it
+	if n, err := s.lockWaiterTable.DeleteTxn(tx, "session", id); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.lockWaiterTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.lockWaiterTable].Notify() })
+	}
+
+	// Invalidate any held locks
+	if session.Behavior == structs.SessionKeysDelete {
+		if err := s.deleteLocks(index, tx, delay, id); err != nil {
+			return err
+		}
+	} else if err := s.invalidateLocks(index, tx, delay, id); err != nil {
 		return err
 	}
-	if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
+
+	// Nuke the session
+	if _, err := s.sessionTable.DeleteTxn(tx, "id", id); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.nodeTable].Notify() })
+
+	// Delete the check mappings
+	if _, err := s.sessionCheckTable.DeleteTxn(tx, "session", id); err != nil {
+		return err
+	}
+
+	// Trigger the update notifications
+	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(index, tx, dbSessions, id, structs.ChangeDelete); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
 	return nil
 }
 
-// GetNode returns all the address of the known and if it was found
-func (s *StateStore) GetNode(name string) (uint64, bool, string) {
-	idx, res, err := s.nodeTable.Get("id", name)
+// invalidateLocks is used to invalidate all the locks held by a session
+// within a given txn. All tables should be locked in the tx.
+func (s *StateStore) invalidateLocks(index uint64, tx *MDBTxn,
+	lockDelay time.Duration, id string) error {
+	pairs, err := s.kvsTable.GetTxn(tx, "session", id)
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Error during node lookup: %v", err)
-		return 0, false, ""
+		return err
 	}
-	if len(res) == 0 {
-		return idx, false, ""
+
+	var expires time.Time
+	if lockDelay > 0 {
+		s.lockDelayLock.Lock()
+		defer s.lockDelayLock.Unlock()
+		expires = s.now().Add(lockDelay)
 	}
-	return idx, true, res[0].(*structs.Node).Address
+
+	for _, pair := range pairs {
+		kv := pair.(*structs.DirEntry)
+		kv.Session = ""        // Clear the lock
+		kv.ModifyIndex = index // Update the modified time
+		if err := s.kvsTable.InsertTxn(tx, kv); err != nil {
+			return err
+		}
+		if err := s.recordKVSChangeTxn(index, tx, kv.Namespace, kv.Key, structs.ChangeSet); err != nil {
+			return err
+		}
+		// If there is a lock delay, prevent acquisition
+		// for at least lockDelay period
+		if lockDelay > 0 {
+			s.lockDelay[kv.Key] = expires
+			time.AfterFunc(lockDelay, func() {
+				s.lockDelayLock.Lock()
+				delete(s.lockDelay, kv.Key)
+				s.lockDelayLock.Unlock()
+			})
+		}
+		tx.Defer(func() { s.notifyKV(kv.Key, false) })
+	}
+	if len(pairs) > 0 {
+		if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+	}
+
+	// Without a lock delay, the locks are handed over to the queued
+	// sessions. Otherwise the waiters must retry once the delay expires,
+	// and queued sessions still take precedence when they do.
+	if lockDelay == 0 {
+		for _, pair := range pairs {
+			if err := s.grantLockTxn(index, tx, pair.(*structs.DirEntry).Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// GetNodes returns all the known nodes, the slice alternates between
-// the node name and address
-func (s *StateStore) Nodes() (uint64, structs.Nodes) {
-	idx, res, err := s.nodeTable.Get("id")
+// deleteLocks is used to delete all the locks held by a session
+// within a given txn. All tables should be locked in the tx.
+func (s *StateStore) deleteLocks(index uint64, tx *MDBTxn,
+	lockDelay time.Duration, id string) error {
+	pairs, err := s.kvsTable.GetTxn(tx, "session", id)
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Error getting nodes: %v", err)
+		return err
 	}
-	results := make([]structs.Node, len(res))
-	for i, r := range res {
-		results[i] = *r.(*structs.Node)
+
+	var expires time.Time
+	if lockDelay > 0 {
+		s.lockDelayLock.Lock()
+		defer s.lockDelayLock.Unlock()
+		expires = s.now().Add(lockDelay)
 	}
-	return idx, results
+
+	for _, pair := range pairs {
+		kv := pair.(*structs.DirEntry)
+		if err := s.kvsDeleteWithIndexTxn(index, tx, "id", kv.Namespace, kv.Key); err != nil {
+			return err
+		}
+
+		// If there is a lock delay, prevent acquisition
+		// for at least lockDelay period
+		if lockDelay > 0 {
+			s.lockDelay[kv.Key] = expires
+			time.AfterFunc(lockDelay, func() {
+				s.lockDelayLock.Lock()
+				delete(s.lockDelay, kv.Key)
+				s.lockDelayLock.Unlock()
+			})
+		}
+	}
+	return nil
 }
 
-// EnsureService is used to ensure a given node exposes a service
-func (s *StateStore) EnsureService(index uint64, node string, ns *structs.NodeService) error {
+// ACLSet is used to create or update an ACL entry
+func (s *StateStore) ACLSet(index uint64, acl *structs.ACL) error {
+	// Check for an ID
+	if acl.ID == "" {
+		return fmt.Errorf("Missing ACL ID")
+	}
+
+	// Start a new txn
 	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
-	if err := s.ensureServiceTxn(index, node, ns, tx); err != nil {
-		return nil
+
+	// Look for the existing node
+	res, err := s.aclTable.GetTxn(tx, "id", acl.ID)
+	if err != nil {
+		return err
+	}
+
+	// The usage of the token is kept in its own table
+	acl.LastUsedIndex = 0
+	acl.LastUsedTime = time.Time{}
+
+	switch len(res) {
+	case 0:
+		acl.CreateIndex = index
+		acl.ModifyIndex = index
+	case 1:
+		exist := res[0].(*structs.ACL)
+		acl.CreateIndex = exist.CreateIndex
+		acl.ModifyIndex = index
+	default:
+		panic(fmt.Errorf("Duplicate ACL definition. Internal error"))
 	}
-	return tx.Commit()
-}
 
-// ensureServiceTxn is used to ensure a given node exposes a service in a transaction
-func (s *StateStore) ensureServiceTxn(index uint64, node string, ns *structs.NodeService, tx *MDBTxn) error {
-	// Ensure the node exists
-	res, err := s.nodeTable.GetTxn(tx, "id", node)
-	if err != nil {
+	// Insert the ACL
+	if err := s.aclTable.InsertTxn(tx, acl); err != nil {
 		return err
 	}
-	if len(res) == 0 {
-		return fmt.Errorf("Missing node registration")
-	}
 
-	// Create the entry
-	entry := structs.ServiceNode{
-		Node:           node,
-		ServiceID:      ns.ID,
-		ServiceName:    ns.Service,
-		ServiceTags:    ns.Tags,
-		ServiceAddress: ns.Address,
-		ServicePort:    ns.Port,
+	// Trigger the update notifications
+	if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
 	}
-
-	// Ensure the service entry is set
-	if err := s.serviceTable.InsertTxn(tx, &entry); err != nil {
+	if err := s.recordChangeTxn(index, tx, dbACLs, acl.ID, structs.ChangeSet); err != nil {
 		return err
 	}
-	if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+	tx.Defer(func() { s.watch[s.aclTable].Notify() })
+	return tx.Commit()
+}
+
+// ACLRestore is used to restore an ACL. It should only be used when
+// doing a restore, otherwise ACLSet should be used. Restoring many ACLs
+// is faster through a StateRestore.
+func (s *StateStore) ACLRestore(acl *structs.ACL) error {
+	r := s.Restore()
+	defer r.Abort()
+	if err := r.ACL(acl); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.serviceTable].Notify() })
-	return nil
+	return r.Commit()
 }
 
-// NodeServices is used to return all the services of a given node
-func (s *StateStore) NodeServices(name string) (uint64, *structs.NodeServices) {
-	tables := s.queryTables["NodeServices"]
-	tx, err := tables.StartTxn(true)
+// ACLRestoreTable is used to restore ACLs from a snapshot into the live
+// store. Unlike ACLRestore, the ACLs are written at the given index so
+// that watchers and blocking queries observe the change. If reset is
+// set, all the existing ACLs are deleted first.
+func (s *StateStore) ACLRestoreTable(index uint64, reset bool, acls structs.ACLs) error {
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
-	return s.parseNodeServices(tables, tx, name)
-}
 
-// parseNodeServices is used to get the services belonging to a
-// node, using a given txn
-func (s *StateStore) parseNodeServices(tables MDBTables, tx *MDBTxn, name string) (uint64, *structs.NodeServices) {
-	ns := &structs.NodeServices{
-		Services: make(map[string]*structs.NodeService),
+	if reset {
+		res, err := s.aclTable.GetTxn(tx, "id")
+		if err != nil {
+			return err
+		}
+		for _, raw := range res {
+			id := raw.(*structs.ACL).ID
+			if _, err := s.aclTable.DeleteTxn(tx, "id", id); err != nil {
+				return err
+			}
+			if _, err := s.aclUsageTable.DeleteTxn(tx, "id", id); err != nil {
+				return err
+			}
+			if err := s.recordChangeTxn(index, tx, dbACLs, id, structs.ChangeDelete); err != nil {
+				return err
+			}
+		}
+	}
+	for _, acl := range acls {
+		if acl.ID == "" {
+			return fmt.Errorf("Missing ACL ID")
+		}
+		a := *acl
+		a.CreateIndex = index
+		a.ModifyIndex = index
+		if err := s.aclTable.InsertTxn(tx, &a); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbACLs, a.ID, structs.ChangeSet); err != nil {
+			return err
+		}
 	}
 
-	// Get the maximum index
-	index, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+	if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
 	}
+	tx.Defer(func() { s.watch[s.aclTable].Notify() })
+	return tx.Commit()
+}
 
-	// Get the node first
-	res, err := s.nodeTable.GetTxn(tx, "id", name)
-	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get node: %v", err)
+// ACLGet is used to get an ACL by ID
+func (s *StateStore) ACLGet(id string) (uint64, *structs.ACL, error) {
+	idx, res, err := s.aclTable.Get("id", id)
+	var d *structs.ACL
+	if len(res) > 0 {
+		d = res[0].(*structs.ACL)
 	}
-	if len(res) == 0 {
-		return index, nil
+	if err == nil && d != nil {
+		err = s.aclUsageFill([]*structs.ACL{d})
 	}
+	return idx, d, err
+}
 
-	// Set the address
-	node := res[0].(*structs.Node)
-	ns.Node = *node
-
-	// Get the services
-	res, err = s.serviceTable.GetTxn(tx, "id", name)
-	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get node '%s' services: %v", name, err)
+// ACLList is used to list all the acls
+func (s *StateStore) ACLList() (uint64, []*structs.ACL, error) {
+	idx, res, err := s.aclTable.Get("id")
+	out := make([]*structs.ACL, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ACL)
 	}
-
-	// Add each service
-	for _, r := range res {
-		service := r.(*structs.ServiceNode)
-		srv := &structs.NodeService{
-			ID:      service.ServiceID,
-			Service: service.ServiceName,
-			Tags:    service.ServiceTags,
-			Address: service.ServiceAddress,
-			Port:    service.ServicePort,
-		}
-		ns.Services[srv.ID] = srv
+	if err == nil {
+		err = s.aclUsageFill(out)
 	}
-	return index, ns
+	return idx, out, err
 }
 
-// DeleteNodeService is used to delete a node service
-func (s *StateStore) DeleteNodeService(index uint64, node, id string) error {
-	tx, err := s.tables.StartTxn(false)
+// aclUsageFill is used to set when the given ACLs were last used. ACLs
+// without a recorded use keep the usage they carry, which is only set
+// for the ACLs restored from older snapshots.
+func (s *StateStore) aclUsageFill(acls []*structs.ACL) error {
+	tx, err := s.aclUsageTable.StartTxn(true, nil)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
 
-	if n, err := s.serviceTable.DeleteTxn(tx, "id", node, id); err != nil {
-		return err
-	} else if n > 0 {
-		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+	for _, acl := range acls {
+		res, err := s.aclUsageTable.GetTxn(tx, "id", acl.ID)
+		if err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
+		if len(res) == 0 {
+			continue
+		}
+		usage := res[0].(*structs.ACLUsage)
+		acl.LastUsedIndex = usage.LastUsedIndex
+		acl.LastUsedTime = usage.LastUsedTime
 	}
+	return nil
+}
 
-	// Invalidate any sessions using these checks
-	checks, err := s.checkTable.GetTxn(tx, "node", node, id)
+// ACLUsage is used to record the use of the given tokens. The use is
+// kept in its own table, so the ACL table and its watchers are not
+// disturbed, and tokens that no longer exist are ignored.
+func (s *StateStore) ACLUsage(index uint64, ids []string) error {
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
 		return err
 	}
-	for _, c := range checks {
-		check := c.(*structs.HealthCheck)
-		if err := s.invalidateCheck(index, tx, node, check.CheckID); err != nil {
+	defer tx.Abort()
+
+	now := s.now()
+	updated := false
+	for _, id := range ids {
+		res, err := s.aclTable.GetTxn(tx, "id", id)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			continue
+		}
+		usage := &structs.ACLUsage{
+			ID:            id,
+			LastUsedIndex: index,
+			LastUsedTime:  now,
+		}
+		if err := s.aclUsageTable.InsertTxn(tx, usage); err != nil {
 			return err
 		}
+		updated = true
 	}
 
-	if n, err := s.checkTable.DeleteTxn(tx, "node", node, id); err != nil {
-		return err
-	} else if n > 0 {
-		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+	if updated {
+		if err := s.aclUsageTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+		tx.Defer(func() { s.watch[s.aclUsageTable].Notify() })
 	}
 	return tx.Commit()
 }
 
-// DeleteNode is used to delete a node and all it's services
-func (s *StateStore) DeleteNode(index uint64, node string) error {
-	tx, err := s.tables.StartTxn(false)
+// ACLUsageRestore is used to restore when a token was last used. It
+// should only be used when doing a restore.
+func (s *StateStore) ACLUsageRestore(usage *structs.ACLUsage) error {
+	// Start a new txn
+	tx, err := s.aclUsageTable.StartTxn(false, nil)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
 
-	// Invalidate any sessions held by the node
-	if err := s.invalidateNode(index, tx, node); err != nil {
+	if err := s.aclUsageTable.InsertTxn(tx, usage); err != nil {
+		return err
+	}
+	if err := s.aclUsageTable.SetMaxLastIndexTxn(tx, usage.LastUsedIndex); err != nil {
 		return err
 	}
+	return tx.Commit()
+}
+
+// ACLDelete is used to remove an ACL
+func (s *StateStore) ACLDelete(index uint64, id string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
 
-	if n, err := s.serviceTable.DeleteTxn(tx, "id", node); err != nil {
+	if n, err := s.aclTable.DeleteTxn(tx, "id", id); err != nil {
 		return err
 	} else if n > 0 {
-		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.serviceTable].Notify() })
-	}
-	if n, err := s.checkTable.DeleteTxn(tx, "id", node); err != nil {
-		return err
-	} else if n > 0 {
-		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := s.recordChangeTxn(index, tx, dbACLs, id, structs.ChangeDelete); err != nil {
 			return err
 		}
-		tx.Defer(func() { s.watch[s.checkTable].Notify() })
+		tx.Defer(func() { s.watch[s.aclTable].Notify() })
 	}
-	if n, err := s.nodeTable.DeleteTxn(tx, "id", node); err != nil {
+	if _, err := s.aclUsageTable.DeleteTxn(tx, "id", id); err != nil {
 		return err
-	} else if n > 0 {
-		if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
-			return err
-		}
-		tx.Defer(func() { s.watch[s.nodeTable].Notify() })
 	}
 	return tx.Commit()
 }
 
-// Services is used to return all the services with a list of associated tags
-func (s *StateStore) Services() (uint64, map[string][]string) {
-	services := make(map[string][]string)
-	idx, res, err := s.serviceTable.Get("id")
-	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get services: %v", err)
-		return idx, services
-	}
-	for _, r := range res {
-		srv := r.(*structs.ServiceNode)
-		tags, ok := services[srv.ServiceName]
-		if !ok {
-			services[srv.ServiceName] = make([]string, 0)
-		}
+// ACLClone is used to create a copy of an ACL with a new ID. The copy
+// has the same name, type and rules as the original.
+func (s *StateStore) ACLClone(index uint64, id, newID string) error {
+	return s.aclCopy(index, id, newID, false, time.Time{})
+}
 
-		for _, tag := range srv.ServiceTags {
-			if !strContains(tags, tag) {
-				tags = append(tags, tag)
-				services[srv.ServiceName] = tags
-			}
-		}
-	}
-	return idx, services
+// ACLRotate is used to move an ACL to a new ID, which allows the secret
+// of a token to be rotated. The name, type, rules and CreateIndex of the
+// ACL are preserved. The old ID remains valid until the given time, so its
+// users can switch to the new ID, or is removed at once if it is zero.
+func (s *StateStore) ACLRotate(index uint64, id, newID string, expires time.Time) error {
+	return s.aclCopy(index, id, newID, true, expires)
 }
 
-// ServiceNodes returns the nodes associated with a given service
-func (s *StateStore) ServiceNodes(service string) (uint64, structs.ServiceNodes) {
-	tables := s.queryTables["ServiceNodes"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+// aclCopy is used to copy an ACL to a new ID, and optionally retire the
+// original in the same transaction, either by expiring or deleting it
+func (s *StateStore) aclCopy(index uint64, id, newID string, move bool, expires time.Time) error {
+	if id == "" || newID == "" {
+		return fmt.Errorf("Missing ACL ID")
 	}
-	defer tx.Abort()
 
-	idx, err := tables.LastIndexTxn(tx)
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+		return err
 	}
+	defer tx.Abort()
 
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
-	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err)
-}
-
-// ServiceTagNodes returns the nodes associated with a given service matching a tag
-func (s *StateStore) ServiceTagNodes(service, tag string) (uint64, structs.ServiceNodes) {
-	tables := s.queryTables["ServiceNodes"]
-	tx, err := tables.StartTxn(true)
+	// Get the original ACL
+	res, err := s.aclTable.GetTxn(tx, "id", id)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
-	defer tx.Abort()
+	if len(res) == 0 {
+		return fmt.Errorf("ACL '%s' not found", id)
+	}
+	exist := res[0].(*structs.ACL)
 
-	idx, err := tables.LastIndexTxn(tx)
+	// Ensure the new ID is not in use
+	res, err = s.aclTable.GetTxn(tx, "id", newID)
 	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+		return err
+	}
+	if len(res) > 0 {
+		return fmt.Errorf("ACL '%s' already exists", newID)
 	}
 
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
-	res = serviceTagFilter(res, tag)
-	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err)
-}
+	acl := &structs.ACL{
+		ID:          newID,
+		Name:        exist.Name,
+		Type:        exist.Type,
+		Rules:       exist.Rules,
+		CreateIndex: index,
+		ModifyIndex: index,
+	}
+	if move {
+		acl.CreateIndex = exist.CreateIndex
+	}
+	if err := s.aclTable.InsertTxn(tx, acl); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(index, tx, dbACLs, newID, structs.ChangeSet); err != nil {
+		return err
+	}
 
-// serviceTagFilter is used to filter a list of *structs.ServiceNode which do
-// not have the specified tag
-func serviceTagFilter(l []interface{}, tag string) []interface{} {
-	n := len(l)
-	for i := 0; i < n; i++ {
-		srv := l[i].(*structs.ServiceNode)
-		if !strContains(ToLowerList(srv.ServiceTags), strings.ToLower(tag)) {
-			l[i], l[n-1] = l[n-1], nil
-			i--
-			n--
+	// Retire the original if moving, and move its usage
+	if move && !expires.IsZero() {
+		old := *exist
+		old.ExpireTime = expires
+		old.ModifyIndex = index
+		if err := s.aclTable.InsertTxn(tx, &old); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbACLs, id, structs.ChangeSet); err != nil {
+			return err
+		}
+	} else if move {
+		if _, err := s.aclTable.DeleteTxn(tx, "id", id); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbACLs, id, structs.ChangeDelete); err != nil {
+			return err
+		}
+	}
+	if move {
+		res, err := s.aclUsageTable.GetTxn(tx, "id", id)
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 {
+			usage := *res[0].(*structs.ACLUsage)
+			usage.ID = newID
+			if err := s.aclUsageTable.InsertTxn(tx, &usage); err != nil {
+				return err
+			}
+			if expires.IsZero() {
+				if _, err := s.aclUsageTable.DeleteTxn(tx, "id", id); err != nil {
+					return err
+				}
+			}
 		}
 	}
-	return l[:n]
+
+	// Trigger the update notifications
+	if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.aclTable].Notify() })
+	return tx.Commit()
 }
 
-// parseServiceNodes parses results ServiceNodes and ServiceTagNodes
-func (s *StateStore) parseServiceNodes(tx *MDBTxn, table *MDBTable, res []interface{}, err error) structs.ServiceNodes {
-	nodes := make(structs.ServiceNodes, len(res))
+// CheckDefinitionSet is used to create or update a server-executed
+// check definition
+func (s *StateStore) CheckDefinitionSet(index uint64, def *structs.CheckDefinition) error {
+	// Start a new txn
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get service nodes: %v", err)
-		return nodes
+		return err
 	}
+	defer tx.Abort()
 
-	for i, r := range res {
-		srv := r.(*structs.ServiceNode)
-
-		// Get the address of the node
-		nodeRes, err := table.GetTxn(tx, "id", srv.Node)
-		if err != nil || len(nodeRes) != 1 {
-			s.logger.Printf("[ERR] consul.state: Failed to join service node %#v with node: %v", *srv, err)
-			continue
-		}
-		srv.Address = nodeRes[0].(*structs.Node).Address
+	// Verify the definition
+	if err := s.validateCheckDefinitionTxn(tx, def); err != nil {
+		return err
+	}
 
-		nodes[i] = *srv
+	// Look for the existing definition
+	res, err := s.checkDefTable.GetTxn(tx, "id", def.Node, def.CheckID)
+	if err != nil {
+		return err
+	}
+	switch len(res) {
+	case 0:
+		def.CreateIndex = index
+		def.ModifyIndex = index
+	case 1:
+		exist := res[0].(*structs.CheckDefinition)
+		def.CreateIndex = exist.CreateIndex
+		def.ModifyIndex = index
+	default:
+		panic(fmt.Errorf("Duplicate check definition. Internal error"))
 	}
 
-	return nodes
-}
+	// Insert the definition
+	if err := s.checkDefTable.InsertTxn(tx, def); err != nil {
+		return err
+	}
 
-// EnsureCheck is used to create a check or updates it's state
-func (s *StateStore) EnsureCheck(index uint64, check *structs.HealthCheck) error {
-	tx, err := s.tables.StartTxn(false)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+	// Trigger the update notifications
+	if err := s.checkDefTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
 	}
-	defer tx.Abort()
-	if err := s.ensureCheckTxn(index, check, tx); err != nil {
+	if err := s.recordChangeTxn(index, tx, dbCheckDefinitions, def.Node+"/"+def.CheckID, structs.ChangeSet); err != nil {
 		return err
 	}
+	tx.Defer(func() { s.watch[s.checkDefTable].Notify() })
 	return tx.Commit()
 }
 
-// ensureCheckTxn is used to create a check or updates it's state in a transaction
-func (s *StateStore) ensureCheckTxn(index uint64, check *structs.HealthCheck, tx *MDBTxn) error {
-	// Ensure we have a status
-	if check.Status == "" {
-		check.Status = structs.HealthCritical
+// validateCheckDefinitionTxn is used to verify a check definition and
+// that the node and service it targets exist. The ServiceName of the
+// definition is updated to match the registered service.
+func (s *StateStore) validateCheckDefinitionTxn(tx *MDBTxn, def *structs.CheckDefinition) error {
+	if def.Node == "" || def.CheckID == "" {
+		return fmt.Errorf("Missing node or check ID")
+	}
+	if (def.HTTP == "") == (def.TCP == "") {
+		return fmt.Errorf("Check definition must provide exactly one of HTTP or TCP")
+	}
+	if def.Interval <= 0 {
+		return fmt.Errorf("Check definition must provide a positive interval")
 	}
 
 	// Ensure the node exists
-	res, err := s.nodeTable.GetTxn(tx, "id", check.Node)
+	res, err := s.nodeTable.GetTxn(tx, "id", def.Node)
 	if err != nil {
 		return err
 	}
 	if len(res) == 0 {
-		return fmt.Errorf("Missing node registration")
+		return structs.ErrMissingNode
 	}
 
 	// Ensure the service exists if specified
-	if check.ServiceID != "" {
-		res, err = s.serviceTable.GetTxn(tx, "id", check.Node, check.ServiceID)
+	def.ServiceName = ""
+	if def.ServiceID != "" {
+		res, err = s.serviceTable.GetTxn(tx, "id", def.Node, def.ServiceID, "")
 		if err != nil {
 			return err
 		}
 		if len(res) == 0 {
-			return fmt.Errorf("Missing service registration")
-		}
-		// Ensure we set the correct service
-		srv := res[0].(*structs.ServiceNode)
-		check.ServiceName = srv.ServiceName
-	}
-
-	// Invalidate any sessions if status is critical
-	if check.Status == structs.HealthCritical {
-		err := s.invalidateCheck(index, tx, check.Node, check.CheckID)
-		if err != nil {
-			return err
+			return structs.ErrMissingService
 		}
+		def.ServiceName = res[0].(*structs.ServiceNode).ServiceName
 	}
-
-	// Ensure the check is set
-	if err := s.checkTable.InsertTxn(tx, check); err != nil {
-		return err
-	}
-	if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
-		return err
-	}
-	tx.Defer(func() { s.watch[s.checkTable].Notify() })
 	return nil
 }
 
-// DeleteNodeCheck is used to delete a node health check
-func (s *StateStore) DeleteNodeCheck(index uint64, node, id string) error {
-	tx, err := s.tables.StartTxn(false)
+// CheckDefinitionRestore is used to restore a check definition. It should
+// only be used when doing a restore, otherwise CheckDefinitionSet should
+// be used.
+func (s *StateStore) CheckDefinitionRestore(def *structs.CheckDefinition) error {
+	// Start a new txn
+	tx, err := s.checkDefTable.StartTxn(false, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Abort()
 
-	// Invalidate any sessions held by this check
-	if err := s.invalidateCheck(index, tx, node, id); err != nil {
+	if err := s.checkDefTable.InsertTxn(tx, def); err != nil {
 		return err
 	}
-
-	if n, err := s.checkTable.DeleteTxn(tx, "id", node, id); err != nil {
+	if err := s.checkDefTable.SetMaxLastIndexTxn(tx, def.ModifyIndex); err != nil {
 		return err
-	} else if n > 0 {
-		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
-			return err
-		}
-		tx.Defer(func() { s.watch[s.checkTable].Notify() })
 	}
 	return tx.Commit()
 }
 
-// NodeChecks is used to get all the checks for a node
-func (s *StateStore) NodeChecks(node string) (uint64, structs.HealthChecks) {
-	return s.parseHealthChecks(s.checkTable.Get("id", node))
-}
-
-// ServiceChecks is used to get all the checks for a service
-func (s *StateStore) ServiceChecks(service string) (uint64, structs.HealthChecks) {
-	return s.parseHealthChecks(s.checkTable.Get("service", service))
-}
-
-// CheckInState is used to get all the checks for a service in a given state
-func (s *StateStore) ChecksInState(state string) (uint64, structs.HealthChecks) {
-	var idx uint64
-	var res []interface{}
-	var err error
-	if state == structs.HealthAny {
-		idx, res, err = s.checkTable.Get("id")
-	} else {
-		idx, res, err = s.checkTable.Get("status", state)
+// CheckDefinitionGet is used to get a check definition by node and check ID
+func (s *StateStore) CheckDefinitionGet(node, id string) (uint64, *structs.CheckDefinition, error) {
+	idx, res, err := s.checkDefTable.Get("id", node, id)
+	var d *structs.CheckDefinition
+	if len(res) > 0 {
+		d = res[0].(*structs.CheckDefinition)
 	}
-	return s.parseHealthChecks(idx, res, err)
+	return idx, d, err
 }
 
-// parseHealthChecks is used to handle the results of a Get against
-// the checkTable
-func (s *StateStore) parseHealthChecks(idx uint64, res []interface{}, err error) (uint64, structs.HealthChecks) {
-	results := make([]*structs.HealthCheck, len(res))
-	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get health checks: %v", err)
-		return idx, results
-	}
-	for i, r := range res {
-		results[i] = r.(*structs.HealthCheck)
+// CheckDefinitionList is used to list all the check definitions
+func (s *StateStore) CheckDefinitionList() (uint64, structs.CheckDefinitions, error) {
+	idx, res, err := s.checkDefTable.Get("id")
+	out := make(structs.CheckDefinitions, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.CheckDefinition)
 	}
-	return idx, results
+	return idx, out, err
 }
 
-// CheckServiceNodes returns the nodes associated with a given service, along
-// with any associated check
-func (s *StateStore) CheckServiceNodes(service string) (uint64, structs.CheckServiceNodes) {
-	tables := s.queryTables["CheckServiceNodes"]
-	tx, err := tables.StartTxn(true)
+// CheckDefinitionDelete is used to remove a check definition
+func (s *StateStore) CheckDefinitionDelete(index uint64, node, id string) error {
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
 		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
 	defer tx.Abort()
 
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+	if n, err := s.checkDefTable.DeleteTxn(tx, "id", node, id); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.checkDefTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbCheckDefinitions, node+"/"+id, structs.ChangeDelete); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.checkDefTable].Notify() })
 	}
-
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
-	return idx, s.parseCheckServiceNodes(tx, res, err)
+	return tx.Commit()
 }
 
-// CheckServiceNodes returns the nodes associated with a given service, along
-// with any associated checks
-func (s *StateStore) CheckServiceTagNodes(service, tag string) (uint64, structs.CheckServiceNodes) {
-	tables := s.queryTables["CheckServiceNodes"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+// ClusterConfigSet is used to replace the cluster config
+func (s *StateStore) ClusterConfigSet(index uint64, conf *structs.ClusterConfig) error {
+	if err := validateClusterConfig(conf); err != nil {
+		return err
 	}
-	defer tx.Abort()
+	conf.ID = structs.ClusterConfigID
 
-	idx, err := tables.LastIndexTxn(tx)
+	// Start a new txn
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+		return err
 	}
+	defer tx.Abort()
 
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
-	res = serviceTagFilter(res, tag)
-	return idx, s.parseCheckServiceNodes(tx, res, err)
-}
-
-// parseCheckServiceNodes parses results CheckServiceNodes and CheckServiceTagNodes
-func (s *StateStore) parseCheckServiceNodes(tx *MDBTxn, res []interface{}, err error) structs.CheckServiceNodes {
-	nodes := make(structs.CheckServiceNodes, len(res))
+	// Look for the existing config
+	res, err := s.clusterConfTable.GetTxn(tx, "id", conf.ID)
 	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get service nodes: %v", err)
-		return nodes
+		return err
 	}
-
-	for i, r := range res {
-		srv := r.(*structs.ServiceNode)
-
-		// Get the node
-		nodeRes, err := s.nodeTable.GetTxn(tx, "id", srv.Node)
-		if err != nil || len(nodeRes) != 1 {
-			s.logger.Printf("[ERR] consul.state: Failed to join service node %#v with node: %v", *srv, err)
-			continue
-		}
-
-		// Get any associated checks of the service
-		res, err := s.checkTable.GetTxn(tx, "node", srv.Node, srv.ServiceID)
-		_, checks := s.parseHealthChecks(0, res, err)
-
-		// Get any checks of the node, not associated with any service
-		res, err = s.checkTable.GetTxn(tx, "node", srv.Node, "")
-		_, nodeChecks := s.parseHealthChecks(0, res, err)
-		checks = append(checks, nodeChecks...)
-
-		// Setup the node
-		nodes[i].Node = *nodeRes[0].(*structs.Node)
-		nodes[i].Service = structs.NodeService{
-			ID:      srv.ServiceID,
-			Service: srv.ServiceName,
-			Tags:    srv.ServiceTags,
-			Address: srv.ServiceAddress,
-			Port:    srv.ServicePort,
-		}
-		nodes[i].Checks = checks
+	conf.CreateIndex = index
+	if len(res) > 0 {
+		conf.CreateIndex = res[0].(*structs.ClusterConfig).CreateIndex
 	}
+	conf.ModifyIndex = index
 
-	return nodes
-}
-
-// NodeInfo is used to generate the full info about a node.
-func (s *StateStore) NodeInfo(node string) (uint64, structs.NodeDump) {
-	tables := s.queryTables["NodeInfo"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+	if err := s.clusterConfTable.InsertTxn(tx, conf); err != nil {
+		return err
 	}
-	defer tx.Abort()
-
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+	if err := s.clusterConfTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
 	}
-
-	res, err := s.nodeTable.GetTxn(tx, "id", node)
-	return idx, s.parseNodeInfo(tx, res, err)
+	if err := s.recordChangeTxn(index, tx, dbClusterConfig, conf.ID, structs.ChangeSet); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.clusterConfTable].Notify() })
+	return tx.Commit()
 }
 
-// NodeDump is used to generate the NodeInfo for all nodes. This is very expensive,
-// and should generally be avoided for programmatic access.
-func (s *StateStore) NodeDump() (uint64, structs.NodeDump) {
-	tables := s.queryTables["NodeDump"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+// validateClusterConfig is used to verify the settings of a cluster config
+func validateClusterConfig(conf *structs.ClusterConfig) error {
+	switch conf.SessionBehavior {
+	case "", structs.SessionKeysRelease, structs.SessionKeysDelete:
+	default:
+		return structs.NewError(structs.ErrCodeInvalidSessionBehavior,
+			structs.ErrMsgInvalidSessionBehavior, conf.SessionBehavior)
 	}
-	defer tx.Abort()
-
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+	if conf.SessionTTLMin < 0 || conf.SessionTTLMax < 0 {
+		return fmt.Errorf("Session TTL bounds must not be negative")
 	}
-
-	res, err := s.nodeTable.GetTxn(tx, "id")
-	return idx, s.parseNodeInfo(tx, res, err)
-}
-
-// parseNodeInfo is used to scan over the results of a node
-// iteration and generate a NodeDump
-func (s *StateStore) parseNodeInfo(tx *MDBTxn, res []interface{}, err error) structs.NodeDump {
-	dump := make(structs.NodeDump, 0, len(res))
-	if err != nil {
-		s.logger.Printf("[ERR] consul.state: Failed to get nodes: %v", err)
-		return dump
+	ttlMax := conf.SessionTTLMax
+	if ttlMax == 0 {
+		ttlMax = structs.SessionTTLMax
 	}
-
-	for _, r := range res {
-		// Copy the address and node
-		node := r.(*structs.Node)
-		info := &structs.NodeInfo{
-			Node:    node.Node,
-			Address: node.Address,
-		}
-
-		// Get any services of the node
-		res, err = s.serviceTable.GetTxn(tx, "id", node.Node)
-		if err != nil {
-			s.logger.Printf("[ERR] consul.state: Failed to get node services: %v", err)
-		}
-		info.Services = make([]*structs.NodeService, 0, len(res))
-		for _, r := range res {
-			service := r.(*structs.ServiceNode)
-			srv := &structs.NodeService{
-				ID:      service.ServiceID,
-				Service: service.ServiceName,
-				Tags:    service.ServiceTags,
-				Address: service.ServiceAddress,
-				Port:    service.ServicePort,
-			}
-			info.Services = append(info.Services, srv)
-		}
-
-		// Get any checks of the node
-		res, err = s.checkTable.GetTxn(tx, "node", node.Node)
-		if err != nil {
-			s.logger.Printf("[ERR] consul.state: Failed to get node checks: %v", err)
-		}
-		info.Checks = make([]*structs.HealthCheck, 0, len(res))
-		for _, r := range res {
-			chk := r.(*structs.HealthCheck)
-			info.Checks = append(info.Checks, chk)
-		}
-
-		// Add the node info
-		dump = append(dump, info)
+	if conf.SessionTTLMin > ttlMax {
+		return fmt.Errorf("Session TTL minimum %v exceeds the maximum %v",
+			conf.SessionTTLMin, ttlMax)
 	}
-	return dump
-}
-
-// KVSSet is used to create or update a KV entry
-func (s *StateStore) KVSSet(index uint64, d *structs.DirEntry) error {
-	_, err := s.kvsSet(index, d, kvSet)
-	return err
+	if conf.SessionLockDelayMin < 0 || conf.SessionLockDelayMax < 0 {
+		return fmt.Errorf("Session lock-delay bounds must not be negative")
+	}
+	if max := sessionLockDelayMax(conf); conf.SessionLockDelayMin > max {
+		return fmt.Errorf("Session lock-delay minimum %v exceeds the maximum %v",
+			conf.SessionLockDelayMin, max)
+	}
+	switch conf.ACLDefaultPolicy {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("Unsupported default ACL policy: %s", conf.ACLDefaultPolicy)
+	}
+	switch conf.ACLDownPolicy {
+	case "", "allow", "deny", "extend-cache":
+	default:
+		return fmt.Errorf("Unsupported down ACL policy: %s", conf.ACLDownPolicy)
+	}
+	return nil
 }
 
-// KVSRestore is used to restore a DirEntry. It should only be used when
-// doing a restore, otherwise KVSSet should be used.
-func (s *StateStore) KVSRestore(d *structs.DirEntry) error {
+// ClusterConfigRestore is used to restore the cluster config. It should
+// only be used when doing a restore, otherwise ClusterConfigSet should
+// be used.
+func (s *StateStore) ClusterConfigRestore(conf *structs.ClusterConfig) error {
 	// Start a new txn
-	tx, err := s.kvsTable.StartTxn(false, nil)
+	tx, err := s.clusterConfTable.StartTxn(false, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Abort()
 
-	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
+	if err := s.clusterConfTable.InsertTxn(tx, conf); err != nil {
 		return err
 	}
-	if err := s.kvsTable.SetMaxLastIndexTxn(tx, d.ModifyIndex); err != nil {
+	if err := s.clusterConfTable.SetMaxLastIndexTxn(tx, conf.ModifyIndex); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-// KVSGet is used to get a KV entry
-func (s *StateStore) KVSGet(key string) (uint64, *structs.DirEntry, error) {
-	idx, res, err := s.kvsTable.Get("id", key)
-	var d *structs.DirEntry
+// ClusterConfigGet is used to get the cluster config. It returns nil if
+// the config was never set.
+func (s *StateStore) ClusterConfigGet() (uint64, *structs.ClusterConfig, error) {
+	idx, res, err := s.clusterConfTable.Get("id", structs.ClusterConfigID)
+	var conf *structs.ClusterConfig
 	if len(res) > 0 {
-		d = res[0].(*structs.DirEntry)
+		conf = res[0].(*structs.ClusterConfig)
 	}
-	return idx, d, err
+	return idx, conf, err
 }
 
-// KVSList is used to list all KV entries with a prefix
-func (s *StateStore) KVSList(prefix string) (uint64, uint64, structs.DirEntries, error) {
-	tables := MDBTables{s.kvsTable, s.tombstoneTable}
-	tx, err := tables.StartTxn(true)
+// clusterConfigTxn is used to get the cluster config within a txn. An
+// empty config, which selects all the defaults, is returned if it was
+// never set.
+func (s *StateStore) clusterConfigTxn(tx *MDBTxn) (*structs.ClusterConfig, error) {
+	res, err := s.clusterConfTable.GetTxn(tx, "id", structs.ClusterConfigID)
 	if err != nil {
-		return 0, 0, nil, err
+		return nil, err
 	}
-	defer tx.Abort()
-
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		return 0, 0, nil, err
+	if len(res) == 0 {
+		return &structs.ClusterConfig{}, nil
 	}
+	return res[0].(*structs.ClusterConfig), nil
+}
 
-	res, err := s.kvsTable.GetTxn(tx, "id_prefix", prefix)
-	if err != nil {
-		return 0, 0, nil, err
+// sessionLockDelay returns the lock-delay of a session, within the
+// bounds of the cluster config
+func sessionLockDelay(delay time.Duration, conf *structs.ClusterConfig) time.Duration {
+	if max := sessionLockDelayMax(conf); delay > max {
+		delay = max
 	}
-	ents := make(structs.DirEntries, len(res))
-	for idx, r := range res {
-		ents[idx] = r.(*structs.DirEntry)
+	if delay < conf.SessionLockDelayMin {
+		delay = conf.SessionLockDelayMin
 	}
+	return delay
+}
 
-	// Check for the highest index in the tombstone table
-	var maxIndex uint64
-	res, err = s.tombstoneTable.GetTxn(tx, "id_prefix", prefix)
-	for _, r := range res {
-		ent := r.(*structs.DirEntry)
-		if ent.ModifyIndex > maxIndex {
-			maxIndex = ent.ModifyIndex
-		}
+// sessionLockDelayMax returns the maximum lock-delay of the cluster
+// config, which is MaxLockDelay unless set
+func sessionLockDelayMax(conf *structs.ClusterConfig) time.Duration {
+	if conf.SessionLockDelayMax > 0 {
+		return conf.SessionLockDelayMax
 	}
-
-	return maxIndex, idx, ents, err
+	return structs.MaxLockDelay
 }
 
-// KVSListKeys is used to list keys with a prefix, and up to a given separator
-func (s *StateStore) KVSListKeys(prefix, seperator string) (uint64, []string, error) {
-	tables := MDBTables{s.kvsTable, s.tombstoneTable}
-	tx, err := tables.StartTxn(true)
+// FeatureEnable is used to enable features. Features that are already
+// enabled are left unchanged.
+func (s *StateStore) FeatureEnable(index uint64, names []string) error {
+	// Start a new txn
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		return 0, nil, err
+		return err
 	}
 	defer tx.Abort()
 
-	idx, err := s.kvsTable.LastIndexTxn(tx)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	// Ensure a non-zero index
-	if idx == 0 {
-		// Must provide non-zero index to prevent blocking
-		// Index 1 is impossible anyways (due to Raft internals)
-		idx = 1
-	}
-
-	// Aggregate the stream
-	stream := make(chan interface{}, 128)
-	streamTomb := make(chan interface{}, 128)
-	done := make(chan struct{})
-	var keys []string
-	var maxIndex uint64
-	go func() {
-		prefixLen := len(prefix)
-		sepLen := len(seperator)
-		last := ""
-		for raw := range stream {
-			ent := raw.(*structs.DirEntry)
-			after := ent.Key[prefixLen:]
-
-			// Update the highest index we've seen
-			if ent.ModifyIndex > maxIndex {
-				maxIndex = ent.ModifyIndex
-			}
-
-			// If there is no separator, always accumulate
-			if sepLen == 0 {
-				keys = append(keys, ent.Key)
-				continue
-			}
-
-			// Check for the separator
-			if idx := strings.Index(after, seperator); idx >= 0 {
-				toSep := ent.Key[:prefixLen+idx+sepLen]
-				if last != toSep {
-					keys = append(keys, toSep)
-					last = toSep
-				}
-			} else {
-				keys = append(keys, ent.Key)
-			}
+	enabled := false
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("Missing feature name")
+		}
+		res, err := s.featureTable.GetTxn(tx, "id", name)
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 {
+			continue
 		}
 
-		// Handle the tombstones for any index updates
-		for raw := range streamTomb {
-			ent := raw.(*structs.DirEntry)
-			if ent.ModifyIndex > maxIndex {
-				maxIndex = ent.ModifyIndex
-			}
+		feature := &structs.Feature{Name: name, CreateIndex: index}
+		if err := s.featureTable.InsertTxn(tx, feature); err != nil {
+			return err
 		}
-		close(done)
-	}()
+		if err := s.recordChangeTxn(index, tx, dbFeatures, name, structs.ChangeSet); err != nil {
+			return err
+		}
+		enabled = true
+	}
+	if !enabled {
+		return nil
+	}
 
-	// Start the stream, and wait for completion
-	if err = s.kvsTable.StreamTxn(stream, tx, "id_prefix", prefix); err != nil {
-		return 0, nil, err
+	if err := s.featureTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
 	}
-	if err := s.tombstoneTable.StreamTxn(streamTomb, tx, "id_prefix", prefix); err != nil {
-		return 0, nil, err
+	tx.Defer(func() { s.watch[s.featureTable].Notify() })
+	return tx.Commit()
+}
+
+// FeatureRestore is used to restore a feature. It should only be used
+// when doing a restore, otherwise FeatureEnable should be used.
+func (s *StateStore) FeatureRestore(feature *structs.Feature) error {
+	// Start a new txn
+	tx, err := s.featureTable.StartTxn(false, nil)
+	if err != nil {
+		return err
 	}
-	<-done
+	defer tx.Abort()
 
-	// Use the maxIndex if we have any keys
-	if maxIndex != 0 {
-		idx = maxIndex
+	if err := s.featureTable.InsertTxn(tx, feature); err != nil {
+		return err
 	}
-	return idx, keys, nil
+	if err := s.featureTable.SetMaxLastIndexTxn(tx, feature.CreateIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// KVSDelete is used to delete a KVS entry
-func (s *StateStore) KVSDelete(index uint64, key string) error {
-	return s.kvsDeleteWithIndex(index, "id", key)
+// FeatureEnabled checks if a feature is enabled
+func (s *StateStore) FeatureEnabled(name string) (bool, error) {
+	_, res, err := s.featureTable.Get("id", name)
+	return len(res) > 0, err
 }
 
-// KVSDeleteCheckAndSet is used to perform an atomic delete check-and-set
-func (s *StateStore) KVSDeleteCheckAndSet(index uint64, key string, casIndex uint64) (bool, error) {
+// FeatureList is used to list the enabled features
+func (s *StateStore) FeatureList() (uint64, structs.Features, error) {
+	idx, res, err := s.featureTable.Get("id")
+	out := make(structs.Features, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Feature)
+	}
+	return idx, out, err
+}
+
+// ServiceConfigSet is used to create or update the configuration
+// of a service
+func (s *StateStore) ServiceConfigSet(index uint64, conf *structs.ServiceConfig) error {
+	// Check for a service
+	if conf.Service == "" {
+		return fmt.Errorf("Missing service name")
+	}
+	if conf.DNSTTL < 0 {
+		return fmt.Errorf("Invalid DNS TTL '%v'", conf.DNSTTL)
+	}
+
+	// Start a new txn
 	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		return false, err
+		return err
 	}
 	defer tx.Abort()
 
-	// Get the existing node
-	res, err := s.kvsTable.GetTxn(tx, "id", key)
+	// Look for the existing config
+	res, err := s.serviceConfTable.GetTxn(tx, "id", conf.Service)
 	if err != nil {
-		return false, err
+		return err
 	}
-
-	// Get the existing node if any
-	var exist *structs.DirEntry
-	if len(res) > 0 {
-		exist = res[0].(*structs.DirEntry)
+	switch len(res) {
+	case 0:
+		conf.CreateIndex = index
+		conf.ModifyIndex = index
+	case 1:
+		exist := res[0].(*structs.ServiceConfig)
+		conf.CreateIndex = exist.CreateIndex
+		conf.ModifyIndex = index
+	default:
+		panic(fmt.Errorf("Duplicate service config. Internal error"))
 	}
 
-	// Use the casIndex as the constraint. A modify time of 0 means
-	// we are doing a delete-if-not-exists (odd...), while any other
-	// value means we expect that modify time.
-	if casIndex == 0 {
-		return exist == nil, nil
-	} else if casIndex > 0 && (exist == nil || exist.ModifyIndex != casIndex) {
-		return false, nil
+	// Insert the config
+	if err := s.serviceConfTable.InsertTxn(tx, conf); err != nil {
+		return err
 	}
 
-	// Do the actual delete
-	if err := s.kvsDeleteWithIndexTxn(index, tx, "id", key); err != nil {
-		return false, err
+	// Trigger the update notifications
+	if err := s.serviceConfTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
 	}
-	return true, tx.Commit()
-}
-
-// KVSDeleteTree is used to delete all keys with a given prefix
-func (s *StateStore) KVSDeleteTree(index uint64, prefix string) error {
-	if prefix == "" {
-		return s.kvsDeleteWithIndex(index, "id")
+	if err := s.recordChangeTxn(index, tx, dbServiceConfigs, conf.Service, structs.ChangeSet); err != nil {
+		return err
 	}
-	return s.kvsDeleteWithIndex(index, "id_prefix", prefix)
+	tx.Defer(func() { s.watch[s.serviceConfTable].Notify() })
+	return tx.Commit()
 }
 
-// kvsDeleteWithIndex does a delete with either the id or id_prefix
-func (s *StateStore) kvsDeleteWithIndex(index uint64, tableIndex string, parts ...string) error {
-	tx, err := s.tables.StartTxn(false)
+// ServiceConfigRestore is used to restore a service config. It should
+// only be used when doing a restore, otherwise ServiceConfigSet should
+// be used.
+func (s *StateStore) ServiceConfigRestore(conf *structs.ServiceConfig) error {
+	// Start a new txn
+	tx, err := s.serviceConfTable.StartTxn(false, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Abort()
-	if err := s.kvsDeleteWithIndexTxn(index, tx, tableIndex, parts...); err != nil {
+
+	if err := s.serviceConfTable.InsertTxn(tx, conf); err != nil {
+		return err
+	}
+	if err := s.serviceConfTable.SetMaxLastIndexTxn(tx, conf.ModifyIndex); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-// kvsDeleteWithIndexTxn does a delete within an existing transaction
-func (s *StateStore) kvsDeleteWithIndexTxn(index uint64, tx *MDBTxn, tableIndex string, parts ...string) error {
-	num := 0
-	for {
-		// Get some number of entries to delete
-		pairs, err := s.kvsTable.GetTxnLimit(tx, 128, tableIndex, parts...)
-		if err != nil {
-			return err
-		}
+// ServiceConfigGet is used to get the configuration of a service
+func (s *StateStore) ServiceConfigGet(service string) (uint64, *structs.ServiceConfig, error) {
+	idx, res, err := s.serviceConfTable.Get("id", service)
+	var d *structs.ServiceConfig
+	if len(res) > 0 {
+		d = res[0].(*structs.ServiceConfig)
+	}
+	return idx, d, err
+}
 
-		// Create the tombstones and delete
-		for _, raw := range pairs {
-			ent := raw.(*structs.DirEntry)
-			ent.ModifyIndex = index // Update the index
-			ent.Value = nil         // Reduce storage required
-			ent.Session = ""
-			if err := s.tombstoneTable.InsertTxn(tx, ent); err != nil {
-				return err
-			}
-			if num, err := s.kvsTable.DeleteTxn(tx, "id", ent.Key); err != nil {
-				return err
-			} else if num != 1 {
-				return fmt.Errorf("Failed to delete key '%s'", ent.Key)
-			}
-		}
+// ServiceConfigList is used to list the configuration of all services
+func (s *StateStore) ServiceConfigList() (uint64, structs.ServiceConfigs, error) {
+	idx, res, err := s.serviceConfTable.Get("id")
+	out := make(structs.ServiceConfigs, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ServiceConfig)
+	}
+	return idx, out, err
+}
 
-		// Increment the total number
-		num += len(pairs)
-		if len(pairs) == 0 {
-			break
-		}
+// ServiceConfigDelete is used to remove the configuration of a service
+func (s *StateStore) ServiceConfigDelete(index uint64, service string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
+	defer tx.Abort()
 
-	if num > 0 {
-		if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+	if n, err := s.serviceConfTable.DeleteTxn(tx, "id", service); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.serviceConfTable.SetLastIndexTxn(tx, index); err != nil {
 			return err
 		}
-		tx.Defer(func() {
-			// Trigger the most fine grained notifications if possible
-			switch {
-			case len(parts) == 0:
-				s.notifyKV("", true)
-			case tableIndex == "id":
-				s.notifyKV(parts[0], false)
-			case tableIndex == "id_prefix":
-				s.notifyKV(parts[0], true)
-			default:
-				s.notifyKV("", true)
-			}
-			if s.gc != nil {
-				// If GC is configured, then we hint that this index
-				// required expiration.
-				s.gc.Hint(index)
-			}
-		})
+		if err := s.recordChangeTxn(index, tx, dbServiceConfigs, service, structs.ChangeDelete); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.serviceConfTable].Notify() })
+	}
+	return tx.Commit()
+}
+
+// validateConfigEntry checks that the kind of a config entry is known,
+// and that its name is valid for its kind
+func validateConfigEntry(entry *structs.ConfigEntry) error {
+	if entry.Name == "" {
+		return fmt.Errorf("Missing config entry name")
+	}
+	switch entry.Kind {
+	case structs.ServiceDefaults:
+	case structs.ProxyDefaults:
+		if entry.Name != structs.ProxyConfigGlobal {
+			return fmt.Errorf("Invalid name '%s' for a %s config entry, must be '%s'",
+				entry.Name, structs.ProxyDefaults, structs.ProxyConfigGlobal)
+		}
+	default:
+		return fmt.Errorf("Invalid config entry kind '%s'", entry.Kind)
 	}
 	return nil
 }
 
-// KVSCheckAndSet is used to perform an atomic check-and-set
-func (s *StateStore) KVSCheckAndSet(index uint64, d *structs.DirEntry) (bool, error) {
-	return s.kvsSet(index, d, kvCAS)
+// ConfigEntrySet is used to create or update a config entry
+func (s *StateStore) ConfigEntrySet(index uint64, entry *structs.ConfigEntry) error {
+	if err := validateConfigEntry(entry); err != nil {
+		return err
+	}
+
+	// Start a new txn
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	// Look for the existing entry
+	res, err := s.configEntryTable.GetTxn(tx, "id", entry.Kind, entry.Name)
+	if err != nil {
+		return err
+	}
+	switch len(res) {
+	case 0:
+		entry.CreateIndex = index
+		entry.ModifyIndex = index
+	case 1:
+		exist := res[0].(*structs.ConfigEntry)
+		entry.CreateIndex = exist.CreateIndex
+		entry.ModifyIndex = index
+	default:
+		panic(fmt.Errorf("Duplicate config entry. Internal error"))
+	}
+
+	// Insert the entry
+	if err := s.configEntryTable.InsertTxn(tx, entry); err != nil {
+		return err
+	}
+
+	// Trigger the update notifications
+	if err := s.configEntryTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	key := entry.Kind + "/" + entry.Name
+	if err := s.recordChangeTxn(index, tx, dbConfigEntries, key, structs.ChangeSet); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.configEntryTable].Notify() })
+	return tx.Commit()
 }
 
-// KVSLock works like KVSSet but only writes if the lock can be acquired
-func (s *StateStore) KVSLock(index uint64, d *structs.DirEntry) (bool, error) {
-	return s.kvsSet(index, d, kvLock)
+// ConfigEntryRestore is used to restore a config entry. It should only
+// be used when doing a restore, otherwise ConfigEntrySet should be used.
+func (s *StateStore) ConfigEntryRestore(entry *structs.ConfigEntry) error {
+	// Start a new txn
+	tx, err := s.configEntryTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	if err := s.configEntryTable.InsertTxn(tx, entry); err != nil {
+		return err
+	}
+	if err := s.configEntryTable.SetMaxLastIndexTxn(tx, entry.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// KVSUnlock works like KVSSet but only writes if the lock can be unlocked
-func (s *StateStore) KVSUnlock(index uint64, d *structs.DirEntry) (bool, error) {
-	return s.kvsSet(index, d, kvUnlock)
+// ConfigEntryGet is used to get a config entry by kind and name
+func (s *StateStore) ConfigEntryGet(kind, name string) (uint64, *structs.ConfigEntry, error) {
+	idx, res, err := s.configEntryTable.Get("id", kind, name)
+	var d *structs.ConfigEntry
+	if len(res) > 0 {
+		d = res[0].(*structs.ConfigEntry)
+	}
+	return idx, d, err
 }
 
-// KVSLockDelay returns the expiration time of a key lock delay. A key may
-// have a lock delay if it was unlocked due to a session invalidation instead
-// of a graceful unlock. This must be checked on the leader node, and not in
-// KVSLock due to the variability of clocks.
-func (s *StateStore) KVSLockDelay(key string) time.Time {
-	s.lockDelayLock.RLock()
-	expires := s.lockDelay[key]
-	s.lockDelayLock.RUnlock()
-	return expires
+// ConfigEntryList is used to list the config entries of a kind, or all
+// of them if the kind is empty
+func (s *StateStore) ConfigEntryList(kind string) (uint64, structs.ConfigEntries, error) {
+	var idx uint64
+	var res []interface{}
+	var err error
+	if kind == "" {
+		idx, res, err = s.configEntryTable.Get("id")
+	} else {
+		idx, res, err = s.configEntryTable.Get("id", kind)
+	}
+	out := make(structs.ConfigEntries, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ConfigEntry)
+	}
+	return idx, out, err
 }
 
-// kvsSet is the internal setter
-func (s *StateStore) kvsSet(
-	index uint64,
-	d *structs.DirEntry,
-	mode kvMode) (bool, error) {
-	// Start a new txn
+// ConfigEntryDelete is used to remove a config entry
+func (s *StateStore) ConfigEntryDelete(index uint64, kind, name string) error {
 	tx, err := s.tables.StartTxn(false)
 	if err != nil {
-		return false, err
+		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
 	defer tx.Abort()
 
-	// Get the existing node
-	res, err := s.kvsTable.GetTxn(tx, "id", d.Key)
-	if err != nil {
-		return false, err
+	if n, err := s.configEntryTable.DeleteTxn(tx, "id", kind, name); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.configEntryTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
+		}
+		key := kind + "/" + name
+		if err := s.recordChangeTxn(index, tx, dbConfigEntries, key, structs.ChangeDelete); err != nil {
+			return err
+		}
+		tx.Defer(func() { s.watch[s.configEntryTable].Notify() })
 	}
+	return tx.Commit()
+}
 
-	// Get the existing node if any
-	var exist *structs.DirEntry
-	if len(res) > 0 {
-		exist = res[0].(*structs.DirEntry)
+// IntentionSet is used to create or update an intention. There can only
+// be a single intention for a given source and destination.
+func (s *StateStore) IntentionSet(index uint64, ixn *structs.Intention) error {
+	// Verify the intention
+	if ixn.ID == "" {
+		return fmt.Errorf("Missing intention ID")
 	}
-
-	// Use the ModifyIndex as the constraint. A modify of time of 0
-	// means we are doing a set-if-not-exists, while any other value
-	// means we expect that modify time.
-	if mode == kvCAS {
-		if d.ModifyIndex == 0 && exist != nil {
-			return false, nil
-		} else if d.ModifyIndex > 0 && (exist == nil || exist.ModifyIndex != d.ModifyIndex) {
-			return false, nil
-		}
+	if ixn.SourceName == "" || ixn.DestinationName == "" {
+		return fmt.Errorf("Missing source or destination")
+	}
+	switch ixn.Action {
+	case structs.IntentionActionAllow, structs.IntentionActionDeny:
+	default:
+		return fmt.Errorf("Invalid intention action '%s'", ixn.Action)
 	}
 
-	// If attempting to lock, check this is possible
-	if mode == kvLock {
-		// Verify we have a session
-		if d.Session == "" {
-			return false, fmt.Errorf("Missing session")
-		}
+	// Start a new txn
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
 
-		// Bail if it is already locked
-		if exist != nil && exist.Session != "" {
-			return false, nil
+	// Ensure there is no other intention for the same services
+	res, err := s.intentionTable.GetTxn(tx, "destination", ixn.DestinationName)
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		exist := r.(*structs.Intention)
+		if exist.ID != ixn.ID && strings.EqualFold(exist.SourceName, ixn.SourceName) {
+			return fmt.Errorf("Intention from '%s' to '%s' already exists",
+				ixn.SourceName, ixn.DestinationName)
 		}
+	}
 
-		// Verify the session exists
-		res, err := s.sessionTable.GetTxn(tx, "id", d.Session)
-		if err != nil {
-			return false, err
-		}
-		if len(res) == 0 {
-			return false, fmt.Errorf("Invalid session")
-		}
+	// Look for the existing intention
+	res, err = s.intentionTable.GetTxn(tx, "id", ixn.ID)
+	if err != nil {
+		return err
+	}
+	switch len(res) {
+	case 0:
+		ixn.CreateIndex = index
+		ixn.ModifyIndex = index
+	case 1:
+		exist := res[0].(*structs.Intention)
+		ixn.CreateIndex = exist.CreateIndex
+		ixn.ModifyIndex = index
+	default:
+		panic(fmt.Errorf("Duplicate intention. Internal error"))
+	}
 
-		// Update the lock index
-		if exist != nil {
-			exist.LockIndex++
-			exist.Session = d.Session
-		} else {
-			d.LockIndex = 1
-		}
+	// Insert the intention
+	if err := s.intentionTable.InsertTxn(tx, ixn); err != nil {
+		return err
 	}
 
-	// If attempting to unlock, verify the key exists and is held
-	if mode == kvUnlock {
-		if exist == nil || exist.Session != d.Session {
-			return false, nil
-		}
-		// Clear the session to unlock
-		exist.Session = ""
+	// Trigger the update notifications
+	if err := s.intentionTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(index, tx, dbIntentions, ixn.ID, structs.ChangeSet); err != nil {
+		return err
 	}
+	tx.Defer(func() { s.watch[s.intentionTable].Notify() })
+	return tx.Commit()
+}
 
-	// Set the create and modify times
-	if exist == nil {
-		d.CreateIndex = index
-	} else {
-		d.CreateIndex = exist.CreateIndex
-		d.LockIndex = exist.LockIndex
-		d.Session = exist.Session
+// IntentionRestore is used to restore an intention. It should only be
+// used when doing a restore, otherwise IntentionSet should be used.
+func (s *StateStore) IntentionRestore(ixn *structs.Intention) error {
+	// Start a new txn
+	tx, err := s.intentionTable.StartTxn(false, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
 
+	if err := s.intentionTable.InsertTxn(tx, ixn); err != nil {
+		return err
 	}
-	d.ModifyIndex = index
+	if err := s.intentionTable.SetMaxLastIndexTxn(tx, ixn.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
-		return false, err
+// IntentionGet is used to get an intention by ID
+func (s *StateStore) IntentionGet(id string) (uint64, *structs.Intention, error) {
+	idx, res, err := s.intentionTable.Get("id", id)
+	var d *structs.Intention
+	if len(res) > 0 {
+		d = res[0].(*structs.Intention)
 	}
-	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
-		return false, err
+	return idx, d, err
+}
+
+// IntentionList is used to list all the intentions
+func (s *StateStore) IntentionList() (uint64, structs.Intentions, error) {
+	idx, res, err := s.intentionTable.Get("id")
+	out := make(structs.Intentions, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Intention)
 	}
-	tx.Defer(func() { s.notifyKV(d.Key, false) })
-	return true, tx.Commit()
+	return idx, out, err
 }
 
-// ReapTombstones is used to delete all the tombstones with a ModifyTime
-// less than or equal to the given index. This is used to prevent unbounded
-// storage growth of the tombstones.
-func (s *StateStore) ReapTombstones(index uint64) error {
-	tx, err := s.tombstoneTable.StartTxn(false, nil)
+// IntentionMatch is used to find the intention that applies to a
+// connection from the source to the destination service. Exact names
+// take precedence over wildcards, and the destination is more specific
+// than the source. If no intention matches, nil is returned.
+func (s *StateStore) IntentionMatch(source, dest string) (uint64, *structs.Intention, error) {
+	tables := s.queryTables["IntentionMatch"]
+	tx, err := tables.StartTxn(true)
 	if err != nil {
-		return fmt.Errorf("failed to start txn: %v", err)
+		return 0, nil, err
 	}
 	defer tx.Abort()
 
-	// Scan the tombstone table for all the entries that are
-	// eligible for GC. This could be improved by indexing on
-	// ModifyTime and doing a less-than-equals scan, however
-	// we don't currently support numeric indexes internally.
-	// Luckily, this is a low frequency operation.
-	var toDelete []string
-	streamCh := make(chan interface{}, 128)
-	doneCh := make(chan struct{})
-	go func() {
-		defer close(doneCh)
-		for raw := range streamCh {
-			ent := raw.(*structs.DirEntry)
-			if ent.ModifyIndex <= index {
-				toDelete = append(toDelete, ent.Key)
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var match *structs.Intention
+	var best int
+	for _, name := range []string{dest, structs.IntentionWildcard} {
+		res, err := s.intentionTable.GetTxn(tx, "destination", name)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, r := range res {
+			ixn := r.(*structs.Intention)
+			if prec := intentionPrecedence(ixn, source, dest); prec > best {
+				match, best = ixn, prec
 			}
 		}
-	}()
-	if err := s.tombstoneTable.StreamTxn(streamCh, tx, "id"); err != nil {
-		s.logger.Printf("[ERR] consul.state: failed to scan tombstones: %v", err)
-		return fmt.Errorf("failed to scan tombstones: %v", err)
 	}
-	<-doneCh
+	return idx, match, nil
+}
 
-	// Delete each tombstone
-	if len(toDelete) > 0 {
-		s.logger.Printf("[DEBUG] consul.state: reaping %d tombstones up to %d", len(toDelete), index)
+// intentionPrecedence returns how specifically an intention matches
+// the source and destination, or zero if it does not match
+func intentionPrecedence(ixn *structs.Intention, source, dest string) int {
+	var prec int
+	switch {
+	case strings.EqualFold(ixn.DestinationName, dest):
+		prec += 2
+	case ixn.DestinationName == structs.IntentionWildcard:
+	default:
+		return 0
 	}
-	for _, key := range toDelete {
-		num, err := s.tombstoneTable.DeleteTxn(tx, "id", key)
-		if err != nil {
-			s.logger.Printf("[ERR] consul.state: failed to delete tombstone: %v", err)
-			return fmt.Errorf("failed to delete tombstone: %v", err)
+	switch {
+	case strings.EqualFold(ixn.SourceName, source):
+		prec += 1
+	case ixn.SourceName == structs.IntentionWildcard:
+	default:
+		return 0
+	}
+	return prec + 1
+}
+
+// IntentionDelete is used to delete an intention
+func (s *StateStore) IntentionDelete(index uint64, id string) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		panic(fmt.Errorf("Failed to start txn: %v", err))
+	}
+	defer tx.Abort()
+
+	if n, err := s.intentionTable.DeleteTxn(tx, "id", id); err != nil {
+		return err
+	} else if n > 0 {
+		if err := s.intentionTable.SetLastIndexTxn(tx, index); err != nil {
+			return err
 		}
-		if num != 1 {
-			return fmt.Errorf("failed to delete tombstone '%s'", key)
+		if err := s.recordChangeTxn(index, tx, dbIntentions, id, structs.ChangeDelete); err != nil {
+			return err
 		}
+		tx.Defer(func() { s.watch[s.intentionTable].Notify() })
 	}
 	return tx.Commit()
 }
 
-// TombstoneRestore is used to restore a tombstone.
-// It should only be used when doing a restore.
-func (s *StateStore) TombstoneRestore(d *structs.DirEntry) error {
-	// Start a new txn
-	tx, err := s.tombstoneTable.StartTxn(false, nil)
+// NodeDrain is used to start or stop draining a node. Only a registered
+// node can start draining, and deregistering the node stops the drain.
+func (s *StateStore) NodeDrain(index uint64, node string, drain bool) error {
+	tx, err := s.tables.StartTxn(false)
 	if err != nil {
 		return err
 	}
 	defer tx.Abort()
 
-	if err := s.tombstoneTable.InsertTxn(tx, d); err != nil {
+	res, err := s.nodeDrainTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return err
+	}
+	if drain {
+		// Draining an already draining node is a no-op
+		if len(res) > 0 {
+			return nil
+		}
+		if res, err := s.nodeTable.GetTxn(tx, "id", node); err != nil {
+			return err
+		} else if len(res) == 0 {
+			return structs.NewError(structs.ErrCodeMissingNode, structs.ErrMsgMissingNamedNode, node)
+		}
+		nd := &structs.NodeDrain{CreateIndex: index, Node: node}
+		if err := s.nodeDrainTable.InsertTxn(tx, nd); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbNodeDrains, node, structs.ChangeSet); err != nil {
+			return err
+		}
+	} else {
+		if len(res) == 0 {
+			return nil
+		}
+		if _, err := s.nodeDrainTable.DeleteTxn(tx, "id", node); err != nil {
+			return err
+		}
+		if err := s.recordChangeTxn(index, tx, dbNodeDrains, node, structs.ChangeDelete); err != nil {
+			return err
+		}
+	}
+
+	// Trigger the update notifications
+	if err := s.nodeDrainTable.SetLastIndexTxn(tx, index); err != nil {
 		return err
 	}
+	tx.Defer(func() { s.watch[s.nodeDrainTable].Notify() })
 	return tx.Commit()
 }
 
-// SessionCreate is used to create a new session. The
-// ID will be populated on a successful return
-func (s *StateStore) SessionCreate(index uint64, session *structs.Session) error {
-	// Verify a Session ID is generated
-	if session.ID == "" {
-		return fmt.Errorf("Missing Session ID")
+// NodeProtect is used to protect a registered node from deregistration,
+// or to lift the protection
+func (s *StateStore) NodeProtect(index uint64, node string, protected bool) error {
+	tx, err := s.tables.StartTxn(false)
+	if err != nil {
+		return err
 	}
+	defer tx.Abort()
 
-	switch session.Behavior {
-	case "":
-		// Default behavior is Release for backwards compatibility
-		session.Behavior = structs.SessionKeysRelease
-	case structs.SessionKeysRelease:
-	case structs.SessionKeysDelete:
-	default:
-		return fmt.Errorf("Invalid Session Behavior setting '%s'", session.Behavior)
+	res, err := s.nodeTable.GetTxn(tx, "id", node)
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return structs.NewError(structs.ErrCodeMissingNode, structs.ErrMsgMissingNamedNode, node)
+	}
+	existing := res[0].(*structs.Node)
+	if existing.Protected == protected {
+		return nil
 	}
 
-	// Assign the create index
-	session.CreateIndex = index
+	updated := *existing
+	updated.Protected = protected
+	if err := s.nodeTable.InsertTxn(tx, &updated); err != nil {
+		return err
+	}
+	if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	if err := s.recordChangeTxn(index, tx, dbNodes, node, structs.ChangeSet); err != nil {
+		return err
+	}
+	tx.Defer(func() { s.watch[s.nodeTable].Notify() })
+	return tx.Commit()
+}
 
-	// Start the transaction
-	tx, err := s.tables.StartTxn(false)
+// NodeDrainRestore is used to restore a node drain. It should only be
+// used when doing a restore, otherwise NodeDrain should be used.
+func (s *StateStore) NodeDrainRestore(nd *structs.NodeDrain) error {
+	// Start a new txn
+	tx, err := s.nodeDrainTable.StartTxn(false, nil)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
 
-	// Verify that the node exists
-	res, err := s.nodeTable.GetTxn(tx, "id", session.Node)
-	if err != nil {
+	if err := s.nodeDrainTable.InsertTxn(tx, nd); err != nil {
 		return err
 	}
-	if len(res) == 0 {
-		return fmt.Errorf("Missing node registration")
+	if err := s.nodeDrainTable.SetMaxLastIndexTxn(tx, nd.CreateIndex); err != nil {
+		return err
 	}
+	return tx.Commit()
+}
 
-	// Verify that the checks exist and are not critical
-	for _, checkId := range session.Checks {
-		res, err := s.checkTable.GetTxn(tx, "id", session.Node, checkId)
-		if err != nil {
-			return err
-		}
-		if len(res) == 0 {
-			return fmt.Errorf("Missing check '%s' registration", checkId)
-		}
-		chk := res[0].(*structs.HealthCheck)
-		if chk.Status == structs.HealthCritical {
-			return fmt.Errorf("Check '%s' is in %s state", checkId, chk.Status)
-		}
+// RegistrationTimeRestore is used to restore the registration times of
+// a node or service. It should only be used when doing a restore.
+func (s *StateStore) RegistrationTimeRestore(rt *structs.RegistrationTime) error {
+	table := s.registrationTable
+	if rt.ServiceID == "" {
+		table = s.nodeRegTable
 	}
 
-	// Insert the session
-	if err := s.sessionTable.InsertTxn(tx, session); err != nil {
+	// Start a new txn
+	tx, err := table.StartTxn(false, nil)
+	if err != nil {
 		return err
 	}
+	defer tx.Abort()
 
-	// Insert the check mappings
-	sCheck := sessionCheck{Node: session.Node, Session: session.ID}
-	for _, checkID := range session.Checks {
-		sCheck.CheckID = checkID
-		if err := s.sessionCheckTable.InsertTxn(tx, &sCheck); err != nil {
-			return err
-		}
+	if err := table.InsertTxn(tx, rt); err != nil {
+		return err
 	}
-
-	// Trigger the update notifications
-	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := table.SetMaxLastIndexTxn(tx, rt.ModifyIndex); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
 	return tx.Commit()
 }
 
-// SessionRestore is used to restore a session. It should only be used when
-// doing a restore, otherwise SessionCreate should be used.
-func (s *StateStore) SessionRestore(session *structs.Session) error {
-	// Start the transaction
-	tx, err := s.tables.StartTxn(false)
+// CheckHeardRestore is used to restore the time a healthy status was
+// last heard for a check. It should only be used when doing a restore.
+func (s *StateStore) CheckHeardRestore(heard *structs.CheckHeard) error {
+	// Start a new txn
+	tx, err := s.checkHeardTable.StartTxn(false, nil)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
 
-	// Insert the session
-	if err := s.sessionTable.InsertTxn(tx, session); err != nil {
+	if err := s.checkHeardTable.InsertTxn(tx, heard); err != nil {
 		return err
 	}
+	if err := s.checkHeardTable.SetMaxLastIndexTxn(tx, heard.ModifyIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	// Insert the check mappings
-	sCheck := sessionCheck{Node: session.Node, Session: session.ID}
-	for _, checkID := range session.Checks {
-		sCheck.CheckID = checkID
-		if err := s.sessionCheckTable.InsertTxn(tx, &sCheck); err != nil {
-			return err
-		}
+// NodeSeenRestore is used to restore the time a node was last seen
+// alive. It should only be used when doing a restore.
+func (s *StateStore) NodeSeenRestore(seen *structs.NodeSeen) error {
+	// Start a new txn
+	tx, err := s.nodeSeenTable.StartTxn(false, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Abort()
 
-	// Trigger the update notifications
-	index := session.CreateIndex
-	if err := s.sessionTable.SetMaxLastIndexTxn(tx, index); err != nil {
+	if err := s.nodeSeenTable.InsertTxn(tx, seen); err != nil {
+		return err
+	}
+	if err := s.nodeSeenTable.SetMaxLastIndexTxn(tx, seen.ModifyIndex); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
 	return tx.Commit()
 }
 
-// SessionGet is used to get a session entry
-func (s *StateStore) SessionGet(id string) (uint64, *structs.Session, error) {
-	idx, res, err := s.sessionTable.Get("id", id)
-	var d *structs.Session
-	if len(res) > 0 {
-		d = res[0].(*structs.Session)
+// LockWaiterRestore is used to restore a session queued for a lock.
+// It should only be used when doing a restore.
+func (s *StateStore) LockWaiterRestore(w *structs.LockWaiter) error {
+	// Start a new txn
+	tx, err := s.lockWaiterTable.StartTxn(false, nil)
+	if err != nil {
+		return err
 	}
-	return idx, d, err
+	defer tx.Abort()
+
+	if err := s.lockWaiterTable.InsertTxn(tx, w); err != nil {
+		return err
+	}
+	if err := s.lockWaiterTable.SetMaxLastIndexTxn(tx, w.CreateIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// SessionList is used to list all the open sessions
-func (s *StateStore) SessionList() (uint64, []*structs.Session, error) {
-	idx, res, err := s.sessionTable.Get("id")
-	out := make([]*structs.Session, len(res))
+// NodeDrains is used to list the draining nodes
+func (s *StateStore) NodeDrains() (uint64, structs.NodeDrains, error) {
+	idx, res, err := s.nodeDrainTable.Get("id")
+	out := make(structs.NodeDrains, len(res))
 	for i, raw := range res {
-		out[i] = raw.(*structs.Session)
+		out[i] = raw.(*structs.NodeDrain)
 	}
 	return idx, out, err
 }
 
-// NodeSessions is used to list all the open sessions for a node
-func (s *StateStore) NodeSessions(node string) (uint64, []*structs.Session, error) {
-	idx, res, err := s.sessionTable.Get("node", node)
-	out := make([]*structs.Session, len(res))
+// catalogEventTxn is used to record the pending catalog event, if any,
+// within the txn of the change it describes. The event is consumed, so a
+// txn that changes several parts of the catalog records it once. The
+// trail is bounded to catalogEventsSize events, so once it is full the
+// oldest events are deleted.
+func (s *StateStore) catalogEventTxn(index uint64, tx *MDBTxn, node string) error {
+	ev := s.catalogEvent
+	if ev == nil {
+		return nil
+	}
+	s.catalogEvent = nil
+
+	s.catalogEventLock.Lock()
+	defer s.catalogEventLock.Unlock()
+
+	// Make room by deleting the oldest events
+	count := s.catalogEventCount
+	for ; count >= catalogEventsSize; count-- {
+		res, err := s.catalogEventTable.GetTxnLimit(tx, 1, "id")
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			break
+		}
+		oldest := res[0].(*structs.CatalogEvent)
+		if _, err := s.catalogEventTable.DeleteTxn(tx, "id", oldest.ID); err != nil {
+			return err
+		}
+	}
+
+	// Events of a node use the name of the node that changed
+	if ev.Node != "" {
+		ev.Node = node
+	}
+	ev.ID = fmt.Sprintf("%016x", index)
+	ev.Index = index
+	ev.Time = s.now().UnixNano()
+	if err := s.catalogEventTable.InsertTxn(tx, ev); err != nil {
+		return err
+	}
+	if err := s.catalogEventTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
+	}
+	tx.Defer(func() {
+		s.catalogEventLock.Lock()
+		s.catalogEventCount = count + 1
+		s.catalogEventLock.Unlock()
+		s.watch[s.catalogEventTable].Notify()
+	})
+	return nil
+}
+
+// CatalogEvents is used to list the catalog events, oldest first. If a
+// node is given, only the events of that node are returned.
+func (s *StateStore) CatalogEvents(node string) (uint64, structs.CatalogEvents, error) {
+	var idx uint64
+	var res []interface{}
+	var err error
+	if node == "" {
+		idx, res, err = s.catalogEventTable.Get("id")
+	} else {
+		idx, res, err = s.catalogEventTable.Get("node", node)
+	}
+	out := make(structs.CatalogEvents, len(res))
 	for i, raw := range res {
-		out[i] = raw.(*structs.Session)
+		out[i] = raw.(*structs.CatalogEvent)
 	}
+	sort.Sort(catalogEventsByID(out))
 	return idx, out, err
 }
 
-// SessionDestroy is used to destroy a session.
-func (s *StateStore) SessionDestroy(index uint64, id string) error {
-	tx, err := s.tables.StartTxn(false)
+// CatalogEventRestore is used to restore a catalog event. It should only
+// be used when doing a restore, otherwise catalogEventTxn should be used.
+func (s *StateStore) CatalogEventRestore(ev *structs.CatalogEvent) error {
+	// Start a new txn
+	tx, err := s.catalogEventTable.StartTxn(false, nil)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
 
-	s.logger.Printf("[DEBUG] consul.state: Invalidating session %s due to session destroy",
-		id)
-	if err := s.invalidateSession(index, tx, id); err != nil {
+	if err := s.catalogEventTable.InsertTxn(tx, ev); err != nil {
 		return err
 	}
-	return tx.Commit()
-}
-
-// invalidateNode is used to invalidate all sessions belonging to a node
-// All tables should be locked in the tx.
-func (s *StateStore) invalidateNode(index uint64, tx *MDBTxn, node string) error {
-	sessions, err := s.sessionTable.GetTxn(tx, "node", node)
-	if err != nil {
+	if err := s.catalogEventTable.SetMaxLastIndexTxn(tx, ev.Index); err != nil {
 		return err
 	}
-	for _, sess := range sessions {
-		session := sess.(*structs.Session).ID
-		s.logger.Printf("[DEBUG] consul.state: Invalidating session %s due to node '%s' invalidation",
-			session, node)
-		if err := s.invalidateSession(index, tx, session); err != nil {
-			return err
-		}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
+
+	s.catalogEventLock.Lock()
+	s.catalogEventCount++
+	s.catalogEventLock.Unlock()
 	return nil
 }
 
-// invalidateCheck is used to invalidate all sessions belonging to a check
-// All tables should be locked in the tx.
-func (s *StateStore) invalidateCheck(index uint64, tx *MDBTxn, node, check string) error {
-	sessionChecks, err := s.sessionCheckTable.GetTxn(tx, "id", node, check)
+// RecordUserEvent is used to persist a user event at the given index.
+// Only the userEventsSize most recent events are retained, so once the
+// table is full the oldest events are deleted.
+func (s *StateStore) RecordUserEvent(index uint64, ev *structs.UserEvent) error {
+	tx, err := s.userEventTable.StartTxn(false, nil)
 	if err != nil {
 		return err
 	}
-	for _, sc := range sessionChecks {
-		session := sc.(*sessionCheck).Session
-		s.logger.Printf("[DEBUG] consul.state: Invalidating session %s due to check '%s' invalidation",
-			session, check)
-		if err := s.invalidateSession(index, tx, session); err != nil {
+	defer tx.Abort()
+
+	s.userEventLock.Lock()
+	defer s.userEventLock.Unlock()
+
+	// Make room by deleting the oldest events
+	count := s.userEventCount
+	for ; count >= userEventsSize; count-- {
+		res, err := s.userEventTable.GetTxnLimit(tx, 1, "id")
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			break
+		}
+		oldest := res[0].(*structs.UserEvent)
+		if _, err := s.userEventTable.DeleteTxn(tx, "id", oldest.ID); err != nil {
 			return err
 		}
 	}
-	return nil
-}
 
-// invalidateSession is used to invalidate a session within a given txn
-// All tables should be locked in the tx.
-func (s *StateStore) invalidateSession(index uint64, tx *MDBTxn, id string) error {
-	// Get the session
-	res, err := s.sessionTable.GetTxn(tx, "id", id)
-	if err != nil {
+	ev.ID = fmt.Sprintf("%016x", index)
+	ev.Index = index
+	if err := s.userEventTable.InsertTxn(tx, ev); err != nil {
 		return err
 	}
-
-	// Quit if this session does not exist
-	if len(res) == 0 {
-		return nil
+	if err := s.userEventTable.SetLastIndexTxn(tx, index); err != nil {
+		return err
 	}
-	session := res[0].(*structs.Session)
+	tx.Defer(func() { s.watch[s.userEventTable].Notify() })
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.userEventCount = count + 1
+	return nil
+}
 
-	// Enforce the MaxLockDelay
-	delay := session.LockDelay
-	if delay > structs.MaxLockDelay {
-		delay = structs.MaxLockDelay
+// UserEvents is used to list the persisted user events, oldest first.
+// If a name is given, only the events with that name are returned.
+func (s *StateStore) UserEvents(name string) (uint64, structs.UserEvents, error) {
+	var idx uint64
+	var res []interface{}
+	var err error
+	if name == "" {
+		idx, res, err = s.userEventTable.Get("id")
+	} else {
+		idx, res, err = s.userEventTable.Get("name", name)
+	}
+	out := make(structs.UserEvents, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.UserEvent)
 	}
+	sort.Sort(userEventsByID(out))
+	return idx, out, err
+}
 
-	// Invalidate any held locks
-	if session.Behavior == structs.SessionKeysDelete {
-		if err := s.deleteLocks(index, tx, delay, id); err != nil {
-			return err
-		}
-	} else if err := s.invalidateLocks(index, tx, delay, id); err != nil {
+// UserEventRestore is used to restore a user event. It should only be
+// used when doing a restore, otherwise RecordUserEvent should be used.
+func (s *StateStore) UserEventRestore(ev *structs.UserEvent) error {
+	// Start a new txn
+	tx, err := s.userEventTable.StartTxn(false, nil)
+	if err != nil {
 		return err
 	}
+	defer tx.Abort()
 
-	// Nuke the session
-	if _, err := s.sessionTable.DeleteTxn(tx, "id", id); err != nil {
+	if err := s.userEventTable.InsertTxn(tx, ev); err != nil {
 		return err
 	}
-
-	// Delete the check mappings
-	for _, checkID := range session.Checks {
-		if _, err := s.sessionCheckTable.DeleteTxn(tx, "id",
-			session.Node, checkID, id); err != nil {
-			return err
-		}
+	if err := s.userEventTable.SetMaxLastIndexTxn(tx, ev.Index); err != nil {
+		return err
 	}
-
-	// Trigger the update notifications
-	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.sessionTable].Notify() })
+
+	s.userEventLock.Lock()
+	s.userEventCount++
+	s.userEventLock.Unlock()
 	return nil
 }
 
-// invalidateLocks is used to invalidate all the locks held by a session
-// within a given txn. All tables should be locked in the tx.
-func (s *StateStore) invalidateLocks(index uint64, tx *MDBTxn,
-	lockDelay time.Duration, id string) error {
-	pairs, err := s.kvsTable.GetTxn(tx, "session", id)
+// userEventsByID is used to sort user events in the order they were
+// recorded
+type userEventsByID structs.UserEvents
+
+func (u userEventsByID) Len() int           { return len(u) }
+func (u userEventsByID) Less(i, j int) bool { return u[i].ID < u[j].ID }
+func (u userEventsByID) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// catalogEventsByID is used to sort catalog events in the order they
+// were recorded
+type catalogEventsByID structs.CatalogEvents
+
+func (c catalogEventsByID) Len() int           { return len(c) }
+func (c catalogEventsByID) Less(i, j int) bool { return c[i].ID < c[j].ID }
+func (c catalogEventsByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// recordChangeTxn is used to append a change to the change log within
+// a given txn. The change log is a ring, so once it is full the oldest
+// change is overwritten and the floor of the log is raised.
+func (s *StateStore) recordChangeTxn(index uint64, tx *MDBTxn, table, key string, op structs.ChangeOp) error {
+	return s.appendChangeTxn(tx, structs.Change{
+		Index: index,
+		Table: table,
+		Key:   key,
+		Op:    op,
+	})
+}
+
+// recordKVSChangeTxn is like recordChangeTxn, for a key of a namespace
+// of the KV store
+func (s *StateStore) recordKVSChangeTxn(index uint64, tx *MDBTxn, namespace, key string, op structs.ChangeOp) error {
+	return s.appendChangeTxn(tx, structs.Change{
+		Index:     index,
+		Table:     dbKVS,
+		Namespace: namespace,
+		Key:       key,
+		Op:        op,
+	})
+}
+
+// appendChangeTxn is used to write a change to the next slot of the
+// change log. The sequence and the floor of the log only advance once
+// the txn commits, so an aborted txn leaves no gap in the sequence.
+func (s *StateStore) appendChangeTxn(tx *MDBTxn, change structs.Change) error {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+	batch := s.changeBatch
+	if batch == nil || batch.tx != tx {
+		batch = &changeBatch{tx: tx, seq: s.changeSeq, floor: s.changeFloor}
+		s.changeBatch = batch
+		tx.Defer(func() {
+			s.changeLock.Lock()
+			s.changeSeq = batch.seq
+			s.changeFloor = batch.floor
+			if s.changeBatch == batch {
+				s.changeBatch = nil
+			}
+			s.changeLock.Unlock()
+			s.watch[s.changeTable].Notify()
+		})
+	}
+	seq := batch.seq
+	slot := fmt.Sprintf("%08x", seq%changeLogSize)
+
+	// Raise the floor if we are overwriting a change
+	res, err := s.changeTable.GetTxn(tx, "id", slot)
 	if err != nil {
 		return err
 	}
-
-	var expires time.Time
-	if lockDelay > 0 {
-		s.lockDelayLock.Lock()
-		defer s.lockDelayLock.Unlock()
-		expires = time.Now().Add(lockDelay)
+	floor := batch.floor
+	if len(res) > 0 {
+		exist := res[0].(*changeLogEntry)
+		if exist.Change.Index > floor {
+			floor = exist.Change.Index
+		}
 	}
 
-	for _, pair := range pairs {
-		kv := pair.(*structs.DirEntry)
-		kv.Session = ""        // Clear the lock
-		kv.ModifyIndex = index // Update the modified time
-		if err := s.kvsTable.InsertTxn(tx, kv); err != nil {
-			return err
-		}
-		// If there is a lock delay, prevent acquisition
-		// for at least lockDelay period
-		if lockDelay > 0 {
-			s.lockDelay[kv.Key] = expires
-			time.AfterFunc(lockDelay, func() {
-				s.lockDelayLock.Lock()
-				delete(s.lockDelay, kv.Key)
-				s.lockDelayLock.Unlock()
-			})
-		}
-		tx.Defer(func() { s.notifyKV(kv.Key, false) })
+	entry := &changeLogEntry{
+		Slot:   slot,
+		Seq:    seq,
+		Change: change,
 	}
-	if len(pairs) > 0 {
-		if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
-			return err
-		}
+	if err := s.changeTable.InsertTxn(tx, entry); err != nil {
+		return err
+	}
+	if err := s.changeTable.SetLastIndexTxn(tx, change.Index); err != nil {
+		return err
 	}
+	batch.seq, batch.floor = seq+1, floor
 	return nil
 }
 
-// deleteLocks is used to delete all the locks held by a session
-// within a given txn. All tables should be locked in the tx.
-func (s *StateStore) deleteLocks(index uint64, tx *MDBTxn,
-	lockDelay time.Duration, id string) error {
-	pairs, err := s.kvsTable.GetTxn(tx, "session", id)
+// ChangesSince is used to return the changes made after the given index,
+// in the order they were applied. If some of those changes are no longer
+// retained by the change log, errChangeLogTruncated is returned and the
+// caller must fall back to a full snapshot.
+func (s *StateStore) ChangesSince(index uint64) (uint64, structs.Changes, error) {
+	tables := s.queryTables["ChangesSince"]
+	tx, err := tables.StartTxn(true)
 	if err != nil {
-		return err
+		panic(fmt.Errorf("Failed to start txn: %v", err))
 	}
+	defer tx.Abort()
 
-	var expires time.Time
-	if lockDelay > 0 {
-		s.lockDelayLock.Lock()
-		defer s.lockDelayLock.Unlock()
-		expires = time.Now().Add(lockDelay)
+	idx, err := tables.LastIndexTxn(tx)
+	if err != nil {
+		panic(fmt.Errorf("Failed to get last index: %v", err))
+	}
+
+	// Check that all the changes are retained
+	s.changeLock.Lock()
+	floor := s.changeFloor
+	s.changeLock.Unlock()
+	if index < floor {
+		return idx, nil, errChangeLogTruncated
 	}
 
-	for _, pair := range pairs {
-		kv := pair.(*structs.DirEntry)
-		if err := s.kvsDeleteWithIndexTxn(index, tx, "id", kv.Key); err != nil {
-			return err
+	res, err := s.changeTable.GetTxn(tx, "id")
+	if err != nil {
+		return idx, nil, err
+	}
+	entries := make([]*changeLogEntry, 0, len(res))
+	for _, raw := range res {
+		entry := raw.(*changeLogEntry)
+		if entry.Change.Index > index {
+			entries = append(entries, entry)
 		}
+	}
+	sort.Sort(changeLogBySeq(entries))
 
-		// If there is a lock delay, prevent acquisition
-		// for at least lockDelay period
-		if lockDelay > 0 {
-			s.lockDelay[kv.Key] = expires
-			time.AfterFunc(lockDelay, func() {
-				s.lockDelayLock.Lock()
-				delete(s.lockDelay, kv.Key)
-				s.lockDelayLock.Unlock()
-			})
-		}
+	out := make(structs.Changes, len(entries))
+	for i, entry := range entries {
+		out[i] = &entry.Change
 	}
-	return nil
+	return idx, out, nil
 }
 
-// ACLSet is used to create or update an ACL entry
-func (s *StateStore) ACLSet(index uint64, acl *structs.ACL) error {
-	// Check for an ID
-	if acl.ID == "" {
-		return fmt.Errorf("Missing ACL ID")
+// CopyChangeLog is used to carry the change log of a store over to this
+// one. It must only be used when both stores hold the same state, such
+// as after a compaction.
+func (s *StateStore) CopyChangeLog(from *StateStore) error {
+	rtx, err := from.changeTable.StartTxn(true, nil)
+	if err != nil {
+		return err
 	}
+	defer rtx.Abort()
 
-	// Start a new txn
-	tx, err := s.tables.StartTxn(false)
+	res, err := from.changeTable.GetTxn(rtx, "id")
 	if err != nil {
 		return err
 	}
-	defer tx.Abort()
-
-	// Look for the existing node
-	res, err := s.aclTable.GetTxn(tx, "id", acl.ID)
+	idx, err := from.changeTable.LastIndexTxn(rtx)
 	if err != nil {
 		return err
 	}
 
-	switch len(res) {
-	case 0:
-		acl.CreateIndex = index
-		acl.ModifyIndex = index
-	case 1:
-		exist := res[0].(*structs.ACL)
-		acl.CreateIndex = exist.CreateIndex
-		acl.ModifyIndex = index
-	default:
-		panic(fmt.Errorf("Duplicate ACL definition. Internal error"))
+	tx, err := s.changeTable.StartTxn(false, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Abort()
 
-	// Insert the ACL
-	if err := s.aclTable.InsertTxn(tx, acl); err != nil {
+	// Replace the changes recorded while populating this store
+	if _, err := s.changeTable.DeleteTxn(tx, "id"); err != nil {
 		return err
 	}
-
-	// Trigger the update notifications
-	if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
+	for _, raw := range res {
+		if err := s.changeTable.InsertTxn(tx, raw); err != nil {
+			return err
+		}
+	}
+	if err := s.changeTable.SetMaxLastIndexTxn(tx, idx); err != nil {
 		return err
 	}
-	tx.Defer(func() { s.watch[s.aclTable].Notify() })
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	from.changeLock.Lock()
+	seq, floor := from.changeSeq, from.changeFloor
+	from.changeLock.Unlock()
+
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+	s.changeSeq = seq
+	s.changeFloor = floor
+	s.changeBatch = nil
+	return nil
 }
 
-// ACLRestore is used to restore an ACL. It should only be used when
-// doing a restore, otherwise ACLSet should be used.
-func (s *StateStore) ACLRestore(acl *structs.ACL) error {
-	// Start a new txn
-	tx, err := s.aclTable.StartTxn(false, nil)
+// ResetChangeLog is used to mark the change log as starting from the
+// current index of the store. Rows inserted by a restore are not recorded
+// as changes, so this must be called once a restore is complete.
+func (s *StateStore) ResetChangeLog() error {
+	tx, err := s.tables.StartTxn(true)
 	if err != nil {
 		return err
 	}
 	defer tx.Abort()
 
-	if err := s.aclTable.InsertTxn(tx, acl); err != nil {
+	idx, err := s.tables.LastIndexTxn(tx)
+	if err != nil {
 		return err
 	}
-	if err := s.aclTable.SetMaxLastIndexTxn(tx, acl.ModifyIndex); err != nil {
-		return err
+
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+	if idx > s.changeFloor {
+		s.changeFloor = idx
 	}
-	return tx.Commit()
+	return nil
 }
 
-// ACLGet is used to get an ACL by ID
-func (s *StateStore) ACLGet(id string) (uint64, *structs.ACL, error) {
-	idx, res, err := s.aclTable.Get("id", id)
-	var d *structs.ACL
-	if len(res) > 0 {
-		d = res[0].(*structs.ACL)
+// ValidateRegistration is used to verify that a registration request can
+// be applied against the current state, without modifying it. The node
+// itself is always created by a registration, but checks must refer to
+// services that either exist or are part of the same request.
+func (s *StateStore) ValidateRegistration(req *structs.RegisterRequest) error {
+	tx, err := s.tables.StartTxn(true)
+	if err != nil {
+		return err
 	}
-	return idx, d, err
-}
+	defer tx.Abort()
 
-// ACLList is used to list all the acls
-func (s *StateStore) ACLList() (uint64, []*structs.ACL, error) {
-	idx, res, err := s.aclTable.Get("id")
-	out := make([]*structs.ACL, len(res))
-	for i, raw := range res {
-		out[i] = raw.(*structs.ACL)
+	checks := req.Checks
+	if req.Check != nil {
+		checks = append(checks, req.Check)
 	}
-	return idx, out, err
+	for _, check := range checks {
+		node := check.Node
+		if node == "" {
+			node = req.Node
+		}
+
+		// Ensure the node exists, or is being registered
+		if !strings.EqualFold(node, req.Node) {
+			res, err := s.nodeTable.GetTxn(tx, "id", node)
+			if err != nil {
+				return err
+			}
+			if len(res) == 0 {
+				return structs.ErrMissingNode
+			}
+		}
+
+		// Ensure the service exists, or is being registered
+		if check.ServiceID == "" {
+			continue
+		}
+		if strings.EqualFold(node, req.Node) && req.Service != nil && req.Service.ID == check.ServiceID {
+			continue
+		}
+		res, err := s.serviceTable.GetTxn(tx, "id", node, check.ServiceID, check.Namespace)
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return structs.ErrMissingService
+		}
+	}
+	return nil
 }
 
-// ACLDelete is used to remove an ACL
-func (s *StateStore) ACLDelete(index uint64, id string) error {
-	tx, err := s.tables.StartTxn(false)
+// ValidateSession is used to verify that a session can be created
+// against the current state, without modifying it
+func (s *StateStore) ValidateSession(session *structs.Session) error {
+	tx, err := s.tables.StartTxn(true)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return err
 	}
 	defer tx.Abort()
+	return s.validateSessionTxn(tx, session)
+}
 
-	if n, err := s.aclTable.DeleteTxn(tx, "id", id); err != nil {
+// ValidateKVSLock is used to verify that the session used to acquire
+// a lock exists, without modifying the state
+func (s *StateStore) ValidateKVSLock(d *structs.DirEntry) error {
+	if d.Session == "" {
+		return structs.ErrMissingSession
+	}
+	_, res, err := s.sessionTable.Get("id", d.Session)
+	if err != nil {
 		return err
-	} else if n > 0 {
-		if err := s.aclTable.SetLastIndexTxn(tx, index); err != nil {
-			return err
-		}
-		tx.Defer(func() { s.watch[s.aclTable].Notify() })
 	}
-	return tx.Commit()
+	if len(res) == 0 {
+		return structs.ErrInvalidSession
+	}
+	return nil
+}
+
+// ValidateCheckDefinition is used to verify that a check definition can
+// be stored against the current state, without modifying it
+func (s *StateStore) ValidateCheckDefinition(def *structs.CheckDefinition) error {
+	tx, err := s.tables.StartTxn(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+	return s.validateCheckDefinitionTxn(tx, def)
 }
 
 // Snapshot is used to create a point in time snapshot
@@ -2082,7 +7318,7 @@ func (s *StateSnapshot) LastIndex() uint64 {
 func (s *StateSnapshot) Nodes() structs.Nodes {
 	res, err := s.store.nodeTable.GetTxn(s.tx, "id")
 	if err != nil {
-		s.store.logger.Printf("[ERR] consul.state: Failed to get nodes: %v", err)
+		s.store.logger.Error("Failed to get nodes", logError(err))
 		return nil
 	}
 	results := make([]structs.Node, len(res))
@@ -2093,11 +7329,39 @@ func (s *StateSnapshot) Nodes() structs.Nodes {
 }
 
 // NodeServices is used to return all the services of a given node
+// in the default namespace
 func (s *StateSnapshot) NodeServices(name string) *structs.NodeServices {
-	_, res := s.store.parseNodeServices(s.store.tables, s.tx, name)
+	_, res := s.store.parseNodeServices(s.store.tables, s.tx, name, "")
 	return res
 }
 
+// NodeServiceList is used to return the services of a given node in
+// every namespace. Services of different namespaces can share an ID, so
+// they are not keyed by it.
+func (s *StateSnapshot) NodeServiceList(name string) ([]*structs.NodeService, error) {
+	res, err := s.store.serviceTable.GetTxn(s.tx, "id", name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*structs.NodeService, len(res))
+	for i, r := range res {
+		service := r.(*structs.ServiceNode)
+		out[i] = &structs.NodeService{
+			ID:        service.ServiceID,
+			Service:   service.ServiceName,
+			Tags:      service.ServiceTags,
+			Address:   service.ServiceAddress,
+			Port:      service.ServicePort,
+			Version:   service.ServiceVersion,
+			Canary:    service.ServiceCanary,
+			Namespace: service.Namespace,
+			Addresses: service.ServiceAddresses,
+			Source:    service.ServiceSource,
+		}
+	}
+	return out, nil
+}
+
 // NodeChecks is used to return all the checks of a given node
 func (s *StateSnapshot) NodeChecks(node string) structs.HealthChecks {
 	res, err := s.store.checkTable.GetTxn(s.tx, "id", node)
@@ -2105,6 +7369,118 @@ func (s *StateSnapshot) NodeChecks(node string) structs.HealthChecks {
 	return checks
 }
 
+// TablesIndex returns the highest last index of the named tables
+func (s *StateSnapshot) TablesIndex(names ...string) (uint64, error) {
+	var index uint64
+	for _, name := range names {
+		table := s.store.getTable(name)
+		if table == nil {
+			return 0, fmt.Errorf("Unknown table '%s'", name)
+		}
+		idx, err := table.LastIndexTxn(s.tx)
+		if err != nil {
+			return 0, err
+		}
+		if idx > index {
+			index = idx
+		}
+	}
+	return index, nil
+}
+
+// TableStats returns the number of rows in the named table, and their
+// approximate size in bytes. The size is that of the encoded rows, so
+// it excludes the indexes and the overhead of the underlying storage.
+func (s *StateSnapshot) TableStats(name string) (int, int, error) {
+	table := s.store.getTable(name)
+	if table == nil {
+		return 0, 0, fmt.Errorf("Unknown table '%s'", name)
+	}
+
+	idx, key, err := table.getIndex("id", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	var rows, bytes int
+	err = idx.iterate(s.tx, key, func(encRowId, res []byte) (bool, bool) {
+		rows++
+		bytes += len(res)
+		return false, false
+	})
+	return rows, bytes, err
+}
+
+// TableTreeStats returns the B+tree statistics of the named table
+func (s *StateSnapshot) TableTreeStats(name string) (*MDBStats, error) {
+	table := s.store.getTable(name)
+	if table == nil {
+		return nil, fmt.Errorf("Unknown table '%s'", name)
+	}
+	return table.StatsTxn(s.tx)
+}
+
+// EnvStats returns the storage statistics of the state store, without
+// those of the tables, which must be walked
+func (s *StateSnapshot) EnvStats() (*structs.StateStoreStats, error) {
+	stat, err := s.store.env.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.store.env.Info()
+	if err != nil {
+		return nil, err
+	}
+	return &structs.StateStoreStats{
+		Index:     s.lastIndex,
+		PageSize:  uint64(stat.PSize),
+		MapSize:   uint64(info.MapSize),
+		UsedPages: uint64(info.LastPNO) + 1,
+	}, nil
+}
+
+// StorageStats returns the storage statistics of the state store, and of
+// each of its tables
+func (s *StateSnapshot) StorageStats() (*structs.StateStoreStats, error) {
+	out, err := s.EnvStats()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range s.store.tables {
+		rows, size, err := s.TableStats(table.Name)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := table.StatsTxn(s.tx)
+		if err != nil {
+			return nil, err
+		}
+		out.Tables = append(out.Tables, &structs.StateTableStats{
+			Table:         table.Name,
+			Rows:          rows,
+			Bytes:         size,
+			Entries:       tree.Entries,
+			Depth:         tree.Depth,
+			BranchPages:   tree.BranchPages,
+			LeafPages:     tree.LeafPages,
+			OverflowPages: tree.OverflowPages,
+		})
+	}
+	return out, nil
+}
+
+// TableIndexes returns the last index that modified each table
+func (s *StateSnapshot) TableIndexes() (map[string]uint64, error) {
+	out := make(map[string]uint64, len(s.store.tables))
+	for _, table := range s.store.tables {
+		idx, err := table.LastIndexTxn(s.tx)
+		if err != nil {
+			return nil, err
+		}
+		out[table.Name] = idx
+	}
+	return out, nil
+}
+
 // KVSDump is used to list all KV entries. It takes a channel and streams
 // back *struct.DirEntry objects. This will block and should be invoked
 // in a goroutine.
@@ -2129,6 +7505,16 @@ func (s *StateSnapshot) SessionList() ([]*structs.Session, error) {
 	return out, err
 }
 
+// ACLUsageList is used to list when each token was last used
+func (s *StateSnapshot) ACLUsageList() (structs.ACLUsages, error) {
+	res, err := s.store.aclUsageTable.GetTxn(s.tx, "id")
+	out := make(structs.ACLUsages, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ACLUsage)
+	}
+	return out, err
+}
+
 // ACLList is used to list all of the ACLs
 func (s *StateSnapshot) ACLList() ([]*structs.ACL, error) {
 	res, err := s.store.aclTable.GetTxn(s.tx, "id")
@@ -2138,3 +7524,150 @@ func (s *StateSnapshot) ACLList() ([]*structs.ACL, error) {
 	}
 	return out, err
 }
+
+// CheckDefinitionList is used to list all of the check definitions
+func (s *StateSnapshot) CheckDefinitionList() (structs.CheckDefinitions, error) {
+	res, err := s.store.checkDefTable.GetTxn(s.tx, "id")
+	out := make(structs.CheckDefinitions, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.CheckDefinition)
+	}
+	return out, err
+}
+
+// ServiceConfigList is used to list all of the service configs
+func (s *StateSnapshot) ServiceConfigList() (structs.ServiceConfigs, error) {
+	res, err := s.store.serviceConfTable.GetTxn(s.tx, "id")
+	out := make(structs.ServiceConfigs, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ServiceConfig)
+	}
+	return out, err
+}
+
+// ConfigEntryList is used to list all of the config entries
+func (s *StateSnapshot) ConfigEntryList() (structs.ConfigEntries, error) {
+	res, err := s.store.configEntryTable.GetTxn(s.tx, "id")
+	out := make(structs.ConfigEntries, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.ConfigEntry)
+	}
+	return out, err
+}
+
+// ClusterConfig is used to get the cluster config, or nil if it was
+// never set
+func (s *StateSnapshot) ClusterConfig() (*structs.ClusterConfig, error) {
+	res, err := s.store.clusterConfTable.GetTxn(s.tx, "id", structs.ClusterConfigID)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return res[0].(*structs.ClusterConfig), nil
+}
+
+// FeatureList is used to list the enabled features
+func (s *StateSnapshot) FeatureList() (structs.Features, error) {
+	res, err := s.store.featureTable.GetTxn(s.tx, "id")
+	out := make(structs.Features, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Feature)
+	}
+	return out, err
+}
+
+// IntentionList is used to list all of the intentions
+func (s *StateSnapshot) IntentionList() (structs.Intentions, error) {
+	res, err := s.store.intentionTable.GetTxn(s.tx, "id")
+	out := make(structs.Intentions, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Intention)
+	}
+	return out, err
+}
+
+// NodeDrainList is used to list all of the draining nodes
+func (s *StateSnapshot) NodeDrainList() (structs.NodeDrains, error) {
+	res, err := s.store.nodeDrainTable.GetTxn(s.tx, "id")
+	out := make(structs.NodeDrains, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.NodeDrain)
+	}
+	return out, err
+}
+
+// RegistrationTimeList is used to list the registration times of all
+// the nodes and services
+func (s *StateSnapshot) RegistrationTimeList() (structs.RegistrationTimes, error) {
+	var out structs.RegistrationTimes
+	for _, table := range []*MDBTable{s.store.nodeRegTable, s.store.registrationTable} {
+		res, err := table.GetTxn(s.tx, "id")
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range res {
+			out = append(out, raw.(*structs.RegistrationTime))
+		}
+	}
+	return out, nil
+}
+
+// CheckHeardList is used to list the times a healthy status was last
+// heard for each check
+func (s *StateSnapshot) CheckHeardList() (structs.CheckHeards, error) {
+	res, err := s.store.checkHeardTable.GetTxn(s.tx, "id")
+	out := make(structs.CheckHeards, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.CheckHeard)
+	}
+	return out, err
+}
+
+// NodeSeenList is used to list the times each node was last seen alive
+func (s *StateSnapshot) NodeSeenList() (structs.NodeSeens, error) {
+	res, err := s.store.nodeSeenTable.GetTxn(s.tx, "id")
+	out := make(structs.NodeSeens, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.NodeSeen)
+	}
+	return out, err
+}
+
+// LockWaiterList is used to list the sessions queued for locks
+func (s *StateSnapshot) LockWaiterList() (structs.LockWaiters, error) {
+	res, err := s.store.lockWaiterTable.GetTxn(s.tx, "id")
+	out := make(structs.LockWaiters, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.LockWaiter)
+	}
+	return out, err
+}
+
+// CatalogEventList is used to list all the catalog events
+func (s *StateSnapshot) CatalogEventList() (structs.CatalogEvents, error) {
+	res, err := s.store.catalogEventTable.GetTxn(s.tx, "id")
+	out := make(structs.CatalogEvents, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.CatalogEvent)
+	}
+	return out, err
+}
+
+// UserEventList is used to list all of the user events
+func (s *StateSnapshot) UserEventList() (structs.UserEvents, error) {
+	res, err := s.store.userEventTable.GetTxn(s.tx, "id")
+	out := make(structs.UserEvents, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.UserEvent)
+	}
+	return out, err
+}
+
+// PrefixTombstoneList is used to list all the prefix tombstones
+func (s *StateSnapshot) PrefixTombstoneList() (structs.PrefixTombstones, error) {
+	res, err := s.store.prefixTombTable.GetTxn(s.tx, "id")
+	out := make(structs.PrefixTombstones, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.PrefixTombstone)
+	}
+	return out, err
+}
@@ -1,12 +1,15 @@
 package consul
 
 import (
+	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"sort"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/acl"
 	"github.com/hashicorp/consul/consul/structs"
 )
 
@@ -14,6 +17,25 @@ func testStateStore() (*StateStore, error) {
 	return NewStateStore(nil, os.Stderr)
 }
 
+func TestStateStore_Tables(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Every table and index must be opened, beyond the 64 named DBs
+	// the store used to be limited to
+	if n := store.tables.namedDBs(); n <= 64 {
+		t.Fatalf("bad: %d", n)
+	}
+	for _, table := range store.tables {
+		if _, _, err := table.Get("id"); err != nil {
+			t.Fatalf("table %s: %v", table.Name, err)
+		}
+	}
+}
+
 func TestEnsureRegistration(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -24,7 +46,7 @@ func TestEnsureRegistration(t *testing.T) {
 	reg := &structs.RegisterRequest{
 		Node:    "foo",
 		Address: "127.0.0.1",
-		Service: &structs.NodeService{"api", "api", nil, "", 5000, false},
+		Service: &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""},
 		Check: &structs.HealthCheck{
 			Node:      "foo",
 			CheckID:   "api",
@@ -74,6 +96,74 @@ func TestEnsureRegistration(t *testing.T) {
 	}
 }
 
+func TestEnsureRegistration_Namespaces(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Register the same service in the default namespace and in "a"
+	for i, ns := range []string{"", "a"} {
+		reg := &structs.RegisterRequest{
+			Node:    "foo",
+			Address: "127.0.0.1",
+			Service: &structs.NodeService{"web", "web", nil, "", 80 + i, false, "", false, ns, nil, ""},
+			Check: &structs.HealthCheck{
+				Node:      "foo",
+				CheckID:   "web",
+				Name:      "web alive",
+				Status:    structs.HealthPassing,
+				ServiceID: "web",
+			},
+		}
+		if err := store.EnsureRegistration(uint64(10+i), reg); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	_, nodes := store.ServiceNodes("web", nil)
+	if len(nodes) != 1 || nodes[0].ServicePort != 80 || nodes[0].Namespace != "" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, nodes = store.NamespaceServiceNodes("a", "web", nil)
+	if len(nodes) != 1 || nodes[0].ServicePort != 81 || nodes[0].Namespace != "a" {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	_, services := store.NodeServices("foo")
+	if len(services.Services) != 1 || services.Services["web"].Port != 80 {
+		t.Fatalf("bad: %v", services)
+	}
+	_, checks := store.NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Namespace != "" {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// The check of the namespaced service inherits its namespace
+	_, csn := store.NamespaceCheckServiceNodes("a", "web", nil)
+	if len(csn) != 1 || len(csn[0].Checks) != 1 || csn[0].Checks[0].Namespace != "a" {
+		t.Fatalf("bad: %v", csn)
+	}
+
+	// Deleting the namespaced service leaves the default one
+	if err := store.DeleteNamespaceService(12, "a", "foo", "web"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes = store.NamespaceServiceNodes("a", "web", nil)
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, checks = store.NamespaceNodeChecks("a", "foo")
+	if len(checks) != 0 {
+		t.Fatalf("bad: %v", checks)
+	}
+	_, csn = store.CheckServiceNodes("web", nil)
+	if len(csn) != 1 || len(csn[0].Checks) != 1 {
+		t.Fatalf("bad: %v", csn)
+	}
+}
+
 func TestEnsureNode(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -81,7 +171,7 @@ func TestEnsureNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -90,7 +180,7 @@ func TestEnsureNode(t *testing.T) {
 		t.Fatalf("Bad: %v %v %v", idx, found, addr)
 	}
 
-	if err := store.EnsureNode(4, structs.Node{"foo", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(4, structs.Node{Node: "foo", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -100,6 +190,59 @@ func TestEnsureNode(t *testing.T) {
 	}
 }
 
+func TestEnsureNode_NodeID(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	id := generateUUID()
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1", NodeID: id}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node := store.GetNodeByID(id)
+	if node == nil || node.Node != "foo" {
+		t.Fatalf("bad: %v", node)
+	}
+
+	// Nodes without an ID do not conflict
+	if err := store.EnsureNode(4, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(5, structs.Node{Node: "baz", Address: "127.0.0.3"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Another node cannot take the ID
+	err = store.EnsureNode(6, structs.Node{Node: "bar", Address: "127.0.0.2", NodeID: id})
+	if structs.ErrorCodeOf(err) != structs.ErrCodeNodeIDConflict {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Registering without an ID keeps the existing one
+	req := &structs.RegisterRequest{Node: "foo", Address: "127.0.0.4"}
+	if err := store.EnsureRegistration(7, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node = store.GetNodeByID(id)
+	if node == nil || node.Node != "foo" || node.Address != "127.0.0.4" {
+		t.Fatalf("bad: %v", node)
+	}
+
+	// Once the node is gone, the ID is free
+	if err := store.DeleteNode(8, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(9, structs.Node{Node: "bar", Address: "127.0.0.2", NodeID: id}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, node = store.GetNodeByID(id)
+	if node == nil || node.Node != "bar" {
+		t.Fatalf("bad: %v", node)
+	}
+}
+
 func TestGetNodes(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -107,11 +250,11 @@ func TestGetNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(40, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(40, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(41, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(41, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -141,7 +284,7 @@ func TestGetNodes_Watch_StopWatch(t *testing.T) {
 	store.Watch(store.QueryTables("Nodes"), notify2)
 	store.StopWatch(store.QueryTables("Nodes"), notify2)
 
-	if err := store.EnsureNode(40, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(40, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -165,11 +308,11 @@ func BenchmarkGetNodes(b *testing.B) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(100, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(100, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		b.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(101, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(101, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		b.Fatalf("err: %v", err)
 	}
 
@@ -185,19 +328,19 @@ func TestEnsureService(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(10, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(11, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(11, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5001, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5001, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(13, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -223,6 +366,107 @@ func TestEnsureService(t *testing.T) {
 	}
 }
 
+func TestEnsureService_Addresses(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Addresses must be IPs of the family of their tag
+	for _, addrs := range []map[string]string{
+		{"": "10.0.0.1"},
+		{"private": "db.local"},
+		{structs.AddressLANIPv4: "fd00::1"},
+		{structs.AddressWANIPv6: "10.0.0.1"},
+	} {
+		ns := &structs.NodeService{ID: "db", Service: "db", Addresses: addrs}
+		if err := store.EnsureService(11, "foo", ns); err == nil {
+			t.Fatalf("should fail: %v", addrs)
+		}
+	}
+
+	addrs := map[string]string{
+		structs.AddressLANIPv4: "10.0.0.1",
+		structs.AddressLANIPv6: "fd00::1",
+		"private":              "fd00::2",
+	}
+	ns := &structs.NodeService{ID: "db", Service: "db", Address: "10.0.0.1", Addresses: addrs}
+	if err := store.EnsureService(12, "foo", ns); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, services := store.NodeServices("foo")
+	if entry := services.Services["db"]; entry == nil || !reflect.DeepEqual(entry.Addresses, addrs) {
+		t.Fatalf("bad: %#v", services)
+	}
+	_, nodes := store.CheckServiceNodes("db", nil)
+	if len(nodes) != 1 || !reflect.DeepEqual(nodes[0].Service.Addresses, addrs) {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestEnsureRegistration_Source(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	reg := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{ID: "db", Service: "db", Port: 8000},
+		Check:   &structs.HealthCheck{Node: "foo", CheckID: "db", Name: "db", ServiceID: "db"},
+		Source:  structs.RegistrationSourceExternal,
+	}
+	if err := store.EnsureRegistration(10, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A registration without a source keeps the existing one
+	reg = &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{ID: "db", Service: "db", Port: 8001},
+		Check:   &structs.HealthCheck{Node: "foo", CheckID: "db", Name: "db", ServiceID: "db", Status: structs.HealthPassing},
+	}
+	if err := store.EnsureRegistration(11, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, services := store.NodeServices("foo")
+	if srv := services.Services["db"]; srv.Port != 8001 || srv.Source != structs.RegistrationSourceExternal {
+		t.Fatalf("bad: %v", srv)
+	}
+	_, nodes := store.ServiceNodes("db", nil)
+	if len(nodes) != 1 || nodes[0].ServiceSource != structs.RegistrationSourceExternal {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, checks := store.NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Status != structs.HealthPassing ||
+		checks[0].Source != structs.RegistrationSourceExternal {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// A new source replaces it
+	reg.Source = structs.RegistrationSourceAgent
+	if err := store.EnsureRegistration(12, reg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, services = store.NodeServices("foo")
+	if srv := services.Services["db"]; srv.Source != structs.RegistrationSourceAgent {
+		t.Fatalf("bad: %v", srv)
+	}
+	_, checks = store.NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Source != structs.RegistrationSourceAgent {
+		t.Fatalf("bad: %v", checks)
+	}
+}
+
 func TestEnsureService_DuplicateNode(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -230,19 +474,19 @@ func TestEnsureService_DuplicateNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(10, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(11, "foo", &structs.NodeService{"api1", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(11, "foo", &structs.NodeService{"api1", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api2", "api", nil, "", 5001, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{"api2", "api", nil, "", 5001, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "foo", &structs.NodeService{"api3", "api", nil, "", 5002, false}); err != nil {
+	if err := store.EnsureService(13, "foo", &structs.NodeService{"api3", "api", nil, "", 5002, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -283,11 +527,11 @@ func TestDeleteNodeService(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(11, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -331,15 +575,15 @@ func TestDeleteNodeService_One(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(11, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "foo", &structs.NodeService{"api2", "api", nil, "", 5001, false}); err != nil {
+	if err := store.EnsureService(13, "foo", &structs.NodeService{"api2", "api", nil, "", 5001, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -368,11 +612,11 @@ func TestDeleteNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(20, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(20, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(21, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(21, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -423,23 +667,23 @@ func TestGetServices(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(30, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(30, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(31, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(31, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(32, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(32, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(33, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(33, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(34, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(34, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -473,35 +717,35 @@ func TestServiceNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(10, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(11, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(13, "bar", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(13, "bar", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(14, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(14, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(15, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(15, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(16, "bar", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(16, "bar", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	idx, nodes := store.ServiceNodes("db")
+	idx, nodes := store.ServiceNodes("db", nil)
 	if idx != 16 {
 		t.Fatalf("bad: %v", 16)
 	}
@@ -557,6 +801,68 @@ func TestServiceNodes(t *testing.T) {
 	}
 }
 
+func TestNodesWithoutService(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(10, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureNode(11, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureNode(12, structs.Node{Node: "baz", Address: "127.0.0.3"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureService(13, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureService(14, "bar", &structs.NodeService{"db", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, nodes := store.NodesWithoutService("api")
+	if idx != 14 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	for _, n := range nodes {
+		if n.Node == "foo" {
+			t.Fatalf("bad: %v", nodes)
+		}
+	}
+
+	// Every node is missing an unknown service
+	_, nodes = store.NodesWithoutService("web")
+	if len(nodes) != 3 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// No node is missing once all provide it
+	if err := store.EnsureService(15, "bar", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(16, "baz", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, nodes = store.NodesWithoutService("api")
+	if idx != 16 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
 func TestServiceTagNodes(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -564,27 +870,27 @@ func TestServiceTagNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(15, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(15, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(16, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(16, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(17, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(17, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(18, "foo", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(18, "foo", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(19, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(19, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	idx, nodes := store.ServiceTagNodes("db", "master")
+	idx, nodes := store.ServiceTagNodes("db", "master", nil)
 	if idx != 19 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -612,27 +918,27 @@ func TestServiceTagNodes_MultipleTags(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(15, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(15, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(16, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(16, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(17, "foo", &structs.NodeService{"db", "db", []string{"master", "v2"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(17, "foo", &structs.NodeService{"db", "db", []string{"master", "v2"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(18, "foo", &structs.NodeService{"db2", "db", []string{"slave", "v2", "dev"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(18, "foo", &structs.NodeService{"db2", "db", []string{"slave", "v2", "dev"}, "", 8001, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(19, "bar", &structs.NodeService{"db", "db", []string{"slave", "v2"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(19, "bar", &structs.NodeService{"db", "db", []string{"slave", "v2"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	idx, nodes := store.ServiceTagNodes("db", "master")
+	idx, nodes := store.ServiceTagNodes("db", "master", nil)
 	if idx != 19 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -652,7 +958,7 @@ func TestServiceTagNodes_MultipleTags(t *testing.T) {
 		t.Fatalf("bad: %v", nodes)
 	}
 
-	idx, nodes = store.ServiceTagNodes("db", "v2")
+	idx, nodes = store.ServiceTagNodes("db", "v2", nil)
 	if idx != 19 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -660,7 +966,7 @@ func TestServiceTagNodes_MultipleTags(t *testing.T) {
 		t.Fatalf("bad: %v", nodes)
 	}
 
-	idx, nodes = store.ServiceTagNodes("db", "dev")
+	idx, nodes = store.ServiceTagNodes("db", "dev", nil)
 	if idx != 19 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -688,23 +994,23 @@ func TestStoreSnapshot(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(8, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(8, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureNode(9, structs.Node{"bar", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(9, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(10, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(10, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(11, "foo", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false}); err != nil {
+	if err := store.EnsureService(11, "foo", &structs.NodeService{"db2", "db", []string{"slave"}, "", 8001, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := store.EnsureService(12, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(12, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -889,13 +1195,13 @@ func TestStoreSnapshot(t *testing.T) {
 	}
 
 	// Make some changes!
-	if err := store.EnsureService(23, "foo", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(23, "foo", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(24, "bar", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(24, "bar", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureNode(25, structs.Node{"baz", "127.0.0.3"}); err != nil {
+	if err := store.EnsureNode(25, structs.Node{Node: "baz", Address: "127.0.0.3"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	checkAfter := &structs.HealthCheck{
@@ -1016,10 +1322,10 @@ func TestEnsureCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1057,7 +1363,7 @@ func TestEnsureCheck(t *testing.T) {
 		t.Fatalf("bad: %v", checks[1])
 	}
 
-	idx, checks = store.ServiceChecks("db")
+	idx, checks = store.ServiceChecks("db", structs.CheckCursor{}, 0)
 	if idx != 4 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -1068,7 +1374,7 @@ func TestEnsureCheck(t *testing.T) {
 		t.Fatalf("bad: %v", checks[0])
 	}
 
-	idx, checks = store.ChecksInState(structs.HealthPassing)
+	idx, checks = store.ChecksInState(structs.HealthPassing, structs.CheckCursor{}, 0)
 	if idx != 4 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -1079,7 +1385,7 @@ func TestEnsureCheck(t *testing.T) {
 		t.Fatalf("bad: %v", checks[0])
 	}
 
-	idx, checks = store.ChecksInState(structs.HealthWarning)
+	idx, checks = store.ChecksInState(structs.HealthWarning, structs.CheckCursor{}, 0)
 	if idx != 4 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -1090,7 +1396,7 @@ func TestEnsureCheck(t *testing.T) {
 		t.Fatalf("bad: %v", checks[0])
 	}
 
-	idx, checks = store.ChecksInState(structs.HealthAny)
+	idx, checks = store.ChecksInState(structs.HealthAny, structs.CheckCursor{}, 0)
 	if idx != 4 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -1105,6 +1411,85 @@ func TestEnsureCheck(t *testing.T) {
 	}
 }
 
+func TestEnsureCheck_Grace(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	start := time.Unix(1000, 0)
+	store.SetClock(start)
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "ttl",
+		Name:    "ttl",
+		Status:  structs.HealthPassing,
+		Output:  "ok",
+	}
+	if err := store.EnsureCheck(2, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A critical registration within the grace period keeps the status
+	store.SetClock(start.Add(5 * time.Second))
+	req := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Check: &structs.HealthCheck{
+			Node:    "foo",
+			CheckID: "ttl",
+			Name:    "ttl",
+			Status:  structs.HealthCritical,
+		},
+		CheckGrace: 10 * time.Second,
+	}
+	if err := store.EnsureRegistration(3, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks := store.NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Status != structs.HealthPassing || checks[0].Output != "ok" {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// Without a grace period the critical status is applied
+	if err := store.UpdateCheckStatus(4, "foo", "ttl", structs.HealthCritical, "", 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks = store.NodeChecks("foo")
+	if checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// Once the grace period has passed the critical status is applied
+	if err := store.UpdateCheckStatus(5, "foo", "ttl", structs.HealthPassing, "ok", 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.SetClock(start.Add(time.Minute))
+	if err := store.UpdateCheckStatus(6, "foo", "ttl", structs.HealthCritical, "", 10*time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, checks = store.NodeChecks("foo")
+	if checks[0].Status != structs.HealthCritical {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	// Deleting the check removes when it was heard
+	if err := store.DeleteNodeCheck(7, "foo", "ttl"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, res, err := store.checkHeardTable.Get("id")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
 func TestDeleteNodeCheck(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -1112,10 +1497,10 @@ func TestDeleteNodeCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1162,10 +1547,10 @@ func TestCheckServiceNodes(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1188,7 +1573,7 @@ func TestCheckServiceNodes(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	idx, nodes := store.CheckServiceNodes("db")
+	idx, nodes := store.CheckServiceNodes("db", nil)
 	if idx != 4 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -1212,7 +1597,7 @@ func TestCheckServiceNodes(t *testing.T) {
 		t.Fatalf("Bad: %v", nodes[0])
 	}
 
-	idx, nodes = store.CheckServiceTagNodes("db", "master")
+	idx, nodes = store.CheckServiceTagNodes("db", "master", nil)
 	if idx != 4 {
 		t.Fatalf("bad: %v", idx)
 	}
@@ -1243,10 +1628,10 @@ func BenchmarkCheckServiceNodes(t *testing.B) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1270,53 +1655,232 @@ func BenchmarkCheckServiceNodes(t *testing.B) {
 	}
 
 	for i := 0; i < t.N; i++ {
-		store.CheckServiceNodes("db")
+		store.CheckServiceNodes("db", nil)
 	}
 }
 
-func TestSS_Register_Deregister_Query(t *testing.T) {
+func TestServiceHasPassingInstance(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
-		t.Fatalf("err: %v", err)
+	if ok, _ := store.ServiceHasPassingInstance("db"); ok {
+		t.Fatalf("should have no passing instance")
 	}
 
-	srv := &structs.NodeService{
-		"statsite-box-stats",
-		"statsite-box-stats",
-		nil,
-		"",
-		0,
-		false}
-	if err := store.EnsureService(2, "foo", srv); err != nil {
-		t.Fatalf("err: %v", err)
+	for i, node := range []string{"foo", "bar"} {
+		if err := store.EnsureNode(uint64(1+i), structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.EnsureService(uint64(3+i), node, &structs.NodeService{"db1", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
 	}
 
-	srv = &structs.NodeService{
-		"statsite-share-stats",
-		"statsite-share-stats",
-		nil,
-		"",
-		0,
-		false}
-	if err := store.EnsureService(3, "foo", srv); err != nil {
-		t.Fatalf("err: %v", err)
+	// Instances without checks are passing
+	ok, idx := store.ServiceHasPassingInstance("db")
+	if !ok || idx != 4 {
+		t.Fatalf("bad: %v %v", ok, idx)
 	}
 
-	if err := store.DeleteNode(4, "foo"); err != nil {
+	// A failing service check fails its instance only
+	check := &structs.HealthCheck{
+		Node:      "foo",
+		CheckID:   "db",
+		Name:      "Can connect",
+		Status:    structs.HealthCritical,
+		ServiceID: "db1",
+	}
+	if err := store.EnsureCheck(5, check); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-
-	idx, nodes := store.CheckServiceNodes("statsite-share-stats")
-	if idx != 4 {
-		t.Fatalf("bad: %v", idx)
+	if ok, _ := store.ServiceHasPassingInstance("db"); !ok {
+		t.Fatalf("should have a passing instance")
 	}
-	if len(nodes) != 0 {
-		t.Fatalf("Bad: %v", nodes)
+
+	// A failing node check fails every instance of the node
+	check = &structs.HealthCheck{
+		Node:    "bar",
+		CheckID: SerfCheckID,
+		Name:    SerfCheckName,
+		Status:  structs.HealthWarning,
+	}
+	if err := store.EnsureCheck(6, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok, idx = store.ServiceHasPassingInstance("db")
+	if ok || idx != 6 {
+		t.Fatalf("bad: %v %v", ok, idx)
+	}
+
+	check.Status = structs.HealthPassing
+	if err := store.EnsureCheck(7, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, _ := store.ServiceHasPassingInstance("db"); !ok {
+		t.Fatalf("should have a passing instance")
+	}
+
+	// Draining nodes are skipped
+	if err := store.NodeDrain(8, "bar", true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, _ := store.ServiceHasPassingInstance("db"); ok {
+		t.Fatalf("should have no passing instance")
+	}
+}
+
+func TestPassingCheckServiceNodes(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i, node := range []string{"foo", "bar"} {
+		if err := store.EnsureNode(uint64(1+i), structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The status of an instance registered after its node checks
+	// includes them
+	nodeCheck := &structs.HealthCheck{
+		Node:    "bar",
+		CheckID: SerfCheckID,
+		Name:    SerfCheckName,
+		Status:  structs.HealthWarning,
+	}
+	if err := store.EnsureCheck(3, nodeCheck); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i, node := range []string{"foo", "bar"} {
+		if err := store.EnsureService(uint64(4+i), node, &structs.NodeService{"db1", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	statuses := func() map[string]string {
+		_, services := store.ServiceNodes("db", nil)
+		out := make(map[string]string)
+		for _, srv := range services {
+			out[srv.Node] = srv.AggregatedStatus
+		}
+		return out
+	}
+	expect := map[string]string{"foo": structs.HealthPassing, "bar": structs.HealthWarning}
+	if got := statuses(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad: %v", got)
+	}
+	idx, nodes := store.PassingCheckServiceNodes("db", nil)
+	if idx != 5 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 1 || nodes[0].Node.Node != "foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// The worst status of the service checks is kept
+	for i, status := range []string{structs.HealthWarning, structs.HealthCritical} {
+		check := &structs.HealthCheck{
+			Node:      "foo",
+			CheckID:   "db" + status,
+			Name:      "Can connect",
+			Status:    status,
+			ServiceID: "db1",
+		}
+		if err := store.EnsureCheck(uint64(6+i), check); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	expect["foo"] = structs.HealthCritical
+	if got := statuses(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad: %v", got)
+	}
+	if _, nodes := store.PassingCheckServiceNodes("db", nil); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Updating and deleting checks updates the status
+	if err := store.UpdateCheckStatus(8, "foo", "db"+structs.HealthCritical, structs.HealthPassing, "", 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNodeCheck(9, "foo", "db"+structs.HealthWarning); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNodeCheck(10, "bar", SerfCheckID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect = map[string]string{"foo": structs.HealthPassing, "bar": structs.HealthPassing}
+	if got := statuses(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("bad: %v", got)
+	}
+	idx, nodes = store.PassingCheckServiceNodes("db", nil)
+	if idx != 10 || len(nodes) != 2 {
+		t.Fatalf("bad: %v %v", idx, nodes)
+	}
+
+	// Changing the status leaves the index of the services as is
+	idx, _ = store.ServiceNodes("db", nil)
+	if idx != 5 {
+		t.Fatalf("bad: %v", idx)
+	}
+}
+
+func TestSS_Register_Deregister_Query(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	srv := &structs.NodeService{
+		"statsite-box-stats",
+		"statsite-box-stats",
+		nil,
+		"",
+		0,
+		false,
+		"",
+		false,
+		"",
+		nil,
+		""}
+	if err := store.EnsureService(2, "foo", srv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	srv = &structs.NodeService{
+		"statsite-share-stats",
+		"statsite-share-stats",
+		nil,
+		"",
+		0,
+		false,
+		"",
+		false,
+		"",
+		nil,
+		""}
+	if err := store.EnsureService(3, "foo", srv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.DeleteNode(4, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, nodes := store.CheckServiceNodes("statsite-share-stats", nil)
+	if idx != 4 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 0 {
+		t.Fatalf("Bad: %v", nodes)
 	}
 }
 
@@ -1327,10 +1891,10 @@ func TestNodeInfo(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -1386,16 +1950,16 @@ func TestNodeDump(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(1, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureNode(3, structs.Node{"baz", "127.0.0.2"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "baz", Address: "127.0.0.2"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(4, "baz", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false}); err != nil {
+	if err := store.EnsureService(4, "baz", &structs.NodeService{"db1", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -1618,7 +2182,7 @@ func TestKVSDelete(t *testing.T) {
 	}
 
 	// Check tombstone exists
-	_, res, err := store.tombstoneTable.Get("id", "/foo")
+	_, res, err := store.tombstoneTable.Get("id", "", "/foo")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1637,6 +2201,106 @@ func TestKVSDelete(t *testing.T) {
 	}
 }
 
+func TestKVSNamespaces(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// The same key in the default namespace and two others
+	ents := structs.DirEntries{
+		&structs.DirEntry{Key: "/foo", Value: []byte("default")},
+		&structs.DirEntry{Key: "/foo", Value: []byte("a"), Namespace: "a"},
+		&structs.DirEntry{Key: "/foo/bar", Value: []byte("a"), Namespace: "a"},
+		&structs.DirEntry{Key: "/foo", Value: []byte("b"), Namespace: "b"},
+	}
+	for i, d := range ents {
+		if err := store.KVSSet(uint64(1000+i), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	idx, d, err := store.KVSGet("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1003 || d == nil || string(d.Value) != "default" {
+		t.Fatalf("bad: %d %v", idx, d)
+	}
+	idx, d, err = store.KVSNamespaceGet("a", "/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1002 || d == nil || string(d.Value) != "a" || d.Namespace != "a" {
+		t.Fatalf("bad: %d %v", idx, d)
+	}
+	idx, d, err = store.KVSNamespaceGet("c", "/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 0 || d != nil {
+		t.Fatalf("bad: %d %v", idx, d)
+	}
+
+	// Listings only include the keys of the namespace
+	_, _, res, err := store.KVSList("/foo", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 || string(res[0].Value) != "default" {
+		t.Fatalf("bad: %v", res)
+	}
+	_, idx, res, err = store.KVSNamespaceList("a", "/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1002 || len(res) != 2 || res[0].Namespace != "a" || res[1].Namespace != "a" {
+		t.Fatalf("bad: %d %v", idx, res)
+	}
+
+	// Deleting a key leaves the others alone, and only advances the
+	// index of its namespace
+	if err := store.KVSNamespaceDelete(1010, "b", "/foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx, err := store.KVSNamespaceIndex("b"); err != nil || idx != 1010 {
+		t.Fatalf("bad: %d %v", idx, err)
+	}
+	if idx, err := store.KVSNamespaceIndex("a"); err != nil || idx != 1002 {
+		t.Fatalf("bad: %d %v", idx, err)
+	}
+	maxIndex, _, res, err := store.KVSNamespaceList("b", "/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if maxIndex != 1010 || len(res) != 0 {
+		t.Fatalf("bad: %d %v", maxIndex, res)
+	}
+	for _, ns := range []string{"", "a"} {
+		if _, d, err := store.KVSNamespaceGet(ns, "/foo"); err != nil || d == nil {
+			t.Fatalf("bad: %v %v", d, err)
+		}
+	}
+
+	// A tree delete of the default namespace leaves the others alone
+	if err := store.KVSDeleteTree(1020, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, d, err := store.KVSGet("/foo"); err != nil || d != nil {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+	if _, _, res, err := store.KVSNamespaceList("a", ""); err != nil || len(res) != 2 {
+		t.Fatalf("bad: %v %v", res, err)
+	}
+
+	// Locks are only supported in the default namespace
+	d = &structs.DirEntry{Key: "/lock", Namespace: "a", Session: "foo"}
+	if _, err := store.KVSLock(1030, d); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
 func TestKVSDeleteCheckAndSet(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -1758,7 +2422,7 @@ func TestKVS_List(t *testing.T) {
 	defer store.Close()
 
 	// Should not exist
-	_, idx, ents, err := store.KVSList("/web")
+	_, idx, ents, err := store.KVSList("/web", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1784,7 +2448,7 @@ func TestKVS_List(t *testing.T) {
 	}
 
 	// Should list
-	_, idx, ents, err = store.KVSList("/web")
+	_, idx, ents, err = store.KVSList("/web", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1840,7 +2504,7 @@ func TestKVSList_TombstoneIndex(t *testing.T) {
 	}
 
 	// List should properly reflect tombstoned value
-	tombIdx, idx, ents, err := store.KVSList("/web")
+	tombIdx, idx, ents, err := store.KVSList("/web", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1855,6 +2519,84 @@ func TestKVSList_TombstoneIndex(t *testing.T) {
 	}
 }
 
+func TestKVS_List_ACL(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	keys := []string{"/other", "/web/a", "/web/priv/shared/z", "/web/priv/x",
+		"/web/priv/y", "/web/sub/b"}
+	for i, key := range keys {
+		d := &structs.DirEntry{Key: key, Value: []byte("test")}
+		if err := store.KVSSet(uint64(1000+i), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	policy, err := acl.Parse(`
+key "/web/" {
+	policy = "read"
+}
+key "/web/priv/" {
+	policy = "deny"
+}
+key "/web/priv/shared/" {
+	policy = "read"
+}
+`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a, err := acl.New(acl.DenyAll(), policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The denied keys are skipped
+	_, _, ents, err := store.KVSList("", a)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var found []string
+	for _, ent := range ents {
+		found = append(found, ent.Key)
+	}
+	expect := []string{"/web/a", "/web/priv/shared/z", "/web/sub/b"}
+	if !reflect.DeepEqual(found, expect) {
+		t.Fatalf("bad: %v", found)
+	}
+
+	// A prefix that is entirely denied returns nothing
+	_, _, ents, err = store.KVSList("/web/priv/x", a)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 0 {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// Denied roll ups are skipped along with the keys beneath them
+	_, list, err := store.KVSListKeys("/web/", "/", a)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect = []string{"/web/a", "/web/sub/"}
+	if !reflect.DeepEqual(list, expect) {
+		t.Fatalf("bad: %v", list)
+	}
+
+	_, list, err = store.KVSListKeys("/web/priv/", "", a)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect = []string{"/web/priv/shared/z"}
+	if !reflect.DeepEqual(list, expect) {
+		t.Fatalf("bad: %v", list)
+	}
+}
+
 func TestKVS_ListKeys(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -1863,7 +2605,7 @@ func TestKVS_ListKeys(t *testing.T) {
 	defer store.Close()
 
 	// Should not exist
-	idx, keys, err := store.KVSListKeys("", "/")
+	idx, keys, err := store.KVSListKeys("", "/", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1889,7 +2631,7 @@ func TestKVS_ListKeys(t *testing.T) {
 	}
 
 	// Should list
-	idx, keys, err = store.KVSListKeys("", "/")
+	idx, keys, err = store.KVSListKeys("", "/", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1904,7 +2646,7 @@ func TestKVS_ListKeys(t *testing.T) {
 	}
 
 	// Should list just web
-	idx, keys, err = store.KVSListKeys("/", "/")
+	idx, keys, err = store.KVSListKeys("/", "/", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1919,7 +2661,7 @@ func TestKVS_ListKeys(t *testing.T) {
 	}
 
 	// Should list a, b, sub/
-	idx, keys, err = store.KVSListKeys("/web/", "/")
+	idx, keys, err = store.KVSListKeys("/web/", "/", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1940,7 +2682,7 @@ func TestKVS_ListKeys(t *testing.T) {
 	}
 
 	// Should list c
-	idx, keys, err = store.KVSListKeys("/web/sub/", "/")
+	idx, keys, err = store.KVSListKeys("/web/sub/", "/", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1955,7 +2697,7 @@ func TestKVS_ListKeys(t *testing.T) {
 	}
 
 	// Should list all
-	idx, keys, err = store.KVSListKeys("/web/", "")
+	idx, keys, err = store.KVSListKeys("/web/", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -1995,7 +2737,7 @@ func TestKVS_ListKeys_Index(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	idx, keys, err := store.KVSListKeys("/foo", "")
+	idx, keys, err := store.KVSListKeys("/foo", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2006,7 +2748,7 @@ func TestKVS_ListKeys_Index(t *testing.T) {
 		t.Fatalf("bad: %v", keys)
 	}
 
-	idx, keys, err = store.KVSListKeys("/ba", "")
+	idx, keys, err = store.KVSListKeys("/ba", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2017,7 +2759,7 @@ func TestKVS_ListKeys_Index(t *testing.T) {
 		t.Fatalf("bad: %v", keys)
 	}
 
-	idx, keys, err = store.KVSListKeys("/nope", "")
+	idx, keys, err = store.KVSListKeys("/nope", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2057,7 +2799,7 @@ func TestKVS_ListKeys_TombstoneIndex(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	idx, keys, err := store.KVSListKeys("/foo", "")
+	idx, keys, err := store.KVSListKeys("/foo", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2068,7 +2810,7 @@ func TestKVS_ListKeys_TombstoneIndex(t *testing.T) {
 		t.Fatalf("bad: %v", keys)
 	}
 
-	idx, keys, err = store.KVSListKeys("/ba", "")
+	idx, keys, err = store.KVSListKeys("/ba", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2079,7 +2821,7 @@ func TestKVS_ListKeys_TombstoneIndex(t *testing.T) {
 		t.Fatalf("bad: %v", keys)
 	}
 
-	idx, keys, err = store.KVSListKeys("/nope", "")
+	idx, keys, err = store.KVSListKeys("/nope", "", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2142,7 +2884,7 @@ func TestKVSDeleteTree(t *testing.T) {
 	}
 
 	// Nothing should list
-	tombIdx, idx, ents, err := store.KVSList("/web")
+	tombIdx, idx, ents, err := store.KVSList("/web", nil)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2157,7 +2899,7 @@ func TestKVSDeleteTree(t *testing.T) {
 	}
 
 	// Check tombstones exists
-	_, res, err := store.tombstoneTable.Get("id_prefix", "/web")
+	_, res, err := store.tombstoneTable.Get("id_prefix", "", "/web")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2198,75 +2940,155 @@ func TestKVSDeleteTree(t *testing.T) {
 	}
 }
 
-func TestReapTombstones(t *testing.T) {
+func TestKVSDeleteTree_PrefixTombstone(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer store.Close()
 
-	ttl := 10 * time.Millisecond
-	gran := 5 * time.Millisecond
-	gc, err := NewTombstoneGC(ttl, gran)
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	gc.SetEnabled(true)
-	store.gc = gc
-
-	// Should not exist
-	err = store.KVSDeleteTree(1000, "/web")
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-
-	// Create the entries
-	d := &structs.DirEntry{Key: "/web/a", Flags: 42, Value: []byte("test")}
+	d := &structs.DirEntry{Key: "/other", Value: []byte("test")}
 	if err := store.KVSSet(1000, d); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	d = &structs.DirEntry{Key: "/web/b", Flags: 42, Value: []byte("test")}
-	if err := store.KVSSet(1001, d); err != nil {
-		t.Fatalf("err: %v", err)
+	for i := 0; i <= prefixTombstoneThreshold; i++ {
+		d := &structs.DirEntry{Key: fmt.Sprintf("/web/%d", i), Value: []byte("test")}
+		if err := store.KVSSet(1001, d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
 	}
-	d = &structs.DirEntry{Key: "/web/sub/c", Flags: 42, Value: []byte("test")}
-	if err := store.KVSSet(1002, d); err != nil {
+	if err := store.KVSDelete(1002, "/web/0"); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	// Nuke just a
-	err = store.KVSDelete(1010, "/web/a")
-	if err != nil {
+	// Nuke the web tree
+	if err := store.KVSDeleteTree(1010, "/web/"); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	// Nuke the web tree
-	err = store.KVSDeleteTree(1020, "/web")
+	// The tombstones of the keys are replaced by a prefix tombstone
+	_, res, err := store.tombstoneTable.Get("id_prefix", "", "/web/")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-
-	// Do a reap, should be a noop
-	if err := store.ReapTombstones(1000); err != nil {
-		t.Fatalf("err: %v", err)
+	if len(res) != 0 {
+		t.Fatalf("bad: %v", res)
 	}
-
-	// Check tombstones exists
-	_, res, err := store.tombstoneTable.Get("id_prefix", "/web")
+	_, res, err = store.prefixTombTable.Get("id")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if len(res) != 3 {
-		t.Fatalf("bad: %#v", d)
+	if len(res) != 1 {
+		t.Fatalf("bad: %v", res)
+	}
+	if tomb := res[0].(*structs.PrefixTombstone); tomb.Prefix != "/web/" || tomb.ModifyIndex != 1010 {
+		t.Fatalf("bad: %#v", tomb)
 	}
 
-	// Do a reap, should remove just /web/a
-	if err := store.ReapTombstones(1010); err != nil {
+	// Listings above and below the prefix see the delete
+	for _, prefix := range []string{"/", "/web/", "/web/1"} {
+		tombIdx, _, ents, err := store.KVSList(prefix, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if tombIdx != 1010 {
+			t.Fatalf("bad: %s %v", prefix, tombIdx)
+		}
+		if prefix != "/" && len(ents) != 0 {
+			t.Fatalf("bad: %v", ents)
+		}
+
+		idx, _, err := store.KVSListKeys(prefix, "", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if idx != 1010 {
+			t.Fatalf("bad: %s %v", prefix, idx)
+		}
+	}
+
+	// Reaping removes the prefix tombstone
+	if err := store.ReapTombstones(1010); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, res, err = store.prefixTombTable.Get("id")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
+func TestReapTombstones(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	ttl := 10 * time.Millisecond
+	gran := 5 * time.Millisecond
+	gc, err := NewTombstoneGC(ttl, gran)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	gc.SetEnabled(true)
+	store.gc = gc
+
+	// Should not exist
+	err = store.KVSDeleteTree(1000, "/web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create the entries
+	d := &structs.DirEntry{Key: "/web/a", Flags: 42, Value: []byte("test")}
+	if err := store.KVSSet(1000, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d = &structs.DirEntry{Key: "/web/b", Flags: 42, Value: []byte("test")}
+	if err := store.KVSSet(1001, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d = &structs.DirEntry{Key: "/web/sub/c", Flags: 42, Value: []byte("test")}
+	if err := store.KVSSet(1002, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nuke just a
+	err = store.KVSDelete(1010, "/web/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nuke the web tree
+	err = store.KVSDeleteTree(1020, "/web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Do a reap, should be a noop
+	if err := store.ReapTombstones(1000); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Check tombstones exists
+	_, res, err := store.tombstoneTable.Get("id_prefix", "", "/web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("bad: %#v", d)
+	}
+
+	// Do a reap, should remove just /web/a
+	if err := store.ReapTombstones(1010); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
 	// Check tombstones exists
-	_, res, err = store.tombstoneTable.Get("id_prefix", "/web")
+	_, res, err = store.tombstoneTable.Get("id_prefix", "", "/web")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2280,7 +3102,7 @@ func TestReapTombstones(t *testing.T) {
 	}
 
 	// Check no tombstones exists
-	_, res, err = store.tombstoneTable.Get("id_prefix", "/web")
+	_, res, err = store.tombstoneTable.Get("id_prefix", "", "/web")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -2296,7 +3118,7 @@ func TestSessionCreate(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2341,7 +3163,7 @@ func TestSessionCreate_Invalid(t *testing.T) {
 	}
 
 	// Check not registered
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	if err := store.SessionCreate(1000, session); err.Error() != "Missing check 'bar' registration" {
@@ -2362,6 +3184,256 @@ func TestSessionCreate_Invalid(t *testing.T) {
 	}
 }
 
+func TestNodeNameCase(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "Foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writes naming the node with another case use its registered name
+	req := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.2",
+		Service: &structs.NodeService{ID: "api", Service: "api"},
+		Check:   &structs.HealthCheck{Node: "FOO", CheckID: "mem", Name: "mem"},
+	}
+	if err := store.EnsureRegistration(2, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(3, "FOO", &structs.NodeService{ID: "db", Service: "db"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, services := store.NodeServices("foo")
+	if services == nil || services.Node.Node != "Foo" || services.Node.Address != "127.0.0.2" ||
+		len(services.Services) != 2 {
+		t.Fatalf("bad: %#v", services)
+	}
+	_, checks := store.NodeChecks("Foo")
+	if len(checks) != 1 || checks[0].CheckID != "mem" {
+		t.Fatalf("bad: %v", checks)
+	}
+
+	session := &structs.Session{ID: generateUUID(), Node: "fOO"}
+	if err := store.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if session.Node != "Foo" {
+		t.Fatalf("bad: %v", session)
+	}
+
+	// New nodes are lowercased once the cluster config asks for it,
+	// while existing nodes keep their name
+	conf := &structs.ClusterConfig{LowercaseNodeNames: true}
+	if err := store.ClusterConfigSet(5, conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(6, structs.Node{Node: "Bar", Address: "127.0.0.3"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(7, structs.Node{Node: "FOO", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes := store.Nodes()
+	if len(nodes) != 2 || nodes[0].Node != "bar" || nodes[1].Node != "Foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestMergeNodeNames(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "Foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "Foo", &structs.NodeService{ID: "api", Service: "api", Port: 80}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "Foo"}
+	if err := store.SessionCreate(3, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Write the rows left by the writes made before the names were
+	// normalized, including one of a node that is gone
+	tx, err := store.tables.StartTxn(false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rows := []*structs.ServiceNode{
+		&structs.ServiceNode{Node: "foo", ServiceID: "api", ServiceName: "api", ServicePort: 8080},
+		&structs.ServiceNode{Node: "FOO", ServiceID: "db", ServiceName: "db"},
+		&structs.ServiceNode{Node: "gone", ServiceID: "web", ServiceName: "web"},
+	}
+	for _, row := range rows {
+		if err := store.serviceTable.InsertTxn(tx, row); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	check := &structs.HealthCheck{Node: "foo", CheckID: "mem", Name: "mem", Status: structs.HealthPassing}
+	if err := store.checkTable.InsertTxn(tx, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := &structs.ClusterConfig{LowercaseNodeNames: true}
+	if err := store.ClusterConfigSet(4, conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.MergeNodeNames(5); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The node is lowercased, and its rows are merged, keeping the
+	// rows of the registered name
+	_, nodes := store.Nodes()
+	if len(nodes) != 1 || nodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	idx, services := store.NodeServices("foo")
+	if idx != 5 || services == nil || len(services.Services) != 2 ||
+		services.Services["api"].Port != 80 || services.Services["db"] == nil {
+		t.Fatalf("bad: %d %#v", idx, services)
+	}
+	_, checks := store.NodeChecks("foo")
+	if len(checks) != 1 || checks[0].Node != "foo" || checks[0].CheckID != "mem" {
+		t.Fatalf("bad: %v", checks)
+	}
+	_, out, err := store.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || out.Node != "foo" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	tx, err = store.tables.StartTxn(true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	res, err := store.serviceTable.GetTxn(tx, "id")
+	tx.Abort()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// Deletes naming the node with another case find its rows
+	if err := store.DeleteNodeService(6, "FOO", "db"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNodeCheck(7, "Foo", "mem"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, services = store.NodeServices("foo")
+	if len(services.Services) != 1 {
+		t.Fatalf("bad: %#v", services)
+	}
+	_, checks = store.NodeChecks("foo")
+	if len(checks) != 0 {
+		t.Fatalf("bad: %v", checks)
+	}
+	if err := store.DeleteNode(8, "FOO"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes = store.Nodes()
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestSessionCreate_ClusterConfig(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without a config, the built-in defaults apply
+	session := &structs.Session{
+		ID:        generateUUID(),
+		Node:      "foo",
+		LockDelay: 2 * time.Minute,
+	}
+	if err := store.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if session.Behavior != structs.SessionKeysRelease || session.LockDelay != structs.MaxLockDelay {
+		t.Fatalf("bad: %v", session)
+	}
+
+	// Invalid configs are rejected
+	bad := &structs.ClusterConfig{
+		SessionLockDelayMin: 2 * time.Minute,
+	}
+	if err := store.ClusterConfigSet(5, bad); err == nil {
+		t.Fatalf("expected error")
+	}
+	bad = &structs.ClusterConfig{
+		SessionBehavior: "nope",
+	}
+	if err := store.ClusterConfigSet(5, bad); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	conf := &structs.ClusterConfig{
+		SessionBehavior:     structs.SessionKeysDelete,
+		SessionLockDelayMin: 5 * time.Second,
+		SessionLockDelayMax: 30 * time.Second,
+	}
+	if err := store.ClusterConfigSet(5, conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, out, err := store.ClusterConfigGet()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || out == nil || out.ID != structs.ClusterConfigID ||
+		out.SessionBehavior != structs.SessionKeysDelete {
+		t.Fatalf("bad: %d %v", idx, out)
+	}
+
+	// The config supplies the behavior and bounds the lock-delay
+	session = &structs.Session{
+		ID:   generateUUID(),
+		Node: "foo",
+	}
+	if err := store.SessionCreate(6, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if session.Behavior != structs.SessionKeysDelete || session.LockDelay != 5*time.Second {
+		t.Fatalf("bad: %v", session)
+	}
+	session = &structs.Session{
+		ID:        generateUUID(),
+		Node:      "foo",
+		Behavior:  structs.SessionKeysRelease,
+		LockDelay: time.Minute,
+	}
+	if err := store.SessionCreate(7, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if session.Behavior != structs.SessionKeysRelease || session.LockDelay != 30*time.Second {
+		t.Fatalf("bad: %v", session)
+	}
+}
+
 func TestSession_Lookups(t *testing.T) {
 	store, err := testStateStore()
 	if err != nil {
@@ -2370,7 +3442,7 @@ func TestSession_Lookups(t *testing.T) {
 	defer store.Close()
 
 	// Create a session
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{
@@ -2455,7 +3527,7 @@ func TestSessionInvalidate_CriticalHealthCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2499,7 +3571,7 @@ func TestSessionInvalidate_DeleteHealthCheck(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2542,7 +3614,7 @@ func TestSessionInvalidate_DeleteNode(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -2576,10 +3648,10 @@ func TestSessionInvalidate_DeleteNodeService(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(11, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false}); err != nil {
+	if err := store.EnsureService(12, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	check := &structs.HealthCheck{
@@ -2624,7 +3696,7 @@ func TestKVSLock(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
@@ -2697,7 +3769,7 @@ func TestKVSUnlock(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{ID: generateUUID(), Node: "foo"}
@@ -2754,7 +3826,7 @@ func TestSessionInvalidate_KeyUnlock(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 	defer store.Close()
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{
@@ -2822,7 +3894,7 @@ func TestSessionInvalidate_KeyDelete(t *testing.T) {
 	}
 	defer store.Close()
 
-	if err := store.EnsureNode(3, structs.Node{"foo", "127.0.0.1"}); err != nil {
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	session := &structs.Session{
@@ -3022,3 +4094,2697 @@ func TestACLList(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestACLUsage(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	a := &structs.ACL{
+		ID:   generateUUID(),
+		Name: "User token",
+		Type: structs.ACLTypeClient,
+	}
+	if err := store.ACLSet(50, a); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown tokens are ignored
+	now := time.Now().Round(time.Second)
+	store.SetClock(now)
+	if err := store.ACLUsage(51, []string{a.ID, "nope"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The ACL table is not modified by the usage
+	idx, out, err := store.ACLGet(a.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 50 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if out.ModifyIndex != 50 || out.LastUsedIndex != 51 || !out.LastUsedTime.Equal(now) {
+		t.Fatalf("bad: %v", out)
+	}
+	_, missing, err := store.ACLGet("nope")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if missing != nil {
+		t.Fatalf("bad: %v", missing)
+	}
+
+	// Updating the token keeps its usage
+	a2 := &structs.ACL{
+		ID:   a.ID,
+		Name: "Renamed token",
+		Type: structs.ACLTypeClient,
+	}
+	if err := store.ACLSet(52, a2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, out, err = store.ACLGet(a.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.ModifyIndex != 52 || out.LastUsedIndex != 51 || !out.LastUsedTime.Equal(now) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestNodeHeartbeat(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nodes never seen are not returned
+	_, seen, err := store.NodeLastSeen("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if seen != nil {
+		t.Fatalf("bad: %v", seen)
+	}
+
+	// Unknown nodes are ignored, and names are matched regardless of case
+	now := time.Now().Round(time.Second)
+	store.SetClock(now)
+	if err := store.NodeHeartbeat(2, []string{"FOO", "nope"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, seen, err := store.NodeLastSeen("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 2 || seen == nil || seen.Node != "foo" || seen.ModifyIndex != 2 ||
+		seen.SeenAt != now.UnixNano() {
+		t.Fatalf("bad: %v %v", idx, seen)
+	}
+	_, missing, err := store.NodeLastSeen("nope")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if missing != nil {
+		t.Fatalf("bad: %v", missing)
+	}
+
+	// Deleting the node forgets when it was seen
+	if err := store.DeleteNode(3, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, seen, err = store.NodeLastSeen("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if seen != nil {
+		t.Fatalf("bad: %v", seen)
+	}
+}
+
+func TestCheckDefinitionSet_Get_Delete(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	def := &structs.CheckDefinition{
+		Node:      "foo",
+		CheckID:   "web",
+		Name:      "web http",
+		ServiceID: "web",
+		HTTP:      "http://127.0.0.1:80/health",
+		Interval:  10 * time.Second,
+	}
+
+	// Should fail without a node
+	if err := store.CheckDefinitionSet(10, def); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should fail without a service
+	if err := store.CheckDefinitionSet(12, def); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if err := store.EnsureService(13, "foo", &structs.NodeService{"web", "web", nil, "", 80, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should fail with both HTTP and TCP
+	def.TCP = "127.0.0.1:80"
+	if err := store.CheckDefinitionSet(14, def); err == nil {
+		t.Fatalf("expected error")
+	}
+	def.TCP = ""
+
+	if err := store.CheckDefinitionSet(15, def); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if def.CreateIndex != 15 || def.ModifyIndex != 15 {
+		t.Fatalf("bad: %v", def)
+	}
+	if def.ServiceName != "web" {
+		t.Fatalf("bad: %v", def)
+	}
+
+	idx, out, err := store.CheckDefinitionGet("foo", "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 15 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if !reflect.DeepEqual(out, def) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Update
+	def.Interval = 30 * time.Second
+	if err := store.CheckDefinitionSet(16, def); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if def.CreateIndex != 15 || def.ModifyIndex != 16 {
+		t.Fatalf("bad: %v", def)
+	}
+
+	idx, defs, err := store.CheckDefinitionList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 16 || len(defs) != 1 {
+		t.Fatalf("bad: %v %v", idx, defs)
+	}
+
+	if err := store.CheckDefinitionDelete(17, "foo", "web"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, out, err = store.CheckDefinitionGet("foo", "web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 17 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if out != nil {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestCheckDefinition_DeleteNode(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(11, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	def := &structs.CheckDefinition{
+		Node:     "foo",
+		CheckID:  "ping",
+		TCP:      "127.0.0.1:22",
+		Interval: 10 * time.Second,
+	}
+	if err := store.CheckDefinitionSet(12, def); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.DeleteNode(13, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, out, err := store.CheckDefinitionGet("foo", "ping")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 13 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if out != nil {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestStateStore_NotifyWindow(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	store.SetNotifyWindow(50 * time.Millisecond)
+
+	notify := make(chan struct{}, 1)
+	store.Watch(store.QueryTables("Nodes"), notify)
+
+	notifyKV := make(chan struct{}, 1)
+	store.WatchKV("/foo", notifyKV)
+
+	for i := 0; i < 10; i++ {
+		if err := store.EnsureNode(uint64(40+i), structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.KVSSet(uint64(40+i), &structs.DirEntry{Key: "/foo/bar"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Should not be notified until the window elapses
+	select {
+	case <-notify:
+		t.Fatalf("should not be notified")
+	case <-notifyKV:
+		t.Fatalf("should not be notified")
+	default:
+	}
+
+	for _, ch := range []chan struct{}{notify, notifyKV} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("should be notified")
+		}
+	}
+}
+
+func TestTombstoneList(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i, key := range []string{"/web/b", "/web/a", "/db/a", "/web/c"} {
+		d := &structs.DirEntry{Key: key, Value: []byte("test")}
+		if err := store.KVSSet(uint64(1+i), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for i, key := range []string{"/web/b", "/web/a", "/db/a"} {
+		if err := store.KVSDelete(uint64(5+i), key); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Prefix tombstones containing the prefix or beneath it are listed
+	for _, prefix := range []string{"/", "/web/x/", "/db/"} {
+		tomb := &structs.PrefixTombstone{Prefix: prefix, ModifyIndex: 8}
+		if err := store.PrefixTombstoneRestore(tomb); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	idx, tombs, err := store.TombstoneList("/web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 7 {
+		t.Fatalf("bad: %v", idx)
+	}
+	expected := structs.Tombstones{
+		&structs.Tombstone{Key: "/", ModifyIndex: 8, Prefix: true},
+		&structs.Tombstone{Key: "/web/a", ModifyIndex: 6},
+		&structs.Tombstone{Key: "/web/b", ModifyIndex: 5},
+		&structs.Tombstone{Key: "/web/x/", ModifyIndex: 8, Prefix: true},
+	}
+	if !reflect.DeepEqual(tombs, expected) {
+		t.Fatalf("bad: %v", tombs)
+	}
+
+	// Reaped tombstones are no longer listed
+	if err := store.ReapTombstones(5); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, tombs, err = store.TombstoneList("/web/b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tombs) != 1 || tombs[0].Key != "/" {
+		t.Fatalf("bad: %v", tombs)
+	}
+}
+
+func TestKVSListLocked(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Lock a few keys, inside and outside the prefix
+	for i, key := range []string{"/web/b", "/web/a", "/db/a"} {
+		d := &structs.DirEntry{Key: key, Session: session.ID}
+		if ok, err := store.KVSLock(uint64(5+i), d); err != nil || !ok {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Set a key without a lock
+	if err := store.KVSSet(8, &structs.DirEntry{Key: "/web/c"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, locks, err := store.KVSListLocked("/web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 8 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(locks) != 2 {
+		t.Fatalf("bad: %v", locks)
+	}
+	if locks[0].Key != "/web/a" || locks[1].Key != "/web/b" {
+		t.Fatalf("bad: %v", locks)
+	}
+	for _, l := range locks {
+		if l.Session != session.ID || l.Node != "foo" || l.LockIndex != 1 {
+			t.Fatalf("bad: %v", l)
+		}
+	}
+
+	// Destroying the session releases the locks
+	if err := store.SessionDestroy(9, session.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, locks, err = store.KVSListLocked("/web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 9 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(locks) != 0 {
+		t.Fatalf("bad: %v", locks)
+	}
+}
+
+func TestKVSStats(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// An empty prefix has no keys
+	idx, stats, err := store.KVSStats("/web/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 0 || stats.Keys != 0 || stats.ValueBytes != 0 || stats.Depth != 0 || stats.MaxIndex != 0 {
+		t.Fatalf("bad: %v %v", idx, stats)
+	}
+
+	for i, key := range []string{"/web/a", "/web/sub/b", "/web/priv/deep/c", "/db/d"} {
+		d := &structs.DirEntry{Key: key, Value: []byte(key)}
+		if err := store.KVSSet(uint64(1+i), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	idx, stats, err = store.KVSStats("/web/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 3 {
+		t.Fatalf("bad: %v", idx)
+	}
+	expect := &structs.KVSStats{Keys: 3, ValueBytes: 32, Depth: 2, MaxIndex: 3}
+	if !reflect.DeepEqual(stats, expect) {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// A deleted key only raises the index
+	if err := store.KVSDelete(5, "/web/a"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, stats, err = store.KVSStats("/web/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || stats.Keys != 2 || stats.MaxIndex != 3 {
+		t.Fatalf("bad: %v %v", idx, stats)
+	}
+
+	// Only the keys the ACL can read are counted
+	policy, err := acl.Parse(`
+key "/web/" {
+	policy = "read"
+}
+key "/web/priv/" {
+	policy = "deny"
+}
+`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a, err := acl.New(acl.DenyAll(), policy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, stats, err = store.KVSStats("/web/", a)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect = &structs.KVSStats{Keys: 1, ValueBytes: 10, Depth: 1, MaxIndex: 2}
+	if !reflect.DeepEqual(stats, expect) {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+func TestReapTombstonesPrefix(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Create and delete entries under two prefixes
+	for i, key := range []string{"/election/a", "/election/b", "/web/a"} {
+		d := &structs.DirEntry{Key: key, Value: []byte("test")}
+		if err := store.KVSSet(uint64(1000+i), d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.KVSDelete(uint64(1010+i), key); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, prefix := range []string{"/election/c/", "/web/b/"} {
+		tomb := &structs.PrefixTombstone{Prefix: prefix, ModifyIndex: 1015}
+		if err := store.PrefixTombstoneRestore(tomb); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Reap only the election prefix
+	if err := store.ReapTombstonesPrefix(1020, "/election"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, res, err := store.tombstoneTable.Get("id_prefix", "", "/election")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Tombstones outside the prefix must be kept
+	_, res, err = store.tombstoneTable.Get("id_prefix", "", "/web")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("bad: %#v", res)
+	}
+	_, res, err = store.prefixTombTable.Get("id")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 || res[0].(*structs.PrefixTombstone).Prefix != "/web/b/" {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestServicesSummary(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(30, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureNode(31, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureService(32, "foo", &structs.NodeService{"api", "api", nil, "", 5000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureService(33, "foo", &structs.NodeService{"db", "db", []string{"master"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureService(34, "foo", &structs.NodeService{"db2", "db", []string{"master"}, "", 8001, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureService(35, "bar", &structs.NodeService{"db", "db", []string{"slave"}, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, summaries := store.ServicesSummary()
+	if idx != 35 {
+		t.Fatalf("bad: %v", idx)
+	}
+
+	api, ok := summaries["api"]
+	if !ok {
+		t.Fatalf("missing api: %#v", summaries)
+	}
+	if api.Instances != 1 || api.Nodes != 1 || len(api.Tags) != 0 {
+		t.Fatalf("Bad entry: %#v", api)
+	}
+
+	db, ok := summaries["db"]
+	if !ok {
+		t.Fatalf("missing db: %#v", summaries)
+	}
+	if db.Instances != 3 || db.Nodes != 2 {
+		t.Fatalf("Bad entry: %#v", db)
+	}
+	sort.Strings(db.Tags)
+	if len(db.Tags) != 2 || db.Tags[0] != "master" || db.Tags[1] != "slave" {
+		t.Fatalf("Bad entry: %#v", db.Tags)
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &structs.DirEntry{Key: "/foo", Value: []byte("test")}
+	if err := store.KVSSet(3, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSDelete(4, "/foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNode(5, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, changes, err := store.ChangesSince(0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 {
+		t.Fatalf("bad: %v", idx)
+	}
+	expect := structs.Changes{
+		&structs.Change{1, dbNodes, "", "foo", structs.ChangeSet},
+		&structs.Change{2, dbServices, "", "foo/db", structs.ChangeSet},
+		&structs.Change{3, dbKVS, "", "/foo", structs.ChangeSet},
+		&structs.Change{4, dbKVS, "", "/foo", structs.ChangeDelete},
+		&structs.Change{5, dbServices, "", "foo/", structs.ChangeDeleteTree},
+		&structs.Change{5, dbNodes, "", "foo", structs.ChangeDelete},
+	}
+	if !reflect.DeepEqual(changes, expect) {
+		t.Fatalf("bad: %#v", changes)
+	}
+
+	// Only the later changes should be returned
+	_, changes, err = store.ChangesSince(3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(changes, expect[3:]) {
+		t.Fatalf("bad: %#v", changes)
+	}
+
+	// After a reset, earlier changes are no longer available
+	if err := store.ResetChangeLog(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := store.ChangesSince(3); err != errChangeLogTruncated {
+		t.Fatalf("err: %v", err)
+	}
+	_, changes, err = store.ChangesSince(5)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("bad: %#v", changes)
+	}
+
+	// An aborted txn does not advance the sequence
+	tx, err := store.tables.StartTxn(false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.recordChangeTxn(6, tx, dbNodes, "bar", structs.ChangeSet); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tx.Abort()
+	if store.changeSeq != uint64(len(expect)) {
+		t.Fatalf("bad: %d", store.changeSeq)
+	}
+
+	// The keys of the KV namespaces are recorded too
+	d = &structs.DirEntry{Namespace: "team", Key: "/foo", Value: []byte("test")}
+	if err := store.KVSSet(6, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, changes, err = store.ChangesSince(5)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ns := &structs.Change{6, dbKVS, "team", "/foo", structs.ChangeSet}
+	if len(changes) != 1 || !reflect.DeepEqual(changes[0], ns) {
+		t.Fatalf("bad: %#v", changes)
+	}
+	if store.changeSeq != uint64(len(expect)+1) {
+		t.Fatalf("bad: %d", store.changeSeq)
+	}
+}
+
+func TestKVSSetCASMulti(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Create an existing entry
+	d := &structs.DirEntry{Key: "/foo", Value: []byte("test")}
+	if err := store.KVSSet(1000, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// One wrong precondition should fail the whole batch
+	entries := structs.DirEntries{
+		&structs.DirEntry{Key: "/foo", ModifyIndex: 1000, Value: []byte("foo")},
+		&structs.DirEntry{Key: "/bar", ModifyIndex: 1, Value: []byte("bar")},
+	}
+	ok, err := store.KVSSetCASMulti(1001, entries)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("unexpected commit")
+	}
+	_, d, err = store.KVSGet("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.ModifyIndex != 1000 || string(d.Value) != "test" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Duplicate keys are rejected
+	entries[1].Key = "/foo"
+	if _, err := store.KVSSetCASMulti(1001, entries); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// All preconditions hold, should commit
+	entries[1].Key = "/bar"
+	entries[1].ModifyIndex = 0
+	ok, err = store.KVSSetCASMulti(1002, entries)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected commit")
+	}
+	for _, key := range []string{"/foo", "/bar"} {
+		_, d, err := store.KVSGet(key)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d == nil || d.ModifyIndex != 1002 {
+			t.Fatalf("bad: %v", d)
+		}
+	}
+}
+
+func TestKVSBatch(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Create existing entries
+	for _, key := range []string{"/foo", "/tree/a", "/tree/b"} {
+		if err := store.KVSSet(1000, &structs.DirEntry{Key: key}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// An invalid operation should fail the whole batch
+	ops := structs.KVSBatchOps{
+		&structs.KVSBatchOp{Op: structs.KVSSet, DirEnt: structs.DirEntry{Key: "/bar", Value: []byte("bar")}},
+		&structs.KVSBatchOp{Op: structs.KVSCAS, DirEnt: structs.DirEntry{Key: "/baz"}},
+	}
+	if err := store.KVSBatch(1001, ops); err == nil {
+		t.Fatalf("expected error")
+	}
+	_, d, err := store.KVSGet("/bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Apply a valid batch
+	ops[1] = &structs.KVSBatchOp{Op: structs.KVSDelete, DirEnt: structs.DirEntry{Key: "/foo"}}
+	ops = append(ops, &structs.KVSBatchOp{Op: structs.KVSDeleteTree, DirEnt: structs.DirEntry{Key: "/tree/"}})
+	if err := store.KVSBatch(1002, ops); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, _, ents, err := store.KVSList("/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1002 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(ents) != 1 || ents[0].Key != "/bar" || ents[0].ModifyIndex != 1002 {
+		t.Fatalf("bad: %v", ents)
+	}
+}
+
+func TestKVSImport(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.KVSSet(10, &structs.DirEntry{Key: "/used/foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Cannot import into a prefix with existing keys
+	ents := structs.DirEntries{
+		&structs.DirEntry{Key: "/used/bar", CreateIndex: 5, ModifyIndex: 5},
+	}
+	if err := store.KVSImport(1000, "/used/", ents); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Entries outside the prefix are rejected
+	ents = structs.DirEntries{
+		&structs.DirEntry{Key: "/new/foo", Value: []byte("foo"), CreateIndex: 5, ModifyIndex: 500},
+		&structs.DirEntry{Key: "/other", CreateIndex: 6, ModifyIndex: 6},
+	}
+	if err := store.KVSImport(1000, "/new/", ents); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Entries modified at or after the import are rejected
+	ents[1] = &structs.DirEntry{Key: "/new/bar", CreateIndex: 6, ModifyIndex: 1000}
+	if err := store.KVSImport(1000, "/new/", ents); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The indexes of the entries are kept, and sessions are dropped
+	ents[1] = &structs.DirEntry{Key: "/new/bar", CreateIndex: 6, ModifyIndex: 7, LockIndex: 2, Session: "foo"}
+	if err := store.KVSImport(1000, "/new/", ents); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, _, out, err := store.KVSList("/new/", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1000 || len(out) != 2 {
+		t.Fatalf("bad: %v %v", idx, out)
+	}
+	if out[0].Key != "/new/bar" || out[0].CreateIndex != 6 || out[0].ModifyIndex != 7 ||
+		out[0].LockIndex != 2 || out[0].Session != "" {
+		t.Fatalf("bad: %v", out[0])
+	}
+	if out[1].Key != "/new/foo" || out[1].CreateIndex != 5 || out[1].ModifyIndex != 500 {
+		t.Fatalf("bad: %v", out[1])
+	}
+
+	// Check-and-set against the original index works
+	ok, err := store.KVSCheckAndSet(1001, &structs.DirEntry{Key: "/new/foo", ModifyIndex: 500})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// Importing again is rejected
+	if err := store.KVSImport(1002, "/new/", ents); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestKVSUndelete(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Should fail without soft delete
+	if _, err := store.KVSUndelete(1000, "/foo"); err == nil {
+		t.Fatalf("expected error")
+	}
+	conf := &structs.ClusterConfig{KVSoftDelete: true}
+	if err := store.ClusterConfigSet(999, conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create the entries
+	d := &structs.DirEntry{Key: "/foo/a", Flags: 42, Value: []byte("test")}
+	if err := store.KVSSet(1000, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d = &structs.DirEntry{Key: "/foo/b", Value: []byte("test")}
+	if err := store.KVSSet(1001, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete the tree
+	if err := store.KVSDeleteTree(1002, "/foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	notify1 := make(chan struct{}, 1)
+	store.WatchKV("/foo/a", notify1)
+
+	// Recover a key
+	ok, err := store.KVSUndelete(1003, "/foo/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected undelete")
+	}
+
+	// Check that we've fired notify1
+	select {
+	case <-notify1:
+	default:
+		t.Fatalf("should notify /foo/a")
+	}
+
+	idx, d, err := store.KVSGet("/foo/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1003 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if d == nil || string(d.Value) != "test" || d.Flags != 42 {
+		t.Fatalf("bad: %v", d)
+	}
+	if d.CreateIndex != 1000 || d.ModifyIndex != 1003 {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Tombstone should be removed
+	_, res, err := store.tombstoneTable.Get("id", "", "/foo/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// Cannot undelete twice
+	ok, err = store.KVSUndelete(1004, "/foo/a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("unexpected undelete")
+	}
+
+	// Cannot undelete a recreated key
+	d = &structs.DirEntry{Key: "/foo/b", Value: []byte("new")}
+	if err := store.KVSSet(1005, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok, err = store.KVSUndelete(1006, "/foo/b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok {
+		t.Fatalf("unexpected undelete")
+	}
+}
+
+func TestServiceConfig_CheckServiceNodes(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should fail without a service
+	if err := store.ServiceConfigSet(3, &structs.ServiceConfig{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	conf := &structs.ServiceConfig{Service: "db", DNSTTL: 10 * time.Second}
+	if err := store.ServiceConfigSet(3, conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Update the config
+	conf = &structs.ServiceConfig{Service: "db", DNSTTL: 30 * time.Second}
+	if err := store.ServiceConfigSet(4, conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, out, err := store.ServiceConfigGet("db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if out.CreateIndex != 3 || out.ModifyIndex != 4 || out.DNSTTL != 30*time.Second {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The TTL should be part of the results
+	idx, nodes := store.CheckServiceNodes("db", nil)
+	if idx != 4 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 1 || nodes[0].DNSTTL != 30*time.Second {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Delete the config
+	if err := store.ServiceConfigDelete(5, "db"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, confs, err := store.ServiceConfigList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(confs) != 0 {
+		t.Fatalf("bad: %v", confs)
+	}
+	_, nodes = store.CheckServiceNodes("db", nil)
+	if len(nodes) != 1 || nodes[0].DNSTTL != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestConfigEntries(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Should fail with an unknown kind, or a proxy-defaults entry that
+	// is not the global one
+	if err := store.ConfigEntrySet(1, &structs.ConfigEntry{Kind: "bogus", Name: "db"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := store.ConfigEntrySet(1, &structs.ConfigEntry{Kind: structs.ProxyDefaults, Name: "db"}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	entries := []*structs.ConfigEntry{
+		&structs.ConfigEntry{Kind: structs.ServiceDefaults, Name: "db", Config: map[string]string{"protocol": "tcp"}},
+		&structs.ConfigEntry{Kind: structs.ServiceDefaults, Name: "web", Config: map[string]string{"protocol": "http"}},
+		&structs.ConfigEntry{Kind: structs.ProxyDefaults, Name: structs.ProxyConfigGlobal},
+	}
+	for i, entry := range entries {
+		if err := store.ConfigEntrySet(uint64(i+1), entry); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Update an entry
+	update := &structs.ConfigEntry{Kind: structs.ServiceDefaults, Name: "db", Config: map[string]string{"protocol": "http"}}
+	if err := store.ConfigEntrySet(4, update); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, out, err := store.ConfigEntryGet(structs.ServiceDefaults, "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 4 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if out.CreateIndex != 1 || out.ModifyIndex != 4 || out.Config["protocol"] != "http" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// List by kind, and all kinds
+	_, list, err := store.ConfigEntryList(structs.ServiceDefaults)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("bad: %v", list)
+	}
+	_, list, err = store.ConfigEntryList("")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("bad: %v", list)
+	}
+
+	// Delete an entry
+	if err := store.ConfigEntryDelete(5, structs.ServiceDefaults, "db"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, out, err = store.ConfigEntryGet(structs.ServiceDefaults, "db")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 5 || out != nil {
+		t.Fatalf("bad: %v %v", idx, out)
+	}
+}
+
+func TestCheckStatusHandler(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	var changes []*structs.CheckStatusChange
+	store.SetCheckStatusHandler(func(change *structs.CheckStatusChange) {
+		changes = append(changes, change)
+	})
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "mem",
+		Name:    "memory utilization",
+		Status:  structs.HealthPassing,
+	}
+	if err := store.EnsureCheck(2, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Registering a check or changing its output is not a transition
+	check = &structs.HealthCheck{Node: "foo", CheckID: "mem", Status: structs.HealthPassing, Output: "ok"}
+	if err := store.EnsureCheck(3, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("bad: %v", changes)
+	}
+
+	check = &structs.HealthCheck{Node: "foo", CheckID: "mem", Status: structs.HealthCritical, Output: "oom"}
+	if err := store.EnsureCheck(4, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("bad: %v", changes)
+	}
+	change := changes[0]
+	if change.Index != 4 || change.Node != "foo" || change.CheckID != "mem" ||
+		change.PrevStatus != structs.HealthPassing || change.Status != structs.HealthCritical ||
+		change.Output != "oom" {
+		t.Fatalf("bad: %v", change)
+	}
+}
+
+func TestEnsureCheck_Output(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "mem",
+		Name:    "memory utilization",
+		Status:  structs.HealthPassing,
+		Output:  "used 10%\n",
+	}
+	if err := store.EnsureCheck(2, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Same output, with different whitespace, should be skipped
+	check = &structs.HealthCheck{
+		Node:    "foo",
+		CheckID: "mem",
+		Name:    "memory utilization",
+		Status:  structs.HealthPassing,
+		Output:  "used  10%",
+	}
+	if err := store.EnsureCheck(3, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, checks := store.NodeChecks("foo")
+	if idx != 2 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if checks[0].Output != "used 10%\n" {
+		t.Fatalf("bad: %v", checks[0])
+	}
+
+	// A changed output is stored
+	check.Output = "used 20%"
+	if err := store.EnsureCheck(4, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, checks = store.NodeChecks("foo")
+	if idx != 4 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if checks[0].Output != "used 20%" {
+		t.Fatalf("bad: %q", checks[0].Output)
+	}
+}
+
+func TestWatchKVPattern(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.WatchKVPattern("/services/[", make(chan struct{}, 1)); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	notify1 := make(chan struct{}, 1)
+	if err := store.WatchKVPattern("/services/*/config", notify1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A key that does not match should not notify
+	d := &structs.DirEntry{Key: "/services/web/other", Value: []byte("foo")}
+	if err := store.KVSSet(1000, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify1:
+		t.Fatalf("should not notify")
+	default:
+	}
+
+	// A matching key should notify
+	d = &structs.DirEntry{Key: "/services/web/config", Value: []byte("foo")}
+	if err := store.KVSSet(1001, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify1:
+	default:
+		t.Fatalf("should notify")
+	}
+
+	// Deleting a parent tree should notify
+	if err := store.WatchKVPattern("/services/*/config", notify1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSDeleteTree(1002, "/services/"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify1:
+	default:
+		t.Fatalf("should notify")
+	}
+
+	// A stopped watch should not notify
+	if err := store.WatchKVPattern("/services/*/config", notify1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.StopWatchKVPattern("/services/*/config", notify1)
+	d = &structs.DirEntry{Key: "/services/db/config", Value: []byte("foo")}
+	if err := store.KVSSet(1003, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify1:
+		t.Fatalf("should not notify")
+	default:
+	}
+}
+
+func TestWatchKVPattern_Sharded(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Cross the threshold with unrelated patterns
+	for i := 0; i < kvPatternShardThreshold; i++ {
+		pattern := fmt.Sprintf("/other/%d/*", i)
+		if err := store.WatchKVPattern(pattern, make(chan struct{}, 1)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if store.kvPatternShards != nil {
+		t.Fatalf("should not be sharded")
+	}
+	notify1 := make(chan struct{}, 1)
+	if err := store.WatchKVPattern("/services/*/config", notify1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if store.kvPatternShards == nil {
+		t.Fatalf("should be sharded")
+	}
+
+	// A key that does not match should not notify
+	d := &structs.DirEntry{Key: "/services/web/other", Value: []byte("foo")}
+	if err := store.KVSSet(1000, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify1:
+		t.Fatalf("should not notify")
+	default:
+	}
+
+	// A matching key should notify
+	d = &structs.DirEntry{Key: "/services/web/config", Value: []byte("foo")}
+	if err := store.KVSSet(1001, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify1:
+	default:
+		t.Fatalf("should notify")
+	}
+	if _, ok := store.kvPatternShards.Get("/services/"); ok {
+		t.Fatalf("empty shard should be removed")
+	}
+
+	// Deleting a parent tree should notify
+	if err := store.WatchKVPattern("/services/*/config", notify1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.KVSDeleteTree(1002, "/"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-notify1:
+	default:
+		t.Fatalf("should notify")
+	}
+	if len(store.kvPatternWatch) != 0 || store.kvPatternShards.Len() != 0 {
+		t.Fatalf("bad: %v", store.kvPatternWatch)
+	}
+}
+
+func TestStopWatchKVPattern(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Shard the pattern watches
+	var notify []chan struct{}
+	for i := 0; i <= kvPatternShardThreshold; i++ {
+		ch := make(chan struct{}, 1)
+		if err := store.WatchKVPattern(fmt.Sprintf("/other/%d/*", i), ch); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		notify = append(notify, ch)
+	}
+	if store.kvPatternShards == nil {
+		t.Fatalf("should be sharded")
+	}
+
+	// A pattern that is still watched is kept
+	shared := make(chan struct{}, 1)
+	if err := store.WatchKVPattern("/other/0/*", shared); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.StopWatchKVPattern("/other/0/*", notify[0])
+	if _, ok := store.kvPatternWatch["/other/0/*"]; !ok {
+		t.Fatalf("should be kept")
+	}
+	notify[0] = shared
+
+	// Stopping the last watch of a pattern removes it and its shard
+	for i, ch := range notify {
+		store.StopWatchKVPattern(fmt.Sprintf("/other/%d/*", i), ch)
+	}
+	if len(store.kvPatternWatch) != 0 || store.kvPatternShards.Len() != 0 {
+		t.Fatalf("bad: %v", store.kvPatternWatch)
+	}
+}
+
+func TestKVSIncrement(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Missing key should start at zero
+	val, err := store.KVSIncrement(1000, "/counter", 5)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if val != 5 {
+		t.Fatalf("bad: %v", val)
+	}
+
+	// Increment an existing value, preserving the flags
+	d := &structs.DirEntry{Key: "/counter", Flags: 42, Value: []byte("10")}
+	if err := store.KVSSet(1001, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	val, err = store.KVSIncrement(1002, "/counter", -3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if val != 7 {
+		t.Fatalf("bad: %v", val)
+	}
+
+	idx, d, err := store.KVSGet("/counter")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1002 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if string(d.Value) != "7" || d.Flags != 42 {
+		t.Fatalf("bad: %v", d)
+	}
+	if d.CreateIndex != 1000 || d.ModifyIndex != 1002 {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Non-integer values should fail
+	d = &structs.DirEntry{Key: "/bad", Value: []byte("foo")}
+	if err := store.KVSSet(1003, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := store.KVSIncrement(1004, "/bad", 1); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Overflows should fail, leaving the value alone
+	for val, delta := range map[int64]int64{math.MaxInt64: 1, math.MinInt64: -1, -2: math.MinInt64} {
+		d = &structs.DirEntry{Key: "/counter", Value: []byte(fmt.Sprintf("%d", val))}
+		if err := store.KVSSet(1005, d); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := store.KVSIncrement(1006, "/counter", delta); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	_, d, err = store.KVSGet("/counter")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.ModifyIndex != 1005 {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestStateSnapshot_TableStats(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(2, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Close()
+
+	// Add another node after the snapshot
+	if err := store.EnsureNode(3, structs.Node{Node: "baz", Address: "127.0.0.3"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rows, bytes, err := snap.TableStats(dbNodes)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rows != 2 {
+		t.Fatalf("bad: %v", rows)
+	}
+	if bytes == 0 {
+		t.Fatalf("bad: %v", bytes)
+	}
+
+	rows, bytes, err = snap.TableStats(dbKVS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rows != 0 || bytes != 0 {
+		t.Fatalf("bad: %v %v", rows, bytes)
+	}
+
+	if _, _, err := snap.TableStats("nope"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSessionInvalidate_ServiceCheck(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(4, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(5, "bar", &structs.NodeService{"db", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:      "bar",
+		CheckID:   "db-check",
+		Status:    structs.HealthPassing,
+		ServiceID: "db",
+	}
+	if err := store.EnsureCheck(6, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should fail if the check is not a check of the service
+	session := &structs.Session{
+		ID:   generateUUID(),
+		Node: "foo",
+		ServiceChecks: []structs.SessionServiceCheck{
+			{Node: "bar", ServiceID: "web", CheckID: "db-check"},
+		},
+	}
+	if err := store.SessionCreate(7, session); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	session.ServiceChecks[0].ServiceID = "db"
+	if err := store.SessionCreate(8, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The check mappings can be found from the session
+	_, res, err := store.sessionCheckTable.Get("session", session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 1 || res[0].(*sessionCheck).CheckID != "db-check" {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// Invalidate the service check
+	check.Status = structs.HealthCritical
+	if err := store.EnsureCheck(9, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Lookup by ID, should be nil
+	_, s2, err := store.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+
+	// Check mappings should be removed
+	_, res, err = store.sessionCheckTable.Get("id", "bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %v", res)
+	}
+	_, res, err = store.sessionCheckTable.Get("session", session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// Deleting the node of the service should also invalidate
+	check.Status = structs.HealthPassing
+	if err := store.EnsureCheck(10, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session.ID = generateUUID()
+	if err := store.SessionCreate(11, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNode(12, "bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, s2, err = store.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2 != nil {
+		t.Fatalf("session should be invalidated")
+	}
+}
+
+func TestACLClone_Rotate(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	a := &structs.ACL{
+		ID:    generateUUID(),
+		Name:  "User token",
+		Type:  structs.ACLTypeClient,
+		Rules: "",
+	}
+	if err := store.ACLSet(50, a); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Clone should get a new CreateIndex
+	clone := generateUUID()
+	if err := store.ACLClone(51, a.ID, clone); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, out, err := store.ACLGet(clone)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 51 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if out == nil || out.Name != a.Name || out.Type != a.Type {
+		t.Fatalf("bad: %v", out)
+	}
+	if out.CreateIndex != 51 || out.ModifyIndex != 51 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Cannot copy over an existing ACL
+	if err := store.ACLClone(52, a.ID, clone); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := store.ACLRotate(52, "nope", generateUUID(), time.Time{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Rotate should preserve the CreateIndex
+	rotated := generateUUID()
+	if err := store.ACLRotate(53, a.ID, rotated, time.Time{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, out, err = store.ACLGet(rotated)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || out.Name != a.Name {
+		t.Fatalf("bad: %v", out)
+	}
+	if out.CreateIndex != 50 || out.ModifyIndex != 53 {
+		t.Fatalf("bad: %v", out)
+	}
+	_, out, err = store.ACLGet(a.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Rotating with a grace period keeps the old ID until it expires
+	expires := time.Now().Add(time.Hour)
+	again := generateUUID()
+	if err := store.ACLRotate(54, rotated, again, expires); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, out, err = store.ACLGet(rotated)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || !out.ExpireTime.Equal(expires) || out.ModifyIndex != 54 {
+		t.Fatalf("bad: %v", out)
+	}
+	if out.Expired(time.Now()) || !out.Expired(expires) {
+		t.Fatalf("bad: %v", out)
+	}
+	_, out, err = store.ACLGet(again)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || !out.ExpireTime.IsZero() || out.CreateIndex != 50 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestKVSListSession(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session1 := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(4, session1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session2 := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(5, session2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Lock keys with both sessions, inside and outside the prefix
+	locks := map[string]string{
+		"/web/b": session1.ID,
+		"/web/a": session1.ID,
+		"/web/c": session2.ID,
+		"/db/a":  session1.ID,
+	}
+	var index uint64 = 6
+	for key, id := range locks {
+		d := &structs.DirEntry{Key: key, Session: id}
+		if ok, err := store.KVSLock(index, d); err != nil || !ok {
+			t.Fatalf("err: %v", err)
+		}
+		index++
+	}
+
+	// Set a key without a lock
+	if err := store.KVSSet(index, &structs.DirEntry{Key: "/web/d"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, idx, ents, err := store.KVSListSession("/web", session1.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != index {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(ents) != 2 {
+		t.Fatalf("bad: %v", ents)
+	}
+	if ents[0].Key != "/web/a" || ents[1].Key != "/web/b" {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	// Empty prefix should list everything held by the session
+	_, _, ents, err = store.KVSListSession("", session1.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 3 || ents[0].Key != "/db/a" {
+		t.Fatalf("bad: %v", ents)
+	}
+
+	if _, _, _, err := store.KVSListSession("/web", ""); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestKVSListFlags(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// The low byte of the flags encodes a type
+	flags := map[string]uint64{
+		"/app/a":   0x101,
+		"/app/b":   0x201,
+		"/app/c":   0x102,
+		"/app/d":   0x101,
+		"/other/a": 0x101,
+	}
+	var index uint64 = 1
+	for key, f := range flags {
+		if err := store.KVSSet(index, &structs.DirEntry{Key: key, Flags: f}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		index++
+	}
+
+	keys := func(ents structs.DirEntries) []string {
+		var out []string
+		for _, ent := range ents {
+			out = append(out, ent.Key)
+		}
+		return out
+	}
+
+	// A partial mask scans the prefix
+	_, idx, ents, err := store.KVSListFlags("/app/", 0xff, 0x01, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != index-1 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if got := keys(ents); !reflect.DeepEqual(got, []string{"/app/a", "/app/b", "/app/d"}) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// A full mask uses the flags index
+	_, _, ents, err = store.KVSListFlags("/app/", math.MaxUint64, 0x101, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := keys(ents); !reflect.DeepEqual(got, []string{"/app/a", "/app/d"}) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// The index follows updates of the flags
+	if err := store.KVSSet(index, &structs.DirEntry{Key: "/app/d", Flags: 0x102}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, _, ents, err = store.KVSListFlags("/app/", math.MaxUint64, 0x101, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := keys(ents); !reflect.DeepEqual(got, []string{"/app/a"}) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// No mask lists everything
+	_, _, ents, err = store.KVSListFlags("/app/", 0, 0x101, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ents) != 4 {
+		t.Fatalf("bad: %v", keys(ents))
+	}
+}
+
+func TestIntentionMatch(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	ixns := []*structs.Intention{
+		{ID: "all", SourceName: "*", DestinationName: "*", Action: structs.IntentionActionDeny},
+		{ID: "to-db", SourceName: "*", DestinationName: "db", Action: structs.IntentionActionDeny},
+		{ID: "web-to-db", SourceName: "web", DestinationName: "db", Action: structs.IntentionActionAllow},
+		{ID: "web-to-all", SourceName: "web", DestinationName: "*", Action: structs.IntentionActionAllow},
+	}
+	for i, ixn := range ixns {
+		if err := store.IntentionSet(uint64(10+i), ixn); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Cannot have two intentions for the same services
+	dup := &structs.Intention{ID: "dup", SourceName: "WEB", DestinationName: "db",
+		Action: structs.IntentionActionDeny}
+	if err := store.IntentionSet(14, dup); err == nil {
+		t.Fatalf("expected error")
+	}
+	bad := &structs.Intention{ID: "bad", SourceName: "a", DestinationName: "b", Action: "nope"}
+	if err := store.IntentionSet(14, bad); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	cases := []struct {
+		source, dest, expect string
+	}{
+		{"web", "db", "web-to-db"},
+		{"api", "db", "to-db"},
+		{"web", "cache", "web-to-all"},
+		{"api", "cache", "all"},
+	}
+	for _, c := range cases {
+		idx, ixn, err := store.IntentionMatch(c.source, c.dest)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if idx != 13 {
+			t.Fatalf("bad: %v", idx)
+		}
+		if ixn == nil || ixn.ID != c.expect {
+			t.Fatalf("%s -> %s: bad: %v", c.source, c.dest, ixn)
+		}
+	}
+
+	// Update should preserve the create index
+	ixns[0].Action = structs.IntentionActionAllow
+	if err := store.IntentionSet(15, ixns[0]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, out, err := store.IntentionGet("all")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.CreateIndex != 10 || out.ModifyIndex != 15 || out.Action != structs.IntentionActionAllow {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// No match once the wildcard is removed
+	if err := store.IntentionDelete(16, "all"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, ixn, err := store.IntentionMatch("api", "cache")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ixn != nil {
+		t.Fatalf("bad: %v", ixn)
+	}
+	_, list, err := store.IntentionList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("bad: %v", list)
+	}
+}
+
+func TestNodeDrain(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Draining a missing node fails
+	if err := store.NodeDrain(1, "foo", true); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	for i, node := range []string{"foo", "bar"} {
+		if err := store.EnsureNode(uint64(2+2*i), structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.EnsureService(uint64(3+2*i), node, &structs.NodeService{"db1", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Drain foo, which is only excluded from the health queries
+	if err := store.NodeDrain(6, "foo", true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, nodes := store.CheckServiceNodes("db", nil)
+	if idx != 6 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 1 || nodes[0].Node.Node != "bar" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, services := store.ServiceNodes("db", nil)
+	if len(services) != 2 {
+		t.Fatalf("bad: %v", services)
+	}
+
+	// Stop draining
+	if err := store.NodeDrain(7, "foo", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, nodes = store.CheckServiceNodes("db", nil)
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Deregistering the node stops the drain
+	if err := store.NodeDrain(8, "foo", true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNode(9, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, drains, err := store.NodeDrains()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 9 || len(drains) != 0 {
+		t.Fatalf("bad: %v %v", idx, drains)
+	}
+}
+
+func TestNodeProtect(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Protecting a missing node fails
+	if err := store.NodeProtect(1, "foo", true); structs.ErrorCodeOf(err) != structs.ErrCodeMissingNode {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := store.EnsureNode(2, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(3, "foo", &structs.NodeService{"db1", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.NodeProtect(4, "foo", true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The protection is kept when the node registers again
+	if err := store.EnsureNode(5, structs.Node{Node: "foo", Address: "127.0.0.2"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, nodes := store.Nodes()
+	if idx != 5 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 1 || !nodes[0].Protected || nodes[0].Address != "127.0.0.2" {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Deleting the node is refused, and leaves its services
+	if err := store.DeleteNode(6, "foo"); structs.ErrorCodeOf(err) != structs.ErrCodeNodeProtected {
+		t.Fatalf("err: %v", err)
+	}
+	_, services := store.NodeServices("foo")
+	if services == nil || len(services.Services) != 1 {
+		t.Fatalf("bad: %v", services)
+	}
+
+	// Lifting the protection allows the delete
+	if err := store.NodeProtect(7, "foo", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteNode(8, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A forced delete ignores the protection
+	if err := store.EnsureNode(9, structs.Node{Node: "bar", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.NodeProtect(10, "bar", true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.ForceDeleteNode(11, "bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, nodes = store.Nodes()
+	if idx != 11 || len(nodes) != 0 {
+		t.Fatalf("bad: %v %v", idx, nodes)
+	}
+}
+
+func TestServiceChecksInState(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i, node := range []string{"foo", "bar"} {
+		if err := store.EnsureNode(uint64(10*i+1), structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.EnsureService(uint64(10*i+2), node, &structs.NodeService{"db1", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.EnsureService(uint64(10*i+3), node, &structs.NodeService{"web1", "web", nil, "", 80, false, "", false, "", nil, ""}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	checks := []*structs.HealthCheck{
+		&structs.HealthCheck{Node: "foo", CheckID: "db", Status: structs.HealthCritical, ServiceID: "db1"},
+		&structs.HealthCheck{Node: "bar", CheckID: "db", Status: structs.HealthPassing, ServiceID: "db1"},
+		&structs.HealthCheck{Node: "foo", CheckID: "web", Status: structs.HealthCritical, ServiceID: "web1"},
+		&structs.HealthCheck{Node: "bar", CheckID: "mem", Status: structs.HealthCritical},
+	}
+	for i, check := range checks {
+		if err := store.EnsureCheck(uint64(30+i), check); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the critical checks of the service are returned
+	idx, out := store.ServiceChecksInState("db", structs.HealthCritical, structs.CheckCursor{}, 0)
+	if idx != 33 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(out) != 1 || !reflect.DeepEqual(out[0], checks[0]) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Any state returns all the checks of the service, in ID order
+	_, out = store.ServiceChecksInState("db", structs.HealthAny, structs.CheckCursor{}, 0)
+	if len(out) != 2 || out[0].Node != "bar" || out[1].Node != "foo" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The checks are paged
+	_, out = store.ServiceChecksInState("db", structs.HealthAny, structs.CheckCursor{Node: "bar", CheckID: "db"}, 1)
+	if len(out) != 1 || out[0].Node != "foo" {
+		t.Fatalf("bad: %v", out)
+	}
+
+	_, out = store.ServiceChecksInState("db", structs.HealthWarning, structs.CheckCursor{}, 0)
+	if len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestKVSLockQueue(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var sessions []string
+	for i := 0; i < 3; i++ {
+		session := &structs.Session{ID: generateUUID(), Node: "foo"}
+		if err := store.SessionCreate(uint64(4+i), session); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sessions = append(sessions, session.ID)
+	}
+
+	// The first session acquires the lock right away
+	ok, err := store.KVSLockQueue(10, &structs.DirEntry{Key: "/foo", Value: []byte("one"), Session: sessions[0]})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// The others are queued in order
+	for i, session := range sessions[1:] {
+		d := &structs.DirEntry{Key: "/foo", Flags: uint64(i + 1), Value: []byte("next"), Session: session}
+		ok, err := store.KVSLockQueue(uint64(11+i), d)
+		if err != nil || ok {
+			t.Fatalf("bad: %v %v", ok, err)
+		}
+	}
+	idx, waiters, err := store.KVSLockWaiters("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 12 || len(waiters) != 2 {
+		t.Fatalf("bad: %v %v", idx, waiters)
+	}
+	if waiters[0].Session != sessions[1] || waiters[1].Session != sessions[2] {
+		t.Fatalf("bad: %v", waiters)
+	}
+
+	// Releasing the lock grants it to the oldest waiter
+	ok, err = store.KVSUnlock(13, &structs.DirEntry{Key: "/foo", Session: sessions[0]})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	_, d, err := store.KVSGet("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.Session != sessions[1] || d.LockIndex != 2 || d.Flags != 1 || string(d.Value) != "next" {
+		t.Fatalf("bad: %v", d)
+	}
+
+	ok, err = store.KVSUnlock(14, &structs.DirEntry{Key: "/foo", Session: sessions[1]})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	_, d, err = store.KVSGet("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.Session != sessions[2] || d.LockIndex != 3 || d.Flags != 2 {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Invalidating the holder hands the lock over as well
+	ok, err = store.KVSLockQueue(15, &structs.DirEntry{Key: "/foo", Session: sessions[0]})
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if err := store.SessionDestroy(16, sessions[2]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err = store.KVSGet("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.Session != sessions[0] || d.LockIndex != 4 {
+		t.Fatalf("bad: %v", d)
+	}
+	_, waiters, err = store.KVSLockWaiters("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(waiters) != 0 {
+		t.Fatalf("bad: %v", waiters)
+	}
+
+	// A lock released with a lock delay is not handed over, but the
+	// queued sessions take precedence over other contenders
+	delayed := &structs.Session{ID: generateUUID(), Node: "foo", LockDelay: 50 * time.Millisecond}
+	if err := store.SessionCreate(17, delayed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok, err = store.KVSLock(18, &structs.DirEntry{Key: "/bar", Session: delayed.ID})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	ok, err = store.KVSLockQueue(19, &structs.DirEntry{Key: "/bar", Session: sessions[1]})
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if err := store.SessionDestroy(20, delayed.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, err = store.KVSGet("/bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.Session != "" {
+		t.Fatalf("bad: %v", d)
+	}
+	ok, err = store.KVSLock(21, &structs.DirEntry{Key: "/bar", Session: sessions[0]})
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	ok, err = store.KVSLock(22, &structs.DirEntry{Key: "/bar", Session: sessions[1]})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	_, waiters, err = store.KVSLockWaiters("/bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(waiters) != 0 {
+		t.Fatalf("bad: %v", waiters)
+	}
+}
+
+func TestKVSLockDequeue(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var sessions []string
+	for i := 0; i < 3; i++ {
+		session := &structs.Session{ID: generateUUID(), Node: "foo"}
+		if err := store.SessionCreate(uint64(4+i), session); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sessions = append(sessions, session.ID)
+	}
+	for i, session := range sessions {
+		ok, err := store.KVSLockQueue(uint64(10+i), &structs.DirEntry{Key: "/foo", Session: session})
+		if err != nil || ok != (i == 0) {
+			t.Fatalf("bad: %v %v", ok, err)
+		}
+	}
+
+	// A session that stops waiting leaves the queue
+	ok, err := store.KVSLockDequeue(13, &structs.DirEntry{Key: "/foo", Session: sessions[1]})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	ok, err = store.KVSLockDequeue(14, &structs.DirEntry{Key: "/foo", Session: sessions[1]})
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	idx, waiters, err := store.KVSLockWaiters("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 13 || len(waiters) != 1 || waiters[0].Session != sessions[2] {
+		t.Fatalf("bad: %v %v", idx, waiters)
+	}
+
+	// So the lock skips it
+	ok, err = store.KVSUnlock(15, &structs.DirEntry{Key: "/foo", Session: sessions[0]})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	_, d, err := store.KVSGet("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.Session != sessions[2] {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Deleting the key empties its queue
+	ok, err = store.KVSLockQueue(16, &structs.DirEntry{Key: "/foo", Session: sessions[0]})
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if err := store.KVSDelete(17, "/foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, waiters, err = store.KVSLockWaiters("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 17 || len(waiters) != 0 {
+		t.Fatalf("bad: %v %v", idx, waiters)
+	}
+}
+
+func TestSessionGet_LockCount(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	other := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(5, other); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i, key := range []string{"/foo", "/bar"} {
+		ok, err := store.KVSLock(uint64(6+i), &structs.DirEntry{Key: key, Session: session.ID})
+		if err != nil || !ok {
+			t.Fatalf("bad: %v %v", ok, err)
+		}
+	}
+
+	_, s2, err := store.SessionGet(session.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s2.LockCount != 2 {
+		t.Fatalf("bad: %v", s2)
+	}
+
+	_, all, err := store.SessionList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("bad: %v", all)
+	}
+	for _, s := range all {
+		expect := 0
+		if s.ID == session.ID {
+			expect = 2
+		}
+		if s.LockCount != expect {
+			t.Fatalf("bad: %v", s)
+		}
+	}
+}
+
+func TestCheckServiceVersionNodes(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i, node := range []string{"foo", "bar", "baz"} {
+		if err := store.EnsureNode(uint64(i+1), structs.Node{Node: node, Address: "127.0.0.1"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	services := map[string]*structs.NodeService{
+		"foo": &structs.NodeService{ID: "db", Service: "db", Port: 8000, Version: "1.0"},
+		"bar": &structs.NodeService{ID: "db", Service: "db", Port: 8000, Version: "1.1", Canary: true},
+		"baz": &structs.NodeService{ID: "db", Service: "db", Port: 8000, Version: "1.0"},
+	}
+	for node, service := range services {
+		if err := store.EnsureService(10, node, service); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	idx, nodes := store.CheckServiceVersionNodes("db", "1.0", nil)
+	if idx != 10 {
+		t.Fatalf("bad: %v", idx)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	for _, node := range nodes {
+		if node.Node.Node == "bar" || node.Service.Version != "1.0" || node.Service.Canary {
+			t.Fatalf("bad: %v", node)
+		}
+	}
+
+	_, nodes = store.CheckServiceVersionNodes("db", "1.1", nil)
+	if len(nodes) != 1 || nodes[0].Node.Node != "bar" || !nodes[0].Service.Canary {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	_, nodes = store.CheckServiceVersionNodes("db", "2.0", nil)
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestCatalogEvents_Bounded(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Each registration changes the address of the node
+	for i := 1; i <= catalogEventsSize+10; i++ {
+		node := fmt.Sprintf("node%d", i%2)
+		store.SetCatalogEvent(&structs.CatalogEvent{
+			Op:   structs.CatalogEventRegister,
+			Node: node,
+		})
+		req := &structs.RegisterRequest{
+			Node:    node,
+			Address: fmt.Sprintf("127.0.%d.%d", i/256, i%256),
+		}
+		if err := store.EnsureRegistration(uint64(i), req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Registrations that change nothing are not recorded
+	store.SetCatalogEvent(&structs.CatalogEvent{
+		Op:   structs.CatalogEventRegister,
+		Node: "node0",
+	})
+	req := &structs.RegisterRequest{
+		Node:    "node0",
+		Address: fmt.Sprintf("127.0.%d.%d", (catalogEventsSize+10)/256, (catalogEventsSize+10)%256),
+	}
+	if err := store.EnsureRegistration(catalogEventsSize+11, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.SetCatalogEvent(nil)
+
+	// Only the newest events are retained, in order
+	idx, events, err := store.CatalogEvents("")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != catalogEventsSize+10 || len(events) != catalogEventsSize {
+		t.Fatalf("bad: %d %d", idx, len(events))
+	}
+	if events[0].Index != 11 || events[len(events)-1].Index != catalogEventsSize+10 {
+		t.Fatalf("bad: %v %v", events[0], events[len(events)-1])
+	}
+
+	// Filter by node
+	_, events, err = store.CatalogEvents("node1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(events) != catalogEventsSize/2 || events[0].Index != 11 {
+		t.Fatalf("bad: %d %v", len(events), events[0])
+	}
+	for _, ev := range events {
+		if ev.Node != "node1" {
+			t.Fatalf("bad: %v", ev)
+		}
+	}
+}
+
+func TestUserEvents_Bounded(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= userEventsSize+10; i++ {
+		ev := &structs.UserEvent{
+			Name:    fmt.Sprintf("event%d", i%2),
+			Payload: []byte("test"),
+		}
+		if err := store.RecordUserEvent(uint64(i), ev); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the newest events are retained, in order
+	idx, events, err := store.UserEvents("")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != userEventsSize+10 || len(events) != userEventsSize {
+		t.Fatalf("bad: %d %d", idx, len(events))
+	}
+	if events[0].Index != 11 || events[len(events)-1].Index != userEventsSize+10 {
+		t.Fatalf("bad: %v %v", events[0], events[len(events)-1])
+	}
+
+	// Filter by name
+	_, events, err = store.UserEvents("event1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(events) != userEventsSize/2 || events[0].Index != 11 {
+		t.Fatalf("bad: %d %v", len(events), events[0])
+	}
+	for _, ev := range events {
+		if ev.Name != "event1" {
+			t.Fatalf("bad: %v", ev)
+		}
+	}
+}
+
+func TestFeatureEnable(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.FeatureEnable(10, []string{"foo", ""}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if enabled, err := store.FeatureEnabled("foo"); err != nil || enabled {
+		t.Fatalf("bad: %v %v", enabled, err)
+	}
+
+	if err := store.FeatureEnable(11, []string{"foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if enabled, err := store.FeatureEnabled("foo"); err != nil || !enabled {
+		t.Fatalf("bad: %v %v", enabled, err)
+	}
+
+	// Enabling again keeps the original index
+	if err := store.FeatureEnable(12, []string{"foo", "bar"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	idx, features, err := store.FeatureList()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 12 || len(features) != 2 {
+		t.Fatalf("bad: %v %v", idx, features)
+	}
+	for _, feature := range features {
+		switch feature.Name {
+		case "foo":
+			if feature.CreateIndex != 11 {
+				t.Fatalf("bad: %v", feature)
+			}
+		case "bar":
+			if feature.CreateIndex != 12 {
+				t.Fatalf("bad: %v", feature)
+			}
+		default:
+			t.Fatalf("bad: %v", feature)
+		}
+	}
+
+	// Nothing changes if every feature is enabled
+	if err := store.FeatureEnable(13, []string{"bar"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx, _, err := store.FeatureList(); err != nil || idx != 12 {
+		t.Fatalf("bad: %v %v", idx, err)
+	}
+}
+
+func TestServiceNodes_NodeMeta(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	for i, node := range []string{"foo", "bar"} {
+		req := &structs.RegisterRequest{
+			Node:     node,
+			Address:  "127.0.0.1",
+			NodeMeta: map[string]string{"ssd": fmt.Sprintf("%v", i == 0), "rack": "r1"},
+			Service:  &structs.NodeService{ID: "redis", Service: "redis", Tags: []string{"master"}},
+		}
+		if err := store.EnsureRegistration(uint64(10+i), req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// A registration without metadata keeps the metadata of the node
+	req := &structs.RegisterRequest{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Service: &structs.NodeService{ID: "db", Service: "db"},
+	}
+	if err := store.EnsureRegistration(12, req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	filter := map[string]string{"ssd": "true", "rack": "r1"}
+	_, nodes := store.ServiceNodes("redis", filter)
+	if len(nodes) != 1 || nodes[0].Node != "foo" || nodes[0].Address != "127.0.0.1" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, nodes = store.ServiceTagNodes("redis", "master", filter)
+	if len(nodes) != 1 || nodes[0].Node != "foo" {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, nodes = store.ServiceNodes("redis", map[string]string{"rack": "r1"})
+	if len(nodes) != 2 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	_, nodes = store.ServiceNodes("redis", map[string]string{"rack": "r2"})
+	if len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	_, checkNodes := store.CheckServiceNodes("redis", filter)
+	if len(checkNodes) != 1 || checkNodes[0].Node.Node != "foo" ||
+		checkNodes[0].Node.Meta["ssd"] != "true" {
+		t.Fatalf("bad: %v", checkNodes)
+	}
+	_, checkNodes = store.CheckServiceNodes("db", filter)
+	if len(checkNodes) != 1 || checkNodes[0].Node.Node != "foo" {
+		t.Fatalf("bad: %v", checkNodes)
+	}
+	_, checkNodes = store.CheckServiceTagNodes("redis", "master", map[string]string{"ssd": "false"})
+	if len(checkNodes) != 1 || checkNodes[0].Node.Node != "bar" {
+		t.Fatalf("bad: %v", checkNodes)
+	}
+
+	// The unfiltered result is not affected by a cached filtered query
+	_, checkNodes = store.CheckServiceNodes("redis", nil)
+	if len(checkNodes) != 2 {
+		t.Fatalf("bad: %v", checkNodes)
+	}
+}
+
+func TestKVSGetWithSession(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	// Missing keys return nothing
+	_, d, session, err := store.KVSGetWithSession("/foo")
+	if err != nil || d != nil || session != nil {
+		t.Fatalf("bad: %v %v %v", d, session, err)
+	}
+
+	if err := store.EnsureNode(3, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sess := &structs.Session{ID: generateUUID(), Node: "foo", Name: "leader"}
+	if err := store.SessionCreate(4, sess); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An unlocked key has no session
+	ent := &structs.DirEntry{Key: "/foo", Value: []byte("test")}
+	if err := store.KVSSet(5, ent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, session, err = store.KVSGetWithSession("/foo")
+	if err != nil || d == nil || session != nil {
+		t.Fatalf("bad: %v %v %v", d, session, err)
+	}
+
+	// The holder of the lock is returned along with the entry
+	ent.Session = sess.ID
+	if ok, err := store.KVSLock(6, ent); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	idx, d, session, err := store.KVSGetWithSession("/foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 6 || d == nil || d.Session != sess.ID || string(d.Value) != "test" {
+		t.Fatalf("bad: %v %v", idx, d)
+	}
+	if session == nil || session.ID != sess.ID || session.Name != "leader" || session.LockCount != 1 {
+		t.Fatalf("bad: %v", session)
+	}
+
+	// Destroying the session releases the lock
+	if err := store.SessionDestroy(7, sess.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, d, session, err = store.KVSGetWithSession("/foo")
+	if err != nil || d == nil || d.Session != "" || session != nil {
+		t.Fatalf("bad: %v %v %v", d, session, err)
+	}
+}
@@ -0,0 +1,94 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// ReadTx is a read-only transaction across all the tables of the
+// state store. Every read made through it sees the same state, so an
+// RPC endpoint that combines data from several tables gets a consistent
+// result, along with an index that covers all of it.
+type ReadTx struct {
+	store *StateStore
+	tx    *MDBTxn
+	index uint64
+}
+
+// ReadTxn is used to invoke fn with a read-only transaction across all
+// the tables. The transaction is only valid for the duration of fn,
+// and is released once fn returns.
+func (s *StateStore) ReadTxn(fn func(tx *ReadTx) error) error {
+	tx, err := s.tables.StartTxn(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	index, err := s.tables.LastIndexTxn(tx)
+	if err != nil {
+		return err
+	}
+	return fn(&ReadTx{store: s, tx: tx, index: index})
+}
+
+// Index returns the last index of all the tables as of the transaction.
+// This is the index a blocking query should return for the data read.
+func (r *ReadTx) Index() uint64 {
+	return r.index
+}
+
+// GetNode is used to lookup a node by name, returning nil if it
+// does not exist
+func (r *ReadTx) GetNode(name string) (*structs.Node, error) {
+	res, err := r.store.nodeTable.GetTxn(r.tx, "id", name)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return res[0].(*structs.Node), nil
+}
+
+// NodeServices is used to return all the services of a given node
+func (r *ReadTx) NodeServices(name string) *structs.NodeServices {
+	_, ns := r.store.parseNodeServices(r.store.tables, r.tx, name, "")
+	return ns
+}
+
+// NodeChecks is used to return all the checks of a given node
+func (r *ReadTx) NodeChecks(node string) structs.HealthChecks {
+	res, err := r.store.checkTable.GetTxn(r.tx, "id", node)
+	_, checks := r.store.parseHealthChecks(r.index, namespaceFilter(res, ""), err)
+	return checks
+}
+
+// NodeSessions is used to return all the sessions of a given node
+func (r *ReadTx) NodeSessions(node string) ([]*structs.Session, error) {
+	res, err := r.store.sessionTable.GetTxn(r.tx, "node", node)
+	out := make([]*structs.Session, len(res))
+	for i, raw := range res {
+		out[i] = raw.(*structs.Session)
+	}
+	return out, err
+}
+
+// ServiceNodes is used to return the nodes of a given service, restricted
+// to the nodes with any given metadata
+func (r *ReadTx) ServiceNodes(service string, nodeMeta map[string]string) structs.ServiceNodes {
+	res, err := r.store.serviceTable.GetTxn(r.tx, "service", service, "")
+	return r.store.parseServiceNodes(r.tx, r.store.nodeTable, res, err, nodeMeta)
+}
+
+// CheckServiceNodes is used to return the nodes of a given service,
+// along with their checks, restricted to the nodes with any given metadata
+func (r *ReadTx) CheckServiceNodes(service string, nodeMeta map[string]string) structs.CheckServiceNodes {
+	res, err := r.store.serviceTable.GetTxn(r.tx, "service", service, "")
+	return r.store.parseCheckServiceNodes(r.tx, res, err, nodeMeta)
+}
+
+// KVSGet is used to lookup a key, returning nil if it does not exist
+func (r *ReadTx) KVSGet(key string) (*structs.DirEntry, error) {
+	res, err := r.store.kvsTable.GetTxn(r.tx, "id", "", key)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return res[0].(*structs.DirEntry), nil
+}
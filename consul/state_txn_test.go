@@ -0,0 +1,87 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestStateStore_ReadTxn(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureService(2, "foo", &structs.NodeService{"db", "db", nil, "", 8000, false, "", false, "", nil, ""}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{
+		Node:      "foo",
+		CheckID:   "db",
+		Status:    structs.HealthPassing,
+		ServiceID: "db",
+	}
+	if err := store.EnsureCheck(3, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{ID: generateUUID(), Node: "foo"}
+	if err := store.SessionCreate(4, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	err = store.ReadTxn(func(tx *ReadTx) error {
+		// Writes made during the transaction should not be visible
+		if err := store.EnsureNode(5, structs.Node{Node: "bar", Address: "127.0.0.2"}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if idx := tx.Index(); idx != 4 {
+			t.Fatalf("bad: %v", idx)
+		}
+		if node, err := tx.GetNode("bar"); err != nil || node != nil {
+			t.Fatalf("bad: %v %v", node, err)
+		}
+
+		node, err := tx.GetNode("foo")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if node == nil || node.Address != "127.0.0.1" {
+			t.Fatalf("bad: %v", node)
+		}
+		if ns := tx.NodeServices("foo"); len(ns.Services) != 1 {
+			t.Fatalf("bad: %v", ns)
+		}
+		if checks := tx.NodeChecks("foo"); len(checks) != 1 {
+			t.Fatalf("bad: %v", checks)
+		}
+		sessions, err := tx.NodeSessions("foo")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(sessions) != 1 || sessions[0].ID != session.ID {
+			t.Fatalf("bad: %v", sessions)
+		}
+		if nodes := tx.ServiceNodes("db", nil); len(nodes) != 1 {
+			t.Fatalf("bad: %v", nodes)
+		}
+		nodes := tx.CheckServiceNodes("db", nil)
+		if len(nodes) != 1 || len(nodes[0].Checks) != 1 {
+			t.Fatalf("bad: %v", nodes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Errors should be returned
+	errBad := errors.New("bad")
+	if err := store.ReadTxn(func(tx *ReadTx) error { return errBad }); err != errBad {
+		t.Fatalf("bad: %v", err)
+	}
+}
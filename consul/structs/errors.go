@@ -0,0 +1,126 @@
+package structs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrorCode is a stable identifier of the reason a request failed, which
+// lets clients branch on the reason without matching error messages.
+type ErrorCode string
+
+const (
+	ErrCodeUnknown                ErrorCode = ""
+	ErrCodeNoLeader               ErrorCode = "no-leader"
+	ErrCodePermissionDenied       ErrorCode = "permission-denied"
+	ErrCodeACLNotFound            ErrorCode = "acl-not-found"
+	ErrCodeMissingNode            ErrorCode = "missing-node"
+	ErrCodeMissingService         ErrorCode = "missing-service"
+	ErrCodeMissingCheck           ErrorCode = "missing-check"
+	ErrCodeCheckCritical          ErrorCode = "check-critical"
+	ErrCodeMissingSession         ErrorCode = "missing-session"
+	ErrCodeInvalidSession         ErrorCode = "invalid-session"
+	ErrCodeInvalidSessionBehavior ErrorCode = "invalid-session-behavior"
+	ErrCodeNodeIDConflict         ErrorCode = "node-id-conflict"
+	ErrCodeNodeProtected          ErrorCode = "node-protected"
+)
+
+// Error is an error carrying an ErrorCode. The message is unchanged from
+// the plain errors that were returned before, so existing clients that
+// match on the message keep working.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Messages of the coded errors. The errors are created from these at their
+// source, and ErrorCodeOf matches remote errors against the same messages,
+// so a message can be reworded here without losing its code.
+const (
+	ErrMsgNoLeader               = "No cluster leader"
+	ErrMsgPermissionDenied       = "Permission denied"
+	ErrMsgACLNotFound            = "ACL not found"
+	ErrMsgMissingNode            = "Missing node registration"
+	ErrMsgMissingNamedNode       = "Missing node '%s'"
+	ErrMsgMissingService         = "Missing service registration"
+	ErrMsgMissingCheck           = "Missing check '%s' registration"
+	ErrMsgMissingNodeCheck       = "Missing check '%s' registration on node '%s'"
+	ErrMsgCheckCritical          = "Check '%s' is in %s state"
+	ErrMsgMissingSession         = "Missing session"
+	ErrMsgInvalidSession         = "Invalid session"
+	ErrMsgInvalidSessionBehavior = "Invalid Session Behavior setting '%s'"
+	ErrMsgNodeIDConflict         = "Node ID '%s' is in use by node '%s'"
+	ErrMsgNodeProtected          = "Node '%s' is protected, deregistering it must be forced"
+)
+
+var (
+	ErrMissingNode    = &Error{ErrCodeMissingNode, ErrMsgMissingNode}
+	ErrMissingService = &Error{ErrCodeMissingService, ErrMsgMissingService}
+	ErrMissingSession = &Error{ErrCodeMissingSession, ErrMsgMissingSession}
+	ErrInvalidSession = &Error{ErrCodeInvalidSession, ErrMsgInvalidSession}
+)
+
+// NewError returns an Error with the given code and a message formatted
+// from one of the ErrMsg messages of the code
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{code, fmt.Sprintf(format, args...)}
+}
+
+// errorMessages are the messages of each code. Errors cross the RPC
+// layer as plain strings, so ErrorCodeOf recovers the code of a remote
+// error from these. More specific messages must come first.
+var errorMessages = []struct {
+	code    ErrorCode
+	message string
+}{
+	{ErrCodeNoLeader, ErrMsgNoLeader},
+	{ErrCodePermissionDenied, ErrMsgPermissionDenied},
+	{ErrCodeACLNotFound, ErrMsgACLNotFound},
+	{ErrCodeMissingNode, ErrMsgMissingNode},
+	{ErrCodeMissingNode, ErrMsgMissingNamedNode},
+	{ErrCodeMissingService, ErrMsgMissingService},
+	{ErrCodeMissingCheck, ErrMsgMissingNodeCheck},
+	{ErrCodeMissingCheck, ErrMsgMissingCheck},
+	{ErrCodeCheckCritical, ErrMsgCheckCritical},
+	{ErrCodeInvalidSessionBehavior, ErrMsgInvalidSessionBehavior},
+	{ErrCodeMissingSession, ErrMsgMissingSession},
+	{ErrCodeInvalidSession, ErrMsgInvalidSession},
+	{ErrCodeNodeIDConflict, ErrMsgNodeIDConflict},
+	{ErrCodeNodeProtected, ErrMsgNodeProtected},
+}
+
+// ErrorCodeOf returns the code of an error, or ErrCodeUnknown if the
+// error is not a coded error. Errors returned over RPC lose their type,
+// so their code is recovered from the message instead.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ErrCodeUnknown
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	msg := err.Error()
+	for _, em := range errorMessages {
+		if matchMessage(msg, em.message) {
+			return em.code
+		}
+	}
+	return ErrCodeUnknown
+}
+
+// matchMessage checks if an error message was formatted from the given
+// message, possibly behind the prefix added by the RPC layer
+func matchMessage(msg, message string) bool {
+	for i, part := range strings.Split(message, "%s") {
+		idx := strings.Index(msg, part)
+		if idx < 0 || (i == 0 && idx > 0 && !strings.HasSuffix(msg[:idx], ": ")) {
+			return false
+		}
+		msg = msg[idx+len(part):]
+	}
+	return true
+}
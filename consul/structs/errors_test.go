@@ -0,0 +1,45 @@
+package structs
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	cases := []struct {
+		err  error
+		code ErrorCode
+	}{
+		{nil, ErrCodeUnknown},
+		{errors.New("boom"), ErrCodeUnknown},
+		{ErrMissingNode, ErrCodeMissingNode},
+		{NewError(ErrCodeMissingCheck, "Missing check '%s' registration", "foo"), ErrCodeMissingCheck},
+
+		// Errors returned over RPC only keep their message
+		{rpc.ServerError("Missing node registration"), ErrCodeMissingNode},
+		{rpc.ServerError("Missing node 'foo'"), ErrCodeMissingNode},
+		{rpc.ServerError("Missing check 'foo' registration on node 'bar'"), ErrCodeMissingCheck},
+		{rpc.ServerError("Check 'foo' is in critical state"), ErrCodeCheckCritical},
+		{rpc.ServerError("Invalid Session Behavior setting 'foo'"), ErrCodeInvalidSessionBehavior},
+		{rpc.ServerError("Missing session"), ErrCodeMissingSession},
+		{rpc.ServerError("Invalid session"), ErrCodeInvalidSession},
+		{rpc.ServerError("Permission denied: Cannot modify root ACL"), ErrCodePermissionDenied},
+		{rpc.ServerError("rpc error: ACL not found"), ErrCodeACLNotFound},
+		{rpc.ServerError(ErrNoLeader.Error()), ErrCodeNoLeader},
+		{rpc.ServerError("Lost the Missing session"), ErrCodeUnknown},
+	}
+	for _, c := range cases {
+		if code := ErrorCodeOf(c.err); code != c.code {
+			t.Fatalf("bad: %v %q", c.err, code)
+		}
+	}
+
+	// The code of every message survives the RPC layer
+	for _, em := range errorMessages {
+		err := NewError(em.code, em.message, "foo", "bar")
+		if code := ErrorCodeOf(rpc.ServerError("rpc error: " + err.Error())); code != em.code {
+			t.Fatalf("bad: %v %q", err, code)
+		}
+	}
+}
@@ -2,7 +2,13 @@ package structs
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"sort"
 	"time"
 
 	"github.com/hashicorp/consul/acl"
@@ -10,11 +16,19 @@ import (
 )
 
 var (
-	ErrNoLeader  = fmt.Errorf("No cluster leader")
+	ErrNoLeader  = &Error{ErrCodeNoLeader, ErrMsgNoLeader}
 	ErrNoDCPath  = fmt.Errorf("No path to datacenter")
 	ErrNoServers = fmt.Errorf("No known Consul servers")
 )
 
+// nodeIDRe matches the canonical form of a UUID
+var nodeIDRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ValidNodeID checks if a node ID is a UUID
+func ValidNodeID(id string) bool {
+	return nodeIDRe.MatchString(id)
+}
+
 type MessageType uint8
 
 const (
@@ -24,6 +38,27 @@ const (
 	SessionRequestType
 	ACLRequestType
 	TombstoneRequestType
+	CheckDefinitionRequestType
+	ServiceConfigRequestType
+	IntentionRequestType
+	SnapshotUnchangedType
+	NodeDrainRequestType
+	TableRestoreRequestType
+	RegistrationTimeType
+	LockWaiterType
+	CheckUpdateRequestType
+	CatalogEventType
+	PrefixTombstoneType
+	CheckHeardType
+	ACLUsageRequestType
+	ClusterConfigRequestType
+	FeatureRequestType
+	NodeProtectRequestType
+	ConfigEntryRequestType
+	EventFireRequestType
+	StateCompactRequestType
+	NodeHeartbeatRequestType
+	NodeNameMergeRequestType
 )
 
 const (
@@ -45,6 +80,29 @@ const (
 	HealthCritical = "critical"
 )
 
+// WorseStatus returns the worse of two check statuses. Critical is the
+// worst, followed by unknown, warning and passing.
+func WorseStatus(a, b string) string {
+	if statusSeverity(b) > statusSeverity(a) {
+		return b
+	}
+	return a
+}
+
+// statusSeverity is used to order the check statuses
+func statusSeverity(status string) int {
+	switch status {
+	case HealthPassing:
+		return 0
+	case HealthWarning:
+		return 1
+	case HealthCritical:
+		return 3
+	default:
+		return 2
+	}
+}
+
 func ValidStatus(s string) bool {
 	return s == HealthPassing ||
 		s == HealthWarning ||
@@ -71,6 +129,7 @@ type RPCInfo interface {
 	RequestDatacenter() string
 	IsRead() bool
 	AllowStaleRead() bool
+	MaxStaleness() (time.Duration, uint64)
 	ACLToken() string
 }
 
@@ -91,6 +150,13 @@ type QueryOptions struct {
 	// may be arbitrarily stale.
 	AllowStale bool
 
+	// If set along with AllowStale, bound the staleness of the results.
+	// A follower that has not been contacted by the leader within
+	// MaxStaleDuration, or that has more than MaxStaleIndex committed
+	// entries left to apply, forwards the request to the leader instead.
+	MaxStaleDuration time.Duration
+	MaxStaleIndex    uint64
+
 	// If set, the leader must verify leadership prior to
 	// servicing the request. Prevents a stale read.
 	RequireConsistent bool
@@ -105,6 +171,10 @@ func (q QueryOptions) AllowStaleRead() bool {
 	return q.AllowStale
 }
 
+func (q QueryOptions) MaxStaleness() (time.Duration, uint64) {
+	return q.MaxStaleDuration, q.MaxStaleIndex
+}
+
 func (q QueryOptions) ACLToken() string {
 	return q.Token
 }
@@ -113,6 +183,12 @@ type WriteRequest struct {
 	// Token is the ACL token ID. If not provided, the 'anonymous'
 	// token is assumed for backwards compatibility.
 	Token string
+
+	// Timestamp is the wall clock of the leader when the request was
+	// applied to the Raft log, in nanoseconds since the Unix epoch. It
+	// is set by the leader, and used by the FSM in place of the local
+	// clock so that all the servers compute identical expirations.
+	Timestamp int64
 }
 
 // WriteRequest only applies to writes, always false
@@ -124,10 +200,35 @@ func (w WriteRequest) AllowStaleRead() bool {
 	return false
 }
 
+func (w WriteRequest) MaxStaleness() (time.Duration, uint64) {
+	return 0, 0
+}
+
 func (w WriteRequest) ACLToken() string {
 	return w.Token
 }
 
+// SetTimestamp is used by the leader to stamp the request with its
+// clock before it is applied to the Raft log
+func (w *WriteRequest) SetTimestamp(t time.Time) {
+	w.Timestamp = t.UnixNano()
+}
+
+// RequestTime returns the clock of the leader carried by the request,
+// or the zero time if the request was not stamped
+func (w WriteRequest) RequestTime() time.Time {
+	if w.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, w.Timestamp)
+}
+
+// TimestampedRequest is implemented by the write requests that carry
+// the clock of the leader through the Raft log
+type TimestampedRequest interface {
+	SetTimestamp(t time.Time)
+}
+
 // QueryMeta allows a query response to include potentially
 // useful metadata about a query
 type QueryMeta struct {
@@ -153,21 +254,75 @@ type RegisterRequest struct {
 	Service    *NodeService
 	Check      *HealthCheck
 	Checks     HealthChecks
+
+	// NodeMeta replaces the metadata of the node. If nil, the metadata
+	// of an existing node is kept, so services and checks can be
+	// registered without it.
+	NodeMeta map[string]string
+
+	// NodeID is the UUID of the node. If blank, the ID of an existing
+	// node is kept.
+	NodeID string
+
+	// CheckGrace, if set, keeps a prior passing or warning status of
+	// Check in place of a critical one, as long as the prior status was
+	// last heard within the grace period. Agents set it for TTL checks
+	// restarted without their persisted state, so the checks do not
+	// flap critical before the application checks in again.
+	CheckGrace time.Duration
+
+	// Source records who registered the service and checks, such as
+	// RegistrationSourceAgent. If blank, the source of an existing
+	// service or check is kept.
+	Source string
 	WriteRequest
 }
 
+const (
+	// RegistrationSourceAgent marks the services and checks synced by
+	// the anti-entropy of the agent of their node. RegistrationSourceAPI
+	// marks those registered through the catalog API, which the agent
+	// still deregisters if it does not know them. Those registered with
+	// RegistrationSourceExternal are owned by an external tool, so they
+	// are left alone by anti-entropy and by the reaping of their node.
+	RegistrationSourceAgent    = "agent"
+	RegistrationSourceAPI      = "api"
+	RegistrationSourceExternal = "external"
+)
+
 func (r *RegisterRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// CheckUpdateRequest is used for the Catalog.UpdateCheck endpoint to
+// update the status and output of a registered check. This is much
+// smaller than a RegisterRequest, which must carry the whole definition
+// of the check and of its service.
+type CheckUpdateRequest struct {
+	Datacenter string
+	Node       string
+	CheckID    string
+	Status     string
+	Output     string
+	Grace      time.Duration // Same as RegisterRequest.CheckGrace
+	WriteRequest
+}
+
+func (r *CheckUpdateRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // DeregisterRequest is used for the Catalog.Deregister endpoint
 // to deregister a node as providing a service. If no service is
 // provided the entire node is deregistered.
 type DeregisterRequest struct {
-	Datacenter string
-	Node       string
-	ServiceID  string
-	CheckID    string
+	Datacenter  string
+	Node        string
+	ServiceID   string
+	CheckID     string
+	ServiceName string // Deregister all instances of a service, if no Node
+	Namespace   string // Namespace of the service or check
+	Force       bool   // Deregister the whole node even if it is protected
 	WriteRequest
 }
 
@@ -175,6 +330,31 @@ func (r *DeregisterRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+type CatalogEventOp string
+
+const (
+	CatalogEventRegister   CatalogEventOp = "register"
+	CatalogEventDeregister                = "deregister"
+)
+
+// CatalogEvent records a registration or deregistration applied to the
+// catalog, as an audit trail of changes to the topology. The actor is
+// identified by the name of the ACL of the token used, and by a hash of
+// the token, since the token itself is a secret.
+type CatalogEvent struct {
+	ID          string // Index of the change, hex encoded so IDs sort in order
+	Index       uint64
+	Time        int64 // Unix nanoseconds, from the clock of the leader
+	Op          CatalogEventOp
+	Node        string
+	ServiceID   string
+	CheckIDs    []string
+	ServiceName string // Set when all instances of a service were deregistered
+	Actor       string
+	TokenHash   string
+}
+type CatalogEvents []*CatalogEvent
+
 // DCSpecificRequest is used to query about a specific DC
 type DCSpecificRequest struct {
 	Datacenter string
@@ -191,6 +371,28 @@ type ServiceSpecificRequest struct {
 	ServiceName string
 	ServiceTag  string
 	TagFilter   bool // Controls tag filtering
+
+	// ServiceVersion and Canary restrict the nodes to the instances
+	// of the service of a version, or by their canary flag
+	ServiceVersion string
+	Canary         CanaryFilter
+
+	// NodeMetaFilters restricts the instances to those on nodes with
+	// all of the given metadata
+	NodeMetaFilters map[string]string
+
+	// PassingOnly restricts the nodes to the instances whose checks, and
+	// the checks of their node, are all passing
+	PassingOnly bool
+
+	// AddressTag selects the address of the instances with the given
+	// tag, for the instances registered with one. See NodeService.
+	AddressTag string
+
+	// Limit and Cursor are used to page through the checks of a
+	// service. See CheckCursor.
+	Limit  int
+	Cursor CheckCursor
 	QueryOptions
 }
 
@@ -198,6 +400,39 @@ func (r *ServiceSpecificRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+const (
+	// AddressLANIPv4 and the other well-known address tags identify the
+	// addresses of a service by network and family. The address of a
+	// well-known tag must be of its family, while other tags accept an
+	// address of either family.
+	AddressLANIPv4 = "lan_ipv4"
+	AddressLANIPv6 = "lan_ipv6"
+	AddressWANIPv4 = "wan_ipv4"
+	AddressWANIPv6 = "wan_ipv6"
+)
+
+// CanaryFilter is used to filter the instances of a service by their
+// canary flag
+type CanaryFilter string
+
+const (
+	CanaryAny     CanaryFilter = ""        // All instances
+	CanaryOnly                 = "only"    // Only canaries
+	CanaryExclude              = "exclude" // Only instances that are not canaries
+)
+
+// Matches returns if a service instance passes the filter
+func (f CanaryFilter) Matches(canary bool) bool {
+	switch f {
+	case CanaryOnly:
+		return canary
+	case CanaryExclude:
+		return !canary
+	default:
+		return true
+	}
+}
+
 // NodeSpecificRequest is used to request the information about a single node
 type NodeSpecificRequest struct {
 	Datacenter string
@@ -213,6 +448,14 @@ func (r *NodeSpecificRequest) RequestDatacenter() string {
 type ChecksInStateRequest struct {
 	Datacenter string
 	State      string
+
+	// ServiceName, if set, restricts the checks to those of the service
+	ServiceName string
+
+	// Limit and Cursor are used to page through the checks.
+	// See CheckCursor.
+	Limit  int
+	Cursor CheckCursor
 	QueryOptions
 }
 
@@ -220,10 +463,31 @@ func (r *ChecksInStateRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// CheckCursor is used to page through a large number of health checks.
+// Checks are returned in node and check ID order, starting after the
+// cursor, so the zero value starts at the first check. The cursor is
+// stable, since it refers to the last check returned instead of an
+// offset that shifts as checks are added or removed.
+type CheckCursor struct {
+	Node    string
+	CheckID string
+}
+
 // Used to return information about a node
 type Node struct {
 	Node    string
 	Address string
+	Meta    map[string]string
+
+	// NodeID is a UUID that identifies the node across changes of its
+	// name. It is blank for nodes registered without one.
+	NodeID string
+
+	// Protected nodes are only deregistered by a forced deregistration,
+	// which guards critical nodes against a mistaken deregistration that
+	// would also remove their services, checks and sessions. It is set by
+	// a NodeProtectRequest, and kept across registrations of the node.
+	Protected bool
 }
 type Nodes []Node
 
@@ -231,6 +495,17 @@ type Nodes []Node
 // Maps service name to available tags
 type Services map[string][]string
 
+// ServiceSummary is used to summarize the instances of a service
+// across the catalog.
+type ServiceSummary struct {
+	Instances int
+	Nodes     int
+	Tags      []string
+}
+
+// ServiceSummaries maps service name to a summary of its instances
+type ServiceSummaries map[string]*ServiceSummary
+
 // ServiceNode represents a node that is part of a service
 type ServiceNode struct {
 	Node           string
@@ -240,6 +515,26 @@ type ServiceNode struct {
 	ServiceTags    []string
 	ServiceAddress string
 	ServicePort    int
+	ServiceVersion string
+	ServiceCanary  bool
+
+	// Namespace isolates the service from those of other namespaces, so
+	// the same service can be registered by several teams. Services
+	// without one are in the default namespace.
+	Namespace string `json:",omitempty"`
+
+	// AggregatedStatus is the worst status of the checks of the instance
+	// and of its node, or passing if there are none. It is maintained by
+	// the state store as the checks change, without changing the index of
+	// the service.
+	AggregatedStatus string
+
+	// ServiceAddresses are the additional addresses of the instance, see
+	// NodeService
+	ServiceAddresses map[string]string `json:",omitempty"`
+
+	// ServiceSource is the source of the registration, see RegisterRequest
+	ServiceSource string `json:",omitempty"`
 }
 type ServiceNodes []ServiceNode
 
@@ -251,6 +546,24 @@ type NodeService struct {
 	Address           string
 	Port              int
 	EnableTagOverride bool
+
+	// Version and Canary describe the release of the service instance,
+	// so clients can route to a version, or to or around canaries
+	Version string
+	Canary  bool
+
+	// Namespace is the namespace of the service, see ServiceNode
+	Namespace string `json:",omitempty"`
+
+	// Addresses are additional addresses of the service, keyed by a tag
+	// such as AddressLANIPv6, so a dual-stack or multi-network instance
+	// is registered once. Queries can select one by its tag, falling
+	// back to Address.
+	Addresses map[string]string `json:",omitempty"`
+
+	// Source is the source of the registration, see RegisterRequest. It
+	// is set by the servers, and ignored on registration.
+	Source string `json:",omitempty"`
 }
 type NodeServices struct {
 	Node     Node
@@ -267,6 +580,8 @@ type HealthCheck struct {
 	Output      string // Holds output of script runs
 	ServiceID   string // optional associated service
 	ServiceName string // optional service name
+	Namespace   string `json:",omitempty"` // optional namespace, and that of the service
+	Source      string `json:",omitempty"` // source of the registration, set by the servers
 }
 type HealthChecks []*HealthCheck
 
@@ -276,6 +591,9 @@ type CheckServiceNode struct {
 	Node    Node
 	Service NodeService
 	Checks  HealthChecks
+
+	// DNSTTL is the DNS TTL configured for the service, if any
+	DNSTTL time.Duration
 }
 type CheckServiceNodes []CheckServiceNode
 
@@ -284,10 +602,173 @@ type CheckServiceNodes []CheckServiceNode
 // rather expensive to generate.
 type NodeInfo struct {
 	Node     string
+	NodeID   string
 	Address  string
 	Services []*NodeService
 	Checks   []*HealthCheck
-}
+
+	// RegisteredAt and LastSyncedAt are the registration times of the
+	// node, in Unix nanoseconds. ServiceTimes has the registration
+	// times of the services, keyed by service ID.
+	RegisteredAt int64
+	LastSyncedAt int64
+	ServiceTimes map[string]*RegistrationTime
+}
+
+// Hash returns a stable hash of the node along with its services and
+// checks. The services and checks are sorted by ID before hashing, so
+// the hash does not depend on the order they were read in. This lets an
+// agent compare its view of the node against the catalog without having
+// to fetch the full definitions.
+func (n *NodeInfo) Hash() string {
+	services := make([]*NodeService, len(n.Services))
+	copy(services, n.Services)
+	sort.Sort(nodeServicesByID(services))
+
+	checks := make([]*HealthCheck, len(n.Checks))
+	copy(checks, n.Checks)
+	sort.Sort(healthChecksByCheckID(checks))
+
+	h := newFieldHash()
+	h.String(n.Node)
+	h.String(n.Address)
+	h.Int(int64(len(services)))
+	for _, srv := range services {
+		h.String(srv.SyncHash(false))
+		h.Bool(srv.EnableTagOverride)
+		h.String(srv.Source)
+	}
+	h.Int(int64(len(checks)))
+	for _, check := range checks {
+		h.String(check.SyncHash())
+		h.String(check.StatusHash(false))
+		h.String(check.Source)
+	}
+	return h.Sum()
+}
+
+// SyncHash returns a hash of the fields of a service that are stored in
+// the catalog, which lets an agent find the services that are out of sync
+// without fetching their definitions. The tags are left out if ignoreTags
+// is set. The fields are hashed explicitly, so fields added later, such
+// as the source set by the servers, do not change the hash.
+func (s *NodeService) SyncHash(ignoreTags bool) string {
+	h := newFieldHash()
+	h.String(s.ID)
+	h.String(s.Service)
+	if ignoreTags {
+		h.Strings(nil)
+	} else {
+		h.Strings(s.Tags)
+	}
+	h.String(s.Address)
+	h.Int(int64(s.Port))
+	h.String(s.Version)
+	h.Bool(s.Canary)
+	h.String(s.Namespace)
+	h.StringMap(s.Addresses)
+	return h.Sum()
+}
+
+// SyncHash returns a hash of the definition of a check. The status and
+// output are left out, and are hashed by StatusHash instead, so a change
+// of status can be synced without the definition.
+func (c *HealthCheck) SyncHash() string {
+	h := newFieldHash()
+	h.String(c.Node)
+	h.String(c.CheckID)
+	h.String(c.Name)
+	h.String(c.Notes)
+	h.String(c.ServiceID)
+	h.String(c.ServiceName)
+	h.String(c.Namespace)
+	return h.Sum()
+}
+
+// StatusHash returns a hash of the status and output of a check. The
+// output is left out if ignoreOutput is set.
+func (c *HealthCheck) StatusHash(ignoreOutput bool) string {
+	h := newFieldHash()
+	h.String(c.Status)
+	if !ignoreOutput {
+		h.String(c.Output)
+	}
+	return h.Sum()
+}
+
+// fieldHash is used to hash an explicit, ordered list of fields. Unlike
+// hashing an encoded struct, the hash does not depend on the encoder, on
+// the order of map keys, or on the fields known to a given version.
+type fieldHash struct {
+	h   hash.Hash
+	buf [binary.MaxVarintLen64]byte
+}
+
+func newFieldHash() *fieldHash {
+	return &fieldHash{h: md5.New()}
+}
+
+// Int adds an integer to the hash
+func (f *fieldHash) Int(v int64) {
+	n := binary.PutVarint(f.buf[:], v)
+	f.h.Write(f.buf[:n])
+}
+
+// Bool adds a boolean to the hash
+func (f *fieldHash) Bool(v bool) {
+	if v {
+		f.Int(1)
+	} else {
+		f.Int(0)
+	}
+}
+
+// String adds a string to the hash, prefixed by its length so adjacent
+// fields cannot be confused
+func (f *fieldHash) String(v string) {
+	f.Int(int64(len(v)))
+	io.WriteString(f.h, v)
+}
+
+// Strings adds a list of strings to the hash. Empty and nil lists hash
+// the same.
+func (f *fieldHash) Strings(v []string) {
+	f.Int(int64(len(v)))
+	for _, s := range v {
+		f.String(s)
+	}
+}
+
+// StringMap adds a map to the hash, in the order of its keys
+func (f *fieldHash) StringMap(v map[string]string) {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f.Int(int64(len(keys)))
+	for _, k := range keys {
+		f.String(k)
+		f.String(v[k])
+	}
+}
+
+// Sum returns the hash as a hex string
+func (f *fieldHash) Sum() string {
+	return fmt.Sprintf("%x", f.h.Sum(nil))
+}
+
+type nodeServicesByID []*NodeService
+
+func (n nodeServicesByID) Len() int           { return len(n) }
+func (n nodeServicesByID) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodeServicesByID) Less(i, j int) bool { return n[i].ID < n[j].ID }
+
+type healthChecksByCheckID []*HealthCheck
+
+func (h healthChecksByCheckID) Len() int           { return len(h) }
+func (h healthChecksByCheckID) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h healthChecksByCheckID) Less(i, j int) bool { return h[i].CheckID < h[j].CheckID }
 
 // NodeDump is used to dump all the nodes with all their
 // associated data. This is currently used for the UI only,
@@ -316,11 +797,21 @@ type IndexedNodeServices struct {
 
 type IndexedHealthChecks struct {
 	HealthChecks HealthChecks
+
+	// NextCursor is set if the checks were limited, and is used to
+	// request the next page, which may be empty
+	NextCursor *CheckCursor
 	QueryMeta
 }
 
 type IndexedCheckServiceNodes struct {
 	Nodes CheckServiceNodes
+
+	// Cached is set if the nodes of a remote datacenter were served from
+	// the cache of the server, and CacheAge is then the time since they
+	// were last refreshed
+	Cached   bool          `json:",omitempty"`
+	CacheAge time.Duration `json:",omitempty"`
 	QueryMeta
 }
 
@@ -329,6 +820,79 @@ type IndexedNodeDump struct {
 	QueryMeta
 }
 
+type IndexedCatalogEvents struct {
+	Events CatalogEvents
+	QueryMeta
+}
+
+// IndexedNodeSeen is used to return when a node was last seen alive. It
+// is nil if the node was never seen.
+type IndexedNodeSeen struct {
+	NodeSeen *NodeSeen
+	QueryMeta
+}
+
+// IndexedNodeInfoHash is used to return the hash of a node's services
+// and checks. The hash is empty if the node is not registered.
+type IndexedNodeInfoHash struct {
+	Hash string
+	QueryMeta
+}
+
+// NodeSyncService is the hash of a service of an agent
+type NodeSyncService struct {
+	Hash string // SyncHash of the service
+
+	// IgnoreTags is set for services with EnableTagOverride, whose tags
+	// may be changed through the catalog and are left out of the hash
+	IgnoreTags bool
+}
+
+// NodeSyncCheck is the hash of a check of an agent
+type NodeSyncCheck struct {
+	Hash       string // SyncHash of the check
+	StatusHash string
+}
+
+// NodeSyncRequest is used by an agent to compare its services and checks
+// against the catalog by sending their hashes, instead of fetching all of
+// the services and checks of its node
+type NodeSyncRequest struct {
+	Datacenter string
+	Node       string
+	Services   map[string]NodeSyncService // By service ID
+	Checks     map[string]NodeSyncCheck   // By check ID
+
+	// IgnoreCheckOutput is set if the output of the checks was left out
+	// of their StatusHash
+	IgnoreCheckOutput bool
+	QueryOptions
+}
+
+func (r *NodeSyncRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// NodeSyncDiff lists the services and checks an agent must sync with
+// the catalog
+type NodeSyncDiff struct {
+	SyncServices   []string // Missing from the catalog, or different
+	DeleteServices []string // Only in the catalog
+
+	// ServiceTags are the tags in the catalog of the services sent with
+	// IgnoreTags, which agents adopt as their own
+	ServiceTags map[string][]string
+
+	SyncChecks        []string // Missing from the catalog, or different
+	SyncCheckStatuses []string // Only the status or output is different
+	DeleteChecks      []string // Only in the catalog
+}
+
+type IndexedNodeSyncDiff struct {
+	Diff NodeSyncDiff
+	QueryMeta
+}
+
 // DirEntry is used to represent a directory entry. This is
 // used for values in our Key-Value store.
 type DirEntry struct {
@@ -339,6 +903,15 @@ type DirEntry struct {
 	Flags       uint64
 	Value       []byte
 	Session     string `json:",omitempty"`
+
+	// ContentType and Encoding optionally describe the value, such as
+	// "application/json" and "gzip", so tools can render it properly
+	ContentType string `json:",omitempty"`
+	Encoding    string `json:",omitempty"`
+
+	// Namespace optionally isolates the entry from the keys of other
+	// namespaces. Entries without one are in the default namespace.
+	Namespace string `json:",omitempty"`
 }
 type DirEntries []*DirEntry
 
@@ -349,16 +922,31 @@ const (
 	KVSDelete           = "delete"
 	KVSDeleteCAS        = "delete-cas" // Delete with check-and-set
 	KVSDeleteTree       = "delete-tree"
-	KVSCAS              = "cas"    // Check-and-set
-	KVSLock             = "lock"   // Lock a key
-	KVSUnlock           = "unlock" // Unlock a key
+	KVSCAS              = "cas"       // Check-and-set
+	KVSLock             = "lock"      // Lock a key
+	KVSUnlock           = "unlock"    // Unlock a key
+	KVSUndelete         = "undelete"  // Recover a soft-deleted key
+	KVSIncrement        = "increment" // Atomically increment an integer value
+	KVSBatch            = "batch"     // Apply several operations at once
+	KVSImport           = "import"    // Import entries with their original indexes
+	KVSDequeue          = "dequeue"   // Leave the queue for a lock
+	KVSCASMulti         = "cas-multi" // Check-and-set several keys at once
 )
 
 // KVSRequest is used to operate on the Key-Value store
 type KVSRequest struct {
 	Datacenter string
-	Op         KVSOp    // Which operation are we performing
-	DirEnt     DirEntry // Which directory entry
+	Op         KVSOp       // Which operation are we performing
+	DirEnt     DirEntry    // Which directory entry
+	Delta      int64       // Amount to add for KVSIncrement
+	Queue      bool        // Queue for the lock if it is held, for KVSLock
+	Batch      KVSBatchOps // Operations to apply, for KVSBatch
+	Entries    DirEntries  // Entries to import under DirEnt.Key, for KVSImport, or to set for KVSCASMulti
+
+	// QueueWait bounds how long a queued lock waits to be granted, after
+	// which the session leaves the queue
+	QueueWait time.Duration
+
 	WriteRequest
 }
 
@@ -366,13 +954,73 @@ func (r *KVSRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// KVSBatchOp is a single operation of a batch. Only the operations that
+// do not depend on the existing entry, which are set, delete and
+// delete-tree, can be batched.
+type KVSBatchOp struct {
+	Op     KVSOp
+	DirEnt DirEntry
+}
+type KVSBatchOps []*KVSBatchOp
+
+// KVSBatchRequest is used to apply several operations to the Key-Value
+// store with a single Raft entry
+type KVSBatchRequest struct {
+	Datacenter string
+	Ops        KVSBatchOps
+	WriteRequest
+}
+
+func (r *KVSBatchRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// KVSCASMultiRequest is used to check-and-set several keys at once. The
+// ModifyIndex of each entry is checked like for KVSCAS, and either all
+// the entries are written, or none of them.
+type KVSCASMultiRequest struct {
+	Datacenter string
+	Entries    DirEntries
+	WriteRequest
+}
+
+func (r *KVSCASMultiRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// LockWaiter is a session queued to acquire a held lock. When the lock
+// is released, it is granted to the oldest waiter along with the value
+// and flags the waiter attempted to acquire it with.
+type LockWaiter struct {
+	CreateIndex uint64
+	Key         string
+	Session     string
+	Flags       uint64
+	Value       []byte
+}
+type LockWaiters []*LockWaiter
+
 // KeyRequest is used to request a key, or key prefix
 type KeyRequest struct {
 	Datacenter string
 	Key        string
+	Session    string // Only list the keys locked by this session, if set
+	Pattern    string // Only list the keys matching this glob pattern, if set
+
+	// FlagsMask and Flags restrict the entries to those whose flags
+	// match Flags on the bits of FlagsMask. A zero mask matches every
+	// entry.
+	FlagsMask uint64
+	Flags     uint64
 	QueryOptions
 }
 
+// MatchFlags returns if flags match the flags of the request on the
+// bits of its mask
+func (r *KeyRequest) MatchFlags(flags uint64) bool {
+	return flags&r.FlagsMask == r.Flags&r.FlagsMask
+}
+
 func (r *KeyRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
@@ -394,11 +1042,78 @@ type IndexedDirEntries struct {
 	QueryMeta
 }
 
+// IndexedDirEntryWithSession is used to return an entry along with the
+// session holding its lock, if any
+type IndexedDirEntryWithSession struct {
+	Entry   *DirEntry
+	Session *Session
+	QueryMeta
+}
+
+// KVReplicationStatus is used to report the progress of replicating
+// the KV store from a primary datacenter
+type KVReplicationStatus struct {
+	Enabled          bool
+	Running          bool
+	SourceDatacenter string
+	ReplicatedIndex  uint64
+	LastSuccess      time.Time
+	LastError        string
+	LastErrorTime    time.Time
+}
+
 type IndexedKeyList struct {
 	Keys []string
 	QueryMeta
 }
 
+// KVSStats summarizes the keys under a prefix. Depth is the deepest
+// nesting of the keys beneath the prefix, counted in '/' separators, and
+// MaxIndex is the highest ModifyIndex of the keys.
+type KVSStats struct {
+	Keys       int
+	ValueBytes int64
+	Depth      int
+	MaxIndex   uint64
+}
+
+type IndexedKVSStats struct {
+	Stats *KVSStats
+	QueryMeta
+}
+
+// KeyLock describes a key that is currently locked, along with
+// the session holding the lock and the node owning that session
+type KeyLock struct {
+	Key         string
+	LockIndex   uint64
+	ModifyIndex uint64
+	Session     string
+	Node        string
+}
+type KeyLocks []*KeyLock
+
+type IndexedKeyLocks struct {
+	Locks KeyLocks
+	QueryMeta
+}
+
+// Tombstone describes a deleted key whose tombstone has not been reaped
+// yet. Tombstones hold up the index of a listing under their key until
+// they are reaped. Prefix is set for the tombstone of a tree delete,
+// whose Key is the prefix that was deleted.
+type Tombstone struct {
+	Key         string
+	ModifyIndex uint64
+	Prefix      bool
+}
+type Tombstones []*Tombstone
+
+type IndexedTombstones struct {
+	Tombstones Tombstones
+	QueryMeta
+}
+
 type SessionBehavior string
 
 const (
@@ -422,9 +1137,25 @@ type Session struct {
 	LockDelay   time.Duration
 	Behavior    SessionBehavior // What to do when session is invalidated
 	TTL         string
+
+	// ServiceChecks binds the session to the checks of services,
+	// which may be registered on other nodes than the session
+	ServiceChecks []SessionServiceCheck
+
+	// LockCount is the number of keys locked by the session. It is
+	// computed when the session is read, and is not stored.
+	LockCount int
 }
 type Sessions []*Session
 
+// SessionServiceCheck is used to bind a session to a service-level
+// check. The session is invalidated when the check becomes critical.
+type SessionServiceCheck struct {
+	Node      string
+	ServiceID string
+	CheckID   string
+}
+
 type SessionOp string
 
 const (
@@ -460,6 +1191,34 @@ type IndexedSessions struct {
 	QueryMeta
 }
 
+// SessionInvalidation describes a session that was destroyed, either
+// explicitly or because of a failed check or node. The event is gossiped
+// to every member, so it does not name the keys locked by the session,
+// which would bypass the KV ACLs. Behavior tells whether its locks were
+// released or deleted.
+type SessionInvalidation struct {
+	Index    uint64
+	Session  string
+	Name     string
+	Node     string
+	Behavior SessionBehavior
+}
+
+// CheckStatusChange describes a transition of the status of an existing
+// health check, as applied to the catalog
+type CheckStatusChange struct {
+	Index       uint64
+	Node        string
+	CheckID     string
+	Name        string
+	Namespace   string
+	ServiceID   string
+	ServiceName string
+	PrevStatus  string
+	Status      string
+	Output      string
+}
+
 // ACL is used to represent a token and it's rules
 type ACL struct {
 	CreateIndex uint64
@@ -468,15 +1227,43 @@ type ACL struct {
 	Name        string
 	Type        string
 	Rules       string
+
+	// ExpireTime is set on the old ID of a rotated token, which remains
+	// valid until then so its users can switch to the new ID. The leader
+	// deletes the token once it expires.
+	ExpireTime time.Time `json:",omitempty"`
+
+	// LastUsedIndex and LastUsedTime record when the token was last
+	// used to authenticate a request. Usage is only recorded once per
+	// interval, so they are approximate, and zero if never recorded.
+	// They are kept in their own table, see ACLUsage.
+	LastUsedIndex uint64
+	LastUsedTime  time.Time
 }
 type ACLs []*ACL
 
+// Expired checks if the token has expired at the given time
+func (a *ACL) Expired(now time.Time) bool {
+	return !a.ExpireTime.IsZero() && !now.Before(a.ExpireTime)
+}
+
+// ACLUsage records when a token was last used. It is kept apart from
+// the token, so recording its use does not modify the ACL table.
+type ACLUsage struct {
+	ID            string
+	LastUsedIndex uint64
+	LastUsedTime  time.Time
+}
+type ACLUsages []*ACLUsage
+
 type ACLOp string
 
 const (
 	ACLSet      ACLOp = "set"
 	ACLForceSet       = "force-set" // Deprecated, left to backwards compatibility
 	ACLDelete         = "delete"
+	ACLClone          = "clone"  // Copy an ACL to a new ID
+	ACLRotate         = "rotate" // Move an ACL to a new ID
 )
 
 // ACLRequest is used to create, update or delete an ACL
@@ -484,6 +1271,11 @@ type ACLRequest struct {
 	Datacenter string
 	Op         ACLOp
 	ACL        ACL
+	NewID      string // ID of the copy for ACLClone and ACLRotate
+
+	// GracePeriod is how long the old ID of an ACLRotate remains valid.
+	// It is set by the leader, and the old ID is removed at once if zero.
+	GracePeriod time.Duration
 	WriteRequest
 }
 
@@ -491,6 +1283,17 @@ func (r *ACLRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// ACLUsageRequest is used to record the use of ACL tokens
+type ACLUsageRequest struct {
+	Datacenter string
+	IDs        []string
+	WriteRequest
+}
+
+func (r *ACLUsageRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // ACLSpecificRequest is used to request an ACL by ID
 type ACLSpecificRequest struct {
 	Datacenter string
@@ -537,6 +1340,11 @@ type EventFireRequest struct {
 	Name       string
 	Payload    []byte
 
+	// Persist records the event through Raft before it is gossiped,
+	// so it can be listed from the servers afterwards. This requires
+	// a leader, so the request must not allow stale reads.
+	Persist bool
+
 	// Not using WriteRequest so that any server can process
 	// the request. It is a bit unusual...
 	QueryOptions
@@ -551,10 +1359,39 @@ type EventFireResponse struct {
 	QueryMeta
 }
 
+// UserEvent is a user event that was persisted by the servers. Only the
+// most recent events are retained.
+type UserEvent struct {
+	ID      string // Index of the event, hex encoded so IDs sort in order
+	Index   uint64
+	Time    int64 // Unix nanoseconds, from the clock of the leader
+	Name    string
+	Payload []byte
+}
+type UserEvents []*UserEvent
+
+// EventListRequest is used to list the persisted user events, optionally
+// only the ones with the given name
+type EventListRequest struct {
+	Datacenter string
+	Name       string
+	QueryOptions
+}
+
+func (r *EventListRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedUserEvents struct {
+	Events UserEvents
+	QueryMeta
+}
+
 type TombstoneOp string
 
 const (
-	TombstoneReap TombstoneOp = "reap"
+	TombstoneReap       TombstoneOp = "reap"
+	TombstoneReapPrefix             = "reap-prefix" // Reap only under Prefix
 )
 
 // TombstoneRequest is used to trigger a reaping of the tombstones
@@ -562,6 +1399,7 @@ type TombstoneRequest struct {
 	Datacenter string
 	Op         TombstoneOp
 	ReapIndex  uint64
+	Prefix     string
 	WriteRequest
 }
 
@@ -569,6 +1407,702 @@ func (r *TombstoneRequest) RequestDatacenter() string {
 	return r.Datacenter
 }
 
+// PrefixTombstone marks the deletion of every key under a prefix. It is
+// used in place of a tombstone per key when a tree delete removes a
+// large number of keys, so the index of a listing under the prefix can
+// still advance past the delete.
+type PrefixTombstone struct {
+	Prefix      string
+	ModifyIndex uint64
+}
+type PrefixTombstones []*PrefixTombstone
+
+// CheckDefinition is used to store the definition of a health check that
+// is executed by the servers instead of an agent. This allows "external"
+// services, which have no agent running alongside them, to still have
+// their health probed using either an HTTP or TCP check.
+type CheckDefinition struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+	Node        string
+	CheckID     string
+	Name        string
+	Notes       string
+	ServiceID   string
+	ServiceName string
+	HTTP        string
+	TCP         string
+	Interval    time.Duration
+	Timeout     time.Duration
+}
+type CheckDefinitions []*CheckDefinition
+
+type CheckDefinitionOp string
+
+const (
+	CheckDefinitionSet    CheckDefinitionOp = "set"
+	CheckDefinitionDelete                   = "delete"
+)
+
+// CheckDefinitionRequest is used to create, update or delete
+// a server-executed check definition
+type CheckDefinitionRequest struct {
+	Datacenter string
+	Op         CheckDefinitionOp
+	Definition CheckDefinition
+	WriteRequest
+}
+
+func (r *CheckDefinitionRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// CheckDefinitionQuery is used to get the check definition of a node by
+// check ID, or to list all of them if no node is given
+type CheckDefinitionQuery struct {
+	Datacenter string
+	Node       string
+	CheckID    string
+	QueryOptions
+}
+
+func (r *CheckDefinitionQuery) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedCheckDefinitions struct {
+	Definitions CheckDefinitions
+	QueryMeta
+}
+
+// ServiceConfig is used to store configuration that applies to all the
+// instances of a service, regardless of the node providing them
+type ServiceConfig struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+	Service     string
+	DNSTTL      time.Duration
+}
+type ServiceConfigs []*ServiceConfig
+
+type ServiceConfigOp string
+
+const (
+	ServiceConfigSet    ServiceConfigOp = "set"
+	ServiceConfigDelete                 = "delete"
+)
+
+// ServiceConfigRequest is used to create, update or delete
+// the configuration of a service
+type ServiceConfigRequest struct {
+	Datacenter string
+	Op         ServiceConfigOp
+	Config     ServiceConfig
+	WriteRequest
+}
+
+func (r *ServiceConfigRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ServiceConfigQuery is used to query the configuration of all services,
+// or of a single one if the service is given
+type ServiceConfigQuery struct {
+	Datacenter string
+	Service    string
+	QueryOptions
+}
+
+func (r *ServiceConfigQuery) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedServiceConfigs struct {
+	Configs ServiceConfigs
+	QueryMeta
+}
+
+const (
+	// ServiceDefaults is the kind of the config entries holding the
+	// defaults of a service, named after the service
+	ServiceDefaults = "service-defaults"
+
+	// ProxyDefaults is the kind of the config entry holding the defaults
+	// of all the proxies. There is a single one, named ProxyConfigGlobal.
+	ProxyDefaults = "proxy-defaults"
+
+	// ProxyConfigGlobal is the name of the proxy-defaults config entry
+	ProxyConfigGlobal = "global"
+)
+
+// ConfigEntry is used to store the runtime configuration of a kind of
+// entity, such as a service. Entries are identified by their kind and
+// name, and their settings are left to the consumers of each kind.
+type ConfigEntry struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+	Kind        string
+	Name        string
+	Config      map[string]string
+}
+type ConfigEntries []*ConfigEntry
+
+type ConfigEntryOp string
+
+const (
+	ConfigEntrySet    ConfigEntryOp = "set"
+	ConfigEntryDelete               = "delete"
+)
+
+// ConfigEntryRequest is used to create, update or delete a config entry
+type ConfigEntryRequest struct {
+	Datacenter string
+	Op         ConfigEntryOp
+	Entry      ConfigEntry
+	WriteRequest
+}
+
+func (r *ConfigEntryRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// ConfigEntryQuery is used to query the config entries of a kind, or a
+// single entry if the name is given
+type ConfigEntryQuery struct {
+	Datacenter string
+	Kind       string
+	Name       string
+	QueryOptions
+}
+
+func (r *ConfigEntryQuery) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedConfigEntries struct {
+	Entries ConfigEntries
+	QueryMeta
+}
+
+// ClusterConfigID is the ID of the cluster config, of which there is
+// a single one
+const ClusterConfigID = "cluster"
+
+// ClusterConfig is used to store settings that apply to the whole
+// cluster. It is applied through Raft, so every server enforces the
+// same settings regardless of its own configuration. A zero value
+// selects the built-in default of the setting.
+type ClusterConfig struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+	ID          string // Always ClusterConfigID
+
+	// SessionBehavior is the behavior of sessions created without one
+	SessionBehavior SessionBehavior
+
+	// SessionTTLMin and SessionTTLMax bound the TTL of new sessions
+	SessionTTLMin time.Duration
+	SessionTTLMax time.Duration
+
+	// SessionLockDelayMin and SessionLockDelayMax bound the lock-delay
+	// of sessions
+	SessionLockDelayMin time.Duration
+	SessionLockDelayMax time.Duration
+
+	// LowercaseNodeNames lowercases the names of the nodes registered
+	// from then on. Nodes already registered keep their name, which is
+	// also used for the writes naming them with another case, until
+	// they are renamed by Operator.NodeNameMerge.
+	LowercaseNodeNames bool
+
+	// ACLDefaultPolicy and ACLDownPolicy override the acl_default_policy
+	// and acl_down_policy of the servers, unless empty. The default policy
+	// is enforced by the ACL datacenter, and the down policy by each
+	// datacenter.
+	ACLDefaultPolicy string
+	ACLDownPolicy    string
+
+	// KVSoftDelete retains the values of deleted keys in their tombstones,
+	// so that an accidental delete can be undone with an undelete operation
+	// until the tombstones are reaped. Keys deleted while it is disabled
+	// cannot be recovered.
+	KVSoftDelete bool
+}
+
+// ClusterConfigRequest is used to replace the cluster config
+type ClusterConfigRequest struct {
+	Datacenter string
+	Config     ClusterConfig
+	WriteRequest
+}
+
+func (r *ClusterConfigRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// FSMHealth is the health of the FSM of a server. A server with entries
+// waiting to be applied, but none applied for a while, is stalled.
+type FSMHealth struct {
+	Server string
+
+	// CommitIndex is the last index committed, as last reported to the
+	// server, and AppliedIndex the last index it applied. QueueDepth is
+	// the number of entries waiting to be applied.
+	CommitIndex  uint64
+	AppliedIndex uint64
+	QueueDepth   uint64
+
+	// LastApply is the time an entry was last applied, or a snapshot
+	// restored, and SinceLastApply the time elapsed since
+	LastApply      time.Time
+	SinceLastApply time.Duration
+	Stalled        bool
+
+	// TableIndexes is the last index that modified each table
+	TableIndexes map[string]uint64
+	QueryMeta
+}
+
+type IndexedClusterConfig struct {
+	Config *ClusterConfig
+	QueryMeta
+}
+
+const (
+	// FeatureKVSBatch covers the batch op of KVSRequestType
+	FeatureKVSBatch = "kvs-batch"
+
+	// FeatureKVSImport covers the import op of KVSRequestType
+	FeatureKVSImport = "kvs-import"
+
+	// FeatureACLUsage covers ACLUsageRequestType
+	FeatureACLUsage = "acl-usage"
+
+	// FeatureClusterConfig covers ClusterConfigRequestType
+	FeatureClusterConfig = "cluster-config"
+
+	// FeatureStateCompact covers StateCompactRequestType
+	FeatureStateCompact = "state-compact"
+
+	// FeatureNodeNameMerge covers NodeNameMergeRequestType
+	FeatureNodeNameMerge = "node-name-merge"
+
+	// FeatureNodeSyncDiff covers the Catalog.NodeSyncDiff RPC, which
+	// agents only use once every server supports it
+	FeatureNodeSyncDiff = "node-sync-diff"
+
+	// FeatureKVSLockQueue covers the queue option of the lock op of
+	// KVSRequestType, and its dequeue op
+	FeatureKVSLockQueue = "kvs-lock-queue"
+
+	// FeatureCheckDefinitions covers CheckDefinitionRequestType
+	FeatureCheckDefinitions = "check-definitions"
+
+	// FeatureServiceConfig covers ServiceConfigRequestType
+	FeatureServiceConfig = "service-config"
+
+	// FeatureTombstoneReapPrefix covers the reap-prefix op of
+	// TombstoneRequestType
+	FeatureTombstoneReapPrefix = "tombstone-reap-prefix"
+
+	// FeatureKVSCASMulti covers the cas-multi op of KVSRequestType
+	FeatureKVSCASMulti = "kvs-cas-multi"
+
+	// FeatureACLRotateGrace covers the GracePeriod of the rotate op of
+	// ACLRequestType
+	FeatureACLRotateGrace = "acl-rotate-grace"
+
+	// FeatureDeregisterService covers the DeregisterRequestType entries
+	// without a node, which deregister every instance of a service
+	FeatureDeregisterService = "deregister-service"
+
+	// FeatureNamespaces covers the Namespace of the services and checks
+	// of RegisterRequestType and DeregisterRequestType
+	FeatureNamespaces = "namespaces"
+
+	// FeatureCheckUpdate covers CheckUpdateRequestType, which agents only
+	// send once every server supports it
+	FeatureCheckUpdate = "check-update"
+
+	// FeatureNodeProtect covers NodeProtectRequestType
+	FeatureNodeProtect = "node-protect"
+
+	// FeatureKVSIncrement covers the increment op of KVSRequestType
+	FeatureKVSIncrement = "kvs-increment"
+
+	// FeatureKVSSoftDelete covers the undelete op of KVSRequestType, and
+	// the deletes of KVSRequestType while the cluster config enables
+	// soft deletes
+	FeatureKVSSoftDelete = "kvs-soft-delete"
+
+	// FeatureNodeDrain covers NodeDrainRequestType
+	FeatureNodeDrain = "node-drain"
+
+	// FeatureConfigEntries covers ConfigEntryRequestType
+	FeatureConfigEntries = "config-entries"
+
+	// FeatureUserEvents covers EventFireRequestType
+	FeatureUserEvents = "user-events"
+
+	// FeatureTableRestore covers TableRestoreRequestType
+	FeatureTableRestore = "table-restore"
+)
+
+// Feature is a capability of the servers that was enabled for the
+// datacenter, once every server supported it. It is applied through
+// Raft, so every server branches the same way on it during a rolling
+// upgrade. Features are never disabled once enabled.
+type Feature struct {
+	Name        string
+	CreateIndex uint64
+}
+
+type Features []*Feature
+
+// FeatureRequest is used to enable features
+type FeatureRequest struct {
+	Datacenter string
+	Names      []string
+	WriteRequest
+}
+
+func (r *FeatureRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedFeatures struct {
+	Features Features
+	QueryMeta
+}
+
+// SnapshotUnchanged is written to an incremental snapshot in place of
+// a section that is unchanged since the previous snapshot
+type SnapshotUnchanged struct {
+	Section string
+	Index   uint64
+}
+
+// IntentionWildcard matches any service in an intention
+const IntentionWildcard = "*"
+
+type IntentionAction string
+
+const (
+	IntentionActionAllow IntentionAction = "allow"
+	IntentionActionDeny                  = "deny"
+)
+
+// Intention is used to allow or deny a source service from connecting
+// to a destination service. Either service name may be the wildcard,
+// in which case the intention applies to all the services.
+type Intention struct {
+	CreateIndex     uint64
+	ModifyIndex     uint64
+	ID              string
+	SourceName      string
+	DestinationName string
+	Action          IntentionAction
+	Description     string
+}
+type Intentions []*Intention
+
+type IntentionOp string
+
+const (
+	IntentionSet    IntentionOp = "set"
+	IntentionDelete             = "delete"
+)
+
+// IntentionRequest is used to create, update or delete an intention
+type IntentionRequest struct {
+	Datacenter string
+	Op         IntentionOp
+	Intention  Intention
+	WriteRequest
+}
+
+func (r *IntentionRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedIntentions struct {
+	Intentions Intentions
+	QueryMeta
+}
+
+// NodeDrain marks a node as draining. A draining node remains in the
+// catalog, but it is excluded from the health queries and DNS, so its
+// instances can be removed gracefully before it is deregistered.
+type NodeDrain struct {
+	CreateIndex uint64
+	Node        string
+}
+type NodeDrains []*NodeDrain
+
+// RegistrationTime records when a node or one of its services was first
+// registered, and when it was last synced by a registration. The times
+// are in Unix nanoseconds, taken from the clock of the leader that
+// accepted the registration. ServiceID is empty for the node itself.
+type RegistrationTime struct {
+	ModifyIndex  uint64
+	Node         string
+	ServiceID    string
+	RegisteredAt int64
+	LastSyncedAt int64
+}
+type RegistrationTimes []*RegistrationTime
+
+// CheckHeard records when a passing or warning status was last reported
+// for a check. The time is in Unix nanoseconds, taken from the clock of
+// the leader that accepted the status.
+type CheckHeard struct {
+	ModifyIndex uint64
+	Node        string
+	CheckID     string
+	HeardAt     int64
+}
+type CheckHeards []*CheckHeard
+
+// NodeSeen records when a node was last seen alive by the leader. The
+// time is in Unix nanoseconds, taken from the clock of the leader.
+type NodeSeen struct {
+	ModifyIndex uint64
+	Node        string
+	SeenAt      int64
+}
+type NodeSeens []*NodeSeen
+
+// TableMemoryStats is an estimate of the bytes retained by a table
+// of the state store
+type TableMemoryStats struct {
+	Table      string
+	Rows       int
+	ValueBytes uint64 // Encoded rows
+	IndexBytes uint64 // Row IDs and index entries
+}
+
+// StateMemoryStats is an estimate of the bytes retained by the state
+// store, as of the given index
+type StateMemoryStats struct {
+	Index      uint64
+	Tables     []*TableMemoryStats
+	TotalBytes uint64
+}
+
+// NodeDrainRequest is used to start or stop draining a node
+type NodeDrainRequest struct {
+	Datacenter string
+	Node       string
+	Drain      bool
+	WriteRequest
+}
+
+func (r *NodeDrainRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// NodeProtectRequest is used to protect a node from deregistration,
+// or to lift the protection
+type NodeProtectRequest struct {
+	Datacenter string
+	Node       string
+	Protected  bool
+	WriteRequest
+}
+
+func (r *NodeProtectRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type ChangeOp string
+
+const (
+	ChangeSet        ChangeOp = "set"
+	ChangeDelete              = "delete"
+	ChangeDeleteTree          = "delete-tree"
+)
+
+// Change is a single entry of the state store change log. It records
+// that a row of a table was modified at a given Raft index, so that
+// external tooling can do incremental backups instead of snapshots.
+// For a delete-tree, the Key is the prefix of all the removed rows.
+// The Namespace is only set for the keys of a KV namespace.
+type Change struct {
+	Index     uint64
+	Table     string
+	Namespace string
+	Key       string
+	Op        ChangeOp
+}
+type Changes []*Change
+
+// ChangesRequest is used to read the changes made after an index
+type ChangesRequest struct {
+	Datacenter string
+	Since      uint64
+	QueryOptions
+}
+
+func (r *ChangesRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+type IndexedChanges struct {
+	Changes Changes
+	QueryMeta
+}
+
+// RaftServer describes a server in the Raft peer configuration
+type RaftServer struct {
+	// Node is the name of the server, if it is a known member of
+	// the LAN gossip pool
+	Node string
+
+	// Address is the Raft address of the server
+	Address string
+
+	// Leader is true if the server is the current leader
+	Leader bool
+}
+
+// RaftConfigurationResponse is returned when querying for the
+// Raft peer configuration
+type RaftConfigurationResponse struct {
+	Servers []*RaftServer
+	QueryMeta
+}
+
+// RaftPeerByAddressRequest is used to remove a peer from the Raft
+// configuration by its address
+type RaftPeerByAddressRequest struct {
+	Datacenter string
+	Address    string
+	WriteRequest
+}
+
+func (r *RaftPeerByAddressRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// PartialRestoreRequest is used by operators to restore only some of the
+// sections of a snapshot, such as "acls" or "kvs", into the live state.
+// This is used to recover a single subsystem without rolling back the
+// rest of the cluster state.
+type PartialRestoreRequest struct {
+	Datacenter string
+	Sections   []string
+	Snapshot   []byte // Contents of a snapshot, or empty for the latest snapshot of the leader
+	WriteRequest
+}
+
+func (r *PartialRestoreRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SnapshotRequest is sent on a snapshot connection to request the latest
+// snapshot of the leader, or a snapshot of a single table if Table is set
+type SnapshotRequest struct {
+	Datacenter string
+	Table      string // Name of the table or of its snapshot section
+	QueryOptions
+}
+
+func (r *SnapshotRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// StateTableStats are the storage statistics of a table of the state
+// store. Rows and Bytes are those of the encoded rows. The entries and
+// pages are summed over the B+trees of the table and its indexes, and
+// Depth is that of the deepest tree.
+type StateTableStats struct {
+	Table         string
+	Rows          int
+	Bytes         int
+	Entries       uint64
+	Depth         uint64
+	BranchPages   uint64
+	LeafPages     uint64
+	OverflowPages uint64
+}
+
+// StateStoreStats are the storage statistics of the state store of a
+// server. LMDB never shrinks its map, so the pages freed by a large
+// delete are only reused by later writes. UsedPages counts the pages
+// ever used, including the free ones, which a compaction releases.
+type StateStoreStats struct {
+	Server    string
+	Index     uint64 // Last index of the state
+	PageSize  uint64
+	MapSize   uint64
+	UsedPages uint64
+	Tables    []*StateTableStats
+	QueryMeta
+}
+
+// StateCompactRequest is used to copy the state store of every server
+// into a fresh one
+type StateCompactRequest struct {
+	Datacenter string
+	WriteRequest
+}
+
+func (r *StateCompactRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// NodeHeartbeatRequest is used by the leader to record the nodes that
+// are alive
+type NodeHeartbeatRequest struct {
+	Datacenter string
+	Nodes      []string
+	WriteRequest
+}
+
+func (r *NodeHeartbeatRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// NodeNameMergeRequest is used to merge the rows stored under another
+// case of the name of a node into the rows of its registered name
+type NodeNameMergeRequest struct {
+	Datacenter string
+	WriteRequest
+}
+
+func (r *NodeNameMergeRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
+// SnapshotResponse is sent by the leader ahead of the contents of a
+// snapshot streamed to a follower. It carries the Raft metadata of the
+// snapshot, so the follower can add it to its own snapshot store. For a
+// table snapshot, Index is the last index of the table, and Size is zero
+// since the table is streamed as it is read.
+type SnapshotResponse struct {
+	Error string // Set if the snapshot cannot be streamed
+	Index uint64
+	Term  uint64
+	Peers []byte
+	Size  int64
+}
+
+// TableRestoreRequest is used to apply a batch of a partial restore
+// through Raft. The first batch of a section has Reset set, which clears
+// the section before the entries are written.
+type TableRestoreRequest struct {
+	Datacenter string
+	Section    string
+	Reset      bool
+	ACLs       ACLs
+	DirEntries DirEntries
+	WriteRequest
+}
+
+func (r *TableRestoreRequest) RequestDatacenter() string {
+	return r.Datacenter
+}
+
 // msgpackHandle is a shared handle for encoding/decoding of structs
 var msgpackHandle = &codec.MsgpackHandle{}
 
@@ -53,3 +53,125 @@ func TestStructs_Implements(t *testing.T) {
 		_ CompoundResponse = &KeyringResponses{}
 	)
 }
+
+func TestNodeService_SyncHash(t *testing.T) {
+	srv := &NodeService{
+		ID:      "db",
+		Service: "db",
+		Tags:    []string{"master"},
+		Port:    8000,
+	}
+	hash := srv.SyncHash(false)
+
+	// Fields that are not synced do not change the hash
+	other := *srv
+	other.Source = "agent"
+	other.EnableTagOverride = true
+	if other.SyncHash(false) != hash {
+		t.Fatalf("hash should not change")
+	}
+
+	// Fields that are synced do
+	other.Port = 8001
+	if other.SyncHash(false) == hash {
+		t.Fatalf("hash should change")
+	}
+
+	// Tags are left out if ignored
+	other = *srv
+	other.Tags = []string{"slave"}
+	if other.SyncHash(false) == hash || other.SyncHash(true) != srv.SyncHash(true) {
+		t.Fatalf("bad hashes")
+	}
+
+	// Adjacent fields cannot be confused
+	a := &NodeService{ID: "ab", Service: "c"}
+	b := &NodeService{ID: "a", Service: "bc"}
+	if a.SyncHash(false) == b.SyncHash(false) {
+		t.Fatalf("hashes should differ")
+	}
+}
+
+func TestHealthCheck_SyncHash(t *testing.T) {
+	check := &HealthCheck{
+		Node:    "foo",
+		CheckID: "mem",
+		Name:    "mem",
+		Status:  HealthPassing,
+		Output:  "ok",
+	}
+	hash, status := check.SyncHash(), check.StatusHash(false)
+
+	other := *check
+	other.Status = HealthCritical
+	other.Source = "agent"
+	if other.SyncHash() != hash || other.StatusHash(false) == status {
+		t.Fatalf("bad hashes")
+	}
+
+	other = *check
+	other.Output = "still ok"
+	if other.StatusHash(false) == status || other.StatusHash(true) != check.StatusHash(true) {
+		t.Fatalf("bad hashes")
+	}
+}
+
+func TestNodeService_SyncHash_Addresses(t *testing.T) {
+	srv := &NodeService{
+		ID:      "db",
+		Service: "db",
+		Addresses: map[string]string{
+			"lan_ipv4": "10.0.0.1",
+			"lan_ipv6": "::1",
+			"wan_ipv4": "198.18.0.1",
+			"wan_ipv6": "2001:db8::1",
+		},
+	}
+	hash := srv.SyncHash(false)
+	for i := 0; i < 20; i++ {
+		if h := srv.SyncHash(false); h != hash {
+			t.Fatalf("bad: %s %s", h, hash)
+		}
+	}
+
+	srv.Addresses["lan_ipv6"] = "::2"
+	if srv.SyncHash(false) == hash {
+		t.Fatalf("hash should change")
+	}
+}
+
+func TestNodeInfo_Hash(t *testing.T) {
+	info := &NodeInfo{
+		Node:    "foo",
+		Address: "127.0.0.1",
+		Services: []*NodeService{
+			&NodeService{ID: "db", Service: "db"},
+			&NodeService{ID: "web", Service: "web", Addresses: map[string]string{"a": "1", "b": "2"}},
+		},
+		Checks: []*HealthCheck{
+			&HealthCheck{Node: "foo", CheckID: "mem", Status: HealthPassing},
+			&HealthCheck{Node: "foo", CheckID: "cpu", Status: HealthPassing},
+		},
+	}
+	hash := info.Hash()
+
+	// The order of the services and checks does not matter
+	other := &NodeInfo{
+		Node:     "foo",
+		Address:  "127.0.0.1",
+		Services: []*NodeService{info.Services[1], info.Services[0]},
+		Checks:   []*HealthCheck{info.Checks[1], info.Checks[0]},
+	}
+	if other.Hash() != hash {
+		t.Fatalf("hash should not change")
+	}
+
+	// The status of the checks does
+	other.Checks = []*HealthCheck{
+		info.Checks[0],
+		&HealthCheck{Node: "foo", CheckID: "cpu", Status: HealthCritical},
+	}
+	if other.Hash() == hash {
+		t.Fatalf("hash should change")
+	}
+}
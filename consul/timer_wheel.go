@@ -0,0 +1,296 @@
+package consul
+
+import (
+	"sync"
+	"time"
+)
+
+// wheelLevelBits is the number of bits of the expiration tick used to
+// pick a slot at each level of a timerWheel. The first level has a slot
+// per tick, and each level above it a slot per turn of the level below.
+var wheelLevelBits = []uint{8, 6, 6, 6}
+
+// timerWheel is a hierarchical timer wheel, used to track a large number
+// of timers that are mostly reset before they expire, such as the TTLs of
+// sessions. Unlike time.Timer, it takes no runtime timer per timer: a
+// single goroutine sleeps until the next tick that has a timer due, or
+// that moves timers down from a coarser level, and exits once the wheel
+// is empty. Resetting or stopping a timer only moves it between slots.
+type timerWheel struct {
+	tick  time.Duration
+	start time.Time
+
+	l sync.Mutex
+
+	// now is the next tick to process
+	now uint64
+
+	// levels holds the slots of each level, and count the number of
+	// timers in each level
+	levels [][]map[*wheelTimer]struct{}
+	count  []int
+
+	// running is set while the goroutine of the wheel runs, and wakeAt
+	// is the tick it sleeps until. wakeCh is used to wake it earlier.
+	running bool
+	wakeAt  uint64
+	wakeCh  chan struct{}
+}
+
+// wheelTimer is a timer of a timerWheel
+type wheelTimer struct {
+	wheel   *timerWheel
+	fn      func()
+	expires uint64
+
+	// slot is the slot holding the timer, or nil if it is not active,
+	// and level is the level of the slot
+	slot  map[*wheelTimer]struct{}
+	level int
+}
+
+// newTimerWheel returns a wheel which expires its timers with the given
+// resolution
+func newTimerWheel(tick time.Duration) *timerWheel {
+	w := &timerWheel{
+		tick:   tick,
+		start:  time.Now(),
+		levels: make([][]map[*wheelTimer]struct{}, len(wheelLevelBits)),
+		count:  make([]int, len(wheelLevelBits)),
+		wakeCh: make(chan struct{}, 1),
+	}
+	for i, bits := range wheelLevelBits {
+		w.levels[i] = make([]map[*wheelTimer]struct{}, 1<<bits)
+	}
+	return w
+}
+
+// AfterFunc starts a timer which calls fn in its own goroutine once the
+// duration has elapsed. The timer never fires early, but may fire up to
+// a tick late.
+func (w *timerWheel) AfterFunc(d time.Duration, fn func()) *wheelTimer {
+	t := &wheelTimer{wheel: w, fn: fn}
+	t.Reset(d)
+	return t
+}
+
+// Len returns the number of active timers
+func (w *timerWheel) Len() int {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.lenLocked()
+}
+
+func (w *timerWheel) lenLocked() int {
+	var n int
+	for _, c := range w.count {
+		n += c
+	}
+	return n
+}
+
+// Reset changes the timer to expire after the duration, starting it
+// again if it expired or was stopped. It returns true if the timer was
+// active.
+func (t *wheelTimer) Reset(d time.Duration) bool {
+	w := t.wheel
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	active := w.removeLocked(t)
+	now := time.Now()
+	if !w.running {
+		// Nothing was tracked while the wheel was stopped
+		w.now = w.tickOf(now)
+	}
+	t.expires = w.tickOf(now.Add(d + w.tick - 1))
+	w.placeLocked(t)
+
+	// Start the wheel, or wake it if the timer is due before it would
+	// wake up
+	if !w.running {
+		w.running = true
+		w.wakeAt = t.expires
+		go w.run()
+	} else if t.expires < w.wakeAt {
+		w.wakeAt = t.expires
+		select {
+		case w.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+	return active
+}
+
+// Stop prevents the timer from firing. It returns true if the timer was
+// active.
+func (t *wheelTimer) Stop() bool {
+	w := t.wheel
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.removeLocked(t)
+}
+
+// run is the goroutine of the wheel, which fires the timers as they
+// expire, and exits once there are none left
+func (w *timerWheel) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		w.l.Lock()
+		expired := w.advanceLocked(w.tickOf(time.Now()))
+		if w.lenLocked() == 0 {
+			w.running = false
+			w.l.Unlock()
+			fireWheelTimers(expired)
+			return
+		}
+		w.wakeAt = w.nextWakeLocked()
+		wait := w.timeOf(w.wakeAt).Sub(time.Now())
+		w.l.Unlock()
+		fireWheelTimers(expired)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-w.wakeCh:
+		}
+	}
+}
+
+// fireWheelTimers calls the functions of the expired timers
+func fireWheelTimers(expired []*wheelTimer) {
+	for _, t := range expired {
+		go t.fn()
+	}
+}
+
+// advanceLocked processes the ticks up to the given one, and returns the
+// timers that expired
+func (w *timerWheel) advanceLocked(tick uint64) []*wheelTimer {
+	var expired []*wheelTimer
+	for ; w.now <= tick; w.now++ {
+		// Move the timers of the next slot of each coarser level
+		// down, once the levels below it have turned
+		for level := 1; level < len(wheelLevelBits); level++ {
+			if w.now&(1<<wheelShift(level)-1) != 0 {
+				break
+			}
+			w.cascadeLocked(level)
+		}
+
+		slots := w.levels[0]
+		slot := slots[w.now&uint64(len(slots)-1)]
+		for t := range slot {
+			w.removeLocked(t)
+			expired = append(expired, t)
+		}
+		if w.lenLocked() == 0 {
+			w.now = tick + 1
+			break
+		}
+	}
+	return expired
+}
+
+// cascadeLocked places again the timers of the current slot of a level,
+// which moves them to finer levels
+func (w *timerWheel) cascadeLocked(level int) {
+	slots := w.levels[level]
+	slot := slots[(w.now>>wheelShift(level))&uint64(len(slots)-1)]
+	for t := range slot {
+		w.removeLocked(t)
+		w.placeLocked(t)
+	}
+}
+
+// nextWakeLocked returns the next tick that has a timer due, or that
+// moves timers down from a coarser level
+func (w *timerWheel) nextWakeLocked() uint64 {
+	slots := w.levels[0]
+	turn := uint64(len(slots))
+	next := w.now + turn
+	if w.count[0] > 0 {
+		for tick := w.now; tick < w.now+turn; tick++ {
+			if len(slots[tick&(turn-1)]) > 0 {
+				next = tick
+				break
+			}
+		}
+	}
+	if w.lenLocked() > w.count[0] {
+		if boundary := (w.now + turn - 1) &^ (turn - 1); boundary < next {
+			next = boundary
+		}
+	}
+	return next
+}
+
+// tickOf returns the tick of a point in time
+func (w *timerWheel) tickOf(at time.Time) uint64 {
+	if at.Before(w.start) {
+		return 0
+	}
+	return uint64(at.Sub(w.start) / w.tick)
+}
+
+// timeOf returns the point in time of a tick
+func (w *timerWheel) timeOf(tick uint64) time.Time {
+	return w.start.Add(time.Duration(tick) * w.tick)
+}
+
+// wheelShift returns the number of low bits of a tick below those that
+// pick a slot of the given level
+func wheelShift(level int) uint {
+	var s uint
+	for _, bits := range wheelLevelBits[:level] {
+		s += bits
+	}
+	return s
+}
+
+// placeLocked adds a timer to the slot of the finest level that spans
+// its expiration. Timers beyond the span of the wheel are added to the
+// last slot it spans, and placed again once moved down from there.
+func (w *timerWheel) placeLocked(t *wheelTimer) {
+	expires := t.expires
+	if expires < w.now {
+		expires = w.now
+	}
+	if span := uint64(1) << wheelShift(len(wheelLevelBits)); expires-w.now >= span {
+		expires = w.now + span - 1
+	}
+	level := 0
+	for ; level < len(wheelLevelBits)-1; level++ {
+		if expires-w.now < 1<<wheelShift(level+1) {
+			break
+		}
+	}
+
+	slots := w.levels[level]
+	idx := (expires >> wheelShift(level)) & uint64(len(slots)-1)
+	if slots[idx] == nil {
+		slots[idx] = make(map[*wheelTimer]struct{})
+	}
+	slots[idx][t] = struct{}{}
+	t.slot, t.level = slots[idx], level
+	w.count[level]++
+}
+
+// removeLocked removes a timer from its slot, returning true if it was
+// in one
+func (w *timerWheel) removeLocked(t *wheelTimer) bool {
+	if t.slot == nil {
+		return false
+	}
+	delete(t.slot, t)
+	t.slot = nil
+	w.count[t.level]--
+	return true
+}
@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel_Advance(t *testing.T) {
+	// Use small levels, so the timers cascade and overflow quickly
+	old := wheelLevelBits
+	wheelLevelBits = []uint{2, 2, 2}
+	defer func() { wheelLevelBits = old }()
+
+	w := newTimerWheel(time.Millisecond)
+	expires := []uint64{0, 1, 3, 4, 5, 17, 63, 64, 65, 200, 201}
+	timers := make(map[*wheelTimer]uint64)
+	for _, e := range expires {
+		timer := &wheelTimer{wheel: w, expires: e}
+		w.placeLocked(timer)
+		timers[timer] = e
+	}
+
+	// Stopped timers do not fire
+	stopped := &wheelTimer{wheel: w, expires: 10}
+	w.placeLocked(stopped)
+	if !w.removeLocked(stopped) {
+		t.Fatalf("should be active")
+	}
+	if w.removeLocked(stopped) {
+		t.Fatalf("should not be active")
+	}
+
+	var fired int
+	for tick := uint64(0); tick <= 210; tick++ {
+		for _, timer := range w.advanceLocked(tick) {
+			if timers[timer] != tick {
+				t.Fatalf("timer for %d fired at %d", timers[timer], tick)
+			}
+			fired++
+		}
+	}
+	if fired != len(expires) {
+		t.Fatalf("bad: %d", fired)
+	}
+	if n := w.lenLocked(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestTimerWheel_AfterFunc(t *testing.T) {
+	w := newTimerWheel(time.Millisecond)
+
+	var fired int32
+	start := time.Now()
+	doneCh := make(chan time.Duration, 1)
+	w.AfterFunc(20*time.Millisecond, func() {
+		doneCh <- time.Now().Sub(start)
+	})
+	stopped := w.AfterFunc(10*time.Millisecond, func() {
+		atomic.AddInt32(&fired, 1)
+	})
+	if !stopped.Stop() {
+		t.Fatalf("should be active")
+	}
+
+	select {
+	case d := <-doneCh:
+		if d < 20*time.Millisecond {
+			t.Fatalf("fired early: %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("should fire")
+	}
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Fatalf("stopped timer fired")
+	}
+	if n := w.Len(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestTimerWheel_Reset(t *testing.T) {
+	w := newTimerWheel(time.Millisecond)
+
+	var fired int32
+	timer := w.AfterFunc(20*time.Millisecond, func() {
+		atomic.AddInt32(&fired, 1)
+	})
+
+	// Keep pushing the timer back
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if !timer.Reset(20 * time.Millisecond) {
+			t.Fatalf("should be active")
+		}
+	}
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Fatalf("should not fire")
+	}
+
+	// A timer far out sits in a coarser level, and a timer reset to
+	// expire sooner wakes the wheel
+	w.AfterFunc(time.Hour, func() {})
+	timer.Reset(time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&fired) != 1 {
+		t.Fatalf("should fire")
+	}
+	if n := w.Len(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// An expired timer can be started again
+	if timer.Reset(time.Millisecond) {
+		t.Fatalf("should not be active")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&fired) != 2 {
+		t.Fatalf("should fire")
+	}
+}
@@ -2,6 +2,7 @@ package consul
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -33,6 +34,15 @@ type TombstoneGC struct {
 	// expireCh is used to stream expiration
 	expireCh chan uint64
 
+	// prefixTTLs maps the prefixes whose tombstones have a TTL of their
+	// own to that TTL, and prefixExpires tracks their expirations like
+	// expires, by prefix
+	prefixTTLs    map[string]time.Duration
+	prefixExpires map[string]map[time.Time]*expireInterval
+
+	// prefixExpireCh is used to stream the expiration of the prefixes
+	prefixExpireCh chan PrefixExpiration
+
 	// lock is used to ensure safe access to all the fields
 	lock sync.Mutex
 }
@@ -44,6 +54,12 @@ type expireInterval struct {
 	timer    *time.Timer
 }
 
+// PrefixExpiration is the maximum index to expire under a prefix
+type PrefixExpiration struct {
+	Prefix string
+	Index  uint64
+}
+
 // NewTombstoneGC is used to construct a new TombstoneGC given
 // a TTL for tombstones and a tracking granularity. Longer TTLs
 // ensure correct behavior for more time, but use more storage.
@@ -61,16 +77,43 @@ func NewTombstoneGC(ttl, granularity time.Duration) (*TombstoneGC, error) {
 		enabled:     false,
 		expires:     make(map[time.Time]*expireInterval),
 		expireCh:    make(chan uint64, 1),
+
+		prefixTTLs:     make(map[string]time.Duration),
+		prefixExpires:  make(map[string]map[time.Time]*expireInterval),
+		prefixExpireCh: make(chan PrefixExpiration, 1),
 	}
 	return t, nil
 }
 
+// SetPrefixTTL is used to set the TTL of the tombstones under a prefix,
+// so hot prefixes with heavy delete churn can be compacted sooner than
+// the rest of the keyspace
+func (t *TombstoneGC) SetPrefixTTL(prefix string, ttl time.Duration) error {
+	if prefix == "" {
+		return fmt.Errorf("Tombstone prefix must not be empty")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("Tombstone TTL of prefix '%s' must be positive", prefix)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.prefixTTLs[prefix] = ttl
+	return nil
+}
+
 // ExpireCh is used to return a channel that streams the next index
 // that should be expired
 func (t *TombstoneGC) ExpireCh() <-chan uint64 {
 	return t.expireCh
 }
 
+// PrefixExpireCh is used to return a channel that streams the next
+// index that should be expired under a prefix
+func (t *TombstoneGC) PrefixExpireCh() <-chan PrefixExpiration {
+	return t.prefixExpireCh
+}
+
 // SetEnabled is used to control if the tombstone GC is
 // enabled. Should only be enabled by the leader node.
 func (t *TombstoneGC) SetEnabled(enabled bool) {
@@ -86,6 +129,12 @@ func (t *TombstoneGC) SetEnabled(enabled bool) {
 			exp.timer.Stop()
 		}
 		t.expires = make(map[time.Time]*expireInterval)
+		for _, expires := range t.prefixExpires {
+			for _, exp := range expires {
+				exp.timer.Stop()
+			}
+		}
+		t.prefixExpires = make(map[string]map[time.Time]*expireInterval)
 	}
 
 	// Update the status
@@ -95,7 +144,7 @@ func (t *TombstoneGC) SetEnabled(enabled bool) {
 // Hint is used to indicate that keys at the given index have been
 // deleted, and that their GC should be scheduled.
 func (t *TombstoneGC) Hint(index uint64) {
-	expires := t.nextExpires()
+	expires := t.nextExpires(t.ttl)
 
 	t.lock.Lock()
 	defer t.lock.Unlock()
@@ -122,16 +171,54 @@ func (t *TombstoneGC) Hint(index uint64) {
 	}
 }
 
+// HintKey is like Hint, but for the keys deleted under the given key.
+// It also schedules the GC of each prefix with a TTL of its own that
+// overlaps the deleted keys.
+func (t *TombstoneGC) HintKey(index uint64, key string) {
+	t.Hint(index)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.enabled {
+		return
+	}
+
+	for prefix, ttl := range t.prefixTTLs {
+		if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+			continue
+		}
+		expires := t.nextExpires(ttl)
+		intervals, ok := t.prefixExpires[prefix]
+		if !ok {
+			intervals = make(map[time.Time]*expireInterval)
+			t.prefixExpires[prefix] = intervals
+		}
+		if exp, ok := intervals[expires]; ok {
+			if index > exp.maxIndex {
+				exp.maxIndex = index
+			}
+			continue
+		}
+		prefix := prefix
+		intervals[expires] = &expireInterval{
+			maxIndex: index,
+			timer: time.AfterFunc(expires.Sub(time.Now()), func() {
+				t.expirePrefixTime(prefix, expires)
+			}),
+		}
+	}
+}
+
 // PendingExpiration is used to check if any expirations are pending
 func (t *TombstoneGC) PendingExpiration() bool {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	return len(t.expires) > 0
+	return len(t.expires) > 0 || len(t.prefixExpires) > 0
 }
 
 // nextExpires is used to calculate the next expiration time
-func (t *TombstoneGC) nextExpires() time.Time {
-	expires := time.Now().Add(t.ttl)
+func (t *TombstoneGC) nextExpires(ttl time.Duration) time.Time {
+	expires := time.Now().Add(ttl)
 	remain := expires.UnixNano() % int64(t.granularity)
 	adj := expires.Add(t.granularity - time.Duration(remain))
 	return adj
@@ -148,3 +235,25 @@ func (t *TombstoneGC) expireTime(expires time.Time) {
 	// Notify the expires channel
 	t.expireCh <- exp.maxIndex
 }
+
+// expirePrefixTime is used to expire the entries under a prefix at the
+// given time
+func (t *TombstoneGC) expirePrefixTime(prefix string, expires time.Time) {
+	// Get the maximum index and clear the entry
+	t.lock.Lock()
+	intervals := t.prefixExpires[prefix]
+	exp := intervals[expires]
+	delete(intervals, expires)
+	if len(intervals) == 0 {
+		delete(t.prefixExpires, prefix)
+	}
+	t.lock.Unlock()
+
+	// The GC may have been disabled as the timer fired
+	if exp == nil {
+		return
+	}
+
+	// Notify the expires channel
+	t.prefixExpireCh <- PrefixExpiration{Prefix: prefix, Index: exp.maxIndex}
+}
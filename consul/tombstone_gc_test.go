@@ -102,3 +102,53 @@ func TestTombstoneGC_Expire(t *testing.T) {
 	case <-time.After(20 * time.Millisecond):
 	}
 }
+
+func TestTombstoneGC_Prefix(t *testing.T) {
+	ttl := 20 * time.Millisecond
+	gran := 5 * time.Millisecond
+	gc, err := NewTombstoneGC(time.Hour, gran)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := gc.SetPrefixTTL("", ttl); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := gc.SetPrefixTTL("/election", ttl); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	gc.SetEnabled(true)
+
+	// Keys outside the prefix only wait for the global TTL
+	gc.HintKey(100, "/web/a")
+	start := time.Now()
+	gc.HintKey(110, "/election/a")
+	gc.HintKey(120, "/election/b")
+
+	select {
+	case exp := <-gc.PrefixExpireCh():
+		if time.Now().Sub(start) < ttl {
+			t.Fatalf("expired early")
+		}
+		if exp.Prefix != "/election" || exp.Index != 120 {
+			t.Fatalf("bad: %v", exp)
+		}
+	case <-time.After(ttl * 2):
+		t.Fatalf("should get expiration")
+	}
+
+	// A tree delete above the prefix covers it too
+	gc.HintKey(130, "/")
+	select {
+	case exp := <-gc.PrefixExpireCh():
+		if exp.Index != 130 {
+			t.Fatalf("bad: %v", exp)
+		}
+	case <-time.After(ttl * 2):
+		t.Fatalf("should get expiration")
+	}
+
+	gc.SetEnabled(false)
+	if gc.PendingExpiration() {
+		t.Fatalf("should not be pending")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hashicorp/serf/serf"
 )
@@ -33,6 +34,7 @@ type serverParts struct {
 	Bootstrap  bool
 	Expect     int
 	Version    int
+	Features   []string
 	Addr       net.Addr
 }
 
@@ -137,6 +139,7 @@ func isConsulServer(m serf.Member) (bool, *serverParts) {
 		Expect:     expect,
 		Addr:       addr,
 		Version:    vsn,
+		Features:   parseFeaturesTag(m.Tags["features"]),
 	}
 	return true, parts
 }
@@ -250,3 +253,16 @@ func generateUUID() string {
 func randomStagger(intv time.Duration) time.Duration {
 	return time.Duration(uint64(rand.Int63()) % uint64(intv))
 }
+
+// truncateOutput is used to limit the output of a check to at most limit
+// bytes, without splitting a multi-byte character. A limit of zero leaves
+// the output untouched.
+func truncateOutput(output string, limit int) string {
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+	for limit > 0 && !utf8.RuneStart(output[limit]) {
+		limit--
+	}
+	return output[:limit]
+}
@@ -207,3 +207,22 @@ func TestRandomStagger(t *testing.T) {
 		}
 	}
 }
+
+func TestTruncateOutput(t *testing.T) {
+	cases := []struct {
+		output string
+		limit  int
+		expect string
+	}{
+		{"used 10%", 0, "used 10%"},
+		{"used 10%", 16, "used 10%"},
+		{"used 10%", 4, "used"},
+		{"caf\u00e9 ok", 4, "caf"},
+		{"caf\u00e9 ok", 5, "caf\u00e9"},
+	}
+	for _, c := range cases {
+		if out := truncateOutput(c.output, c.limit); out != c.expect {
+			t.Fatalf("bad: %q %d %q", c.output, c.limit, out)
+		}
+	}
+}
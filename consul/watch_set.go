@@ -0,0 +1,108 @@
+package consul
+
+import (
+	"time"
+)
+
+// watchResult is the reason a WatchSet stopped waiting
+type watchResult int
+
+const (
+	watchFired watchResult = iota
+	watchAbandoned
+	watchTimeout
+)
+
+// WatchSet is used to wait on several state store watches at once, such
+// as the tables, KV prefixes and KV patterns a blocking query depends on.
+// Every watch of the set shares a single channel, so waiting takes no
+// goroutine or channel per watch, and the set moves itself over to the
+// new store when a snapshot restore abandons the one it is armed on.
+type WatchSet struct {
+	tables     MDBTables
+	kvPrefixes []string
+	kvPatterns []string
+
+	// state is the store the set is armed on, or nil
+	state    *StateStore
+	notifyCh chan struct{}
+}
+
+// AddTables is used to watch for changes to the given tables
+func (w *WatchSet) AddTables(tables MDBTables) {
+	w.tables = append(w.tables, tables...)
+}
+
+// AddKVPrefix is used to watch for changes to the KV entries under the
+// given prefix
+func (w *WatchSet) AddKVPrefix(prefix string) {
+	w.kvPrefixes = append(w.kvPrefixes, prefix)
+}
+
+// AddKVPattern is used to watch for changes to the KV entries matching
+// the given glob pattern
+func (w *WatchSet) AddKVPattern(pattern string) {
+	w.kvPatterns = append(w.kvPatterns, pattern)
+}
+
+// Empty checks if there is nothing to watch
+func (w *WatchSet) Empty() bool {
+	return len(w.tables) == 0 && len(w.kvPrefixes) == 0 && len(w.kvPatterns) == 0
+}
+
+// Arm is used to register the watches with the given store. It must be
+// called again after each time the set fires, since a notification clears
+// the channel from the watch that fired. If the set is armed on another
+// store, it is first stopped there.
+func (w *WatchSet) Arm(state *StateStore) error {
+	if w.state != nil && w.state != state {
+		w.Stop()
+	}
+	if w.notifyCh == nil {
+		w.notifyCh = make(chan struct{}, 1)
+	}
+	w.state = state
+
+	state.Watch(w.tables, w.notifyCh)
+	for _, prefix := range w.kvPrefixes {
+		state.WatchKV(prefix, w.notifyCh)
+	}
+	for _, pattern := range w.kvPatterns {
+		if err := state.WatchKVPattern(pattern, w.notifyCh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop is used to unregister the watches from the store the set is
+// armed on. It is safe to call on a set that is not armed.
+func (w *WatchSet) Stop() {
+	state := w.state
+	if state == nil {
+		return
+	}
+	state.StopWatch(w.tables, w.notifyCh)
+	for _, prefix := range w.kvPrefixes {
+		state.StopWatchKV(prefix, w.notifyCh)
+	}
+	for _, pattern := range w.kvPatterns {
+		state.StopWatchKVPattern(pattern, w.notifyCh)
+	}
+	w.state = nil
+}
+
+// Wait is used to block until any watch of the set fires, the store the
+// set is armed on is abandoned, or the timeout channel fires. In the
+// first two cases, the set must be armed again before the next wait.
+func (w *WatchSet) Wait(timeoutCh <-chan time.Time) watchResult {
+	select {
+	case <-w.notifyCh:
+		return watchFired
+	case <-w.state.AbandonCh():
+		w.Stop()
+		return watchAbandoned
+	case <-timeoutCh:
+		return watchTimeout
+	}
+}
@@ -0,0 +1,123 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+func TestWatchSet(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	var ws WatchSet
+	if !ws.Empty() {
+		t.Fatalf("should be empty")
+	}
+	ws.AddTables(store.QueryTables("Nodes"))
+	ws.AddKVPrefix("foo/")
+	if ws.Empty() {
+		t.Fatalf("should not be empty")
+	}
+	if err := ws.Arm(store); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ws.Stop()
+
+	// Nothing has changed
+	if res := ws.Wait(time.After(10 * time.Millisecond)); res != watchTimeout {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// A change to the tables fires the set
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res := ws.Wait(time.After(time.Second)); res != watchFired {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// A change to the prefix fires the set once it is armed again
+	if err := ws.Arm(store); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &structs.DirEntry{Key: "foo/bar", Value: []byte("test")}
+	if err := store.KVSSet(2, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res := ws.Wait(time.After(time.Second)); res != watchFired {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// Changes outside the set do not fire it
+	if err := ws.Arm(store); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d = &structs.DirEntry{Key: "zip", Value: []byte("test")}
+	if err := store.KVSSet(3, d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res := ws.Wait(time.After(10 * time.Millisecond)); res != watchTimeout {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
+func TestWatchSet_Abandon(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	var ws WatchSet
+	ws.AddTables(store.QueryTables("Nodes"))
+	if err := ws.Arm(store); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ws.Stop()
+
+	store.Abandon()
+	if res := ws.Wait(time.After(time.Second)); res != watchAbandoned {
+		t.Fatalf("bad: %v", res)
+	}
+
+	// Arm against a new store, the old one no longer fires the set
+	store2, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store2.Close()
+	if err := ws.Arm(store2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res := ws.Wait(time.After(10 * time.Millisecond)); res != watchTimeout {
+		t.Fatalf("bad: %v", res)
+	}
+	if err := store2.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if res := ws.Wait(time.After(time.Second)); res != watchFired {
+		t.Fatalf("bad: %v", res)
+	}
+}
+
+func TestWatchSet_BadPattern(t *testing.T) {
+	store, err := testStateStore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+
+	var ws WatchSet
+	ws.AddKVPattern("foo/[")
+	if err := ws.Arm(store); err == nil {
+		t.Fatalf("should fail")
+	}
+}